@@ -0,0 +1,70 @@
+package irma
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/go-errors/errors"
+)
+
+// AttestationRequest is sent by a client to the /attestation endpoint of an IRMA server that is
+// configured to attest to attribute-based signatures. The server verifies the signature and starts
+// an issuance session, of which it returns the session pointer, of a credential containing the digest
+// of the signature and the date of its timestamp. With this credential the user can later show that
+// they signed a message on that date, without having to show the signature itself. As signatures are
+// not secret, the issuance session requires disclosure of the attributes disclosed in the signature,
+// with the same values, binding the attestation to the signer.
+type AttestationRequest struct {
+	Signature *SignedMessage `json:"signature"`
+}
+
+func (ar *AttestationRequest) Validate() error {
+	if ar.Signature == nil {
+		return errors.New("Attestation request contains no signature")
+	}
+	if ar.Signature.Timestamp == nil {
+		return errors.New("Only timestamped signatures can be attested")
+	}
+	return nil
+}
+
+// Digest returns the hex-encoded SHA-256 hash of the signature, by which attestations refer to it.
+// Archive timestamps added to the signature later do not change its digest. The hash is computed
+// over the canonical JSON serialization of the signature (see CanonicalJSON()).
+func (sm *SignedMessage) Digest() (string, error) {
+	return sm.digest(CanonicalJSON)
+}
+
+// LegacyDigest returns the digest of the signature as computed by earlier versions, over the JSON
+// serialization of encoding/json instead of the canonical one. Attestations issued by those
+// versions contain this digest.
+func (sm *SignedMessage) LegacyDigest() (string, error) {
+	return sm.digest(json.Marshal)
+}
+
+// MatchesDigest returns whether the digest, e.g. of an attestation, refers to the signature, i.e.
+// whether it equals either Digest() or LegacyDigest().
+func (sm *SignedMessage) MatchesDigest(digest string) (bool, error) {
+	for _, f := range []func() (string, error){sm.Digest, sm.LegacyDigest} {
+		d, err := f()
+		if err != nil {
+			return false, err
+		}
+		if d == digest {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (sm *SignedMessage) digest(marshal func(v interface{}) ([]byte, error)) (string, error) {
+	signature := *sm
+	signature.ArchiveTimestamps = nil
+	bts, err := marshal(signature)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(bts)
+	return hex.EncodeToString(hash[:]), nil
+}
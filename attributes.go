@@ -222,6 +222,15 @@ func (attr *MetadataAttribute) setSigningDate() {
 	attr.setField(signingDateField, shortToByte(int(time.Now().Unix()/ExpiryFactor)))
 }
 
+// coarsenSigningDate rounds the signing date down to a multiple of the specified amount of epochs.
+func (attr *MetadataAttribute) coarsenSigningDate(epochs int) {
+	if epochs <= 1 {
+		return
+	}
+	date := int(binary.BigEndian.Uint16(attr.field(signingDateField)[1:]))
+	attr.setField(signingDateField, shortToByte(date-date%epochs))
+}
+
 // KeyCounter return the public key counter of the metadata attribute
 func (attr *MetadataAttribute) KeyCounter() int {
 	return int(binary.BigEndian.Uint16(attr.field(keyCounterField)))
@@ -0,0 +1,160 @@
+package irma
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	gobig "math/big"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains the canonical JSON serialization of the structures over which hashes or
+// signatures are computed, such as session requests and disclosures, so that implementations in
+// other languages can reproduce these hashes and signatures. The encoding of Go depends on the order
+// of the fields in the structs, and escapes some characters differently than other encoders do.
+// CanonicalJSON() follows the JSON Canonicalization Scheme (RFC 8785), except for large integers:
+//  - no whitespace is emitted;
+//  - the members of objects are sorted by their names, compared as UTF-16 code units;
+//  - strings are emitted as UTF-8, escaping only '"', '\' and control characters, the latter using
+//    the short escapes \b, \t, \n, \f and \r where possible and \u00xx otherwise;
+//  - integers are emitted verbatim in decimal without exponent or leading zeros. This deviates from
+//    RFC 8785, which treats all numbers as float64: integers larger than 2^53, such as nonces, would
+//    then lose precision (and the structures would no longer be hashed as they were sent). Other
+//    implementations must therefore parse integers with arbitrary precision, e.g. as big integers,
+//    to reproduce the serialization. Other numbers are emitted in the shortest representation that
+//    parses to the same float64, which matches RFC 8785 for all but very large or small numbers.
+
+// CanonicalJSON returns the canonical JSON serialization of v, which is first serialized using
+// json.Marshal().
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return CanonicalizeJSON(bts)
+}
+
+// CanonicalizeJSON returns the canonical serialization of the JSON in bts.
+func CanonicalizeJSON(bts []byte) ([]byte, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(bts))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("Trailing data after JSON value")
+	}
+	var buf bytes.Buffer
+	if err := writeCanonicalJSON(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		return writeCanonicalNumber(buf, v)
+	case string:
+		writeCanonicalString(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return utf16Less(keys[i], keys[j]) })
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, key)
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return errors.Errorf("Unexpected JSON value of type %T", value)
+	}
+	return nil
+}
+
+func writeCanonicalNumber(buf *bytes.Buffer, n json.Number) error {
+	if i, ok := new(gobig.Int).SetString(string(n), 10); ok {
+		buf.WriteString(i.String())
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1e21 {
+		buf.WriteString(strconv.FormatFloat(f, 'f', -1, 64))
+		return nil
+	}
+	buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	return nil
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// utf16Less compares the strings as sequences of UTF-16 code units.
+func utf16Less(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
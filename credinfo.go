@@ -2,10 +2,13 @@ package irma
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/privacybydesign/gabi/big"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
 )
 
 // CredentialInfo contains all information of an IRMA credential.
@@ -17,6 +20,45 @@ type CredentialInfo struct {
 	Expires         Timestamp                                    // Unix timestamp
 	Attributes      map[AttributeTypeIdentifier]TranslatedString // Human-readable rendered attributes
 	Hash            string                                       // SHA256 hash over the attributes
+
+	// The attributes in the order in which they should be shown, along with the display metadata
+	// of their attribute types from the scheme
+	DisplayAttributes []*DisplayAttribute
+
+	// How often the credential type has been disclosed, if tracked by the client
+	Usage *CredentialUsage
+
+	// The credentials from which attributes were disclosed when this credential was issued, if any
+	Provenance *CredentialProvenance `json:",omitempty"`
+}
+
+// CredentialProvenance links credentials to the credentials of which attributes were disclosed in
+// the session in which they were issued, e.g. a diploma issued after disclosing a passport.
+type CredentialProvenance struct {
+	Time      Timestamp
+	Requestor TranslatedString `json:",omitempty"` // name of the requestor of the issuance session
+	Sources   []*CredentialReference
+}
+
+// CredentialReference refers to a credential, which need not be present anymore.
+type CredentialReference struct {
+	CredentialType CredentialTypeIdentifier
+	Hash           string
+}
+
+// CredentialUsage contains how often credentials of a credential type have been disclosed.
+type CredentialUsage struct {
+	Disclosures   int
+	LastDisclosed Timestamp // zero if never disclosed
+}
+
+// DisplayAttribute is an attribute of a CredentialInfo along with its display metadata.
+type DisplayAttribute struct {
+	Type  AttributeTypeIdentifier
+	Value TranslatedString
+	// Display group of the attribute (see CredentialType.DisplayGroups), nil if none
+	Group     *DisplayGroup
+	Important bool
 }
 
 // A CredentialInfoList is a list of credentials (implements sort.Interface).
@@ -30,6 +72,18 @@ func NewCredentialInfo(ints []*big.Int, conf *Configuration) *CredentialInfo {
 	}
 
 	attrs := NewAttributeListFromInts(ints, conf)
+	values := attrs.Map(conf)
+	display := make([]*DisplayAttribute, 0, len(credtype.AttributeTypes))
+	for _, attrtype := range credtype.DisplayOrder() {
+		attrid := attrtype.GetAttributeTypeIdentifier()
+		display = append(display, &DisplayAttribute{
+			Type:      attrid,
+			Value:     values[attrid],
+			Group:     credtype.DisplayGroup(attrtype.DisplayGroup),
+			Important: attrtype.Important,
+		})
+	}
+
 	id := credtype.Identifier()
 	issid := id.IssuerIdentifier()
 	return &CredentialInfo{
@@ -38,13 +92,20 @@ func NewCredentialInfo(ints []*big.Int, conf *Configuration) *CredentialInfo {
 		SchemeManagerID: issid.SchemeManagerIdentifier().Name(),
 		SignedOn:        Timestamp(meta.SigningDate()),
 		Expires:         Timestamp(meta.Expiry()),
-		Attributes:      attrs.Map(conf),
+		Attributes:      values,
 		Hash:            attrs.Hash(),
+
+		DisplayAttributes: display,
 	}
 }
 
 func (ci CredentialInfo) GetCredentialType(conf *Configuration) *CredentialType {
-	return conf.CredentialTypes[NewCredentialTypeIdentifier(fmt.Sprintf("%s.%s.%s", ci.SchemeManagerID, ci.IssuerID, ci.ID))]
+	return conf.CredentialTypes[ci.Identifier()]
+}
+
+// Identifier returns the identifier of the credential type of the credential.
+func (ci CredentialInfo) Identifier() CredentialTypeIdentifier {
+	return NewCredentialTypeIdentifier(fmt.Sprintf("%s.%s.%s", ci.SchemeManagerID, ci.IssuerID, ci.ID))
 }
 
 // Returns true if credential is expired at moment of calling this function
@@ -62,8 +123,58 @@ func (cl CredentialInfoList) Swap(i, j int) {
 	cl[i], cl[j] = cl[j], cl[i]
 }
 
-// Less implements sort.Interface.
+// Less implements sort.Interface, ordering credentials by the identifiers of their scheme, issuer
+// and credential type, and then by issuance time (newest first). See also SortLocalized().
 func (cl CredentialInfoList) Less(i, j int) bool {
-	// TODO Decide on sorting, and if it depends on a irmago.TranslatedString, allow language choosing
-	return strings.Compare(cl[i].ID, cl[j].ID) > 0
+	return compareCredentialInfo(cl[i], cl[j]) < 0
+}
+
+// SortLocalized sorts the credentials by the names of their scheme, issuer and credential type in the
+// specified language, collated according to the rules of that language, and then as Less() does.
+func (cl CredentialInfoList) SortLocalized(conf *Configuration, lang string) {
+	collator := collate.New(language.Make(lang))
+	names := make(map[*CredentialInfo][3]string, len(cl))
+	for _, info := range cl {
+		var n [3]string
+		if scheme := conf.SchemeManagers[NewSchemeManagerIdentifier(info.SchemeManagerID)]; scheme != nil {
+			n[0] = scheme.Name.translation(lang)
+		}
+		if issuer := conf.Issuers[NewIssuerIdentifier(info.SchemeManagerID+"."+info.IssuerID)]; issuer != nil {
+			n[1] = issuer.Name.translation(lang)
+		}
+		if credtype := info.GetCredentialType(conf); credtype != nil {
+			n[2] = credtype.Name.translation(lang)
+		}
+		names[info] = n
+	}
+	sort.SliceStable(cl, func(i, j int) bool {
+		ni, nj := names[cl[i]], names[cl[j]]
+		for k := range ni {
+			if c := collator.CompareString(ni[k], nj[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return compareCredentialInfo(cl[i], cl[j]) < 0
+	})
+}
+
+// compareCredentialInfo orders credentials by scheme, issuer and credential type identifier,
+// then by issuance time (newest first), and finally by hash so that the order is deterministic.
+func compareCredentialInfo(a, b *CredentialInfo) int {
+	for _, c := range []int{
+		strings.Compare(a.SchemeManagerID, b.SchemeManagerID),
+		strings.Compare(a.IssuerID, b.IssuerID),
+		strings.Compare(a.ID, b.ID),
+	} {
+		if c != 0 {
+			return c
+		}
+	}
+	if ta, tb := time.Time(a.SignedOn), time.Time(b.SignedOn); !ta.Equal(tb) {
+		if ta.After(tb) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.Hash, b.Hash)
 }
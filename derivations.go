@@ -0,0 +1,132 @@
+package irma
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains derived attributes: attributes whose value is computed from another attribute
+// of the same credential type, as declared by the scheme, e.g.
+//   <Attribute id="over18" derivedFrom="dateofbirth" derivation="ageAtLeast:18">
+// When issuing, the IRMA server computes derived attributes from the attributes supplied by the
+// requestor (see CredentialRequest.DeriveAttributes()), so that they are always consistent with
+// them. Requestors may omit derived attributes; if they do supply them, they must be correct.
+//
+// A derivation consists of the name of a function in AttributeDerivations, optionally followed by
+// a colon and a parameter for the function.
+
+// AttributeDerivation computes the value of a derived attribute from the value of the attribute
+// it is derived from. The parameter is the part of the derivation after the colon, if any.
+type AttributeDerivation func(value, param string) (string, error)
+
+// AttributeDerivations contains the derivations that schemes can use for derived attributes.
+var AttributeDerivations = map[string]AttributeDerivation{
+	// Whether a date (e.g. of birth) lies at least the specified amount of years in the past, "Yes" or "No"
+	"ageAtLeast": deriveAgeAtLeast,
+	// The year of a date
+	"year": deriveYear,
+}
+
+// Layouts of dates accepted by derivations
+var derivationDateLayouts = []string{"02-01-2006", "2006-01-02"}
+
+func parseDerivationDate(value string) (time.Time, error) {
+	for _, layout := range derivationDateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid date %s", value)
+}
+
+func deriveAgeAtLeast(value, param string) (string, error) {
+	years, err := strconv.Atoi(param)
+	if err != nil || years < 0 {
+		return "", errors.Errorf("invalid age %s", param)
+	}
+	date, err := parseDerivationDate(value)
+	if err != nil {
+		return "", err
+	}
+	if date.AddDate(years, 0, 0).After(time.Now()) {
+		return "No", nil
+	}
+	return "Yes", nil
+}
+
+func deriveYear(value, _ string) (string, error) {
+	date, err := parseDerivationDate(value)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(date.Year()), nil
+}
+
+// IsDerived returns whether the attribute is computed from another attribute.
+func (ad AttributeType) IsDerived() bool {
+	return ad.DerivedFrom != ""
+}
+
+// derivation returns the derivation function and its parameter.
+func (ad AttributeType) derivation() (AttributeDerivation, string, error) {
+	parts := strings.SplitN(ad.Derivation, ":", 2)
+	f, ok := AttributeDerivations[parts[0]]
+	if !ok {
+		return nil, "", errors.Errorf("unknown derivation %s", parts[0])
+	}
+	if len(parts) == 1 {
+		return f, "", nil
+	}
+	return f, parts[1], nil
+}
+
+// Derive computes the value of the derived attribute from the attributes of a credential.
+// It returns false if the attribute it is derived from is absent.
+func (ad AttributeType) Derive(attributes map[string]string) (string, bool, error) {
+	value, present := attributes[ad.DerivedFrom]
+	if !present {
+		return "", false, nil
+	}
+	f, param, err := ad.derivation()
+	if err != nil {
+		return "", false, err
+	}
+	derived, err := f(value, param)
+	if err != nil {
+		return "", false, errors.WrapPrefix(err, "Failed to derive attribute "+ad.ID, 0)
+	}
+	return derived, true, nil
+}
+
+// DeriveAttributes computes the derived attributes of the credential request, checking that
+// derived attributes supplied by the requestor are correct.
+func (cr *CredentialRequest) DeriveAttributes(conf *Configuration) error {
+	credtype := conf.CredentialTypes[cr.CredentialTypeID]
+	if credtype == nil {
+		return errors.New("Credential request of unknown credential type")
+	}
+	for _, attrtype := range credtype.AttributeTypes {
+		if !attrtype.IsDerived() {
+			continue
+		}
+		derived, ok, err := attrtype.Derive(cr.Attributes)
+		if err != nil {
+			return err
+		}
+		supplied, present := cr.Attributes[attrtype.ID]
+		if !ok {
+			if present {
+				return errors.Errorf("Derived attribute %s present without %s", attrtype.ID, attrtype.DerivedFrom)
+			}
+			continue
+		}
+		if present && supplied != derived {
+			return errors.Errorf("Derived attribute %s is inconsistent with %s", attrtype.ID, attrtype.DerivedFrom)
+		}
+		cr.Attributes[attrtype.ID] = derived
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package irma
 import (
 	"encoding/xml"
 	"fmt"
+	"sort"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/internal/fs"
@@ -25,12 +26,39 @@ type SchemeManager struct {
 	XMLVersion        int      `xml:"version,attr"`
 	XMLName           xml.Name `xml:"SchemeManager"`
 
+	// Hosts that may be contacted over plain HTTP instead of HTTPS for this scheme, its keyshare server
+	// and sessions of requestors in its requestor registry, for development
+	InsecureHosts []string `xml:"InsecureHosts>Host"`
+
+	// Messages for the user by which clients translate the names of errors returned by the servers
+	// of this scheme (see Configuration.RemoteErrorMessage()), for example:
+	// <ErrorMessages><Message key="SESSION_UNKNOWN"><en>...</en><nl>...</nl></Message></ErrorMessages>
+	ErrorMessages []*ErrorMessage `xml:"ErrorMessages>Message" json:",omitempty"`
+
 	Status SchemeManagerStatus `xml:"-"`
 	Valid  bool                `xml:"-"` // true iff Status == SchemeManagerStatusValid
 
 	Timestamp Timestamp
 
 	index SchemeManagerIndex
+	// Whether the scheme was parsed without verifying its signature, see ParseUnsignedSchemeManagerFolder()
+	unsigned bool
+}
+
+// ErrorMessage is the message for the user of the errors whose ErrorName is the specified key.
+type ErrorMessage struct {
+	Key     string `xml:"key,attr"`
+	Message TranslatedString
+}
+
+// UnmarshalXML unmarshals the translations of the message along with its key.
+func (em *ErrorMessage) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "key" {
+			em.Key = attr.Value
+		}
+	}
+	return em.Message.UnmarshalXML(d, start)
 }
 
 type SchemeAppVersion struct {
@@ -65,9 +93,22 @@ type CredentialType struct {
 	XMLName         xml.Name         `xml:"IssueSpecification"`
 	IssueURL        TranslatedString `xml:"IssueURL"`
 
+	// Maximum amount of instances of this (non-singleton) credential type that a client may hold
+	// simultaneously; 0 means unlimited
+	MaxInstances int `xml:"MaxInstances" json:",omitempty"`
+
+	// Groups in which the attributes should be shown, in display order (see AttributeType.DisplayGroup)
+	DisplayGroups []*DisplayGroup `xml:"DisplayGroups>Group" json:",omitempty"`
+
 	Valid bool `xml:"-"`
 }
 
+// DisplayGroup is a group of attributes of a credential type that should be shown together.
+type DisplayGroup struct {
+	ID   string `xml:"id,attr"`
+	Name TranslatedString
+}
+
 // AttributeType is a description of an attribute within a credential type.
 type AttributeType struct {
 	ID          string `xml:"id,attr"`
@@ -77,6 +118,17 @@ type AttributeType struct {
 
 	Index        int  `xml:"-"`
 	DisplayIndex *int `xml:"displayIndex,attr" json:",omitempty"`
+	// ID of the DisplayGroup of the credential type in which the attribute should be shown, if any
+	DisplayGroup string `xml:"displayGroup,attr" json:",omitempty"`
+	// Whether the attribute should be shown prominently, e.g. in overviews of credentials
+	Important bool `xml:"important,attr" json:",omitempty"`
+	// Whether the attribute belongs to a sensitive category (e.g. a national identification number
+	// or health data), which clients avoid disclosing when other options are available
+	Sensitive bool `xml:"sensitive,attr" json:",omitempty"`
+	// If set, the attribute is computed from the attribute with this ID of the credential type
+	// using the derivation, see derivations.go
+	DerivedFrom string `xml:"derivedFrom,attr" json:",omitempty"`
+	Derivation  string `xml:"derivation,attr" json:",omitempty"`
 
 	// Taken from containing CredentialType
 	CredentialTypeID string `xml:"-"`
@@ -92,6 +144,34 @@ func (ad AttributeType) IsOptional() bool {
 	return ad.Optional == "true"
 }
 
+// DisplayOrder returns the attribute types of this credential type in the order in which they
+// should be shown: by their displayIndex if present, and otherwise in the order of the XML.
+func (ct *CredentialType) DisplayOrder() []*AttributeType {
+	attrs := make([]*AttributeType, len(ct.AttributeTypes))
+	copy(attrs, ct.AttributeTypes)
+	sort.SliceStable(attrs, func(i, j int) bool {
+		return attrs[i].displayIndex(i) < attrs[j].displayIndex(j)
+	})
+	return attrs
+}
+
+// DisplayGroup returns the display group with the specified ID, or nil if it does not exist.
+func (ct *CredentialType) DisplayGroup(id string) *DisplayGroup {
+	for _, group := range ct.DisplayGroups {
+		if group.ID == id {
+			return group
+		}
+	}
+	return nil
+}
+
+func (ad AttributeType) displayIndex(index int) int {
+	if ad.DisplayIndex != nil {
+		return *ad.DisplayIndex
+	}
+	return index
+}
+
 // ContainsAttribute tests whether the specified attribute is contained in this
 // credentialtype.
 func (ct *CredentialType) ContainsAttribute(ai AttributeTypeIdentifier) bool {
@@ -131,6 +211,12 @@ func (ct CredentialType) AttributeType(ai AttributeTypeIdentifier) *AttributeTyp
 // TranslatedString is a map of translated strings.
 type TranslatedString map[string]string
 
+// translation returns the translation in the specified language, falling back to other languages
+// as Translate() does.
+func (ts TranslatedString) translation(lang string) string {
+	return ts.Translate(lang).Text
+}
+
 type xmlTranslation struct {
 	XMLName xml.Name
 	Text    string `xml:",chardata"`
@@ -209,6 +295,12 @@ func (sm *SchemeManager) Identifier() SchemeManagerIdentifier {
 	return NewSchemeManagerIdentifier(sm.ID)
 }
 
+// CheckURL checks that the URL, which must be the URL of this scheme or of its keyshare server,
+// uses HTTPS, unless its host is a loopback host or listed among the InsecureHosts of this scheme.
+func (sm *SchemeManager) CheckURL(url string) error {
+	return checkURL(url, sm)
+}
+
 // Distributed indicates if this scheme manager uses a keyshare server.
 func (sm *SchemeManager) Distributed() bool {
 	return len(sm.KeyshareServer) > 0
@@ -5,14 +5,21 @@
 package servercore
 
 import (
+	"crypto/ecdsa"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
 	"github.com/jasonlvhit/gocron"
 	"github.com/privacybydesign/gabi"
@@ -25,9 +32,22 @@ import (
 
 type Server struct {
 	conf          *server.Configuration
+	confLock      sync.RWMutex // guards conf, which is replaced by Reload()
 	sessions      sessionStore
 	scheduler     *gocron.Scheduler
 	stopScheduler chan bool
+	validators    map[irma.AttributeTypeIdentifier][]server.AttributeValidator
+
+	// Key with which session requests are signed, if configured, and its public key as included in QRs
+	requestKey       *ecdsa.PrivateKey
+	requestPublicKey string
+
+	// Set when the server is shutting down, after which no new sessions are accepted
+	draining     bool
+	drainingLock sync.RWMutex
+
+	// Sensitive attributes for which a MinimizationUnrestricted warning was logged, see checkMinimization()
+	minimizationLogged sync.Map
 }
 
 func New(conf *server.Configuration) (*Server, error) {
@@ -45,12 +65,23 @@ func New(conf *server.Configuration) (*Server, error) {
 	})
 	s.stopScheduler = s.scheduler.Start()
 
-	return s, s.verifyConfiguration(s.conf)
+	span := irma.StartSpan("irmaserver.New")
+	err := s.verifyConfiguration(s.conf)
+	span.End(err)
+	return s, err
 }
 
 func (s *Server) Stop() {
 	s.stopScheduler <- true
 	s.sessions.stop()
+	// Let audit sinks write or send any pending audit events
+	for _, sink := range s.config().AuditSinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				_ = server.LogError(err)
+			}
+		}
+	}
 }
 
 func (s *Server) verifyConfiguration(configuration *server.Configuration) error {
@@ -101,41 +132,50 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 		s.conf.IrmaConfiguration.AutoUpdateSchemes(uint(s.conf.SchemesUpdateInterval))
 	}
 
-	if s.conf.IssuerPrivateKeys == nil {
-		s.conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]*gabi.PrivateKey)
+	if s.conf.ProofVerificationWorkers == 0 {
+		s.conf.ProofVerificationWorkers = runtime.NumCPU()
 	}
-	if s.conf.IssuerPrivateKeysPath != "" {
-		files, err := ioutil.ReadDir(s.conf.IssuerPrivateKeysPath)
-		if err != nil {
-			return server.LogError(err)
+	if s.conf.ProofVerificationWorkers > 1 {
+		s.conf.IrmaConfiguration.ProofVerificationPool = irma.NewProofVerificationPool(s.conf.ProofVerificationWorkers)
+	}
+
+	if s.conf.ReplayStore == nil {
+		s.conf.ReplayStore = server.NewMemoryReplayStore()
+	}
+
+	switch s.conf.MinimizationPolicy {
+	case "":
+		s.conf.MinimizationPolicy = server.MinimizationWarn
+	case server.MinimizationWarn, server.MinimizationReject, server.MinimizationOff:
+	default:
+		return server.LogError(errors.Errorf("Unknown minimization_policy %s", s.conf.MinimizationPolicy))
+	}
+
+	if err := s.combineIssuerPrivateKeyShares(); err != nil {
+		return err
+	}
+	if err := s.loadIssuerKeyBackends(); err != nil {
+		return err
+	}
+	if err := loadIssuerPrivateKeys(s.conf); err != nil {
+		return err
+	}
+	if err := s.loadRequestKey(); err != nil {
+		return err
+	}
+
+	s.validators = make(map[irma.AttributeTypeIdentifier][]server.AttributeValidator)
+	for id, confs := range s.conf.AttributeValidators {
+		attrid := irma.NewAttributeTypeIdentifier(id)
+		if _, ok := s.conf.IrmaConfiguration.AttributeTypes[attrid]; !ok {
+			return server.LogError(errors.Errorf("Attribute validator configured for unknown attribute %s", id))
 		}
-		for _, file := range files {
-			filename := file.Name()
-			if filepath.Ext(filename) != ".xml" || filename[0] == '.' || strings.Count(filename, ".") != 2 {
-				s.conf.Logger.WithField("file", filename).Infof("Skipping non-private key file encountered in private keys path")
-				continue
-			}
-			issid := irma.NewIssuerIdentifier(strings.TrimSuffix(filename, filepath.Ext(filename))) // strip .xml
-			if _, ok := s.conf.IrmaConfiguration.Issuers[issid]; !ok {
-				return server.LogError(errors.Errorf("Private key %s belongs to an unknown issuer", filename))
-			}
-			sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(s.conf.IssuerPrivateKeysPath, filename))
+		for _, c := range confs {
+			validator, err := server.NewAttributeValidator(c)
 			if err != nil {
 				return server.LogError(err)
 			}
-			s.conf.IssuerPrivateKeys[issid] = sk
-		}
-	}
-	for issid, sk := range s.conf.IssuerPrivateKeys {
-		pk, err := s.conf.IrmaConfiguration.PublicKey(issid, int(sk.Counter))
-		if err != nil {
-			return server.LogError(err)
-		}
-		if pk == nil {
-			return server.LogError(errors.Errorf("Missing public key belonging to private key %s-%d", issid.String(), sk.Counter))
-		}
-		if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
-			return server.LogError(errors.Errorf("Private key %s-%d does not belong to corresponding public key", issid.String(), sk.Counter))
+			s.validators[attrid] = append(s.validators[attrid], validator)
 		}
 	}
 
@@ -171,7 +211,268 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 	return nil
 }
 
+func (s *Server) loadRequestKey() error {
+	if s.conf.SessionRequestPrivateKey == "" && s.conf.SessionRequestPrivateKeyFile == "" {
+		return nil
+	}
+	keybytes, err := fs.ReadKey(s.conf.SessionRequestPrivateKey, s.conf.SessionRequestPrivateKeyFile)
+	if err != nil {
+		return server.LogError(errors.WrapPrefix(err, "failed to read session request private key", 0))
+	}
+	if s.requestKey, err = jwt.ParseECPrivateKeyFromPEM(keybytes); err != nil {
+		return server.LogError(errors.WrapPrefix(err, "failed to parse session request private key", 0))
+	}
+	if s.requestPublicKey, err = irma.MarshalRequestKey(&s.requestKey.PublicKey); err != nil {
+		return server.LogError(err)
+	}
+	s.conf.Logger.Info("Signing session requests")
+	return nil
+}
+
+// combineIssuerPrivateKeyShares reassembles in memory the issuer private keys of which shares
+// are configured, adding them to the issuer private keys.
+func (s *Server) combineIssuerPrivateKeyShares() error {
+	shares := append([]*server.PrivateKeyShare{}, s.conf.IssuerPrivateKeyShares...)
+	for _, filename := range s.conf.IssuerPrivateKeyShareFiles {
+		share, err := server.ReadPrivateKeyShare(filename)
+		if err != nil {
+			return server.LogError(err)
+		}
+		shares = append(shares, share)
+	}
+	if len(shares) == 0 {
+		return nil
+	}
+
+	type keyID struct {
+		issuer  irma.IssuerIdentifier
+		counter uint
+	}
+	keyShares := map[keyID][]*server.PrivateKeyShare{}
+	for _, share := range shares {
+		id := keyID{share.Issuer, share.Counter}
+		keyShares[id] = append(keyShares[id], share)
+	}
+	for id, shares := range keyShares {
+		if _, ok := s.conf.IrmaConfiguration.Issuers[id.issuer]; !ok {
+			return server.LogError(errors.Errorf("Private key shares of %s-%d belong to an unknown issuer", id.issuer, id.counter))
+		}
+		_, sk, err := server.CombinePrivateKeyShares(shares)
+		if err != nil {
+			return server.LogError(err)
+		}
+		s.addIssuerPrivateKey(id.issuer, sk)
+		s.conf.Logger.WithField("issuer", id.issuer.String()).Infof("Reassembled private key %d from %d shares", id.counter, len(shares))
+	}
+	return nil
+}
+
+// loadIssuerKeyBackends adds the issuer private keys of the configured key backends
+// to the issuer private keys.
+func (s *Server) loadIssuerKeyBackends() error {
+	for _, backend := range s.conf.IssuerKeyBackends {
+		keys, err := backend.PrivateKeys()
+		if err != nil {
+			return server.LogError(err)
+		}
+		for issid, sk := range keys {
+			if _, ok := s.conf.IrmaConfiguration.Issuers[issid]; !ok {
+				return server.LogError(errors.Errorf("Private key %s-%d belongs to an unknown issuer", issid, sk.Counter))
+			}
+			s.addIssuerPrivateKey(issid, sk)
+			s.conf.Logger.WithField("issuer", issid.String()).Infof("Loaded private key %d from key backend", sk.Counter)
+		}
+	}
+	return nil
+}
+
+// addIssuerPrivateKey adds the private key to the issuer private keys,
+// unless a private key of the issuer with a higher counter is present.
+func (s *Server) addIssuerPrivateKey(issid irma.IssuerIdentifier, sk *gabi.PrivateKey) {
+	if s.conf.IssuerPrivateKeys == nil {
+		s.conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]*gabi.PrivateKey)
+	}
+	if existing := s.conf.IssuerPrivateKeys[issid]; existing == nil || existing.Counter < sk.Counter {
+		s.conf.IssuerPrivateKeys[issid] = sk
+	}
+}
+
+// loadIssuerPrivateKeys loads the issuer private keys from IssuerPrivateKeysPath, if set, into the
+// issuer private keys of the configuration, and checks them against the public keys in its schemes.
+func loadIssuerPrivateKeys(conf *server.Configuration) error {
+	if conf.IssuerPrivateKeys == nil {
+		conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]*gabi.PrivateKey)
+	}
+	if conf.IssuerPrivateKeysPath != "" {
+		files, err := ioutil.ReadDir(conf.IssuerPrivateKeysPath)
+		if err != nil {
+			return server.LogError(err)
+		}
+		for _, file := range files {
+			filename := file.Name()
+			if filepath.Ext(filename) != ".xml" || filename[0] == '.' || strings.Count(filename, ".") != 2 {
+				conf.Logger.WithField("file", filename).Infof("Skipping non-private key file encountered in private keys path")
+				continue
+			}
+			issid := irma.NewIssuerIdentifier(strings.TrimSuffix(filename, filepath.Ext(filename))) // strip .xml
+			if _, ok := conf.IrmaConfiguration.Issuers[issid]; !ok {
+				return server.LogError(errors.Errorf("Private key %s belongs to an unknown issuer", filename))
+			}
+			sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(conf.IssuerPrivateKeysPath, filename))
+			if err != nil {
+				return server.LogError(err)
+			}
+			conf.IssuerPrivateKeys[issid] = sk
+		}
+	}
+	for issid, sk := range conf.IssuerPrivateKeys {
+		pk, err := conf.IrmaConfiguration.PublicKey(issid, int(sk.Counter))
+		if err != nil {
+			return server.LogError(err)
+		}
+		if pk == nil {
+			return server.LogError(errors.Errorf("Missing public key belonging to private key %s-%d", issid.String(), sk.Counter))
+		}
+		if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
+			return server.LogError(errors.Errorf("Private key %s-%d does not belong to corresponding public key", issid.String(), sk.Counter))
+		}
+	}
+	return nil
+}
+
+// Reload re-parses the IRMA schemes from disk and reloads the issuer private keys from
+// IssuerPrivateKeysPath, if set. The schemes and keys are loaded into a copy of the configuration,
+// which replaces the current one only if loading succeeded. Sessions that are in progress keep
+// using the configuration with which they were started.
+func (s *Server) Reload() error {
+	conf := s.config()
+	conf.Logger.Info("Reloading schemes and private keys")
+	irmaconf, err := conf.IrmaConfiguration.Reparse()
+	if err != nil {
+		return server.LogError(err)
+	}
+	reloaded := *conf
+	reloaded.IrmaConfiguration = irmaconf
+	reloaded.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]*gabi.PrivateKey, len(conf.IssuerPrivateKeys))
+	for issid, sk := range conf.IssuerPrivateKeys {
+		reloaded.IssuerPrivateKeys[issid] = sk
+	}
+	if err = loadIssuerPrivateKeys(&reloaded); err != nil {
+		return err
+	}
+
+	if !conf.DisableSchemesUpdate {
+		conf.IrmaConfiguration.StopAutoUpdateSchemes()
+		irmaconf.AutoUpdateSchemes(uint(conf.SchemesUpdateInterval))
+	}
+	s.confLock.Lock()
+	s.conf = &reloaded
+	s.confLock.Unlock()
+	return nil
+}
+
+// config returns the current configuration, see Reload().
+func (s *Server) config() *server.Configuration {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.conf
+}
+
+// IrmaConfiguration returns the current IRMA configuration, see Reload().
+func (s *Server) IrmaConfiguration() *irma.Configuration {
+	return s.config().IrmaConfiguration
+}
+
+// Drain stops the server from accepting new sessions, and then waits until either all
+// sessions currently in progress have finished or the timeout has passed. It returns the
+// amount of sessions that were still unfinished when it returned.
+func (s *Server) Drain(timeout time.Duration) int {
+	s.drainingLock.Lock()
+	s.draining = true
+	s.drainingLock.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		active := s.sessions.activeCount()
+		if active == 0 || !time.Now().Before(deadline) {
+			if active > 0 {
+				s.config().Logger.Warnf("Shutdown deadline passed with %d session(s) still in progress", active)
+			}
+			return active
+		}
+		s.config().Logger.Debugf("Waiting for %d session(s) to finish", active)
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// Draining returns whether the server is shutting down and refuses new sessions.
+func (s *Server) Draining() bool {
+	s.drainingLock.RLock()
+	defer s.drainingLock.RUnlock()
+	return s.draining
+}
+
+// Readiness checks if the server is able to handle sessions: if the schemes have been parsed
+// without errors, if the session store is reachable, and if the public keys of all issuer
+// private keys are present.
+func (s *Server) Readiness() *server.Readiness {
+	checks := map[string]string{}
+
+	conf := s.config()
+	irmaconf := conf.IrmaConfiguration
+	switch {
+	case len(irmaconf.SchemeManagers) == 0:
+		checks["schemes"] = "no schemes loaded"
+	case len(irmaconf.DisabledSchemeManagers) > 0:
+		disabled := make([]string, 0, len(irmaconf.DisabledSchemeManagers))
+		for id := range irmaconf.DisabledSchemeManagers {
+			disabled = append(disabled, id.String())
+		}
+		checks["schemes"] = "disabled schemes: " + strings.Join(disabled, ", ")
+	default:
+		checks["schemes"] = "ok"
+	}
+
+	if err := s.sessions.ping(); err != nil {
+		checks["sessions"] = err.Error()
+	} else {
+		checks["sessions"] = "ok"
+	}
+
+	checks["issuer_keys"] = "ok"
+	for issid, sk := range conf.IssuerPrivateKeys {
+		pk, err := irmaconf.PublicKey(issid, int(sk.Counter))
+		if err != nil || pk == nil {
+			checks["issuer_keys"] = fmt.Sprintf("missing public key belonging to private key %s-%d", issid.String(), sk.Counter)
+			break
+		}
+	}
+
+	if s.Draining() {
+		checks["shutdown"] = "shutting down"
+	} else {
+		checks["shutdown"] = "ok"
+	}
+
+	ready := true
+	for _, result := range checks {
+		if result != "ok" {
+			ready = false
+		}
+	}
+	return &server.Readiness{Ready: ready, Checks: checks}
+}
+
 func (s *Server) StartSession(req interface{}) (*irma.Qr, string, error) {
+	if s.Draining() {
+		return nil, "", server.LogWarning(errors.New("Server is shutting down, not accepting new sessions"))
+	}
+
+	conf := s.config()
+	span := irma.StartSpan("irmaserver.StartSession")
+	var err error
+	defer func() { span.End(err) }()
+
 	rrequest, err := server.ParseSessionRequest(req)
 	if err != nil {
 		return nil, "", err
@@ -179,54 +480,151 @@ func (s *Server) StartSession(req interface{}) (*irma.Qr, string, error) {
 
 	request := rrequest.SessionRequest()
 	action := request.Action()
+	span.SetAttribute("action", string(action))
 	if action == irma.ActionIssuing {
-		if err := s.validateIssuanceRequest(request.(*irma.IssuanceRequest)); err != nil {
+		if err = s.validateIssuanceRequest(conf, request.(*irma.IssuanceRequest)); err != nil {
 			return nil, "", err
 		}
 	}
+	warnings, err := s.checkMinimization(conf, request)
+	if err != nil {
+		return nil, "", err
+	}
+	if max := rrequest.Base().MaxCompletions; max < 0 || (max > 1 && action != irma.ActionIssuing) {
+		err = server.LogWarning(errors.New("maxCompletions must be positive, and is only supported in issuance sessions"))
+		return nil, "", err
+	}
 
-	session := s.newSession(action, rrequest)
-	s.conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.token}).Infof("Session started")
-	if s.conf.Logger.IsLevelEnabled(logrus.DebugLevel) {
-		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request: ", server.ToJson(rrequest))
+	session, err := s.newSession(conf, action, rrequest)
+	if err != nil {
+		return nil, "", err
+	}
+	session.minimizationWarnings = warnings
+	conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.token}).Infof("Session started")
+	if conf.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request: ", server.ToJson(rrequest))
 	} else {
-		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
+		conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
 	}
-	return &irma.Qr{
-		Type: action,
-		URL:  s.conf.URL + session.clientToken,
-	}, session.token, nil
+	s.auditCreated(session)
+	qr := &irma.Qr{
+		Type:       action,
+		URL:        conf.URL + session.clientToken,
+		RequestKey: s.requestPublicKey,
+	}
+	// Long server URLs may make the QR too dense to be scanned
+	if _, err := irma.CheckQrSize(qr, irma.QrLevelL); err != nil {
+		conf.Logger.WithFields(logrus.Fields{"session": session.token}).Warn(err.Error())
+	}
+	return qr, session.token, nil
+}
+
+func (s *Server) auditCreated(session *session) {
+	event := &server.AuditEvent{
+		Type:    server.AuditSessionCreated,
+		Session: session.token,
+		Action:  session.action,
+	}
+	for _, disjunction := range session.request.ToDisclose() {
+		event.Attributes = append(event.Attributes, disjunction.Attributes...)
+	}
+	if isreq, ok := session.request.(*irma.IssuanceRequest); ok {
+		for _, cred := range isreq.Credentials {
+			event.Credentials = append(event.Credentials, cred.CredentialTypeID)
+		}
+	}
+	session.conf.Audit(event)
 }
 
 func (s *Server) GetSessionResult(token string) *server.SessionResult {
+	conf := s.config()
 	session := s.sessions.get(token)
 	if session == nil {
-		s.conf.Logger.Warn("Session result requested of unknown session ", token)
+		conf.Logger.Warn("Session result requested of unknown session ", token)
 		return nil
 	}
+	conf.Audit(&server.AuditEvent{
+		Type:    server.AuditResultFetched,
+		Session: session.token,
+		Action:  session.action,
+		Status:  session.result.Status,
+	})
 	return session.result
 }
 
 func (s *Server) GetRequest(token string) irma.RequestorRequest {
 	session := s.sessions.get(token)
 	if session == nil {
-		s.conf.Logger.Warn("Session request requested of unknown session ", token)
+		s.config().Logger.Warn("Session request requested of unknown session ", token)
 		return nil
 	}
 	return session.rrequest
 }
 
+// GetMinimizationWarnings returns the data minimization warnings of the request of the specified
+// session, see server.CheckMinimization().
+func (s *Server) GetMinimizationWarnings(token string) []*server.MinimizationWarning {
+	session := s.sessions.get(token)
+	if session == nil {
+		return nil
+	}
+	return session.minimizationWarnings
+}
+
+// GetIssuanceResults returns, for each client that completed the specified issuance session (i.e. one
+// client, except in group issuance sessions), whether or not it could construct each of the issued
+// credentials, as reported by the client (protocol version 2.6 and up) after the session is done;
+// the entry of a client that did not report it is nil.
+func (s *Server) GetIssuanceResults(token string) ([][]*irma.CredentialIssuanceResult, error) {
+	session := s.sessions.get(token)
+	if session == nil {
+		return nil, server.LogError(errors.Errorf("can't get issuance results of unknown session %s", token))
+	}
+	session.Lock()
+	defer session.Unlock()
+	return append([][]*irma.CredentialIssuanceResult{}, session.issuanceResults...), nil
+}
+
+// GetConfirmationCode returns the confirmation code that the client sent when retrieving the
+// session request, for the app or website that started the session to show to the user; it is
+// empty if the client has not yet retrieved the request or did not send a code. The code is only
+// available to the requestor, as a client could otherwise learn the code without being shown it.
+func (s *Server) GetConfirmationCode(token string) (string, error) {
+	session := s.sessions.get(token)
+	if session == nil {
+		return "", server.LogError(errors.Errorf("can't get confirmation code of unknown session %s", token))
+	}
+	session.Lock()
+	defer session.Unlock()
+	return session.confirmationCode, nil
+}
+
 func (s *Server) CancelSession(token string) error {
 	session := s.sessions.get(token)
 	if session == nil {
 		return server.LogError(errors.Errorf("can't cancel unknown session %s", token))
 	}
+	session.Lock()
+	defer session.Unlock()
 	session.handleDelete()
 	return nil
 }
 
+// signedSessionRequest returns the session request as a JWT signed with the request key,
+// for clients that retrieve the session request with the SignedRequestHeader.
+func (s *Server) signedSessionRequest(session *session, token string, request irma.SessionRequest) (int, []byte) {
+	if s.requestKey == nil {
+		return server.JsonResponse(nil, session.fail(server.ErrorUnsupported, "session requests are not signed by this server"))
+	}
+	signed, err := irma.SignClientSessionRequest(request, token, s.requestKey)
+	if err != nil {
+		return server.JsonResponse(nil, session.fail(server.ErrorUnknown, err.Error()))
+	}
+	return http.StatusOK, []byte(signed)
+}
+
 func ParsePath(path string) (string, string, error) {
-	pattern := regexp.MustCompile("(\\w+)/?(|commitments|proofs|status|statusevents)$")
+	pattern := regexp.MustCompile("(\\w+)/?(|commitments|proofs|status|statusevents|issuanceresults|failure)$")
 	matches := pattern.FindStringSubmatch(path)
 	if len(matches) != 3 {
 		return "", "", server.LogWarning(errors.Errorf("Invalid URL: %s", path))
@@ -235,7 +633,7 @@ func ParsePath(path string) (string, string, error) {
 }
 
 func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
-	if !s.conf.EnableSSE {
+	if !s.config().EnableSSE {
 		return errors.New("Server sent events disabled")
 	}
 
@@ -286,31 +684,56 @@ func (s *Server) HandleProtocolMessage(
 		}
 	}
 
-	s.conf.Logger.WithFields(logrus.Fields{"method": method, "path": path}).Debugf("Routing protocol message")
+	logger := s.config().Logger
+	logger.WithFields(logrus.Fields{"method": method, "path": path}).Debugf("Routing protocol message")
 	if len(message) > 0 {
-		s.conf.Logger.Trace("POST body: ", string(message))
+		logger.Trace("POST body: ", string(message))
 	}
-	s.conf.Logger.Trace("HTTP headers: ", server.ToJson(headers))
+	logger.Trace("HTTP headers: ", server.ToJson(headers))
 	token, noun, err := ParsePath(path)
 	if err != nil {
 		status, output = server.JsonResponse(nil, server.RemoteError(server.ErrorUnsupported, ""))
 		return
 	}
 
+	span := irma.StartSpan("irmaserver.HandleProtocolMessage")
+	span.SetAttribute("method", method)
+	span.SetAttribute("noun", noun)
+	defer func() {
+		span.SetAttribute("status", strconv.Itoa(status))
+		span.End(nil)
+	}()
+
 	// Fetch the session
 	session := s.sessions.clientGet(token)
 	if session == nil {
-		s.conf.Logger.WithField("clientToken", token).Warn("Session not found")
+		logger.WithField("clientToken", token).Warn("Session not found")
 		status, output = server.JsonResponse(nil, server.RemoteError(server.ErrorSessionUnknown, ""))
 		return
 	}
+	// The hooks of a client connecting are called before the session is locked, as they may take long
+	connecting, refused := false, (*irma.RemoteError)(nil)
+	if len(noun) == 0 && method == http.MethodGet {
+		connecting, refused = session.clientConnecting()
+	}
+
 	session.Lock()
 	defer session.Unlock()
 
+	// In group issuance sessions, clients may only act on their own attempt, see groups.go
+	if rerr := session.checkAttempt(noun, method, http.Header(headers).Get(irma.AttemptHeader)); rerr != nil {
+		status, output = server.JsonResponse(nil, rerr)
+		return
+	}
+
 	// However we return, if the session status has been updated
 	// then we should inform the user by returning a SessionResult
 	defer func() {
-		if session.status != session.prevStatus {
+		if session.completion != nil {
+			// A client completed a group issuance session, which was reset for the next client
+			session.prevStatus = session.status
+			result, session.completion = session.completion, nil
+		} else if session.status != session.prevStatus {
 			session.prevStatus = session.status
 			result = session.result
 		}
@@ -320,11 +743,15 @@ func (s *Server) HandleProtocolMessage(
 	switch len(noun) {
 	case 0:
 		if method == http.MethodDelete {
-			session.handleDelete()
+			session.handleClientDelete()
 			status = http.StatusOK
 			return
 		}
 		if method == http.MethodGet {
+			if refused != nil {
+				status, output = server.JsonResponse(nil, refused)
+				return
+			}
 			h := http.Header(headers)
 			min := &irma.ProtocolVersion{}
 			max := &irma.ProtocolVersion{}
@@ -336,7 +763,12 @@ func (s *Server) HandleProtocolMessage(
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
 				return
 			}
-			status, output = server.JsonResponse(session.handleGetRequest(min, max))
+			request, rerr := session.handleGetRequest(min, max, h.Get(irma.ConfirmationCodeHeader), h.Get(irma.AttemptHeader), connecting)
+			if rerr == nil && h.Get(irma.SignedRequestHeader) != "" {
+				status, output = s.signedSessionRequest(session, token, request)
+				return
+			}
+			status, output = server.JsonResponse(request, rerr)
 			return
 		}
 		status, output = server.JsonResponse(nil, session.fail(server.ErrorInvalidRequest, ""))
@@ -359,6 +791,15 @@ func (s *Server) HandleProtocolMessage(
 			return
 		}
 
+		if noun == "failure" {
+			failure := &irma.ClientFailure{}
+			if err := json.Unmarshal(message, failure); err != nil {
+				status, output = server.JsonResponse(nil, server.RemoteError(server.ErrorMalformedInput, ""))
+				return
+			}
+			status, output = server.JsonResponse(nil, session.handlePostFailure(failure))
+			return
+		}
 		if noun == "commitments" && session.action == irma.ActionIssuing {
 			commitments := &irma.IssueCommitmentMessage{}
 			if err := irma.UnmarshalValidate(message, commitments); err != nil {
@@ -368,6 +809,15 @@ func (s *Server) HandleProtocolMessage(
 			status, output = server.JsonResponse(session.handlePostCommitments(commitments))
 			return
 		}
+		if noun == "issuanceresults" && session.action == irma.ActionIssuing {
+			var results []*irma.CredentialIssuanceResult
+			if err := json.Unmarshal(message, &results); err != nil {
+				status, output = server.JsonResponse(nil, server.RemoteError(server.ErrorMalformedInput, ""))
+				return
+			}
+			status, output = server.JsonResponse(nil, session.handlePostIssuanceResults(results))
+			return
+		}
 		if noun == "proofs" && session.action == irma.ActionDisclosing {
 			disclosure := irma.Disclosure{}
 			if err := irma.UnmarshalValidate(message, &disclosure); err != nil {
@@ -0,0 +1,124 @@
+package servercore
+
+import (
+	"net/http"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// This file contains group issuance sessions: issuance sessions whose request specifies
+// MaxCompletions, which may be completed by that many clients one after another using the same
+// QR, e.g. to issue attendee credentials at a conference. When a client completes the session, its
+// result is added to the Completions of the session result and reported to the requestor as if
+// the session were done, after which the session is reset for the next client with a fresh nonce.
+// If a client fails or cancels, only its own attempt is discarded. After the last completion the
+// session is done as usual; it times out as usual when no next client connects in time.
+//
+// As all clients use the same session token, clients identify their attempt by a random identifier
+// that they send in the irma.AttemptHeader of all requests. The attempt of the client that retrieves
+// the session request becomes the current attempt; other requests are only accepted from that client
+// (see checkAttempt()), so that other clients can not cancel or otherwise interfere with its attempt.
+// Issuance results are only accepted from the client of the completion that they belong to.
+
+// maxAttemptLength is the maximum length of the value of the irma.AttemptHeader.
+const maxAttemptLength = 64
+
+// isGroup returns whether the session is a group issuance session that accepts further clients.
+func (session *session) isGroup() bool {
+	return session.rrequest.Base().MaxCompletions > 1 && !session.status.Finished() &&
+		len(session.result.Completions) < session.rrequest.Base().MaxCompletions
+}
+
+// complete finishes the session after the client successfully completed it, or, in group
+// issuance sessions that accept further clients, resets it for the next client.
+func (session *session) complete() {
+	if !session.isGroup() {
+		session.setStatus(server.StatusDone)
+		return
+	}
+
+	completion := *session.result
+	completion.Status = server.StatusDone
+	completion.Completions = nil
+	session.result.Completions = append(session.result.Completions, &completion)
+	session.attempts = append(session.attempts, session.attempt)
+	if len(session.result.Completions) == session.rrequest.Base().MaxCompletions {
+		session.setStatus(server.StatusDone)
+		return
+	}
+
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "completions": len(session.result.Completions)}).
+		Info("Group issuance session completed by client")
+	session.queueResultHooks(&completion)
+	session.completion = &completion
+	session.reset()
+}
+
+// reset prepares a group issuance session for the next client, discarding the attempt of the
+// current one.
+func (session *session) reset() {
+	nonce, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[2048].Lstatzk)
+	if err != nil {
+		// Without a fresh nonce the session can not be reused for the next client
+		session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "error": err.Error()}).
+			Error("Failed to reset group issuance session")
+		session.result.Err = server.RemoteError(server.ErrorUnknown, "")
+		session.setStatus(server.StatusCancelled)
+		return
+	}
+	session.result = &server.SessionResult{
+		Token:       session.token,
+		Type:        session.action,
+		Status:      server.StatusInitialized,
+		Completions: session.result.Completions,
+	}
+	session.request.SetNonce(nonce)
+	session.attempt = ""
+	session.kssProofs = nil
+	session.confirmationCode = ""
+	session.clientFailure = nil
+	session.setStatus(server.StatusInitialized)
+}
+
+// checkAttempt checks that a request of a client in a group issuance session belongs to the current
+// attempt, or for issuance results, to the attempt of the completion to which they belong. Retrieving
+// the session request starts a new attempt, see handleGetRequest().
+func (session *session) checkAttempt(noun, method, attempt string) *irma.RemoteError {
+	if session.rrequest.Base().MaxCompletions <= 1 {
+		return nil
+	}
+	switch {
+	case noun == "" && method == http.MethodGet, noun == "status", noun == "statusevents":
+		return nil
+	case noun == "issuanceresults":
+		completion := session.lastCompletion()
+		if attempt != "" && completion >= 0 && completion < len(session.attempts) && session.attempts[completion] == attempt {
+			return nil
+		}
+	default:
+		if attempt != "" && attempt == session.attempt {
+			return nil
+		}
+	}
+	return server.RemoteError(server.ErrorUnexpectedRequest, "Request does not belong to the attempt of this client")
+}
+
+// lastCompletion returns the index of the completion to which issuance results reported by the
+// client after the session is done belong (0 if the session is not a group issuance session),
+// or -1 if there is none.
+func (session *session) lastCompletion() int {
+	completions := len(session.result.Completions)
+	if session.status == server.StatusDone {
+		if completions == 0 {
+			return 0
+		}
+		return completions - 1
+	}
+	if session.status == server.StatusInitialized && completions > 0 {
+		return completions - 1
+	}
+	return -1
+}
@@ -1,6 +1,8 @@
 package servercore
 
 import (
+	"fmt"
+
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
@@ -18,20 +20,77 @@ func (session *session) handleDelete() {
 	}
 	session.markAlive()
 
-	session.result = &server.SessionResult{Token: session.token, Status: server.StatusCancelled, Type: session.action}
+	session.result = &server.SessionResult{
+		Token:         session.token,
+		Status:        server.StatusCancelled,
+		Type:          session.action,
+		ClientFailure: session.clientFailure,
+		Completions:   session.result.Completions,
+	}
 	session.setStatus(server.StatusCancelled)
 }
 
-func (session *session) handleGetRequest(min, max *irma.ProtocolVersion) (irma.SessionRequest, *irma.RemoteError) {
-	if session.status != server.StatusInitialized {
+// handleClientDelete handles the client cancelling the session, which in group issuance sessions
+// only discards its own attempt.
+func (session *session) handleClientDelete() {
+	if session.isGroup() {
+		session.markAlive()
+		session.reset()
+		return
+	}
+	session.handleDelete()
+}
+
+// handlePostFailure records why the session failed at the client, before the client deletes it.
+func (session *session) handlePostFailure(failure *irma.ClientFailure) *irma.RemoteError {
+	if session.status.Finished() || session.clientFailure != nil {
+		return server.RemoteError(server.ErrorUnexpectedRequest, "Session finished or failure already reported")
+	}
+	if err := failure.Validate(session.request.Identifiers().SchemeManagers); err != nil {
+		return server.RemoteError(server.ErrorMalformedInput, err.Error())
+	}
+	session.markAlive()
+	session.clientFailure = failure
+	session.conf.Logger.WithFields(logrus.Fields{
+		"session": session.token, "code": failure.Code, "identifier": failure.Identifier,
+	}).Info("Session failed at client")
+	return nil
+}
+
+// handleGetRequest handles a client retrieving the session request; connecting is whether this
+// client passed the OnClientConnected hooks, see clientConnecting(). In group issuance sessions, the
+// attempt of the client becomes the current attempt, see groups.go.
+func (session *session) handleGetRequest(min, max *irma.ProtocolVersion, confirmationCode, attempt string, connecting bool) (irma.SessionRequest, *irma.RemoteError) {
+	if session.status != server.StatusInitialized || session.connecting != connecting {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session already started")
 	}
+	session.connecting = false
 	session.markAlive()
+	if session.isGroup() {
+		if attempt == "" || len(attempt) > maxAttemptLength {
+			return nil, server.RemoteError(server.ErrorProtocolVersion, "Group issuance sessions require an attempt identifier")
+		}
+		session.attempt = attempt
+	}
+	if len(confirmationCode) > irma.MaxConfirmationCodeLength {
+		return nil, session.fail(server.ErrorMalformedInput, "Confirmation code too long")
+	}
+	session.confirmationCode = confirmationCode
 
 	var err error
 	if session.version, err = chooseProtocolVersion(min, max); err != nil {
 		return nil, session.fail(server.ErrorProtocolVersion, "")
 	}
+	// Disclosure to multiple recipients requires protocol version 2.5
+	if dr, ok := session.request.(*irma.DisclosureRequest); ok && len(dr.Recipients) > 0 &&
+		session.version.BelowVersion(irma.NewVersion(2, 5)) {
+		return nil, session.fail(server.ErrorProtocolVersion, "Disclosure to multiple recipients not supported by client")
+	}
+	// Coarsened signing dates require protocol version 2.6
+	if ir, ok := session.request.(*irma.IssuanceRequest); ok && ir.CoarsensSigningDate() &&
+		session.version.BelowVersion(irma.NewVersion(2, 6)) {
+		return nil, session.fail(server.ErrorProtocolVersion, "Coarsened signing dates not supported by client")
+	}
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "version": session.version.String()}).Debugf("Protocol version negotiated")
 	session.request.SetVersion(session.version)
 
@@ -74,9 +133,13 @@ func (session *session) handlePostDisclosure(disclosure irma.Disclosure) (*irma.
 
 	var err error
 	var rerr *irma.RemoteError
+	request := session.request.(*irma.DisclosureRequest)
 	session.result.Disclosed, session.result.ProofStatus, err = disclosure.Verify(
-		session.conf.IrmaConfiguration, session.request.(*irma.DisclosureRequest))
+		session.conf.IrmaConfiguration, request)
 	if err == nil {
+		if session.result.ProofStatus == irma.ProofStatusValid {
+			session.result.Transcripts = request.Transcripts(&disclosure)
+		}
 		session.setStatus(server.StatusDone)
 	} else {
 		if err == irma.ErrorMissingPublicKey {
@@ -96,10 +159,25 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 
 	request := session.request.(*irma.IssuanceRequest)
 
+	// The proofs consist of the disclosure proofs, followed by one issuance proof for each credential,
+	// correlated with request.Credentials by the credential IDs; we return the signatures in the
+	// order of the issuance proofs
 	discloseCount := len(commitments.Proofs) - len(request.Credentials)
 	if discloseCount < 0 {
 		return nil, session.fail(server.ErrorMalformedInput, "Received insufficient proofs")
 	}
+	ids, err := commitments.CredentialIndices(request)
+	if err != nil {
+		return nil, session.fail(server.ErrorMalformedInput, err.Error())
+	}
+	for i, id := range ids {
+		if _, ok := commitments.Proofs[i+discloseCount].(*gabi.ProofU); !ok {
+			return nil, session.fail(server.ErrorMalformedInput, fmt.Sprintf(
+				"Proof %d is not an issuance proof of credential %s", i+discloseCount, request.Credentials[id].CredentialTypeID))
+		}
+	}
+
+	replayKeys := replayKeys(commitments, discloseCount)
 
 	// Compute list of public keys against which to verify the received proofs
 	disclosureproofs := irma.ProofList(commitments.Proofs[:discloseCount])
@@ -107,7 +185,8 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	if err != nil {
 		return nil, session.fail(server.ErrorInvalidProofs, err.Error())
 	}
-	for _, cred := range request.Credentials {
+	for _, id := range ids {
+		cred := request.Credentials[id]
 		iss := cred.CredentialTypeID.IssuerIdentifier()
 		pubkey, _ := session.conf.IrmaConfiguration.PublicKey(iss, cred.KeyCounter) // No error, already checked earlier
 		pubkeys = append(pubkeys, pubkey)
@@ -142,10 +221,14 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	if session.result.ProofStatus != irma.ProofStatusValid {
 		return nil, session.fail(server.ErrorInvalidProofs, "")
 	}
+	if rerr := session.checkReplay(replayKeys); rerr != nil {
+		return nil, rerr
+	}
 
 	// Compute CL signatures
 	var sigs []*gabi.IssueSignatureMessage
-	for i, cred := range request.Credentials {
+	for i, credid := range ids {
+		cred := request.Credentials[credid]
 		id := cred.CredentialTypeID.IssuerIdentifier()
 		pk, _ := session.conf.IrmaConfiguration.PublicKey(id, cred.KeyCounter)
 		sk, _ := session.conf.PrivateKey(id)
@@ -153,15 +236,51 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 		proof := commitments.Proofs[i+discloseCount].(*gabi.ProofU)
 		attributes, err := cred.AttributeList(session.conf.IrmaConfiguration, 0x03)
 		if err != nil {
-			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+			return nil, session.fail(server.ErrorIssuanceFailed, fmt.Sprintf("credential %s: %s", cred.CredentialTypeID, err.Error()))
 		}
 		sig, err := issuer.IssueSignature(proof.U, attributes.Ints, commitments.Nonce2)
 		if err != nil {
-			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+			return nil, session.fail(server.ErrorIssuanceFailed, fmt.Sprintf("credential %s: %s", cred.CredentialTypeID, err.Error()))
 		}
 		sigs = append(sigs, sig)
 	}
 
-	session.setStatus(server.StatusDone)
+	credtypes := make([]irma.CredentialTypeIdentifier, 0, len(request.Credentials))
+	for _, cred := range request.Credentials {
+		credtypes = append(credtypes, cred.CredentialTypeID)
+	}
+	session.conf.Audit(&server.AuditEvent{
+		Type:        server.AuditIssuancePerformed,
+		Session:     session.token,
+		Action:      session.action,
+		Credentials: credtypes,
+	})
+
+	session.complete()
 	return sigs, nil
 }
+
+// handlePostIssuanceResults records which of the issued credentials the client could construct.
+// Unlike the other endpoints, this is called after the session is done. The results are stored
+// apart from the session result, which does not change after the session is done.
+func (session *session) handlePostIssuanceResults(results []*irma.CredentialIssuanceResult) *irma.RemoteError {
+	completion := session.lastCompletion()
+	if completion < 0 || (completion < len(session.issuanceResults) && session.issuanceResults[completion] != nil) {
+		return server.RemoteError(server.ErrorUnexpectedRequest, "Session not finished or results already reported")
+	}
+	request := session.request.(*irma.IssuanceRequest)
+	if len(results) != len(request.Credentials) {
+		return server.RemoteError(server.ErrorMalformedInput, "Amount of results does not match amount of credentials")
+	}
+	for i, result := range results {
+		if result == nil || result.CredentialTypeID != request.Credentials[i].CredentialTypeID {
+			return server.RemoteError(server.ErrorMalformedInput, "Results do not match issued credentials")
+		}
+	}
+	session.markAlive()
+	for len(session.issuanceResults) <= completion {
+		session.issuanceResults = append(session.issuanceResults, nil)
+	}
+	session.issuanceResults[completion] = results
+	return nil
+}
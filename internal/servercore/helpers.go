@@ -28,7 +28,105 @@ func (session *session) setStatus(status server.Status) {
 		Info("Session status updated")
 	session.status = status
 	session.result.Status = status
+	if status == server.StatusTimeout {
+		token := session.token
+		session.queueHooks(func(hooks server.SessionHooks) { hooks.OnExpiry(token) })
+	} else if status.Finished() {
+		session.queueResultHooks(session.result)
+	}
 	session.sessions.update(session)
+	if status.Finished() {
+		session.auditFinished()
+	}
+}
+
+// queueHooks queues a call of the hooks, which is made by Unlock() once the session is unlocked,
+// so that hooks taking long do not block other users of the session.
+func (session *session) queueHooks(call func(hooks server.SessionHooks)) {
+	if len(session.conf.Hooks) > 0 {
+		session.queuedHooks = append(session.queuedHooks, call)
+	}
+}
+
+// queueResultHooks queues a call of the OnResult hooks with a copy of the result.
+func (session *session) queueResultHooks(result *server.SessionResult) {
+	cpy := *result
+	session.queueHooks(func(hooks server.SessionHooks) { hooks.OnResult(&cpy) })
+}
+
+// Unlock unlocks the session, and then makes the calls of the hooks queued while it was locked.
+func (session *session) Unlock() {
+	session.runHooks(session.unlockQueued())
+}
+
+// unlockQueued unlocks the session, returning the calls of the hooks queued while it was locked
+// for the caller to make using runHooks().
+func (session *session) unlockQueued() []func(hooks server.SessionHooks) {
+	queued := session.queuedHooks
+	session.queuedHooks = nil
+	session.Mutex.Unlock()
+	return queued
+}
+
+func (session *session) runHooks(queued []func(hooks server.SessionHooks)) {
+	for _, call := range queued {
+		for _, hooks := range session.conf.Hooks {
+			call(hooks)
+		}
+	}
+}
+
+// clientConnecting calls the OnClientConnected hooks when a client retrieves the session request,
+// returning whether it did so. As hooks may take long, the session is not locked meanwhile, but marked
+// as connecting so that no other client can retrieve the session request. If a hook refuses the client,
+// the session is cancelled; the reason is logged, but not returned to the client.
+func (session *session) clientConnecting() (bool, *irma.RemoteError) {
+	if len(session.conf.Hooks) == 0 {
+		return false, nil
+	}
+	session.Lock()
+	if session.status != server.StatusInitialized || session.connecting {
+		session.Unlock()
+		return false, server.RemoteError(server.ErrorUnexpectedRequest, "Session already started")
+	}
+	session.connecting = true
+	request := session.request
+	session.Unlock()
+
+	var err error
+	for _, hooks := range session.conf.Hooks {
+		if err = hooks.OnClientConnected(session.token, request); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "error": err.Error()}).Info("Client refused by hook")
+		session.Lock()
+		defer session.Unlock()
+		session.connecting = false
+		return false, session.fail(server.ErrorSessionRefused, "")
+	}
+	return true, nil // handleGetRequest() clears session.connecting
+}
+
+func (session *session) auditFinished() {
+	event := &server.AuditEvent{
+		Type:    server.AuditSessionFinished,
+		Session: session.token,
+		Action:  session.action,
+		Status:  session.status,
+	}
+	if len(session.result.Disclosed) > 0 {
+		event.Values = make(map[irma.AttributeTypeIdentifier]string, len(session.result.Disclosed))
+		for _, attr := range session.result.Disclosed {
+			event.Attributes = append(event.Attributes, attr.Identifier)
+			if attr.RawValue != nil {
+				event.Values[attr.Identifier] = *attr.RawValue
+			}
+		}
+	}
+	session.conf.Audit(event)
 }
 
 func (session *session) onUpdate() {
@@ -42,25 +140,58 @@ func (session *session) onUpdate() {
 
 func (session *session) fail(err server.Error, message string) *irma.RemoteError {
 	rerr := server.RemoteError(err, message)
-	session.setStatus(server.StatusCancelled)
+	if session.isGroup() {
+		// Only the attempt of this client fails
+		session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "error": rerr.ErrorName}).
+			Info("Client failed in group issuance session")
+		session.reset()
+		return rerr
+	}
 	session.result = &server.SessionResult{Err: rerr, Token: session.token, Status: server.StatusCancelled, Type: session.action}
+	session.setStatus(server.StatusCancelled)
 	return rerr
 }
 
+// checkMinimization logs and returns the data minimization warnings of the request, returning a
+// server.MinimizationError if the policy rejects the request. As requestors may well need the value
+// of a sensitive attribute, MinimizationUnrestricted warnings are logged only once per attribute,
+// and do not cause the request to be rejected.
+func (s *Server) checkMinimization(conf *server.Configuration, request irma.SessionRequest) ([]*server.MinimizationWarning, error) {
+	if conf.MinimizationPolicy == server.MinimizationOff {
+		return nil, nil
+	}
+	warnings := server.CheckMinimization(conf.IrmaConfiguration, request)
+	var rejected []*server.MinimizationWarning
+	for _, warning := range warnings {
+		if warning.Reason == server.MinimizationUnrestricted {
+			if _, logged := s.minimizationLogged.LoadOrStore(warning.Attribute, true); logged {
+				continue
+			}
+		} else {
+			rejected = append(rejected, warning)
+		}
+		conf.Logger.WithFields(logrus.Fields{"attribute": warning.Attribute, "reason": warning.Reason}).Warn(warning.Guidance)
+	}
+	if len(rejected) > 0 && conf.MinimizationPolicy == server.MinimizationReject {
+		return nil, &server.MinimizationError{Warnings: rejected}
+	}
+	return warnings, nil
+}
+
 // Issuance helpers
 
-func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
+func (s *Server) validateIssuanceRequest(conf *server.Configuration, request *irma.IssuanceRequest) error {
 	for _, cred := range request.Credentials {
 		// Check that we have the appropriate private key
 		iss := cred.CredentialTypeID.IssuerIdentifier()
-		privatekey, err := s.conf.PrivateKey(iss)
+		privatekey, err := conf.PrivateKey(iss)
 		if err != nil {
 			return err
 		}
 		if privatekey == nil {
 			return errors.Errorf("missing private key of issuer %s", iss.String())
 		}
-		pubkey, err := s.conf.IrmaConfiguration.PublicKey(iss, int(privatekey.Counter))
+		pubkey, err := conf.IrmaConfiguration.PublicKey(iss, int(privatekey.Counter))
 		if err != nil {
 			return err
 		}
@@ -70,7 +201,17 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 		cred.KeyCounter = int(privatekey.Counter)
 
 		// Check that the credential is consistent with irma_configuration
-		if err := cred.Validate(s.conf.IrmaConfiguration); err != nil {
+		if err := cred.Validate(conf.IrmaConfiguration); err != nil {
+			return err
+		}
+
+		// Run configured validators and normalizers over the attribute values
+		if err := s.validateAttributes(cred); err != nil {
+			return err
+		}
+
+		// Compute derived attributes from the normalized attribute values
+		if err := cred.DeriveAttributes(conf.IrmaConfiguration); err != nil {
 			return err
 		}
 
@@ -87,6 +228,21 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 	return nil
 }
 
+func (s *Server) validateAttributes(cred *irma.CredentialRequest) error {
+	for name, value := range cred.Attributes {
+		attrid := irma.NewAttributeTypeIdentifier(cred.CredentialTypeID.String() + "." + name)
+		for _, validator := range s.validators[attrid] {
+			normalized, err := validator.Validate(value)
+			if err != nil {
+				return &server.AttributeValueError{Attribute: attrid, Reason: err.Error()}
+			}
+			value = normalized
+		}
+		cred.Attributes[name] = value
+	}
+	return nil
+}
+
 func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, scheme irma.SchemeManagerIdentifier) (*gabi.ProofP, error) {
 	if session.kssProofs == nil {
 		session.kssProofs = make(map[irma.SchemeManagerIdentifier]*gabi.ProofP)
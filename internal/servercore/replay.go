@@ -0,0 +1,56 @@
+package servercore
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// This file contains the refusal of replayed issuance commitments. The secret key commitments (U)
+// of the issuance proofs and the nonce of the client (Nonce2) that the server accepts are recorded
+// in the ReplayStore of the configuration, along with the session in which they were accepted. An
+// IssueCommitmentMessage containing a commitment or client nonce that was accepted before, whether
+// in the same (group issuance) session or in another session, is refused before anything is signed.
+// The keys are recorded after the proofs have been verified, so that invalid messages cannot be used
+// to make the server refuse the commitments of others.
+
+// replayRetention is how long accepted commitments and client nonces are recorded.
+const replayRetention = time.Hour
+
+// replayKeys returns the keys under which the commitments and client nonce are recorded. It must be
+// called before the proofs of the keyshare server are merged into the commitments.
+func replayKeys(commitments *irma.IssueCommitmentMessage, discloseCount int) []string {
+	var keys []string
+	if commitments.Nonce2 != nil {
+		keys = append(keys, "nonce:"+base64.StdEncoding.EncodeToString(commitments.Nonce2.Bytes()))
+	}
+	for _, proof := range commitments.Proofs[discloseCount:] {
+		if proofU, ok := proof.(*gabi.ProofU); ok && proofU.U != nil {
+			hash := sha256.Sum256(proofU.U.Bytes())
+			keys = append(keys, "commitment:"+base64.StdEncoding.EncodeToString(hash[:]))
+		}
+	}
+	return keys
+}
+
+// checkReplay records the keys, failing the session if any of them was recorded before.
+func (session *session) checkReplay(keys []string) *irma.RemoteError {
+	usedBy, err := session.conf.ReplayStore.Record(session.token, keys, time.Now().Add(replayRetention))
+	if err != nil {
+		return session.fail(server.ErrorUnknown, err.Error())
+	}
+	if usedBy == "" {
+		return nil
+	}
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "used_by": usedBy}).
+		Warn("Refusing replayed issuance commitments")
+	if usedBy == session.token {
+		return session.fail(server.ErrorReplayedCommitments, "commitments were already used in this session")
+	}
+	return session.fail(server.ErrorReplayedCommitments, "commitments were already used in another session")
+}
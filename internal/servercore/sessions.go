@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
@@ -32,6 +33,25 @@ type session struct {
 
 	kssProofs map[irma.SchemeManagerIdentifier]*gabi.ProofP
 
+	// Sent by the client in sessions started from a deep link, see irma.ConfirmationCodeHeader
+	confirmationCode string
+	// Sent by the client when the session fails at the client, see irma.ClientFailure
+	clientFailure *irma.ClientFailure
+	// Result of the client that just completed a group issuance session, see groups.go
+	completion *server.SessionResult
+	// In group issuance sessions, the attempt of the client that retrieved the session request, and
+	// the attempts of the clients that completed the session, see groups.go
+	attempt  string
+	attempts []string
+	// Reported by the client after the session is done, per completion; see handlePostIssuanceResults()
+	issuanceResults [][]*irma.CredentialIssuanceResult
+	// Set while the OnClientConnected hooks are called, see clientConnecting()
+	connecting bool
+	// Hooks to be called once the session is unlocked, see Unlock()
+	queuedHooks []func(hooks server.SessionHooks)
+	// Data minimization warnings of the session request, see checkMinimization()
+	minimizationWarnings []*server.MinimizationWarning
+
 	conf     *server.Configuration
 	sessions sessionStore
 }
@@ -42,6 +62,8 @@ type sessionStore interface {
 	add(session *session)
 	update(session *session)
 	deleteExpired()
+	activeCount() int
+	ping() error
 	stop()
 }
 
@@ -60,7 +82,7 @@ const (
 
 var (
 	minProtocolVersion = irma.NewVersion(2, 4)
-	maxProtocolVersion = irma.NewVersion(2, 4)
+	maxProtocolVersion = irma.NewVersion(2, 7)
 )
 
 func (s *memorySessionStore) get(t string) *session {
@@ -96,11 +118,30 @@ func (s *memorySessionStore) stop() {
 	}
 }
 
+func (s *memorySessionStore) ping() error {
+	return nil // always reachable
+}
+
+func (s *memorySessionStore) activeCount() int {
+	s.RLock()
+	defer s.RUnlock()
+	count := 0
+	for _, session := range s.requestor {
+		session.Lock()
+		if !session.status.Finished() {
+			count++
+		}
+		session.Unlock()
+	}
+	return count
+}
+
 func (s *memorySessionStore) deleteExpired() {
 	// First check which sessions have expired
 	// We don't need a write lock for this yet, so postpone that for actual deleting
 	s.RLock()
 	expired := make([]string, 0, len(s.requestor))
+	var hooks []func() // called after unlocking, see session.Unlock()
 	for token, session := range s.requestor {
 		session.Lock()
 
@@ -119,9 +160,15 @@ func (s *memorySessionStore) deleteExpired() {
 				expired = append(expired, token)
 			}
 		}
-		session.Unlock()
+		if queued := session.unlockQueued(); len(queued) > 0 {
+			session := session
+			hooks = append(hooks, func() { session.runHooks(queued) })
+		}
 	}
 	s.RUnlock()
+	for _, call := range hooks {
+		call()
+	}
 
 	// Using a write lock, delete the expired sessions
 	s.Lock()
@@ -138,7 +185,7 @@ func (s *memorySessionStore) deleteExpired() {
 
 var one *big.Int = big.NewInt(1)
 
-func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *session {
+func (s *Server) newSession(conf *server.Configuration, action irma.Action, request irma.RequestorRequest) (*session, error) {
 	token := newSessionToken()
 	clientToken := newSessionToken()
 
@@ -151,7 +198,7 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *
 		clientToken: clientToken,
 		status:      server.StatusInitialized,
 		prevStatus:  server.StatusInitialized,
-		conf:        s.conf,
+		conf:        conf,
 		sessions:    s.sessions,
 		result: &server.SessionResult{
 			Token:  token,
@@ -160,13 +207,22 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *
 		},
 	}
 
-	s.conf.Logger.WithFields(logrus.Fields{"session": ses.token}).Debug("New session started")
-	nonce, _ := gabi.RandomBigInt(gabi.DefaultSystemParameters[2048].Lstatzk)
+	conf.Logger.WithFields(logrus.Fields{"session": ses.token}).Debug("New session started")
+	nonce, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[2048].Lstatzk)
+	if err != nil {
+		return nil, err
+	}
 	ses.request.SetNonce(nonce)
 	ses.request.SetContext(one)
+	for _, hooks := range conf.Hooks {
+		if err := hooks.OnSessionCreated(ses.token, request); err != nil {
+			conf.Logger.WithFields(logrus.Fields{"session": ses.token, "error": err.Error()}).Info("Session refused by hook")
+			return nil, server.LogWarning(errors.New("Session refused"))
+		}
+	}
 	s.sessions.add(ses)
 
-	return ses
+	return ses, nil
 }
 
 func newSessionToken() string {
@@ -0,0 +1,69 @@
+package sessiontest
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bwesterb/go-atum"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+func attestationServerConfiguration(attestation *requestorserver.AttestationConfiguration) *requestorserver.Configuration {
+	return &requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                   "http://localhost:48682/irma",
+			Logger:                logger,
+			SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		},
+		DisableRequestorAuthentication: true,
+		Port:                           48682,
+		Attestation:                    attestation,
+	}
+}
+
+func TestSignatureAttestation(t *testing.T) {
+	// The attestation credential type must contain the configured attributes
+	_, err := requestorserver.New(attestationServerConfiguration(&requestorserver.AttestationConfiguration{
+		Credential:      "irma-demo.MijnOverheid.fullName",
+		DigestAttribute: "firstnames",
+		DateAttribute:   "nonexisting",
+	}))
+	require.Error(t, err)
+
+	s, err := requestorserver.New(attestationServerConfiguration(&requestorserver.AttestationConfiguration{
+		Credential:      "irma-demo.MijnOverheid.fullName",
+		DigestAttribute: "firstnames",
+		DateAttribute:   "familyname",
+	}))
+	require.NoError(t, err)
+	httpserver := httptest.NewServer(s.Handler())
+	defer httpserver.Close()
+
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	c := make(chan *SessionResult, 1)
+	handler := TestHandler{t: t, c: c, client: client}
+
+	// Signatures without timestamp are refused by the client
+	signature := &irma.SignedMessage{Message: "message", Nonce: big.NewInt(1), Context: big.NewInt(1)}
+	require.Nil(t, client.RequestAttestation(httpserver.URL, signature, handler))
+	result := <-c
+	require.Error(t, result.Err)
+
+	// Invalid signatures are refused by the server
+	signature.Timestamp = &atum.Timestamp{}
+	require.Nil(t, client.RequestAttestation(httpserver.URL, signature, handler))
+	result = <-c
+	require.Error(t, result.Err)
+	serr, ok := result.Err.(*irma.SessionError)
+	require.True(t, ok)
+	require.NotNil(t, serr.RemoteError)
+	require.Equal(t, string(server.ErrorInvalidSignature.Type), serr.RemoteError.ErrorName)
+}
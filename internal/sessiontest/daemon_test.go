@@ -0,0 +1,78 @@
+package sessiontest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient/daemon"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientDaemon(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	path := test.FindTestdataFolder(t)
+	d, err := daemon.New(&daemon.Configuration{
+		StoragePath:           filepath.Join(path, "storage", "test"),
+		IrmaConfigurationPath: filepath.Join(path, "irma_configuration"),
+		SessionRetention:      100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, d.Token())
+
+	s := httptest.NewServer(d.Handler())
+	defer s.Close()
+	do := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	// Requests without the token are rejected
+	res := do("GET", "/credentials", "", "")
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res = do("GET", "/credentials", "incorrect", "")
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res = do("GET", "/credentials", d.Token(), "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var credentials irma.CredentialInfoList
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&credentials))
+	require.Len(t, credentials, len(d.Client.CredentialInfoList()))
+
+	// A session that cannot be started fails immediately
+	res = do("POST", "/sessions", d.Token(), "not a session pointer")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var session daemon.Session
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&session))
+	require.Equal(t, "failure", session.Result)
+
+	res = do("POST", "/sessions/"+session.ID+"/permission", d.Token(), `{"proceed":true}`)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res = do("DELETE", "/sessions/"+session.ID, d.Token(), "")
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	res = do("GET", "/sessions/"+session.ID, d.Token(), "")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// Finished sessions are removed after the session retention when other sessions are started
+	res = do("POST", "/sessions", d.Token(), "not a session pointer")
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&session))
+	res = do("GET", "/sessions/"+session.ID, d.Token(), "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	time.Sleep(200 * time.Millisecond)
+	do("POST", "/sessions", d.Token(), "not a session pointer")
+	res = do("GET", "/sessions/"+session.ID, d.Token(), "")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
@@ -3,10 +3,12 @@ package sessiontest
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/irmaclient"
+	wallet "github.com/privacybydesign/irmago/irmaclient/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -51,6 +53,11 @@ func (i *TestClientHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentif
 		i.t.Fatal(err)
 	}
 }
+func (i *TestClientHandler) CredentialLimitReached(id irma.CredentialTypeIdentifier, existing []*irma.CredentialInfo, callback func(index int)) {
+	callback(0)
+}
+func (i *TestClientHandler) StorageRepaired(damage []*irmaclient.StorageDamage)                   {}
+func (i *TestClientHandler) SchemeStale(scheme irma.SchemeManagerIdentifier, refreshed time.Time) {}
 func (i *TestClientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int) {
 	err := errors.New("blocked account")
 	select {
@@ -99,7 +106,7 @@ func (th TestHandler) UnsatisfiableRequest(serverName irma.TranslatedString, mis
 		ErrorType: irma.ErrorType("UnsatisfiableRequest"),
 	})
 }
-func (th TestHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+func (th TestHandler) RequestVerificationPermission(request irma.DisclosureRequest, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
 	choice := &irma.DisclosureChoice{
 		Attributes: []*irma.AttributeIdentifier{},
 	}
@@ -112,19 +119,19 @@ func (th TestHandler) RequestVerificationPermission(request irma.DisclosureReque
 		choice.Attributes = append(choice.Attributes, candidates[0])
 	}
 	if len(th.expectedServerName) != 0 {
-		require.Equal(th.t, th.expectedServerName, ServerName)
+		require.Equal(th.t, th.expectedServerName, serverName)
 	}
 	callback(true, choice)
 }
-func (th TestHandler) RequestIssuancePermission(request irma.IssuanceRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+func (th TestHandler) RequestIssuancePermission(request irma.IssuanceRequest, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
 	dreq := irma.DisclosureRequest{
 		BaseRequest: request.BaseRequest,
 		Content:     request.Disclose,
 	}
-	th.RequestVerificationPermission(dreq, ServerName, callback)
+	th.RequestVerificationPermission(dreq, serverName, callback)
 }
-func (th TestHandler) RequestSignaturePermission(request irma.SignatureRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
-	th.RequestVerificationPermission(request.DisclosureRequest, ServerName, callback)
+func (th TestHandler) RequestSignaturePermission(request irma.SignatureRequest, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	th.RequestVerificationPermission(request.DisclosureRequest, serverName, callback)
 }
 func (th TestHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
 	callback(true)
@@ -194,3 +201,21 @@ func (th *ManualTestHandler) RequestVerificationPermission(request irma.Disclosu
 	}
 	ph(true, &choice)
 }
+
+// WalletTestHandler is a TestHandler for sessions started by a wallet of the v2 API.
+type WalletTestHandler struct {
+	TestHandler
+}
+
+func (th WalletTestHandler) RequestVerificationPermission(request irma.DisclosureRequest, serverName irma.TranslatedString, callback wallet.PermissionHandler) {
+	th.TestHandler.RequestVerificationPermission(request, serverName, irmaclient.PermissionHandler(callback))
+}
+func (th WalletTestHandler) RequestIssuancePermission(request irma.IssuanceRequest, serverName irma.TranslatedString, callback wallet.PermissionHandler) {
+	th.TestHandler.RequestIssuancePermission(request, serverName, irmaclient.PermissionHandler(callback))
+}
+func (th WalletTestHandler) RequestSignaturePermission(request irma.SignatureRequest, serverName irma.TranslatedString, callback wallet.PermissionHandler) {
+	th.TestHandler.RequestSignaturePermission(request, serverName, irmaclient.PermissionHandler(callback))
+}
+func (th WalletTestHandler) RequestPin(remainingAttempts int, callback wallet.PinHandler) {
+	th.TestHandler.RequestPin(remainingAttempts, irmaclient.PinHandler(callback))
+}
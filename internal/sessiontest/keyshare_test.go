@@ -26,7 +26,8 @@ func TestRequestorIssuanceKeyshareSession(t *testing.T) {
 }
 
 func TestKeyshareRegister(t *testing.T) {
-	client, handler := parseStorage(t)
+	// The test keyshare server does not support the PAKE, so the hashed PIN is registered
+	client, handler := parseStorage(t, irmaclient.WithHashedPinFallback())
 	defer test.ClearTestStorage(t)
 
 	require.NoError(t, client.KeyshareRemoveAll())
@@ -70,3 +70,23 @@ func TestLogging(t *testing.T) {
 
 	test.ClearTestStorage(t)
 }
+
+func TestDisclosureSummary(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, client.RemoveAllCredentials())
+
+	attrid := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	sessionHelper(t, getIssuanceRequest(true), "issue", client)
+	sessionHelper(t, getDisclosureRequest(attrid), "verification", client)
+	sessionHelper(t, getDisclosureRequest(attrid), "verification", client)
+
+	summary, err := client.DisclosureSummary()
+	require.NoError(t, err)
+	require.Len(t, summary, 1)
+	require.Equal(t, "localhost", summary[0].Hostname)
+	require.Equal(t, 2, summary[0].Sessions)
+	require.Len(t, summary[0].Attributes, 1)
+	require.Equal(t, attrid, summary[0].Attributes[0].Type)
+	require.Equal(t, 2, summary[0].Attributes[0].Count)
+}
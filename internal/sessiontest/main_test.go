@@ -35,15 +35,15 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-func parseStorage(t *testing.T) (*irmaclient.Client, *TestClientHandler) {
+func parseStorage(t *testing.T, opts ...irmaclient.Option) (*irmaclient.Client, *TestClientHandler) {
 	test.SetupTestStorage(t)
 	handler := &TestClientHandler{t: t, c: make(chan error)}
 	path := test.FindTestdataFolder(t)
 	client, err := irmaclient.New(
 		filepath.Join(path, "storage", "test"),
 		filepath.Join(path, "irma_configuration"),
-		"",
 		handler,
+		opts...,
 	)
 	require.NoError(t, err)
 	return client, handler
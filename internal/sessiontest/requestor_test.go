@@ -1,12 +1,32 @@
 package sessiontest
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
+	wallet "github.com/privacybydesign/irmago/irmaclient/v2"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,6 +37,12 @@ func requestorSessionHelper(t *testing.T, request irma.SessionRequest) *server.S
 	client, _ := parseStorage(t)
 	defer test.ClearTestStorage(t)
 
+	return requestorSession(t, request, client, nil)
+}
+
+// requestorSession performs a session with the running irmaServer, passing the QR through
+// modifyQr (if not nil) before handing it to the client.
+func requestorSession(t *testing.T, request irma.SessionRequest, client *irmaclient.Client, modifyQr func(*irma.Qr)) *server.SessionResult {
 	clientChan := make(chan *SessionResult)
 	serverChan := make(chan *server.SessionResult)
 
@@ -24,6 +50,9 @@ func requestorSessionHelper(t *testing.T, request irma.SessionRequest) *server.S
 		serverChan <- result
 	})
 	require.NoError(t, err)
+	if modifyQr != nil {
+		modifyQr(qr)
+	}
 
 	h := TestHandler{t, clientChan, client, nil}
 	j, err := json.Marshal(qr)
@@ -169,3 +198,763 @@ func testRequestorIssuance(t *testing.T, keyshare bool) {
 	require.Equal(t, attrid, result.Disclosed[0].Identifier)
 	require.Equal(t, "456", result.Disclosed[0].Value["en"])
 }
+
+func TestSignedSessionRequest(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	skbts, err := x509.MarshalECPrivateKey(sk)
+	require.NoError(t, err)
+	startIrmaServer(t, &server.Configuration{
+		SessionRequestPrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: skbts})),
+	})
+	defer StopIrmaServer()
+
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	result := requestorSession(t, getIssuanceRequest(true), client, func(qr *irma.Qr) {
+		pk, err := irma.ParseRequestKey(qr.RequestKey)
+		require.NoError(t, err)
+		require.Equal(t, sk.PublicKey, *pk)
+	})
+	require.Equal(t, server.StatusDone, result.Status)
+
+	// A reverse proxy that does not pass on the request for a signed session request
+	// (or that alters the session request) causes the client to reject the session
+	proxy := httptest.NewServer(&httputil.ReverseProxy{Director: func(r *http.Request) {
+		r.URL.Scheme, r.URL.Host = "http", "localhost:48680"
+		r.Header.Del(irma.SignedRequestHeader)
+	}})
+	defer proxy.Close()
+
+	qr, _, err := irmaServer.StartSession(getIssuanceRequest(true), nil)
+	require.NoError(t, err)
+	qr.URL = strings.Replace(qr.URL, "http://localhost:48680", proxy.URL, 1)
+	clientChan := make(chan *SessionResult)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.IsType(t, &irma.SessionError{}, clientResult.Err)
+	require.Equal(t, irma.ErrorInvalidJWT, clientResult.Err.(*irma.SessionError).ErrorType)
+}
+
+// promptRecordingHandler passes the permission prompts of issuance sessions to the test
+// instead of answering them.
+type promptRecordingHandler struct {
+	TestHandler
+	connected chan struct{}
+	prompts   chan irmaclient.PermissionHandler
+}
+
+func (h promptRecordingHandler) StatusUpdate(action irma.Action, status irma.Status) {
+	if status == irma.StatusConnected {
+		h.connected <- struct{}{}
+	}
+}
+func (h promptRecordingHandler) RequestIssuancePermission(request irma.IssuanceRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.prompts <- callback
+}
+
+func TestDuplicateSessionPrompt(t *testing.T) {
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	clientChan := make(chan *SessionResult, 2)
+	h := promptRecordingHandler{
+		TestHandler: TestHandler{t, clientChan, client, nil},
+		connected:   make(chan struct{}, 2),
+		prompts:     make(chan irmaclient.PermissionHandler, 2),
+	}
+	for i := 0; i < 2; i++ {
+		// Explicit validity, as the default validity set by the server depends on the current time
+		qr, _, err := irmaServer.StartSession(getIssuanceRequest(false), nil)
+		require.NoError(t, err)
+		j, err := json.Marshal(qr)
+		require.NoError(t, err)
+		client.NewSession(string(j), h)
+		<-h.connected
+	}
+
+	// The user is prompted once, and the answer applies to both sessions
+	callback := <-h.prompts
+	require.Empty(t, h.prompts)
+	callback(true, nil)
+	for i := 0; i < 2; i++ {
+		require.Nil(t, <-clientChan)
+	}
+	require.Empty(t, h.prompts)
+}
+
+type recordingHooks struct {
+	server.NopSessionHooks
+	events        chan string
+	refuseConnect bool
+}
+
+func (h *recordingHooks) OnSessionCreated(token string, request irma.RequestorRequest) error {
+	h.events <- "created"
+	if request.SessionRequest().Action() == irma.ActionSigning {
+		return errors.New("signatures not allowed")
+	}
+	return nil
+}
+func (h *recordingHooks) OnClientConnected(token string, request irma.SessionRequest) error {
+	h.events <- "connected"
+	if h.refuseConnect {
+		return errors.New("fraud detected")
+	}
+	return nil
+}
+func (h *recordingHooks) OnResult(result *server.SessionResult) {
+	h.events <- "result " + string(result.Status)
+}
+
+func TestSessionHooks(t *testing.T) {
+	hooks := &recordingHooks{events: make(chan string, 10)}
+	startIrmaServer(t, &server.Configuration{Hooks: []server.SessionHooks{hooks}})
+	defer StopIrmaServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	requestorSession(t, getIssuanceRequest(true), client, nil)
+	require.Equal(t, "created", <-hooks.events)
+	require.Equal(t, "connected", <-hooks.events)
+	require.Equal(t, "result "+string(server.StatusDone), <-hooks.events)
+
+	// Refusing to create a session
+	_, _, err := irmaServer.StartSession(getSigningRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")), nil)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "signatures not allowed")
+	require.Equal(t, "created", <-hooks.events)
+
+	// Refusing a client
+	hooks.refuseConnect = true
+	qr, _, err := irmaServer.StartSession(getIssuanceRequest(true), nil)
+	require.NoError(t, err)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult, 1)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.Equal(t, string(server.ErrorSessionRefused.Type), clientResult.Err.(*irma.SessionError).RemoteError.ErrorName)
+	require.Empty(t, clientResult.Err.(*irma.SessionError).RemoteError.Message)
+	require.Equal(t, "created", <-hooks.events)
+	require.Equal(t, "connected", <-hooks.events)
+	require.Equal(t, "result "+string(server.StatusCancelled), <-hooks.events)
+	require.Empty(t, hooks.events)
+}
+
+func TestIssuerPrivateKeyShares(t *testing.T) {
+	issuer := irma.NewIssuerIdentifier("irma-demo.MijnOverheid")
+	sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(testdata, "privatekeys", "irma-demo.MijnOverheid.xml"))
+	require.NoError(t, err)
+	shares, err := server.SplitPrivateKey(issuer, sk, 3, 5)
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+
+	// Any 3 shares reassemble the private key
+	id, combined, err := server.CombinePrivateKeyShares([]*server.PrivateKeyShare{shares[4], shares[0], shares[2]})
+	require.NoError(t, err)
+	require.Equal(t, issuer, id)
+	require.Equal(t, sk.P, combined.P)
+	require.Equal(t, sk.Q, combined.Q)
+	require.Equal(t, sk.Counter, combined.Counter)
+
+	// Too few, duplicate or tampered shares do not
+	_, _, err = server.CombinePrivateKeyShares(shares[:2])
+	require.Error(t, err)
+	_, _, err = server.CombinePrivateKeyShares([]*server.PrivateKeyShare{shares[0], shares[1], shares[1]})
+	require.Error(t, err)
+	tampered := *shares[1]
+	tampered.Share = append([]byte{}, shares[1].Share...)
+	tampered.Share[0] ^= 1
+	_, _, err = server.CombinePrivateKeyShares([]*server.PrivateKeyShare{shares[0], &tampered, shares[2]})
+	require.Error(t, err)
+
+	// The server reassembles the private key at startup from share files and entered shares
+	dir, err := ioutil.TempDir("", "keyshares")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bts, err := json.Marshal(shares[3])
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "share.json"), bts, 0600))
+	conf := &server.Configuration{
+		URL:                        "http://localhost:48680",
+		Logger:                     logger,
+		SchemesPath:                filepath.Join(testdata, "irma_configuration"),
+		DisableSchemesUpdate:       true,
+		IssuerPrivateKeyShareFiles: []string{filepath.Join(dir, "share.json")},
+		IssuerPrivateKeyShares:     shares[:2],
+	}
+	_, err = irmaserver.New(conf)
+	require.NoError(t, err)
+	require.Equal(t, sk.P, conf.IssuerPrivateKeys[issuer].P)
+
+	conf.IssuerPrivateKeys = nil
+	conf.IssuerPrivateKeyShareFiles = nil
+	_, err = irmaserver.New(conf)
+	require.Error(t, err)
+}
+
+// fakeVault mimics the transit secrets engine of HashiCorp Vault, "encrypting" by prefixing.
+func fakeVault(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "token", r.Header.Get("X-Vault-Token"))
+		var req map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		data := map[string]string{}
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/irma":
+			data["ciphertext"] = "vault:v1:" + req["plaintext"]
+		case "/v1/transit/decrypt/irma":
+			data["plaintext"] = strings.TrimPrefix(req["ciphertext"], "vault:v1:")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+}
+
+func TestIssuerKeyBackend(t *testing.T) {
+	vault := fakeVault(t)
+	defer vault.Close()
+	transit, err := (&server.KeyCipherSettings{VaultURL: vault.URL, VaultToken: "token", VaultTransitKey: "irma"}).Cipher()
+	require.NoError(t, err)
+
+	// Exactly one HSM or KMS must be configured, with its credentials
+	_, err = (&server.KeyCipherSettings{VaultURL: vault.URL, VaultTransitKey: "irma"}).Cipher()
+	require.Error(t, err)
+	_, err = (&server.KeyCipherSettings{VaultURL: vault.URL, VaultToken: "token", VaultTransitKey: "irma", GoogleCloudKMSKey: "key"}).Cipher()
+	require.Error(t, err)
+
+	issuer := irma.NewIssuerIdentifier("irma-demo.MijnOverheid")
+	sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(testdata, "privatekeys", "irma-demo.MijnOverheid.xml"))
+	require.NoError(t, err)
+	esk, err := server.EncryptPrivateKey(issuer, sk, transit)
+	require.NoError(t, err)
+	require.NotContains(t, string(esk.Ciphertext), sk.P.String())
+
+	dir, err := ioutil.TempDir("", "encryptedkeys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bts, err := json.Marshal(esk)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "irma-demo.MijnOverheid.json"), bts, 0600))
+
+	conf := &server.Configuration{
+		URL:                  "http://localhost:48680",
+		Logger:               logger,
+		SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+		DisableSchemesUpdate: true,
+		IssuerKeyBackends:    []server.IssuerKeyBackend{&server.EncryptedKeysBackend{Path: dir, Decrypter: transit}},
+	}
+	_, err = irmaserver.New(conf)
+	require.NoError(t, err)
+	require.Equal(t, sk.P, conf.IssuerPrivateKeys[issuer].P)
+
+	// The encrypted private key is bound to its issuer
+	esk.Issuer = irma.NewIssuerIdentifier("irma-demo.RU")
+	_, err = esk.Decrypt(transit)
+	require.Error(t, err)
+}
+
+func TestClientFailureReport(t *testing.T) {
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	qr, token, err := irmaServer.StartSession(getIssuanceRequest(true), nil)
+	require.NoError(t, err)
+	transport := irma.NewHTTPTransport(qr.URL)
+	transport.SetHeader(irma.MinVersionHeader, "2.4")
+	transport.SetHeader(irma.MaxVersionHeader, "2.7")
+	_, err = transport.GetBytes("")
+	require.NoError(t, err)
+
+	// Only known codes are accepted, with as identifier only a scheme of the session request,
+	// so that the report cannot reveal which credentials the user has
+	var x string
+	require.Error(t, transport.Post("failure", &x, &irma.ClientFailure{Code: "irma-demo.RU.studentCard"}))
+	require.Error(t, transport.Post("failure", &x, &irma.ClientFailure{Code: irma.FailureUnknownPublicKey, Identifier: "irma-demo.MijnOverheid-2"}))
+	require.Error(t, transport.Post("failure", &x, &irma.ClientFailure{Code: irma.FailureKeyshareEnrollment, Identifier: "pbdf"}))
+
+	failure := &irma.ClientFailure{Code: irma.FailureKeyshareEnrollment, Identifier: "irma-demo"}
+	require.NoError(t, transport.Post("failure", &x, failure))
+	// Only one report per session is accepted
+	require.Error(t, transport.Post("failure", &x, failure))
+	transport.Delete()
+
+	result := irmaServer.GetSessionResult(token)
+	require.Equal(t, server.StatusCancelled, result.Status)
+	require.Equal(t, failure, result.ClientFailure)
+}
+
+func TestGroupIssuanceSession(t *testing.T) {
+	hooks := &recordingHooks{events: make(chan string, 10)}
+	startIrmaServer(t, &server.Configuration{Hooks: []server.SessionHooks{hooks}})
+	defer StopIrmaServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	serverChan := make(chan *server.SessionResult, 2)
+	request := &irma.IdentityProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{MaxCompletions: 2},
+		Request:              getIssuanceRequest(false),
+	}
+	qr, token, err := irmaServer.StartSession(request, func(result *server.SessionResult) {
+		serverChan <- result
+	})
+	require.NoError(t, err)
+	require.Equal(t, "created", <-hooks.events)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+
+	// Other clients can not cancel the attempt of a client
+	attempt := func(id string) *irma.HTTPTransport {
+		transport := irma.NewHTTPTransport(qr.URL)
+		transport.SetHeader(irma.MinVersionHeader, irma.NewVersion(2, 4).String())
+		transport.SetHeader(irma.MaxVersionHeader, irma.NewVersion(2, 7).String())
+		transport.SetHeader(irma.AttemptHeader, id)
+		return transport
+	}
+	first := attempt("first")
+	require.NoError(t, first.Get("", &irma.IssuanceRequest{}))
+	require.Equal(t, "connected", <-hooks.events)
+	attempt("second").Delete()
+	require.Equal(t, server.StatusConnected, irmaServer.GetSessionResult(token).Status)
+	first.Delete()
+	require.Equal(t, server.StatusInitialized, irmaServer.GetSessionResult(token).Status)
+
+	// Each completion is reported, the last one finishing the session
+	for i := 1; i <= 2; i++ {
+		clientChan := make(chan *SessionResult)
+		client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+		require.Nil(t, <-clientChan)
+		result := <-serverChan
+		require.Equal(t, token, result.Token)
+		require.Equal(t, server.StatusDone, result.Status)
+		if i < 2 {
+			require.Empty(t, result.Completions)
+		} else {
+			require.Len(t, result.Completions, 2)
+		}
+		require.Equal(t, "connected", <-hooks.events)
+		require.Equal(t, "result "+string(server.StatusDone), <-hooks.events)
+	}
+	result := irmaServer.GetSessionResult(token)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Len(t, result.Completions, 2)
+
+	// Further clients are refused
+	clientChan := make(chan *SessionResult)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.Error(t, clientResult.Err)
+
+	// Only issuance sessions can be completed more than once
+	_, _, err = irmaServer.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{MaxCompletions: 2},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}, nil)
+	require.Error(t, err)
+}
+
+// replayingStore records the keys of the commitments accepted by the server, and replays the
+// recorded keys along with those of later sessions when replay is set.
+type replayingStore struct {
+	server.ReplayStore
+	keys   []string
+	replay bool
+}
+
+func (s *replayingStore) Record(session string, keys []string, expiry time.Time) (string, error) {
+	if s.replay {
+		keys = append(keys, s.keys...)
+	} else {
+		s.keys = append(s.keys, keys...)
+	}
+	return s.ReplayStore.Record(session, keys, expiry)
+}
+
+func TestReplayedCommitments(t *testing.T) {
+	store := &replayingStore{ReplayStore: server.NewMemoryReplayStore()}
+	startIrmaServer(t, &server.Configuration{ReplayStore: store})
+	defer StopIrmaServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// The client nonce and the commitment of the credential are recorded
+	result := requestorSession(t, getIssuanceRequest(false), client, nil)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Len(t, store.keys, 2)
+	require.True(t, strings.HasPrefix(store.keys[0], "nonce:"))
+	require.True(t, strings.HasPrefix(store.keys[1], "commitment:"))
+
+	// Within the same session they are refused too
+	usedBy, err := store.ReplayStore.Record(result.Token, store.keys[1:], time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, result.Token, usedBy)
+
+	// Sessions in which they are replayed fail
+	store.replay = true
+	qr, token, err := irmaServer.StartSession(getIssuanceRequest(false), nil)
+	require.NoError(t, err)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	serr, ok := clientResult.Err.(*irma.SessionError)
+	require.True(t, ok)
+	require.NotNil(t, serr.RemoteError)
+	require.Equal(t, string(server.ErrorReplayedCommitments.Type), serr.RemoteError.ErrorName)
+	require.Equal(t, server.StatusCancelled, irmaServer.GetSessionResult(token).Status)
+}
+
+func TestWalletAPI(t *testing.T) {
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+	handler := &TestClientHandler{t: t, c: make(chan error)}
+	path := test.FindTestdataFolder(t)
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	w, err := wallet.Open(filepath.Join(path, "storage", "test"), filepath.Join(path, "irma_configuration"), handler)
+	require.NoError(t, err)
+	defer w.Close()
+
+	qr, _, err := irmaServer.StartSession(getIssuanceRequest(true), nil)
+	require.NoError(t, err)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult)
+	w.NewSession(string(j), WalletTestHandler{TestHandler{t, clientChan, w.Client(), nil}})
+	require.Nil(t, <-clientChan)
+	logs, err := w.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	require.Equal(t, irma.ActionIssuing, logs[0].Type)
+	issued, err := logs[0].IssuedCredentials(w.Client().Configuration)
+	require.NoError(t, err)
+	require.NotEmpty(t, issued)
+
+	credentials := w.Credentials()
+	require.NotEmpty(t, credentials)
+	hash := credentials[0].Hash
+	require.NoError(t, w.ArchiveCredential(hash))
+	require.Len(t, w.ArchivedCredentials(), 1)
+	require.NoError(t, w.RestoreCredential(hash))
+	require.NoError(t, w.RemoveCredential(hash))
+	require.Len(t, w.Credentials(), len(credentials)-1)
+}
+
+func TestMinimizationPolicy(t *testing.T) {
+	conf := &server.Configuration{MinimizationPolicy: server.MinimizationReject}
+	startIrmaServer(t, conf)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	attrtype := conf.IrmaConfiguration.CredentialTypes[id.CredentialTypeIdentifier()].AttributeType(id)
+	attrtype.Sensitive = true
+	defer func() { attrtype.Sensitive = false }()
+
+	// As the requestor may need the value of the attribute, requesting it only results in a warning
+	request := getDisclosureRequest(id)
+	warnings := server.CheckMinimization(conf.IrmaConfiguration, request)
+	require.Len(t, warnings, 1)
+	require.Equal(t, id, warnings[0].Attribute)
+	require.Equal(t, server.MinimizationUnrestricted, warnings[0].Reason)
+	_, token, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Equal(t, warnings, irmaServer.GetMinimizationWarnings(token))
+
+	// Requesting a required value suffices
+	value := "456"
+	disjunction := request.Content[0]
+	disjunction.Values = map[irma.AttributeTypeIdentifier]*string{id: &value}
+	require.Empty(t, server.CheckMinimization(conf.IrmaConfiguration, request))
+	_, token, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Empty(t, irmaServer.GetMinimizationWarnings(token))
+
+	// Requests in which other attributes would suffice as well are rejected
+	disjunction.Attributes = append(disjunction.Attributes, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level"))
+	warnings = server.CheckMinimization(conf.IrmaConfiguration, request)
+	require.Len(t, warnings, 1)
+	require.Equal(t, server.MinimizationAlternatives, warnings[0].Reason)
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.IsType(t, &server.MinimizationError{}, err)
+}
+
+func TestServerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	schemes, keys := filepath.Join(dir, "irma_configuration"), filepath.Join(dir, "privatekeys")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(testdata, "irma_configuration"), schemes))
+	require.NoError(t, fs.CopyDirectory(filepath.Join(testdata, "privatekeys"), keys))
+	startIrmaServer(t, &server.Configuration{
+		SchemesPath:           schemes,
+		IssuerPrivateKeysPath: keys,
+		DisableSchemesUpdate:  true,
+	})
+	defer StopIrmaServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	conf := irmaServer.IrmaConfiguration()
+
+	// A reload that fails leaves the configuration in use intact
+	description := filepath.Join(schemes, "irma-demo", "description.xml")
+	bts, err := ioutil.ReadFile(description)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(description, []byte("garbage"), 0600))
+	require.Error(t, irmaServer.Reload())
+	require.NoError(t, ioutil.WriteFile(description, bts, 0600))
+	require.True(t, conf == irmaServer.IrmaConfiguration())
+	require.Contains(t, conf.SchemeManagers, irma.NewSchemeManagerIdentifier("irma-demo"))
+	require.Empty(t, conf.DisabledSchemeManagers)
+
+	unknown := filepath.Join(keys, "irma-demo.Unknown.xml")
+	require.NoError(t, ioutil.WriteFile(unknown, nil, 0600))
+	require.Error(t, irmaServer.Reload())
+	require.NoError(t, os.Remove(unknown))
+	require.True(t, conf == irmaServer.IrmaConfiguration())
+	require.True(t, irmaServer.Readiness().Ready)
+
+	// A session started before a successful reload is completed with the configuration with which
+	// it was started, and new sessions use the reloaded configuration
+	qr, _, err := irmaServer.StartSession(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")), nil)
+	require.NoError(t, err)
+	require.NoError(t, irmaServer.Reload())
+	require.False(t, conf == irmaServer.IrmaConfiguration())
+	require.Contains(t, conf.SchemeManagers, irma.NewSchemeManagerIdentifier("irma-demo"))
+
+	clientChan := make(chan *SessionResult)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	require.Nil(t, <-clientChan)
+	require.Equal(t, server.StatusDone, requestorSession(t, getIssuanceRequest(false), client, nil).Status)
+}
+
+func TestReadiness(t *testing.T) {
+	StartRequestorServer(IrmaServerConfiguration)
+	defer StopRequestorServer()
+
+	res, err := http.Get("http://localhost:48682/healthz")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res, err = http.Get("http://localhost:48682/readyz")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	readiness := &server.Readiness{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(readiness))
+	require.NoError(t, res.Body.Close())
+	require.True(t, readiness.Ready)
+	for _, result := range readiness.Checks {
+		require.Equal(t, "ok", result)
+	}
+
+	// Details of failed checks are reported only to the caller of Readiness()
+	details := &server.Readiness{Ready: false, Checks: map[string]string{
+		"schemes":     "disabled schemes: irma-demo",
+		"issuer_keys": "missing public key belonging to private key irma-demo.MijnOverheid-2",
+		"sessions":    "ok",
+	}}
+	require.Equal(t, &server.Readiness{Ready: false, Checks: map[string]string{
+		"schemes":     "failed",
+		"issuer_keys": "failed",
+		"sessions":    "ok",
+	}}, details.Summary())
+
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+	require.True(t, irmaServer.Readiness().Ready)
+	irmaServer.Drain(0)
+	readiness = irmaServer.Readiness()
+	require.False(t, readiness.Ready)
+	require.Equal(t, "shutting down", readiness.Checks["shutdown"])
+}
+
+func TestAuditSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file, err := server.NewFileAuditSink(filepath.Join(dir, "audit.log"))
+	require.NoError(t, err)
+	startIrmaServer(t, &server.Configuration{AuditSinks: []server.AuditSink{file}})
+	defer StopIrmaServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	result := requestorSession(t, getIssuanceRequest(false), client, nil)
+	require.Equal(t, server.StatusDone, result.Status)
+	irmaServer.GetSessionResult(result.Token)
+	require.NoError(t, file.Close())
+
+	bts, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	require.NoError(t, err)
+	var types []server.AuditEventType
+	for _, line := range strings.Split(strings.TrimSpace(string(bts)), "\n") {
+		event := &server.AuditEvent{}
+		require.NoError(t, json.Unmarshal([]byte(line), event))
+		require.Equal(t, result.Token, event.Session)
+		require.Empty(t, event.Values) // attribute values are not audited by default
+		types = append(types, event.Type)
+	}
+	require.Equal(t, []server.AuditEventType{
+		server.AuditSessionCreated, server.AuditIssuancePerformed, server.AuditSessionFinished, server.AuditResultFetched,
+	}, types)
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	received := make(chan *server.AuditEvent, server.WebhookAuditQueueSize+1)
+	first := make(chan struct{})
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &server.AuditEvent{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(event))
+		if event.Session == "0" {
+			close(first)
+			<-release
+		}
+		received <- event
+		_, _ = w.Write([]byte(`""`))
+	}))
+	defer webhook.Close()
+	sink := server.NewWebhookAuditSink(webhook.URL)
+
+	// Auditing does not wait for the webhook, until too many events are waiting to be sent
+	require.NoError(t, sink.Audit(&server.AuditEvent{Type: server.AuditSessionCreated, Session: "0"}))
+	<-first
+	for i := 1; i <= server.WebhookAuditQueueSize; i++ {
+		require.NoError(t, sink.Audit(&server.AuditEvent{Type: server.AuditSessionCreated, Session: strconv.Itoa(i)}))
+	}
+	require.Error(t, sink.Audit(&server.AuditEvent{Type: server.AuditSessionCreated, Session: "dropped"}))
+
+	// Closing sends the waiting events in order
+	close(release)
+	require.NoError(t, sink.Close())
+	require.Len(t, received, server.WebhookAuditQueueSize+1)
+	for i := 0; i <= server.WebhookAuditQueueSize; i++ {
+		require.Equal(t, strconv.Itoa(i), (<-received).Session)
+	}
+	require.Error(t, sink.Audit(&server.AuditEvent{Type: server.AuditSessionCreated, Session: "closed"}))
+}
+
+func TestAttributeValidators(t *testing.T) {
+	validate := func(conf *server.AttributeValidatorConfig, value string) (string, error) {
+		validator, err := server.NewAttributeValidator(conf)
+		require.NoError(t, err)
+		return validator.Validate(value)
+	}
+	_, err := server.NewAttributeValidator(&server.AttributeValidatorConfig{Type: "unknown"})
+	require.Error(t, err)
+	_, err = server.NewAttributeValidator(&server.AttributeValidatorConfig{Type: "regex", Pattern: "("})
+	require.Error(t, err)
+
+	regex := &server.AttributeValidatorConfig{Type: "regex", Pattern: "s[0-9]+"}
+	value, err := validate(regex, "s1234567")
+	require.NoError(t, err)
+	require.Equal(t, "s1234567", value)
+	_, err = validate(regex, "xs1234567") // the whole value must match
+	require.Error(t, err)
+
+	date := &server.AttributeValidatorConfig{Type: "date", InputFormats: []string{"02-01-2006", "2006-01-02"}}
+	value, err = validate(date, "31-12-1999")
+	require.NoError(t, err)
+	require.Equal(t, "1999-12-31", value)
+	_, err = validate(date, "31-31-1999")
+	require.Error(t, err)
+
+	bsn := &server.AttributeValidatorConfig{Type: "bsn"}
+	value, err = validate(bsn, "12345672")
+	require.NoError(t, err)
+	require.Equal(t, "012345672", value)
+	for _, invalid := range []string{"123456789", "000000000", "12345678a", "1234567890"} {
+		_, err = validate(bsn, invalid)
+		require.Error(t, err, invalid)
+	}
+
+	value, err = validate(&server.AttributeValidatorConfig{Type: "trim"}, " Radboud ")
+	require.NoError(t, err)
+	require.Equal(t, "Radboud", value)
+
+	// Validators configured for an attribute normalize its value before issuance, in order
+	startIrmaServer(t, &server.Configuration{
+		AttributeValidators: map[string][]*server.AttributeValidatorConfig{
+			"irma-demo.RU.studentCard.studentID": {{Type: "trim"}, regex},
+		},
+	})
+	defer StopIrmaServer()
+	request := getIssuanceRequest(false)
+	request.Credentials[0].Attributes["studentID"] = " s1234567 "
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Equal(t, "s1234567", request.Credentials[0].Attributes["studentID"])
+
+	request.Credentials[0].Attributes["studentID"] = "1234567"
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.IsType(t, &server.AttributeValueError{}, err)
+	require.Equal(t, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), err.(*server.AttributeValueError).Attribute)
+
+	// Validators of unknown attributes are refused
+	_, err = irmaserver.New(&server.Configuration{
+		URL:                  "http://localhost:48680",
+		Logger:               logger,
+		SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+		DisableSchemesUpdate: true,
+		AttributeValidators: map[string][]*server.AttributeValidatorConfig{
+			"irma-demo.RU.studentCard.unknown": {{Type: "trim"}},
+		},
+	})
+	require.Error(t, err)
+}
+
+func TestPushSession(t *testing.T) {
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	push := func(payload interface{}, origin string) *SessionResult {
+		if p, ok := payload.(*irma.PushPayload); ok {
+			qr, _, err := irmaServer.StartSession(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")), nil)
+			require.NoError(t, err)
+			p.SessionPtr = qr
+			bts, err := json.Marshal(p)
+			require.NoError(t, err)
+			payload = string(bts)
+		}
+		c := make(chan *SessionResult, 1)
+		client.NewPushSession(payload.(string), origin, TestHandler{t, c, client, nil})
+		return <-c
+	}
+
+	require.Nil(t, push(&irma.PushPayload{Requestor: "localhost"}, "localhost"))
+	require.Nil(t, push(&irma.PushPayload{Requestor: "localhost"}, "LOCALHOST"))
+
+	errorType := func(result *SessionResult) irma.ErrorType {
+		require.NotNil(t, result)
+		serr, ok := result.Err.(*irma.SessionError)
+		require.True(t, ok)
+		return serr.ErrorType
+	}
+
+	// Both the requestor and the host of the session must match the push origin
+	result := push(&irma.PushPayload{Requestor: "localhost"}, "example.com")
+	require.Equal(t, irma.ErrorRequestorMismatch, errorType(result))
+	result = push(&irma.PushPayload{Requestor: "example.com"}, "example.com")
+	require.Equal(t, irma.ErrorRequestorMismatch, errorType(result))
+	result = push(&irma.PushPayload{Requestor: "example.com"}, "localhost")
+	require.Equal(t, irma.ErrorRequestorMismatch, errorType(result))
+
+	result = push(`{"requestor":"localhost"}`, "localhost")
+	require.Equal(t, irma.ErrorSerialization, errorType(result))
+}
@@ -46,20 +46,29 @@ func StopRequestorServer() {
 }
 
 func StartIrmaServer(t *testing.T) {
+	startIrmaServer(t, &server.Configuration{})
+}
+
+// startIrmaServer starts an irmaserver using the specified configuration,
+// completed with the URL, and the schemes and private keys of the tests if not set.
+func startIrmaServer(t *testing.T, conf *server.Configuration) {
 	testdata := test.FindTestdataFolder(t)
 
 	logger := logrus.New()
 	logger.Level = logrus.ErrorLevel
 	logger.Formatter = &logrus.TextFormatter{}
 
-	var err error
-	irmaServer, err = irmaserver.New(&server.Configuration{
-		URL:                   "http://localhost:48680",
-		Logger:                logger,
-		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
-		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
-	})
+	conf.URL = "http://localhost:48680"
+	conf.Logger = logger
+	if conf.SchemesPath == "" {
+		conf.SchemesPath = filepath.Join(testdata, "irma_configuration")
+	}
+	if conf.IssuerPrivateKeysPath == "" {
+		conf.IssuerPrivateKeysPath = filepath.Join(testdata, "privatekeys")
+	}
 
+	var err error
+	irmaServer, err = irmaserver.New(conf)
 	require.NoError(t, err)
 
 	mux := http.NewServeMux()
@@ -2,11 +2,16 @@ package sessiontest
 
 import (
 	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/require"
 )
 
@@ -45,6 +50,23 @@ func TestDefaultCredentialValidity(t *testing.T) {
 	sessionHelper(t, request, "issue", client)
 }
 
+func TestCoarsenedSigningDate(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	request := getIssuanceRequest(false)
+	request.Credentials[0].SigningDatePrecision = 8
+	sessionHelper(t, request, "issue", client)
+
+	var info *irma.CredentialInfo
+	for _, ci := range client.CredentialInfoList() {
+		if time.Time(ci.Expires).Equal(time.Time(*request.Credentials[0].Validity)) {
+			info = ci
+		}
+	}
+	require.NotNil(t, info)
+	require.Zero(t, time.Time(info.SignedOn).Unix()%(8*irma.ExpiryFactor))
+}
+
 func TestIssuanceOptionalEmptyAttributes(t *testing.T) {
 	req := getNameIssuanceRequest()
 	sessionHelper(t, req, "issue", nil)
@@ -264,3 +286,89 @@ func TestDownloadSchemeManager(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, exists)
 }
+
+func TestInsecureSessionURL(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	c := make(chan *SessionResult, 1)
+	qr, err := json.Marshal(&irma.Qr{Type: irma.ActionDisclosing, URL: "http://example.com/irma/session/token"})
+	require.NoError(t, err)
+	require.Nil(t, client.NewSession(string(qr), TestHandler{t, c, client, nil}))
+	result := <-c
+	require.NotNil(t, result)
+	serr, ok := result.Err.(*irma.SessionError)
+	require.True(t, ok)
+	require.Equal(t, irma.ErrorInsecureURL, serr.ErrorType)
+
+	qr, err = json.Marshal(&irma.SchemeManagerRequest{Type: irma.ActionSchemeManager, URL: "http://example.com/irma-demo"})
+	require.NoError(t, err)
+	client.NewSession(string(qr), TestHandler{t, c, client, nil})
+	result = <-c
+	require.NotNil(t, result)
+	require.Equal(t, irma.ErrorInsecureURL, result.Err.(*irma.SessionError).ErrorType)
+}
+
+// confirmationCodeHandler retrieves the confirmation code of the session from the requestor endpoints
+// of the server, passing it along with the code shown to the user (see irmaclient.RequestorHandler)
+// to the codes channel. It also checks that the code is not available to the client.
+type confirmationCodeHandler struct {
+	TestHandler
+	url       string
+	clienturl string
+	codes     chan []string
+}
+
+func (h confirmationCodeHandler) RequestIssuancePermissionFrom(request irma.IssuanceRequest, requestor *irmaclient.SessionRequestor, callback irmaclient.PermissionHandler) {
+	if _, err := irma.NewHTTPTransport(h.clienturl).GetBytes("confirmation"); err == nil {
+		h.Failure(&irma.SessionError{Err: errors.New("confirmation code available to client")})
+		return
+	}
+	var code string
+	bts, err := irma.NewHTTPTransport(h.url).GetBytes("confirmation")
+	if err == nil {
+		err = json.Unmarshal(bts, &code)
+	}
+	if err != nil {
+		h.Failure(&irma.SessionError{Err: err})
+		return
+	}
+	h.codes <- []string{requestor.ConfirmationCode, code}
+	h.TestHandler.RequestIssuancePermission(request, requestor.Name, callback)
+}
+func (h confirmationCodeHandler) RequestVerificationPermissionFrom(request irma.DisclosureRequest, requestor *irmaclient.SessionRequestor, callback irmaclient.PermissionHandler) {
+	h.TestHandler.RequestVerificationPermission(request, requestor.Name, callback)
+}
+func (h confirmationCodeHandler) RequestSignaturePermissionFrom(request irma.SignatureRequest, requestor *irmaclient.SessionRequestor, callback irmaclient.PermissionHandler) {
+	h.TestHandler.RequestSignaturePermission(request, requestor.Name, callback)
+}
+
+func TestDeepLinkSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	var sesPkg server.SessionPackage
+	err := irma.NewHTTPTransport("http://localhost:48682").
+		Post("session", &sesPkg, getJwt(t, getIssuanceRequest(true), "issue", jwt.SigningMethodRS256))
+	require.NoError(t, err)
+	qrjson, err := json.Marshal(sesPkg.SessionPtr)
+	require.NoError(t, err)
+
+	c := make(chan *SessionResult)
+	codes := make(chan []string, 1)
+	h := confirmationCodeHandler{
+		TestHandler: TestHandler{t, c, client, nil},
+		url:         "http://localhost:48682/session/" + sesPkg.Token,
+		clienturl:   sesPkg.SessionPtr.URL,
+		codes:       codes,
+	}
+	client.NewDeepLinkSession(string(qrjson), h)
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+	code := <-codes
+	require.Len(t, code[0], 6)
+	require.Equal(t, code[0], code[1])
+}
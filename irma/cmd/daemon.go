@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/privacybydesign/irmago/irmaclient/daemon"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon storage-path [irma_configuration-path]",
+	Short: "Run an IRMA client controlled over a local HTTP API",
+	Long: `Run an IRMA client as a daemon that is controlled over an HTTP API on localhost.
+
+The client stores its credentials in the specified storage directory, which is created if it
+does not exist. Applications can list credentials, start sessions from session pointers, and
+answer the permission and PIN prompts of sessions through the API. All requests must include
+the token that is printed on startup in an "Authorization: Bearer <token>" header.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		port, _ := flags.GetInt("port")
+		listenAddress, _ := flags.GetString("listen-addr")
+		token, _ := flags.GetString("token")
+		verbosity, _ := flags.GetCount("verbose")
+
+		irmaconf := server.DefaultSchemesPath()
+		if len(args) > 1 {
+			irmaconf = args[1]
+		}
+		if irmaconf == "" {
+			die("Failed to determine default irma_configuration path", nil)
+		}
+
+		logger := logrus.New()
+		logger.Level = server.Verbosity(verbosity)
+		d, err := daemon.New(&daemon.Configuration{
+			StoragePath:           args[0],
+			IrmaConfigurationPath: irmaconf,
+			ListenAddress:         listenAddress,
+			Port:                  port,
+			Token:                 token,
+			Logger:                logger,
+		})
+		if err != nil {
+			die("Failed to start client", err)
+		}
+		if token == "" {
+			fmt.Println("Token:", d.Token())
+		}
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-stop
+			d.Stop()
+		}()
+		if err = d.Start(); err != nil {
+			die("Failed to listen", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(daemonCmd)
+
+	flags := daemonCmd.Flags()
+	flags.SortFlags = false
+	flags.IntP("port", "p", daemon.DefaultPort, "port to listen at")
+	flags.StringP("listen-addr", "l", "127.0.0.1", "address to listen at")
+	flags.String("token", "", "token that API requests must include (default: random)")
+	flags.CountP("verbose", "v", "verbose (repeatable)")
+}
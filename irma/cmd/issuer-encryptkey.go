@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// issuerEncryptKeyCmd represents the encrypt-key command
+var issuerEncryptKeyCmd = &cobra.Command{
+	Use:   "encrypt-key issuer privatekey output",
+	Short: "Encrypt an IRMA issuer private key using a key in an HSM or KMS",
+	Long: `Encrypt an IRMA issuer private key using a key in an HSM or KMS
+
+The encrypt-key command encrypts the private key of the specified issuer (e.g. irma-demo.MijnOverheid)
+using a random data key, which is encrypted by a key in one of the following, and writes the result to
+"output" (which should have the .json extension):
+ - the transit secrets engine of a HashiCorp Vault server (--vault-url, --vault-transit-key),
+   authenticating with the token in --vault-token-file or $VAULT_TOKEN;
+ - an HSM through its PKCS#11 library (--pkcs11-module, --pkcs11-token, --pkcs11-key),
+   logging in with the PIN in --pkcs11-pin-file or $PKCS11_PIN;
+ - Google Cloud KMS (--gcp-kms-key), authenticating with the access token in --gcp-token-file
+   or $GOOGLE_OAUTH_ACCESS_TOKEN.
+
+The IRMA server decrypts the private keys in the directory passed using the --privkeys-encrypted option
+in memory at startup, so that the raw private key never resides on the disk of the server. After
+encrypting, the private key file should be removed.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		overwrite, _ := flags.GetBool("force-overwrite")
+		encrypter, err := keyCipher(flags)
+		if err != nil {
+			return err
+		}
+		if closer, ok := encrypter.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		sk, err := gabi.NewPrivateKeyFromFile(args[1])
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read private key", 0)
+		}
+		if !overwrite {
+			if exists, err := fs.PathExists(args[2]); err != nil || exists {
+				return errors.New("output file already exists, will not overwrite (force with -f flag)")
+			}
+		}
+		esk, err := server.EncryptPrivateKey(irma.NewIssuerIdentifier(args[0]), sk, encrypter)
+		if err != nil {
+			return err
+		}
+		bts, err := json.MarshalIndent(esk, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(args[2], bts, 0600); err != nil {
+			return err
+		}
+		fmt.Println("Wrote", args[2])
+		return nil
+	},
+}
+
+// keyCipher returns the HSM or KMS specified by the flags.
+func keyCipher(flags *pflag.FlagSet) (server.KeyCipher, error) {
+	settings := &server.KeyCipherSettings{}
+	settings.VaultURL, _ = flags.GetString("vault-url")
+	settings.VaultTransitKey, _ = flags.GetString("vault-transit-key")
+	settings.PKCS11Module, _ = flags.GetString("pkcs11-module")
+	settings.PKCS11Token, _ = flags.GetString("pkcs11-token")
+	settings.PKCS11Key, _ = flags.GetString("pkcs11-key")
+	settings.GoogleCloudKMSKey, _ = flags.GetString("gcp-kms-key")
+
+	var err error
+	if settings.VaultURL != "" {
+		if settings.VaultToken, err = readSecret(flags, "vault-token-file", "VAULT_TOKEN"); err != nil {
+			return nil, err
+		}
+	}
+	if settings.PKCS11Module != "" {
+		if settings.PKCS11PIN, err = readSecret(flags, "pkcs11-pin-file", "PKCS11_PIN"); err != nil {
+			return nil, err
+		}
+	}
+	if settings.GoogleCloudKMSKey != "" {
+		if settings.GoogleCloudKMSToken, err = readSecret(flags, "gcp-token-file", "GOOGLE_OAUTH_ACCESS_TOKEN"); err != nil {
+			return nil, err
+		}
+	}
+	return settings.Cipher()
+}
+
+// readSecret reads a secret from the file specified by the flag, or else from the environment variable.
+func readSecret(flags *pflag.FlagSet, flag, env string) (string, error) {
+	path, _ := flags.GetString(flag)
+	if path == "" {
+		return os.Getenv(env), nil
+	}
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.WrapPrefix(err, "Failed to read --"+flag, 0)
+	}
+	return strings.TrimSpace(string(bts)), nil
+}
+
+func init() {
+	issuerCmd.AddCommand(issuerEncryptKeyCmd)
+
+	flags := issuerEncryptKeyCmd.Flags()
+	flags.String("vault-url", "", "URL of the HashiCorp Vault server")
+	flags.String("vault-token-file", "", "File containing the Vault token (default: $VAULT_TOKEN)")
+	flags.String("vault-transit-key", "", "Name of the key in the Vault transit secrets engine")
+	flags.String("pkcs11-module", "", "Path to the PKCS#11 library of the HSM (requires building with the pkcs11 tag)")
+	flags.String("pkcs11-token", "", "Label of the PKCS#11 token")
+	flags.String("pkcs11-pin-file", "", "File containing the PIN of the PKCS#11 token (default: $PKCS11_PIN)")
+	flags.String("pkcs11-key", "", "Label of the AES key in the PKCS#11 token")
+	flags.String("gcp-kms-key", "", "Resource name of the Google Cloud KMS key")
+	flags.String("gcp-token-file", "", "File containing the Google Cloud access token (default: $GOOGLE_OAUTH_ACCESS_TOKEN)")
+	flags.BoolP("force-overwrite", "f", false, "Force overwriting of output file if it already exists")
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+// issuerSplitKeyCmd represents the split-key command
+var issuerSplitKeyCmd = &cobra.Command{
+	Use:   "split-key issuer privatekey [outputdir]",
+	Short: "Split an IRMA issuer private key into shares",
+	Long: `Split an IRMA issuer private key into shares
+
+The split-key command splits the private key of the specified issuer (e.g. irma-demo.MijnOverheid)
+into a number of shares using Shamir secret sharing, of which a threshold amount is required to
+reassemble the private key. The shares are written to "outputdir" (default the current directory)
+as $issuer-$counter-$index.json, to be handed out to different operators.
+
+The IRMA server reassembles the private key in memory at startup from the shares passed using the
+--privkey-shares and --privkey-shares-stdin options, so that no single operator needs to hold the
+full private key. After splitting, the private key file should be removed.`,
+	Args: cobra.RangeArgs(2, 3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		threshold, _ := flags.GetInt("threshold")
+		count, _ := flags.GetInt("shares")
+		overwrite, _ := flags.GetBool("force-overwrite")
+
+		issuer := irma.NewIssuerIdentifier(args[0])
+		sk, err := gabi.NewPrivateKeyFromFile(args[1])
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read private key", 0)
+		}
+		outdir := "."
+		if len(args) == 3 {
+			outdir = args[2]
+		}
+		if err = fs.EnsureDirectoryExists(outdir); err != nil {
+			return errors.WrapPrefix(err, "Failed to create "+outdir, 0)
+		}
+
+		shares, err := server.SplitPrivateKey(issuer, sk, threshold, count)
+		if err != nil {
+			return err
+		}
+		for _, share := range shares {
+			filename := filepath.Join(outdir, fmt.Sprintf("%s-%d-%d.json", issuer, share.Counter, share.Index))
+			if !overwrite {
+				if exists, err := fs.PathExists(filename); err != nil || exists {
+					return errors.Errorf("share file %s already exists, will not overwrite (force with -f flag)", filename)
+				}
+			}
+			bts, err := json.Marshal(share)
+			if err != nil {
+				return err
+			}
+			if err = ioutil.WriteFile(filename, append(bts, '\n'), 0600); err != nil {
+				return err
+			}
+			fmt.Println("Wrote", filename)
+		}
+		return nil
+	},
+}
+
+func init() {
+	issuerCmd.AddCommand(issuerSplitKeyCmd)
+
+	issuerSplitKeyCmd.Flags().IntP("threshold", "t", 2, "Amount of shares required to reassemble the private key")
+	issuerSplitKeyCmd.Flags().IntP("shares", "n", 3, "Amount of shares to create")
+	issuerSplitKeyCmd.Flags().BoolP("force-overwrite", "f", false, "Force overwriting of share files if files already exist")
+}
@@ -3,8 +3,10 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -31,6 +33,10 @@ var requestCmd = &cobra.Command{
 
 		flags := cmd.Flags()
 		authmethod, _ := flags.GetString("authmethod")
+		if qr, _ := flags.GetBool("qr"); qr {
+			printRequestQr(request.SessionRequest())
+			return
+		}
 		var output string
 		if authmethod == "none" || authmethod == "token" {
 			output = prettyprint(request)
@@ -129,9 +135,10 @@ func constructSessionRequest(cmd *cobra.Command, conf *irma.Configuration) (irma
 	issue, _ := cmd.Flags().GetStringArray("issue")
 	sign, _ := cmd.Flags().GetStringArray("sign")
 	message, _ := cmd.Flags().GetString("message")
+	file, _ := cmd.Flags().GetString("file")
 	jsonrequest, _ := cmd.Flags().GetString("request")
 
-	if len(disclose) == 0 && len(issue) == 0 && len(sign) == 0 && message == "" {
+	if len(disclose) == 0 && len(issue) == 0 && len(sign) == 0 && message == "" && file == "" {
 		if jsonrequest == "" {
 			return nil, errors.New("Provide either a complete session request using --request or construct one using the other flags")
 		}
@@ -153,8 +160,11 @@ func constructSessionRequest(cmd *cobra.Command, conf *irma.Configuration) (irma
 		if len(issue) != 0 {
 			return nil, errors.New("cannot combine issuance and signature sessions, use either --issue or --sign")
 		}
-		if message == "" {
-			return nil, errors.New("signature sessions require a message to be signed using --message")
+		if message == "" && file == "" {
+			return nil, errors.New("signature sessions require a message or file to be signed using --message or --file")
+		}
+		if message != "" && file != "" {
+			return nil, errors.New("cannot sign both a message and a file, use either --message or --file")
 		}
 	}
 
@@ -177,6 +187,12 @@ func constructSessionRequest(cmd *cobra.Command, conf *irma.Configuration) (irma
 		if err != nil {
 			return nil, err
 		}
+		var signedFile *irma.SignedFile
+		if file != "" {
+			if signedFile, err = readSignedFile(file); err != nil {
+				return nil, err
+			}
+		}
 		request = &irma.SignatureRequestorRequest{
 			Request: &irma.SignatureRequest{
 				DisclosureRequest: irma.DisclosureRequest{
@@ -184,6 +200,7 @@ func constructSessionRequest(cmd *cobra.Command, conf *irma.Configuration) (irma
 					Content:     disjunctions,
 				},
 				Message: message,
+				File:    signedFile,
 			},
 		}
 	}
@@ -280,16 +297,36 @@ func printQr(qr *irma.Qr, noqr bool) error {
 	if noqr {
 		fmt.Println(string(qrBts))
 	} else {
-		qrterminal.GenerateWithConfig(string(qrBts), qrterminal.Config{
-			Level:     qrterminal.L,
-			Writer:    os.Stdout,
-			BlackChar: qrterminal.BLACK,
-			WhiteChar: qrterminal.WHITE,
-		})
+		if _, err := irma.CheckQrSize(qr, irma.QrLevelL); err != nil {
+			logger.Warn(err.Error())
+		}
+		drawQr(qrBts)
 	}
 	return nil
 }
 
+// printRequestQr draws a QR containing the session request, for a manual session,
+// if the session request fits in a scannable QR.
+func printRequestQr(request irma.SessionRequest) {
+	if _, err := irma.CheckQrSize(request, irma.QrLevelL); err != nil {
+		die("Session request too large for a QR (start a session at an IRMA server using \"irma session\" instead)", err)
+	}
+	bts, err := json.Marshal(request)
+	if err != nil {
+		die("Failed to serialize session request", err)
+	}
+	drawQr(bts)
+}
+
+func drawQr(contents []byte) {
+	qrterminal.GenerateWithConfig(string(contents), qrterminal.Config{
+		Level:     qrterminal.L,
+		Writer:    os.Stdout,
+		BlackChar: qrterminal.BLACK,
+		WhiteChar: qrterminal.WHITE,
+	})
+}
+
 func printSessionResult(result *server.SessionResult) {
 	fmt.Println("Session result:")
 	fmt.Println(prettyprint(result))
@@ -302,6 +339,7 @@ func init() {
 	flags.SortFlags = false
 
 	addRequestFlags(flags)
+	flags.Bool("qr", false, "Draw the session request in a QR for a manual session, instead of printing it")
 }
 
 func addRequestFlags(flags *pflag.FlagSet) {
@@ -313,4 +351,18 @@ func addRequestFlags(flags *pflag.FlagSet) {
 	flags.StringArray("issue", nil, "Add a credential to issue")
 	flags.StringArray("sign", nil, "Add an attribute disjunction to signature session")
 	flags.String("message", "", "Message to sign in signature session")
+	flags.String("file", "", "File whose SHA-256 digest to sign in signature session")
+}
+
+func readSignedFile(path string) (*irma.SignedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return irma.NewSignedFile(filepath.Base(path), contentType, f)
 }
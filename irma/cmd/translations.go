@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+var translationsCmd = &cobra.Command{
+	Use:   "translations [path]",
+	Short: "Report missing translations in a scheme",
+	Long: `The translations command parses the scheme at the specified path, or the current directory if not specified, and reports per language the translations that are missing from the scheme, its issuers, credential types and attributes. The signature of the scheme is not verified, so that schemes can be checked before they are signed.
+
+By default all languages occurring in the scheme are checked; use --language to check specific languages. The exit status is nonzero if translations are missing.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		var path string
+		if len(args) > 0 {
+			path = args[0]
+		} else {
+			if path, err = os.Getwd(); err != nil {
+				die("", err)
+			}
+		}
+		langs, _ := cmd.Flags().GetStringSlice("language")
+
+		missing, err := missingTranslations(path, langs)
+		if err != nil {
+			die("Failed to check translations", err)
+		}
+
+		sorted := make([]string, 0, len(missing))
+		for lang := range missing {
+			sorted = append(sorted, lang)
+		}
+		sort.Strings(sorted)
+		complete := true
+		for _, lang := range sorted {
+			if len(missing[lang]) == 0 {
+				fmt.Printf("%s: complete\n", lang)
+				continue
+			}
+			complete = false
+			fmt.Printf("%s: %d missing\n", lang, len(missing[lang]))
+			for _, m := range missing[lang] {
+				fmt.Println("  " + m.String())
+			}
+		}
+		if !complete {
+			os.Exit(1)
+		}
+	},
+}
+
+func missingTranslations(path string, langs []string) (map[string][]irma.MissingTranslation, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := irma.NewConfigurationReadOnly(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	scheme := irma.NewSchemeManager(filepath.Base(path))
+	if err = conf.ParseUnsignedSchemeManagerFolder(path, scheme); err != nil {
+		return nil, err
+	}
+	return conf.MissingTranslations(scheme.Identifier(), langs...)
+}
+
+func init() {
+	schemeCmd.AddCommand(translationsCmd)
+
+	translationsCmd.Flags().StringSliceP("language", "l", nil, "languages to check (default all languages in the scheme)")
+}
@@ -1,12 +1,18 @@
 package irma
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"log"
 	gobig "math/big"
+	"time"
 
 	"github.com/bwesterb/go-atum"
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 )
@@ -19,11 +25,95 @@ type SignedMessage struct {
 	Nonce     *big.Int                  `json:"nonce"`
 	Context   *big.Int                  `json:"context"`
 	Message   string                    `json:"message"`
+	File      *SignedFile               `json:"file,omitempty"`
 	Timestamp *atum.Timestamp           `json:"timestamp"`
+
+	// Timestamps added later by Retimestamp(), for long-term verifiability
+	ArchiveTimestamps []*atum.Timestamp `json:"archiveTimestamps,omitempty"`
+}
+
+// SignedFile identifies a file by its SHA-256 digest, along with metadata to be shown to the user.
+// A signature over a SignedFile (see SignatureRequest.File) signs the digest as well as the metadata.
+type SignedFile struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	Digest      string `json:"sha256"` // hex-encoded
+}
+
+// NewSignedFile reads the file contents from r and returns a SignedFile containing its digest and size.
+func NewSignedFile(name, contentType string, r io.Reader) (*SignedFile, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedFile{
+		Name:        name,
+		Size:        size,
+		ContentType: contentType,
+		Digest:      hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func (f *SignedFile) Validate() error {
+	digest, err := hex.DecodeString(f.Digest)
+	if err != nil || len(digest) != sha256.Size {
+		return errors.New("File digest is not a hex-encoded SHA-256 hash")
+	}
+	if f.Size < 0 {
+		return errors.New("File size is negative")
+	}
+	return nil
+}
+
+// Matches checks that the file contents read from r match the digest and size of this SignedFile.
+func (f *SignedFile) Matches(r io.Reader) (bool, error) {
+	other, err := NewSignedFile(f.Name, f.ContentType, r)
+	if err != nil {
+		return false, err
+	}
+	expected, err := hex.DecodeString(f.Digest)
+	if err != nil {
+		return false, nil
+	}
+	actual, _ := hex.DecodeString(other.Digest)
+	return other.Size == f.Size && bytes.Equal(expected, actual), nil
+}
+
+// message returns the string that is signed in place of a message when signing a file.
+func (f *SignedFile) message() string {
+	bts, _ := json.Marshal(f) // cannot fail, all fields are strings or integers
+	return string(bts)
+}
+
+// signedMessage returns the message that is signed: the message itself or, when signing a file,
+// the file digest and metadata.
+func signedMessage(message string, file *SignedFile) string {
+	if file != nil {
+		return file.message()
+	}
+	return message
 }
 
 func (sm *SignedMessage) GetNonce() *big.Int {
-	return ASN1ConvertSignatureNonce(sm.Message, sm.Nonce, sm.Timestamp)
+	return ASN1ConvertSignatureNonce(signedMessage(sm.Message, sm.File), sm.Nonce, sm.Timestamp)
+}
+
+// VerifyFile checks that the file contents read from r are the file signed by this signature.
+// Note that this does not verify the signature itself, for that use Verify().
+func (sm *SignedMessage) VerifyFile(r io.Reader) error {
+	if sm.File == nil {
+		return errors.New("Signature is not over a file")
+	}
+	match, err := sm.File.Matches(r)
+	if err != nil {
+		return err
+	}
+	if !match {
+		return errors.New("File does not match signed digest")
+	}
+	return nil
 }
 
 func (sm *SignedMessage) MatchesNonceAndContext(request *SignatureRequest) bool {
@@ -59,3 +149,40 @@ func ASN1ConvertSignatureNonce(message string, nonce *big.Int, timestamp *atum.T
 	asn1hash := sha256.Sum256(asn1bytes)
 	return new(big.Int).SetBytes(asn1hash[:])
 }
+
+// ASN1ConvertRecipientsNonce computes the nonce that is used in the creation of disclosure proofs
+// that are delivered to multiple recipients:
+//    nonce = SHA256(serverNonce, recipientName1, recipientNonce1, recipientName2, ...)
+func ASN1ConvertRecipientsNonce(nonce *big.Int, recipients []*DisclosureRecipient) *big.Int {
+	n := nonce.Value()
+	if n == nil {
+		n = gobig.NewInt(0)
+	}
+	tohash := []interface{}{n}
+	for _, recipient := range recipients {
+		rn := recipient.Nonce.Value()
+		if rn == nil {
+			rn = gobig.NewInt(0)
+		}
+		tohash = append(tohash, []byte(recipient.Name), rn)
+	}
+	// Cannot fail: all elements are integers or byte slices (unlike strings, which must be valid UTF-8)
+	asn1bytes, _ := asn1.Marshal(tohash)
+	asn1hash := sha256.Sum256(asn1bytes)
+	return new(big.Int).SetBytes(asn1hash[:])
+}
+
+// ASN1ConvertWindowNonce computes the nonce that is used in the creation of the disclosure proofs
+// of a disclosure token:
+//    nonce = SHA256(serverNonce, notBefore, notAfter)
+// where notBefore and notAfter are the bounds of the validity window as Unix timestamps.
+func ASN1ConvertWindowNonce(nonce *big.Int, window *DisclosureWindow) *big.Int {
+	n := nonce.Value()
+	if n == nil {
+		n = gobig.NewInt(0)
+	}
+	tohash := []interface{}{n, time.Time(window.NotBefore).Unix(), time.Time(window.NotAfter).Unix()}
+	asn1bytes, _ := asn1.Marshal(tohash) // cannot fail, all elements are integers
+	asn1hash := sha256.Sum256(asn1bytes)
+	return new(big.Int).SetBytes(asn1hash[:])
+}
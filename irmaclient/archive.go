@@ -0,0 +1,154 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the archive of credentials. Archived credentials are retained in storage,
+// along with their signatures, but they are not used in sessions: they are excluded from
+// Candidates() and CredentialInfoList(). This is useful for keeping proof of past attributes
+// (e.g. of expired credentials) without cluttering the disclosure choices of the user.
+// Archived credentials can be restored, after which they are used in sessions again.
+
+// ArchiveCredential archives the specified credential.
+//
+// Deprecated: the index of a credential changes when other credentials are removed; use
+// ArchiveCredentialByHash instead.
+func (client *Client) ArchiveCredential(id irma.CredentialTypeIdentifier, index int) error {
+	deprecated("Client.ArchiveCredential", "Client.ArchiveCredentialByHash")
+	return client.archiveAndStore(id, index)
+}
+
+func (client *Client) archiveAndStore(id irma.CredentialTypeIdentifier, index int) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
+	if err := client.archive(id, index); err != nil {
+		return err
+	}
+	return client.storeArchive()
+}
+
+// ArchiveCredentialByHash archives the specified credential.
+func (client *Client) ArchiveCredentialByHash(hash string) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
+	id, index, found := findAttributeList(client.attributes, hash)
+	if !found {
+		return errors.Errorf("Can't archive credential %s: no such credential", hash)
+	}
+	if err := client.archive(id, index); err != nil {
+		return err
+	}
+	return client.storeArchive()
+}
+
+// RestoreCredentialByHash moves the specified credential out of the archive,
+// so that it is used in sessions again.
+func (client *Client) RestoreCredentialByHash(hash string) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
+	id, index, found := findAttributeList(client.archived, hash)
+	if !found {
+		return errors.Errorf("Can't restore credential %s: no such archived credential", hash)
+	}
+	attrs := client.archived[id][index]
+	if ct := attrs.CredentialType(); ct != nil && ct.IsSingleton && len(client.attributes[id]) > 0 {
+		return errors.Errorf("Can't restore credential %s: singleton credential type %s already present", hash, id)
+	}
+	if ct := attrs.CredentialType(); ct != nil && !ct.IsSingleton && ct.MaxInstances > 0 && len(client.attributes[id]) >= ct.MaxInstances {
+		return errors.Errorf("Can't restore credential %s: maximum amount of instances of %s already present", hash, id)
+	}
+
+	client.archived[id] = append(client.archived[id][:index], client.archived[id][index+1:]...)
+	client.attributes[id] = append(client.attributes[id], attrs)
+	return client.storeArchive()
+}
+
+// RemoveArchivedCredentialByHash permanently removes the specified credential from the archive.
+func (client *Client) RemoveArchivedCredentialByHash(hash string) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
+	id, index, found := findAttributeList(client.archived, hash)
+	if !found {
+		return errors.Errorf("Can't remove credential %s: no such archived credential", hash)
+	}
+	attrs := client.archived[id][index]
+	client.archived[id] = append(client.archived[id][:index], client.archived[id][index+1:]...)
+	if err := client.storage.StoreArchive(client.archived); err != nil {
+		return err
+	}
+	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{id: attrs.Strings()}
+	if err := client.discardCredential(attrs, nil); err != nil {
+		return err
+	}
+	return client.addLogEntry(&LogEntry{
+		Type:    actionRemoval,
+		Time:    irma.Timestamp(time.Now()),
+		Removed: removed,
+	})
+}
+
+// ArchivedCredentialInfoList returns a list of information of all archived credentials.
+func (client *Client) ArchivedCredentialInfoList() irma.CredentialInfoList {
+	client.ensureAttributesOrWarn()
+	list := irma.CredentialInfoList([]*irma.CredentialInfo{})
+	for _, attrlistlist := range client.archived {
+		for _, attrlist := range attrlistlist {
+			if info := attrlist.Info(); info != nil {
+				list = append(list, info)
+			}
+		}
+	}
+	return list
+}
+
+// archive moves the specified credential into the archive, without storing the result.
+func (client *Client) archive(id irma.CredentialTypeIdentifier, index int) error {
+	list, exists := client.attributes[id]
+	if !exists || index >= len(list) {
+		return errors.Errorf("Can't archive credential %s-%d: no such credential", id.String(), index)
+	}
+	attrs := list[index]
+	client.attributes[id] = append(list[:index], list[index+1:]...)
+	client.archived[id] = append(client.archived[id], attrs)
+
+	// The credentials cache is indexed by position within client.attributes[id], which has changed
+	delete(client.credentialsCache, id)
+	return nil
+}
+
+// storeArchive stores the active and archived attributes after a change in the archive.
+func (client *Client) storeArchive() error {
+	if err := client.storage.StoreAttributes(client.attributes); err != nil {
+		return err
+	}
+	return client.storage.StoreArchive(client.archived)
+}
+
+// hasCredential returns whether the client holds the specified credential, possibly archived.
+func (client *Client) hasCredential(hash string) bool {
+	for _, lists := range []map[irma.CredentialTypeIdentifier][]*irma.AttributeList{client.attributes, client.archived} {
+		if _, _, found := findAttributeList(lists, hash); found {
+			return true
+		}
+	}
+	return false
+}
+
+func findAttributeList(lists map[irma.CredentialTypeIdentifier][]*irma.AttributeList, hash string) (irma.CredentialTypeIdentifier, int, bool) {
+	for id, attrlistlist := range lists {
+		for index, attrs := range attrlistlist {
+			if attrs.Hash() == hash {
+				return id, index, true
+			}
+		}
+	}
+	return irma.CredentialTypeIdentifier{}, 0, false
+}
@@ -0,0 +1,47 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// RequestAttestation submits the attribute-based signature to the /attestation endpoint of the IRMA
+// server at the specified URL (see irma.AttestationRequest), and starts the issuance session of the
+// credential attesting to the signature that the server returns. The signature must be timestamped;
+// signatures from the logs can be obtained using LogEntry.GetSignedMessage().
+// Contacting the server happens before this function returns; if it fails, the Failure method of the
+// handler is called and nil is returned.
+func (client *Client) RequestAttestation(serverURL string, signature *irma.SignedMessage, handler Handler) SessionDismisser {
+	if err := client.checkUnlocked(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorWalletLocked, Err: err})
+		return nil
+	}
+	request := &irma.AttestationRequest{Signature: signature}
+	if err := request.Validate(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return nil
+	}
+
+	if err := client.Configuration.CheckSessionURL(serverURL); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInsecureURL, Err: err, Info: serverURL})
+		return nil
+	}
+
+	qr := &irma.Qr{}
+	if err := irma.NewHTTPTransport(serverURL).Post("attestation", qr, request); err != nil {
+		if serr, ok := err.(*irma.SessionError); ok {
+			handler.Failure(serr)
+		} else {
+			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorTransport, Err: err})
+		}
+		return nil
+	}
+	if err := qr.Validate(); err != nil || irma.Action(qr.Type) != irma.ActionIssuing {
+		handler.Failure(&irma.SessionError{
+			ErrorType: irma.ErrorServerResponse,
+			Err:       errors.New("Attestation server did not return an issuance session"),
+		})
+		return nil
+	}
+	return client.newQrSession(qr, handler, "")
+}
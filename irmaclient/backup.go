@@ -0,0 +1,208 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"golang.org/x/crypto/scrypt"
+)
+
+// This file contains the export of the wallet to an encrypted backup, and its restoration into new
+// storage, e.g. on a new phone. The backup contains the secret key, the credentials (including
+// archived ones) with their signatures and provenance, the keyshare server registrations, and the
+// logs. It is encrypted using AES-GCM with a key derived from a passphrase using scrypt. The backup
+// starts with the unencrypted backupMagic, the version of its format and the salt of the passphrase,
+// which are authenticated along with the encrypted contents.
+
+var (
+	// ErrIncorrectBackupPassphrase is returned by RestoreBackup() if the passphrase is incorrect,
+	// or if the backup has been tampered with.
+	ErrIncorrectBackupPassphrase = errors.New("Incorrect backup passphrase or corrupted backup")
+	// ErrStorageNotEmpty is returned by RestoreBackup() if the storage already contains a wallet.
+	ErrStorageNotEmpty = errors.New("Storage already contains a wallet")
+)
+
+const (
+	backupMagic    = "IRMABACKUP"
+	backupVersion  = 1
+	backupSaltSize = 32
+)
+
+// backupContents is the encrypted contents of a backup.
+type backupContents struct {
+	SecretKey       *secretKey                                       `json:"secretKey"`
+	Attributes      []*irma.AttributeList                            `json:"attributes"`
+	Archive         []*irma.AttributeList                            `json:"archive"`
+	Signatures      map[string]*gabi.CLSignature                     `json:"signatures"`
+	KeyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer `json:"keyshareServers"`
+	Logs            []*LogEntry                                      `json:"logs"`
+	Provenance      map[string]*irma.CredentialProvenance            `json:"provenance,omitempty"`
+}
+
+// ExportBackup returns an encrypted backup of the wallet, which can be restored using
+// RestoreBackup() with the same passphrase.
+func (client *Client) ExportBackup(passphrase string) ([]byte, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, errors.New("Backup passphrase must not be empty")
+	}
+
+	// The backup must be restorable on other devices, so it contains the unwrapped secret key
+	key, err := client.unwrappedSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	contents := &backupContents{
+		SecretKey:       &secretKey{Key: key},
+		Attributes:      []*irma.AttributeList{},
+		Archive:         []*irma.AttributeList{},
+		Signatures:      map[string]*gabi.CLSignature{},
+		KeyshareServers: client.keyshareServers,
+		Provenance:      client.provenanceCopy(),
+	}
+	for _, attrlistlist := range client.attributes {
+		contents.Attributes = append(contents.Attributes, attrlistlist...)
+	}
+	for _, attrlistlist := range client.archived {
+		contents.Archive = append(contents.Archive, attrlistlist...)
+	}
+	for _, list := range [][]*irma.AttributeList{contents.Attributes, contents.Archive} {
+		for _, attrs := range list {
+			sig, err := client.storage.LoadSignature(attrs)
+			if err != nil {
+				return nil, err
+			}
+			contents.Signatures[attrs.Hash()] = sig
+		}
+	}
+	if contents.Logs, err = client.storage.LoadLogs(); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, backupSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte(backupMagic), backupVersion), salt...)
+	backup := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(backup, nonce, plaintext, header), nil
+}
+
+// RestoreBackup restores the encrypted backup, created by ExportBackup(), into the storage at the
+// specified path, after which it can be opened using New(). The storage must not already contain
+// a wallet. Of the options, only the storage locations (see WithStorageLocation()) are used; these
+// must be the same as those passed to New() afterwards.
+func RestoreBackup(storagePath, passphrase string, backup []byte, opts ...Option) (err error) {
+	headerSize := len(backupMagic) + 1 + backupSaltSize
+	if len(backup) < headerSize || !bytes.HasPrefix(backup, []byte(backupMagic)) {
+		return errors.New("Not an IRMA backup")
+	}
+	if version := backup[len(backupMagic)]; version != backupVersion {
+		return errors.Errorf("Unsupported backup version %d", version)
+	}
+	header, salt := backup[:headerSize], backup[len(backupMagic)+1:headerSize]
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	ciphertext := backup[headerSize:]
+	if len(ciphertext) < aead.NonceSize() {
+		return ErrIncorrectBackupPassphrase
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], header)
+	if err != nil {
+		return ErrIncorrectBackupPassphrase
+	}
+	contents := &backupContents{}
+	if err = json.Unmarshal(plaintext, contents); err != nil {
+		return err
+	}
+	if contents.SecretKey == nil || contents.SecretKey.Key == nil {
+		return errors.New("Backup contains no secret key")
+	}
+
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	s := &storage{storagePath: storagePath, locations: o.locations}
+	if err = s.EnsureStorageExists(); err != nil {
+		return err
+	}
+	if err = s.lock(); err != nil {
+		return err
+	}
+	defer s.unlock()
+	if err = s.relocate(); err != nil {
+		return err
+	}
+	existing, err := s.fileExists(skFile)
+	if err != nil {
+		return err
+	}
+	if existing {
+		return ErrStorageNotEmpty
+	}
+
+	// The backup contains everything in the current schema, so no migrations need to be applied
+	if err = s.storeSchema(&storageSchema{Version: currentSchemaVersion()}); err != nil {
+		return err
+	}
+	for hash, sig := range contents.Signatures {
+		if err = s.store(sig, signaturesDir+"/"+hash); err != nil {
+			return err
+		}
+	}
+	if err = s.store(contents.Attributes, attributesFile); err != nil {
+		return err
+	}
+	if err = s.store(contents.Archive, archiveFile); err != nil {
+		return err
+	}
+	if err = s.StoreKeyshareServers(contents.KeyshareServers); err != nil {
+		return err
+	}
+	if err = s.StoreLogs(contents.Logs); err != nil {
+		return err
+	}
+	if len(contents.Provenance) > 0 {
+		if err = s.StoreProvenance(contents.Provenance); err != nil {
+			return err
+		}
+	}
+	// Stored last, so that an interrupted restore can be retried
+	return s.StoreSecretKey(contents.SecretKey)
+}
+
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, walletPinScryptN, walletPinScryptR, walletPinScryptP, storageKeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,252 @@
+package irmaclient
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains automatic backups to a BackupProvider, which the app implements to store the
+// encrypted backups of ExportBackup() in the cloud (e.g. iCloud, Google Drive or WebDAV). Once the app
+// has set the provider and the passphrase of the backups using SetBackupProvider(), the client uploads
+// a backup every BackupInterval days (see SetBackupIntervalPreference()), checking whether one is due
+// when the provider is set and after each backup. The passphrase is only kept in memory, so the app
+// must set the provider each time the client is created. The time and the result of the last backup
+// are stored in the backupStateFile and returned by BackupStatus(). RestoreFromBackupProvider()
+// restores the newest backup, e.g. on a new phone.
+//
+// Automatic backups run in the background, one at a time. As sessions change the credentials, no
+// backup is exported while sessions are running; it is then retried after backupRetrySessions. Once
+// the client is closed, no further backups are made.
+
+// BackupProvider stores backups in the cloud; it is implemented by the app.
+type BackupProvider interface {
+	// Upload stores the backup under the specified name.
+	Upload(name string, backup []byte) error
+	// Download returns the backup stored under the specified name.
+	Download(name string) ([]byte, error)
+	// List returns the names of the stored backups.
+	List() ([]string, error)
+}
+
+// BackupStatus describes the last backup to the BackupProvider.
+type BackupStatus struct {
+	// Time of the last successful backup, nil if none
+	LastBackup *irma.Timestamp `json:"lastBackup,omitempty"`
+	// Error of the last attempt, if it failed
+	LastError string `json:"lastError,omitempty"`
+}
+
+const (
+	backupStateFile  = "backupstate"
+	backupNamePrefix = "irma-backup-"
+	// Names of backups sort chronologically
+	backupNameFormat = "20060102T150405Z"
+
+	// Delays after which failed automatic backups are retried
+	backupRetryFailed   = time.Hour
+	backupRetrySessions = time.Minute
+)
+
+// backupSchedule is the state of automatic backups of the client.
+type backupSchedule struct {
+	sync.Mutex
+	provider   BackupProvider
+	passphrase string
+	timer      *time.Timer
+	stopped    bool
+	// Held while scheduleBackup() runs, so that it runs once at a time
+	running sync.Mutex
+	// Calls of scheduleBackup() started by scheduleBackupInBackground()
+	pending sync.WaitGroup
+}
+
+// SetBackupProvider sets the provider to which backups are uploaded, encrypted with the specified
+// passphrase, and uploads a backup in the background if one is due.
+func (client *Client) SetBackupProvider(provider BackupProvider, passphrase string) {
+	client.backups.Lock()
+	client.backups.provider = provider
+	client.backups.passphrase = passphrase
+	client.backups.Unlock()
+	client.scheduleBackupInBackground()
+}
+
+// SetBackupIntervalPreference sets the amount of days between automatic backups; 0 disables them.
+func (client *Client) SetBackupIntervalPreference(days int) {
+	client.Preferences.BackupInterval = days
+	_ = client.storage.StorePreferences(client.Preferences)
+	client.scheduleBackupInBackground()
+}
+
+// BackupStatus returns the status of the last backup to the BackupProvider.
+func (client *Client) BackupStatus() (*BackupStatus, error) {
+	status := &BackupStatus{}
+	return status, client.storage.load(status, backupStateFile)
+}
+
+// BackupNow uploads a backup to the BackupProvider. It returns ErrSessionsRunning if sessions
+// are running.
+func (client *Client) BackupNow() error {
+	client.backups.Lock()
+	defer client.backups.Unlock()
+	if client.backups.provider == nil {
+		return errors.New("No backup provider set")
+	}
+
+	status, err := client.BackupStatus()
+	if err != nil {
+		return err
+	}
+	now := client.now()
+	backup, err := client.exportBackupIdle(client.backups.passphrase)
+	if err == ErrSessionsRunning {
+		return err
+	}
+	if err == nil {
+		err = client.backups.provider.Upload(backupNamePrefix+now.UTC().Format(backupNameFormat), backup)
+	}
+	if err != nil {
+		irma.Logger.Warn("Backup failed: ", err.Error())
+		status.LastError = err.Error()
+	} else {
+		timestamp := irma.Timestamp(now)
+		status.LastBackup, status.LastError = &timestamp, ""
+	}
+	if storeErr := client.storage.store(status, backupStateFile); storeErr != nil {
+		return storeErr
+	}
+	return err
+}
+
+// exportBackupIdle exports a backup if no sessions are running, preventing sessions from
+// starting meanwhile.
+func (client *Client) exportBackupIdle(passphrase string) ([]byte, error) {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	if client.runningSessions > 0 {
+		return nil, ErrSessionsRunning
+	}
+	return client.ExportBackup(passphrase)
+}
+
+// backupDue returns how long it takes until the next automatic backup is due (zero if it is due
+// now), and false if automatic backups are disabled.
+func (client *Client) backupDue() (time.Duration, bool) {
+	client.backups.Lock()
+	provider := client.backups.provider
+	client.backups.Unlock()
+	if provider == nil || client.Preferences.BackupInterval <= 0 {
+		return 0, false
+	}
+	status, err := client.BackupStatus()
+	if err != nil || status.LastBackup == nil {
+		return 0, true
+	}
+	due := time.Time(*status.LastBackup).AddDate(0, 0, client.Preferences.BackupInterval)
+	if wait := due.Sub(client.now()); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// backupIfDue uploads a backup if one is due, returning whether it did.
+func (client *Client) backupIfDue() (bool, error) {
+	if wait, enabled := client.backupDue(); !enabled || wait > 0 || client.WalletLocked() {
+		return false, nil
+	}
+	return true, client.BackupNow()
+}
+
+// scheduleBackupInBackground calls scheduleBackup() in the background.
+func (client *Client) scheduleBackupInBackground() {
+	client.backups.pending.Add(1)
+	go func() {
+		defer client.backups.pending.Done()
+		client.scheduleBackup()
+	}()
+}
+
+// scheduleBackup uploads a backup if one is due, and schedules the next one.
+func (client *Client) scheduleBackup() {
+	client.backups.running.Lock()
+	defer client.backups.running.Unlock()
+	client.backups.Lock()
+	if client.backups.timer != nil {
+		client.backups.timer.Stop()
+		client.backups.timer = nil
+	}
+	stopped := client.backups.stopped
+	client.backups.Unlock()
+	if stopped {
+		return
+	}
+
+	wait, enabled := client.backupDue()
+	if !enabled {
+		return
+	}
+	if wait == 0 {
+		done, err := client.backupIfDue()
+		if done && err == nil {
+			if wait, enabled = client.backupDue(); !enabled {
+				return
+			}
+		}
+		if wait == 0 {
+			// Failed or wallet locked: retry later, or when scheduleBackup() is next called
+			wait = backupRetryFailed
+			if err == ErrSessionsRunning {
+				wait = backupRetrySessions
+			}
+		}
+	}
+	client.backups.Lock()
+	if !client.backups.stopped {
+		client.backups.timer = time.AfterFunc(wait, client.scheduleBackup)
+	}
+	client.backups.Unlock()
+}
+
+// stopBackups stops automatic backups, waiting for a running backup to finish.
+func (client *Client) stopBackups() {
+	client.backups.Lock()
+	client.backups.stopped = true
+	if client.backups.timer != nil {
+		client.backups.timer.Stop()
+		client.backups.timer = nil
+	}
+	client.backups.provider = nil
+	client.backups.Unlock()
+
+	client.backups.pending.Wait()
+	client.backups.running.Lock()
+	client.backups.running.Unlock()
+}
+
+// RestoreFromBackupProvider restores the newest backup stored by the provider into the storage at
+// the specified path, as RestoreBackup().
+func RestoreFromBackupProvider(storagePath, passphrase string, provider BackupProvider, opts ...Option) error {
+	names, err := provider.List()
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, name := range names {
+		if strings.HasPrefix(name, backupNamePrefix) {
+			backups = append(backups, name)
+		}
+	}
+	if len(backups) == 0 {
+		return errors.New("No backups found")
+	}
+	sort.Strings(backups)
+	backup, err := provider.Download(backups[len(backups)-1])
+	if err != nil {
+		return err
+	}
+	return RestoreBackup(storagePath, passphrase, backup, opts...)
+}
@@ -0,0 +1,107 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// ExpiredCredentialsPolicy specifies what happens with credentials after they have expired.
+type ExpiredCredentialsPolicy struct {
+	Action ExpiredCredentialsAction
+	// Amount of days after expiry after which the action is taken
+	Days int
+}
+
+// ExpiredCredentialsAction is an action to take on expired credentials.
+type ExpiredCredentialsAction string
+
+const (
+	// ExpiredCredentialsKeep keeps expired credentials (default)
+	ExpiredCredentialsKeep = ExpiredCredentialsAction("keep")
+	// ExpiredCredentialsArchive moves expired credentials to the archive
+	ExpiredCredentialsArchive = ExpiredCredentialsAction("archive")
+	// ExpiredCredentialsDelete deletes expired credentials
+	ExpiredCredentialsDelete = ExpiredCredentialsAction("delete")
+)
+
+// SetExpiredCredentialsPolicy sets the policy for expired credentials,
+// and applies it immediately using CleanupExpiredCredentials().
+func (client *Client) SetExpiredCredentialsPolicy(policy ExpiredCredentialsPolicy) error {
+	switch policy.Action {
+	case "", ExpiredCredentialsKeep, ExpiredCredentialsArchive, ExpiredCredentialsDelete:
+	default:
+		return errors.Errorf("Unknown expired credentials action %s", policy.Action)
+	}
+	if policy.Days < 0 {
+		return errors.New("Amount of days cannot be negative")
+	}
+	client.Preferences.ExpiredCredentials = policy
+	if err := client.storage.StorePreferences(client.Preferences); err != nil {
+		return err
+	}
+	_, err := client.CleanupExpiredCredentials()
+	return err
+}
+
+// CleanupExpiredCredentials applies the expired credentials policy from the preferences to all
+// credentials, returning the amount of credentials on which action was taken. This is done
+// automatically when the client is created. If any credentials are affected, the UpdateAttributes()
+// method of the ClientHandler is called, and if they are deleted, a log entry is added.
+func (client *Client) CleanupExpiredCredentials() (int, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return 0, err
+	}
+	policy := client.Preferences.ExpiredCredentials
+	if policy.Action != ExpiredCredentialsDelete && policy.Action != ExpiredCredentialsArchive {
+		return 0, nil
+	}
+
+	threshold := client.now().AddDate(0, 0, -policy.Days)
+	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
+	count := 0
+	for id, attrlistlist := range client.attributes {
+		// Iterate backwards so that removals do not affect the indices of the remaining credentials
+		for i := len(attrlistlist) - 1; i >= 0; i-- {
+			attrs := attrlistlist[i]
+			if attrs.CredentialType() == nil || !attrs.Expiry().Before(threshold) {
+				continue
+			}
+			if policy.Action == ExpiredCredentialsArchive {
+				if err := client.archive(id, i); err != nil {
+					return count, err
+				}
+			} else {
+				if err := client.remove(id, i, false); err != nil {
+					return count, err
+				}
+				removed[id] = attrs.Strings()
+			}
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	if policy.Action == ExpiredCredentialsArchive {
+		if err := client.storeArchive(); err != nil {
+			return count, err
+		}
+		client.handler.UpdateAttributes()
+		return count, nil
+	}
+	if err := client.storage.StoreAttributes(client.attributes); err != nil {
+		return count, err
+	}
+	if err := client.addLogEntry(&LogEntry{
+		Type:    actionRemoval,
+		Time:    irma.Timestamp(time.Now()),
+		Removed: removed,
+	}); err != nil {
+		return count, err
+	}
+	client.handler.UpdateAttributes()
+	return count, nil
+}
@@ -1,10 +1,12 @@
 package irmaclient
 
 import (
+	"fmt"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
-	"github.com/getsentry/raven-go"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
@@ -13,7 +15,7 @@ import (
 )
 
 // This file contains most methods of the Client (c.f. session.go
-// and updates.go).
+// and migrations.go).
 //
 // Clients are the main entry point into this package for the user of this package.
 // The Client struct:
@@ -40,10 +42,10 @@ type Client struct {
 	// Stuff we manage on disk
 	secretkey        *secretKey
 	attributes       map[irma.CredentialTypeIdentifier][]*irma.AttributeList
+	archived         map[irma.CredentialTypeIdentifier][]*irma.AttributeList
 	credentialsCache map[irma.CredentialTypeIdentifier]map[int]*credential
 	keyshareServers  map[irma.SchemeManagerIdentifier]*keyshareServer
 	logs             []*LogEntry
-	updates          []update
 
 	// Where we store/load it to/from
 	storage storage
@@ -52,8 +54,63 @@ type Client struct {
 	Preferences           Preferences
 	Configuration         *irma.Configuration
 	irmaConfigurationPath string
-	androidStoragePath    string
 	handler               ClientHandler
+
+	// Transcripts of the most recent sessions, if enabled in the preferences
+	transcripts     []*SessionTranscript
+	transcriptsLock sync.Mutex
+
+	// Re-verification subscriptions, see subscriptions.go
+	subscriptions     []*Subscription
+	subscriptionsLock sync.Mutex
+
+	// Usage of credential types, see usage.go
+	usage     map[irma.CredentialTypeIdentifier]*irma.CredentialUsage
+	usageLock sync.Mutex
+
+	// Provenance of credentials by their hash, see provenance.go
+	provenance     map[string]*irma.CredentialProvenance
+	provenanceLock sync.Mutex
+	// Removal times of credentials by their hash, see sync.go
+	removals map[string]*irma.Timestamp
+
+	// Platform keystore wrapping the secret key, if any; see keystore.go
+	keystore Unwrapper
+
+	// Sessions awaiting a permission prompt, see prompts.go
+	pendingPrompts     map[string][]*session
+	pendingPromptsLock sync.Mutex
+
+	// Wallet lock, nil if not enabled; see walletlock.go
+	walletLock       *walletLock
+	walletLocked     bool
+	walletLockedLock sync.RWMutex
+	// Breadcrumbs for crash reports, see crashreporting.go
+	crashReporter crashReporter
+	// Clock against which the expiry of credentials is checked, see now()
+	clock func() time.Time
+	// Automatic backups, see backupprovider.go
+	backups backupSchedule
+	// Duration of the phases of the initialization, see startup.go
+	timings StartupTimings
+	// Lazy attribute loading, see lazy.go
+	lazyAttributes    bool
+	attributesPending bool
+	attributesIndex   attributesIndex
+	attributesLock    sync.Mutex
+	// Guardianships of the client, see guardianship.go
+	guardianships     []*Guardianship
+	guardianshipsLock sync.Mutex
+	// Issued credentials that could not be stored, see issuancequeue.go
+	issuanceQueue []*queuedCredential
+	// Connection pools of requestors, see transportisolation.go
+	requestorPools     map[string]*irma.ConnectionPool
+	requestorPoolsLock sync.Mutex
+	// Amount of running sessions, see startSession()
+	runningSessions int
+	sessionsLock    sync.Mutex
+	// Whether hashed PINs may be registered at keyshare servers not supporting the PAKE, see pake.go
+	hashedPinFallback bool
 }
 
 // SentryDSN should be set in the init() function
@@ -62,10 +119,29 @@ var SentryDSN = ""
 
 type Preferences struct {
 	EnableCrashReporting bool
+	// Record sanitized transcripts of sessions for debugging, see SessionTranscript
+	EnableSessionTranscripts bool
+	// What to do with expired credentials, see CleanupExpiredCredentials()
+	ExpiredCredentials ExpiredCredentialsPolicy
+	// Allow the aggregate usage of credential types to be exported, see ExportUsage()
+	EnableUsageExport bool
+	// Language of the user, by which CredentialInfoList() is sorted (default "en")
+	Language string
+	// Days between automatic backups to the BackupProvider, 0 if disabled; see backupprovider.go
+	BackupInterval int
+	// Record the mutations of the storage for debugging, see journal.go
+	EnableStorageJournal bool
+	// Which log entries to keep, see PruneLogs()
+	LogRetention LogRetentionPolicy
+	// Maximum staleness of the schemes, see freshness.go
+	SchemeFreshness SchemeFreshnessPolicy
+	// How the connections to requestors are isolated, see transportisolation.go
+	TransportIsolation TransportIsolation
 }
 
 var defaultPreferences = Preferences{
 	EnableCrashReporting: true,
+	ExpiredCredentials:   ExpiredCredentialsPolicy{Action: ExpiredCredentialsKeep},
 }
 
 // KeyshareHandler is used for asking the user for his email address and PIN,
@@ -82,6 +158,22 @@ type ChangePinHandler interface {
 	ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int)
 }
 
+// CredentialLimitHandler may be implemented by a ClientHandler to be asked which credential instance
+// to replace when a new instance of a credential type is received while the maximum amount of instances
+// of that credential type (see irma.CredentialType.MaxInstances) is already present. The callback must
+// be called with the index within existing of the instance to replace, or with -1 to discard the new
+// instance. If it is not called within credentialLimitTimeout, or if the ClientHandler does not implement
+// this interface, the new instance is discarded.
+type CredentialLimitHandler interface {
+	CredentialLimitReached(id irma.CredentialTypeIdentifier, existing []*irma.CredentialInfo, callback func(index int))
+}
+
+// ErrCredentialLimitReached is returned when a new credential instance is discarded because the maximum
+// amount of instances of its credential type is already present (see CredentialLimitHandler).
+var ErrCredentialLimitReached = errors.New("Maximum amount of credential instances reached")
+
+const credentialLimitTimeout = 5 * time.Minute
+
 // ClientHandler informs the user that the configuration or the list of attributes
 // that this client uses has been updated.
 type ClientHandler interface {
@@ -94,30 +186,79 @@ type ClientHandler interface {
 
 type secretKey struct {
 	Key *big.Int
+	// The secret key wrapped by the keystore of the platform instead of Key, see keystore.go
+	Wrapped []byte `json:",omitempty"`
+}
+
+// Option configures optional behaviour of a Client created by New().
+type Option func(*options)
+
+type options struct {
+	// Storage encryption, see encryption.go
+	passphrase *string
+	key        []byte
+	// SQLite storage, see sqlstorage.go
+	sqlDriver string
+	// In-memory storage, see memstorage.go
+	memory bool
+	// Platform keystore wrapping the secret key, see keystore.go
+	keystore Unwrapper
+	// Lazy attribute loading, see lazy.go
+	lazyAttributes bool
+	// Locations of data classes, see storagelocation.go
+	locations map[DataClass]string
+	// Registering hashed PINs at keyshare servers not supporting the PAKE, see pake.go
+	hashedPinFallback bool
 }
 
 // New creates a new Client that uses the directory
 // specified by storagePath for (de)serializing itself. irmaConfigurationPath
-// is the path to a (possibly readonly) folder containing irma_configuration;
-// androidStoragePath is an optional path to the files of the old android app
-// (specify "" if you do not want to parse the old android app files),
+// is the path to a (possibly readonly) folder containing irma_configuration,
 // and handler is used for informing the user of new stuff, and when a
-// enrollment to a keyshare server needs to happen.
+// enrollment to a keyshare server needs to happen. The storage of older apps (e.g. the old
+// Android app) can be imported afterwards using ImportLegacyStorage().
 // The client returned by this function has been fully deserialized
-// and is ready for use.
+// and is ready for use, unless the wallet lock is enabled (see WalletLocked()),
+// in which case it must first be unlocked using UnlockWallet().
+// The storage can be encrypted at rest by passing WithStoragePassphrase() or WithStorageKey()
+// (see encryption.go); existing unencrypted storage is then encrypted. With WithInMemoryStorage()
+// nothing is written to disk (see memstorage.go). With WithLazyAttributeLoading() the attributes of
+// the credentials are loaded on first use instead (see lazy.go). With WithStorageLocation() the
+// secret key, credentials or logs are stored outside storagePath (see storagelocation.go). With
+// WithHashedPinFallback() hashed PINs are registered at keyshare servers not supporting the PAKE
+// (see pake.go).
 //
 // NOTE: It is the responsibility of the caller that there exists a (properly
 // protected) directory at storagePath!
 func New(
 	storagePath string,
 	irmaConfigurationPath string,
-	androidStoragePath string,
 	handler ClientHandler,
+	opts ...Option,
 ) (*Client, error) {
 	var err error
-	if err = fs.AssertPathExists(storagePath); err != nil {
+	start := time.Now()
+	span := irma.StartSpan("irmaclient.New")
+	defer func() { span.End(err) }()
+
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.memory && o.sqlDriver != "" {
+		err = errors.New("SQLite storage cannot be combined with in-memory storage")
 		return nil, err
 	}
+	if o.memory && len(o.locations) > 0 {
+		err = errors.New("Storage locations cannot be combined with in-memory storage")
+		return nil, err
+	}
+
+	if !o.memory {
+		if err = fs.AssertPathExists(storagePath); err != nil {
+			return nil, err
+		}
+	}
 	if err = fs.AssertPathExists(irmaConfigurationPath); err != nil {
 		return nil, err
 	}
@@ -126,60 +267,195 @@ func New(
 		credentialsCache:      make(map[irma.CredentialTypeIdentifier]map[int]*credential),
 		keyshareServers:       make(map[irma.SchemeManagerIdentifier]*keyshareServer),
 		attributes:            make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList),
+		archived:              make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList),
 		irmaConfigurationPath: irmaConfigurationPath,
-		androidStoragePath:    androidStoragePath,
 		handler:               handler,
+		keystore:              o.keystore,
+		lazyAttributes:        o.lazyAttributes || o.sqlDriver != "",
+		hashedPinFallback:     o.hashedPinFallback,
 	}
 
-	cm.Configuration, err = irma.NewConfigurationFromAssets(storagePath+"/irma_configuration", irmaConfigurationPath)
-	if err != nil {
+	// Ensure storage path exists, and lock it before anything in it, including the
+	// irma_configuration folder, is read or written
+	cm.storage = storage{storagePath: storagePath, locations: o.locations}
+	if o.memory {
+		cm.storage.memory = newMemoryFiles()
+	}
+	if err = cm.storage.EnsureStorageExists(); err != nil {
 		return nil, err
 	}
-
-	schemeMgrErr := cm.Configuration.ParseOrRestoreFolder()
-	// If schemMgrErr is of type SchemeManagerError, we continue and
-	// return it at the end; otherwise bail out now
-	_, isSchemeMgrErr := schemeMgrErr.(*irma.SchemeManagerError)
-	if schemeMgrErr != nil && !isSchemeMgrErr {
-		return nil, schemeMgrErr
+	if err = cm.storage.lock(); err != nil {
+		return nil, err
 	}
-
-	// Ensure storage path exists, and populate it with necessary files
-	cm.storage = storage{storagePath: storagePath, Configuration: cm.Configuration}
-	if err = cm.storage.EnsureStorageExists(); err != nil {
+	defer func() {
+		if err != nil {
+			cm.storage.unlock()
+		}
+	}()
+	if err = cm.storage.relocate(); err != nil {
 		return nil, err
 	}
 
-	if cm.Preferences, err = cm.storage.LoadPreferences(); err != nil {
+	if o.memory {
+		cm.Configuration, err = irma.NewConfigurationReadOnly(irmaConfigurationPath)
+	} else {
+		cm.Configuration, err = irma.NewConfigurationFromAssets(storagePath+"/irma_configuration", irmaConfigurationPath)
+	}
+	if err != nil {
 		return nil, err
 	}
+	cm.storage.Configuration = cm.Configuration
+
+	// Parse the configuration while opening the storage, see startup.go
+	var schemeMgrErr error
+	group := &loadGroup{}
+	group.run(&cm.timings.Configuration, func() error {
+		schemeMgrErr = cm.Configuration.ParseOrRestoreFolder()
+		// If schemMgrErr is of type SchemeManagerError, we continue and
+		// return it at the end; otherwise bail out now
+		if _, isSchemeMgrErr := schemeMgrErr.(*irma.SchemeManagerError); schemeMgrErr != nil && !isSchemeMgrErr {
+			return schemeMgrErr
+		}
+		return nil
+	})
+	group.run(&cm.timings.Storage, func() error {
+		if err := cm.storage.checkSchemaVersion(); err != nil {
+			return err
+		}
+		if err := cm.storage.setupEncryption(o); err != nil {
+			return err
+		}
+		return timed(&cm.timings.Preferences, func() (err error) {
+			cm.Preferences, err = cm.storage.LoadPreferences()
+			return
+		})
+	})
+	if err = group.wait(); err != nil {
+		return nil, err
+	}
+
+	if o.sqlDriver != "" {
+		if cm.storage.aead != nil {
+			err = errors.New("SQLite storage cannot be combined with storage encryption")
+			return nil, err
+		}
+		if err = cm.storage.openSQL(o.sqlDriver); err != nil {
+			return nil, err
+		}
+	}
+
 	cm.applyPreferences()
 
-	// Perform new update functions from clientUpdates, if any
-	if err = cm.update(); err != nil {
+	// Apply the storage migrations that have not yet been applied, if any
+	if err = timed(&cm.timings.Migrations, cm.migrate); err != nil {
 		return nil, err
 	}
 
-	// Load our stuff
-	if cm.secretkey, err = cm.storage.LoadSecretKey(); err != nil {
+	// If the wallet lock is enabled, our stuff is loaded when the wallet is unlocked
+	if err = cm.loadWalletLock(); err != nil {
 		return nil, err
 	}
-	if cm.attributes, err = cm.storage.LoadAttributes(); err != nil {
-		return nil, err
+	if cm.walletLock != nil {
+		return cm, schemeMgrErr
 	}
-	if cm.keyshareServers, err = cm.storage.LoadKeyshareServers(); err != nil {
+
+	if err = cm.loadStorage(); err != nil {
 		return nil, err
 	}
 
-	if len(cm.UnenrolledSchemeManagers()) > 1 {
-		return nil, errors.New("Too many keyshare servers")
+	cm.timings.Total = time.Since(start)
+	return cm, schemeMgrErr
+}
+
+// now returns the current time according to the clock of the client. Tests replace the clock
+// to simulate the passing of time, so that the expiry of credentials can be tested.
+func (client *Client) now() time.Time {
+	if client.clock != nil {
+		return client.clock()
 	}
+	return time.Now()
+}
 
-	return cm, schemeMgrErr
+// loadStorage loads our stuff from storage.
+func (client *Client) loadStorage() (err error) {
+	span := irma.StartSpan("irmaclient.loadStorage")
+	defer func() { span.End(err) }()
+
+	// Load the independent parts of the storage concurrently, see startup.go
+	lazy := false
+	group := &loadGroup{}
+	group.run(&client.timings.SecretKey, func() (err error) {
+		if client.secretkey, err = client.storage.LoadSecretKey(); err != nil {
+			return
+		}
+		return client.wrapSecretKey()
+	})
+	group.run(&client.timings.Attributes, func() (err error) {
+		if client.lazyAttributes {
+			if lazy, err = client.loadAttributesIndex(); err != nil || lazy {
+				return
+			}
+		}
+		return client.loadAttributeStorage()
+	})
+	group.run(&client.timings.KeyshareServers, func() (err error) {
+		client.keyshareServers, err = client.storage.LoadKeyshareServers()
+		return
+	})
+	group.run(&client.timings.Other, func() (err error) {
+		if client.subscriptions, err = client.storage.LoadSubscriptions(); err != nil {
+			return
+		}
+		if client.usage, err = client.storage.LoadUsage(); err != nil {
+			return
+		}
+		if client.provenance, err = client.storage.LoadProvenance(); err != nil {
+			return
+		}
+		if client.removals, err = client.storage.LoadRemovals(); err != nil {
+			return
+		}
+		if client.guardianships, err = client.storage.LoadGuardianships(); err != nil {
+			return
+		}
+		client.issuanceQueue, err = client.storage.LoadIssuanceQueue()
+		return
+	})
+	if err = group.wait(); err != nil {
+		return
+	}
+
+	if len(client.UnenrolledSchemeManagers()) > 1 {
+		return errors.New("Too many keyshare servers")
+	}
+	client.warnStaleSchemes()
+	if len(client.issuanceQueue) > 0 {
+		// Loads the attributes, if lazy attribute loading is enabled; failures to store the
+		// queued credentials are only logged
+		if err = client.retryQueuedCredentials(); err != nil {
+			return
+		}
+		lazy = false
+	}
+
+	if _, err = client.pruneLogs(); err != nil {
+		return
+	}
+	if lazy {
+		return
+	}
+	if _, err = client.CleanupExpiredCredentials(); err != nil || !client.lazyAttributes {
+		return
+	}
+	// Write the index, for lazily loading the attributes next time
+	return client.storage.StoreAttributesIndex(newAttributesIndex(client.attributes))
 }
 
-// CredentialInfoList returns a list of information of all contained credentials.
+// CredentialInfoList returns a list of information of all contained credentials, sorted by the names
+// of their scheme, issuer and credential type in the language of the user, and then by issuance time
+// (newest first).
 func (client *Client) CredentialInfoList() irma.CredentialInfoList {
+	client.ensureAttributesOrWarn()
 	list := irma.CredentialInfoList([]*irma.CredentialInfo{})
 
 	for _, attrlistlist := range client.attributes {
@@ -188,13 +464,25 @@ func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 			if info == nil {
 				continue
 			}
-			list = append(list, info)
+			withUsage := *info
+			withUsage.Usage = client.credentialUsage(attrlist.CredentialType().Identifier())
+			withUsage.Provenance = client.credentialProvenance(info.Hash)
+			list = append(list, &withUsage)
 		}
 	}
 
+	list.SortLocalized(client.Configuration, client.language())
 	return list
 }
 
+// language returns the language of the user, see Preferences.Language.
+func (client *Client) language() string {
+	if client.Preferences.Language == "" {
+		return "en"
+	}
+	return client.Preferences.Language
+}
+
 // addCredential adds the specified credential to the Client, saving its signature
 // imediately, and optionally cm.attributes as well.
 func (client *Client) addCredential(cred *credential, storeAttributes bool) (err error) {
@@ -212,6 +500,17 @@ func (client *Client) addCredential(cred *credential, storeAttributes bool) (err
 		}
 	}
 
+	// If the credential type has an instance limit, let the user choose which instance(s) to replace
+	if !id.Empty() && !cred.CredentialType().IsSingleton && cred.CredentialType().MaxInstances > 0 {
+		if err = client.enforceInstanceLimit(id, cred.CredentialType().MaxInstances); err != nil {
+			return
+		}
+	}
+	// Store the signature before changing the attributes, so that if that fails, previous
+	// instances of singleton credential types are kept
+	if err = client.storage.StoreSignature(cred); err != nil {
+		return &credentialStorageError{Err: err}
+	}
 	// If this is a singleton credential type, ensure we have at most one by removing any previous instance
 	if !id.Empty() && cred.CredentialType().IsSingleton {
 		for len(client.attrs(id)) != 0 {
@@ -219,23 +518,64 @@ func (client *Client) addCredential(cred *credential, storeAttributes bool) (err
 		}
 	}
 
-	// Append the new cred to our attributes and credentials
-	client.attributes[id] = append(client.attrs(id), cred.AttributeList())
+	// Append the new cred to our attributes and credentials, which must not share attribute values
+	// so that wiping one does not affect the other (see wipe.go)
+	client.attributes[id] = append(client.attrs(id), irma.NewAttributeListFromInts(copyInts(cred.Attributes[1:]), client.Configuration))
+	counter := len(client.attributes[id]) - 1
 	if !id.Empty() {
 		if _, exists := client.credentialsCache[id]; !exists {
 			client.credentialsCache[id] = make(map[int]*credential)
 		}
-		counter := len(client.attributes[id]) - 1
 		client.credentialsCache[id][counter] = cred
 	}
 
-	if err = client.storage.StoreSignature(cred); err != nil {
-		return
+	if !storeAttributes {
+		return nil
+	}
+	if err = client.storage.StoreAttributes(client.attributes); err != nil {
+		// Roll back the append, so that the credential is not used while it is not stored
+		client.attributes[id] = client.attributes[id][:counter]
+		if !id.Empty() {
+			delete(client.credentialsCache[id], counter)
+		}
+		return &credentialStorageError{Err: err}
 	}
-	if storeAttributes {
-		err = client.storage.StoreAttributes(client.attributes)
+	return nil
+}
+
+// enforceInstanceLimit asks the handler to choose instances of the specified credential type to
+// remove, until there is room for a new instance.
+func (client *Client) enforceInstanceLimit(id irma.CredentialTypeIdentifier, max int) error {
+	handler, ok := client.handler.(CredentialLimitHandler)
+	for len(client.attrs(id)) >= max {
+		if !ok {
+			return ErrCredentialLimitReached
+		}
+		existing := make([]*irma.CredentialInfo, 0, len(client.attrs(id)))
+		for _, attrs := range client.attrs(id) {
+			existing = append(existing, attrs.Info())
+		}
+		choice := make(chan int, 1)
+		handler.CredentialLimitReached(id, existing, func(index int) {
+			select {
+			case choice <- index:
+			default: // called more than once
+			}
+		})
+		index := -1
+		select {
+		case index = <-choice:
+		case <-time.After(credentialLimitTimeout):
+			irma.Logger.Warnf("No instance of %s chosen to replace, discarding new instance", id)
+		}
+		if index < 0 || index >= len(existing) {
+			return ErrCredentialLimitReached
+		}
+		if err := client.remove(id, index, false); err != nil {
+			return err
+		}
 	}
-	return
+	return nil
 }
 
 func generateSecretKey() (*secretKey, error) {
@@ -263,20 +603,12 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 	}
 
 	// Remove credential
-	if creds, exists := client.credentialsCache[id]; exists {
-		if _, exists := creds[index]; exists {
-			delete(creds, index)
-			client.credentialsCache[id] = creds
-		}
-	}
-
-	// Remove signature from storage
-	if err := client.storage.DeleteSignature(attrs); err != nil {
-		return err
-	}
-
+	cred := client.uncacheCredential(id, index)
 	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
 	removed[id] = attrs.Strings()
+	if err := client.discardCredential(attrs, cred); err != nil {
+		return err
+	}
 
 	if storenow {
 		return client.addLogEntry(&LogEntry{
@@ -288,51 +620,117 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 	return nil
 }
 
+// discardCredential does the bookkeeping of a credential whose attributes have been removed from
+// the client: it deletes its signature from storage, forgets its provenance, records its removal
+// for synchronization with other devices, and wipes it from memory.
+func (client *Client) discardCredential(attrs *irma.AttributeList, cred *credential) error {
+	if err := client.storage.DeleteSignature(attrs); err != nil {
+		return err
+	}
+	if err := client.forgetProvenance(attrs.Hash()); err != nil {
+		return err
+	}
+	if err := client.recordRemoval(attrs.Hash()); err != nil {
+		return err
+	}
+	client.wipeCredential(attrs, cred)
+	return nil
+}
+
+// uncacheCredential removes the credential at the specified index from the credentials cache,
+// moving the cached credentials of the subsequent instances down like their attribute lists.
+func (client *Client) uncacheCredential(id irma.CredentialTypeIdentifier, index int) *credential {
+	creds, exists := client.credentialsCache[id]
+	if !exists {
+		return nil
+	}
+	shifted := make(map[int]*credential, len(creds))
+	for i, cred := range creds {
+		if i < index {
+			shifted[i] = cred
+		} else if i > index {
+			shifted[i-1] = cred
+		}
+	}
+	client.credentialsCache[id] = shifted
+	return creds[index]
+}
+
 // RemoveCredential removes the specified credential.
+//
+// Deprecated: the index of a credential changes when other credentials are removed; use
+// RemoveCredentialByHash instead.
 func (client *Client) RemoveCredential(id irma.CredentialTypeIdentifier, index int) error {
+	deprecated("Client.RemoveCredential", "Client.RemoveCredentialByHash")
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
 	return client.remove(id, index, true)
 }
 
 // RemoveCredentialByHash removes the specified credential.
 func (client *Client) RemoveCredentialByHash(hash string) error {
-	cred, index, err := client.credentialByHash(hash)
-	if err != nil {
+	if err := client.checkUnlocked(); err != nil {
 		return err
 	}
-	return client.RemoveCredential(cred.CredentialType().Identifier(), index)
+	id, index, found := findAttributeList(client.attributes, hash)
+	if !found {
+		return errors.Errorf("Can't remove credential %s: no such credential", hash)
+	}
+	return client.remove(id, index, true)
 }
 
-// RemoveAllCredentials removes all credentials.
+// RemoveAllCredentials removes all credentials, including archived ones.
 func (client *Client) RemoveAllCredentials() error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
 	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
-	for _, attrlistlist := range client.attributes {
-		for _, attrs := range attrlistlist {
-			if attrs.CredentialType() != nil {
-				removed[attrs.CredentialType().Identifier()] = attrs.Strings()
+	now := irma.Timestamp(client.now())
+	for _, lists := range []map[irma.CredentialTypeIdentifier][]*irma.AttributeList{client.attributes, client.archived} {
+		for _, attrlistlist := range lists {
+			for _, attrs := range attrlistlist {
+				if attrs.CredentialType() != nil {
+					removed[attrs.CredentialType().Identifier()] = attrs.Strings()
+				}
+				client.storage.DeleteSignature(attrs)
+				client.removals[attrs.Hash()] = &now
+				client.wipeCredential(attrs, nil)
 			}
-			client.storage.DeleteSignature(attrs)
 		}
 	}
+	for _, creds := range client.credentialsCache {
+		for _, cred := range creds {
+			client.wipeCredential(cred.attrs, cred)
+		}
+	}
+	client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
 	client.attributes = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
+	client.archived = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
 	if err := client.storage.StoreAttributes(client.attributes); err != nil {
 		return err
 	}
+	if err := client.storage.StoreArchive(client.archived); err != nil {
+		return err
+	}
+	client.pruneRemovals()
+	if err := client.storage.StoreRemovals(client.removals); err != nil {
+		return err
+	}
 
 	logentry := &LogEntry{
 		Type:    actionRemoval,
 		Time:    irma.Timestamp(time.Now()),
 		Removed: removed,
 	}
-	if err := client.addLogEntry(logentry); err != nil {
-		return err
-	}
-	return client.storage.StoreLogs(client.logs)
+	return client.addLogEntry(logentry)
 }
 
 // Attribute and credential getter methods
 
 // attrs returns cm.attributes[id], initializing it to an empty slice if neccesary
 func (client *Client) attrs(id irma.CredentialTypeIdentifier) []*irma.AttributeList {
+	client.ensureAttributesOrWarn()
 	list, exists := client.attributes[id]
 	if !exists {
 		list = make([]*irma.AttributeList, 0, 1)
@@ -352,7 +750,15 @@ func (client *Client) creds(id irma.CredentialTypeIdentifier) map[int]*credentia
 }
 
 // Attributes returns the attribute list of the requested credential, or nil if we do not have it.
+//
+// Deprecated: the index of a credential changes when other credentials are removed; use the
+// Hash of the credentials in CredentialInfoList instead.
 func (client *Client) Attributes(id irma.CredentialTypeIdentifier, counter int) (attributes *irma.AttributeList) {
+	deprecated("Client.Attributes", "Client.CredentialInfoList")
+	return client.attributesAt(id, counter)
+}
+
+func (client *Client) attributesAt(id irma.CredentialTypeIdentifier, counter int) (attributes *irma.AttributeList) {
 	list := client.attrs(id)
 	if len(list) <= counter {
 		return
@@ -361,6 +767,7 @@ func (client *Client) Attributes(id irma.CredentialTypeIdentifier, counter int)
 }
 
 func (client *Client) credentialByHash(hash string) (*credential, int, error) {
+	client.ensureAttributesOrWarn()
 	for _, attrlistlist := range client.attributes {
 		for index, attrs := range attrlistlist {
 			if attrs.Hash() == hash {
@@ -373,6 +780,7 @@ func (client *Client) credentialByHash(hash string) (*credential, int, error) {
 }
 
 func (client *Client) credentialByID(id irma.CredentialIdentifier) (*credential, error) {
+	client.ensureAttributesOrWarn()
 	if _, exists := client.attributes[id.Type]; !exists {
 		return nil, nil
 	}
@@ -390,27 +798,40 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 	// deserialized during New(). If so, there should be a corresponding signature file,
 	// so we read that, construct the credential, and add it to the credential map
 	if _, exists := client.creds(id)[counter]; !exists {
-		attrs := client.Attributes(id, counter)
+		attrs := client.attributesAt(id, counter)
 		if attrs == nil { // We do not have the requested cred
 			return
 		}
 		sig, err := client.storage.LoadSignature(attrs)
-		if err != nil {
+		if _, corrupted := err.(*StorageCorruptionError); corrupted {
+			client.repairCorruptedSignature()
 			return nil, err
 		}
-		if sig == nil {
-			err = errors.New("signature file not found")
+		if err != nil && !client.signatureMissing(attrs) {
 			return nil, err
 		}
+		if sig == nil {
+			return nil, &reportableError{
+				ClientFailure: irma.ClientFailure{Code: irma.FailureSignatureMissing},
+				msg:           "signature file not found",
+			}
+		}
 		pk, err := attrs.PublicKey()
 		if err != nil {
 			return nil, err
 		}
 		if pk == nil {
-			return nil, errors.New("unknown public key")
+			return nil, &reportableError{
+				ClientFailure: irma.ClientFailure{Code: irma.FailureUnknownPublicKey},
+				msg:           fmt.Sprintf("unknown public key %s-%d", id.IssuerIdentifier(), attrs.KeyCounter()),
+			}
+		}
+		key, err := client.unwrappedSecretKey()
+		if err != nil {
+			return nil, err
 		}
 		cred, err := newCredential(&gabi.Credential{
-			Attributes: append([]*big.Int{client.secretkey.Key}, attrs.Ints...),
+			Attributes: append([]*big.Int{key}, copyInts(attrs.Ints)...),
 			Signature:  sig,
 			Pk:         pk,
 		}, client.Configuration)
@@ -428,9 +849,34 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 // Candidates returns a list of attributes present in this client
 // that satisfy the specified attribute disjunction.
 func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma.AttributeIdentifier {
-	candidates := make([]*irma.AttributeIdentifier, 0, 10)
+	explanations := client.explainCandidates(disjunction)
+	candidates := make([]*irma.AttributeIdentifier, 0, len(explanations))
+	for _, explanation := range explanations {
+		candidates = append(candidates, explanation.Candidate)
+	}
+	return candidates
+}
+
+// CandidateExplanation explains why a candidate attribute, as returned by CheckSatisfiability(),
+// satisfies a disjunction, so that it can be explained to the user why it is suggested.
+type CandidateExplanation struct {
+	Candidate *irma.AttributeIdentifier
+	// Index of the disjunction within the disjunction list that the candidate satisfies
+	Disjunction int
+	// Index of the attribute type within the attributes of the disjunction that the candidate is an instance of
+	Attribute int
+	// Value that the disjunction requires the attribute to have, if any; the candidate has this value
+	RequiredValue *string
+	// Whether the disjunction asks only for the presence of the credential containing the candidate,
+	// i.e. no attribute value is disclosed
+	CredentialLevel bool
+}
+
+func (client *Client) explainCandidates(disjunction *irma.AttributeDisjunction) []*CandidateExplanation {
+	client.ensureAttributesOrWarn()
+	candidates := make([]*CandidateExplanation, 0, 10)
 
-	for _, attribute := range disjunction.Attributes {
+	for i, attribute := range disjunction.Attributes {
 		credID := attribute.CredentialTypeIdentifier()
 		if !client.Configuration.Contains(credID) {
 			continue
@@ -440,24 +886,36 @@ func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma
 		if count == 0 {
 			continue
 		}
+		// Within an attribute type, suggest the newest credentials first
+		creds = append([]*irma.AttributeList{}, creds...)
+		sort.SliceStable(creds, func(i, j int) bool {
+			ti, tj := creds[i].SigningDate(), creds[j].SigningDate()
+			if !ti.Equal(tj) {
+				return ti.After(tj)
+			}
+			return creds[i].Hash() < creds[j].Hash()
+		})
 		for _, attrs := range creds {
-			if !attrs.IsValid() {
+			if !attrs.IsValidOn(client.now()) {
 				continue
 			}
 			id := &irma.AttributeIdentifier{Type: attribute, CredentialHash: attrs.Hash()}
+			explanation := &CandidateExplanation{Candidate: id, Attribute: i}
 			if attribute.IsCredential() {
-				candidates = append(candidates, id)
+				explanation.CredentialLevel = true
+				candidates = append(candidates, explanation)
 			} else {
 				val := attrs.UntranslatedAttribute(attribute)
 				if val == nil {
 					continue
 				}
 				if !disjunction.HasValues() {
-					candidates = append(candidates, id)
+					candidates = append(candidates, explanation)
 				} else {
 					requiredValue, present := disjunction.Values[attribute]
 					if !present || requiredValue == nil || *val == *requiredValue {
-						candidates = append(candidates, id)
+						explanation.RequiredValue = requiredValue
+						candidates = append(candidates, explanation)
 					}
 				}
 			}
@@ -485,6 +943,19 @@ func (client *Client) CheckSatisfiability(
 	return candidates, missing
 }
 
+// ExplainCandidates returns, for each of the specified disjunctions, an explanation of each of its candidates
+// in the same order as returned by CheckSatisfiability().
+func (client *Client) ExplainCandidates(disjunctions irma.AttributeDisjunctionList) [][]*CandidateExplanation {
+	explanations := make([][]*CandidateExplanation, len(disjunctions))
+	for i, disjunction := range disjunctions {
+		explanations[i] = client.explainCandidates(disjunction)
+		for _, explanation := range explanations[i] {
+			explanation.Disjunction = i
+		}
+	}
+	return explanations
+}
+
 // attributeGroup points to a credential and some of its attributes which are to be disclosed
 type attributeGroup struct {
 	cred  irma.CredentialIdentifier
@@ -568,7 +1039,7 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 			disclosed = append(disclosed, d)
 		}
 		r := request.(*irma.SignatureRequest)
-		r.Timestamp, err = irma.GetTimestamp(r.Message, sigs, disclosed)
+		r.Timestamp, err = irma.GetTimestamp(r.SignedMessage(), sigs, disclosed)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -604,6 +1075,10 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest,
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	key, err := client.unwrappedSecretKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	builders := gabi.ProofBuilderList([]gabi.ProofBuilder{})
 	for _, futurecred := range request.Credentials {
 		var pk *gabi.PublicKey
@@ -612,10 +1087,12 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest,
 			return nil, nil, nil, err
 		}
 		credBuilder := gabi.NewCredentialBuilder(
-			pk, request.GetContext(), client.secretkey.Key, issuerProofNonce)
+			pk, request.GetContext(), key, issuerProofNonce)
 		builders = append(builders, credBuilder)
 	}
 
+	// The issuer expects the disclosure proofs first, followed by the proofs of the credential builders,
+	// which we build in the order of request.Credentials; see also issuanceCredentialIDs()
 	disclosures, choices, err := client.ProofBuilders(request.Choice, request, false)
 	if err != nil {
 		return nil, nil, nil, err
@@ -637,50 +1114,136 @@ func (client *Client) IssueCommitments(request *irma.IssuanceRequest,
 			Proofs: builders.BuildProofList(request.GetContext(), request.GetNonce(), false),
 			Nonce2: issuerProofNonce,
 		},
-		Indices: choices,
+		Indices:       choices,
+		CredentialIDs: issuanceCredentialIDs(request),
 	}, builders, nil
 }
 
-// ConstructCredentials constructs and saves new credentials using the specified issuance signature messages
-// and credential builders.
-func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, builders gabi.ProofBuilderList) error {
-	if len(msg) > len(builders) {
-		return errors.New("Received unexpected amount of signatures")
-	}
-
-	// First collect all credentials in a slice, so that if one of them induces an error,
-	// we save none of them to fail the session cleanly
-	gabicreds := []*gabi.Credential{}
-	offset := 0
-	for i, builder := range builders {
-		credbuilder, ok := builder.(*gabi.CredentialBuilder)
-		if !ok { // Skip builders of disclosure proofs
-			offset++
-			continue
-		}
-		sig := msg[i-offset]
-		attrs, err := request.Credentials[i-offset].AttributeList(client.Configuration, irma.GetMetadataVersion(request.GetVersion()))
-		if err != nil {
-			return err
+// issuanceCredentialIDs returns the credential IDs to send along with the proofs of the credential builders
+// returned by IssuanceProofBuilders() (see irma.IssueCommitmentMessage.CredentialIDs). As the builders are
+// in the order of request.Credentials, the i-th signature that the issuer returns is of the i-th credential.
+func issuanceCredentialIDs(request *irma.IssuanceRequest) []int {
+	ids := make([]int, len(request.Credentials))
+	for i := range ids {
+		ids[i] = i
+	}
+	return ids
+}
+
+// PartialIssuanceError is the error of an issuance session in which some of the issued credentials
+// could not be constructed; the other credentials have been stored.
+type PartialIssuanceError struct {
+	Results []*irma.CredentialIssuanceResult
+}
+
+func (e *PartialIssuanceError) Error() string {
+	return fmt.Sprintf("%d of %d issued credentials could not be constructed", len(e.Failed()), len(e.Results))
+}
+
+// Failed returns the types of the credentials that could not be constructed.
+func (e *PartialIssuanceError) Failed() []irma.CredentialTypeIdentifier {
+	failed := []irma.CredentialTypeIdentifier{}
+	for _, result := range e.Results {
+		if !result.Success() {
+			failed = append(failed, result.CredentialTypeID)
 		}
-		cred, err := credbuilder.ConstructCredential(sig, attrs.Ints)
+	}
+	return failed
+}
+
+// ConstructCredentials constructs and saves new credentials using the specified issuance signature messages
+// and credential builders, which must have been sent to the issuer with the IDs of issuanceCredentialIDs(),
+// so that the i-th message is the signature over the i-th credential of the request. Each credential is constructed and saved independently: if one of them fails,
+// the others are still saved. The returned results report for each issued credential whether or not it
+// succeeded; if any of them failed, a *PartialIssuanceError containing the same results is returned.
+// Other errors mean that no credential was saved.
+func (client *Client) ConstructCredentials(
+	msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, builders gabi.ProofBuilderList,
+) ([]*irma.CredentialIssuanceResult, error) {
+	if len(msg) != len(request.Credentials) {
+		return nil, errors.New("Received unexpected amount of signatures")
+	}
+	credbuilders, err := issuanceBuilders(request, builders)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*irma.CredentialIssuanceResult, 0, len(msg))
+	failed := false
+	for i, credreq := range request.Credentials {
+		result := &irma.CredentialIssuanceResult{CredentialTypeID: credreq.CredentialTypeID}
+		cred, queued, err := client.constructCredential(msg[i], credreq, credbuilders[i], request.GetVersion())
 		if err != nil {
-			return err
+			irma.Logger.Warnf("Failed to construct credential %d (%s): %s", i, credreq.CredentialTypeID, err.Error())
+			result.Error = err.Error()
+			result.Queued = queued
+			failed = true
+		} else {
+			result.Hash = cred.AttributeList().Hash()
 		}
-		gabicreds = append(gabicreds, cred)
+		results = append(results, result)
 	}
 
-	for _, gabicred := range gabicreds {
-		newcred, err := newCredential(gabicred, client.Configuration)
-		if err != nil {
-			return err
+	if failed {
+		return results, &PartialIssuanceError{Results: results}
+	}
+	return results, nil
+}
+
+// issuanceBuilders returns the credential builders among the specified builders, such that the i-th
+// builder belongs to the i-th credential of the request, checking that this is the case by means of
+// the issuer and counter of the public key of each builder. IssuanceProofBuilders() returns builders
+// in this order, following the disclosure proof builders (if any), so that the i-th signature in the
+// issuer's response (which is ordered like the credentials in the request) belongs to the i-th builder,
+// also when the credentials are issued by issuers from different schemes.
+func issuanceBuilders(request *irma.IssuanceRequest, builders gabi.ProofBuilderList) ([]*gabi.CredentialBuilder, error) {
+	credbuilders := make([]*gabi.CredentialBuilder, 0, len(request.Credentials))
+	for _, builder := range builders {
+		if credbuilder, ok := builder.(*gabi.CredentialBuilder); ok { // Skip builders of disclosure proofs
+			credbuilders = append(credbuilders, credbuilder)
 		}
-		if err = client.addCredential(newcred, true); err != nil {
-			return err
+	}
+	if len(credbuilders) != len(request.Credentials) {
+		return nil, errors.Errorf("Expected %d credential builders, got %d", len(request.Credentials), len(credbuilders))
+	}
+	for i, credreq := range request.Credentials {
+		pk := credbuilders[i].PublicKey()
+		if irma.NewIssuerIdentifier(pk.Issuer) != credreq.CredentialTypeID.IssuerIdentifier() || int(pk.Counter) != credreq.KeyCounter {
+			return nil, errors.Errorf("Credential builder %d does not belong to credential %s", i, credreq.CredentialTypeID)
 		}
 	}
+	return credbuilders, nil
+}
 
-	return nil
+// constructCredential constructs and stores the credential. If the credential was constructed
+// but storing it failed, it is put in the issuance queue (see issuancequeue.go), in which case
+// queued is true. Credentials that are refused, e.g. by the instance limit of their type, are not
+// queued.
+func (client *Client) constructCredential(
+	sig *gabi.IssueSignatureMessage, credreq *irma.CredentialRequest, builder *gabi.CredentialBuilder, version *irma.ProtocolVersion,
+) (cred *credential, queued bool, err error) {
+	attrs, err := credreq.AttributeList(client.Configuration, irma.GetMetadataVersion(version))
+	if err != nil {
+		return nil, false, err
+	}
+	gabicred, err := builder.ConstructCredential(sig, attrs.Ints)
+	if err != nil {
+		return nil, false, err
+	}
+	if cred, err = newCredential(gabicred, client.Configuration); err != nil {
+		return nil, false, err
+	}
+	if err = client.addCredential(cred, true); err != nil {
+		if _, ok := err.(*credentialStorageError); !ok {
+			return nil, false, err
+		}
+		if queueErr := client.queueCredential(gabicred); queueErr != nil {
+			irma.Logger.Warn("Failed to queue credential: ", queueErr.Error())
+			return nil, false, err
+		}
+		return nil, true, err
+	}
+	return cred, false, nil
 }
 
 // Keyshare server handling
@@ -714,6 +1277,9 @@ func (client *Client) KeyshareEnroll(manager irma.SchemeManagerIdentifier, email
 }
 
 func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifier, email *string, pin string, lang string) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
 	manager, ok := client.Configuration.SchemeManagers[managerID]
 	if !ok {
 		return errors.New("Unknown scheme manager")
@@ -730,10 +1296,16 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	if err != nil {
 		return err
 	}
+	registration, version, err := registerPin(kss, transport, pin, client.allowHashedPin(kss))
+	if err != nil {
+		return err
+	}
+	kss.PinProtocol = version
+	kss.setVersionHeader(transport)
 	message := keyshareEnrollment{
-		Email:    email,
-		Pin:      kss.HashedPin(pin),
-		Language: lang,
+		pinRegistration: *registration,
+		Email:           email,
+		Language:        lang,
 	}
 
 	qr := &irma.Qr{}
@@ -752,7 +1324,7 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		client: client,
 		pin:    pin,
 		kss:    kss,
-	})
+	}, "")
 
 	return nil
 }
@@ -761,6 +1333,9 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 // if not, how many tries are left, or for how long the user is blocked. If an error is returned
 // it is of type *irma.SessionError.
 func (client *Client) KeyshareVerifyPin(pin string, schemeid irma.SchemeManagerIdentifier) (bool, int, int, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return false, 0, 0, err
+	}
 	scheme := client.Configuration.SchemeManagers[schemeid]
 	if scheme == nil || !scheme.Distributed() {
 		return false, 0, 0, &irma.SessionError{
@@ -783,26 +1358,54 @@ func (client *Client) KeyshareChangePin(manager irma.SchemeManagerIdentifier, ol
 }
 
 func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdentifier, oldPin string, newPin string) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
 	kss, ok := client.keyshareServers[managerID]
 	if !ok {
 		return errors.New("Unknown keyshare server")
 	}
 
 	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer)
+	protocol, err := kss.pinProtocol()
+	if err != nil {
+		return err
+	}
+	kss.setVersionHeader(transport)
+	proof, err := protocol.prove(kss, transport, oldPin)
+	if err != nil {
+		return err
+	}
+	// Switches to the PAKE if the keyshare server has started supporting it, see pake.go
+	registration, version, err := registerPin(kss, transport, newPin, client.allowHashedPin(kss))
+	if err != nil {
+		return err
+	}
 	message := keyshareChangepin{
-		Username: kss.Username,
-		OldPin:   kss.HashedPin(oldPin),
-		NewPin:   kss.HashedPin(newPin),
+		Username:     kss.Username,
+		OldPin:       proof.Pin,
+		OldPinProof:  proof.Proof,
+		NewPin:       registration.Pin,
+		NewPinRecord: registration.Record,
 	}
 
 	res := &keysharePinStatus{}
-	err := transport.Post("users/change/pin", res, message)
+	if version != kss.protocolVersion() {
+		transport.SetHeader(kssVersionHeader, strconv.Itoa(version))
+	}
+	err = transport.Post("users/change/pin", res, message)
 	if err != nil {
 		return err
 	}
 
 	switch res.Status {
 	case kssPinSuccess:
+		if version != kss.protocolVersion() {
+			kss.PinProtocol = version
+			if err = client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+				return err
+			}
+		}
 		client.handler.ChangePinSuccess(managerID)
 	case kssPinFailure:
 		attempts, err := strconv.Atoi(res.Message)
@@ -825,15 +1428,25 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 
 // KeyshareRemove unenrolls the keyshare server of the specified scheme manager.
 func (client *Client) KeyshareRemove(manager irma.SchemeManagerIdentifier) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
 	if _, contains := client.keyshareServers[manager]; !contains {
 		return errors.New("Can't uninstall unknown keyshare server")
 	}
+	client.keyshareServers[manager].wipe()
 	delete(client.keyshareServers, manager)
 	return client.storage.StoreKeyshareServers(client.keyshareServers)
 }
 
 // KeyshareRemoveAll removes all keyshare server registrations.
 func (client *Client) KeyshareRemoveAll() error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
+	for _, kss := range client.keyshareServers {
+		kss.wipe()
+	}
 	client.keyshareServers = map[irma.SchemeManagerIdentifier]*keyshareServer{}
 	return client.storage.StoreKeyshareServers(client.keyshareServers)
 }
@@ -841,34 +1454,82 @@ func (client *Client) KeyshareRemoveAll() error {
 // Add, load and store log entries
 
 func (client *Client) addLogEntry(entry *LogEntry) error {
-	client.logs = append(client.logs, entry)
-	return client.storage.StoreLogs(client.logs)
+	// If the logs have not been loaded yet, there is no need to do so: loadLogs() will load the new entry
+	if client.logs != nil {
+		client.logs = append(client.logs, entry)
+	}
+	return client.storage.AppendLog(entry)
 }
 
-// Logs returns the log entries of past events.
+// Logs returns the log entries of past events, oldest first.
+//
+// Deprecated: this loads all log entries in memory; use LoadNewestLogs() and LoadLogsBefore() instead.
 func (client *Client) Logs() ([]*LogEntry, error) {
-	if client.logs == nil || len(client.logs) == 0 {
-		var err error
-		client.logs, err = client.storage.LoadLogs()
+	deprecated("Client.Logs", "Client.LoadNewestLogs")
+	return client.loadLogs()
+}
+
+// LoadNewestLogs returns at most max of the newest log entries, newest first. Older entries can
+// be loaded using LoadLogsBefore() with the Index of the oldest entry returned, e.g. when the user
+// scrolls down.
+func (client *Client) LoadNewestLogs(max int) ([]*LogEntry, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	return client.storage.LoadNewestLogs(max)
+}
+
+// LoadLogsBefore returns at most max of the log entries preceding the one at the specified
+// index, newest first.
+func (client *Client) LoadLogsBefore(index, max int) ([]*LogEntry, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	return client.storage.LoadLogsBefore(index, max)
+}
+
+// loadLogs returns all log entries, oldest first, loading them if necessary.
+func (client *Client) loadLogs() ([]*LogEntry, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	if client.logs == nil {
+		logs, err := client.storage.LoadLogs()
 		if err != nil {
 			return nil, err
 		}
+		client.logs = logs
 	}
 	return client.logs, nil
 }
 
 // SetCrashReportingPreference toggles whether or not crash reports should be sent to Sentry.
-// Has effect only after restarting.
+// Takes effect immediately; disabling also discards the recorded breadcrumbs.
 func (client *Client) SetCrashReportingPreference(enable bool) {
 	client.Preferences.EnableCrashReporting = enable
 	_ = client.storage.StorePreferences(client.Preferences)
 	client.applyPreferences()
 }
 
-func (client *Client) applyPreferences() {
-	if client.Preferences.EnableCrashReporting {
-		raven.SetDSN(SentryDSN)
-	} else {
-		raven.SetDSN("")
+// SetLanguagePreference sets the language of the user (e.g. "nl"), by which credentials are sorted.
+func (client *Client) SetLanguagePreference(lang string) {
+	client.Preferences.Language = lang
+	_ = client.storage.StorePreferences(client.Preferences)
+}
+
+// SetSessionTranscriptsPreference enables or disables recording transcripts of sessions.
+// When disabling, all recorded transcripts are discarded.
+func (client *Client) SetSessionTranscriptsPreference(enable bool) {
+	client.Preferences.EnableSessionTranscripts = enable
+	_ = client.storage.StorePreferences(client.Preferences)
+	if !enable {
+		client.transcriptsLock.Lock()
+		client.transcripts = nil
+		client.transcriptsLock.Unlock()
 	}
 }
+
+func (client *Client) applyPreferences() {
+	client.applyCrashReportingPreference()
+	client.applyStorageJournalPreference()
+}
@@ -0,0 +1,81 @@
+package irmaclient
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// CompactionResult describes the orphaned signatures removed by CompactStorage().
+type CompactionResult struct {
+	// Amount of signatures removed
+	Signatures int `json:"signatures"`
+	// Total size in bytes of the removed signatures
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+// ErrSessionsRunning is returned by CompactStorage() and BackupNow() when they are called while
+// sessions are running.
+var ErrSessionsRunning = errors.New("Cannot compact or back up storage while sessions are running")
+
+// CompactStorage removes the signatures in the storage of which the credential no longer exists,
+// which may remain after a crash or an interrupted removal of a credential or which were moved
+// aside by RepairStorage(), and reports how much space was reclaimed. Like the removal of
+// credentials, the signatures are wiped (see wipe.go). As the signatures of the credentials being
+// issued in a session are stored before their attributes, it fails with ErrSessionsRunning while
+// sessions are running, and sessions started meanwhile wait until it is done.
+func (client *Client) CompactStorage() (*CompactionResult, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	if client.runningSessions > 0 {
+		return nil, ErrSessionsRunning
+	}
+	s := &client.storage
+	if s.sql != nil {
+		s.record(JournalRemove, "sql:signatures", nil)
+		return s.sql.compact()
+	}
+
+	// The names and sizes of all files in the signature directory
+	var files map[string]int64
+	if s.memory != nil {
+		files = s.memory.list(signaturesDir)
+	} else {
+		infos, err := ioutil.ReadDir(s.path(signaturesDir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		files = make(map[string]int64, len(infos))
+		for _, info := range infos {
+			if !info.IsDir() {
+				files[info.Name()] = info.Size()
+			}
+		}
+	}
+
+	for _, lists := range []map[irma.CredentialTypeIdentifier][]*irma.AttributeList{client.attributes, client.archived} {
+		for _, attrlistlist := range lists {
+			for _, attrs := range attrlistlist {
+				delete(files, attrs.Hash())
+			}
+		}
+	}
+
+	result := &CompactionResult{}
+	for name, size := range files {
+		if err := s.wipeFile(signaturesDir + "/" + name); err != nil {
+			return result, err
+		}
+		result.Signatures++
+		result.Reclaimed += size
+	}
+	if result.Signatures > 0 {
+		irma.Logger.Infof("Removed %d orphaned signatures (%d bytes)", result.Signatures, result.Reclaimed)
+	}
+	return result, nil
+}
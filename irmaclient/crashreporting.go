@@ -0,0 +1,160 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/getsentry/raven-go"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the crash reporting to Sentry, which is enabled if SentryDSN is set and the user
+// did not disable it using SetCrashReportingPreference(). Panics occurring during sessions are reported,
+// as well as other failed sessions if SentryReportFailures is enabled and SentryLevel is raven.WARNING
+// or lower. Reports include only the type of the error and the stack trace, and breadcrumbs: the most
+// recent steps of sessions, i.e., their action, status updates, and outcome (with the type of the error
+// if any). Reports never contain hostnames, attributes, or other session contents. Breadcrumbs are kept
+// only in memory, and are discarded when crash reporting is disabled.
+
+// Like SentryDSN, these should be set in the init() function, so that they can be configured per build.
+var (
+	// SentryEnvironment is the environment tag of reports (e.g. "production", "beta")
+	SentryEnvironment = ""
+	// SentryRelease is the release tag of reports (e.g. the app version)
+	SentryRelease = ""
+	// SentryLevel is the minimum level of reports sent by the client
+	SentryLevel = raven.ERROR
+	// SentryReportFailures enables reports of failed sessions other than panics, at level raven.WARNING
+	SentryReportFailures = false
+	// SentryMaxBreadcrumbs is the amount of breadcrumbs attached to reports; 0 disables breadcrumbs
+	SentryMaxBreadcrumbs = 50
+)
+
+var sentrySeverities = map[raven.Severity]int{
+	raven.DEBUG: 0, raven.INFO: 1, raven.WARNING: 2, raven.ERROR: 3, raven.FATAL: 4,
+}
+
+// Breadcrumb is a sanitized session step, attached to crash reports.
+type Breadcrumb struct {
+	Timestamp int64  `json:"timestamp"`
+	Category  string `json:"category"`
+	Message   string `json:"message"`
+}
+
+// breadcrumbs is the raven.Interface by which the breadcrumbs are included in reports.
+type breadcrumbs []*Breadcrumb
+
+func (b breadcrumbs) Class() string { return "breadcrumbs" }
+
+func (b breadcrumbs) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Values []*Breadcrumb `json:"values"`
+	}{[]*Breadcrumb(b)})
+}
+
+type crashReporter struct {
+	breadcrumbs breadcrumbs
+	sync.Mutex
+}
+
+func (client *Client) crashReportingEnabled() bool {
+	return SentryDSN != "" && client.Preferences.EnableCrashReporting
+}
+
+// addBreadcrumb records a session step, if crash reporting is enabled.
+func (client *Client) addBreadcrumb(category, message string) {
+	if !client.crashReportingEnabled() || SentryMaxBreadcrumbs <= 0 {
+		return
+	}
+	client.crashReporter.Lock()
+	defer client.crashReporter.Unlock()
+	client.crashReporter.breadcrumbs = append(client.crashReporter.breadcrumbs,
+		&Breadcrumb{Timestamp: time.Now().Unix(), Category: category, Message: message})
+	if l := len(client.crashReporter.breadcrumbs); l > SentryMaxBreadcrumbs {
+		client.crashReporter.breadcrumbs = client.crashReporter.breadcrumbs[l-SentryMaxBreadcrumbs:]
+	}
+}
+
+// Breadcrumbs returns the breadcrumbs that would be attached to a crash report sent now.
+func (client *Client) Breadcrumbs() []*Breadcrumb {
+	client.crashReporter.Lock()
+	defer client.crashReporter.Unlock()
+	return append([]*Breadcrumb{}, client.crashReporter.breadcrumbs...)
+}
+
+// sentryCapture sends the report to Sentry.
+var sentryCapture = func(packet *raven.Packet) {
+	raven.Capture(packet, nil)
+}
+
+// reportError sends a report of the session error to Sentry, if crash reporting is enabled and the
+// level is at least SentryLevel. The message of the error may contain the URL and token of the session,
+// or the error message of a remote server, so only the type of the error is included.
+func (client *Client) reportError(level raven.Severity, err *irma.SessionError) {
+	if !client.crashReportingEnabled() || sentrySeverities[level] < sentrySeverities[SentryLevel] {
+		return
+	}
+	msg := "Session failure: " + string(err.ErrorType)
+	// Without context lines, which would contain source code around the frames rather than just their location
+	exception := raven.NewException(err, raven.GetOrNewStacktrace(err, 1, 0, nil))
+	exception.Value = msg
+	packet := raven.NewPacket(msg, exception, breadcrumbs(client.Breadcrumbs()))
+	packet.Level = level
+	sentryCapture(packet)
+}
+
+func (client *Client) applyCrashReportingPreference() {
+	if client.Preferences.EnableCrashReporting {
+		raven.SetDSN(SentryDSN)
+		raven.SetEnvironment(SentryEnvironment)
+		raven.SetRelease(SentryRelease)
+		return
+	}
+	raven.SetDSN("")
+	client.crashReporter.Lock()
+	client.crashReporter.breadcrumbs = nil
+	client.crashReporter.Unlock()
+}
+
+// breadcrumbHandler wraps the Handler of a session, recording its steps as breadcrumbs.
+type breadcrumbHandler struct {
+	Handler
+	client *Client
+	action irma.Action
+}
+
+func (h *breadcrumbHandler) StatusUpdate(action irma.Action, status irma.Status) {
+	h.client.addBreadcrumb("session."+string(action), string(status))
+	h.Handler.StatusUpdate(action, status)
+}
+
+func (h *breadcrumbHandler) Success(result string) {
+	h.client.addBreadcrumb("session."+string(h.action), "success")
+	h.Handler.Success(result)
+}
+
+func (h *breadcrumbHandler) Cancelled() {
+	h.client.addBreadcrumb("session."+string(h.action), "cancelled")
+	h.Handler.Cancelled()
+}
+
+func (h *breadcrumbHandler) Failure(err *irma.SessionError) {
+	h.client.addBreadcrumb("session."+string(h.action), "failure: "+string(err.ErrorType))
+	if err.ErrorType == irma.ErrorPanic {
+		h.client.reportError(raven.FATAL, err)
+	} else if SentryReportFailures {
+		h.client.reportError(raven.WARNING, err)
+	}
+	h.Handler.Failure(err)
+}
+
+func (h *breadcrumbHandler) UnsatisfiableRequest(serverName irma.TranslatedString, missing irma.AttributeDisjunctionList) {
+	h.client.addBreadcrumb("session."+string(h.action), "unsatisfiable")
+	h.Handler.UnsatisfiableRequest(serverName, missing)
+}
+
+// startBreadcrumbs starts recording the steps of the session as breadcrumbs.
+func (session *session) startBreadcrumbs() {
+	session.Handler = &breadcrumbHandler{Handler: session.Handler, client: session.client, action: session.Action}
+}
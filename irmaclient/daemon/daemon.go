@@ -0,0 +1,241 @@
+// Package daemon runs an IRMA client as a long-running process that is controlled over an HTTP API
+// on localhost, so that applications in any language (e.g. desktop apps or browser extensions) can
+// use the client without linking to it. Through the API, credentials can be listed, sessions started
+// from session pointers, and the permission and PIN prompts of sessions answered.
+//
+// All requests must include the token of the daemon in an "Authorization: Bearer <token>" header,
+// which prevents websites visited by the user from controlling the client through the browser.
+package daemon
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Configuration contains the configuration of the daemon.
+type Configuration struct {
+	// Path to the storage of the client
+	StoragePath string
+	// Path to a (possibly readonly) folder containing irma_configuration
+	IrmaConfigurationPath string
+	// Address to listen at; defaults to 127.0.0.1. Listening at other addresses than
+	// those of the loopback interface exposes the client to the network.
+	ListenAddress string
+	// Port to listen at
+	Port int
+	// Token that clients of the API must send; if empty, a random token is generated
+	Token string
+	// How long finished sessions remain retrievable over the API; defaults to DefaultSessionRetention
+	SessionRetention time.Duration
+	// Logger for logging
+	Logger *logrus.Logger
+}
+
+// DefaultPort is the port at which the daemon listens if none is configured.
+const DefaultPort = 48690
+
+// DefaultSessionRetention is how long finished sessions remain retrievable if not configured otherwise.
+const DefaultSessionRetention = 10 * time.Minute
+
+// Daemon runs an IRMA client controlled over an HTTP API.
+type Daemon struct {
+	Client *irmaclient.Client
+
+	conf     *Configuration
+	server   *http.Server
+	sessions map[string]*Session
+	lock     sync.Mutex
+}
+
+// New creates a new Daemon along with the client that it runs, which is loaded from the configured storage.
+func New(conf *Configuration) (*Daemon, error) {
+	if conf.Logger == nil {
+		conf.Logger = logrus.StandardLogger()
+	}
+	if conf.ListenAddress == "" {
+		conf.ListenAddress = "127.0.0.1"
+	}
+	if conf.Port == 0 {
+		conf.Port = DefaultPort
+	}
+	if conf.SessionRetention <= 0 {
+		conf.SessionRetention = DefaultSessionRetention
+	}
+	if conf.Token == "" {
+		token, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		conf.Token = token
+	}
+	if err := fs.EnsureDirectoryExists(conf.StoragePath); err != nil {
+		return nil, err
+	}
+
+	d := &Daemon{
+		conf:     conf,
+		sessions: map[string]*Session{},
+	}
+	client, err := irmaclient.New(conf.StoragePath, conf.IrmaConfigurationPath, &clientHandler{logger: conf.Logger})
+	if _, ok := err.(*irma.SchemeManagerError); ok {
+		// The client is usable without the scheme that could not be parsed
+		conf.Logger.Warn("Failed to parse scheme: ", err)
+	} else if err != nil {
+		return nil, err
+	}
+	d.Client = client
+	return d, nil
+}
+
+// Token returns the token that must be sent in all requests to the API.
+func (d *Daemon) Token() string {
+	return d.conf.Token
+}
+
+// Start listens for requests to the API, blocking until Stop() is called.
+func (d *Daemon) Start() error {
+	addr := fmt.Sprintf("%s:%d", d.conf.ListenAddress, d.conf.Port)
+	if ip := net.ParseIP(d.conf.ListenAddress); ip == nil || !ip.IsLoopback() {
+		d.conf.Logger.Warnf("Listening at %s, which is not a loopback address", d.conf.ListenAddress)
+	}
+	d.server = &http.Server{Addr: addr, Handler: d.Handler()}
+	d.conf.Logger.Info("Listening at ", addr)
+	err := d.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Stop stops the daemon, dismissing all running sessions and releasing the storage of the client.
+func (d *Daemon) Stop() {
+	var dismissers []irmaclient.SessionDismisser
+	d.lock.Lock()
+	for _, session := range d.sessions {
+		if !session.finished() && session.dismisser != nil {
+			dismissers = append(dismissers, session.dismisser)
+		}
+	}
+	d.lock.Unlock()
+	for _, dismisser := range dismissers {
+		dismisser.Dismiss()
+	}
+	if d.server != nil {
+		_ = d.server.Close()
+	}
+	if err := d.Client.Close(); err != nil {
+		d.conf.Logger.Warn("Failed to close client: ", err)
+	}
+}
+
+// Handler returns the http.Handler of the API.
+func (d *Daemon) Handler() http.Handler {
+	router := chi.NewRouter()
+	router.Use(d.authenticate)
+
+	router.Get("/credentials", d.handleCredentials)
+	router.Post("/sessions", d.handleStartSession)
+	router.Get("/sessions/{id}", d.handleGetSession)
+	router.Delete("/sessions/{id}", d.handleDeleteSession)
+	router.Post("/sessions/{id}/permission", d.handlePermission)
+	router.Post("/sessions/{id}/pin", d.handlePin)
+	router.Post("/sessions/{id}/schememanager", d.handleSchemeManagerPermission)
+
+	return router
+}
+
+// authenticate is a middleware that rejects requests without the token of the daemon.
+func (d *Daemon) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(d.conf.Token)) != 1 {
+			server.WriteError(w, server.ErrorUnauthorized, "missing or incorrect token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pruneSessions removes the sessions that finished longer than the session retention ago.
+// The lock of the daemon must be held.
+func (d *Daemon) pruneSessions() {
+	threshold := time.Now().Add(-d.conf.SessionRetention)
+	for id, session := range d.sessions {
+		if session.finished() && session.finishedAt.Before(threshold) {
+			delete(d.sessions, id)
+		}
+	}
+}
+
+func (d *Daemon) session(id string) (*Session, error) {
+	session, ok := d.sessions[id]
+	if !ok {
+		return nil, errors.Errorf("Unknown session %s", id)
+	}
+	return session, nil
+}
+
+func randomToken() (string, error) {
+	bts := make([]byte, 16)
+	if _, err := rand.Read(bts); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bts), nil
+}
+
+// clientHandler logs the events of the client.
+type clientHandler struct {
+	logger *logrus.Logger
+}
+
+func (h *clientHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error) {
+	h.logger.WithField("scheme", manager.String()).Error("Keyshare enrollment failed: ", err)
+}
+func (h *clientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
+	h.logger.WithField("scheme", manager.String()).Info("Keyshare enrollment succeeded")
+}
+func (h *clientHandler) ChangePinFailure(manager irma.SchemeManagerIdentifier, err error) {
+	h.logger.WithField("scheme", manager.String()).Error("Changing PIN failed: ", err)
+}
+func (h *clientHandler) ChangePinSuccess(manager irma.SchemeManagerIdentifier) {
+	h.logger.WithField("scheme", manager.String()).Info("PIN changed")
+}
+func (h *clientHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int) {
+	h.logger.WithField("scheme", manager.String()).Warnf("Changing PIN failed: incorrect PIN, %d attempts remaining", attempts)
+}
+func (h *clientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int) {
+	h.logger.WithField("scheme", manager.String()).Warnf("Changing PIN failed: blocked for %d seconds", timeout)
+}
+func (h *clientHandler) CredentialLimitReached(id irma.CredentialTypeIdentifier, existing []*irma.CredentialInfo, callback func(index int)) {
+	h.logger.WithField("credential", id.String()).Info("Maximum amount of instances reached, replacing the oldest")
+	callback(0)
+}
+func (h *clientHandler) StorageRepaired(damage []*irmaclient.StorageDamage) {
+	for _, d := range damage {
+		h.logger.WithField("file", d.File).Warn("Removed corrupted storage: ", d.Err)
+	}
+}
+func (h *clientHandler) SchemeStale(scheme irma.SchemeManagerIdentifier, refreshed time.Time) {
+	h.logger.WithField("scheme", scheme.String()).Warn("Scheme not refreshed since ", refreshed.Format(time.RFC3339))
+}
+func (h *clientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {
+	h.logger.Info("Configuration updated")
+}
+func (h *clientHandler) UpdateAttributes() {
+	h.logger.Debug("Attributes updated")
+}
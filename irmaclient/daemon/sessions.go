@@ -0,0 +1,316 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Prompt is a question to the user that a session is waiting for.
+type Prompt string
+
+const (
+	PromptNone          = Prompt("")
+	PromptPermission    = Prompt("permission")    // answer at POST /sessions/{id}/permission
+	PromptPin           = Prompt("pin")           // answer at POST /sessions/{id}/pin
+	PromptSchemeManager = Prompt("schememanager") // answer at POST /sessions/{id}/schememanager
+)
+
+// Session is the state of a session of the client, as returned by GET /sessions/{id}.
+type Session struct {
+	ID     string      `json:"id"`
+	Action irma.Action `json:"action,omitempty"`
+	Status irma.Status `json:"status,omitempty"`
+
+	// Prompt that the session is waiting for, if any, along with the information required to answer it
+	Prompt            Prompt                        `json:"prompt,omitempty"`
+	Request           irma.SessionRequest           `json:"request,omitempty"`
+	Requestor         *irmaclient.SessionRequestor  `json:"requestor,omitempty"`
+	Candidates        [][]*irma.AttributeIdentifier `json:"candidates,omitempty"`
+	RemainingAttempts int                           `json:"remainingAttempts,omitempty"`
+	SchemeManager     *irma.SchemeManager           `json:"schemeManager,omitempty"`
+	Missing           irma.AttributeDisjunctionList `json:"missing,omitempty"`
+
+	// Outcome of the session: "success", "cancelled", "unsatisfiable" or "failure"
+	Result    string         `json:"result,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	ErrorType irma.ErrorType `json:"errorType,omitempty"`
+
+	finishedAt    time.Time
+	dismisser     irmaclient.SessionDismisser
+	permission    irmaclient.PermissionHandler
+	pin           irmaclient.PinHandler
+	schemeManager func(proceed bool)
+}
+
+func (session *Session) finished() bool {
+	return session.Result != ""
+}
+
+// prompt sets the prompt that the session waits for, clearing the previous one.
+func (session *Session) prompt(prompt Prompt) {
+	session.Prompt = prompt
+	session.permission, session.pin, session.schemeManager = nil, nil, nil
+}
+
+// PermissionAnswer is the body of POST /sessions/{id}/permission.
+type PermissionAnswer struct {
+	Proceed bool                   `json:"proceed"`
+	Choice  *irma.DisclosureChoice `json:"choice,omitempty"`
+}
+
+// PinAnswer is the body of POST /sessions/{id}/pin.
+type PinAnswer struct {
+	Proceed bool   `json:"proceed"`
+	Pin     string `json:"pin"`
+}
+
+// SchemeManagerAnswer is the body of POST /sessions/{id}/schememanager.
+type SchemeManagerAnswer struct {
+	Proceed bool `json:"proceed"`
+}
+
+func (d *Daemon) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, d.Client.CredentialInfoList())
+}
+
+func (d *Daemon) handleStartSession(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	id, err := randomToken()
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+
+	session := &Session{ID: id}
+	d.lock.Lock()
+	d.pruneSessions()
+	d.sessions[id] = session
+	d.lock.Unlock()
+	dismisser := d.Client.NewSession(string(body), &sessionHandler{daemon: d, session: session})
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	session.dismisser = dismisser
+	server.WriteJson(w, session)
+}
+
+func (d *Daemon) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	session, err := d.session(chi.URLParam(r, "id"))
+	if err != nil {
+		server.WriteError(w, server.ErrorSessionUnknown, err.Error())
+		return
+	}
+	server.WriteJson(w, session)
+}
+
+func (d *Daemon) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	session, err := d.session(chi.URLParam(r, "id"))
+	if err != nil {
+		d.lock.Unlock()
+		server.WriteError(w, server.ErrorSessionUnknown, err.Error())
+		return
+	}
+	delete(d.sessions, session.ID)
+	dismisser := session.dismisser
+	finished := session.finished()
+	d.lock.Unlock()
+
+	// Dismissing informs the handler of the session, which takes the lock
+	if !finished && dismisser != nil {
+		dismisser.Dismiss()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) handlePermission(w http.ResponseWriter, r *http.Request) {
+	var answer PermissionAnswer
+	d.answer(w, r, PromptPermission, &answer, func(session *Session) {
+		callback := session.permission
+		go callback(answer.Proceed, answer.Choice)
+	})
+}
+
+func (d *Daemon) handlePin(w http.ResponseWriter, r *http.Request) {
+	var answer PinAnswer
+	d.answer(w, r, PromptPin, &answer, func(session *Session) {
+		callback := session.pin
+		go callback(answer.Proceed, answer.Pin)
+	})
+}
+
+func (d *Daemon) handleSchemeManagerPermission(w http.ResponseWriter, r *http.Request) {
+	var answer SchemeManagerAnswer
+	d.answer(w, r, PromptSchemeManager, &answer, func(session *Session) {
+		callback := session.schemeManager
+		go callback(answer.Proceed)
+	})
+}
+
+// answer parses the answer to the specified prompt from the request body into dest, and if the session
+// is waiting for that prompt, clears the prompt and invokes the callback with the session.
+func (d *Daemon) answer(w http.ResponseWriter, r *http.Request, prompt Prompt, dest interface{}, callback func(*Session)) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err = json.Unmarshal(body, dest); err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	session, err := d.session(chi.URLParam(r, "id"))
+	if err != nil {
+		server.WriteError(w, server.ErrorSessionUnknown, err.Error())
+		return
+	}
+	if session.Prompt != prompt {
+		server.WriteError(w, server.ErrorUnexpectedRequest, "session is not waiting for "+string(prompt))
+		return
+	}
+	callback(session)
+	session.prompt(PromptNone)
+	server.WriteJson(w, session)
+}
+
+// sessionHandler records the events of a session into its Session, for retrieval over the API.
+type sessionHandler struct {
+	daemon  *Daemon
+	session *Session
+}
+
+// update applies f to the session while holding the lock of the daemon.
+func (h *sessionHandler) update(f func(session *Session)) {
+	h.daemon.lock.Lock()
+	defer h.daemon.lock.Unlock()
+	f(h.session)
+}
+
+func (h *sessionHandler) finish(result string, err *irma.SessionError) {
+	h.update(func(session *Session) {
+		session.prompt(PromptNone)
+		session.Result = result
+		session.finishedAt = time.Now()
+		if err != nil {
+			session.Error = err.Error()
+			session.ErrorType = err.ErrorType
+		}
+	})
+}
+
+func (h *sessionHandler) StatusUpdate(action irma.Action, status irma.Status) {
+	h.update(func(session *Session) {
+		session.Action = action
+		session.Status = status
+	})
+}
+
+func (h *sessionHandler) Success(result string) {
+	h.finish("success", nil)
+}
+
+func (h *sessionHandler) Cancelled() {
+	h.finish("cancelled", nil)
+}
+
+func (h *sessionHandler) Failure(err *irma.SessionError) {
+	h.finish("failure", err)
+}
+
+func (h *sessionHandler) UnsatisfiableRequest(ServerName irma.TranslatedString, missing irma.AttributeDisjunctionList) {
+	h.update(func(session *Session) {
+		session.Missing = missing
+	})
+	h.finish("unsatisfiable", nil)
+}
+
+func (h *sessionHandler) keyshareFailure(manager irma.SchemeManagerIdentifier, format string, args ...interface{}) {
+	h.finish("failure", &irma.SessionError{
+		ErrorType: irma.ErrorKeyshare,
+		Err:       errors.Errorf("keyshare server of scheme %s: "+format, append([]interface{}{manager}, args...)...),
+	})
+}
+
+func (h *sessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.keyshareFailure(manager, "blocked for %d seconds", duration)
+}
+
+func (h *sessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.keyshareFailure(manager, "enrollment incomplete")
+}
+
+func (h *sessionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.keyshareFailure(manager, "not enrolled")
+}
+
+func (h *sessionHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.keyshareFailure(manager, "enrollment deleted")
+}
+
+func (h *sessionHandler) requestPermission(request irma.SessionRequest, requestor *irmaclient.SessionRequestor, callback irmaclient.PermissionHandler) {
+	candidates, _ := h.daemon.Client.CheckSatisfiability(request.ToDisclose())
+	h.update(func(session *Session) {
+		session.prompt(PromptPermission)
+		session.Request = request
+		session.Requestor = requestor
+		session.Candidates = candidates
+		session.permission = callback
+	})
+}
+
+func (h *sessionHandler) RequestIssuancePermission(request irma.IssuanceRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.requestPermission(&request, &irmaclient.SessionRequestor{Name: ServerName}, callback)
+}
+
+func (h *sessionHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.requestPermission(&request, &irmaclient.SessionRequestor{Name: ServerName}, callback)
+}
+
+func (h *sessionHandler) RequestSignaturePermission(request irma.SignatureRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.requestPermission(&request, &irmaclient.SessionRequestor{Name: ServerName}, callback)
+}
+
+func (h *sessionHandler) RequestIssuancePermissionFrom(request irma.IssuanceRequest, requestor *irmaclient.SessionRequestor, callback irmaclient.PermissionHandler) {
+	h.requestPermission(&request, requestor, callback)
+}
+
+func (h *sessionHandler) RequestVerificationPermissionFrom(request irma.DisclosureRequest, requestor *irmaclient.SessionRequestor, callback irmaclient.PermissionHandler) {
+	h.requestPermission(&request, requestor, callback)
+}
+
+func (h *sessionHandler) RequestSignaturePermissionFrom(request irma.SignatureRequest, requestor *irmaclient.SessionRequestor, callback irmaclient.PermissionHandler) {
+	h.requestPermission(&request, requestor, callback)
+}
+
+func (h *sessionHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	h.update(func(session *Session) {
+		session.prompt(PromptSchemeManager)
+		session.SchemeManager = manager
+		session.schemeManager = callback
+	})
+}
+
+func (h *sessionHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	h.update(func(session *Session) {
+		session.prompt(PromptPin)
+		session.RemainingAttempts = remainingAttempts
+		session.pin = callback
+	})
+}
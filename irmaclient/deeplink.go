@@ -0,0 +1,52 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// When a session pointer reaches the app through a deep link (e.g. a universal link) on the same
+// device, instead of by scanning a QR that the user sees, the user cannot tell which app or website
+// opened the link: a malicious app could open a link to a session of its own choosing while the user
+// expects a session of another app. To bind the session to the app or website that started it, a
+// session started using NewDeepLinkSession() includes a random confirmation code that the client sends
+// to the server when retrieving the session request, and that is shown to the user in the permission
+// request (see SessionRequestor.ConfirmationCode). The app or website that started the session retrieves
+// the code from the server at GET /session/{token}/confirmation and shows it as well, so that the user
+// can check that the codes are equal before consenting.
+
+const confirmationCodeDigits = 6
+
+// NewDeepLinkSession starts a new IRMA session from a session pointer that was received through a
+// deep link, generating a confirmation code for it (see above). The session is otherwise as
+// those started by NewSession().
+func (client *Client) NewDeepLinkSession(sessionpointer string, handler Handler) SessionDismisser {
+	if err := client.checkUnlocked(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorWalletLocked, Err: err})
+		return nil
+	}
+	qr := &irma.Qr{}
+	if err := irma.UnmarshalValidate([]byte(sessionpointer), qr); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err, Info: sessionpointer})
+		return nil
+	}
+	code, err := newConfirmationCode()
+	if err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+		return nil
+	}
+	return client.newQrSession(qr, handler, code)
+}
+
+// newConfirmationCode returns a random code of confirmationCodeDigits decimal digits.
+func newConfirmationCode() (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(confirmationCodeDigits), nil)
+	i, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", confirmationCodeDigits, i), nil
+}
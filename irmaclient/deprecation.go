@@ -0,0 +1,20 @@
+package irmaclient
+
+import (
+	"sync"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the runtime warnings for the deprecated parts of the API of this package,
+// which are kept for apps that have not yet migrated to the versioned API of the v2 package. A
+// deprecated function logs a warning naming its replacement the first time it is called.
+
+var deprecationWarnings sync.Map
+
+// deprecated warns that the named function is deprecated, once per function.
+func deprecated(name, replacement string) {
+	if _, warned := deprecationWarnings.LoadOrStore(name, true); !warned {
+		irma.Logger.Warnf("irmaclient: %s is deprecated and will be removed in a future version, use %s instead", name, replacement)
+	}
+}
@@ -0,0 +1,113 @@
+package irmaclient
+
+import (
+	"sort"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// RequestorDisclosures summarizes which attributes were disclosed to a requestor, as part of
+// the privacy overview returned by DisclosureSummary().
+type RequestorDisclosures struct {
+	// Hostname and name of the requestor, as in SessionRequestor. These are empty for sessions
+	// from log entries of earlier versions, which did not record the requestor.
+	Hostname string                `json:"hostname,omitempty"`
+	Name     irma.TranslatedString `json:"name,omitempty"`
+
+	// Amount of sessions in which attributes were disclosed to the requestor
+	Sessions    int            `json:"sessions"`
+	LastSession irma.Timestamp `json:"lastSession"`
+	// Disclosed attributes, sorted by attribute type
+	Attributes []*AttributeDisclosures `json:"attributes"`
+}
+
+// AttributeDisclosures summarizes the disclosures of an attribute type to a requestor.
+type AttributeDisclosures struct {
+	Type irma.AttributeTypeIdentifier `json:"type"`
+	// Amount of sessions in which the attribute was disclosed
+	Count int            `json:"count"`
+	Last  irma.Timestamp `json:"last"`
+}
+
+// DisclosureSummary computes from the logs a privacy overview of which attributes were disclosed
+// to which requestors (in disclosure, signature and issuance sessions), how many times and when last.
+// The requestors are sorted by their last session, most recent first. No attribute values are included.
+// The logs are scanned one segment at a time. Log entries of which the disclosed attributes cannot be
+// determined (e.g. because their scheme is no longer present) are skipped.
+func (client *Client) DisclosureSummary() ([]*RequestorDisclosures, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	end, err := client.storage.LogPosition()
+	if err != nil {
+		return nil, err
+	}
+
+	requestors := map[string]*RequestorDisclosures{}
+	attributes := map[*RequestorDisclosures]map[irma.AttributeTypeIdentifier]*AttributeDisclosures{}
+	err = client.storage.EachLogBefore(end, func(entry *LogEntry) (bool, error) {
+		if entry.Type != irma.ActionDisclosing && entry.Type != irma.ActionSigning && entry.Type != irma.ActionIssuing {
+			return true, nil
+		}
+		disclosed, err := entry.GetDisclosedCredentials(client.Configuration)
+		if err != nil {
+			irma.Logger.Warnf("Skipping log entry %d in disclosure summary: %s", entry.Index, err.Error())
+			return true, nil
+		}
+		if len(disclosed) == 0 {
+			return true, nil
+		}
+
+		key := entry.Hostname
+		if key == "" {
+			key = "name:" + entry.ServerName["en"]
+		}
+		requestor := requestors[key]
+		if requestor == nil {
+			requestor = &RequestorDisclosures{Hostname: entry.Hostname}
+			requestors[key] = requestor
+			attributes[requestor] = map[irma.AttributeTypeIdentifier]*AttributeDisclosures{}
+		}
+		requestor.Sessions++
+		// The entries are scanned newest first, so of entries having the same time the first one wins
+		if requestor.Sessions == 1 || time.Time(entry.Time).After(time.Time(requestor.LastSession)) {
+			requestor.LastSession = entry.Time
+			requestor.Name = entry.ServerName
+		}
+
+		seen := map[irma.AttributeTypeIdentifier]bool{}
+		for _, attr := range disclosed {
+			if seen[attr.Identifier] {
+				continue
+			}
+			seen[attr.Identifier] = true
+			summary := attributes[requestor][attr.Identifier]
+			if summary == nil {
+				summary = &AttributeDisclosures{Type: attr.Identifier}
+				attributes[requestor][attr.Identifier] = summary
+				requestor.Attributes = append(requestor.Attributes, summary)
+			}
+			summary.Count++
+			if time.Time(entry.Time).After(time.Time(summary.Last)) {
+				summary.Last = entry.Time
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := make([]*RequestorDisclosures, 0, len(requestors))
+	for _, requestor := range requestors {
+		sort.Slice(requestor.Attributes, func(i, j int) bool {
+			return requestor.Attributes[i].Type.String() < requestor.Attributes[j].Type.String()
+		})
+		summary = append(summary, requestor)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		return time.Time(summary[i].LastSession).After(time.Time(summary[j].LastSession))
+	})
+	return summary, nil
+}
@@ -0,0 +1,29 @@
+package irmaclient
+
+import (
+	"encoding/json"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// tokenHandler wraps the Handler of a session in which a disclosure token is made (i.e., a manual
+// session with a disclosure request having a validity window), converting the disclosure resulting
+// from the session into an irma.DisclosureToken.
+type tokenHandler struct {
+	Handler
+	request *irma.DisclosureRequest
+}
+
+func (h *tokenHandler) Success(result string) {
+	disclosure := &irma.Disclosure{}
+	if err := json.Unmarshal([]byte(result), disclosure); err != nil {
+		h.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return
+	}
+	bts, err := json.Marshal(h.request.Token(disclosure))
+	if err != nil {
+		h.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return
+	}
+	h.Handler.Success(string(bts))
+}
@@ -0,0 +1,347 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"golang.org/x/crypto/scrypt"
+)
+
+// This file contains the optional encryption of the storage of the client at rest. If New() is passed
+// WithStoragePassphrase() or WithStorageKey(), all files that the client stores (the secret key,
+// signatures, attributes, logs, keyshare server information including tokens, and so on) are encrypted
+// using AES-GCM, with a key derived from the passphrase using scrypt, or the key itself. Each file is
+// encrypted as a whole, except for the log segments, whose lines are encrypted separately so that log
+// entries can still be appended without rewriting the segment. The name of the file is authenticated
+// along with its contents, so that encrypted files cannot be swapped.
+//
+// Files are decrypted transparently when loaded. When encryption is first enabled on an existing storage,
+// all of its files are encrypted; if this is interrupted, it is resumed the next time. Afterwards the
+// schemaFile records that the storage is encrypted, and files (or lines of log segments) that are not
+// encrypted are refused, so that they cannot be planted in the storage. The salt of the passphrase, and a
+// check value with which an incorrect passphrase or key is detected, are stored unencrypted in the
+// storageKeyFile. Encrypted storage can only be opened when passing the passphrase or key; the
+// irma_configuration folder is not encrypted.
+
+var (
+	// ErrStorageEncrypted is returned by New() if the storage is encrypted but no passphrase or key is passed.
+	ErrStorageEncrypted = errors.New("Storage is encrypted")
+	// ErrIncorrectStorageKey is returned by New() if the storage is encrypted with another passphrase or key.
+	ErrIncorrectStorageKey = errors.New("Incorrect storage passphrase or key")
+
+	errStorageKeyMissing = errors.New("Storage is encrypted but its key file is missing")
+)
+
+const (
+	storageKeyFile = "storagekey"
+	storageKeySize = 32
+	// Prefix of encrypted files
+	encryptedFileMagic = "IRMAENC1"
+	// Encrypted into the check value of the storageKeyFile
+	storageKeyCheck = "irmaclient storage key"
+	// Encrypted into the check value instead while the wallet lock is enabled, see walletlock.go
+	storageKeyCheckWalletLock = "irmaclient storage key, wallet lock enabled"
+)
+
+// WithStoragePassphrase encrypts the storage of the client using a key derived from the passphrase.
+func WithStoragePassphrase(passphrase string) Option {
+	return func(o *options) {
+		o.passphrase = &passphrase
+	}
+}
+
+// WithStorageKey encrypts the storage of the client using the specified 32 byte key, e.g. obtained
+// from a key handle in the keystore of the platform (iOS Keychain or Android Keystore).
+func WithStorageKey(key []byte) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// storageKeyInfo is the unencrypted contents of the storageKeyFile of encrypted storage.
+type storageKeyInfo struct {
+	// Salt of the passphrase, absent if the storage is encrypted with a key
+	Salt []byte `json:"salt,omitempty"`
+	// storageKeyCheck encrypted with the storage key
+	Check []byte `json:"check"`
+	// Whether or not all files present when encryption was enabled have been encrypted
+	Migrated bool `json:"migrated"`
+}
+
+// setupEncryption enables encryption of the storage if specified by the options, encrypting
+// existing files if necessary, and checks that the passphrase or key is correct if it was
+// already encrypted.
+func (s *storage) setupEncryption(opts *options) error {
+	info := &storageKeyInfo{}
+	bts, err := s.readFile(storageKeyFile)
+	if err != nil {
+		return err
+	}
+	exists := bts != nil
+	if exists {
+		if err = json.Unmarshal(bts, info); err != nil {
+			return err
+		}
+	}
+
+	schema, err := s.loadSchema()
+	if err != nil {
+		return err
+	}
+	encrypted := schema != nil && schema.Encrypted
+
+	if opts.passphrase == nil && opts.key == nil {
+		if exists || encrypted {
+			return ErrStorageEncrypted
+		}
+		return nil
+	}
+	if !exists && encrypted {
+		return errStorageKeyMissing
+	}
+	if opts.passphrase != nil && opts.key != nil {
+		return errors.New("Cannot encrypt storage with both a passphrase and a key")
+	}
+	if !exists && opts.passphrase != nil {
+		info.Salt = make([]byte, storageKeySize)
+		if _, err = rand.Read(info.Salt); err != nil {
+			return err
+		}
+	}
+	if (opts.passphrase != nil) != (info.Salt != nil) {
+		return ErrIncorrectStorageKey // encrypted with a key instead of a passphrase or vice versa
+	}
+
+	key := opts.key
+	if opts.passphrase != nil {
+		key, err = scrypt.Key([]byte(*opts.passphrase), info.Salt, walletPinScryptN, walletPinScryptR, walletPinScryptP, storageKeySize)
+		if err != nil {
+			return err
+		}
+	}
+	if len(key) != storageKeySize {
+		return errors.Errorf("Storage key must be %d bytes", storageKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if s.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+
+	if exists {
+		check, err := s.decrypt(info.Check, storageKeyFile)
+		if err != nil || (string(check) != storageKeyCheck && string(check) != storageKeyCheckWalletLock) {
+			s.aead = nil
+			return ErrIncorrectStorageKey
+		}
+		s.walletLockCheck = string(check) == storageKeyCheckWalletLock
+	} else {
+		if info.Check, err = s.encrypt([]byte(storageKeyCheck), storageKeyFile); err != nil {
+			return err
+		}
+		if err = s.storeKeyInfo(info); err != nil {
+			return err
+		}
+	}
+
+	if !info.Migrated {
+		if err = s.encryptExisting(exists); err != nil {
+			return err
+		}
+		info.Migrated = true
+		if err = s.storeKeyInfo(info); err != nil {
+			return err
+		}
+	}
+	if !encrypted {
+		return s.markEncrypted()
+	}
+	return nil
+}
+
+// markEncrypted records in the schemaFile that all files of the storage are encrypted.
+func (s *storage) markEncrypted() error {
+	schema, err := s.schema()
+	if err != nil {
+		return err
+	}
+	schema.Encrypted = true
+	return s.storeSchema(schema)
+}
+
+// markKeyInfo records in the check value of encrypted storage whether or not the wallet lock
+// is enabled. As the check value is authenticated with the storage key, this cannot be undone
+// without it.
+func (s *storage) markKeyInfo(walletLock bool) error {
+	if s.aead == nil {
+		return nil
+	}
+	info := &storageKeyInfo{}
+	if err := s.loadKeyInfo(info); err != nil {
+		return err
+	}
+	check := storageKeyCheck
+	if walletLock {
+		check = storageKeyCheckWalletLock
+	}
+	var err error
+	if info.Check, err = s.encrypt([]byte(check), storageKeyFile); err != nil {
+		return err
+	}
+	if err = s.storeKeyInfo(info); err != nil {
+		return err
+	}
+	s.walletLockCheck = walletLock
+	return nil
+}
+
+func (s *storage) loadKeyInfo(info *storageKeyInfo) error {
+	bts, err := s.readFile(storageKeyFile)
+	if err != nil {
+		return err
+	}
+	if bts == nil {
+		return errors.New("Storage key file is missing")
+	}
+	return json.Unmarshal(bts, info)
+}
+
+func (s *storage) storeKeyInfo(info *storageKeyInfo) error {
+	bts, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(storageKeyFile, bts)
+}
+
+// encryptExisting encrypts all files in the storage that are not yet encrypted. Unless an earlier
+// run is resumed, no file may be encrypted already: that would mean that the storageKeyFile
+// of encrypted storage was removed, along with what it records (see markKeyInfo()).
+func (s *storage) encryptExisting(resume bool) error {
+	if s.memory != nil {
+		return nil // in-memory storage is empty when encryption is enabled
+	}
+	return s.walk(func(file, path string, info os.FileInfo) error {
+		if info.IsDir() {
+			if file == "irma_configuration" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if file == storageKeyFile || file == schemaFile || file == lockFile || file == locationsFile || strings.HasPrefix(file, sqlStorageFile) {
+			return nil
+		}
+
+		bts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		journal := strings.HasPrefix(file, journalDir+"/")
+		if strings.HasPrefix(file, logSegmentsDir+"/") && file != logIndexFile || journal {
+			// Encrypt each line of log segments and of the journal separately
+			ad := file
+			if journal {
+				ad = journalDir // see appendJournal()
+			}
+			var buf bytes.Buffer
+			for _, line := range bytes.Split(bts, []byte{'\n'}) {
+				if len(line) == 0 {
+					continue
+				}
+				if !resume && !bytes.HasPrefix(line, []byte("{")) {
+					return errStorageKeyMissing
+				}
+				if line, err = s.encryptLine(line, ad); err != nil {
+					return err
+				}
+				buf.Write(line)
+				buf.WriteByte('\n')
+			}
+			bts = buf.Bytes()
+		} else {
+			if bytes.HasPrefix(bts, []byte(encryptedFileMagic)) {
+				if !resume {
+					return errStorageKeyMissing
+				}
+				return nil
+			}
+			if bts, err = s.encrypt(bts, file); err != nil {
+				return err
+			}
+		}
+		return fs.SaveFile(path, bts)
+	})
+}
+
+// encrypt encrypts the contents of the specified file, if encryption is enabled.
+func (s *storage) encrypt(plaintext []byte, file string) ([]byte, error) {
+	if s.aead == nil {
+		return plaintext, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ciphertext := append([]byte(encryptedFileMagic), nonce...)
+	return s.aead.Seal(ciphertext, nonce, plaintext, []byte(file)), nil
+}
+
+// decrypt decrypts the contents of the specified file. If encryption is enabled, the contents must be
+// encrypted; only encryptExisting() accepts files that are not, which it reads directly.
+func (s *storage) decrypt(bts []byte, file string) ([]byte, error) {
+	encrypted := bytes.HasPrefix(bts, []byte(encryptedFileMagic))
+	if s.aead == nil {
+		if encrypted {
+			return nil, ErrStorageEncrypted
+		}
+		return bts, nil
+	}
+	if !encrypted {
+		return nil, errors.Errorf("File %s is not encrypted", file)
+	}
+	bts = bts[len(encryptedFileMagic):]
+	if len(bts) < s.aead.NonceSize() {
+		return nil, errors.Errorf("Encrypted file %s is truncated", file)
+	}
+	return s.aead.Open(nil, bts[:s.aead.NonceSize()], bts[s.aead.NonceSize():], []byte(file))
+}
+
+// encryptLine encrypts a line of the specified file, if encryption is enabled and it is not already
+// encrypted, encoding it such that it does not contain newlines.
+func (s *storage) encryptLine(line []byte, file string) ([]byte, error) {
+	if s.aead == nil || !bytes.HasPrefix(line, []byte("{")) {
+		return line, nil
+	}
+	bts, err := s.encrypt(line, file)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(bts)), nil
+}
+
+// decryptLine decrypts a line of the specified file, which must be encrypted if encryption is enabled.
+func (s *storage) decryptLine(line []byte, file string) ([]byte, error) {
+	if bytes.HasPrefix(line, []byte("{")) {
+		if s.aead != nil {
+			return nil, errors.Errorf("Line of %s is not encrypted", file)
+		}
+		return line, nil
+	}
+	bts, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(bts, file)
+}
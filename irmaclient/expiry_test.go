@@ -0,0 +1,167 @@
+package irmaclient
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// This file contains a harness for testing the expiry of credentials without waiting for epochs
+// to pass: fabricateCredential() adds credentials with arbitrary signing and expiry dates, signed
+// using the private keys of the test configuration, and setTestClock() replaces the clock of the
+// client with one that can be advanced.
+
+// testClock is a clock for the client that only moves when advanced.
+type testClock struct {
+	now time.Time
+}
+
+func setTestClock(client *Client) *testClock {
+	clock := &testClock{now: time.Now()}
+	client.clock = func() time.Time { return clock.now }
+	return clock
+}
+
+// advance moves the clock forward by the specified amount of epochs.
+func (clock *testClock) advance(epochs int) {
+	clock.now = clock.now.Add(time.Duration(epochs*irma.ExpiryFactor) * time.Second)
+}
+
+// epochs returns the time the specified amount of epochs from now (in the past if negative).
+func (clock *testClock) epochs(epochs int) time.Time {
+	return clock.now.Add(time.Duration(epochs*irma.ExpiryFactor) * time.Second)
+}
+
+// fabricateCredential signs a credential of the specified type using key 2 of its issuer, with the
+// specified signing date and expiry, and adds it to the client.
+func fabricateCredential(
+	t *testing.T, client *Client, id irma.CredentialTypeIdentifier, attributes map[string]string, signed, expiry time.Time,
+) *irma.AttributeList {
+	request := &irma.CredentialRequest{KeyCounter: 2, CredentialTypeID: id, Attributes: attributes}
+	attrs, err := request.AttributeList(client.Configuration, 0x03)
+	require.NoError(t, err)
+
+	// Overwrite the signing date and validity duration (both in epochs) in the metadata attribute,
+	// which are at bytes 1-3 and 4-5 respectively, the signing date being one byte too long.
+	meta := attrs.MetadataAttribute.Bytes()
+	signingEpoch := signed.Unix() / irma.ExpiryFactor
+	binary.BigEndian.PutUint16(meta[2:4], uint16(signingEpoch))
+	binary.BigEndian.PutUint16(meta[4:6], uint16(expiry.Unix()/irma.ExpiryFactor-signingEpoch))
+	attrs.Ints[0].SetBytes(meta)
+
+	issuer := id.IssuerIdentifier()
+	pk, err := client.Configuration.PublicKey(issuer, 2)
+	require.NoError(t, err)
+	sk, err := gabi.NewPrivateKeyFromFile(filepath.Join("..", "testdata", "irma_configuration",
+		issuer.SchemeManagerIdentifier().Name(), issuer.Name(), "PrivateKeys", "2.xml"))
+	require.NoError(t, err)
+	ints := append([]*big.Int{client.secretkey.Key}, attrs.Ints...)
+	sig, err := gabi.SignMessageBlock(sk, pk, ints)
+	require.NoError(t, err)
+
+	cred, err := newCredential(&gabi.Credential{Signature: sig, Pk: pk, Attributes: ints}, client.Configuration)
+	require.NoError(t, err)
+	require.NoError(t, client.addCredential(cred, true))
+	return cred.AttributeList()
+}
+
+var expiryStudentCard = map[string]string{
+	"university":        "Radboud",
+	"studentCardNumber": "31415927",
+	"studentID":         "s1234567",
+	"level":             "42",
+}
+
+func TestFabricatedCredential(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	clock := setTestClock(client)
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	signed, expiry := clock.epochs(-10), clock.epochs(5)
+	attrs := fabricateCredential(t, client, id, expiryStudentCard, signed, expiry)
+	require.Equal(t, irma.FloorToEpochBoundary(signed), attrs.SigningDate())
+	require.Equal(t, irma.FloorToEpochBoundary(expiry), attrs.Expiry())
+
+	// The fabricated credential has a valid signature, and survives reloading the storage
+	cred, err := client.credential(id, 0)
+	require.NoError(t, err)
+	require.True(t, cred.Signature.Verify(cred.Pk, cred.Credential.Attributes))
+	require.NoError(t, client.Close())
+	client, err = New(client.storage.storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Equal(t, attrs.Hash(), client.attrs(id)[0].Hash())
+	require.NoError(t, client.Close())
+}
+
+func TestExpiredCandidates(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	clock := setTestClock(client)
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	fabricateCredential(t, client, id, expiryStudentCard, clock.epochs(-10), clock.epochs(2))
+	disjunction := &irma.AttributeDisjunction{
+		Label:      "studentID",
+		Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+	}
+	require.Len(t, client.Candidates(disjunction), 1)
+
+	clock.advance(1)
+	require.Len(t, client.Candidates(disjunction), 1)
+	clock.advance(2)
+	require.Empty(t, client.Candidates(disjunction))
+	_, missing := client.CheckSatisfiability(irma.AttributeDisjunctionList{disjunction})
+	require.Len(t, missing, 1)
+}
+
+func TestExpiredCredentialsCleanup(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	clock := setTestClock(client)
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attrs := fabricateCredential(t, client, id, expiryStudentCard, clock.epochs(-10), clock.epochs(1))
+	require.NoError(t, client.SetExpiredCredentialsPolicy(
+		ExpiredCredentialsPolicy{Action: ExpiredCredentialsArchive, Days: 14},
+	))
+	require.Len(t, client.attrs(id), 1)
+
+	// Expired, but not yet for the amount of days of the policy
+	clock.advance(2)
+	removed, err := client.CleanupExpiredCredentials()
+	require.NoError(t, err)
+	require.Zero(t, removed)
+
+	clock.advance(2)
+	removed, err = client.CleanupExpiredCredentials()
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Empty(t, client.attrs(id))
+	require.Equal(t, attrs.Hash(), client.archived[id][0].Hash())
+}
+
+func TestRefreshExpiredCredential(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	clock := setTestClock(client)
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	fabricateCredential(t, client, id, expiryStudentCard, clock.epochs(-10), clock.epochs(1))
+	clock.advance(2)
+	require.True(t, client.attrs(id)[0].IsValidOn(clock.epochs(-2)))
+	require.False(t, client.attrs(id)[0].IsValidOn(client.now()))
+
+	// Reissuance replaces the expired instance of the singleton credential type by a valid one
+	refreshed := fabricateCredential(t, client, id, expiryStudentCard, clock.now, clock.epochs(10))
+	require.Len(t, client.attrs(id), 1)
+	require.Equal(t, refreshed.Hash(), client.attrs(id)[0].Hash())
+	require.True(t, client.attrs(id)[0].IsValidOn(client.now()))
+}
@@ -0,0 +1,112 @@
+package irmaclient
+
+import (
+	"encoding/json"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the export of a selection of credentials, and their import into another client
+// holding the same secret key, e.g. to partially migrate a wallet. Unlike backups (see backup.go), an
+// export does not contain the secret key, so it is of no use to anyone not holding it; it does contain
+// the attributes of the exported credentials in plaintext.
+
+const credentialExportVersion = 1
+
+// credentialExport is the contents of an export of credentials.
+type credentialExport struct {
+	Version     int                   `json:"version"`
+	Credentials []*exportedCredential `json:"credentials"`
+}
+
+// exportedCredential is a credential without the secret key.
+type exportedCredential struct {
+	Signature  *gabi.CLSignature `json:"signature"`
+	Attributes []*big.Int        `json:"attributes"`
+}
+
+// ExportCredentials exports the credentials with the specified hashes (including archived ones), and
+// all credentials of the specified types, for importing into a client with the same secret key
+// using ImportCredentials().
+func (client *Client) ExportCredentials(hashes []string, types []irma.CredentialTypeIdentifier) ([]byte, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+
+	var selected []*irma.AttributeList
+	for _, hash := range hashes {
+		id, index, found := findAttributeList(client.attributes, hash)
+		lists := client.attributes
+		if !found {
+			id, index, found = findAttributeList(client.archived, hash)
+			lists = client.archived
+		}
+		if !found {
+			return nil, errors.Errorf("Can't export credential %s: no such credential", hash)
+		}
+		selected = append(selected, lists[id][index])
+	}
+	for _, id := range types {
+		selected = append(selected, client.attrs(id)...)
+	}
+
+	export := &credentialExport{Version: credentialExportVersion, Credentials: []*exportedCredential{}}
+	exported := map[string]bool{}
+	for _, attrs := range selected {
+		if exported[attrs.Hash()] {
+			continue
+		}
+		exported[attrs.Hash()] = true
+		sig, err := client.storage.LoadSignature(attrs)
+		if err != nil {
+			return nil, err
+		}
+		export.Credentials = append(export.Credentials, &exportedCredential{Signature: sig, Attributes: attrs.Ints})
+	}
+	return json.Marshal(export)
+}
+
+// ImportCredentials imports the credentials exported by ExportCredentials(). Credentials that are
+// already present are skipped. Failure to import a particular credential, e.g. because it was
+// exported by a client with another secret key, is not an error; instead it is reported in the
+// returned ImportReport.
+func (client *Client) ImportCredentials(bts []byte) (*ImportReport, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	export := &credentialExport{}
+	if err := json.Unmarshal(bts, export); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse credential export", 0)
+	}
+	if export.Version != credentialExportVersion {
+		return nil, errors.Errorf("Unsupported credential export version %d", export.Version)
+	}
+
+	key, err := client.unwrappedSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	report := &ImportReport{
+		Credentials:     make([]*ImportedCredential, 0, len(export.Credentials)),
+		KeyshareServers: []irma.SchemeManagerIdentifier{},
+	}
+	for _, exported := range export.Credentials {
+		if exported == nil {
+			continue
+		}
+		// The signature only verifies if the credential was issued to our secret key
+		attributes := append([]*big.Int{key}, exported.Attributes...)
+		report.Credentials = append(report.Credentials, client.importCredential(key, exported.Signature, attributes))
+	}
+
+	if report.Imported() > 0 {
+		if err := client.storage.StoreAttributes(client.attributes); err != nil {
+			return report, err
+		}
+		client.handler.UpdateAttributes()
+	}
+	return report, nil
+}
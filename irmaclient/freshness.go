@@ -0,0 +1,129 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the freshness checks of the schemes. An attacker that blocks the client from
+// updating its schemes can keep it on an old version of a scheme, in which e.g. a compromised public
+// key of an issuer has not yet been revoked. The same attacker can serve any old timestamp, or an
+// old but validly signed version of the scheme, so the client cannot learn from contacting the
+// remote scheme that its version is still current. Instead, a scheme counts as refreshed at the
+// Timestamp of the version that the client has, which is covered by the signature on its index; so
+// that schemes do not become stale while they are up to date, scheme managers should publish new
+// versions more often than the maximum staleness of clients. If the Timestamp of a scheme is older
+// than the maximum staleness in the preferences, a SchemeFreshnessHandler is warned when the client
+// is created and after UpdateSchemes(), and if enabled, issuance and signature sessions involving
+// the scheme are refused, as the credentials or signatures resulting from these sessions are relied
+// upon long after the session.
+
+// SchemeFreshnessPolicy specifies the maximum staleness of the schemes.
+type SchemeFreshnessPolicy struct {
+	// Amount of days after the last refresh after which a scheme is stale, 0 if disabled
+	MaxStaleness int
+	// Refuse issuance and signature sessions involving stale schemes
+	RefuseSessions bool
+}
+
+// SchemeFreshnessHandler is informed of schemes that have not been refreshed for longer than the
+// maximum staleness, see SchemeFreshnessPolicy. The ClientHandler may optionally implement it.
+type SchemeFreshnessHandler interface {
+	SchemeStale(scheme irma.SchemeManagerIdentifier, refreshed time.Time)
+}
+
+// SetSchemeFreshnessPolicy sets the maximum staleness of the schemes, warning the handler of any
+// schemes that are stale according to it.
+func (client *Client) SetSchemeFreshnessPolicy(policy SchemeFreshnessPolicy) error {
+	if policy.MaxStaleness < 0 {
+		return errors.New("Maximum staleness cannot be negative")
+	}
+	client.Preferences.SchemeFreshness = policy
+	if err := client.storage.StorePreferences(client.Preferences); err != nil {
+		return err
+	}
+	client.warnStaleSchemes()
+	return nil
+}
+
+// SchemeRefreshed returns the time at which the scheme was last refreshed, i.e. the Timestamp of
+// our version of the scheme.
+func (client *Client) SchemeRefreshed(id irma.SchemeManagerIdentifier) time.Time {
+	if manager := client.Configuration.SchemeManagers[id]; manager != nil {
+		return time.Time(manager.Timestamp)
+	}
+	return time.Time{}
+}
+
+// StaleSchemes returns the schemes that have not been refreshed for longer than the maximum
+// staleness in the preferences.
+func (client *Client) StaleSchemes() []irma.SchemeManagerIdentifier {
+	stale := []irma.SchemeManagerIdentifier{}
+	for id := range client.Configuration.SchemeManagers {
+		if client.schemeStale(id) {
+			stale = append(stale, id)
+		}
+	}
+	return stale
+}
+
+// UpdateSchemes updates all schemes, refreshing those of which a newer version is available.
+// The UpdateConfiguration() method of the handler is called if anything was updated.
+// All schemes are tried; the first error encountered is returned.
+func (client *Client) UpdateSchemes() error {
+	updated := &irma.IrmaIdentifierSet{
+		SchemeManagers:  map[irma.SchemeManagerIdentifier]struct{}{},
+		Issuers:         map[irma.IssuerIdentifier]struct{}{},
+		CredentialTypes: map[irma.CredentialTypeIdentifier]struct{}{},
+	}
+	var err error
+	for id := range client.Configuration.SchemeManagers {
+		if e := client.Configuration.UpdateSchemeManager(id, updated); e != nil {
+			irma.Logger.WithField("scheme", id).Warn("Failed to update scheme: ", e.Error())
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	if !updated.Empty() {
+		if e := client.Configuration.ParseFolder(); e != nil {
+			return e
+		}
+		client.handler.UpdateConfiguration(updated)
+	}
+	client.warnStaleSchemes()
+	return err
+}
+
+func (client *Client) schemeStale(id irma.SchemeManagerIdentifier) bool {
+	days := client.Preferences.SchemeFreshness.MaxStaleness
+	return days > 0 && client.SchemeRefreshed(id).AddDate(0, 0, days).Before(client.now())
+}
+
+// warnStaleSchemes informs the handler of the stale schemes, if it implements SchemeFreshnessHandler.
+func (client *Client) warnStaleSchemes() {
+	handler, ok := client.handler.(SchemeFreshnessHandler)
+	if !ok {
+		return
+	}
+	for _, id := range client.StaleSchemes() {
+		handler.SchemeStale(id, client.SchemeRefreshed(id))
+	}
+}
+
+// refuseStaleSchemes returns the first stale scheme involved in the session if the session must
+// be refused because of it.
+func (client *Client) refuseStaleSchemes(action irma.Action, request irma.SessionRequest) (irma.SchemeManagerIdentifier, bool) {
+	if !client.Preferences.SchemeFreshness.RefuseSessions ||
+		action != irma.ActionIssuing && action != irma.ActionSigning {
+		return irma.SchemeManagerIdentifier{}, false
+	}
+	for id := range request.Identifiers().SchemeManagers {
+		if client.schemeStale(id) {
+			return id, true
+		}
+	}
+	return irma.SchemeManagerIdentifier{}, false
+}
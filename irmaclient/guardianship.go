@@ -0,0 +1,628 @@
+package irmaclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains guardianships, with which the client of a guardian (e.g. a parent) may disclose
+// specific attributes of the credentials of a dependent (e.g. a child) until a specified date.
+// Since disclosing requires the secret key of the dependent, which never leaves its client, the
+// client of the guardian does not hold the credentials of the dependent: instead it forwards the
+// session QR over a GuardianChannel implemented by the app to the client of the dependent. That
+// client retrieves the session request from the server itself, and computes the disclosure proofs
+// without asking the user for permission if they only contain attributes covered by the
+// guardianship; the client of the guardian checks and sends them to the server.
+//
+// A guardianship requires the consent of both parties, which is recorded in both clients:
+//  - the dependent proposes it using ProposeGuardianship(),
+//  - the guardian accepts the proposal using AcceptGuardianship(), generating a key pair,
+//  - and the dependent confirms the acceptance using ConfirmGuardianship(), storing the public key
+//    of the guardian.
+// The app transports the proposal and the acceptance between the clients, e.g. using QR codes.
+// The guardian signs its requests to the dependent with its private key, so that knowing the ID of
+// a guardianship does not suffice to obtain disclosures of the dependent. The signature includes
+// the time of the request, which the dependent accepts only for guardianRequestMaxAge; the server
+// accepts each session only once.
+// Either party can revoke the guardianship at any time using RevokeGuardianship(). The disclosures
+// made under a guardianship are logged on both clients, with the ID of the guardianship in the
+// Guardianship field of the log entry. Credentials of schemes using a keyshare server cannot be
+// disclosed under a guardianship, as their disclosure requires the PIN of the dependent.
+
+const (
+	// Version 1 guardianships did not exchange the public key of the guardian
+	guardianshipVersion = 2
+
+	// Domain separator of the signatures of the guardian on its requests
+	guardianRequestDomain = "irma guardian request"
+	guardianRequestMaxAge = 5 * time.Minute
+)
+
+// GuardianshipRole is the role of the client in a guardianship.
+type GuardianshipRole string
+
+const (
+	// GuardianshipGuardian is the role of the client that discloses attributes of the dependent.
+	GuardianshipGuardian = GuardianshipRole("guardian")
+	// GuardianshipDependent is the role of the client holding the credentials.
+	GuardianshipDependent = GuardianshipRole("dependent")
+)
+
+// Guardianship allows the client of a guardian to disclose the specified attributes of the client
+// of a dependent until a date.
+type Guardianship struct {
+	ID   string           `json:"id"`
+	Role GuardianshipRole `json:"role"`
+	// Name of the other party, as entered by the user
+	Name       string                         `json:"name"`
+	Attributes []irma.AttributeTypeIdentifier `json:"attributes"`
+	Until      irma.Timestamp                 `json:"until"`
+
+	// Times at which the parties consented, nil if the party did not (yet) consent
+	DependentConsent *irma.Timestamp `json:"dependentConsent,omitempty"`
+	GuardianConsent  *irma.Timestamp `json:"guardianConsent,omitempty"`
+
+	Uses     int             `json:"uses"`
+	LastUsed *irma.Timestamp `json:"lastUsed,omitempty"`
+
+	// Public key (PKIX) with which the dependent verifies the requests of the guardian. The client of
+	// the guardian also stores the corresponding private key (SEC 1), which Guardianships() omits.
+	GuardianPublicKey []byte `json:"guardianPublicKey,omitempty"`
+	PrivateKey        []byte `json:"privateKey,omitempty"`
+}
+
+// GuardianChannel connects the client of the guardian to the client of the dependent; it is
+// implemented by the app.
+type GuardianChannel interface {
+	// Disclose sends the request to the client of the dependent, which should pass it to
+	// DiscloseForGuardian(), and returns the response of that function.
+	Disclose(request []byte) ([]byte, error)
+}
+
+// ErrGuardianshipKeyMissing is returned when a guardianship concluded before the guardian signed its
+// requests is used; such guardianships must be revoked and concluded again.
+var ErrGuardianshipKeyMissing = errors.New("Guardianship has no guardian key")
+
+// guardianshipMessage is the proposal or acceptance of a guardianship exchanged by the clients.
+type guardianshipMessage struct {
+	Version          int                            `json:"version"`
+	ID               string                         `json:"id"`
+	Attributes       []irma.AttributeTypeIdentifier `json:"attributes,omitempty"`
+	Until            irma.Timestamp                 `json:"until"`
+	DependentConsent *irma.Timestamp                `json:"dependentConsent,omitempty"`
+	GuardianConsent  *irma.Timestamp                `json:"guardianConsent,omitempty"`
+	GuardianKey      []byte                         `json:"guardianKey,omitempty"`
+}
+
+// guardianRequest asks the client of the dependent to disclose in the session of the QR.
+type guardianRequest struct {
+	Guardianship string         `json:"guardianship"`
+	Qr           *irma.Qr       `json:"qr"`
+	Time         irma.Timestamp `json:"time"`
+}
+
+// signedGuardianRequest is a guardianRequest (as JSON) along with the signature of the guardian.
+type signedGuardianRequest struct {
+	Request   []byte `json:"request"`
+	Signature []byte `json:"signature"`
+}
+
+// guardianResponse contains the session request as retrieved by the client of the dependent, and
+// the disclosure it computed.
+type guardianResponse struct {
+	Request    *irma.DisclosureRequest `json:"request"`
+	Disclosure *irma.Disclosure        `json:"disclosure"`
+}
+
+// Active returns whether both parties consented to the guardianship and it has not expired.
+func (g *Guardianship) Active() bool {
+	return g.DependentConsent != nil && g.GuardianConsent != nil && time.Time(g.Until).After(time.Now())
+}
+
+// choice returns the attributes to disclose from the candidates if all disjunctions can be
+// satisfied with attributes of the guardianship, and nil otherwise.
+func (g *Guardianship) choice(candidates [][]*irma.AttributeIdentifier) *irma.DisclosureChoice {
+	return allowedChoice(g.Attributes, candidates)
+}
+
+// exported returns a copy of the guardianship without the private key of the guardian.
+func (g *Guardianship) exported() *Guardianship {
+	copied := *g
+	copied.PrivateKey = nil
+	return &copied
+}
+
+// Guardianships returns the guardianships of the client, including those awaiting consent.
+func (client *Client) Guardianships() []*Guardianship {
+	client.guardianshipsLock.Lock()
+	defer client.guardianshipsLock.Unlock()
+	list := make([]*Guardianship, 0, len(client.guardianships))
+	for _, g := range client.guardianships {
+		list = append(list, g.exported())
+	}
+	return list
+}
+
+// ProposeGuardianship proposes a guardianship allowing the guardian with the specified name to
+// disclose the attributes of this client until the specified date. The returned proposal must be
+// passed to AcceptGuardianship() of the client of the guardian.
+func (client *Client) ProposeGuardianship(
+	guardian string, attributes []irma.AttributeTypeIdentifier, until irma.Timestamp,
+) (*Guardianship, []byte, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, nil, err
+	}
+	if len(attributes) == 0 {
+		return nil, nil, errors.New("Guardianship contains no attributes")
+	}
+	for _, attr := range attributes {
+		if client.Configuration.AttributeTypes[attr] == nil &&
+			!(attr.IsCredential() && client.Configuration.Contains(attr.CredentialTypeIdentifier())) {
+			return nil, nil, errors.Errorf("Guardianship contains unknown attribute %s", attr)
+		}
+		if client.Configuration.SchemeManagers[attr.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier()].Distributed() {
+			return nil, nil, errors.Errorf("Attribute %s requires a keyshare server", attr)
+		}
+	}
+	if !time.Time(until).After(time.Now()) {
+		return nil, nil, errors.New("Guardianship must end in the future")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+	now := irma.Timestamp(time.Now())
+	g := &Guardianship{
+		ID:               hex.EncodeToString(id),
+		Role:             GuardianshipDependent,
+		Name:             guardian,
+		Attributes:       attributes,
+		Until:            until,
+		DependentConsent: &now,
+	}
+	proposal, err := json.Marshal(&guardianshipMessage{
+		Version:          guardianshipVersion,
+		ID:               g.ID,
+		Attributes:       g.Attributes,
+		Until:            g.Until,
+		DependentConsent: g.DependentConsent,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client.guardianshipsLock.Lock()
+	defer client.guardianshipsLock.Unlock()
+	client.guardianships = append(client.currentGuardianships(), g)
+	return g.exported(), proposal, client.storage.StoreGuardianships(client.guardianships)
+}
+
+// AcceptGuardianship accepts the proposal of the dependent with the specified name, as returned
+// by ProposeGuardianship() of the client of the dependent, generating the key pair with which the
+// requests of this client under the guardianship are signed. The returned acceptance, containing
+// the public key, must be passed to ConfirmGuardianship() of that client.
+func (client *Client) AcceptGuardianship(proposal []byte, dependent string) (*Guardianship, []byte, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, nil, err
+	}
+	msg := &guardianshipMessage{}
+	if err := json.Unmarshal(proposal, msg); err != nil {
+		return nil, nil, errors.WrapPrefix(err, "Failed to parse guardianship proposal", 0)
+	}
+	if msg.Version != guardianshipVersion {
+		return nil, nil, errors.Errorf("Unsupported guardianship version %d", msg.Version)
+	}
+	if msg.ID == "" || msg.DependentConsent == nil || len(msg.Attributes) == 0 {
+		return nil, nil, errors.New("Invalid guardianship proposal")
+	}
+	if !time.Time(msg.Until).After(time.Now()) {
+		return nil, nil, errors.New("Guardianship has expired")
+	}
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	skBts, err := x509.MarshalECPrivateKey(sk)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkBts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := irma.Timestamp(time.Now())
+	g := &Guardianship{
+		ID:                msg.ID,
+		Role:              GuardianshipGuardian,
+		Name:              dependent,
+		Attributes:        msg.Attributes,
+		Until:             msg.Until,
+		DependentConsent:  msg.DependentConsent,
+		GuardianConsent:   &now,
+		GuardianPublicKey: pkBts,
+		PrivateKey:        skBts,
+	}
+	acceptance, err := json.Marshal(&guardianshipMessage{
+		Version:         guardianshipVersion,
+		ID:              g.ID,
+		Until:           g.Until,
+		GuardianConsent: g.GuardianConsent,
+		GuardianKey:     g.GuardianPublicKey,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client.guardianshipsLock.Lock()
+	defer client.guardianshipsLock.Unlock()
+	if client.guardianshipByID(g.ID) != nil {
+		return nil, nil, errors.Errorf("Guardianship %s already exists", g.ID)
+	}
+	client.guardianships = append(client.currentGuardianships(), g)
+	return g.exported(), acceptance, client.storage.StoreGuardianships(client.guardianships)
+}
+
+// ConfirmGuardianship records the consent of the guardian, as returned by AcceptGuardianship() of
+// the client of the guardian, activating the guardianship proposed by this client.
+func (client *Client) ConfirmGuardianship(acceptance []byte) (*Guardianship, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	msg := &guardianshipMessage{}
+	if err := json.Unmarshal(acceptance, msg); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse guardianship acceptance", 0)
+	}
+	if msg.Version != guardianshipVersion {
+		return nil, errors.Errorf("Unsupported guardianship version %d", msg.Version)
+	}
+	if msg.GuardianConsent == nil {
+		return nil, errors.New("Invalid guardianship acceptance")
+	}
+	if _, err := parseGuardianPublicKey(msg.GuardianKey); err != nil {
+		return nil, errors.WrapPrefix(err, "Invalid guardianship acceptance", 0)
+	}
+
+	client.guardianshipsLock.Lock()
+	defer client.guardianshipsLock.Unlock()
+	g := client.guardianshipByID(msg.ID)
+	if g == nil || g.Role != GuardianshipDependent {
+		return nil, errors.Errorf("Unknown guardianship %s", msg.ID)
+	}
+	if g.GuardianConsent != nil {
+		return nil, errors.Errorf("Guardianship %s was already confirmed", msg.ID)
+	}
+	if time.Time(msg.Until).Unix() != time.Time(g.Until).Unix() {
+		return nil, errors.New("Guardianship acceptance does not match proposal")
+	}
+	g.GuardianConsent = msg.GuardianConsent
+	g.GuardianPublicKey = msg.GuardianKey
+	return g.exported(), client.storage.StoreGuardianships(client.guardianships)
+}
+
+// RevokeGuardianship removes the specified guardianship. The other party is not informed, but
+// the client of the dependent refuses further disclosures under the guardianship.
+func (client *Client) RevokeGuardianship(id string) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
+	client.guardianshipsLock.Lock()
+	defer client.guardianshipsLock.Unlock()
+	for i, g := range client.guardianships {
+		if g.ID == id {
+			client.guardianships = append(client.guardianships[:i], client.guardianships[i+1:]...)
+			return client.storage.StoreGuardianships(client.guardianships)
+		}
+	}
+	return errors.Errorf("Unknown guardianship %s", id)
+}
+
+// GuardianDisclose performs the disclosure session of the QR on behalf of the dependent of the
+// specified guardianship, obtaining the disclosure from the client of the dependent over the channel.
+// As this is done on the explicit request of the user, the user is not asked for permission.
+func (client *Client) GuardianDisclose(id string, qr *irma.Qr, channel GuardianChannel) (*LogEntry, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	g := client.activeGuardianship(id, GuardianshipGuardian)
+	if g == nil {
+		return nil, errors.Errorf("No active guardianship %s", id)
+	}
+	if len(g.PrivateKey) == 0 {
+		return nil, ErrGuardianshipKeyMissing
+	}
+	u, err := guardianSessionURL(client.Configuration, qr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Let the client of the dependent retrieve the request and compute the disclosure
+	bts, err := json.Marshal(&guardianRequest{Guardianship: g.ID, Qr: qr, Time: irma.Timestamp(time.Now())})
+	if err != nil {
+		return nil, err
+	}
+	signed := &signedGuardianRequest{Request: bts}
+	if signed.Signature, err = signGuardianRequest(g.PrivateKey, bts); err != nil {
+		return nil, err
+	}
+	if bts, err = json.Marshal(signed); err != nil {
+		return nil, err
+	}
+	if bts, err = channel.Disclose(bts); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to obtain disclosure of dependent", 0)
+	}
+
+	// Check the disclosure before sending it
+	res := &guardianResponse{}
+	if err = json.Unmarshal(bts, res); err != nil || res.Request == nil || res.Disclosure == nil {
+		return nil, errors.New("Failed to parse disclosure of dependent")
+	}
+	request, disclosure := res.Request, res.Disclosure
+	for _, disjunction := range request.ToDisclose() {
+		if allowedChoice(g.Attributes, [][]*irma.AttributeIdentifier{attributeCandidates(disjunction)}) == nil {
+			return nil, errors.Errorf("Guardianship does not cover %s", disjunction.Label)
+		}
+	}
+	if _, status, err := disclosure.Verify(client.Configuration, request); err != nil || status != irma.ProofStatusValid {
+		return nil, errors.Errorf("Invalid disclosure of dependent: %s", status)
+	}
+
+	transport, pool := client.sessionTransport(qr.URL, u.Hostname())
+	if pool != nil {
+		defer pool.Close()
+	}
+	var response disclosureResponse
+	if err = transport.Post("proofs", &response, disclosure); err != nil {
+		return nil, err
+	}
+	if response != "VALID" {
+		return nil, &irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response)}
+	}
+
+	requestor := sessionRequestor(u.Hostname(), request, client.Configuration)
+	entry := &LogEntry{
+		Type:         irma.ActionDisclosing,
+		Time:         irma.Timestamp(time.Now()),
+		Version:      request.GetVersion(),
+		Hostname:     u.Hostname(),
+		ServerName:   requestor.Name,
+		request:      request,
+		Disclosure:   disclosure,
+		Guardianship: g.ID,
+	}
+	if err = entry.setSessionRequest(); err != nil {
+		return nil, err
+	}
+	if err = client.useGuardianship(g.ID); err != nil {
+		return nil, err
+	}
+	return entry, client.addLogEntry(entry)
+}
+
+// DiscloseForGuardian computes the disclosure requested by the client of the guardian through
+// GuardianDisclose(), if the request is signed by the guardian of an active guardianship and the
+// session request, which this client retrieves from the server, is covered by the guardianship.
+func (client *Client) DiscloseForGuardian(bts []byte) ([]byte, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	signed := &signedGuardianRequest{}
+	req := &guardianRequest{}
+	if err := json.Unmarshal(bts, signed); err != nil {
+		return nil, errors.New("Failed to parse guardian request")
+	}
+	if err := json.Unmarshal(signed.Request, req); err != nil || req.Qr == nil {
+		return nil, errors.New("Failed to parse guardian request")
+	}
+	g := client.activeGuardianship(req.Guardianship, GuardianshipDependent)
+	if g == nil {
+		return nil, errors.Errorf("No active guardianship %s", req.Guardianship)
+	}
+	if len(g.GuardianPublicKey) == 0 {
+		return nil, ErrGuardianshipKeyMissing
+	}
+	if err := verifyGuardianRequest(g.GuardianPublicKey, signed.Request, signed.Signature); err != nil {
+		return nil, err
+	}
+	if age := time.Since(time.Time(req.Time)); age > guardianRequestMaxAge || age < -guardianRequestMaxAge {
+		return nil, errors.New("Guardian request has expired")
+	}
+	u, err := guardianSessionURL(client.Configuration, req.Qr)
+	if err != nil {
+		return nil, err
+	}
+	request, err := client.guardianSessionRequest(req.Qr, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, missing := client.CheckSatisfiability(request.ToDisclose())
+	if len(missing) > 0 {
+		return nil, errors.New("Requested attributes are not present")
+	}
+	choice := g.choice(candidates)
+	if choice == nil {
+		return nil, errors.New("Guardianship does not cover the requested attributes")
+	}
+	request.SetCandidates(candidates)
+	request.SetDisclosureChoice(choice)
+
+	client.startSession()
+	disclosure, err := client.Proofs(choice, request, false)
+	client.finishSession()
+	if err != nil {
+		return nil, err
+	}
+	if bts, err = json.Marshal(&guardianResponse{Request: request, Disclosure: disclosure}); err != nil {
+		return nil, err
+	}
+
+	entry := &LogEntry{
+		Type:         irma.ActionDisclosing,
+		Time:         irma.Timestamp(time.Now()),
+		Version:      request.GetVersion(),
+		Hostname:     u.Hostname(),
+		ServerName:   sessionRequestor(u.Hostname(), request, client.Configuration).Name,
+		request:      request,
+		Disclosure:   disclosure,
+		Guardianship: g.ID,
+	}
+	if err = entry.setSessionRequest(); err != nil {
+		return nil, err
+	}
+	if err = client.useGuardianship(g.ID); err != nil {
+		return nil, err
+	}
+	if err = client.addLogEntry(entry); err != nil {
+		return nil, err
+	}
+	if usageErr := client.recordUsage(choice); usageErr != nil {
+		irma.Logger.Warn("Failed to record credential usage: ", usageErr.Error())
+	}
+	return bts, nil
+}
+
+// guardianSessionRequest retrieves the disclosure request of the session of the QR from the server.
+func (client *Client) guardianSessionRequest(qr *irma.Qr, hostname string) (*irma.DisclosureRequest, error) {
+	transport, pool := client.sessionTransport(qr.URL, hostname)
+	if pool != nil {
+		defer pool.Close()
+	}
+	transport.SetHeader(irma.MinVersionHeader, minVersion.String())
+	transport.SetHeader(irma.MaxVersionHeader, maxVersion.String())
+	request := &irma.DisclosureRequest{}
+	var err error
+	if qr.RequestKey == "" {
+		err = transport.Get("", request)
+	} else {
+		key, keyErr := irma.ParseRequestKey(qr.RequestKey)
+		if keyErr != nil {
+			return nil, &irma.SessionError{ErrorType: irma.ErrorInvalidJWT, Err: keyErr}
+		}
+		transport.SetHeader(irma.SignedRequestHeader, "true")
+		err = getSignedRequest(transport, qr.URL, key, request)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if request.GetVersion() == nil {
+		request.SetVersion(irma.NewVersion(2, 0))
+	}
+	return request, nil
+}
+
+// activeGuardianship returns a copy of the specified guardianship if it is active and the client
+// has the specified role in it, and nil otherwise.
+func (client *Client) activeGuardianship(id string, role GuardianshipRole) *Guardianship {
+	client.guardianshipsLock.Lock()
+	defer client.guardianshipsLock.Unlock()
+	g := client.guardianshipByID(id)
+	if g == nil || g.Role != role || !g.Active() {
+		return nil
+	}
+	copied := *g
+	return &copied
+}
+
+// useGuardianship registers a disclosure under the specified guardianship.
+func (client *Client) useGuardianship(id string) error {
+	client.guardianshipsLock.Lock()
+	defer client.guardianshipsLock.Unlock()
+	g := client.guardianshipByID(id)
+	if g == nil {
+		return errors.Errorf("Unknown guardianship %s", id)
+	}
+	now := irma.Timestamp(time.Now())
+	g.Uses++
+	g.LastUsed = &now
+	return client.storage.StoreGuardianships(client.guardianships)
+}
+
+func (client *Client) guardianshipByID(id string) *Guardianship {
+	for _, g := range client.guardianships {
+		if g.ID == id {
+			return g
+		}
+	}
+	return nil
+}
+
+// currentGuardianships returns the guardianships that have not expired.
+func (client *Client) currentGuardianships() []*Guardianship {
+	list := []*Guardianship{}
+	for _, g := range client.guardianships {
+		if time.Time(g.Until).After(time.Now()) {
+			list = append(list, g)
+		}
+	}
+	return list
+}
+
+// attributeCandidates returns the attributes of the disjunction as candidates, without credentials.
+func attributeCandidates(disjunction *irma.AttributeDisjunction) []*irma.AttributeIdentifier {
+	candidates := make([]*irma.AttributeIdentifier, 0, len(disjunction.Attributes))
+	for _, attr := range disjunction.Attributes {
+		candidates = append(candidates, &irma.AttributeIdentifier{Type: attr})
+	}
+	return candidates
+}
+
+// guardianSessionURL checks that the QR is of a disclosure session at an acceptable URL.
+func guardianSessionURL(conf *irma.Configuration, qr *irma.Qr) (*url.URL, error) {
+	if irma.Action(qr.Type) != irma.ActionDisclosing {
+		return nil, errors.Errorf("Guardianships do not support %s sessions", qr.Type)
+	}
+	if err := conf.CheckSessionURL(qr.URL); err != nil {
+		return nil, err
+	}
+	return url.ParseRequestURI(qr.URL)
+}
+
+func parseGuardianPublicKey(bts []byte) (*ecdsa.PublicKey, error) {
+	pk, err := x509.ParsePKIXPublicKey(bts)
+	if err != nil {
+		return nil, err
+	}
+	ecpk, ok := pk.(*ecdsa.PublicKey)
+	if !ok || ecpk.Curve != elliptic.P256() {
+		return nil, errors.New("Guardian key is not a P-256 ECDSA key")
+	}
+	return ecpk, nil
+}
+
+func signGuardianRequest(privateKey []byte, request []byte) ([]byte, error) {
+	sk, err := x509.ParseECPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	hash := guardianRequestHash(request)
+	return ecdsa.SignASN1(rand.Reader, sk, hash[:])
+}
+
+func verifyGuardianRequest(publicKey []byte, request []byte, signature []byte) error {
+	pk, err := parseGuardianPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	hash := guardianRequestHash(request)
+	if !ecdsa.VerifyASN1(pk, hash[:], signature) {
+		return errors.New("Invalid signature on guardian request")
+	}
+	return nil
+}
+
+func guardianRequestHash(request []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte(guardianRequestDomain), request...))
+}
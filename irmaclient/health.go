@@ -0,0 +1,103 @@
+package irmaclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains signed reports of the health of the wallet for enterprise device management
+// (MDM) systems, which may require a healthy app before allowing access to internal requestors.
+// The client generates an ECDSA key when it is first needed, of which the app registers the public
+// key (see HealthReportKey()) at the MDM system when the device is enrolled there. The MDM system
+// then requests reports using a nonce of its choosing (see SignedWalletHealth()) and verifies them
+// using irma.ParseWalletHealth(). Reports contain no attribute values or other information about
+// the user, only the state of the storage, schemes and app (see irma.WalletHealth).
+//
+// These reports are not attestations: the key is generated by the app itself and kept in its
+// storage (encrypted if the storage is, see encryption.go), so a report only shows that it was
+// signed by the app instance that was enrolled, which vouches for its own health. A tampered device
+// or app can sign any report. MDM systems that need assurance of the integrity of the device and app
+// must additionally use platform attestation (e.g. Android Key Attestation or Apple App Attest).
+
+// HealthReportKey returns the public key with which wallet health reports are signed,
+// generating the key if necessary.
+func (client *Client) HealthReportKey() (*ecdsa.PublicKey, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	sk, err := client.healthReportKey()
+	if err != nil {
+		return nil, err
+	}
+	return &sk.PublicKey, nil
+}
+
+// WalletHealth checks the health of the wallet. The app version is included as is.
+func (client *Client) WalletHealth(appVersion string) (*irma.WalletHealth, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	damage, err := client.storageDamage()
+	if err != nil {
+		return nil, err
+	}
+	schema, err := client.storage.schema()
+	if err != nil {
+		return nil, err
+	}
+	health := &irma.WalletHealth{
+		StorageIntact:      damage == 0,
+		StorageDamage:      damage,
+		StorageEncrypted:   client.storage.aead != nil,
+		StorageVersion:     schema.Version,
+		Schemes:            map[irma.SchemeManagerIdentifier]*irma.SchemeHealth{},
+		MinProtocolVersion: minVersion,
+		MaxProtocolVersion: maxVersion,
+		AppVersion:         appVersion,
+	}
+	for id, manager := range client.Configuration.SchemeManagers {
+		health.Schemes[id] = &irma.SchemeHealth{Status: manager.Status, Timestamp: manager.Timestamp}
+	}
+	return health, nil
+}
+
+// SignedWalletHealth checks the health of the wallet, and returns a JWT containing it signed with
+// the health report key, for the MDM system that requested it using the specified nonce.
+func (client *Client) SignedWalletHealth(nonce, appVersion string) (string, error) {
+	health, err := client.WalletHealth(appVersion)
+	if err != nil {
+		return "", err
+	}
+	sk, err := client.healthReportKey()
+	if err != nil {
+		return "", err
+	}
+	return irma.SignWalletHealth(health, nonce, sk)
+}
+
+// healthReportKey loads the health report key from storage, or generates and stores it if absent.
+func (client *Client) healthReportKey() (*ecdsa.PrivateKey, error) {
+	var bts []byte
+	if err := client.storage.load(&bts, healthReportKeyFile); err != nil {
+		return nil, err
+	}
+	if bts != nil {
+		return x509.ParseECPrivateKey(bts)
+	}
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if bts, err = x509.MarshalECPrivateKey(sk); err != nil {
+		return nil, err
+	}
+	if err = client.storage.store(bts, healthReportKeyFile); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
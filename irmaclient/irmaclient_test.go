@@ -1,13 +1,28 @@
 package irmaclient
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
-
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/getsentry/raven-go"
+	goerrors "github.com/go-errors/errors"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
@@ -31,7 +46,6 @@ func parseStorage(t *testing.T) *Client {
 	client, err := New(
 		"../testdata/storage/test",
 		"../testdata/irma_configuration",
-		"",
 		&TestClientHandler{t: t},
 	)
 	require.NoError(t, err)
@@ -231,11 +245,89 @@ func TestCredentialInfoListNewAttribute(t *testing.T) {
 	require.Fail(t, "studentCard credential not found")
 }
 
+func TestSchemeFreshness(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	handler := client.handler.(*TestClientHandler)
+	demo := irma.NewSchemeManagerIdentifier("irma-demo")
+	request := &irma.IssuanceRequest{Credentials: []*irma.CredentialRequest{
+		{CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")},
+	}}
+
+	// Without a maximum staleness, no scheme is stale
+	client.clock = func() time.Time { return time.Now().AddDate(10, 0, 0) }
+	require.Empty(t, client.StaleSchemes())
+	require.Error(t, client.SetSchemeFreshnessPolicy(SchemeFreshnessPolicy{MaxStaleness: -1}))
+	require.NoError(t, client.SetSchemeFreshnessPolicy(SchemeFreshnessPolicy{MaxStaleness: 30, RefuseSessions: true}))
+	require.Contains(t, handler.stale, demo)
+	_, refuse := client.refuseStaleSchemes(irma.ActionIssuing, request)
+	require.True(t, refuse)
+	_, refuse = client.refuseStaleSchemes(irma.ActionDisclosing, request)
+	require.False(t, refuse)
+
+	// Checking for updates without finding a newer version does not refresh the schemes
+	require.NoError(t, client.UpdateSchemes())
+	require.Contains(t, client.StaleSchemes(), demo)
+
+	// Schemes are fresh within the maximum staleness after the timestamp of their signed index
+	timestamp := client.SchemeRefreshed(demo)
+	require.Equal(t, time.Time(client.Configuration.SchemeManagers[demo].Timestamp), timestamp)
+	client.clock = func() time.Time { return timestamp.AddDate(0, 0, 29) }
+	require.NotContains(t, client.StaleSchemes(), demo)
+	_, refuse = client.refuseStaleSchemes(irma.ActionIssuing, request)
+	require.False(t, refuse)
+	require.NoError(t, client.Close())
+}
+
+func TestTransportIsolation(t *testing.T) {
+	client, err := New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+	defer client.Close()
+
+	// By default each session gets a pool of its own
+	_, pool1 := client.sessionTransport("https://example.com/irma/session/a", "example.com")
+	_, pool2 := client.sessionTransport("https://example.com/irma/session/b", "example.com")
+	require.NotNil(t, pool1)
+	require.NotNil(t, pool2)
+	require.True(t, pool1 != pool2)
+	require.Empty(t, client.requestorPools)
+
+	// With requestor isolation, sessions with the same requestor share a pool that is not closed after the session
+	require.Error(t, client.SetTransportIsolationPreference("unknown"))
+	require.NoError(t, client.SetTransportIsolationPreference(TransportIsolationRequestor))
+	_, pool := client.sessionTransport("https://example.com/irma/session/a", "example.com")
+	require.Nil(t, pool)
+	_, pool = client.sessionTransport("https://example.com/irma/session/b", "example.com")
+	require.Nil(t, pool)
+	_, pool = client.sessionTransport("https://example.org/irma/session/c", "example.org")
+	require.Nil(t, pool)
+	require.Len(t, client.requestorPools, 2)
+
+	// Changing the preference drops the pools of the requestors
+	require.NoError(t, client.SetTransportIsolationPreference(TransportIsolationSession))
+	require.Empty(t, client.requestorPools)
+}
+
+func TestPushOriginMatching(t *testing.T) {
+	require.True(t, matchesHost("example.com", "example.com"))
+	require.True(t, matchesHost("irma.example.com", "Example.com"))
+	require.False(t, matchesHost("badexample.com", "example.com"))
+	require.False(t, matchesHost("example.com", "irma.example.com"))
+	require.False(t, matchesHost("example.com", ""))
+}
+
 // ------
 
 type TestClientHandler struct {
 	t *testing.T
 	c chan error
+
+	// Index of the credential instance to replace when the instance limit is reached
+	replace int
+	// Storage damage reported by the client
+	damage []*StorageDamage
+	// Stale schemes reported by the client
+	stale []irma.SchemeManagerIdentifier
 }
 
 func (i *TestClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
@@ -274,6 +366,15 @@ func (i *TestClientHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentif
 		i.t.Fatal(err)
 	}
 }
+func (i *TestClientHandler) CredentialLimitReached(id irma.CredentialTypeIdentifier, existing []*irma.CredentialInfo, callback func(index int)) {
+	callback(i.replace)
+}
+func (i *TestClientHandler) StorageRepaired(damage []*StorageDamage) {
+	i.damage = append(i.damage, damage...)
+}
+func (i *TestClientHandler) SchemeStale(scheme irma.SchemeManagerIdentifier, refreshed time.Time) {
+	i.stale = append(i.stale, scheme)
+}
 func (i *TestClientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int) {
 	err := errors.New("blocked account")
 	select {
@@ -282,3 +383,2584 @@ func (i *TestClientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifie
 		i.t.Fatal(err)
 	}
 }
+
+func TestSessionTranscripts(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	require.Nil(t, client.newTranscript(irma.ActionDisclosing, "localhost"))
+	client.SetSessionTranscriptsPreference(true)
+	transcript := client.newTranscript(irma.ActionDisclosing, "localhost")
+	require.NotNil(t, transcript)
+
+	transport := irma.NewHTTPTransport("http://localhost:48681/irma_configuration/irma-demo/")
+	transport.SetObserver(transcript.record)
+	var timestamp string
+	require.NoError(t, transport.Get("timestamp", &timestamp))
+	require.Error(t, transport.Get("nonexisting", &timestamp))
+	transcript.finish("failure", &irma.SessionError{ErrorType: irma.ErrorServerResponse, RemoteStatus: 404})
+
+	transcripts := client.SessionTranscripts()
+	require.Len(t, transcripts, 1)
+	require.Len(t, transcripts[0].Requests, 2)
+	require.Equal(t, "timestamp", transcripts[0].Requests[0].Endpoint)
+	require.Equal(t, len(timestamp), transcripts[0].Requests[0].ResponseSize)
+	require.Equal(t, 404, transcripts[0].Requests[1].Status)
+
+	// Transport errors do not contain the path of the URL, which may contain a session token
+	transport = irma.NewHTTPTransport("http://localhost:1/irma/session/secrettoken/")
+	transport.SetObserver(transcript.record)
+	require.Error(t, transport.Get("status?token=secret", &timestamp))
+	require.Len(t, transcripts[0].Requests, 3)
+	require.Contains(t, transcripts[0].Requests[2].TransportError, "http://localhost:1")
+	require.NotContains(t, transcripts[0].Requests[2].TransportError, "secret")
+
+	_, err := client.ExportSessionTranscripts()
+	require.NoError(t, err)
+
+	client.SetSessionTranscriptsPreference(false)
+	require.Empty(t, client.SessionTranscripts())
+}
+
+func TestStats(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	stats, err := client.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.CredentialsPerIssuer[irma.NewIssuerIdentifier("irma-demo.RU")])
+	require.NotZero(t, stats.CredentialsPerScheme[irma.NewSchemeManagerIdentifier("irma-demo")])
+	require.NotZero(t, stats.StorageSize)
+	require.Contains(t, stats.SchemeTimestamps, irma.NewSchemeManagerIdentifier("irma-demo"))
+
+	// Only sessions are counted, and the logs are not cached
+	month := time.Unix(1, 0)
+	client.logs = nil
+	for _, typ := range []irma.Action{irma.ActionDisclosing, irma.ActionSigning, actionRemoval, actionPruned} {
+		require.NoError(t, client.addLogEntry(&LogEntry{Type: typ, Time: irma.Timestamp(month)}))
+	}
+	stats, err = client.Stats()
+	require.NoError(t, err)
+	require.Equal(t, map[irma.Action]int{irma.ActionDisclosing: 1, irma.ActionSigning: 1},
+		stats.SessionsPerMonth[month.Format("2006-01")])
+	require.Nil(t, client.logs)
+}
+
+func TestDisclosureSummarySkipsUnresolvableEntries(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	client.logs = nil
+	require.NoError(t, client.addLogEntry(&LogEntry{
+		Type:    irma.ActionDisclosing,
+		Time:    irma.Timestamp(time.Now()),
+		Request: json.RawMessage("[]"),
+	}))
+	summary, err := client.DisclosureSummary()
+	require.NoError(t, err)
+	require.Empty(t, summary)
+	require.Nil(t, client.logs)
+}
+
+func TestStorageInfo(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	info, err := client.StorageInfo()
+	require.NoError(t, err)
+	require.NotZero(t, info.Configuration)
+	require.NotZero(t, info.Credentials)
+	require.NotZero(t, info.Keyshare)
+	require.NotZero(t, info.Other)
+
+	// Removing credentials frees up space in the credentials category, but adds a log entry
+	require.NoError(t, client.RemoveAllCredentials())
+	after, err := client.StorageInfo()
+	require.NoError(t, err)
+	require.True(t, after.Credentials < info.Credentials)
+	require.True(t, after.Logs > info.Logs)
+	require.Equal(t, info.Configuration, after.Configuration)
+}
+
+func TestCleanupExpiredCredentials(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	count := len(client.CredentialInfoList())
+	require.NotZero(t, count)
+
+	// Nothing is removed with the default policy
+	removed, err := client.CleanupExpiredCredentials()
+	require.NoError(t, err)
+	require.Zero(t, removed)
+
+	// Move the clock forward such that all credentials have expired for longer than the policy allows
+	client.clock = func() time.Time { return time.Now().AddDate(50, 0, 0) }
+	defer func() { client.clock = nil }()
+	for _, info := range client.CredentialInfoList() {
+		require.True(t, time.Time(info.Expires).AddDate(0, 0, 30).Before(client.now()))
+	}
+
+	require.Error(t, client.SetExpiredCredentialsPolicy(ExpiredCredentialsPolicy{Action: "unknown"}))
+	require.Error(t, client.SetExpiredCredentialsPolicy(ExpiredCredentialsPolicy{Action: ExpiredCredentialsDelete, Days: -1}))
+	require.Len(t, client.CredentialInfoList(), count)
+	require.NoError(t, client.SetExpiredCredentialsPolicy(ExpiredCredentialsPolicy{Action: ExpiredCredentialsDelete, Days: 30}))
+	require.Empty(t, client.CredentialInfoList())
+
+	logs, err := client.LoadNewestLogs(1)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	require.Equal(t, actionRemoval, logs[0].Type)
+	removedCount := 0
+	for _, attrs := range logs[0].Removed {
+		require.NotEmpty(t, attrs)
+		removedCount++
+	}
+	require.NotZero(t, removedCount)
+
+	// Running it again does not remove anything
+	removed, err = client.CleanupExpiredCredentials()
+	require.NoError(t, err)
+	require.Zero(t, removed)
+}
+
+func TestArchiveCredential(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	require.NotEmpty(t, client.attributes[id])
+	hash := client.attributes[id][0].Hash()
+	count := len(client.CredentialInfoList())
+
+	require.NoError(t, client.ArchiveCredentialByHash(hash))
+	require.Len(t, client.CredentialInfoList(), count-1)
+	require.Len(t, client.ArchivedCredentialInfoList(), 1)
+	require.Equal(t, hash, client.ArchivedCredentialInfoList()[0].Hash)
+	require.Error(t, client.ArchiveCredentialByHash(hash))
+
+	// The archive survives reloading the client from storage
+	archived, err := client.storage.LoadArchive()
+	require.NoError(t, err)
+	require.Len(t, archived[id], 1)
+
+	require.NoError(t, client.RestoreCredentialByHash(hash))
+	require.Len(t, client.CredentialInfoList(), count)
+	require.Empty(t, client.ArchivedCredentialInfoList())
+	require.Error(t, client.RestoreCredentialByHash(hash))
+
+	// Removing an archived credential does the same bookkeeping as removing an active one
+	require.NoError(t, client.ArchiveCredentialByHash(hash))
+	client.provenance = map[string]*irma.CredentialProvenance{hash: {}}
+	require.NoError(t, client.RemoveArchivedCredentialByHash(hash))
+	require.Empty(t, client.ArchivedCredentialInfoList())
+	require.Contains(t, client.removals, hash)
+	require.Nil(t, client.credentialProvenance(hash))
+	require.Error(t, client.RemoveArchivedCredentialByHash(hash))
+	hash = client.CredentialInfoList()[0].Hash
+
+	// Credentials can be archived before the attributes are loaded lazily (the first time
+	// the client is opened with lazy loading, the attributes are loaded to write their index)
+	require.NoError(t, client.Close())
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithLazyAttributeLoading())
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithLazyAttributeLoading())
+	require.NoError(t, err)
+	require.True(t, client.attributesPending)
+	require.NoError(t, client.ArchiveCredentialByHash(hash))
+	require.Len(t, client.ArchivedCredentialInfoList(), 1)
+	require.NoError(t, client.Close())
+}
+
+func TestImportLegacyAndroidStorage(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Write the credentials of the client to legacy storage in the format of the old Android app
+	legacy := map[string][]*LegacyCredential{}
+	for id, attrlistlist := range client.attributes {
+		for i := range attrlistlist {
+			cred, err := client.credential(id, i)
+			require.NoError(t, err)
+			legacy[id.Name()] = append(legacy[id.Name()], &LegacyCredential{
+				Signature:  cred.Signature,
+				Attributes: cred.Attributes,
+			})
+		}
+	}
+	legacy["invalid"] = []*LegacyCredential{{Attributes: []*big.Int{client.secretkey.Key}}}
+	bts, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	legacyPath := filepath.Join("..", "testdata", "storage", "android")
+	require.NoError(t, fs.EnsureDirectoryExists(filepath.Join(legacyPath, "shared_prefs")))
+	defer os.RemoveAll(legacyPath)
+	xmlbts := `<?xml version='1.0' encoding='utf-8' standalone='yes' ?><map><string name="credentials">` +
+		html.EscapeString(string(bts)) + `</string></map>`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(legacyPath, legacyAndroidStorageFile), []byte(xmlbts), 0600))
+
+	_, err = client.ImportLegacyStorage(LegacyImporterAndroid, filepath.Join("..", "testdata", "nonexisting"))
+	require.Error(t, err)
+
+	count := len(client.CredentialInfoList())
+	require.NoError(t, client.RemoveAllCredentials())
+	report, err := client.ImportLegacyStorage(LegacyImporterAndroid, legacyPath)
+	require.NoError(t, err)
+	require.Equal(t, count, report.Imported())
+	require.Len(t, report.Failed(), 1)
+	require.Len(t, client.CredentialInfoList(), count)
+
+	// Importing again is harmless
+	report, err = client.ImportLegacyStorage(LegacyImporterAndroid, legacyPath)
+	require.NoError(t, err)
+	require.Zero(t, report.Imported())
+	require.Len(t, report.Failed(), 1)
+	require.Len(t, client.CredentialInfoList(), count)
+
+	_, err = client.ImportLegacyStorage("nonexisting", legacyPath)
+	require.Error(t, err)
+}
+
+func TestImportLegacyIOSStorage(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	manager := irma.NewSchemeManagerIdentifier("irma-demo")
+
+	_, err := client.ImportLegacyStorage(LegacyImporterIOS, filepath.Join("..", "testdata", "nonexisting"))
+	require.Error(t, err)
+
+	// The user defaults of the old iOS app, as a binary property list, containing the credentials of
+	// the test storage and an enrollment
+	count := len(client.CredentialInfoList())
+	require.NoError(t, client.RemoveAllCredentials())
+	report, err := client.ImportLegacyStorage(LegacyImporterIOS, filepath.Join("..", "testdata", "legacy", "ios"))
+	require.NoError(t, err)
+	require.Equal(t, count, report.Imported())
+	require.Empty(t, report.Failed())
+	require.Equal(t, []irma.SchemeManagerIdentifier{manager}, report.KeyshareServers)
+	require.Len(t, client.CredentialInfoList(), count)
+	require.Equal(t, "user", client.keyshareServers[manager].Username)
+	require.Equal(t, []byte{1, 2, 3}, client.keyshareServers[manager].Nonce)
+
+	// The user defaults as an XML property list, as converted by plutil
+	legacyPath := filepath.Join("..", "testdata", "storage", "ios")
+	require.NoError(t, fs.EnsureDirectoryExists(filepath.Join(legacyPath, "Library", "Preferences")))
+	defer os.RemoveAll(legacyPath)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(legacyPath, filepath.FromSlash(legacyIOSStorageFile)), []byte(
+		`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0"><dict>
+	<key>NSLanguages</key><array><string>nl-NL</string></array>
+	<key>keyshare</key><string>{"irma-demo":{"username":"other","nonce":"AQID"}}</string>
+</dict></plist>`), 0600))
+	legacy, err := iosImporter{}.Read(legacyPath)
+	require.NoError(t, err)
+	require.Empty(t, legacy.Credentials)
+	require.Equal(t, "other", legacy.KeyshareServers[manager].Username)
+}
+
+// memoryLegacyImporter is a LegacyImporter of a third-party wallet keeping its storage in memory.
+type memoryLegacyImporter map[string]*LegacyStorage
+
+func (memoryLegacyImporter) Name() string {
+	return "memory"
+}
+
+func (importer memoryLegacyImporter) Read(path string) (*LegacyStorage, error) {
+	if legacy, ok := importer[path]; ok {
+		return legacy, nil
+	}
+	return nil, goerrors.Errorf("No storage at %s", path)
+}
+
+func TestLegacyImporter(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	cred, err := client.credential(studentCard, 0)
+	require.NoError(t, err)
+	// Copy the credential, as removing it below wipes it from memory
+	bts, err := json.Marshal(&LegacyCredential{Signature: cred.Signature, Attributes: cred.Attributes})
+	require.NoError(t, err)
+	legacycred := &LegacyCredential{}
+	require.NoError(t, json.Unmarshal(bts, legacycred))
+	manager := irma.NewSchemeManagerIdentifier("irma-demo")
+
+	RegisterLegacyImporter(memoryLegacyImporter{"wallet": {
+		Credentials: []*LegacyCredential{legacycred},
+		KeyshareServers: map[irma.SchemeManagerIdentifier]*LegacyKeyshareEnrollment{
+			manager: {Username: "user", Nonce: []byte{1, 2, 3}},
+		},
+	}})
+	require.Contains(t, LegacyImporters(), "memory")
+	require.Contains(t, LegacyImporters(), LegacyImporterAndroid)
+
+	_, err = client.ImportLegacyStorage("memory", "nonexisting")
+	require.Error(t, err)
+	require.NoError(t, client.RemoveCredentialByHash(client.attrs(studentCard)[0].Hash()))
+	report, err := client.ImportLegacyStorage("memory", "wallet")
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Imported())
+	require.Equal(t, []irma.SchemeManagerIdentifier{manager}, report.KeyshareServers)
+	require.Len(t, client.attrs(studentCard), 1)
+	require.Equal(t, "user", client.keyshareServers[manager].Username)
+}
+
+func TestLegacyImportForgedSecretKey(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	cred, err := client.credential(studentCard, 0)
+	require.NoError(t, err)
+	bts, err := json.Marshal(&LegacyCredential{Signature: cred.Signature, Attributes: cred.Attributes})
+	require.NoError(t, err)
+	valid, forged := &LegacyCredential{}, &LegacyCredential{}
+	require.NoError(t, json.Unmarshal(bts, valid))
+	require.NoError(t, json.Unmarshal(bts, forged))
+	forged.Attributes[0] = big.NewInt(42)
+
+	key, err := client.unwrappedSecretKey()
+	require.NoError(t, err)
+	key = new(big.Int).Set(key)
+	require.NoError(t, client.RemoveAllCredentials())
+	client.keyshareServers = map[irma.SchemeManagerIdentifier]*keyshareServer{}
+	require.True(t, client.isEmpty())
+
+	// A credential whose signature does not verify does not determine our secret key
+	RegisterLegacyImporter(memoryLegacyImporter{
+		"forged": {Credentials: []*LegacyCredential{forged}},
+		"both":   {Credentials: []*LegacyCredential{forged, valid}},
+	})
+	report, err := client.ImportLegacyStorage("memory", "forged")
+	require.NoError(t, err)
+	require.Zero(t, report.Imported())
+	require.Equal(t, "credential signature invalid", report.Failed()[0].Error)
+	require.Equal(t, studentCard, report.Failed()[0].CredentialType)
+	unwrapped, err := client.unwrappedSecretKey()
+	require.NoError(t, err)
+	require.Zero(t, key.Cmp(unwrapped))
+
+	// It is taken from the first credential that does verify, which is left intact when the secret
+	// key is wrapped and wiped
+	client.keystore = &xorKeystore{}
+	report, err = client.ImportLegacyStorage("memory", "both")
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Imported())
+	require.Len(t, report.Failed(), 1)
+	require.NotEmpty(t, client.secretkey.Wrapped)
+	require.Zero(t, key.Cmp(valid.Attributes[0]))
+	unwrapped, err = client.unwrappedSecretKey()
+	require.NoError(t, err)
+	require.Zero(t, key.Cmp(unwrapped))
+}
+
+func TestExportCredentials(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	mijnirma := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	hash := client.attrs(studentCard)[0].Hash()
+	_, err := client.ExportCredentials([]string{"nonexisting"}, nil)
+	require.Error(t, err)
+	bts, err := client.ExportCredentials([]string{hash}, []irma.CredentialTypeIdentifier{studentCard, mijnirma})
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), client.secretkey.Key.String())
+
+	count := len(client.CredentialInfoList())
+	require.NoError(t, client.RemoveCredentialByHash(hash))
+	report, err := client.ImportCredentials(bts)
+	require.NoError(t, err)
+	require.Len(t, report.Credentials, 2)
+	require.Equal(t, 1, report.Imported())
+	require.Empty(t, report.Failed())
+	require.Len(t, client.CredentialInfoList(), count)
+	verifyClientIsUnmarshaled(t, client)
+
+	// Credentials cannot be imported into a client with another secret key
+	other, err := New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+	report, err = other.ImportCredentials(bts)
+	require.NoError(t, err)
+	require.Len(t, report.Failed(), 2)
+	require.Empty(t, other.CredentialInfoList())
+}
+
+func TestExplainCandidates(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	attrtype := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	credtype := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard")
+	reqval := "456"
+	disjunctions := irma.AttributeDisjunctionList{
+		&irma.AttributeDisjunction{
+			Attributes: []irma.AttributeTypeIdentifier{attrtype},
+		},
+		&irma.AttributeDisjunction{
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over12"), attrtype},
+			Values:     map[irma.AttributeTypeIdentifier]*string{attrtype: &reqval},
+		},
+		&irma.AttributeDisjunction{
+			Attributes: []irma.AttributeTypeIdentifier{credtype},
+		},
+	}
+
+	// Expired credentials are no candidates, so we move the clock to when the test credentials were valid
+	signed := client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))[0].SigningDate()
+	client.clock = func() time.Time { return signed.Add(time.Hour) }
+	defer func() { client.clock = nil }()
+
+	candidates, _ := client.CheckSatisfiability(disjunctions)
+	explanations := client.ExplainCandidates(disjunctions)
+	require.Len(t, explanations, len(disjunctions))
+	for i := range disjunctions {
+		require.Len(t, explanations[i], len(candidates[i]))
+		for j, explanation := range explanations[i] {
+			require.Equal(t, candidates[i][j], explanation.Candidate)
+			require.Equal(t, i, explanation.Disjunction)
+		}
+	}
+
+	require.NotEmpty(t, explanations[0])
+	require.NotEmpty(t, explanations[1])
+	require.NotEmpty(t, explanations[2])
+	require.Nil(t, explanations[0][0].RequiredValue)
+	require.False(t, explanations[0][0].CredentialLevel)
+	require.Equal(t, 1, explanations[1][0].Attribute)
+	require.Equal(t, &reqval, explanations[1][0].RequiredValue)
+	require.True(t, explanations[2][0].CredentialLevel)
+}
+
+func TestPolicyHandler(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	policy := &Policy{}
+	policy.AddRule("verified", AllowVerifiedRequestors(irma.ActionIssuing))
+	policy.AddRule("no-signing", func(request *PolicyRequest) (PolicyDecision, *irma.DisclosureChoice) {
+		if request.Action == irma.ActionSigning {
+			return PolicyDeny, nil
+		}
+		return PolicyAbstain, nil
+	})
+	handler := client.NewPolicyHandler(policy, nil).(RequestorHandler)
+
+	var proceeded bool
+	callback := func(proceed bool, choice *irma.DisclosureChoice) { proceeded = proceed }
+	verified := &SessionRequestor{Name: irma.NewTranslatedString(nil), Verified: true}
+
+	handler.RequestIssuancePermissionFrom(irma.IssuanceRequest{}, verified, callback)
+	require.True(t, proceeded)
+	handler.RequestIssuancePermissionFrom(irma.IssuanceRequest{}, &SessionRequestor{}, callback)
+	require.False(t, proceeded)
+	handler.RequestSignaturePermissionFrom(irma.SignatureRequest{}, verified, callback)
+	require.False(t, proceeded)
+
+	audit := policy.AuditTrail()
+	require.Len(t, audit, 3)
+	require.Equal(t, PolicyAllow, audit[0].Decision)
+	require.Equal(t, "verified", audit[0].Rule)
+	require.Equal(t, PolicyAbstain, audit[1].Decision)
+	require.Empty(t, audit[1].Rule)
+	require.Equal(t, PolicyDeny, audit[2].Decision)
+	require.Equal(t, "no-signing", audit[2].Rule)
+
+	// The audit trail keeps only the most recent decisions
+	policy.MaxAuditEntries = 2
+	handler.RequestIssuancePermissionFrom(irma.IssuanceRequest{}, verified, callback)
+	audit = policy.AuditTrail()
+	require.Len(t, audit, 2)
+	require.Equal(t, "no-signing", audit[0].Rule)
+	require.Equal(t, "verified", audit[1].Rule)
+}
+
+func TestLogSegments(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Earlier versions stored all logs in a single file, which is converted to segments
+	old := []*LogEntry{{Type: actionRemoval, Time: irma.Timestamp(time.Unix(1, 0))}}
+	require.NoError(t, os.RemoveAll(client.storage.path(logSegmentsDir)))
+	require.NoError(t, client.storage.store(old, logsFile))
+	client.storage.logIndex, client.logs = nil, nil
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	exists, err := fs.PathExists(client.storage.path(logsFile))
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	count := logSegmentSize + 10
+	for i := 1; i < count; i++ {
+		entry := &LogEntry{Type: actionRemoval, Time: irma.Timestamp(time.Unix(int64(i+1), 0))}
+		require.NoError(t, client.addLogEntry(entry))
+	}
+	require.Len(t, client.storage.logIndex.Segments, 2)
+
+	// Simulate an interrupted append, which should be skipped when loading
+	last := client.storage.logIndex.Segments[1]
+	file, err := os.OpenFile(client.storage.path(logSegmentsDir+"/"+last.Name), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.Write([]byte(`{"Type":"remo`))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: actionRemoval, Time: irma.Timestamp(time.Unix(int64(count+1), 0))}))
+	count++
+
+	// Load the logs from a fresh storage, which determines the amount of entries in the last segment
+	// from the segment instead of from the stored index
+	s := storage{storagePath: client.storage.storagePath, Configuration: client.Configuration}
+	index, err := s.loadLogIndex()
+	require.NoError(t, err)
+	require.Equal(t, count+1, index.count()) // including the line of the partial entry
+	logs, err = s.LoadLogs()
+	require.NoError(t, err)
+	require.Len(t, logs, count)
+	for i, entry := range logs {
+		require.Equal(t, int64(i+1), time.Time(entry.Time).Unix())
+		if i < count-1 {
+			require.Equal(t, i, entry.Index)
+		} else {
+			require.Equal(t, i+1, entry.Index) // the last entry follows the partial one
+		}
+	}
+
+	// Load the logs page by page, newest first
+	page, err := s.LoadNewestLogs(30)
+	require.NoError(t, err)
+	require.Len(t, page, 30)
+	require.Equal(t, count, page[0].Index)
+	loaded := 0
+	for len(page) > 0 {
+		for _, entry := range page {
+			require.Equal(t, int64(count-loaded), time.Time(entry.Time).Unix())
+			require.Equal(t, logs[count-1-loaded].Index, entry.Index)
+			loaded++
+		}
+		page, err = s.LoadLogsBefore(page[len(page)-1].Index, 30)
+		require.NoError(t, err)
+	}
+	require.Equal(t, count, loaded)
+
+	// After reopening the client, entries are appended after the existing ones, and loaded in
+	// pages at the same positions
+	require.NoError(t, client.Close())
+	client, err = New(client.storage.storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	entry := &LogEntry{Type: actionRemoval, Time: irma.Timestamp(time.Unix(int64(count+1), 0))}
+	require.NoError(t, client.addLogEntry(entry))
+	require.Equal(t, count+1, entry.Index)
+	require.NoError(t, client.Close())
+	client, err = New(client.storage.storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	page, err = client.LoadNewestLogs(2)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	require.Equal(t, count+1, page[0].Index)
+	require.Equal(t, int64(count+1), time.Time(page[0].Time).Unix())
+	page, err = client.LoadLogsBefore(page[1].Index, logSegmentSize)
+	require.NoError(t, err)
+	require.Len(t, page, logSegmentSize)
+	for i, entry := range page {
+		require.Equal(t, logs[count-2-i].Index, entry.Index)
+		require.Equal(t, int64(count-1-i), time.Time(entry.Time).Unix())
+	}
+	require.NoError(t, client.Close())
+}
+
+func TestWalletLock(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	require.False(t, client.WalletPinEnabled())
+	ok, _, _, err := client.SetWalletPin("", "12345")
+	require.NoError(t, err)
+	require.True(t, ok)
+	key, err := client.EnableBiometricUnlock()
+	require.NoError(t, err)
+
+	// The wallet lock cannot be bypassed by removing its file
+	require.NoError(t, client.Close())
+	storagePath := client.storage.storagePath
+	bts, err := ioutil.ReadFile(filepath.Join(storagePath, walletLockFile))
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(storagePath, walletLockFile)))
+	_, err = New(storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.Equal(t, ErrWalletLockMissing, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(storagePath, walletLockFile), bts, 0600))
+
+	// A new client starts locked
+	client, err = New(storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.True(t, client.WalletLocked())
+	require.Empty(t, client.CredentialInfoList())
+	_, err = client.Logs()
+	require.Equal(t, ErrWalletLocked, err)
+	require.Equal(t, ErrWalletLocked, client.RemoveAllCredentials())
+
+	ok, attempts, blocked, err := client.UnlockWallet("00000")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, walletPinAttempts-1, attempts)
+	require.Zero(t, blocked)
+
+	ok, _, _, err = client.UnlockWallet("12345")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.False(t, client.WalletLocked())
+	verifyClientIsUnmarshaled(t, client)
+
+	// Incorrect attempts block the wallet, also for the correct PIN
+	client.LockWallet()
+	require.Empty(t, client.CredentialInfoList())
+	for i := 0; i < walletPinAttempts; i++ {
+		ok, _, blocked, err = client.UnlockWalletBiometric([]byte("incorrect"))
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+	require.NotZero(t, blocked)
+	ok, _, blocked, err = client.UnlockWalletBiometric(key)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NotZero(t, blocked)
+
+	client.walletLock.BlockedUntil = time.Now().Add(-time.Second)
+	ok, _, _, err = client.UnlockWalletBiometric(key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	verifyClientIsUnmarshaled(t, client)
+
+	// Disable the wallet lock
+	ok, _, _, err = client.SetWalletPin("12345", "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.False(t, client.WalletPinEnabled())
+	require.NoError(t, client.Close())
+	client, err = New(client.storage.storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.False(t, client.WalletLocked())
+}
+
+func TestSubscriptions(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	requestor := &SessionRequestor{Hostname: "Example.com"}
+	_, err := client.Subscribe(requestor, []irma.AttributeTypeIdentifier{id}, 0, nil)
+	require.Error(t, err)
+	_, err = client.Subscribe(&SessionRequestor{}, []irma.AttributeTypeIdentifier{id}, 1, nil)
+	require.Error(t, err)
+
+	sub, err := client.Subscribe(requestor, []irma.AttributeTypeIdentifier{id}, 1, nil)
+	require.NoError(t, err)
+	require.Len(t, client.Subscriptions(), 1)
+
+	candidates := [][]*irma.AttributeIdentifier{{{Type: id}}}
+	require.Nil(t, client.useSubscription(&SessionRequestor{Hostname: "example.org"}, candidates))
+	other := [][]*irma.AttributeIdentifier{{{Type: id}}, {{Type: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")}}}
+	require.Nil(t, client.useSubscription(requestor, other))
+	// The host has become associated to a requestor in the requestor registry
+	verified := &SessionRequestor{Hostname: "example.com", Verified: true, Info: &irma.RequestorInfo{ID: "example", Scheme: irma.NewSchemeManagerIdentifier("irma-demo")}}
+	require.Nil(t, client.useSubscription(verified, candidates))
+
+	choice := client.useSubscription(requestor, candidates)
+	require.NotNil(t, choice)
+	require.Equal(t, id, choice.Attributes[0].Type)
+
+	// The subscription is exhausted
+	require.Nil(t, client.useSubscription(requestor, candidates))
+	require.Empty(t, client.Subscriptions())
+	require.Error(t, client.RevokeSubscription(sub.ID))
+
+	// Only exactly the subscribed attributes are disclosed without permission
+	level := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	_, err = client.Subscribe(verified, []irma.AttributeTypeIdentifier{id, id}, 5, nil)
+	require.Error(t, err)
+	_, err = client.Subscribe(verified, []irma.AttributeTypeIdentifier{id, level}, 5, nil)
+	require.NoError(t, err)
+	require.Nil(t, client.useSubscription(verified, candidates))
+	require.Nil(t, client.useSubscription(requestor, other))
+	require.NotNil(t, client.useSubscription(verified, other))
+	require.NotNil(t, client.useSubscription(verified, [][]*irma.AttributeIdentifier{{{Type: level}, {Type: id}}, {{Type: id}}}))
+
+	// Subscriptions are stored
+	sub, err = client.Subscribe(requestor, []irma.AttributeTypeIdentifier{id}, 5, nil)
+	require.NoError(t, err)
+	subs, err := client.storage.LoadSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.NoError(t, client.RevokeSubscription(sub.ID))
+	require.Len(t, client.Subscriptions(), 1)
+}
+
+// issueLocally computes the commitments of the client for the request, and acts as the issuer
+// of the (irma-demo) credentials in the request by signing them.
+func issueLocally(t *testing.T, client *Client, request *irma.IssuanceRequest) ([]*gabi.IssueSignatureMessage, gabi.ProofBuilderList) {
+	commitments, builders, err := client.IssueCommitments(request)
+	require.NoError(t, err)
+
+	var sigs []*gabi.IssueSignatureMessage
+	for i, cred := range request.Credentials {
+		pk, err := client.Configuration.PublicKey(cred.CredentialTypeID.IssuerIdentifier(), cred.KeyCounter)
+		require.NoError(t, err)
+		sk, err := gabi.NewPrivateKeyFromFile(filepath.Join("..", "testdata", "irma_configuration", "irma-demo",
+			cred.CredentialTypeID.IssuerIdentifier().Name(), "PrivateKeys", "2.xml"))
+		require.NoError(t, err)
+		attrs, err := cred.AttributeList(client.Configuration, 0x03)
+		require.NoError(t, err)
+		sig, err := gabi.NewIssuer(sk, pk, big.NewInt(1)).
+			IssueSignature(commitments.Proofs[i].(*gabi.ProofU).U, attrs.Ints, commitments.Nonce2)
+		require.NoError(t, err)
+		sigs = append(sigs, sig)
+	}
+	return sigs, builders
+}
+
+func TestPartialIssuance(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	validity := irma.Timestamp(irma.FloorToEpochBoundary(time.Now().AddDate(1, 0, 0)))
+	request := &irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing, Context: big.NewInt(1), Nonce: big.NewInt(42)},
+		Credentials: []*irma.CredentialRequest{
+			{
+				Validity:         &validity,
+				KeyCounter:       2,
+				CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+				Attributes: map[string]string{
+					"university":        "Radboud",
+					"studentCardNumber": "31415927",
+					"studentID":         "s1234567",
+					"level":             "42",
+				},
+			},
+			{
+				Validity:         &validity,
+				KeyCounter:       2,
+				CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+				Attributes:       map[string]string{"BSN": "299792458"},
+			},
+		},
+	}
+	request.Version = &irma.ProtocolVersion{Major: 2, Minor: 6}
+
+	sigs, builders := issueLocally(t, client, request)
+	// Corrupt the signature on the first credential
+	sigs[0].Signature.A = new(big.Int).Add(sigs[0].Signature.A, big.NewInt(1))
+
+	before := len(client.attributes[request.Credentials[1].CredentialTypeID])
+	results, err := client.ConstructCredentials(sigs, request, builders)
+	require.IsType(t, &PartialIssuanceError{}, err)
+	require.Equal(t, []irma.CredentialTypeIdentifier{request.Credentials[0].CredentialTypeID}, err.(*PartialIssuanceError).Failed())
+	require.Len(t, results, 2)
+	require.False(t, results[0].Success())
+	require.False(t, results[0].Queued) // an invalid signature cannot be stored later either
+	require.True(t, results[1].Success())
+
+	// The other credential was stored
+	require.Len(t, client.attributes[request.Credentials[1].CredentialTypeID], before+1)
+	require.Zero(t, client.QueuedCredentials())
+}
+
+func TestIssuanceQueue(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	path := client.storage.storagePath
+
+	validity := irma.Timestamp(irma.FloorToEpochBoundary(time.Now().AddDate(1, 0, 0)))
+	request := &irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing, Context: big.NewInt(1), Nonce: big.NewInt(42)},
+		Credentials: []*irma.CredentialRequest{{
+			Validity:         &validity,
+			KeyCounter:       2,
+			CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+			Attributes:       map[string]string{"BSN": "299792458"},
+		}},
+	}
+	request.Version = &irma.ProtocolVersion{Major: 2, Minor: 6}
+	id := request.Credentials[0].CredentialTypeID
+	before := len(client.attrs(id))
+
+	// Make storing the signature fail by replacing the signature directory by a file
+	sigs := filepath.Join(path, signaturesDir)
+	require.NoError(t, os.Rename(sigs, sigs+".moved"))
+	require.NoError(t, ioutil.WriteFile(sigs, nil, 0600))
+
+	issuesigs, builders := issueLocally(t, client, request)
+	results, err := client.ConstructCredentials(issuesigs, request, builders)
+	require.IsType(t, &PartialIssuanceError{}, err)
+	require.True(t, results[0].Queued)
+	require.Equal(t, 1, client.QueuedCredentials())
+	require.Len(t, client.attrs(id), before) // the credential is not used until it is stored
+
+	// After the storage is repaired, the credential is stored when the client is next started
+	require.NoError(t, client.Close())
+	require.NoError(t, os.Remove(sigs))
+	require.NoError(t, os.Rename(sigs+".moved", sigs))
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Zero(t, client.QueuedCredentials())
+	require.Len(t, client.attrs(id), before+1)
+	cred, err := client.credential(id, before)
+	require.NoError(t, err)
+	require.NotNil(t, cred)
+
+	// The queue is empty when the client is started again
+	require.NoError(t, client.Close())
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Zero(t, client.QueuedCredentials())
+	require.Len(t, client.attrs(id), before+1)
+
+	// A queued singleton credential does not replace an instance issued since
+	require.NoError(t, os.Rename(sigs, sigs+".moved"))
+	require.NoError(t, ioutil.WriteFile(sigs, nil, 0600))
+	issuesigs, builders = issueLocally(t, client, request)
+	results, err = client.ConstructCredentials(issuesigs, request, builders)
+	require.Error(t, err)
+	require.True(t, results[0].Queued)
+	require.Len(t, client.attrs(id), before+1) // the previous instance is kept
+	require.NoError(t, os.Remove(sigs))
+	require.NoError(t, os.Rename(sigs+".moved", sigs))
+	request.Credentials[0].Attributes["BSN"] = "314159265"
+	issuesigs, builders = issueLocally(t, client, request)
+	_, err = client.ConstructCredentials(issuesigs, request, builders)
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Zero(t, client.QueuedCredentials())
+	require.Len(t, client.attrs(id), before+1)
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	require.Equal(t, "314159265", *client.attrs(id)[before].UntranslatedAttribute(bsn))
+	require.NoError(t, client.Close())
+}
+
+func TestIssuanceBuilderCorrelation(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Credentials from issuers of two different schemes
+	request := &irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing, Context: big.NewInt(1), Nonce: big.NewInt(42)},
+		Credentials: []*irma.CredentialRequest{
+			{KeyCounter: 2, CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")},
+			{KeyCounter: 3, CredentialTypeID: irma.NewCredentialTypeIdentifier("test.test.email")},
+		},
+	}
+	builders, _, _, err := client.IssuanceProofBuilders(request)
+	require.NoError(t, err)
+
+	credbuilders, err := issuanceBuilders(request, builders)
+	require.NoError(t, err)
+	require.Len(t, credbuilders, 2)
+	require.Equal(t, "irma-demo.RU", credbuilders[0].PublicKey().Issuer)
+	require.Equal(t, "test.test", credbuilders[1].PublicKey().Issuer)
+
+	// Builders in another order than the credentials of the request are rejected
+	_, err = issuanceBuilders(request, gabi.ProofBuilderList{builders[1], builders[0]})
+	require.Error(t, err)
+	_, err = issuanceBuilders(request, builders[:1])
+	require.Error(t, err)
+	_, err = client.ConstructCredentials(make([]*gabi.IssueSignatureMessage, 2), request, gabi.ProofBuilderList{builders[1], builders[0]})
+	require.Error(t, err)
+	_, partial := err.(*PartialIssuanceError)
+	require.False(t, partial)
+}
+
+func TestCrashReportingBreadcrumbs(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Without a DSN no breadcrumbs are recorded
+	client.addBreadcrumb("session.disclosing", "communicating")
+	require.Empty(t, client.Breadcrumbs())
+
+	defer func(dsn string, max int) {
+		SentryDSN, SentryMaxBreadcrumbs = dsn, max
+		client.SetCrashReportingPreference(false)
+	}(SentryDSN, SentryMaxBreadcrumbs)
+	SentryDSN, SentryMaxBreadcrumbs = "https://public@localhost/1", 2
+	client.SetCrashReportingPreference(true)
+
+	for _, status := range []string{"communicating", "connected", "done"} {
+		client.addBreadcrumb("session.disclosing", status)
+	}
+	crumbs := client.Breadcrumbs()
+	require.Len(t, crumbs, 2)
+	require.Equal(t, "connected", crumbs[0].Message)
+	require.Equal(t, "done", crumbs[1].Message)
+
+	// Disabling takes effect immediately and discards the breadcrumbs
+	client.SetCrashReportingPreference(false)
+	require.Empty(t, client.Breadcrumbs())
+	client.addBreadcrumb("session.disclosing", "communicating")
+	require.Empty(t, client.Breadcrumbs())
+}
+
+// failureHandler is a session Handler recording the failure of the session.
+type failureHandler struct {
+	Handler
+	err *irma.SessionError
+}
+
+func (h *failureHandler) Failure(err *irma.SessionError) {
+	h.err = err
+}
+
+func (h *failureHandler) RequestPin(remainingAttempts int, callback PinHandler) {
+	callback(true, "54321")
+}
+
+func TestRedactPanics(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer func(dsn string, capture func(*raven.Packet)) {
+		SentryDSN, sentryCapture = dsn, capture
+		client.SetCrashReportingPreference(false)
+	}(SentryDSN, sentryCapture)
+	SentryDSN = "https://public@localhost/1"
+	client.SetCrashReportingPreference(true)
+	var reports []string
+	sentryCapture = func(packet *raven.Packet) {
+		// Include the exception and its stacktrace, which are not part of the packet JSON
+		bts, err := json.Marshal([]interface{}{packet, packet.Interfaces})
+		require.NoError(t, err)
+		reports = append(reports, string(bts))
+	}
+
+	var value string
+	for _, val := range client.attributes[irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")][0].Strings() {
+		if len(val[""]) > len(value) {
+			value = val[""]
+		}
+	}
+	require.True(t, len(value) >= redactMinLength)
+	client.keyshareServers[irma.NewSchemeManagerIdentifier("test")].token.set("secret-token")
+	secrets := []string{value, client.secretkey.Key.String(), "secret-token", "54321"}
+
+	handler := &failureHandler{}
+	session := &session{Action: irma.ActionDisclosing, Handler: handler, client: client}
+	session.startBreadcrumbs()
+	(&pinRecorder{Handler: handler, session: session}).RequestPin(3, func(bool, string) {})
+	func() {
+		defer session.recoverFromPanic()
+		panic(fmt.Sprintf("attribute %s, key %s, token %s, pin %s", secrets[0], secrets[1], secrets[2], secrets[3]))
+	}()
+
+	require.NotNil(t, handler.err)
+	require.Equal(t, irma.ErrorPanic, handler.err.ErrorType)
+	require.Len(t, reports, 1)
+	require.Contains(t, handler.err.Info, redactedValue)
+	for _, report := range []string{handler.err.Info, reports[0]} {
+		for _, secret := range secrets {
+			require.NotContains(t, report, secret)
+		}
+	}
+}
+
+func TestReportFailures(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer func(dsn string, capture func(*raven.Packet), level raven.Severity) {
+		SentryDSN, sentryCapture, SentryLevel, SentryReportFailures = dsn, capture, level, false
+		client.SetCrashReportingPreference(false)
+	}(SentryDSN, sentryCapture, SentryLevel)
+	SentryDSN = "https://public@localhost/1"
+	SentryLevel = raven.WARNING
+	client.SetCrashReportingPreference(true)
+	var reports []string
+	sentryCapture = func(packet *raven.Packet) {
+		bts, err := json.Marshal([]interface{}{packet, packet.Interfaces})
+		require.NoError(t, err)
+		reports = append(reports, string(bts))
+	}
+
+	session := &session{Action: irma.ActionDisclosing, Handler: &failureHandler{}, client: client}
+	session.startBreadcrumbs()
+	fail := func() {
+		session.Handler.Failure(&irma.SessionError{
+			ErrorType:   irma.ErrorTransport,
+			Info:        "https://example.com/irma/session/secret-token",
+			Err:         errors.New("POST https://example.com/irma/session/secret-token failed"),
+			RemoteError: &irma.RemoteError{Message: "remote message"},
+		})
+	}
+
+	// Failures other than panics are only reported if enabled, and only by their type
+	fail()
+	require.Empty(t, reports)
+	SentryReportFailures = true
+	fail()
+	require.Len(t, reports, 1)
+	require.Contains(t, reports[0], string(irma.ErrorTransport))
+	for _, secret := range []string{"example.com", "secret-token", "remote message"} {
+		require.NotContains(t, reports[0], secret)
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	path := client.storage.storagePath
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: actionRemoval, Time: irma.Timestamp(time.Unix(1, 0))}))
+
+	// Enabling encryption encrypts the existing storage
+	require.NoError(t, client.Close())
+	client, err := New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, WithStoragePassphrase("passphrase"))
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	bts, err := ioutil.ReadFile(filepath.Join(path, skFile))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(bts), encryptedFileMagic))
+	index, err := client.storage.loadLogIndex()
+	require.NoError(t, err)
+	require.Len(t, index.Segments, 1)
+	bts, err = ioutil.ReadFile(filepath.Join(path, logSegmentsDir, index.Segments[0].Name))
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), "{")
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: actionRemoval, Time: irma.Timestamp(time.Unix(2, 0))}))
+
+	require.NoError(t, client.Close())
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, WithStoragePassphrase("passphrase"))
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 2)
+
+	require.NoError(t, client.Close())
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.Equal(t, ErrStorageEncrypted, err)
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, WithStoragePassphrase("incorrect"))
+	require.Equal(t, ErrIncorrectStorageKey, err)
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, WithStorageKey(make([]byte, storageKeySize)))
+	require.Equal(t, ErrIncorrectStorageKey, err)
+
+	// Files that are not encrypted are refused
+	require.NoError(t, ioutil.WriteFile(filepath.Join(path, kssFile), addChecksum([]byte("{}")), 0600))
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, WithStoragePassphrase("passphrase"))
+	require.IsType(t, &StorageCorruptionError{}, err)
+
+	// Removing the key file does not turn it into unencrypted storage
+	require.NoError(t, os.Remove(filepath.Join(path, storageKeyFile)))
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.Equal(t, ErrStorageEncrypted, err)
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, WithStoragePassphrase("passphrase"))
+	require.Equal(t, errStorageKeyMissing, err)
+}
+
+func TestCredentialInstanceLimit(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	// All irma-demo credential types are singletons, so make this one a limited non-singleton
+	client.Configuration.CredentialTypes[id].IsSingleton = false
+	client.Configuration.CredentialTypes[id].MaxInstances = 2
+	validity := irma.Timestamp(irma.FloorToEpochBoundary(time.Now().AddDate(1, 0, 0)))
+	issue := func(studentID string) error {
+		request := &irma.IssuanceRequest{
+			BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing, Context: big.NewInt(1), Nonce: big.NewInt(42)},
+			Credentials: []*irma.CredentialRequest{{
+				Validity:         &validity,
+				KeyCounter:       2,
+				CredentialTypeID: id,
+				Attributes: map[string]string{
+					"university":        "Radboud",
+					"studentCardNumber": "31415927",
+					"studentID":         studentID,
+					"level":             "42",
+				},
+			}},
+		}
+		request.Version = &irma.ProtocolVersion{Major: 2, Minor: 6}
+		sigs, builders := issueLocally(t, client, request)
+		_, err := client.ConstructCredentials(sigs, request, builders)
+		return err
+	}
+	studentIDs := func() (ids []string) {
+		for _, attrs := range client.attrs(id) {
+			ids = append(ids, *attrs.UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+		}
+		return
+	}
+
+	for len(client.attrs(id)) < 2 {
+		require.NoError(t, issue(fmt.Sprintf("s%d", len(client.attrs(id)))))
+	}
+	before := studentIDs()
+
+	// The instance chosen by the handler is replaced
+	client.handler.(*TestClientHandler).replace = 0
+	require.NoError(t, issue("s1234567"))
+	require.Equal(t, []string{before[1], "s1234567"}, studentIDs())
+	cred, err := client.credential(id, 1)
+	require.NoError(t, err)
+	require.Equal(t, "s1234567", *cred.AttributeList().UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+
+	// The new instance is discarded if the handler declines
+	client.handler.(*TestClientHandler).replace = -1
+	err = issue("s7654321")
+	require.Error(t, err)
+	require.Equal(t, []string{before[1], "s1234567"}, studentIDs())
+	require.Zero(t, client.QueuedCredentials())
+
+	// The new instance is discarded if the handler does not handle instance limits
+	client.handler = struct{ ClientHandler }{client.handler}
+	err = issue("s7654321")
+	require.Error(t, err)
+	require.Equal(t, []string{before[1], "s1234567"}, studentIDs())
+
+	// Removing an instance moves the cached credentials of the subsequent instances without wiping them
+	sk := new(big.Int).Set(cred.Attributes[0])
+	require.NoError(t, client.RemoveCredentialByHash(client.attrs(id)[0].Hash()))
+	moved, err := client.credential(id, 0)
+	require.NoError(t, err)
+	require.True(t, moved == cred)
+	require.Equal(t, "s1234567", *moved.AttributeList().UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.Zero(t, sk.Cmp(moved.Attributes[0]))
+}
+
+func TestQueryCredentials(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	testQueryCredentials(t, client)
+}
+
+func TestPromptKey(t *testing.T) {
+	key := func(hostname string, validity int64, counter int, studentID string) string {
+		v := irma.Timestamp(time.Unix(validity, 0))
+		request := &irma.IssuanceRequest{
+			BaseRequest: irma.BaseRequest{
+				Type: irma.ActionIssuing, Context: big.NewInt(validity), Nonce: big.NewInt(validity),
+				Version: &irma.ProtocolVersion{Major: 2, Minor: counter + 4},
+			},
+			Credentials: []*irma.CredentialRequest{{
+				Validity:         &v,
+				KeyCounter:       counter,
+				CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+				Attributes:       map[string]string{"studentID": studentID},
+			}},
+		}
+		k, err := (&session{Hostname: hostname, request: request}).promptKey()
+		require.NoError(t, err)
+		return k
+	}
+
+	// Fields set by the server for each session are ignored
+	require.Equal(t, key("example.com", 1, 0, "s1"), key("example.com", 2, 1, "s1"))
+	require.NotEqual(t, key("example.com", 1, 0, "s1"), key("example.com", 1, 0, "s2"))
+	require.NotEqual(t, key("example.com", 1, 0, "s1"), key("example.org", 1, 0, "s1"))
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	path := client.storage.storagePath
+
+	require.NoError(t, client.Close())
+	client, err := New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, WithSQLiteStorage("sqlite3"))
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	exists, err := fs.PathExists(filepath.Join(path, attributesFile))
+	require.NoError(t, err)
+	require.False(t, exists)
+	testQueryCredentials(t, client)
+	counts := client.CredentialCounts()
+
+	// The attributes are loaded from the database on first use
+	require.NoError(t, client.Close())
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, WithSQLiteStorage("sqlite3"))
+	require.NoError(t, err)
+	require.True(t, client.attributesPending)
+	require.Empty(t, client.attributes)
+	require.Equal(t, counts, client.CredentialCounts())
+	_, err = client.QueryCredentials(CredentialQuery{})
+	require.NoError(t, err)
+	require.True(t, client.attributesPending)
+	verifyClientIsUnmarshaled(t, client)
+	require.False(t, client.attributesPending)
+}
+
+func testQueryCredentials(t *testing.T, client *Client) {
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attr := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	value := *client.attrs(id)[0].UntranslatedAttribute(attr)
+
+	all, err := client.QueryCredentials(CredentialQuery{})
+	require.NoError(t, err)
+	require.Len(t, all, len(client.CredentialInfoList()))
+
+	list, err := client.QueryCredentials(CredentialQuery{CredentialType: id})
+	require.NoError(t, err)
+	require.Len(t, list, len(client.attrs(id)))
+	require.Equal(t, "studentCard", list[0].ID)
+
+	list, err = client.QueryCredentials(CredentialQuery{Attribute: attr, Value: value})
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	list, err = client.QueryCredentials(CredentialQuery{Attribute: attr, Value: value + "x"})
+	require.NoError(t, err)
+	require.Empty(t, list)
+
+	_, err = client.QueryCredentials(CredentialQuery{CredentialType: irma.NewCredentialTypeIdentifier("test.test.mijnirma"), Attribute: attr})
+	require.Error(t, err)
+}
+
+func TestStorageLocations(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+	path := filepath.Join(test.FindTestdataFolder(t), "storage", "test")
+	keydir, err := ioutil.TempDir("", "irmaclient-sk")
+	require.NoError(t, err)
+	defer os.RemoveAll(keydir)
+	cachedir, err := ioutil.TempDir("", "irmaclient-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cachedir)
+	logdir := filepath.Join(cachedir, "logs")
+
+	opts := []Option{WithStorageLocation(DataSecretKey, keydir), WithStorageLocation(DataLogs, logdir)}
+	client, err := New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, opts...)
+	require.NoError(t, err)
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: actionRemoval, Time: irma.Timestamp(time.Now())}))
+	sk := client.secretkey.Key
+
+	for file, dir := range map[string]string{skFile: keydir, logIndexFile: logdir, preferencesFile: path} {
+		exists, err := fs.PathExists(filepath.Join(dir, file))
+		require.NoError(t, err)
+		require.True(t, exists, file)
+	}
+	for _, file := range []string{skFile, logSegmentsDir} {
+		exists, err := fs.PathExists(filepath.Join(path, file))
+		require.NoError(t, err)
+		require.False(t, exists, file)
+	}
+	info, err := client.StorageInfo()
+	require.NoError(t, err)
+	require.NotZero(t, info.Logs)
+
+	// Clearing the cache removes the logs, but not the secret key
+	require.NoError(t, client.Close())
+	require.NoError(t, os.RemoveAll(logdir))
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, opts...)
+	require.NoError(t, err)
+	require.Equal(t, sk, client.secretkey.Key)
+	logs, err := client.LoadNewestLogs(10)
+	require.NoError(t, err)
+	require.Empty(t, logs)
+	require.NoError(t, client.Close())
+
+	// Locations may not overlap with the storage path
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t},
+		WithStorageLocation(DataLogs, filepath.Join(path, "logs")))
+	require.Error(t, err)
+}
+
+func TestStorageRelocation(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	path := client.storage.storagePath
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: actionRemoval, Time: irma.Timestamp(time.Now())}))
+	sk := client.secretkey.Key
+	credentials := len(client.CredentialInfoList())
+	require.NotZero(t, credentials)
+	require.NoError(t, client.Close())
+
+	keydir, err := ioutil.TempDir("", "irmaclient-sk")
+	require.NoError(t, err)
+	defer os.RemoveAll(keydir)
+	credentialdir, err := ioutil.TempDir("", "irmaclient-credentials")
+	require.NoError(t, err)
+	defer os.RemoveAll(credentialdir)
+	logdir := filepath.Join(credentialdir, "..", filepath.Base(credentialdir)+"-logs")
+	defer os.RemoveAll(logdir)
+
+	// Configuring locations moves the existing files to them
+	check := func(dirs map[string]string, opts ...Option) {
+		client, err := New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, opts...)
+		require.NoError(t, err)
+		require.Equal(t, sk, client.secretkey.Key)
+		require.Len(t, client.CredentialInfoList(), credentials)
+		logs, err := client.LoadNewestLogs(1)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		require.NoError(t, client.Close())
+		for file, dir := range dirs {
+			for _, d := range []string{path, keydir, credentialdir, logdir} {
+				exists, err := fs.PathExists(filepath.Join(d, file))
+				require.NoError(t, err)
+				require.Equal(t, d == dir, exists, file+" in "+d)
+			}
+		}
+	}
+	opts := []Option{
+		WithStorageLocation(DataSecretKey, keydir),
+		WithStorageLocation(DataCredentials, credentialdir),
+		WithStorageLocation(DataLogs, logdir),
+	}
+	check(map[string]string{skFile: keydir, attributesFile: credentialdir, logIndexFile: logdir}, opts...)
+
+	// As do changed locations, including back to the storage path
+	check(map[string]string{skFile: keydir, attributesFile: path, logIndexFile: path}, opts[0])
+	check(map[string]string{skFile: path, attributesFile: path, logIndexFile: path})
+
+	// Files existing in both locations are not overwritten
+	bts, err := ioutil.ReadFile(filepath.Join(path, skFile))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(keydir, skFile), bts, 0600))
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t}, opts[0])
+	require.Error(t, err)
+	require.NoError(t, os.Remove(filepath.Join(keydir, skFile)))
+
+	// No new secret key is generated for existing credentials
+	require.NoError(t, os.Remove(filepath.Join(path, skFile)))
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.Equal(t, ErrSecretKeyMissing, err)
+	exists, err := fs.PathExists(filepath.Join(path, skFile))
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestInMemoryStorage(t *testing.T) {
+	client, err := New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+	require.Empty(t, client.CredentialInfoList())
+
+	validity := irma.Timestamp(irma.FloorToEpochBoundary(time.Now().AddDate(1, 0, 0)))
+	request := &irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing, Context: big.NewInt(1), Nonce: big.NewInt(42)},
+		Credentials: []*irma.CredentialRequest{{
+			Validity:         &validity,
+			KeyCounter:       2,
+			CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+			Attributes:       map[string]string{"BSN": "299792458"},
+		}},
+	}
+	request.Version = &irma.ProtocolVersion{Major: 2, Minor: 6}
+	sigs, builders := issueLocally(t, client, request)
+	_, err = client.ConstructCredentials(sigs, request, builders)
+	require.NoError(t, err)
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: actionRemoval, Time: irma.Timestamp(time.Unix(1, 0))}))
+
+	// Drop the cache, so that the credential and logs are read back from the in-memory storage
+	client.credentialsCache = map[irma.CredentialTypeIdentifier]map[int]*credential{}
+	client.storage.logIndex = nil
+	client.logs = nil
+	cred, err := client.credential(request.Credentials[0].CredentialTypeID, 0)
+	require.NoError(t, err)
+	require.NotNil(t, cred)
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	attrs, err := client.storage.LoadAttributes()
+	require.NoError(t, err)
+	require.Len(t, attrs[request.Credentials[0].CredentialTypeID], 1)
+	require.NoError(t, client.RemoveCredential(request.Credentials[0].CredentialTypeID, 0))
+
+	// Another in-memory client does not share the storage
+	client, err = New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+	require.Empty(t, client.CredentialInfoList())
+	logs, err = client.Logs()
+	require.NoError(t, err)
+	require.Empty(t, logs)
+}
+
+func TestRepairStorage(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	path := client.storage.storagePath
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	count := len(client.CredentialInfoList())
+
+	// Truncate the signature of a credential
+	sigfile := filepath.Join(path, client.storage.signatureFilename(client.attributes[studentCard][0]))
+	bts, err := ioutil.ReadFile(sigfile)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(sigfile, bts[:len(bts)/2], 0600))
+
+	handler := &TestClientHandler{t: t}
+	require.NoError(t, client.Close())
+	client, err = New(path, "../testdata/irma_configuration", handler)
+	require.NoError(t, err)
+
+	// The signatures are not checked at startup, but the storage is repaired when the signature is used
+	require.Empty(t, handler.damage)
+	require.Len(t, client.CredentialInfoList(), count)
+	_, err = client.credential(studentCard, 0)
+	require.Error(t, err)
+	require.Len(t, handler.damage, 1)
+	require.Equal(t, studentCard.String(), handler.damage[0].Credential.SchemeManagerID+"."+
+		handler.damage[0].Credential.IssuerID+"."+handler.damage[0].Credential.ID)
+	require.Len(t, client.CredentialInfoList(), count-1)
+	require.Empty(t, client.attributes[studentCard])
+	exists, err := fs.PathExists(sigfile + ".corrupt")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// The repaired attributes are stored with a checksum, so that corruption is detected
+	attrsfile := filepath.Join(path, attributesFile)
+	bts, err = ioutil.ReadFile(attrsfile)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(bts), checksumFileMagic))
+	bts[len(bts)-2] ^= 1
+	require.NoError(t, ioutil.WriteFile(attrsfile, bts, 0600))
+
+	handler = &TestClientHandler{t: t}
+	require.NoError(t, client.Close())
+	client, err = New(path, "../testdata/irma_configuration", handler)
+	require.NoError(t, err)
+	require.Len(t, handler.damage, 1)
+	require.Equal(t, attributesFile, handler.damage[0].File)
+	require.Empty(t, client.CredentialInfoList())
+
+	// Nothing to repair anymore
+	damage, err := client.RepairStorage()
+	require.NoError(t, err)
+	require.Empty(t, damage)
+
+	// The StorageRepairHandler is optional
+	client.handler = struct{ ClientHandler }{client.handler}
+	require.NoError(t, ioutil.WriteFile(attrsfile, []byte(checksumFileMagic), 0600))
+	require.NoError(t, client.loadAttributeStorage())
+	require.Empty(t, client.CredentialInfoList())
+}
+
+func TestCredentialUsage(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	require.Len(t, client.UnusedCredentials(), len(client.CredentialInfoList()))
+
+	// Disclosing two attributes of a credential counts as one disclosure of its credential type
+	require.NoError(t, client.recordUsage(&irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{
+		{Type: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		{Type: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")},
+	}}))
+	for _, info := range client.CredentialInfoList() {
+		if info.Identifier() == studentCard {
+			require.Equal(t, 1, info.Usage.Disclosures)
+			require.False(t, time.Time(info.Usage.LastDisclosed).IsZero())
+		} else {
+			require.Zero(t, info.Usage.Disclosures)
+		}
+	}
+	for _, info := range client.UnusedCredentials() {
+		require.NotEqual(t, studentCard, info.Identifier())
+	}
+
+	// Exporting requires opting in
+	_, err := client.ExportUsage()
+	require.Equal(t, ErrUsageExportDisabled, err)
+	client.SetUsageExportPreference(true)
+
+	// The usage is persisted
+	require.NoError(t, client.Close())
+	client, err = New(client.storage.storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	report, err := client.ExportUsage()
+	require.NoError(t, err)
+	require.Equal(t, map[irma.CredentialTypeIdentifier]int{studentCard: 1}, report.Disclosures)
+	require.NotContains(t, report.Unused, studentCard)
+	require.NotEmpty(t, report.Unused)
+}
+
+func TestStorageMigrations(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	path := "../testdata/storage/test"
+	require.NoError(t, fs.CopyDirectory("../testdata/teststorage", path))
+
+	// The test storage predates the schema file and has applied the first 5 migrations
+	pending, err := PendingMigrations(path)
+	require.NoError(t, err)
+	require.Len(t, pending, currentSchemaVersion()-5)
+	require.Equal(t, 6, pending[0].Version)
+
+	// A newly registered migration is applied once
+	applied := 0
+	migrations = append(migrations, Migration{Version: len(migrations) + 1, Description: "test", Migrate: func(*Client) error {
+		applied++
+		return nil
+	}})
+	defer func() { migrations = migrations[:len(migrations)-1] }()
+	client, err := New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	require.Equal(t, 1, applied)
+	schema, err := client.storage.loadSchema()
+	require.NoError(t, err)
+	require.Equal(t, currentSchemaVersion(), schema.Version)
+	require.Len(t, schema.History, currentSchemaVersion())
+	pending, err = PendingMigrations(path)
+	require.NoError(t, err)
+	require.Empty(t, pending)
+	require.NoError(t, client.Close())
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Equal(t, 1, applied)
+
+	// Storage with a newer schema version is refused
+	migrations = migrations[:len(migrations)-1]
+	_, err = PendingMigrations(path)
+	require.IsType(t, &StorageTooNewError{}, err)
+	require.NoError(t, client.Close())
+	_, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.IsType(t, &StorageTooNewError{}, err)
+	require.Equal(t, currentSchemaVersion()+1, err.(*StorageTooNewError).Version)
+	migrations = append(migrations, Migration{}) // restored by the deferred function
+
+	// Failed migrations recorded in the legacy updatesFile are not counted as applied
+	require.Equal(t, 2, legacySchemaVersion([]migrationResult{
+		{Number: 0, Success: true},
+		{Number: 1, Success: true},
+		{Number: 2, Success: false},
+	}))
+	require.Equal(t, 3, legacySchemaVersion([]migrationResult{
+		{Number: 0, Success: true},
+		{Number: 1, Success: false},
+		{Number: 1, Success: true},
+		{Number: 2, Success: true},
+	}))
+
+	// New storage needs no migrations
+	client, err = New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+	schema, err = client.storage.loadSchema()
+	require.NoError(t, err)
+	require.Equal(t, currentSchemaVersion(), schema.Version)
+	require.Empty(t, schema.History)
+}
+
+func TestWipeRemovedCredential(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attrs := client.attributes[studentCard][0]
+	cred, err := client.credential(studentCard, 0)
+	require.NoError(t, err)
+	sk := new(big.Int).Set(client.secretkey.Key)
+
+	// Keep the signature file open to inspect its contents after it is unlinked
+	sigfile := filepath.Join(client.storage.storagePath, client.storage.signatureFilename(attrs))
+	original, err := ioutil.ReadFile(sigfile)
+	require.NoError(t, err)
+	f, err := os.Open(sigfile)
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, client.RemoveCredential(studentCard, 0))
+
+	exists, err := fs.PathExists(sigfile)
+	require.NoError(t, err)
+	require.False(t, exists)
+	contents, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Len(t, contents, len(original))
+	require.NotEqual(t, original, contents)
+
+	for _, i := range attrs.Ints {
+		require.Zero(t, i.Sign())
+	}
+	require.Zero(t, cred.Signature.A.Sign())
+	require.Zero(t, cred.Signature.V.Sign())
+
+	// The secret key, shared by all credentials, is left intact
+	require.Zero(t, sk.Cmp(client.secretkey.Key))
+	for id := range client.attributes {
+		_, err = client.credential(id, 0)
+		require.NoError(t, err)
+	}
+}
+
+func TestWipeSecrets(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	ok, _, _, err := client.SetWalletPin("", "12345")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Replacing a keyshare token wipes the old one
+	kss := client.keyshareServers[irma.NewSchemeManagerIdentifier("test")]
+	kss.token.set("token")
+	old := kss.token
+	kss.token.set("other token")
+	require.Equal(t, make(secret, len("token")), old)
+
+	// Locking the wallet wipes the secret key and the keyshare tokens
+	sk, token := client.secretkey, kss.token
+	client.LockWallet()
+	require.Zero(t, sk.Key.Sign())
+	require.Equal(t, make(secret, len("other token")), token)
+
+	ok, _, _, err = client.UnlockWallet("12345")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NotZero(t, client.secretkey.Key.Sign())
+	verifyClientIsUnmarshaled(t, client)
+}
+
+func TestMinimalDisclosure(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	attr := func(id, hash string) *irma.AttributeIdentifier {
+		return &irma.AttributeIdentifier{Type: irma.NewAttributeTypeIdentifier(id), CredentialHash: hash}
+	}
+	university := attr("irma-demo.RU.studentCard.university", "a")
+	studentID := attr("irma-demo.RU.studentCard.studentID", "a")
+	otherUniversity := attr("irma-demo.RU.studentCard.university", "b")
+	bsn := attr("irma-demo.MijnOverheid.root.BSN", "c")
+	root := attr("irma-demo.MijnOverheid.root", "c")
+
+	// Prefer attributes from credentials of which other attributes are disclosed
+	choice := client.MinimalDisclosure([][]*irma.AttributeIdentifier{{otherUniversity, university}, {studentID}})
+	require.Equal(t, []*irma.AttributeIdentifier{university, studentID}, choice.Attributes)
+
+	// Prefer disclosing the presence of a credential over disclosing an attribute value
+	choice = client.MinimalDisclosure([][]*irma.AttributeIdentifier{{university, root}, {otherUniversity}})
+	require.Equal(t, []*irma.AttributeIdentifier{root, otherUniversity}, choice.Attributes)
+
+	// Otherwise prefer the first candidate
+	choice = client.MinimalDisclosure([][]*irma.AttributeIdentifier{{otherUniversity, university}})
+	require.Equal(t, []*irma.AttributeIdentifier{otherUniversity}, choice.Attributes)
+
+	// Avoid sensitive attributes, even if this discloses more values
+	choice = client.MinimalDisclosure([][]*irma.AttributeIdentifier{{bsn, studentID}, {bsn, otherUniversity}})
+	require.Equal(t, []*irma.AttributeIdentifier{bsn, bsn}, choice.Attributes)
+	bsntype := client.Configuration.CredentialTypes[root.Type.CredentialTypeIdentifier()].AttributeType(bsn.Type)
+	bsntype.Sensitive = true
+	defer func() { bsntype.Sensitive = false }()
+	choice = client.MinimalDisclosure([][]*irma.AttributeIdentifier{{bsn, studentID}, {bsn, otherUniversity}})
+	require.Equal(t, []*irma.AttributeIdentifier{studentID, otherUniversity}, choice.Attributes)
+
+	require.Nil(t, client.MinimalDisclosure([][]*irma.AttributeIdentifier{{university}, {}}))
+}
+
+func TestClientFailure(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	// Delete the signature of a credential that is not yet loaded
+	attrs := client.attributes[studentCard][0]
+	require.NoError(t, os.Remove(filepath.Join(client.storage.storagePath, client.storage.signatureFilename(attrs))))
+	_, err := client.credential(studentCard, 0)
+	require.Error(t, err)
+
+	failure := clientFailure(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: goerrors.WrapPrefix(err, "proof", 0)})
+	require.Equal(t, &irma.ClientFailure{Code: irma.FailureSignatureMissing}, failure)
+
+	// Other failures are reported by their type only, without the error message
+	failure = clientFailure(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: errors.New("0612345678")})
+	require.Equal(t, &irma.ClientFailure{Code: irma.FailureCrypto}, failure)
+	failure = clientFailure(&irma.SessionError{ErrorType: irma.ErrorUnknownSchemeManager, Info: "test"})
+	require.Equal(t, &irma.ClientFailure{Code: irma.FailureUnknownScheme, Identifier: "test"}, failure)
+
+	// Identifiers are only valid for failures concerning a scheme of the session request
+	schemes := map[irma.SchemeManagerIdentifier]struct{}{irma.NewSchemeManagerIdentifier("test"): {}}
+	require.NoError(t, failure.Validate(schemes))
+	require.Error(t, failure.Validate(nil))
+	require.Error(t, (&irma.ClientFailure{Code: irma.FailureSignatureMissing, Identifier: "test"}).Validate(schemes))
+	require.Error(t, (&irma.ClientFailure{Code: "irma-demo.RU.studentCard"}).Validate(schemes))
+}
+
+func TestCompactStorage(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	sigs := filepath.Join(client.storage.storagePath, signaturesDir)
+
+	result, err := client.CompactStorage()
+	require.NoError(t, err)
+	require.Equal(t, &CompactionResult{}, result)
+
+	// Refused while a session is running
+	client.startSession()
+	_, err = client.CompactStorage()
+	require.Equal(t, ErrSessionsRunning, err)
+	client.finishSession()
+
+	orphan := filepath.Join(sigs, "orphan")
+	require.NoError(t, ioutil.WriteFile(orphan, make([]byte, 100), 0600))
+	require.NoError(t, ioutil.WriteFile(orphan+".corrupt", make([]byte, 50), 0600))
+	result, err = client.CompactStorage()
+	require.NoError(t, err)
+	require.Equal(t, &CompactionResult{Signatures: 2, Reclaimed: 150}, result)
+	exists, err := fs.PathExists(orphan)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// The signatures of existing credentials are kept
+	require.NoError(t, client.Close())
+	client, err = New(client.storage.storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+}
+
+func TestSignedWalletHealth(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	pk, err := client.HealthReportKey()
+	require.NoError(t, err)
+	token, err := client.SignedWalletHealth("nonce", "6.0.0")
+	require.NoError(t, err)
+	health, err := irma.ParseWalletHealth(token, "nonce", pk)
+	require.NoError(t, err)
+	require.True(t, health.StorageIntact)
+	require.Equal(t, currentSchemaVersion(), health.StorageVersion)
+	require.Equal(t, "6.0.0", health.AppVersion)
+	require.Equal(t, irma.SchemeManagerStatusValid, health.Schemes[irma.NewSchemeManagerIdentifier("irma-demo")].Status)
+
+	_, err = irma.ParseWalletHealth(token, "other nonce", pk)
+	require.Error(t, err)
+
+	// The health report key is kept across restarts
+	require.NoError(t, client.Close())
+	client, err = New(client.storage.storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	samepk, err := client.HealthReportKey()
+	require.NoError(t, err)
+	require.Equal(t, pk, samepk)
+
+	// Damage to the storage shows in the report
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	require.NoError(t, os.Remove(filepath.Join(client.storage.storagePath, client.storage.signatureFilename(client.attributes[studentCard][0]))))
+	health, err = client.WalletHealth("")
+	require.NoError(t, err)
+	require.False(t, health.StorageIntact)
+	require.Equal(t, 1, health.StorageDamage)
+}
+
+func TestStorageLock(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	path := client.storage.storagePath
+
+	_, err := New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.Equal(t, ErrStorageLocked, err)
+
+	require.NoError(t, client.Close())
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	require.NoError(t, client.Close())
+}
+
+func TestBackup(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	path := client.storage.storagePath
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: actionRemoval, Time: irma.Timestamp(time.Unix(1, 0))}))
+	sk := client.secretkey.Key
+	creds := len(client.CredentialInfoList())
+
+	backup, err := client.ExportBackup("passphrase")
+	require.NoError(t, err)
+	require.NotContains(t, string(backup), "irma-demo")
+	require.Equal(t, ErrStorageLocked, RestoreBackup(path, "passphrase", backup))
+	require.NoError(t, client.Close())
+	require.Equal(t, ErrStorageNotEmpty, RestoreBackup(path, "passphrase", backup))
+
+	test.CreateTestStorage(t)
+	require.Equal(t, ErrIncorrectBackupPassphrase, RestoreBackup(path, "incorrect", backup))
+	backup[len(backup)-1] ^= 1
+	require.Equal(t, ErrIncorrectBackupPassphrase, RestoreBackup(path, "passphrase", backup))
+	backup[len(backup)-1] ^= 1
+	require.NoError(t, RestoreBackup(path, "passphrase", backup))
+
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	require.Equal(t, sk, client.secretkey.Key)
+	require.Len(t, client.CredentialInfoList(), creds)
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	require.NoError(t, client.Close())
+}
+
+func TestCredentialProvenance(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	studentCard := client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))[0]
+	mijnirma := client.attrs(irma.NewCredentialTypeIdentifier("test.test.mijnirma"))[0]
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	choice := &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{
+		{Type: studentID, CredentialHash: studentCard.Hash()},
+		{Type: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level"), CredentialHash: studentCard.Hash()},
+	}}
+
+	// Pretend that the mijnirma credential was issued after disclosing the student card
+	entry := &LogEntry{Type: irma.ActionIssuing, Time: irma.Timestamp(time.Unix(1, 0))}
+	results := []*irma.CredentialIssuanceResult{
+		{CredentialTypeID: mijnirma.CredentialType().Identifier(), Hash: mijnirma.Hash()},
+		{CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"), Error: "failed"},
+	}
+	require.NoError(t, client.recordProvenance(entry, results, choice))
+	require.Equal(t, []string{mijnirma.Hash()}, entry.Issued)
+	require.Len(t, entry.Provenance.Sources, 1)
+	require.Equal(t, studentCard.Hash(), entry.Provenance.Sources[0].Hash)
+
+	derived := client.DerivedCredentials(studentCard.Hash())
+	require.Len(t, derived, 1)
+	require.Equal(t, mijnirma.Hash(), derived[0].Hash)
+	require.Equal(t, entry.Provenance, derived[0].Provenance)
+	for _, info := range client.CredentialInfoList() {
+		if info.Hash != mijnirma.Hash() {
+			require.Nil(t, info.Provenance)
+		}
+	}
+
+	// The provenance is stored, and forgotten when the derived credential is removed
+	require.NoError(t, client.Close())
+	client, err := New(client.storage.storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Len(t, client.DerivedCredentials(studentCard.Hash()), 1)
+	require.NoError(t, client.RemoveCredentialByHash(mijnirma.Hash()))
+	require.Empty(t, client.provenance)
+	require.NoError(t, client.Close())
+}
+
+// memoryBackupProvider is a BackupProvider that keeps the backups in memory.
+type memoryBackupProvider map[string][]byte
+
+func (p memoryBackupProvider) Upload(name string, backup []byte) error {
+	p[name] = backup
+	return nil
+}
+
+func (p memoryBackupProvider) Download(name string) ([]byte, error) {
+	return p[name], nil
+}
+
+func (p memoryBackupProvider) List() ([]string, error) {
+	var names []string
+	for name := range p {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func TestBackupProvider(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	path := client.storage.storagePath
+	clock := setTestClock(client)
+	provider := memoryBackupProvider{}
+
+	// Without interval, nothing is backed up automatically
+	client.SetBackupProvider(provider, "passphrase")
+	client.backups.pending.Wait()
+	require.Empty(t, provider)
+	require.NoError(t, client.BackupNow())
+	require.Len(t, provider, 1)
+	status, err := client.BackupStatus()
+	require.NoError(t, err)
+	require.NotNil(t, status.LastBackup)
+
+	client.SetBackupIntervalPreference(14)
+	client.backups.pending.Wait()
+	done, err := client.backupIfDue()
+	require.NoError(t, err)
+	require.False(t, done)
+	clock.advance(1)
+	done, err = client.backupIfDue()
+	require.NoError(t, err)
+	require.False(t, done)
+	clock.advance(1)
+	done, err = client.backupIfDue()
+	require.NoError(t, err)
+	require.True(t, done)
+	require.Len(t, provider, 2)
+
+	// No backups are exported while sessions are running
+	client.startSession()
+	require.Equal(t, ErrSessionsRunning, client.BackupNow())
+	client.finishSession()
+
+	// The newest backup is restored
+	require.NoError(t, client.RemoveAllCredentials())
+	require.NoError(t, client.BackupNow())
+	require.Len(t, provider, 2) // overwritten, as the clock did not advance
+	require.NoError(t, client.Close())
+	test.CreateTestStorage(t)
+	require.NoError(t, RestoreFromBackupProvider(path, "passphrase", provider))
+	client, err = New(path, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Empty(t, client.CredentialInfoList())
+	require.NoError(t, client.Close())
+}
+
+// blockingBackupProvider is a memoryBackupProvider of which uploads wait for the channel.
+type blockingBackupProvider struct {
+	memoryBackupProvider
+	c chan struct{}
+}
+
+func (p blockingBackupProvider) Upload(name string, backup []byte) error {
+	<-p.c
+	return p.memoryBackupProvider.Upload(name, backup)
+}
+
+func TestBackupProviderBackground(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	provider := blockingBackupProvider{memoryBackupProvider{}, make(chan struct{})}
+
+	// The due backup is uploaded in the background
+	client.Preferences.BackupInterval = 14
+	client.SetBackupProvider(provider, "passphrase")
+	provider.c <- struct{}{}
+	client.backups.pending.Wait()
+	require.Len(t, provider.memoryBackupProvider, 1)
+	client.backups.Lock()
+	require.NotNil(t, client.backups.timer)
+	client.backups.Unlock()
+
+	// Once closed, no further backups are scheduled
+	require.NoError(t, client.Close())
+	client.scheduleBackup()
+	client.backups.Lock()
+	require.Nil(t, client.backups.timer)
+	client.backups.Unlock()
+}
+
+// syncPeer is a SyncChannel to another client in the same process.
+type syncPeer struct {
+	client *Client
+}
+
+func (peer syncPeer) Exchange(state []byte) ([]byte, error) {
+	own, err := peer.client.syncState()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = peer.client.mergeSyncState(state); err != nil {
+		return nil, err
+	}
+	return own, nil
+}
+
+func syncHashes(client *Client) []string {
+	var hashes []string
+	for _, info := range client.CredentialInfoList() {
+		hashes = append(hashes, info.Hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func TestSync(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	clock := setTestClock(client)
+	other, err := New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+	other.secretkey = client.secretkey
+	require.NoError(t, other.storage.StoreSecretKey(other.secretkey))
+
+	// Both devices obtain a new instance of a singleton credential; the newest one wins
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	fabricateCredential(t, client, id, expiryStudentCard, clock.epochs(-2), clock.epochs(10))
+	newest := fabricateCredential(t, other, id, expiryStudentCard, clock.epochs(-1), clock.epochs(10))
+	count := len(client.CredentialInfoList())
+
+	report, err := client.Sync(syncPeer{other})
+	require.NoError(t, err)
+	require.Len(t, report.Credentials, 1)
+	require.Equal(t, ImportStatusImported, report.Credentials[0].Status)
+	require.Equal(t, id, report.Credentials[0].CredentialType)
+	require.Len(t, report.Removed, 1)
+	require.Equal(t, syncHashes(client), syncHashes(other))
+	require.Len(t, client.CredentialInfoList(), count)
+	require.Equal(t, newest.Hash(), client.attrs(id)[0].Hash())
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	otherLogs, err := other.Logs()
+	require.NoError(t, err)
+	require.Equal(t, len(logs), len(otherLogs))
+
+	// Synchronizing again changes nothing
+	report, err = other.Sync(syncPeer{client})
+	require.NoError(t, err)
+	require.Empty(t, report.Credentials)
+	require.Empty(t, report.Removed)
+	require.Zero(t, report.Logs)
+
+	// Removals are propagated, along with their log entries
+	hash := other.CredentialInfoList()[0].Hash
+	require.NoError(t, other.RemoveCredentialByHash(hash))
+	report, err = client.Sync(syncPeer{other})
+	require.NoError(t, err)
+	require.Equal(t, []string{hash}, report.Removed)
+	require.Equal(t, 1, report.Logs)
+	require.Len(t, client.CredentialInfoList(), count-1)
+	require.Equal(t, syncHashes(client), syncHashes(other))
+
+	// The removal is remembered after reloading
+	require.NoError(t, client.Close())
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Contains(t, client.removals, hash)
+	require.NoError(t, client.Close())
+}
+
+func TestSyncAuthentication(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	clock := setTestClock(client)
+	other, err := New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+
+	// Sync states of devices holding another secret key are rejected
+	state, err := client.syncState()
+	require.NoError(t, err)
+	_, err = other.mergeSyncState(state)
+	require.Equal(t, ErrSyncStateUnauthenticated, err)
+
+	// As are tampered and unencrypted sync states
+	tampered := append([]byte{}, state...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = client.mergeSyncState(tampered)
+	require.Equal(t, ErrSyncStateUnauthenticated, err)
+	_, err = client.mergeSyncState([]byte(`{"version":2,"removals":{}}`))
+	require.Equal(t, ErrSyncStateUnauthenticated, err)
+	_, err = client.mergeSyncState(state)
+	require.NoError(t, err)
+
+	// Removals are forgotten after syncRemovalLifetime
+	old := irma.Timestamp(clock.now.Add(-syncRemovalLifetime - time.Hour))
+	client.removals["old"] = &old
+	require.NoError(t, client.recordRemoval("new"))
+	require.NotContains(t, client.removals, "old")
+	require.Contains(t, client.removals, "new")
+	require.NoError(t, client.Close())
+}
+
+func TestDeprecationWarning(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	var log bytes.Buffer
+	out := irma.Logger.Out
+	irma.Logger.SetOutput(&log)
+	defer irma.Logger.SetOutput(out)
+	deprecationWarnings.Delete("Client.Attributes")
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	require.NotNil(t, client.Attributes(id, 0))
+	require.Contains(t, log.String(), "Client.Attributes is deprecated")
+
+	// The warning is logged once
+	log.Reset()
+	require.NotNil(t, client.Attributes(id, 0))
+	require.Empty(t, log.String())
+}
+
+// xorKeystore is an Unwrapper that wraps using XOR, counting the unwraps.
+type xorKeystore struct {
+	unwraps int
+}
+
+func (ks *xorKeystore) Wrap(secret []byte) ([]byte, error) {
+	wrapped := make([]byte, len(secret))
+	for i, b := range secret {
+		wrapped[i] = b ^ 0x5a
+	}
+	return wrapped, nil
+}
+
+func (ks *xorKeystore) Unwrap(wrapped []byte) ([]byte, error) {
+	ks.unwraps++
+	return ks.Wrap(wrapped)
+}
+
+func TestKeystore(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	key := new(big.Int).Set(client.secretkey.Key)
+	require.NoError(t, client.Close())
+
+	// Opening the client with a keystore wraps the existing secret key
+	ks := &xorKeystore{}
+	client, err := New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithKeystore(ks))
+	require.NoError(t, err)
+	require.Nil(t, client.secretkey.Key)
+	stored, err := client.storage.LoadSecretKey()
+	require.NoError(t, err)
+	require.Nil(t, stored.Key)
+	require.NotEmpty(t, stored.Wrapped)
+
+	// The secret key is unwrapped when credentials are used, and dropped once no sessions use it
+	require.Zero(t, ks.unwraps)
+	client.startSession()
+	client.startSession()
+	verifyClientIsUnmarshaled(t, client)
+	require.NotZero(t, ks.unwraps)
+	cred, err := client.credential(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), 0)
+	require.NoError(t, err)
+	require.Zero(t, key.Cmp(cred.Attributes[0]))
+	client.finishSession()
+	require.NotEmpty(t, client.credentialsCache)
+	require.Zero(t, key.Cmp(cred.Attributes[0]))
+	client.finishSession()
+	require.Empty(t, client.credentialsCache)
+	require.Zero(t, cred.Attributes[0].Sign())
+
+	// Backups contain the unwrapped secret key
+	backup, err := client.ExportBackup("passphrase")
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	test.CreateTestStorage(t)
+	require.NoError(t, RestoreBackup("../testdata/storage/test", "passphrase", backup))
+
+	// The wrapped secret key cannot be used without the keystore
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithKeystore(ks))
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	_, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.Equal(t, ErrKeystoreRequired, err)
+}
+
+func TestLazyAttributeLoading(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	expected := client.CredentialInfoList()
+	counts := client.CredentialCounts()
+	require.NoError(t, client.Close())
+
+	// Without an index, the attributes are loaded immediately and the index is written
+	client, err := New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithLazyAttributeLoading())
+	require.NoError(t, err)
+	require.False(t, client.attributesPending)
+	require.NoError(t, client.Close())
+
+	// With the index, only the index is read until the attributes are used
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithLazyAttributeLoading())
+	require.NoError(t, err)
+	require.True(t, client.attributesPending)
+	require.Empty(t, client.attributes)
+	require.Equal(t, counts, client.CredentialCounts())
+	require.True(t, client.attributesPending)
+
+	require.Equal(t, expected, client.CredentialInfoList())
+	require.False(t, client.attributesPending)
+	require.Equal(t, counts, client.CredentialCounts())
+
+	// Changes to the credentials are reflected in the index
+	require.NoError(t, client.RemoveCredentialByHash(expected[0].Hash))
+	require.NoError(t, client.Close())
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithLazyAttributeLoading())
+	require.NoError(t, err)
+
+	// Concurrent first uses all wait until the attributes are loaded
+	lengths := make([]int, 4)
+	var wg sync.WaitGroup
+	for i := range lengths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lengths[i] = len(client.CredentialInfoList())
+		}(i)
+	}
+	wg.Wait()
+	for _, length := range lengths {
+		require.Equal(t, len(expected)-1, length)
+	}
+	_, err = client.Stats()
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	// Pruning the logs when the client is created does not load the attributes
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithLazyAttributeLoading())
+	require.NoError(t, err)
+	require.NoError(t, client.SetLogRetentionPolicy(LogRetentionPolicy{MaxCount: 1}))
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: ActionRemoval, Time: irma.Timestamp(time.Now())}))
+	require.NoError(t, client.Close())
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithLazyAttributeLoading())
+	require.NoError(t, err)
+	require.True(t, client.attributesPending)
+	require.NoError(t, client.Close())
+}
+
+func TestStartupTimings(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	timings := client.StartupTimings()
+	require.NotZero(t, timings.Configuration)
+	require.NotZero(t, timings.Storage)
+	require.NotZero(t, timings.Attributes)
+	require.NotZero(t, timings.SecretKey)
+	require.True(t, timings.Total >= timings.Configuration)
+	require.True(t, timings.Total >= timings.Attributes)
+	require.True(t, timings.Storage >= timings.Preferences)
+	verifyClientIsUnmarshaled(t, client)
+}
+
+func TestStorageJournal(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Nothing is recorded unless enabled
+	hashes, values := []string{}, []string{}
+	for _, info := range client.CredentialInfoList() {
+		hashes = append(hashes, info.Hash)
+		for _, value := range info.Attributes {
+			values = append(values, value["en"])
+		}
+	}
+	require.NoError(t, client.RemoveCredentialByHash(hashes[0]))
+	entries, err := client.StorageJournal()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	client.SetStorageJournalPreference(true)
+	require.NoError(t, client.RemoveCredentialByHash(hashes[1]))
+	entries, err = client.StorageJournal()
+	require.NoError(t, err)
+	require.True(t, len(entries) > 1)
+	require.Equal(t, "(*Client).SetStorageJournalPreference", entries[0].Operation)
+	require.Equal(t, preferencesFile, entries[0].File)
+	files := map[string]string{}
+	for _, entry := range entries[1:] {
+		require.Equal(t, "(*Client).RemoveCredentialByHash", entry.Operation)
+		files[entry.File] = entry.Action
+	}
+	require.Equal(t, JournalWrite, files[attributesFile])
+	require.Equal(t, JournalRemove, files[signaturesDir+"/"+hashes[1]])
+	require.Equal(t, JournalAppend, files[logSegmentsDir+"/"+fmt.Sprintf(logSegmentNameF, 0)])
+
+	// The journal survives restarts, and contains no attribute values
+	require.NoError(t, client.Close())
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	bts, err := ioutil.ReadFile(filepath.Join("../testdata/storage/test", journalFile))
+	require.NoError(t, err)
+	for _, value := range values {
+		require.NotContains(t, string(bts), value)
+	}
+	entries, err = client.StorageJournal()
+	require.NoError(t, err)
+	require.Len(t, entries, len(files)+2)
+	require.Equal(t, "New", entries[len(entries)-1].Operation)
+
+	// The journal is rotated, keeping at most journalMaxFiles files of journalMaxSize bytes
+	for i := 0; i < 8*journalMaxSize/100; i++ {
+		client.storage.record(JournalWrite, fmt.Sprintf("test%d", i), nil)
+	}
+	var size int64
+	for i := 1; i < journalMaxFiles; i++ {
+		info, err := os.Stat(filepath.Join("../testdata/storage/test", fmt.Sprintf(journalRotatedF, i)))
+		require.NoError(t, err)
+		require.True(t, info.Size() <= journalMaxSize)
+		size += info.Size()
+	}
+	_, err = os.Stat(filepath.Join("../testdata/storage/test", fmt.Sprintf(journalRotatedF, journalMaxFiles)))
+	require.True(t, os.IsNotExist(err))
+	entries, err = client.StorageJournal()
+	require.NoError(t, err)
+	require.True(t, len(entries) < 8*journalMaxSize/100)
+	require.Equal(t, fmt.Sprintf("test%d", 8*journalMaxSize/100-1), entries[len(entries)-1].File)
+	require.True(t, size > (journalMaxFiles-2)*journalMaxSize)
+
+	require.NoError(t, client.ClearStorageJournal())
+	entries, err = client.StorageJournal()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.NoError(t, client.Close())
+}
+
+func TestGuardianship(t *testing.T) {
+	dependent := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	guardian, err := New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	until := irma.Timestamp(time.Now().Add(time.Hour))
+	_, _, err = dependent.ProposeGuardianship("parent", nil, until)
+	require.Error(t, err)
+	_, _, err = dependent.ProposeGuardianship("parent", []irma.AttributeTypeIdentifier{id}, irma.Timestamp(time.Now()))
+	require.Error(t, err)
+
+	// Both parties consent
+	g, proposal, err := dependent.ProposeGuardianship("parent", []irma.AttributeTypeIdentifier{id}, until)
+	require.NoError(t, err)
+	require.False(t, g.Active())
+	accepted, acceptance, err := guardian.AcceptGuardianship(proposal, "child")
+	require.NoError(t, err)
+	require.True(t, accepted.Active())
+	require.Equal(t, GuardianshipGuardian, accepted.Role)
+	g, err = dependent.ConfirmGuardianship(acceptance)
+	require.NoError(t, err)
+	require.True(t, g.Active())
+	_, err = dependent.ConfirmGuardianship(acceptance)
+	require.Error(t, err)
+
+	// The guardian discloses the attributes covered by the guardianship through the dependent, which
+	// retrieves the session request from the server
+	attr := id
+	var posted *irma.Disclosure
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res interface{}
+		if r.Method == http.MethodPost {
+			posted = &irma.Disclosure{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(posted))
+			res = "VALID"
+		} else {
+			res = &irma.DisclosureRequest{
+				BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing, Context: big.NewInt(1), Nonce: big.NewInt(42), Version: irma.NewVersion(2, 5)},
+				Content:     irma.AttributeDisjunctionList{{Label: "foo", Attributes: []irma.AttributeTypeIdentifier{attr}}},
+			}
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(res))
+	}))
+	defer srv.Close()
+	qr := &irma.Qr{URL: srv.URL + "/irma/session/token", Type: irma.ActionDisclosing}
+	var forwarded []byte
+	channel := guardianChannel(func(request []byte) ([]byte, error) {
+		forwarded = request
+		return dependent.DiscloseForGuardian(request)
+	})
+
+	entry, err := guardian.GuardianDisclose(g.ID, qr, channel)
+	require.NoError(t, err)
+	require.NotNil(t, posted)
+	require.Equal(t, g.ID, entry.Guardianship)
+	logs, err := dependent.LoadNewestLogs(1)
+	require.NoError(t, err)
+	entry = logs[0]
+	require.Equal(t, g.ID, entry.Guardianship)
+	require.Equal(t, "127.0.0.1", entry.Hostname)
+	_, status, err := entry.Verify(guardian.Configuration)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Equal(t, 1, dependent.Guardianships()[0].Uses)
+	require.Empty(t, guardian.Guardianships()[0].PrivateKey)
+
+	// Requests not signed by the guardian are refused, even if they contain the guardianship ID
+	signed := &signedGuardianRequest{}
+	require.NoError(t, json.Unmarshal(forwarded, signed))
+	signed.Signature[len(signed.Signature)-1] ^= 1
+	forged, err := json.Marshal(signed)
+	require.NoError(t, err)
+	_, err = dependent.DiscloseForGuardian(forged)
+	require.Error(t, err)
+
+	// Other attributes are refused, as are disclosures after revocation
+	attr = irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	_, err = guardian.GuardianDisclose(g.ID, qr, channel)
+	require.Error(t, err)
+	attr = id
+	stored, err := dependent.storage.LoadGuardianships()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	require.NoError(t, dependent.RevokeGuardianship(g.ID))
+	_, err = guardian.GuardianDisclose(g.ID, qr, channel)
+	require.Error(t, err)
+	require.Empty(t, dependent.Guardianships())
+	require.NoError(t, guardian.Close())
+}
+
+type guardianChannel func(request []byte) ([]byte, error)
+
+func (c guardianChannel) Disclose(request []byte) ([]byte, error) {
+	return c(request)
+}
+
+func TestQueryLogs(t *testing.T) {
+	client, err := New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	root := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	for i := 1; i <= 3*logSegmentSize; i++ {
+		id := studentCard
+		if i%2 == 0 {
+			id = root
+		}
+		require.NoError(t, client.addLogEntry(&LogEntry{
+			Type:    ActionRemoval,
+			Time:    irma.Timestamp(time.Unix(int64(i), 0)),
+			Removed: map[irma.CredentialTypeIdentifier][]irma.TranslatedString{id: {}},
+		}))
+	}
+
+	logs, err := client.QueryLogs(LogQuery{})
+	require.NoError(t, err)
+	require.Len(t, logs, 3*logSegmentSize)
+	logs, err = client.QueryLogs(LogQuery{Type: irma.ActionDisclosing})
+	require.NoError(t, err)
+	require.Empty(t, logs)
+
+	from, to := irma.Timestamp(time.Unix(11, 0)), irma.Timestamp(time.Unix(21, 0))
+	logs, err = client.QueryLogs(LogQuery{CredentialType: root, From: &from, To: &to})
+	require.NoError(t, err)
+	require.Len(t, logs, 5)
+	require.Equal(t, int64(20), time.Time(logs[0].Time).Unix())
+	require.Equal(t, int64(12), time.Time(logs[4].Time).Unix())
+
+	logs, err = client.QueryLogs(LogQuery{CredentialType: studentCard, Max: 2})
+	require.NoError(t, err)
+	require.Len(t, logs, 2)
+	require.Equal(t, int64(3*logSegmentSize-1), time.Time(logs[0].Time).Unix())
+	require.NoError(t, client.Close())
+}
+
+func TestQueryLogsStorage(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	for i := 1; i <= logSegmentSize+10; i++ {
+		require.NoError(t, client.addLogEntry(&LogEntry{Type: ActionRemoval, Time: irma.Timestamp(time.Unix(int64(1000+i), 0))}))
+	}
+	// An entry of before a change of the clock, followed by an interrupted append
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: ActionRemoval, Time: irma.Timestamp(time.Unix(1, 0))}))
+	segments := client.storage.logIndex.Segments
+	file, err := os.OpenFile(client.storage.path(logSegmentsDir+"/"+segments[len(segments)-1].Name), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.Write([]byte(`{"Type":"remo`))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.NoError(t, client.Close())
+
+	// After reopening the client, entries after the older entry are found, including a new one
+	client, err = New(client.storage.storagePath, "../testdata/irma_configuration", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: ActionRemoval, Time: irma.Timestamp(time.Unix(2000, 0))}))
+	from, to := irma.Timestamp(time.Unix(1001, 0)), irma.Timestamp(time.Unix(2001, 0))
+	logs, err := client.QueryLogs(LogQuery{Type: ActionRemoval, From: &from, To: &to})
+	require.NoError(t, err)
+	require.Len(t, logs, logSegmentSize+11)
+	require.Equal(t, int64(2000), time.Time(logs[0].Time).Unix())
+	require.Equal(t, int64(1001), time.Time(logs[len(logs)-1].Time).Unix())
+	require.Equal(t, logs[1].Index+3, logs[0].Index) // after the older and the partial entry
+	require.NoError(t, client.Close())
+}
+
+func TestPruneLogs(t *testing.T) {
+	client, err := New("", "../testdata/irma_configuration", &TestClientHandler{t: t}, WithInMemoryStorage())
+	require.NoError(t, err)
+	now := time.Unix(time.Now().Unix(), 0) // log entries are stored with a precision of seconds
+	client.clock = func() time.Time { return now }
+	for i := 2 * logSegmentSize; i > 0; i-- {
+		require.NoError(t, client.addLogEntry(&LogEntry{
+			Type: ActionRemoval,
+			Time: irma.Timestamp(now.AddDate(0, 0, -i)),
+		}))
+	}
+
+	// Nothing is pruned with the default policy
+	pruned, err := client.PruneLogs()
+	require.NoError(t, err)
+	require.Zero(t, pruned)
+
+	require.Error(t, client.SetLogRetentionPolicy(LogRetentionPolicy{MaxCount: -1}))
+	require.NoError(t, client.SetLogRetentionPolicy(LogRetentionPolicy{MaxCount: 5}))
+	logs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Len(t, logs, 6)
+	summary := logs[5]
+	require.Equal(t, ActionPruned, summary.Type)
+	require.Equal(t, 2*logSegmentSize-5, summary.Pruned)
+	require.Equal(t, now.AddDate(0, 0, -6).Unix(), time.Time(summary.Time).Unix())
+
+	// Pruning again adds to the summary
+	require.NoError(t, client.addLogEntry(&LogEntry{Type: ActionRemoval, Time: irma.Timestamp(now)}))
+	pruned, err = client.PruneLogs()
+	require.NoError(t, err)
+	require.Equal(t, 1, pruned)
+	require.NoError(t, client.SetLogRetentionPolicy(LogRetentionPolicy{MaxAge: 2}))
+	logs, err = client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Len(t, logs, 4)
+	require.Equal(t, ActionPruned, logs[3].Type)
+	require.Equal(t, 2*logSegmentSize-2, logs[3].Pruned)
+
+	// Only the segments containing pruned entries are replaced
+	for i := 0; i < 2*logSegmentSize; i++ {
+		require.NoError(t, client.addLogEntry(&LogEntry{Type: ActionRemoval, Time: irma.Timestamp(now)}))
+	}
+	index, err := client.storage.loadLogIndex()
+	require.NoError(t, err)
+	require.Len(t, index.Segments, 3)
+	kept := []logSegment{*index.Segments[1], *index.Segments[2]}
+	require.NoError(t, client.SetLogRetentionPolicy(LogRetentionPolicy{MaxCount: 2*logSegmentSize - 50}))
+	index, err = client.storage.loadLogIndex()
+	require.NoError(t, err)
+	require.Len(t, index.Segments, 3)
+	require.Equal(t, kept, []logSegment{*index.Segments[1], *index.Segments[2]})
+	require.Equal(t, logSegmentSize-53, index.Segments[0].Count)
+	logs, err = client.LoadNewestLogs(1000)
+	require.NoError(t, err)
+	require.Len(t, logs, 2*logSegmentSize-49)
+	require.Equal(t, ActionPruned, logs[len(logs)-1].Type)
+	require.Equal(t, 2*logSegmentSize+51, logs[len(logs)-1].Pruned)
+
+	// The summary does not involve any credential type
+	logs, err = client.QueryLogs(LogQuery{CredentialType: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")})
+	require.NoError(t, err)
+	require.Empty(t, logs)
+	require.NoError(t, client.Close())
+}
+
+func TestExportLogs(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	university := client.attrs(studentCard)[0].UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"))
+	require.NoError(t, client.RemoveCredential(studentCard, 0))
+	logs, err := client.storage.LoadLogs()
+	require.NoError(t, err)
+
+	_, err = client.ExportLogs("xml")
+	require.Error(t, err)
+
+	bts, err := client.ExportLogs(LogExportJSON)
+	require.NoError(t, err)
+	var exported []*ExportedLogEntry
+	require.NoError(t, json.Unmarshal(bts, &exported))
+	require.Len(t, exported, len(logs))
+	removal := exported[len(exported)-1]
+	require.Equal(t, ActionRemoval, removal.Type)
+	require.Contains(t, removal.Removed, &ExportedAttribute{
+		ID:         irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"),
+		Credential: "Student Card",
+		Attribute:  "University",
+		Value:      *university,
+	})
+
+	// Translated in the language of the user
+	client.SetLanguagePreference("nl")
+	bts, err = client.ExportLogs(LogExportCSV)
+	require.NoError(t, err)
+	records, err := csv.NewReader(bytes.NewReader(bts)).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, logExportCSVHeader, records[0])
+	require.True(t, len(records) > len(logs))
+	last := records[len(records)-1]
+	require.Equal(t, string(ActionRemoval), last[1])
+	require.Equal(t, "removed", last[4])
+	require.Equal(t, "Studentenkaart", last[5])
+
+	// Cells that would be interpreted as a formula are neutralized
+	bts, err = exportLogsCSV([]*ExportedLogEntry{{
+		Time:      time.Unix(1000, 0),
+		Type:      irma.ActionSigning,
+		Requestor: "@SUM(A1)",
+		Message:   "=HYPERLINK(\"https://example.com\")",
+		Disclosed: []*ExportedAttribute{{Value: "-1+2"}, {Value: "\t+1"}, {Value: "1-2"}},
+	}})
+	require.NoError(t, err)
+	records, err = csv.NewReader(bytes.NewReader(bts)).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	require.Equal(t, "'@SUM(A1)", records[1][2])
+	require.Equal(t, "'=HYPERLINK(\"https://example.com\")", records[1][8])
+	require.Equal(t, "'-1+2", records[1][7])
+	require.Equal(t, "'\t+1", records[2][7])
+	require.Equal(t, "1-2", records[3][7])
+}
@@ -0,0 +1,112 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the retry queue of issued credentials that could not be stored. Once the
+// issuer has sent its signatures, the issuance session cannot be repeated: if storing a credential
+// then fails (e.g. because the disk is full), the credential would be lost. Instead, the signature
+// and the attributes of the constructed credential are kept in the issuance queue, and storing the
+// credential is retried when the client is next started. The secret key is not included in the
+// queue, as it is stored separately (see storagelocation.go).
+
+// queuedCredential is a constructed credential that could not be stored.
+type queuedCredential struct {
+	Signature *gabi.CLSignature `json:"signature"`
+	// The attributes of the credential, excluding the secret key
+	Attributes []*big.Int      `json:"attributes"`
+	Queued     *irma.Timestamp `json:"queued"`
+}
+
+// QueuedCredentials returns the amount of issued credentials that could not be stored, of which
+// storing is retried when the client is next started.
+func (client *Client) QueuedCredentials() int {
+	return len(client.issuanceQueue)
+}
+
+// credentialStorageError is returned by addCredential() when storing the credential failed, in
+// which case the credential can be queued.
+type credentialStorageError struct {
+	Err error
+}
+
+func (e *credentialStorageError) Error() string {
+	return e.Err.Error()
+}
+
+// queueCredential adds the constructed credential to the issuance queue.
+func (client *Client) queueCredential(gabicred *gabi.Credential) error {
+	now := irma.Timestamp(time.Now())
+	client.issuanceQueue = append(client.issuanceQueue, &queuedCredential{
+		Signature:  gabicred.Signature,
+		Attributes: gabicred.Attributes[1:],
+		Queued:     &now,
+	})
+	if err := client.storage.StoreIssuanceQueue(client.issuanceQueue); err != nil {
+		client.issuanceQueue = client.issuanceQueue[:len(client.issuanceQueue)-1]
+		return err
+	}
+	return nil
+}
+
+// retryQueuedCredentials stores the credentials in the issuance queue, keeping those that again
+// could not be stored in the queue. As this is done when the client is started, failures are only
+// logged, and the user is not asked to choose instances to replace if the instance limit of the
+// type of a queued credential is reached: the credential is kept in the queue instead. Queued
+// singleton credentials are discarded if an instance that was issued at the same time or later
+// was stored in the meantime.
+func (client *Client) retryQueuedCredentials() error {
+	if len(client.issuanceQueue) == 0 {
+		return nil
+	}
+	if err := client.ensureAttributes(); err != nil {
+		return err
+	}
+	client.startSession()
+	defer client.finishSession()
+	key, err := client.unwrappedSecretKey()
+	if err != nil {
+		irma.Logger.Warn("Failed to store queued credentials: ", err.Error())
+		return nil
+	}
+
+	var remaining []*queuedCredential
+	for _, queued := range client.issuanceQueue {
+		cred, err := newCredential(&gabi.Credential{
+			Attributes: append([]*big.Int{key}, queued.Attributes...),
+			Signature:  queued.Signature,
+		}, client.Configuration)
+		if err != nil {
+			irma.Logger.Warn("Failed to store queued credential: ", err.Error())
+			remaining = append(remaining, queued)
+			continue
+		}
+		if credtype := cred.CredentialType(); credtype != nil {
+			existing := client.attrs(credtype.Identifier())
+			if credtype.IsSingleton && len(existing) > 0 &&
+				!existing[0].SigningDate().Before(cred.AttributeList().SigningDate()) {
+				irma.Logger.Warnf("Discarding queued credential of %s, as a newer instance exists", credtype.Identifier())
+				continue
+			}
+			if !credtype.IsSingleton && credtype.MaxInstances > 0 && len(existing) >= credtype.MaxInstances {
+				irma.Logger.Warnf("Keeping queued credential of %s, as its instance limit is reached", credtype.Identifier())
+				remaining = append(remaining, queued)
+				continue
+			}
+		}
+		if err = client.addCredential(cred, true); err != nil {
+			irma.Logger.Warn("Failed to store queued credential: ", err.Error())
+			remaining = append(remaining, queued)
+		}
+	}
+	client.issuanceQueue = remaining
+	if err = client.storage.StoreIssuanceQueue(client.issuanceQueue); err != nil {
+		irma.Logger.Warn("Failed to store issuance queue: ", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package irmaclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the storage journal, which when enabled (see Preferences.EnableStorageJournal)
+// records every mutation of the storage: which file was written, appended to, moved aside or removed
+// (or which rows of the SQLite storage were changed), when, and by which operation of the client, so
+// that support engineers can reconstruct how a wallet got into a bad state. The contents written are
+// not recorded, only their size and a hash, so that the journal does not contain attributes or keys.
+// The operation is the outermost function of this package on the stack, e.g. "(*Client).RemoveCredential".
+//
+// Like log segments, the journal consists of files containing one JSON-encoded (and possibly
+// encrypted) entry per line. When the current file exceeds journalMaxSize it is rotated, keeping at
+// most journalMaxFiles files, so that the journal never takes more than journalMaxFiles*journalMaxSize
+// bytes. Errors writing the journal are logged, and do not affect the storage operation.
+
+const (
+	journalDir      = "journal"
+	journalFile     = journalDir + "/current"
+	journalRotatedF = journalDir + "/%d" // 1 is the most recently rotated file
+	journalMaxSize  = 256 * 1024
+	journalMaxFiles = 4 // including the current file
+)
+
+// Actions recorded in the journal.
+const (
+	JournalWrite     = "write"
+	JournalAppend    = "append"
+	JournalRemove    = "remove"
+	JournalMoveAside = "moveaside"
+)
+
+// JournalEntry is a mutation of the storage recorded in the storage journal.
+type JournalEntry struct {
+	Time      irma.Timestamp `json:"time"`
+	Operation string         `json:"operation"`
+	Action    string         `json:"action"`
+	// The file within the storage, or for the SQLite storage the table and row prefixed by "sql:"
+	File string `json:"file"`
+	// Size and truncated SHA256 hash of the bytes written, if any
+	Size int    `json:"size,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// storageJournal holds the state of the enabled journal.
+type storageJournal struct {
+	sync.Mutex
+	size int64 // of the current file; -1 if not yet known
+}
+
+// StorageJournal returns the entries of the storage journal, oldest first.
+func (client *Client) StorageJournal() ([]*JournalEntry, error) {
+	s := &client.storage
+	var entries []*JournalEntry
+	for i := journalMaxFiles - 1; i >= 0; i-- {
+		file := journalFile
+		if i > 0 {
+			file = fmt.Sprintf(journalRotatedF, i)
+		}
+		bts, err := s.readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(bts))
+		for scanner.Scan() {
+			line, err := s.decryptLine(scanner.Bytes(), journalDir)
+			if err != nil {
+				continue // skip partially written entries
+			}
+			entry := &JournalEntry{}
+			if err = json.Unmarshal(line, entry); err != nil {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// SetStorageJournalPreference enables or disables the storage journal. Disabling it keeps the
+// journal recorded so far; ClearStorageJournal() removes it.
+func (client *Client) SetStorageJournalPreference(enable bool) {
+	client.Preferences.EnableStorageJournal = enable
+	client.applyStorageJournalPreference()
+	_ = client.storage.StorePreferences(client.Preferences)
+}
+
+func (client *Client) applyStorageJournalPreference() {
+	if !client.Preferences.EnableStorageJournal {
+		client.storage.journal = nil
+	} else if client.storage.journal == nil {
+		client.storage.journal = &storageJournal{size: -1}
+	}
+}
+
+// ClearStorageJournal removes all entries of the storage journal.
+func (client *Client) ClearStorageJournal() error {
+	s := &client.storage
+	if j := s.journal; j != nil {
+		j.Lock()
+		defer j.Unlock()
+		j.size = 0
+	}
+	for i := 0; i < journalMaxFiles; i++ {
+		file := journalFile
+		if i > 0 {
+			file = fmt.Sprintf(journalRotatedF, i)
+		}
+		if err := s.removeFile(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// record records the mutation of the file in the journal, if enabled.
+func (s *storage) record(action, file string, bts []byte) {
+	j := s.journal
+	if j == nil || strings.HasPrefix(file, journalDir+"/") {
+		return
+	}
+	entry := &JournalEntry{
+		Time:      irma.Timestamp(time.Now()),
+		Operation: journalOperation(),
+		Action:    action,
+		File:      file,
+	}
+	if bts != nil {
+		hash := sha256.Sum256(bts)
+		entry.Size = len(bts)
+		entry.Hash = hex.EncodeToString(hash[:8])
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	if err := s.appendJournal(j, entry); err != nil {
+		irma.Logger.Warn("Failed to write storage journal: ", err.Error())
+	}
+}
+
+func (s *storage) appendJournal(j *storageJournal, entry *JournalEntry) error {
+	bts, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// All journal files use the same associated data, as they are renamed when rotating
+	if bts, err = s.encryptLine(bts, journalDir); err != nil {
+		return err
+	}
+	bts = append(bts, '\n')
+
+	if j.size < 0 {
+		current, err := s.readFile(journalFile)
+		if err != nil {
+			return err
+		}
+		j.size = int64(len(current))
+	}
+	if j.size > 0 && j.size+int64(len(bts)) > journalMaxSize {
+		if err = s.rotateJournal(); err != nil {
+			return err
+		}
+		j.size = 0
+	}
+
+	if s.memory != nil {
+		s.memory.append(journalFile, bts)
+	} else {
+		if err = fs.EnsureDirectoryExists(s.path(journalDir)); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(s.path(journalFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err = file.Write(bts); err != nil {
+			_ = file.Close()
+			return err
+		}
+		if err = file.Close(); err != nil {
+			return err
+		}
+	}
+	j.size += int64(len(bts))
+	return nil
+}
+
+// rotateJournal shifts the journal files, discarding the oldest one.
+func (s *storage) rotateJournal() error {
+	name := func(i int) string {
+		if i == 0 {
+			return journalFile
+		}
+		return fmt.Sprintf(journalRotatedF, i)
+	}
+	if err := s.removeFile(name(journalMaxFiles - 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := journalMaxFiles - 2; i >= 0; i-- {
+		if s.memory != nil {
+			if bts, exists := s.memory.read(name(i)); exists {
+				s.memory.write(name(i+1), bts)
+				_ = s.memory.remove(name(i))
+			}
+			continue
+		}
+		if err := os.Rename(s.path(name(i)), s.path(name(i+1))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalOperation returns the outermost function of this package (excluding tests) on the stack of the caller.
+func journalOperation() string {
+	const prefix = "github.com/privacybydesign/irmago/irmaclient."
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	operation := ""
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, prefix) && !strings.HasSuffix(frame.File, "_test.go") {
+			operation = strings.TrimPrefix(frame.Function, prefix)
+		}
+		if !more {
+			break
+		}
+	}
+	return operation
+}
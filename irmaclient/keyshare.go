@@ -36,6 +36,12 @@ type keyshareSessionHandler interface {
 	KeyshareError(manager *irma.SchemeManagerIdentifier, err error)
 	KeysharePin()
 	KeysharePinOK()
+	// KeyshareKeyRotated is called when a JWT of the keyshare server is signed with a key that the
+	// scheme does not contain, presumably because the keyshare server rotated its keys; it should
+	// update the scheme so that the new keys become available
+	KeyshareKeyRotated(manager irma.SchemeManagerIdentifier) error
+	// observeTransport is called with each transport to a keyshare server that is used in the session
+	observeTransport(transport *irma.HTTPTransport)
 }
 
 type keyshareSession struct {
@@ -49,26 +55,37 @@ type keyshareSession struct {
 	transports       map[irma.SchemeManagerIdentifier]*irma.HTTPTransport
 	issuerProofNonce *big.Int
 	pinCheck         bool
+	retries          int
+	// Whether the tokens were refreshed in this session, see refreshToken()
+	tokensRefreshed bool
+	// Schemes that were updated in this session because their keyshare server rotated its keys
+	keysUpdated map[irma.SchemeManagerIdentifier]bool
 }
 
 type keyshareServer struct {
 	Username                string `json:"username"`
 	Nonce                   []byte `json:"nonce"`
 	SchemeManagerIdentifier irma.SchemeManagerIdentifier
-	token                   string
+	// Identifies this device at the keyshare server, if the account is shared by multiple devices
+	DeviceID string `json:"deviceID,omitempty"`
+	// Keyshare protocol version determining how the PIN is verified, see pake.go
+	PinProtocol int `json:"pinProtocol,omitempty"`
+	token       secret
 }
 
 type keyshareEnrollment struct {
-	Username string  `json:"username"`
-	Pin      string  `json:"pin"`
+	Username string `json:"username"`
+	pinRegistration
 	Email    *string `json:"email"`
 	Language string  `json:"language"`
 }
 
 type keyshareChangepin struct {
-	Username string `json:"id"`
-	OldPin   string `json:"oldpin"`
-	NewPin   string `json:"newpin"`
+	Username     string           `json:"id"`
+	OldPin       string           `json:"oldpin,omitempty"`
+	NewPin       string           `json:"newpin,omitempty"`
+	OldPinProof  []byte           `json:"oldpinProof,omitempty"`
+	NewPinRecord *irma.PakeRecord `json:"newpinRecord,omitempty"`
 }
 
 type keyshareAuthorization struct {
@@ -78,7 +95,13 @@ type keyshareAuthorization struct {
 
 type keysharePinMessage struct {
 	Username string `json:"id"`
-	Pin      string `json:"pin"`
+	pinProof
+}
+
+// keyshareTokenRefresh requests a new token for the token sent along in the kssAuthHeader,
+// see refreshToken().
+type keyshareTokenRefresh struct {
+	Username string `json:"id"`
 }
 
 type keysharePinStatus struct {
@@ -122,11 +145,15 @@ const (
 	kssPinSuccess     = "success"
 	kssPinFailure     = "failure"
 	kssPinError       = "error"
+
+	// Max amount of times that a step of the keyshare protocol is retried after a transport
+	// error, in those steps where this is safe
+	kssMaxRetries = 2
 )
 
 func newKeyshareServer(schemeManagerIdentifier irma.SchemeManagerIdentifier) (ks *keyshareServer, err error) {
 	ks = &keyshareServer{
-		Nonce: make([]byte, 32),
+		Nonce:                   make([]byte, 32),
 		SchemeManagerIdentifier: schemeManagerIdentifier,
 	}
 	_, err = rand.Read(ks.Nonce)
@@ -134,13 +161,21 @@ func newKeyshareServer(schemeManagerIdentifier irma.SchemeManagerIdentifier) (ks
 }
 
 func (ks *keyshareServer) HashedPin(pin string) string {
-	hash := sha256.Sum256(append(ks.Nonce, []byte(pin)...))
+	salted := secret(append(append(make([]byte, 0, len(ks.Nonce)+len(pin)), ks.Nonce...), pin...))
+	defer salted.wipe()
+	hash := sha256.Sum256(salted)
+	defer secret(hash[:]).wipe()
 	// We must be compatible with the old Android app here,
 	// which uses Base64.encodeToString(hash, Base64.DEFAULT),
 	// which appends a newline.
 	return base64.StdEncoding.EncodeToString(hash[:]) + "\n"
 }
 
+// authorization returns the value of the kssAuthHeader authorizing us with the token.
+func (ks *keyshareServer) authorization() string {
+	return "Bearer " + string(ks.token)
+}
+
 // startKeyshareSession starts and completes the entire keyshare protocol with all involved keyshare servers
 // for the specified session, merging the keyshare proofs into the specified ProofBuilder's.
 // The user's pin is retrieved using the KeysharePinRequestor, repeatedly, until either it is correct; or the
@@ -182,6 +217,7 @@ func startKeyshareSession(
 		keyshareServers:  keyshareServers,
 		issuerProofNonce: issuerProofNonce,
 		pinCheck:         false,
+		keysUpdated:      map[irma.SchemeManagerIdentifier]bool{},
 	}
 
 	for managerID := range session.Identifiers().SchemeManagers {
@@ -193,26 +229,25 @@ func startKeyshareSession(
 		ks.keyshareServer = ks.keyshareServers[managerID]
 		transport := irma.NewHTTPTransport(scheme.KeyshareServer)
 		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
-		transport.SetHeader(kssAuthHeader, "Bearer "+ks.keyshareServer.token)
-		transport.SetHeader(kssVersionHeader, "2")
+		transport.SetHeader(kssAuthHeader, ks.keyshareServer.authorization())
+		ks.keyshareServer.setVersionHeader(transport)
+		sessionHandler.observeTransport(transport)
 		ks.transports[managerID] = transport
 
 		// Try to parse token as a jwt to see if it is still valid; if so we don't need to ask for the PIN
-		parser := new(jwt.Parser)
-		parser.SkipClaimsValidation = true // We want to verify expiry on our own below so we can add leeway
+		// (we verify expiry on our own below so we can add leeway)
 		claims := jwt.StandardClaims{}
-		_, err := parser.ParseWithClaims(ks.keyshareServer.token, &claims, ks.conf.KeyshareServerKeyFunc(managerID))
-		if err != nil {
+		if err := ks.parseJwt(managerID, string(ks.keyshareServer.token), &claims); err != nil {
 			irma.Logger.Info("Keyshare server token invalid, asking for PIN")
-			irma.Logger.Debug("Token: ", ks.keyshareServer.token)
+			irma.Logger.Debug("Token: ", string(ks.keyshareServer.token))
 			ks.pinCheck = true
 			continue
 		}
 		// Add a minute of leeway for possible clockdrift with the server,
 		// and for the rest of the protocol to take place with this token
-		if !claims.VerifyExpiresAt(time.Now().Add(1*time.Minute).Unix(), true) {
+		if !claims.VerifyExpiresAt(time.Now().Add(1*time.Minute).Unix(), true) && !refreshToken(ks.keyshareServer, transport) {
 			irma.Logger.Info("Keyshare server token expires too soon, asking for PIN")
-			irma.Logger.Debug("Token: ", ks.keyshareServer.token)
+			irma.Logger.Debug("Token: ", string(ks.keyshareServer.token))
 			ks.pinCheck = true
 		}
 	}
@@ -249,6 +284,44 @@ func (ks *keyshareSession) fail(manager irma.SchemeManagerIdentifier, err error)
 	}
 }
 
+// refreshTokens refreshes the tokens of all keyshare servers in the session, returning whether
+// this succeeded; it is done at most once per session.
+func (ks *keyshareSession) refreshTokens() bool {
+	ks.tokensRefreshed = true
+	for managerID := range ks.session.Identifiers().SchemeManagers {
+		if !ks.conf.SchemeManagers[managerID].Distributed() {
+			continue
+		}
+		if !refreshToken(ks.keyshareServers[managerID], ks.transports[managerID]) {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshToken asks the keyshare server for a new token in exchange for the current one, returning
+// whether it did so. Whether the current token is fresh enough for this is decided by the keyshare
+// server rather than by us, so that this works regardless of the difference between our clock and
+// that of the keyshare server. Keyshare servers not supporting this respond with 404, in which case
+// we fall back to asking for the PIN, as we do when the keyshare server refuses.
+func refreshToken(kss *keyshareServer, transport *irma.HTTPTransport) bool {
+	if len(kss.token) == 0 {
+		return false
+	}
+	result := &keysharePinStatus{}
+	if err := transport.Post("users/refresh", result, keyshareTokenRefresh{Username: kss.Username}); err != nil {
+		irma.Logger.Info("Keyshare server token not refreshed: ", err)
+		return false
+	}
+	if result.Status != kssPinSuccess || result.Message == "" {
+		irma.Logger.Info("Keyshare server refused to refresh token")
+		return false
+	}
+	kss.token.set(result.Message)
+	transport.SetHeader(kssAuthHeader, kss.authorization())
+	return true
+}
+
 // Ask for a pin, repeatedly if necessary, and either continue the keyshare protocol
 // with authorization, or stop the keyshare protocol and inform of failure.
 func (ks *keyshareSession) VerifyPin(attempts int) {
@@ -278,7 +351,16 @@ func (ks *keyshareSession) VerifyPin(attempts int) {
 
 func verifyPinWorker(pin string, kss *keyshareServer, transport *irma.HTTPTransport) (
 	success bool, tries int, blocked int, err error) {
-	pinmsg := keysharePinMessage{Username: kss.Username, Pin: kss.HashedPin(pin)}
+	protocol, err := kss.pinProtocol()
+	if err != nil {
+		return
+	}
+	kss.setVersionHeader(transport)
+	proof, err := protocol.prove(kss, transport, pin)
+	if err != nil {
+		return
+	}
+	pinmsg := keysharePinMessage{Username: kss.Username, pinProof: *proof}
 	pinresult := &keysharePinStatus{}
 	err = transport.Post("users/verify/pin", pinresult, pinmsg)
 	if err != nil {
@@ -288,8 +370,8 @@ func verifyPinWorker(pin string, kss *keyshareServer, transport *irma.HTTPTransp
 	switch pinresult.Status {
 	case kssPinSuccess:
 		success = true
-		kss.token = pinresult.Message
-		transport.SetHeader(kssAuthHeader, kss.token)
+		kss.token.set(pinresult.Message)
+		transport.SetHeader(kssAuthHeader, string(kss.token))
 		return
 	case kssPinFailure:
 		tries, err = strconv.Atoi(pinresult.Message)
@@ -366,13 +448,23 @@ func (ks *keyshareSession) GetCommitments() {
 		if err != nil {
 			if err.(*irma.SessionError).RemoteError != nil &&
 				err.(*irma.SessionError).RemoteError.Status == http.StatusForbidden && !ks.pinCheck {
-				// JWT may be out of date due to clock drift; request pin and try again
-				// (but only if we did not ask for a PIN earlier)
-				ks.pinCheck = false
+				// JWT may be out of date due to clock drift; refresh it or request pin and try again
+				// (but only if we did not do so earlier)
+				if !ks.tokensRefreshed && ks.refreshTokens() {
+					ks.GetCommitments()
+					return
+				}
+				ks.pinCheck = true
 				ks.sessionHandler.KeysharePin()
 				ks.VerifyPin(-1)
 				return
 			}
+			if ks.retryable(err) {
+				// None of the commitments have been merged into our builders yet, so we can safely
+				// start this step over, reusing the tokens that we already obtained
+				ks.GetCommitments()
+				return
+			}
 			ks.sessionHandler.KeyshareError(&managerID, err)
 			return
 		}
@@ -410,7 +502,16 @@ func (ks *keyshareSession) GetProofPs() {
 			continue
 		}
 		var jwt string
-		err := transport.Post("prove/getResponse", &jwt, challenge)
+		var err error
+		for {
+			// Sending the same challenge again is safe: the keyshare server either returns
+			// the same response, or refuses. We must never request a new challenge here however,
+			// as the commitments have already been merged into our builders.
+			err = transport.Post("prove/getResponse", &jwt, challenge)
+			if err == nil || !ks.retryable(err) {
+				break
+			}
+		}
 		if err != nil {
 			ks.sessionHandler.KeyshareError(&managerID, err)
 			return
@@ -421,6 +522,18 @@ func (ks *keyshareSession) GetProofPs() {
 	ks.Finish(challenge, responses)
 }
 
+// retryable checks if the error is a transport error (as opposed to an error returned by the
+// keyshare server), and if so, whether or not we may retry once more.
+func (ks *keyshareSession) retryable(err error) bool {
+	serr, ok := err.(*irma.SessionError)
+	if !ok || serr.ErrorType != irma.ErrorTransport || ks.retries >= kssMaxRetries {
+		return false
+	}
+	ks.retries++
+	irma.Logger.Warnf("Keyshare server unreachable, retrying (%d/%d)", ks.retries, kssMaxRetries)
+	return true
+}
+
 // Finish the keyshare protocol: in case of issuance, put the keyshare jwt in the
 // IssueCommitmentMessage; in case of disclosure and signing, parse each keyshare jwt,
 // merge in the received ProofP's, and finish.
@@ -448,6 +561,37 @@ func (ks *keyshareSession) Finish(challenge *big.Int, responses map[irma.SchemeM
 	}
 }
 
+// parseJwt parses and verifies a JWT of the keyshare server of the specified scheme, without validating
+// its claims. If the JWT is signed with a key that the scheme does not contain, then the keyshare server
+// has probably rotated its keys; in that case the scheme is updated (once per session) and the JWT is
+// parsed again.
+func (ks *keyshareSession) parseJwt(managerID irma.SchemeManagerIdentifier, token string, claims jwt.Claims) error {
+	parser := new(jwt.Parser)
+	parser.SkipClaimsValidation = true
+	_, err := parser.ParseWithClaims(token, claims, ks.conf.KeyshareServerKeyFunc(managerID))
+	if !isUnknownKeyshareKey(err) || ks.keysUpdated[managerID] {
+		return err
+	}
+
+	irma.Logger.WithField("scheme", managerID).Info("Keyshare server uses unknown key, updating scheme")
+	ks.keysUpdated[managerID] = true
+	if err = ks.sessionHandler.KeyshareKeyRotated(managerID); err != nil {
+		return err
+	}
+	_, err = parser.ParseWithClaims(token, claims, ks.conf.KeyshareServerKeyFunc(managerID))
+	return err
+}
+
+// isUnknownKeyshareKey checks if the error, returned by the JWT parser, is caused by the JWT
+// being signed with a key that the scheme does not contain.
+func isUnknownKeyshareKey(err error) bool {
+	if verr, ok := err.(*jwt.ValidationError); ok {
+		err = verr.Inner
+	}
+	_, ok := err.(*irma.UnknownKeyshareKeyError)
+	return ok
+}
+
 func (ks *keyshareSession) finishDisclosureOrSigning(challenge *big.Int, responses map[irma.SchemeManagerIdentifier]string) {
 	proofPs := make([]*gabi.ProofP, len(ks.builders))
 	for i, builder := range ks.builders {
@@ -460,9 +604,7 @@ func (ks *keyshareSession) finishDisclosureOrSigning(challenge *big.Int, respons
 			jwt.StandardClaims
 			ProofP *gabi.ProofP
 		}{}
-		parser := new(jwt.Parser)
-		parser.SkipClaimsValidation = true // no need to abort due to clock drift issues
-		if _, err := parser.ParseWithClaims(responses[managerID], &claims, ks.conf.KeyshareServerKeyFunc(managerID)); err != nil {
+		if err := ks.parseJwt(managerID, responses[managerID], &claims); err != nil {
 			ks.sessionHandler.KeyshareError(&managerID, err)
 			return
 		}
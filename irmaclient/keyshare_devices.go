@@ -0,0 +1,258 @@
+package irmaclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the client side of keyshare accounts shared by multiple devices.
+// Each device has its own secret key and its own PIN hash, but shares the keyshare
+// server's part of the secret key. A device is added to an existing account as follows:
+// on an already enrolled device the user authenticates with their PIN and obtains a pairing
+// code (KeyshareStartDevicePairing()), which acts as the approval of the new device; the new
+// device then enrolls using that pairing code (KeyshareEnrollDevice()), after which the
+// keyshare server issues it its own keyshare login attribute.
+
+// KeyshareDevice is a device registered to a keyshare account.
+type KeyshareDevice struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`
+	Enrolled irma.Timestamp `json:"enrolled"`
+	LastSeen irma.Timestamp `json:"lastSeen"`
+	// Whether or not this is the device on which this client runs
+	Current bool `json:"-"`
+}
+
+// KeysharePairing is a pairing code with which a new device can join a keyshare account.
+type KeysharePairing struct {
+	Code    string         `json:"code"`
+	Expires irma.Timestamp `json:"expires"`
+}
+
+// KeysharePinError is returned by keyshare account management methods when the specified PIN
+// was incorrect.
+type KeysharePinError struct {
+	Manager irma.SchemeManagerIdentifier
+	// Amount of remaining PIN attempts, if not blocked
+	RemainingAttempts int
+	// If nonzero, the amount of seconds that the account is blocked
+	Blocked int
+}
+
+func (e *KeysharePinError) Error() string {
+	if e.Blocked != 0 {
+		return fmt.Sprintf("keyshare account of %s blocked for %d seconds", e.Manager, e.Blocked)
+	}
+	return fmt.Sprintf("incorrect PIN for keyshare account of %s, %d attempts remaining", e.Manager, e.RemainingAttempts)
+}
+
+type keyshareDeviceEnrollment struct {
+	PairingCode string `json:"pairingCode"`
+	pinRegistration
+	DeviceName string `json:"deviceName"`
+}
+
+type keyshareDeviceEnrollmentResult struct {
+	SessionPtr *irma.Qr `json:"sessionPtr"`
+	DeviceID   string   `json:"deviceID"`
+}
+
+type keyshareDeviceRevocation struct {
+	ID string `json:"id"`
+}
+
+// keyshareTransport returns a transport to the keyshare server of the specified scheme at which
+// we are enrolled.
+func (client *Client) keyshareTransport(managerID irma.SchemeManagerIdentifier) (*irma.HTTPTransport, *keyshareServer, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, nil, err
+	}
+	kss, ok := client.keyshareServers[managerID]
+	if !ok {
+		return nil, nil, errors.New("Unknown keyshare server")
+	}
+	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	kss.setVersionHeader(transport)
+	return transport, kss, nil
+}
+
+// keyshareAuthorizedTransport verifies the PIN at the keyshare server of the specified scheme,
+// and returns a transport to it that is authorized using the obtained token.
+func (client *Client) keyshareAuthorizedTransport(managerID irma.SchemeManagerIdentifier, pin string) (*irma.HTTPTransport, *keyshareServer, error) {
+	transport, kss, err := client.keyshareTransport(managerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	success, tries, blocked, err := verifyPinWorker(pin, kss, transport)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !success {
+		return nil, nil, &KeysharePinError{Manager: managerID, RemainingAttempts: tries, Blocked: blocked}
+	}
+	transport.SetHeader(kssAuthHeader, kss.authorization())
+	return transport, kss, nil
+}
+
+// KeyshareDevices lists the devices registered to the keyshare account at the specified scheme.
+func (client *Client) KeyshareDevices(manager irma.SchemeManagerIdentifier, pin string) ([]*KeyshareDevice, error) {
+	transport, kss, err := client.keyshareAuthorizedTransport(manager, pin)
+	if err != nil {
+		return nil, err
+	}
+	var devices []*KeyshareDevice
+	if err = transport.Get("users/devices", &devices); err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		device.Current = kss.DeviceID != "" && device.ID == kss.DeviceID
+	}
+	return devices, nil
+}
+
+// KeyshareRevokeDevice removes the specified device from the keyshare account at the specified
+// scheme, after which the keyshare server refuses to cooperate with it.
+func (client *Client) KeyshareRevokeDevice(manager irma.SchemeManagerIdentifier, pin string, deviceID string) error {
+	transport, kss, err := client.keyshareAuthorizedTransport(manager, pin)
+	if err != nil {
+		return err
+	}
+	if deviceID == kss.DeviceID {
+		return errors.New("Cannot revoke current device, use KeyshareRemove instead")
+	}
+	var x string
+	return transport.Post("users/devices/revoke", &x, keyshareDeviceRevocation{ID: deviceID})
+}
+
+// KeyshareStartDevicePairing approves the enrollment of a new device to the keyshare account at the
+// specified scheme, returning a pairing code that must be passed to KeyshareEnrollDevice() on the
+// new device before it expires.
+func (client *Client) KeyshareStartDevicePairing(manager irma.SchemeManagerIdentifier, pin string) (*KeysharePairing, error) {
+	transport, _, err := client.keyshareAuthorizedTransport(manager, pin)
+	if err != nil {
+		return nil, err
+	}
+	pairing := &KeysharePairing{}
+	if err = transport.Post("users/devices/pairing", pairing, nil); err != nil {
+		return nil, err
+	}
+	return pairing, nil
+}
+
+// KeyshareEnrollDevice enrolls this device to an existing keyshare account at the specified scheme,
+// using a pairing code obtained with KeyshareStartDevicePairing() on a device already enrolled to
+// the account. The specified PIN becomes the PIN of this device. Success or failure is reported
+// to the EnrollmentSuccess() and EnrollmentFailure() methods of the ClientHandler.
+func (client *Client) KeyshareEnrollDevice(manager irma.SchemeManagerIdentifier, pairingCode string, pin string, deviceName string) {
+	go func() {
+		err := client.keyshareEnrollDeviceWorker(manager, pairingCode, pin, deviceName)
+		if err != nil {
+			client.handler.EnrollmentFailure(manager, err)
+		}
+	}()
+}
+
+func (client *Client) keyshareEnrollDeviceWorker(managerID irma.SchemeManagerIdentifier, pairingCode string, pin string, deviceName string) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
+	manager, ok := client.Configuration.SchemeManagers[managerID]
+	if !ok {
+		return errors.New("Unknown scheme manager")
+	}
+	if len(manager.KeyshareServer) == 0 {
+		return errors.New("Scheme manager has no keyshare server")
+	}
+	if _, enrolled := client.keyshareServers[managerID]; enrolled {
+		return errors.New("Already enrolled to this keyshare server")
+	}
+	if len(pin) < 5 {
+		return errors.New("PIN too short, must be at least 5 characters")
+	}
+
+	transport := irma.NewHTTPTransport(manager.KeyshareServer)
+	kss, err := newKeyshareServer(managerID)
+	if err != nil {
+		return err
+	}
+	registration, version, err := registerPin(kss, transport, pin, client.allowHashedPin(kss))
+	if err != nil {
+		return err
+	}
+	kss.PinProtocol = version
+	kss.setVersionHeader(transport)
+	message := keyshareDeviceEnrollment{
+		PairingCode:     pairingCode,
+		pinRegistration: *registration,
+		DeviceName:      deviceName,
+	}
+
+	result := &keyshareDeviceEnrollmentResult{}
+	if err = transport.Post("client/register/device", result, message); err != nil {
+		return err
+	}
+	if result.SessionPtr == nil {
+		return errors.New("Keyshare server returned no session pointer")
+	}
+	kss.DeviceID = result.DeviceID
+
+	// As in keyshareEnrollWorker(), the keyshareEnrollmentHandler stores or removes the
+	// keyshare server depending on the outcome of the session.
+	client.keyshareServers[managerID] = kss
+	client.newQrSession(result.SessionPtr, &keyshareEnrollmentHandler{
+		client: client,
+		pin:    pin,
+		kss:    kss,
+	}, "")
+
+	return nil
+}
+
+// KeyshareAccountInfo contains information about a keyshare account.
+type KeyshareAccountInfo struct {
+	Username string `json:"username"`
+	// Whether or not an email address is registered to the account
+	EmailRegistered bool           `json:"emailRegistered"`
+	Enrolled        irma.Timestamp `json:"enrolled"`
+	// Expiry of the token with which this client authenticates to the keyshare server,
+	// nil if there is no such token or if it has expired
+	TokenExpiry *irma.Timestamp `json:"-"`
+	// Whether or not the fields above that are reported by the keyshare server are
+	// populated. This requires a valid token: if there is none, the user must first
+	// authenticate with their PIN (e.g. using KeyshareVerifyPin()).
+	Authenticated bool `json:"-"`
+}
+
+// KeyshareAccountInfo returns information about the keyshare account at the specified scheme.
+// If the client holds a valid token for the keyshare server, the account details are fetched
+// from the keyshare server; otherwise only the locally known details are returned.
+func (client *Client) KeyshareAccountInfo(manager irma.SchemeManagerIdentifier) (*KeyshareAccountInfo, error) {
+	transport, kss, err := client.keyshareTransport(manager)
+	if err != nil {
+		return nil, err
+	}
+	info := &KeyshareAccountInfo{Username: kss.Username}
+
+	claims := jwt.StandardClaims{}
+	parser := new(jwt.Parser)
+	parser.SkipClaimsValidation = true // we check expiry ourselves below
+	if _, err = parser.ParseWithClaims(string(kss.token), &claims, client.Configuration.KeyshareServerKeyFunc(manager)); err != nil ||
+		!claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return info, nil
+	}
+	expiry := irma.Timestamp(time.Unix(claims.ExpiresAt, 0))
+
+	transport.SetHeader(kssAuthHeader, kss.authorization())
+	if err = transport.Get("users/info", info); err != nil {
+		return nil, err
+	}
+	info.Username = kss.Username
+	info.TokenExpiry = &expiry
+	info.Authenticated = true
+	return info, nil
+}
@@ -0,0 +1,133 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyshareDevices(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	fake := &fakeKeyshareServer{t: t}
+	srv := fake.start()
+	defer srv.Close()
+
+	manager := irma.NewSchemeManagerIdentifier("test")
+	client.Configuration.SchemeManagers[manager].KeyshareServer = srv.URL
+	kss := client.keyshareServers[manager]
+	kss.DeviceID = "1"
+	fake.enroll(&pinRegistration{Pin: kss.HashedPin("12345")})
+	fake.devices = []*KeyshareDevice{{ID: "1"}, {ID: "2"}}
+
+	_, err := client.KeyshareDevices(manager, "54321")
+	require.IsType(t, &KeysharePinError{}, err)
+	require.Equal(t, 2, err.(*KeysharePinError).RemainingAttempts)
+
+	devices, err := client.KeyshareDevices(manager, "12345")
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	require.True(t, devices[0].Current)
+	require.False(t, devices[1].Current)
+
+	// The current device must be removed using KeyshareRemove() instead
+	require.Error(t, client.KeyshareRevokeDevice(manager, "12345", "1"))
+	require.NoError(t, client.KeyshareRevokeDevice(manager, "12345", "2"))
+	require.Len(t, fake.devices, 1)
+
+	pairing, err := client.KeyshareStartDevicePairing(manager, "12345")
+	require.NoError(t, err)
+	require.Equal(t, fake.pairing, pairing.Code)
+
+	// Devices already enrolled cannot enroll again
+	require.Error(t, client.keyshareEnrollDeviceWorker(manager, pairing.Code, "12345", "phone"))
+
+	// The keyshare server refuses enrollment using an incorrect pairing code
+	delete(client.keyshareServers, manager)
+	require.Error(t, client.keyshareEnrollDeviceWorker(manager, "incorrect", "12345", "phone"))
+	require.NotContains(t, client.keyshareServers, manager)
+	require.Error(t, client.keyshareEnrollDeviceWorker(manager, pairing.Code, "1234", "phone"))
+	require.NotEmpty(t, fake.pairing)
+
+	// The fake keyshare server accepts the pairing code but starts no session
+	require.EqualError(t, client.keyshareEnrollDeviceWorker(manager, pairing.Code, "12345", "phone"),
+		"Keyshare server returned no session pointer")
+	require.Empty(t, fake.pairing)
+	require.NotContains(t, client.keyshareServers, manager)
+}
+
+func TestKeyshareAccountInfo(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	fake := &fakeKeyshareServer{t: t}
+	srv := fake.start()
+	defer srv.Close()
+
+	manager := irma.NewSchemeManagerIdentifier("test")
+	client.Configuration.SchemeManagers[manager].KeyshareServer = srv.URL
+	kss := client.keyshareServers[manager]
+
+	// Replace the keyshare server public key of the scheme by one of which we have the private key
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkbts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(client.Configuration.Path, manager.Name(), "kss-0.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts}),
+		0600,
+	))
+	token := func(expiry time.Time) string {
+		str, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.StandardClaims{ExpiresAt: expiry.Unix()}).SignedString(sk)
+		require.NoError(t, err)
+		return str
+	}
+	fake.info = &KeyshareAccountInfo{Username: "other", EmailRegistered: true}
+
+	// Without a token only the locally known details are returned
+	info, err := client.KeyshareAccountInfo(manager)
+	require.NoError(t, err)
+	require.False(t, info.Authenticated)
+	require.Equal(t, kss.Username, info.Username)
+	require.Nil(t, info.TokenExpiry)
+
+	// Expired tokens are not used
+	kss.token.set(token(time.Now().Add(-time.Minute)))
+	info, err = client.KeyshareAccountInfo(manager)
+	require.NoError(t, err)
+	require.False(t, info.Authenticated)
+	require.False(t, info.EmailRegistered)
+
+	// Tokens not signed by the keyshare server are not used
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}).SignedString(other)
+	require.NoError(t, err)
+	kss.token.set(forged)
+	info, err = client.KeyshareAccountInfo(manager)
+	require.NoError(t, err)
+	require.False(t, info.Authenticated)
+
+	// With a valid token the details reported by the keyshare server are returned,
+	// except for the username which we know ourselves
+	expiry := time.Now().Add(time.Hour)
+	fake.token = token(expiry)
+	kss.token.set(fake.token)
+	info, err = client.KeyshareAccountInfo(manager)
+	require.NoError(t, err)
+	require.True(t, info.Authenticated)
+	require.True(t, info.EmailRegistered)
+	require.Equal(t, kss.Username, info.Username)
+	require.NotNil(t, info.TokenExpiry)
+	require.Equal(t, expiry.Unix(), time.Time(*info.TokenExpiry).Unix())
+}
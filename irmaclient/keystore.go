@@ -0,0 +1,101 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the wrapping of the secret key of the client by a key of the keystore of the
+// platform (Android Keystore or iOS Secure Enclave), which never leaves the keystore. When New() is
+// passed WithKeystore(), only the wrapped secret key is stored and kept in memory; the app's
+// Unwrapper is called to unwrap it when it is needed, i.e. when computing proofs or issuance
+// commitments, when importing or synchronizing credentials, and when exporting a backup (which
+// contains the unwrapped secret key, as it must be restorable on other devices). Once no sessions
+// are running anymore (see startSession()), the credentials containing the unwrapped secret key
+// are dropped from memory, so that concurrent sessions do not pull it from under each other.
+//
+// An existing unwrapped secret key is wrapped when the client is first created WithKeystore(),
+// e.g. after restoring a backup; a wrapped secret key can no longer be used without the keystore.
+
+// Unwrapper wraps and unwraps the secret key of the client using a key of the platform keystore;
+// it is implemented by the app.
+type Unwrapper interface {
+	// Wrap encrypts the secret key using the keystore key.
+	Wrap(secret []byte) ([]byte, error)
+	// Unwrap decrypts the secret key wrapped by Wrap().
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// ErrKeystoreRequired is returned by New() if the secret key is wrapped but no keystore is passed.
+var ErrKeystoreRequired = errors.New("Secret key is wrapped by a keystore, but no keystore was passed")
+
+// WithKeystore wraps the secret key of the client using the specified platform keystore.
+func WithKeystore(keystore Unwrapper) Option {
+	return func(o *options) {
+		o.keystore = keystore
+	}
+}
+
+// wrapSecretKey wraps the loaded secret key if the client uses a keystore and it is not yet wrapped.
+func (client *Client) wrapSecretKey() error {
+	sk := client.secretkey
+	if sk.Wrapped != nil && client.keystore == nil {
+		return ErrKeystoreRequired
+	}
+	if sk.Wrapped != nil || client.keystore == nil {
+		return nil
+	}
+	wrapped, err := client.keystore.Wrap(sk.Key.Bytes())
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to wrap secret key", 0)
+	}
+	if err = client.storage.StoreSecretKey(&secretKey{Wrapped: wrapped}); err != nil {
+		return err
+	}
+	sk.wipe()
+	client.secretkey = &secretKey{Wrapped: wrapped}
+	return nil
+}
+
+// setSecretKey replaces the secret key of the client by a copy of the specified key, wrapping it if
+// the client uses a keystore. As the copy is wiped once wrapped, the key itself, e.g. the first
+// attribute of an imported credential, remains intact.
+func (client *Client) setSecretKey(key *big.Int) error {
+	client.secretkey = &secretKey{Key: new(big.Int).Set(key)}
+	if client.keystore != nil {
+		return client.wrapSecretKey()
+	}
+	return client.storage.StoreSecretKey(client.secretkey)
+}
+
+// unwrappedSecretKey returns the secret key of the client, unwrapping it if necessary.
+func (client *Client) unwrappedSecretKey() (*big.Int, error) {
+	if client.secretkey.Wrapped == nil {
+		return client.secretkey.Key, nil
+	}
+	unwrapped, err := client.keystore.Unwrap(client.secretkey.Wrapped)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to unwrap secret key", 0)
+	}
+	key := new(big.Int).SetBytes(unwrapped)
+	secret(unwrapped).wipe()
+	return key, nil
+}
+
+// releaseSecretKey wipes the unwrapped secret key and drops the credentials containing it from
+// memory, if the client uses a keystore. It is called by finishSession() with the sessionsLock
+// held once no sessions are running, so that no session is using the credentials.
+func (client *Client) releaseSecretKey() {
+	if client.secretkey == nil || client.secretkey.Wrapped == nil {
+		return
+	}
+	for _, creds := range client.credentialsCache {
+		for _, cred := range creds {
+			if cred.Credential != nil && len(cred.Attributes) > 0 {
+				wipeInt(cred.Attributes[0])
+			}
+		}
+	}
+	client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
+}
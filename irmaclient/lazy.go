@@ -0,0 +1,104 @@
+package irmaclient
+
+import (
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the lazy loading of attributes. Normally New() loads the attribute lists of
+// all credentials and the archive (repairing them if they are corrupted, see repair.go) before it
+// returns. When passed WithLazyAttributeLoading(), New() instead only reads the attributes index,
+// containing the amount of credentials per credential type, and the attribute lists are loaded on
+// first use: by any method that fails when the wallet is locked, or that returns or uses credentials
+// (e.g. CredentialInfoList() or a session). Until then, CredentialCounts() is answered from the index,
+// so that e.g. placeholders for the credentials can be shown quickly. Expired credentials are cleaned
+// up (see cleanup.go) once the attributes are loaded.
+//
+// The index is written along with the attributes. If there is no index yet (e.g. in storage of
+// earlier versions), New() loads the attributes as usual and writes the index.
+
+// attributesIndex contains the amount of credentials per credential type.
+type attributesIndex map[irma.CredentialTypeIdentifier]int
+
+func newAttributesIndex(attributes map[irma.CredentialTypeIdentifier][]*irma.AttributeList) attributesIndex {
+	index := attributesIndex{}
+	for id, attrlistlist := range attributes {
+		if len(attrlistlist) > 0 {
+			index[id] = len(attrlistlist)
+		}
+	}
+	return index
+}
+
+// WithLazyAttributeLoading defers loading the attribute lists of the credentials until they are
+// first used, reading only the attributes index at startup.
+func WithLazyAttributeLoading() Option {
+	return func(o *options) {
+		o.lazyAttributes = true
+	}
+}
+
+// loadAttributesIndex is called instead of loading the attributes when lazy attribute loading is
+// enabled, returning whether an index was found.
+func (client *Client) loadAttributesIndex() (bool, error) {
+	index, err := client.storage.LoadAttributesIndex()
+	if err != nil || index == nil {
+		return false, err
+	}
+	client.attributesLock.Lock()
+	defer client.attributesLock.Unlock()
+	client.attributesIndex = index
+	client.attributesPending = true
+	return true, nil
+}
+
+// ensureAttributes loads the attributes if that was deferred by lazy attribute loading. Concurrent
+// callers wait until the attributes are loaded. The lock is held only while loading the attributes
+// from the storage, which does not call back into the client; the damage found while loading them
+// is reported, and expired credentials are cleaned up, once it is released, as these use methods
+// that call ensureAttributes() themselves, as may the handler.
+func (client *Client) ensureAttributes() error {
+	client.attributesLock.Lock()
+	if !client.attributesPending {
+		client.attributesLock.Unlock()
+		return nil
+	}
+	damage, err := client.loadAttributeLists()
+	if err == nil {
+		client.attributesPending = false
+		client.attributesIndex = nil
+	}
+	client.attributesLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	client.reportDamage(damage)
+	_, err = client.CleanupExpiredCredentials()
+	return err
+}
+
+// ensureAttributesOrWarn is ensureAttributes() for methods that cannot return an error.
+func (client *Client) ensureAttributesOrWarn() {
+	if err := client.ensureAttributes(); err != nil {
+		irma.Logger.Warn("Failed to load attributes: ", err.Error())
+	}
+}
+
+// CredentialCounts returns the amount of credentials per credential type. Unlike
+// CredentialInfoList(), it does not cause the attributes to be loaded when lazy attribute loading is
+// enabled; the counts may then include expired credentials that are removed once they are loaded.
+func (client *Client) CredentialCounts() map[irma.CredentialTypeIdentifier]int {
+	counts := map[irma.CredentialTypeIdentifier]int{}
+	client.attributesLock.Lock()
+	defer client.attributesLock.Unlock()
+	if client.attributesPending {
+		for id, count := range client.attributesIndex {
+			counts[id] = count
+		}
+		return counts
+	}
+	for id, count := range newAttributesIndex(client.attributes) {
+		counts[id] = count
+	}
+	return counts
+}
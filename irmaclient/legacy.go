@@ -0,0 +1,365 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the import of credentials and keyshare server enrollments from legacy storage,
+// i.e. the storage of older IRMA apps or of third-party wallets. Each storage format is read by a
+// LegacyImporter, which is registered under its name using RegisterLegacyImporter(), so that
+// importers can be added (e.g. by apps) without changing the API of the client. ImportLegacyStorage()
+// imports the storage at a path using the importer of the specified name.
+//
+// The importer of the storage of the old Android app, which kept its credentials and keyshare server
+// enrollments as JSON within the shared preferences XML file cardemu.xml, is registered under
+// LegacyImporterAndroid.
+
+// ImportStatus is the result of importing a single credential from legacy storage.
+type ImportStatus string
+
+const (
+	// ImportStatusImported means the credential was imported
+	ImportStatusImported = ImportStatus("imported")
+	// ImportStatusPresent means the credential was already present (e.g. from an earlier import)
+	ImportStatusPresent = ImportStatus("present")
+	// ImportStatusFailed means the credential could not be imported, see ImportedCredential.Error
+	ImportStatusFailed = ImportStatus("failed")
+)
+
+// LegacyImporterAndroid is the name of the importer of the storage of the old Android app.
+const LegacyImporterAndroid = "android"
+
+// LegacyImporter reads legacy storage in a particular format.
+type LegacyImporter interface {
+	// Name returns the name under which the importer is registered.
+	Name() string
+	// Read returns the credentials and keyshare server enrollments in the legacy storage at the
+	// specified path, or an error if there is no legacy storage at the path or it cannot be read.
+	Read(path string) (*LegacyStorage, error)
+}
+
+// LegacyStorage contains the credentials and keyshare server enrollments read by a LegacyImporter.
+type LegacyStorage struct {
+	Credentials     []*LegacyCredential
+	KeyshareServers map[irma.SchemeManagerIdentifier]*LegacyKeyshareEnrollment
+}
+
+// LegacyCredential is a credential in legacy storage.
+type LegacyCredential struct {
+	Signature *gabi.CLSignature `json:"signature"`
+	// The attributes of the credential, starting with the secret key and the metadata attribute
+	Attributes []*big.Int `json:"attributes"`
+}
+
+// LegacyKeyshareEnrollment is an enrollment to a keyshare server in legacy storage.
+type LegacyKeyshareEnrollment struct {
+	Username string `json:"username"`
+	Nonce    []byte `json:"nonce"`
+}
+
+var (
+	legacyImporters     = map[string]LegacyImporter{}
+	legacyImportersLock sync.RWMutex
+)
+
+func init() {
+	RegisterLegacyImporter(androidImporter{})
+}
+
+// RegisterLegacyImporter registers the importer under its name, replacing any importer previously
+// registered under that name.
+func RegisterLegacyImporter(importer LegacyImporter) {
+	legacyImportersLock.Lock()
+	defer legacyImportersLock.Unlock()
+	legacyImporters[importer.Name()] = importer
+}
+
+// LegacyImporters returns the names of the registered importers, sorted.
+func LegacyImporters() []string {
+	legacyImportersLock.RLock()
+	defer legacyImportersLock.RUnlock()
+	names := make([]string, 0, len(legacyImporters))
+	for name := range legacyImporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ImportReport describes the result of ImportLegacyStorage().
+type ImportReport struct {
+	Credentials []*ImportedCredential `json:"credentials"`
+	// Schemes whose keyshare server enrollment was imported
+	KeyshareServers []irma.SchemeManagerIdentifier `json:"keyshareServers"`
+}
+
+// ImportedCredential describes the result of importing a single credential from legacy storage.
+type ImportedCredential struct {
+	// Empty if the credential type of the credential could not be determined
+	CredentialType irma.CredentialTypeIdentifier `json:"credentialType"`
+	Status         ImportStatus                  `json:"status"`
+	Error          string                        `json:"error,omitempty"`
+}
+
+// Imported returns the amount of credentials that were imported.
+func (report *ImportReport) Imported() int {
+	count := 0
+	for _, cred := range report.Credentials {
+		if cred.Status == ImportStatusImported {
+			count++
+		}
+	}
+	return count
+}
+
+// Failed returns the credentials that could not be imported.
+func (report *ImportReport) Failed() []*ImportedCredential {
+	var failed []*ImportedCredential
+	for _, cred := range report.Credentials {
+		if cred.Status == ImportStatusFailed {
+			failed = append(failed, cred)
+		}
+	}
+	return failed
+}
+
+const legacyAndroidStorageFile = "shared_prefs/cardemu.xml"
+
+// ImportLegacyStorage imports the credentials and keyshare server enrollments from the legacy storage
+// at the specified path, using the importer registered under the specified name. Credentials that are
+// already present are skipped, so it is safe to invoke this more than once. Failure to import a
+// particular credential is not an error; instead it is reported in the returned ImportReport.
+//
+// If the client does not yet contain any credentials or keyshare enrollments, it adopts the secret key
+// of the legacy credentials. Otherwise, legacy credentials with a different secret key cannot be imported.
+func (client *Client) ImportLegacyStorage(importer, path string) (*ImportReport, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	legacyImportersLock.RLock()
+	imp, ok := legacyImporters[importer]
+	legacyImportersLock.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("Unknown legacy importer %s", importer)
+	}
+	legacy, err := imp.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	var credentials []*LegacyCredential
+	for _, cred := range legacy.Credentials {
+		if cred != nil && len(cred.Attributes) > 0 && cred.Attributes[0] != nil {
+			credentials = append(credentials, cred)
+		}
+	}
+
+	if client.isEmpty() {
+		// Adopt the secret key only from a credential whose signature is valid, as otherwise anyone
+		// able to write to the legacy storage could choose our secret key
+		for _, cred := range credentials {
+			if _, err = client.verifyLegacyCredential(cred.Signature, cred.Attributes); err == nil {
+				if err = client.setSecretKey(cred.Attributes[0]); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+	key, err := client.unwrappedSecretKey()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{
+		Credentials:     make([]*ImportedCredential, 0, len(credentials)),
+		KeyshareServers: []irma.SchemeManagerIdentifier{},
+	}
+	for _, legacycred := range credentials {
+		report.Credentials = append(report.Credentials, client.importCredential(key, legacycred.Signature, legacycred.Attributes))
+	}
+
+	for smi, enrollment := range legacy.KeyshareServers {
+		if enrollment == nil {
+			continue
+		}
+		if _, present := client.keyshareServers[smi]; present {
+			continue
+		}
+		if _, known := client.Configuration.SchemeManagers[smi]; !known {
+			continue
+		}
+		client.keyshareServers[smi] = &keyshareServer{
+			Username:                enrollment.Username,
+			Nonce:                   enrollment.Nonce,
+			SchemeManagerIdentifier: smi,
+		}
+		report.KeyshareServers = append(report.KeyshareServers, smi)
+	}
+
+	if len(report.KeyshareServers) > 0 {
+		if err = client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+			return report, err
+		}
+	}
+	if report.Imported() > 0 {
+		if err = client.storage.StoreAttributes(client.attributes); err != nil {
+			return report, err
+		}
+	}
+	if report.Imported() > 0 || len(report.KeyshareServers) > 0 {
+		client.handler.UpdateAttributes()
+	}
+	return report, nil
+}
+
+// ImportLegacyAndroidStorage imports the files of the old Android app at the specified path,
+// as ImportLegacyStorage().
+//
+// Deprecated: use ImportLegacyStorage with LegacyImporterAndroid instead.
+func (client *Client) ImportLegacyAndroidStorage(path string) (*ImportReport, error) {
+	deprecated("Client.ImportLegacyAndroidStorage", "Client.ImportLegacyStorage")
+	return client.ImportLegacyStorage(LegacyImporterAndroid, path)
+}
+
+// importCredential adds the credential with the specified signature and attributes (including the
+// secret key) to the client, if it is valid, issued to the specified (unwrapped) secret key of the
+// client, and not already present.
+func (client *Client) importCredential(key *big.Int, signature *gabi.CLSignature, attributes []*big.Int) *ImportedCredential {
+	result := &ImportedCredential{Status: ImportStatusFailed}
+	cred, err := client.verifyLegacyCredential(signature, attributes)
+	if cred != nil {
+		result.CredentialType = cred.CredentialType().Identifier()
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if cred.Attributes[0].Cmp(key) != 0 {
+		result.Error = "credential has a different secret key"
+		return result
+	}
+
+	if client.hasCredential(cred.AttributeList().Hash()) {
+		result.Status = ImportStatusPresent
+		return result
+	}
+
+	if err = client.addCredential(cred, false); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = ImportStatusImported
+	return result
+}
+
+// verifyLegacyCredential constructs the credential with the specified signature and attributes
+// (including the secret key), checking that it has a known credential type and a valid signature.
+// If the credential type is known, the credential is returned also if its signature is invalid.
+func (client *Client) verifyLegacyCredential(signature *gabi.CLSignature, attributes []*big.Int) (*credential, error) {
+	if signature == nil || len(attributes) < 2 {
+		return nil, errors.New("credential is incomplete")
+	}
+	cred, err := newCredential(&gabi.Credential{
+		Signature:  signature,
+		Attributes: attributes,
+	}, client.Configuration)
+	if err != nil {
+		return nil, err
+	}
+	if cred.CredentialType() == nil {
+		return nil, errors.New("unknown credential type")
+	}
+	if cred.Pk == nil || !cred.Signature.Verify(cred.Pk, cred.Attributes) {
+		return cred, errors.New("credential signature invalid")
+	}
+	return cred, nil
+}
+
+// isEmpty returns whether the client contains no credentials and is not enrolled to any keyshare server.
+func (client *Client) isEmpty() bool {
+	return len(client.attributes) == 0 && len(client.archived) == 0 && len(client.keyshareServers) == 0
+}
+
+// androidImporter reads the storage of the old Android app.
+type androidImporter struct{}
+
+func (androidImporter) Name() string {
+	return LegacyImporterAndroid
+}
+
+func (androidImporter) Read(path string) (*LegacyStorage, error) {
+	path = filepath.Join(path, legacyAndroidStorageFile)
+	exists, err := fs.PathExists(path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.Errorf("No legacy Android storage found at %s", path)
+	}
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedxml := struct {
+		Strings []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:",chardata"`
+		} `xml:"string"`
+	}{}
+	if err = xml.Unmarshal(bts, &parsedxml); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse legacy Android storage", 0)
+	}
+
+	legacy := &LegacyStorage{KeyshareServers: map[irma.SchemeManagerIdentifier]*LegacyKeyshareEnrollment{}}
+	for _, xmltag := range parsedxml.Strings {
+		switch xmltag.Name {
+		case legacyCredentialsKey:
+			if err = legacy.parseCredentials([]byte(html.UnescapeString(xmltag.Content))); err != nil {
+				return nil, errors.WrapPrefix(err, "Failed to parse legacy Android credentials", 0)
+			}
+		case legacyKeyshareKey:
+			if err = legacy.parseKeyshareServers([]byte(html.UnescapeString(xmltag.Content))); err != nil {
+				return nil, errors.WrapPrefix(err, "Failed to parse legacy Android keyshare enrollments", 0)
+			}
+		}
+	}
+	return legacy, nil
+}
+
+// Keys under which the old apps stored their credentials and keyshare server enrollments as JSON
+const (
+	legacyCredentialsKey = "credentials"
+	legacyKeyshareKey    = "keyshare"
+)
+
+// parseCredentials parses the credentials as stored by the old apps, i.e. a JSON map from the names
+// of the credential types to lists of credentials.
+func (legacy *LegacyStorage) parseCredentials(bts []byte) error {
+	parsedjson := map[string][]*LegacyCredential{}
+	if err := json.Unmarshal(bts, &parsedjson); err != nil {
+		return err
+	}
+	for _, list := range parsedjson {
+		legacy.Credentials = append(legacy.Credentials, list...)
+	}
+	return nil
+}
+
+// parseKeyshareServers parses the keyshare server enrollments as stored by the old apps, i.e. a JSON
+// map from scheme manager identifiers to enrollments.
+func (legacy *LegacyStorage) parseKeyshareServers(bts []byte) error {
+	return json.Unmarshal(bts, &legacy.KeyshareServers)
+}
@@ -0,0 +1,270 @@
+package irmaclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"unicode/utf16"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the importer of the storage of the old iOS app, registered under
+// LegacyImporterIOS. Like the old Android app, which kept its credentials and keyshare server
+// enrollments as JSON strings under the keys "credentials" and "keyshare" of its shared preferences,
+// the old iOS app kept them under the same keys in its user defaults. These are stored in the
+// Library/Preferences folder of the data container of the app as a property list, which iOS writes
+// in the binary format ("bplist00"); the XML format is accepted as well, e.g. for property lists
+// converted using plutil. The app passes the path of its data container to ImportLegacyStorage().
+
+// LegacyImporterIOS is the name of the importer of the storage of the old iOS app.
+const LegacyImporterIOS = "ios"
+
+// legacyIOSStorageFile is the property list of the user defaults of the old iOS app.
+const legacyIOSStorageFile = "Library/Preferences/org.irmacard.cardemu.plist"
+
+func init() {
+	RegisterLegacyImporter(iosImporter{})
+}
+
+// iosImporter reads the user defaults of the old iOS app.
+type iosImporter struct{}
+
+func (iosImporter) Name() string {
+	return LegacyImporterIOS
+}
+
+func (iosImporter) Read(path string) (*LegacyStorage, error) {
+	path = filepath.Join(path, filepath.FromSlash(legacyIOSStorageFile))
+	exists, err := fs.PathExists(path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.Errorf("No legacy iOS storage found at %s", path)
+	}
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var defaults map[string]string
+	if bytes.HasPrefix(bts, []byte(bplistMagic)) {
+		defaults, err = parseBinaryPlistStrings(bts)
+	} else {
+		defaults, err = parseXMLPlistStrings(bts)
+	}
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse legacy iOS storage", 0)
+	}
+
+	legacy := &LegacyStorage{KeyshareServers: map[irma.SchemeManagerIdentifier]*LegacyKeyshareEnrollment{}}
+	if value, ok := defaults[legacyCredentialsKey]; ok {
+		if err = legacy.parseCredentials([]byte(value)); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to parse legacy iOS credentials", 0)
+		}
+	}
+	if value, ok := defaults[legacyKeyshareKey]; ok {
+		if err = legacy.parseKeyshareServers([]byte(value)); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to parse legacy iOS keyshare enrollments", 0)
+		}
+	}
+	return legacy, nil
+}
+
+// Binary property lists consist of the magic, the objects, a table of the offsets of the objects,
+// and a trailer describing the offset table and pointing to the top level object. Objects start
+// with a marker byte whose high nibble is the type of the object, and whose low nibble is its
+// length, or 0xF if its length follows as an integer object.
+const (
+	bplistMagic       = "bplist00"
+	bplistTrailerSize = 32
+
+	bplistTypeInt     = 0x1
+	bplistTypeData    = 0x4
+	bplistTypeASCII   = 0x5
+	bplistTypeUnicode = 0x6
+	bplistTypeDict    = 0xD
+)
+
+type bplist struct {
+	bts        []byte
+	offsets    []uint64
+	objRefSize int
+}
+
+// parseBinaryPlistStrings returns the strings (and data) in the top level dictionary of the binary
+// property list; values of other types are skipped.
+func parseBinaryPlistStrings(bts []byte) (map[string]string, error) {
+	if len(bts) < len(bplistMagic)+bplistTrailerSize {
+		return nil, errors.New("binary property list too short")
+	}
+	trailer := bts[len(bts)-bplistTrailerSize:]
+	offsetSize, objRefSize := int(trailer[6]), int(trailer[7])
+	count := binary.BigEndian.Uint64(trailer[8:16])
+	top := binary.BigEndian.Uint64(trailer[16:24])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+	if offsetSize < 1 || offsetSize > 8 || objRefSize < 1 || objRefSize > 8 || top >= count ||
+		tableOffset > uint64(len(bts)-bplistTrailerSize) ||
+		count > (uint64(len(bts)-bplistTrailerSize)-tableOffset)/uint64(offsetSize) {
+		return nil, errors.New("invalid binary property list trailer")
+	}
+
+	p := &bplist{bts: bts, offsets: make([]uint64, count), objRefSize: objRefSize}
+	for i := range p.offsets {
+		start := tableOffset + uint64(i*offsetSize)
+		p.offsets[i] = bplistUint(bts[start : start+uint64(offsetSize)])
+	}
+
+	typ, length, start, err := p.object(top)
+	if err != nil {
+		return nil, err
+	}
+	if typ != bplistTypeDict {
+		return nil, errors.New("binary property list does not contain a dictionary")
+	}
+	refs, err := p.slice(start, length*2*uint64(objRefSize))
+	if err != nil {
+		return nil, err
+	}
+	strings := map[string]string{}
+	for i := uint64(0); i < length; i++ {
+		key, ok, err := p.string(bplistUint(refs[i*uint64(objRefSize) : (i+1)*uint64(objRefSize)]))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("binary property list dictionary has a key that is not a string")
+		}
+		j := length + i
+		value, ok, err := p.string(bplistUint(refs[j*uint64(objRefSize) : (j+1)*uint64(objRefSize)]))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			strings[key] = value
+		}
+	}
+	return strings, nil
+}
+
+// object returns the type and length of the specified object, and the offset of its contents.
+func (p *bplist) object(ref uint64) (byte, uint64, uint64, error) {
+	if ref >= uint64(len(p.offsets)) || p.offsets[ref] >= uint64(len(p.bts)) {
+		return 0, 0, 0, errors.New("invalid binary property list object reference")
+	}
+	offset := p.offsets[ref]
+	marker := p.bts[offset]
+	typ, length := marker>>4, uint64(marker&0xF)
+	offset++
+	if length == 0xF && typ != bplistTypeInt {
+		if offset >= uint64(len(p.bts)) || p.bts[offset]>>4 != bplistTypeInt {
+			return 0, 0, 0, errors.New("invalid binary property list object length")
+		}
+		size := uint64(1) << (p.bts[offset] & 0xF)
+		bts, err := p.slice(offset+1, size)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		length = bplistUint(bts)
+		offset += 1 + size
+	}
+	if length > uint64(len(p.bts)) {
+		return 0, 0, 0, errors.New("binary property list object out of bounds")
+	}
+	return typ, length, offset, nil
+}
+
+// string returns the specified object if it is a string or data, and false otherwise.
+func (p *bplist) string(ref uint64) (string, bool, error) {
+	typ, length, start, err := p.object(ref)
+	if err != nil {
+		return "", false, err
+	}
+	switch typ {
+	case bplistTypeASCII, bplistTypeData:
+		bts, err := p.slice(start, length)
+		return string(bts), err == nil, err
+	case bplistTypeUnicode:
+		bts, err := p.slice(start, length*2)
+		if err != nil {
+			return "", false, err
+		}
+		units := make([]uint16, length)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(bts[2*i:])
+		}
+		return string(utf16.Decode(units)), true, nil
+	default:
+		return "", false, nil
+	}
+}
+
+func (p *bplist) slice(start, length uint64) ([]byte, error) {
+	if start > uint64(len(p.bts)) || length > uint64(len(p.bts))-start {
+		return nil, errors.New("binary property list object out of bounds")
+	}
+	return p.bts[start : start+length], nil
+}
+
+// bplistUint parses a big-endian unsigned integer of at most 8 bytes.
+func bplistUint(bts []byte) uint64 {
+	var i uint64
+	for _, b := range bts {
+		i = i<<8 | uint64(b)
+	}
+	return i
+}
+
+// parseXMLPlistStrings returns the strings in the top level dictionary of the XML property list;
+// values of other types are skipped.
+func parseXMLPlistStrings(bts []byte) (map[string]string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(bts))
+	strings := map[string]string{}
+	depth := 0 // 1 within <plist>, 2 within its <dict>
+	key := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth < 2 {
+				if (depth == 0 && t.Name.Local != "plist") || (depth == 1 && t.Name.Local != "dict") {
+					return nil, errors.New("XML property list does not contain a dictionary")
+				}
+				depth++
+				continue
+			}
+			var value string
+			if t.Name.Local == "key" || t.Name.Local == "string" {
+				if err = decoder.DecodeElement(&value, &t); err != nil {
+					return nil, err
+				}
+			} else if err = decoder.Skip(); err != nil {
+				return nil, err
+			}
+			switch t.Name.Local {
+			case "key":
+				key = value
+			case "string":
+				strings[key] = value
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("XML property list incomplete")
+	}
+	return strings, nil
+}
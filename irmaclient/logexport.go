@@ -0,0 +1,219 @@
+package irmaclient
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the export of the logs in a structured format, so that users can take their
+// history to personal data tools. Unlike the log entries themselves, the export contains no proofs
+// or session requests, but the names of the requestors and of the involved credentials and
+// attributes translated in the language from the preferences, along with the attribute values.
+// The JSON export contains a list of ExportedLogEntry; the CSV export contains a header and one row
+// per attribute, or a single row for entries without attributes. As the values in the logs come from
+// requestors and issuers, cells of the CSV export that spreadsheet applications would interpret as a
+// formula are prefixed with a single quote (see csvCell()).
+
+// LogExportFormat is a format in which ExportLogs() exports the logs.
+type LogExportFormat string
+
+const (
+	// LogExportJSON exports the logs as a JSON list of ExportedLogEntry
+	LogExportJSON = LogExportFormat("json")
+	// LogExportCSV exports the logs as CSV, with the columns of logExportCSVHeader
+	LogExportCSV = LogExportFormat("csv")
+)
+
+// ExportedLogEntry is a log entry as exported by ExportLogs().
+type ExportedLogEntry struct {
+	Time      time.Time   `json:"time"`
+	Type      irma.Action `json:"type"`
+	Requestor string      `json:"requestor,omitempty"`
+	Hostname  string      `json:"hostname,omitempty"`
+	// Attributes disclosed in the session
+	Disclosed []*ExportedAttribute `json:"disclosed,omitempty"`
+	// Attributes of the credentials issued in the session
+	Issued []*ExportedAttribute `json:"issued,omitempty"`
+	// Attributes of the removed credentials
+	Removed []*ExportedAttribute `json:"removed,omitempty"`
+	// Message signed in signature sessions
+	Message string `json:"message,omitempty"`
+	// Amount of pruned log entries, see PruneLogs()
+	Pruned int `json:"pruned,omitempty"`
+}
+
+// ExportedAttribute is an attribute in an ExportedLogEntry.
+type ExportedAttribute struct {
+	ID         irma.AttributeTypeIdentifier `json:"id"`
+	Credential string                       `json:"credential"`
+	Attribute  string                       `json:"attribute"`
+	Value      string                       `json:"value"`
+}
+
+var logExportCSVHeader = []string{
+	"time", "type", "requestor", "hostname", "category", "credential", "attribute", "value", "message", "pruned",
+}
+
+// ExportLogs exports all log entries, oldest first, in the specified format.
+func (client *Client) ExportLogs(format LogExportFormat) ([]byte, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	if format != LogExportJSON && format != LogExportCSV {
+		return nil, errors.Errorf("Unknown log export format %s", format)
+	}
+	logs, err := client.storage.LoadLogs()
+	if err != nil {
+		return nil, err
+	}
+	exported := make([]*ExportedLogEntry, 0, len(logs))
+	for _, entry := range logs {
+		exported = append(exported, client.exportLogEntry(entry))
+	}
+	if format == LogExportJSON {
+		return json.Marshal(exported)
+	}
+	return exportLogsCSV(exported)
+}
+
+// exportLogEntry converts the log entry for ExportLogs(). Attributes that cannot be obtained from
+// the entry, e.g. because the public key of their issuer is no longer known, are left out.
+func (client *Client) exportLogEntry(entry *LogEntry) *ExportedLogEntry {
+	lang := client.language()
+	exported := &ExportedLogEntry{
+		Time:      time.Time(entry.Time),
+		Type:      entry.Type,
+		Requestor: entry.ServerName.Translate(lang).Text,
+		Hostname:  entry.Hostname,
+		Pruned:    entry.Pruned,
+	}
+	conf := client.Configuration
+
+	switch entry.Type {
+	case irma.ActionDisclosing, irma.ActionSigning, irma.ActionIssuing:
+		if entry.Disclosure == nil && entry.IssueCommitment == nil {
+			break
+		}
+		disclosed, err := entry.GetDisclosedCredentials(conf)
+		if err != nil {
+			irma.Logger.Warn("Failed to export disclosed attributes of log entry: ", err.Error())
+		}
+		for _, attr := range disclosed {
+			if attr.RawValue != nil {
+				exported.Disclosed = append(exported.Disclosed, exportAttribute(conf, attr.Identifier, attr.Value, lang))
+			}
+		}
+	case actionRemoval:
+		ids := make([]irma.CredentialTypeIdentifier, 0, len(entry.Removed))
+		for id := range entry.Removed {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+		for _, id := range ids {
+			credtype := conf.CredentialTypes[id]
+			for i, value := range entry.Removed[id] {
+				if credtype == nil || i >= len(credtype.AttributeTypes) || value == nil {
+					continue
+				}
+				exported.Removed = append(exported.Removed,
+					exportAttribute(conf, credtype.AttributeTypes[i].GetAttributeTypeIdentifier(), value, lang))
+			}
+		}
+	}
+
+	if entry.Type == irma.ActionIssuing {
+		issued, err := entry.GetIssuedCredentials(conf)
+		if err != nil {
+			irma.Logger.Warn("Failed to export issued attributes of log entry: ", err.Error())
+		}
+		for _, cred := range issued {
+			for _, attr := range cred.DisplayAttributes {
+				if attr.Value != nil {
+					exported.Issued = append(exported.Issued, exportAttribute(conf, attr.Type, attr.Value, lang))
+				}
+			}
+		}
+	}
+	if entry.Type == irma.ActionSigning {
+		exported.Message = string(entry.SignedMessage)
+	}
+	return exported
+}
+
+func exportAttribute(conf *irma.Configuration, id irma.AttributeTypeIdentifier, value irma.TranslatedString, lang string) *ExportedAttribute {
+	attr := &ExportedAttribute{
+		ID:         id,
+		Credential: id.CredentialTypeIdentifier().String(),
+		Attribute:  id.Name(),
+		Value:      value.Translate(lang).Text,
+	}
+	if credtype := conf.CredentialTypes[id.CredentialTypeIdentifier()]; credtype != nil {
+		attr.Credential = credtype.Name.Translate(lang).Text
+		if attrtype := credtype.AttributeType(id); attrtype != nil {
+			attr.Attribute = attrtype.Name.Translate(lang).Text
+		}
+	}
+	return attr
+}
+
+// csvCell neutralizes a cell that spreadsheet applications would interpret as a formula,
+// by prefixing it with a single quote.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func exportLogsCSV(logs []*ExportedLogEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(logExportCSVHeader); err != nil {
+		return nil, err
+	}
+	for _, entry := range logs {
+		row := func(category string, attr *ExportedAttribute) error {
+			record := []string{
+				entry.Time.UTC().Format(time.RFC3339), string(entry.Type), entry.Requestor, entry.Hostname,
+				category, "", "", "", entry.Message, "",
+			}
+			if attr != nil {
+				record[5], record[6], record[7] = attr.Credential, attr.Attribute, attr.Value
+			}
+			if entry.Pruned != 0 {
+				record[9] = strconv.Itoa(entry.Pruned)
+			}
+			for i := range record {
+				record[i] = csvCell(record[i])
+			}
+			return w.Write(record)
+		}
+		rows := 0
+		for _, attrs := range []struct {
+			category string
+			list     []*ExportedAttribute
+		}{{"disclosed", entry.Disclosed}, {"issued", entry.Issued}, {"removed", entry.Removed}} {
+			for _, attr := range attrs.list {
+				if err := row(attrs.category, attr); err != nil {
+					return nil, err
+				}
+				rows++
+			}
+		}
+		if rows == 0 {
+			if err := row("", nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
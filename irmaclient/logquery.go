@@ -0,0 +1,97 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+const (
+	// ActionRemoval is the Type of log entries of removed credentials.
+	ActionRemoval = actionRemoval
+	// ActionPruned is the Type of the log entry summarizing pruned log entries, see PruneLogs().
+	ActionPruned = actionPruned
+)
+
+// LogQuery selects log entries in QueryLogs(). Empty fields match all entries.
+type LogQuery struct {
+	// Type of the entries, e.g. irma.ActionDisclosing or ActionRemoval
+	Type irma.Action
+	// If set, only entries of sessions in which attributes of credentials of this type were disclosed
+	// or in which such credentials were issued, and of removals of such credentials, are selected
+	CredentialType irma.CredentialTypeIdentifier
+	// If set, only entries at or after From and before To are selected
+	From *irma.Timestamp
+	To   *irma.Timestamp
+	// Maximum amount of entries to return, 0 if unlimited
+	Max int
+}
+
+// QueryLogs returns the log entries selected by the query, newest first. The log entries preceding
+// the position of the next entry at the time of the query are scanned, one segment at a time. Log
+// entries are appended in the order of their sessions, but their times need not be in chronological
+// order (e.g. when the clock of the device was changed), so entries before From do not end the scan.
+func (client *Client) QueryLogs(query LogQuery) ([]*LogEntry, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	end, err := client.storage.LogPosition()
+	if err != nil {
+		return nil, err
+	}
+	logs := []*LogEntry{}
+	err = client.storage.EachLogBefore(end, func(entry *LogEntry) (bool, error) {
+		t := time.Time(entry.Time)
+		if query.From != nil && t.Before(time.Time(*query.From)) {
+			return true, nil
+		}
+		if query.To != nil && !t.Before(time.Time(*query.To)) {
+			return true, nil
+		}
+		if query.Type != "" && entry.Type != query.Type {
+			return true, nil
+		}
+		if !query.CredentialType.Empty() {
+			involved, err := entry.involves(client.Configuration, query.CredentialType)
+			if err != nil || !involved {
+				return err == nil, err
+			}
+		}
+		logs = append(logs, entry)
+		return query.Max == 0 || len(logs) < query.Max, nil
+	})
+	return logs, err
+}
+
+// involves returns whether attributes of credentials of the specified type were disclosed in the
+// session of the log entry, or whether such credentials were issued or removed.
+func (entry *LogEntry) involves(conf *irma.Configuration, id irma.CredentialTypeIdentifier) (bool, error) {
+	if entry.Type == actionRemoval {
+		_, ok := entry.Removed[id]
+		return ok, nil
+	}
+	if entry.Type == irma.ActionIssuing {
+		request, err := entry.SessionRequest()
+		if err != nil {
+			return false, err
+		}
+		for _, cred := range request.(*irma.IssuanceRequest).Credentials {
+			if cred.CredentialTypeID == id {
+				return true, nil
+			}
+		}
+	}
+	if entry.Disclosure == nil && entry.IssueCommitment == nil {
+		return false, nil
+	}
+	disclosed, err := entry.GetDisclosedCredentials(conf)
+	if err != nil {
+		return false, err
+	}
+	for _, attr := range disclosed {
+		if attr.Identifier.CredentialTypeIdentifier() == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
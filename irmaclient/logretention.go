@@ -0,0 +1,153 @@
+package irmaclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains the pruning of old log entries, so that the logs of long-lived wallets do not
+// grow unboundedly. The pruned entries are replaced by a single log entry of type ActionPruned,
+// which records their amount in its Pruned field and the time of the newest of them, so that the
+// logs remain in chronological order. Pruning again adds to the amount of this entry.
+
+// LogRetentionPolicy specifies which log entries are kept. Zero fields impose no limit.
+type LogRetentionPolicy struct {
+	// Amount of days after which log entries are pruned
+	MaxAge int
+	// Maximum amount of log entries, not counting the summary of pruned entries
+	MaxCount int
+}
+
+// SetLogRetentionPolicy sets the policy for pruning log entries, and applies it immediately
+// using PruneLogs().
+func (client *Client) SetLogRetentionPolicy(policy LogRetentionPolicy) error {
+	if policy.MaxAge < 0 || policy.MaxCount < 0 {
+		return errors.New("Log retention limits cannot be negative")
+	}
+	client.Preferences.LogRetention = policy
+	if err := client.storage.StorePreferences(client.Preferences); err != nil {
+		return err
+	}
+	_, err := client.PruneLogs()
+	return err
+}
+
+// PruneLogs removes the log entries exceeding the log retention policy from the preferences,
+// oldest first, returning the amount of removed entries. This is done automatically when the
+// client is created.
+func (client *Client) PruneLogs() (int, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return 0, err
+	}
+	return client.pruneLogs()
+}
+
+// pruneLogs applies the log retention policy. Unlike PruneLogs() it does not load the attributes,
+// so that it can be used when the client is created without defeating lazy attribute loading.
+func (client *Client) pruneLogs() (int, error) {
+	policy := client.Preferences.LogRetention
+	if policy.MaxAge == 0 && policy.MaxCount == 0 {
+		return 0, nil
+	}
+	var before time.Time
+	if policy.MaxAge > 0 {
+		before = client.now().AddDate(0, 0, -policy.MaxAge)
+	}
+	count, err := client.storage.PruneLogs(policy.MaxCount, before)
+	if count > 0 {
+		client.logs = nil // reloaded by loadLogs()
+	}
+	return count, err
+}
+
+// PruneLogs replaces the oldest log entries, exceeding maxCount if it is nonzero and preceding
+// before if it is nonzero, by the summary of pruned entries, returning the amount of pruned entries.
+// Only the segments containing pruned entries are loaded and replaced, along with the newest
+// segments when counting the entries to keep.
+func (s *storage) PruneLogs(maxCount int, before time.Time) (int, error) {
+	index, err := s.loadLogIndex()
+	if err != nil || len(index.Segments) == 0 {
+		return 0, err
+	}
+
+	// Find the position of the oldest of the maxCount newest entries, if older entries exist.
+	// As the amount of lines bounds the amount of entries, there are none if it does not exceed maxCount.
+	keep := 0
+	if maxCount > 0 && index.count() > maxCount {
+		kept, exceeded := 0, false
+		err = s.eachLog(index, index.count(), func(entry *LogEntry) (bool, error) {
+			if entry.Type == actionPruned {
+				return false, nil
+			}
+			if kept == maxCount {
+				exceeded = true
+				return false, nil
+			}
+			kept++
+			keep = entry.Index
+			return true, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if !exceeded {
+			keep = 0
+		}
+	}
+
+	// As the log entries are in chronological order, the entries to prune are in the oldest segments
+	summary := &LogEntry{Type: actionPruned}
+	count := 0
+	affected := 0        // amount of segments up to the last one containing the summary or pruned entries
+	var rest []*LogEntry // entries to keep of the last affected segment
+	start := 0           // position of the first entry of the current segment
+	for n, segment := range index.Segments {
+		entries, _, err := s.loadLogSegment(segment)
+		if err != nil {
+			return 0, err
+		}
+		entries = segment.cap(entries)
+		i := 0
+		for ; i < len(entries); i++ {
+			entry := entries[i]
+			if entry.Type == actionPruned {
+				summary.Pruned += entry.Pruned
+				summary.Time = entry.Time
+			} else if entry.Index+start < keep || !before.IsZero() && time.Time(entry.Time).Before(before) {
+				count++
+				summary.Time = entry.Time
+			} else {
+				break
+			}
+		}
+		if i > 0 {
+			affected = n + 1
+		}
+		if i < len(entries) {
+			if i > 0 {
+				rest = entries[i:]
+			}
+			break
+		}
+		start += segment.Count
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	summary.Pruned += count
+
+	// Replace the affected segments by a new one containing the summary and the remaining entries
+	segment := &logSegment{Name: fmt.Sprintf(logSegmentNameF, index.Next)}
+	index.Next++
+	if err = s.writeLogSegment(segment, append([]*LogEntry{summary}, rest...)); err != nil {
+		return 0, err
+	}
+	old := index.Segments[:affected]
+	index.Segments = append([]*logSegment{segment}, index.Segments[affected:]...)
+	if err = s.store(index, logIndexFile); err != nil {
+		return 0, err
+	}
+	return count, s.removeLogSegments(old)
+}
@@ -12,10 +12,15 @@ import (
 // LogEntry is a log entry of a past event.
 type LogEntry struct {
 	// General info
+	Index   int `json:"-"` // Position of the entry in the logs, oldest first, see LoadLogsBefore()
 	Type    irma.Action
 	Time    irma.Timestamp        // Time at which the session was completed
 	Version *irma.ProtocolVersion `json:",omitempty"` // Protocol version that was used in the session
 
+	// Requestor of the session, as in SessionRequestor (not recorded by earlier versions)
+	Hostname   string                `json:",omitempty"`
+	ServerName irma.TranslatedString `json:",omitempty"`
+
 	Request json.RawMessage     `json:",omitempty"` // Message that started the session
 	request irma.SessionRequest // cached parsed version of Request; get with LogEntry.SessionRequest()
 
@@ -26,9 +31,20 @@ type LogEntry struct {
 
 	IssueCommitment *irma.IssueCommitmentMessage `json:",omitempty"`
 	Disclosure      *irma.Disclosure             `json:",omitempty"`
+	// In case of issuance sessions in which attributes were disclosed: the issued credentials by their
+	// hash, and the credentials from which attributes were disclosed
+	Issued     []string                   `json:",omitempty"`
+	Provenance *irma.CredentialProvenance `json:",omitempty"`
+	// In case of disclosures under a guardianship: its ID, see guardianship.go
+	Guardianship string `json:",omitempty"`
+	// In case of the summary of pruned log entries: their amount, see logretention.go
+	Pruned int `json:",omitempty"`
 }
 
-const actionRemoval = irma.Action("removal")
+const (
+	actionRemoval = irma.Action("removal")
+	actionPruned  = irma.Action("pruned")
+)
 
 func (entry *LogEntry) SessionRequest() (irma.SessionRequest, error) {
 	if entry.request == nil {
@@ -63,7 +79,7 @@ func (entry *LogEntry) setSessionRequest() error {
 
 // GetDisclosedCredentials gets the list of disclosed credentials for a log entry
 func (entry *LogEntry) GetDisclosedCredentials(conf *irma.Configuration) ([]*irma.DisclosedAttribute, error) {
-	if entry.Type == actionRemoval {
+	if entry.Type == actionRemoval || entry.Type == actionPruned {
 		return []*irma.DisclosedAttribute{}, nil
 	}
 
@@ -109,10 +125,41 @@ func (entry *LogEntry) GetSignedMessage() (abs *irma.SignedMessage, err error) {
 		Nonce:     sigrequest.Nonce,
 		Context:   sigrequest.Context,
 		Message:   string(entry.SignedMessage),
+		File:      sigrequest.File,
 		Timestamp: entry.Timestamp,
 	}, nil
 }
 
+// Verify re-verifies the disclosure or attribute-based signature contained in the log entry,
+// evaluating the validity of the attributes at the time of the session rather than now.
+func (entry *LogEntry) Verify(conf *irma.Configuration) ([]*irma.DisclosedAttribute, irma.ProofStatus, error) {
+	t := time.Time(entry.Time)
+	switch entry.Type {
+	case irma.ActionDisclosing:
+		request, err := entry.SessionRequest()
+		if err != nil {
+			return nil, irma.ProofStatusInvalid, err
+		}
+		return entry.Disclosure.VerifyAt(conf, request.(*irma.DisclosureRequest), &t)
+	case irma.ActionSigning:
+		request, err := entry.SessionRequest()
+		if err != nil {
+			return nil, irma.ProofStatusInvalid, err
+		}
+		abs, err := entry.GetSignedMessage()
+		if err != nil {
+			return nil, irma.ProofStatusInvalid, err
+		}
+		// If present, the timestamp of the signature determines the signing time
+		if abs.Timestamp != nil {
+			return abs.VerifyAt(conf, request.(*irma.SignatureRequest), nil)
+		}
+		return abs.VerifyAt(conf, request.(*irma.SignatureRequest), &t)
+	default:
+		return nil, irma.ProofStatusInvalid, errors.Errorf("Log entry of type %s contains no verifiable proofs", entry.Type)
+	}
+}
+
 func (session *session) createLogEntry(response interface{}) (*LogEntry, error) {
 	entry := &LogEntry{
 		Type:    session.Action,
@@ -120,6 +167,10 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 		Version: session.Version,
 		request: session.request,
 	}
+	if session.Requestor != nil {
+		entry.Hostname = session.Requestor.Hostname
+		entry.ServerName = session.Requestor.Name
+	}
 
 	if err := entry.setSessionRequest(); err != nil {
 		return nil, err
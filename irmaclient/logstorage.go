@@ -0,0 +1,371 @@
+package irmaclient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the storage of log entries. Log entries are appended to segment files
+// containing one JSON-encoded entry per line, so that adding an entry does not require rewriting
+// all earlier entries. When a segment contains logSegmentSize entries a new segment is started.
+// The segments are listed, in order, in an index file in the same directory, along with the amount
+// of entries in each segment. As the index is not rewritten on each append, the amount of entries
+// in the last segment is determined from the segment itself when the index is loaded. The position
+// of an entry (its Index) is the amount of lines preceding it in the segments, so that a line that
+// is skipped when loading, e.g. the partial entry of an interrupted append, does not change the
+// positions of the entries after it.
+//
+// Earlier versions stored all log entries as a single JSON array in the logs file; this file
+// is converted to segments when the logs are first loaded.
+
+const (
+	logSegmentsDir  = "logsegments"
+	logIndexFile    = logSegmentsDir + "/index"
+	logSegmentSize  = 100
+	logSegmentNameF = "%010d"
+)
+
+// logIndex lists the log segments, oldest first.
+type logIndex struct {
+	Segments []*logSegment `json:"segments"`
+	// Number of the next segment to be created
+	Next int `json:"next"`
+}
+
+type logSegment struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func (s *storage) loadLogIndex() (*logIndex, error) {
+	if s.logIndex != nil {
+		return s.logIndex, nil
+	}
+	if s.memory == nil {
+		if err := fs.EnsureDirectoryExists(s.path(logSegmentsDir)); err != nil {
+			return nil, err
+		}
+	}
+	index := &logIndex{Segments: []*logSegment{}}
+	if err := s.load(index, logIndexFile); err != nil {
+		return nil, err
+	}
+	if err := s.migrateLogs(index); err != nil {
+		return nil, err
+	}
+	// Appending an entry does not store the index, so the count of the last segment (the only one
+	// that is appended to) is outdated if entries were appended to it since; so we recount it
+	if n := len(index.Segments); n > 0 {
+		_, lines, err := s.loadLogSegment(index.Segments[n-1])
+		if err != nil {
+			return nil, err
+		}
+		index.Segments[n-1].Count = lines
+	}
+	s.logIndex = index
+	return index, nil
+}
+
+// migrateLogs converts the logs file of earlier versions, if present, to segments.
+func (s *storage) migrateLogs(index *logIndex) error {
+	exists, err := s.fileExists(logsFile)
+	if err != nil || !exists {
+		return err
+	}
+	logs := []*LogEntry{}
+	if err = s.load(&logs, logsFile); err != nil {
+		return err
+	}
+	if err = s.writeLogs(index, logs); err != nil {
+		return err
+	}
+	return s.removeFile(logsFile)
+}
+
+// writeLogs replaces all segments with new ones containing the specified log entries.
+func (s *storage) writeLogs(index *logIndex, logs []*LogEntry) error {
+	old := index.Segments
+	index.Segments = []*logSegment{}
+	for i, entry := range logs {
+		entry.Index = i
+	}
+	for start := 0; start < len(logs); start += logSegmentSize {
+		end := start + logSegmentSize
+		if end > len(logs) {
+			end = len(logs)
+		}
+		if err := s.writeLogSegment(index.newSegment(), logs[start:end]); err != nil {
+			return err
+		}
+	}
+	if err := s.store(index, logIndexFile); err != nil {
+		return err
+	}
+	return s.removeLogSegments(old)
+}
+
+// writeLogSegment writes the log entries to the segment, which must not yet exist.
+func (s *storage) writeLogSegment(segment *logSegment, logs []*LogEntry) error {
+	var buf bytes.Buffer
+	for _, entry := range logs {
+		bts, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if bts, err = s.encryptLine(bts, logSegmentsDir+"/"+segment.Name); err != nil {
+			return err
+		}
+		buf.Write(bts)
+		buf.WriteByte('\n')
+	}
+	if err := s.writeFile(logSegmentsDir+"/"+segment.Name, buf.Bytes()); err != nil {
+		return err
+	}
+	segment.Count = len(logs)
+	return nil
+}
+
+// removeLogSegments removes the files of segments that are no longer in the index.
+func (s *storage) removeLogSegments(segments []*logSegment) error {
+	for _, segment := range segments {
+		if err := s.removeFile(logSegmentsDir + "/" + segment.Name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// count returns the amount of lines in the segments, i.e. the position of the next log entry.
+func (index *logIndex) count() int {
+	count := 0
+	for _, segment := range index.Segments {
+		count += segment.Count
+	}
+	return count
+}
+
+func (index *logIndex) newSegment() *logSegment {
+	segment := &logSegment{Name: fmt.Sprintf(logSegmentNameF, index.Next)}
+	index.Next++
+	index.Segments = append(index.Segments, segment)
+	return segment
+}
+
+// AppendLog appends the log entry to the last segment, starting a new segment if it is full.
+func (s *storage) AppendLog(entry *LogEntry) error {
+	index, err := s.loadLogIndex()
+	if err != nil {
+		return err
+	}
+	bts, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	entry.Index = index.count()
+
+	var segment *logSegment
+	if len(index.Segments) > 0 && index.Segments[len(index.Segments)-1].Count < logSegmentSize {
+		segment = index.Segments[len(index.Segments)-1]
+	} else {
+		segment = index.newSegment()
+		// Register the new segment in the index before writing to it
+		if err = s.store(index, logIndexFile); err != nil {
+			return err
+		}
+	}
+
+	if bts, err = s.encryptLine(bts, logSegmentsDir+"/"+segment.Name); err != nil {
+		return err
+	}
+	s.record(JournalAppend, logSegmentsDir+"/"+segment.Name, bts)
+	if s.memory != nil {
+		s.memory.append(logSegmentsDir+"/"+segment.Name, append(bts, '\n'))
+		segment.Count++
+		return nil
+	}
+	file, err := os.OpenFile(s.path(logSegmentsDir+"/"+segment.Name), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	// If an earlier append was interrupted, terminate its partial entry so that it is skipped when loading
+	bts = append(bts, '\n')
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			bts = append([]byte{'\n'}, bts...)
+		}
+	}
+	if _, err = file.Write(bts); err != nil {
+		// Part of the entry may have been written, so have the last segment recounted
+		_ = file.Close()
+		s.logIndex = nil
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	segment.Count++
+	return nil
+}
+
+// StoreLogs replaces all stored log entries with the specified ones.
+func (s *storage) StoreLogs(logs []*LogEntry) error {
+	index, err := s.loadLogIndex()
+	if err != nil {
+		return err
+	}
+	return s.writeLogs(index, logs)
+}
+
+// LoadLogs loads all log entries, oldest first.
+func (s *storage) LoadLogs() ([]*LogEntry, error) {
+	index, err := s.loadLogIndex()
+	if err != nil {
+		return nil, err
+	}
+	logs := []*LogEntry{}
+	start := 0 // position of the first entry of the current segment
+	for _, segment := range index.Segments {
+		entries, _, err := s.loadLogSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range segment.cap(entries) {
+			entry.Index += start
+			logs = append(logs, entry)
+		}
+		start += segment.Count
+	}
+	return logs, nil
+}
+
+// LoadNewestLogs loads at most max of the newest log entries, newest first.
+func (s *storage) LoadNewestLogs(max int) ([]*LogEntry, error) {
+	index, err := s.loadLogIndex()
+	if err != nil {
+		return nil, err
+	}
+	return s.loadLogsBefore(index, index.count(), max)
+}
+
+// LoadLogsBefore loads at most max of the log entries preceding the one at the specified position,
+// newest first.
+func (s *storage) LoadLogsBefore(before, max int) ([]*LogEntry, error) {
+	index, err := s.loadLogIndex()
+	if err != nil {
+		return nil, err
+	}
+	return s.loadLogsBefore(index, before, max)
+}
+
+// loadLogsBefore loads only the segments containing the requested log entries, starting at the last one.
+func (s *storage) loadLogsBefore(index *logIndex, before, max int) ([]*LogEntry, error) {
+	logs := []*LogEntry{}
+	if max <= 0 {
+		return logs, nil
+	}
+	err := s.eachLog(index, before, func(entry *LogEntry) (bool, error) {
+		logs = append(logs, entry)
+		return len(logs) < max, nil
+	})
+	return logs, err
+}
+
+// LogPosition returns the position that the next log entry will have.
+func (s *storage) LogPosition() (int, error) {
+	index, err := s.loadLogIndex()
+	if err != nil {
+		return 0, err
+	}
+	return index.count(), nil
+}
+
+// EachLogBefore calls f for each log entry preceding the one at the specified position, newest
+// first, until f returns false, loading one segment at a time.
+func (s *storage) EachLogBefore(before int, f func(entry *LogEntry) (bool, error)) error {
+	index, err := s.loadLogIndex()
+	if err != nil {
+		return err
+	}
+	return s.eachLog(index, before, f)
+}
+
+// eachLog calls f for each log entry preceding the one at the specified position, newest first,
+// until f returns false.
+func (s *storage) eachLog(index *logIndex, before int, f func(entry *LogEntry) (bool, error)) error {
+	end := index.count() // position of the entry following the current segment
+	for i := len(index.Segments) - 1; i >= 0; i-- {
+		start := end - index.Segments[i].Count
+		end = start
+		if start >= before {
+			continue
+		}
+		entries, _, err := s.loadLogSegment(index.Segments[i])
+		if err != nil {
+			return err
+		}
+		entries = index.Segments[i].cap(entries)
+		for j := len(entries) - 1; j >= 0; j-- {
+			if entries[j].Index += start; entries[j].Index >= before {
+				continue
+			}
+			if more, err := f(entries[j]); err != nil || !more {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cap returns the entries at positions within the amount of lines of the segment in the index.
+// Only the last segment is appended to, and its count is determined when loading the index, so
+// other entries should not exist; but as the positions of the entries of the following segments
+// depend on the count, we never return entries beyond it.
+func (segment *logSegment) cap(entries []*LogEntry) []*LogEntry {
+	for i, entry := range entries {
+		if entry.Index >= segment.Count {
+			return entries[:i]
+		}
+	}
+	return entries
+}
+
+// loadLogSegment returns the entries of the segment, with their position within the segment as
+// Index, and the amount of (nonempty) lines in the segment.
+func (s *storage) loadLogSegment(segment *logSegment) ([]*LogEntry, int, error) {
+	file := logSegmentsDir + "/" + segment.Name
+	bts, err := s.readFile(file)
+	if err != nil || bts == nil {
+		return nil, 0, err
+	}
+
+	entries := []*LogEntry{}
+	lines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(bts))
+	scanner.Buffer(make([]byte, 64*1024), len(bts)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		lines++
+		if line, err = s.decryptLine(line, file); err == ErrStorageEncrypted {
+			return nil, 0, err
+		}
+		entry := &LogEntry{Index: lines - 1}
+		if err != nil || json.Unmarshal(line, entry) != nil {
+			// An interrupted append may have left a partial entry, which we skip
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return entries, lines, nil
+}
@@ -0,0 +1,95 @@
+package irmaclient
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// This file contains the in-memory storage of the client, with which nothing is written to disk:
+// when New() is passed WithInMemoryStorage(), the files that the client would otherwise store in
+// its storage path are kept in memory, and the irma_configuration folder is parsed read-only from
+// the irmaConfigurationPath without copying it, so scheme updates are not available. Everything is
+// lost when the client is discarded, which is useful for tests, demos and incognito wallets.
+
+// WithInMemoryStorage keeps the storage of the client in memory instead of in the storage path,
+// which may then be empty. It cannot be combined with WithSQLiteStorage().
+func WithInMemoryStorage() Option {
+	return func(o *options) {
+		o.memory = true
+	}
+}
+
+// memoryFiles contains the files of in-memory storage, by their name within the storage path.
+type memoryFiles struct {
+	files map[string][]byte
+	sync.Mutex
+}
+
+func newMemoryFiles() *memoryFiles {
+	return &memoryFiles{files: map[string][]byte{}}
+}
+
+func (m *memoryFiles) read(file string) ([]byte, bool) {
+	m.Lock()
+	defer m.Unlock()
+	bts, exists := m.files[file]
+	return append([]byte(nil), bts...), exists
+}
+
+func (m *memoryFiles) write(file string, bts []byte) {
+	m.Lock()
+	defer m.Unlock()
+	m.files[file] = append([]byte(nil), bts...)
+}
+
+func (m *memoryFiles) append(file string, bts []byte) {
+	m.Lock()
+	defer m.Unlock()
+	m.files[file] = append(m.files[file], bts...)
+}
+
+func (m *memoryFiles) remove(file string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, exists := m.files[file]; !exists {
+		return &os.PathError{Op: "remove", Path: file, Err: os.ErrNotExist}
+	}
+	delete(m.files, file)
+	return nil
+}
+
+// wipe overwrites the file with zeros and removes it.
+func (m *memoryFiles) wipe(file string) error {
+	m.Lock()
+	bts := m.files[file]
+	for i := range bts {
+		bts[i] = 0
+	}
+	m.Unlock()
+	return m.remove(file)
+}
+
+// list returns the names and sizes of the files in the specified directory.
+func (m *memoryFiles) list(dir string) map[string]int64 {
+	m.Lock()
+	defer m.Unlock()
+	files := map[string]int64{}
+	for file, bts := range m.files {
+		if strings.HasPrefix(file, dir+"/") {
+			files[strings.TrimPrefix(file, dir+"/")] = int64(len(bts))
+		}
+	}
+	return files
+}
+
+// sizes returns the sizes of all files.
+func (m *memoryFiles) sizes() map[string]int64 {
+	m.Lock()
+	defer m.Unlock()
+	sizes := make(map[string]int64, len(m.files))
+	for file, bts := range m.files {
+		sizes[file] = int64(len(bts))
+	}
+	return sizes
+}
@@ -0,0 +1,270 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the versioning of the storage schema of the Client, and the migrations
+// that bring storage of earlier versions up to date.
+//
+// The version of the storage schema is the amount of migrations that have been applied to it, and
+// is stored, along with the history of the applied migrations, in the schemaFile. This file is never
+// encrypted, so that the version can be checked before anything else is loaded: if the storage has a
+// newer version than this version of irmaclient knows about, New() refuses to open it with an
+// *StorageTooNewError, instead of misinterpreting it. PendingMigrations() reports which migrations
+// New() would apply to a storage, without applying them.
+//
+// To change the storage format, append a migration to the migrations registry below; never remove
+// or reorder migrations (replace migrations that are no longer necessary by a nil Migrate function).
+// Storage created before the schemaFile existed has its version derived from the updatesFile, in
+// which the migrations were previously recorded.
+
+const schemaFile = "schema"
+
+// Migration is a forward migration of the storage schema.
+type Migration struct {
+	// Version of the storage schema after the migration
+	Version     int
+	Description string
+	// Performs the migration; nil if it is no longer necessary
+	Migrate func(client *Client) error `json:"-"`
+}
+
+// migrations is the registry of storage migrations, in order of version.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Convert old cardemu.xml Android storage to our own storage format",
+		Migrate:     nil, // No longer necessary as the Android app was deprecated long ago
+	},
+	{
+		// Check the signatures of all scheme managers, if any is not ok,
+		// copy the entire irma_configuration folder from assets
+		Version:     2,
+		Description: "Add scheme manager index, signature and public key",
+		Migrate:     nil, // made irrelevant by irma_configuration-autocopying
+	},
+	{
+		Version:     3,
+		Description: "Rename config to preferences",
+		Migrate: func(client *Client) (err error) {
+			exists, err := client.storage.fileExists("config")
+			if !exists || err != nil {
+				return
+			}
+			oldStruct := &struct {
+				SendCrashReports bool
+			}{}
+			// Load old file, convert to new struct, and save
+			err = client.storage.load(oldStruct, "config")
+			if err != nil {
+				return err
+			}
+			client.Preferences = Preferences{
+				EnableCrashReporting: oldStruct.SendCrashReports,
+			}
+			return client.storage.StorePreferences(client.Preferences)
+		},
+	},
+	{
+		Version:     4,
+		Description: "Copy new irma_configuration out of assets",
+		Migrate:     nil, // made irrelevant by irma_configuration-autocopying
+	},
+	{
+		Version:     5,
+		Description: "Include in each keyshare server the identifier of its scheme manager",
+		Migrate: func(client *Client) (err error) {
+			keyshareServers, err := client.storage.LoadKeyshareServers()
+			if err != nil {
+				return err
+			}
+			for smi, kss := range keyshareServers {
+				kss.SchemeManagerIdentifier = smi
+			}
+			return client.storage.StoreKeyshareServers(keyshareServers)
+		},
+	},
+	{
+		Version:     6,
+		Description: "Remove the test scheme manager which was erroneously included in a production build",
+		Migrate:     nil, // No longer necessary, also broke many unit tests
+	},
+	{
+		Version:     7,
+		Description: "Remove earlier log items of wrong format",
+		Migrate: func(client *Client) (err error) {
+			return client.storage.StoreLogs([]*LogEntry{})
+		},
+	},
+}
+
+// StorageTooNewError is returned by New() if the storage has a newer schema version than
+// this version of irmaclient supports, i.e. if it was used by a newer version of the app.
+type StorageTooNewError struct {
+	Version   int
+	Supported int
+}
+
+func (e *StorageTooNewError) Error() string {
+	return fmt.Sprintf("Storage has schema version %d, but at most %d is supported", e.Version, e.Supported)
+}
+
+// storageSchema is the contents of the schemaFile.
+type storageSchema struct {
+	Version int               `json:"version"`
+	History []migrationResult `json:"history"`
+	// Whether or not the wallet lock is enabled, see walletlock.go
+	WalletLock bool `json:"walletLock,omitempty"`
+	// Whether or not the storage is encrypted, see encryption.go
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+type migrationResult struct {
+	When    irma.Timestamp
+	Number  int // index of the migration in the registry, i.e. its Version minus one
+	Success bool
+	Error   *string
+}
+
+func currentSchemaVersion() int {
+	return len(migrations)
+}
+
+// loadSchema loads the storage schema, or returns nil if the storage does not yet have a schemaFile.
+func (s *storage) loadSchema() (*storageSchema, error) {
+	bts, err := s.readFile(schemaFile)
+	if err != nil || bts == nil {
+		return nil, err
+	}
+	if bts, err = verifyChecksum(bts, schemaFile); err != nil {
+		return nil, err
+	}
+	schema := &storageSchema{}
+	if err = json.Unmarshal(bts, schema); err != nil {
+		return nil, &StorageCorruptionError{File: schemaFile, Err: err}
+	}
+	return schema, nil
+}
+
+// storeSchema stores the storage schema, unencrypted.
+func (s *storage) storeSchema(schema *storageSchema) error {
+	bts, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(schemaFile, addChecksum(bts))
+}
+
+// checkSchemaVersion refuses storage with a newer schema version than is supported.
+func (s *storage) checkSchemaVersion() error {
+	schema, err := s.loadSchema()
+	if err != nil {
+		return err
+	}
+	if schema != nil && schema.Version > currentSchemaVersion() {
+		return &StorageTooNewError{Version: schema.Version, Supported: currentSchemaVersion()}
+	}
+	return nil
+}
+
+// schema returns the storage schema, deriving it from the legacy updatesFile or from the
+// absence of a secret key (in case of new storage, which needs no migrations) if necessary.
+func (s *storage) schema() (*storageSchema, error) {
+	schema, err := s.loadSchema()
+	if err != nil || schema != nil {
+		return schema, err
+	}
+	schema = &storageSchema{}
+	legacy, err := s.fileExists(updatesFile)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		updates := []migrationResult{}
+		if err = s.load(&updates, updatesFile); err != nil {
+			return nil, err
+		}
+		schema.Version = legacySchemaVersion(updates)
+		schema.History = updates
+		return schema, nil
+	}
+	existing, err := s.fileExists(skFile)
+	if err != nil {
+		return nil, err
+	}
+	if !existing {
+		schema.Version = currentSchemaVersion()
+	}
+	return schema, nil
+}
+
+// legacySchemaVersion derives the schema version from the migrations recorded in the legacy
+// updatesFile. Failed migrations were recorded as well, so the version is the amount of leading
+// migrations that succeeded; later ones are (re)applied.
+func legacySchemaVersion(updates []migrationResult) int {
+	succeeded := map[int]bool{}
+	for _, update := range updates {
+		if update.Success {
+			succeeded[update.Number] = true
+		}
+	}
+	version := 0
+	for succeeded[version] {
+		version++
+	}
+	return version
+}
+
+// PendingMigrations returns the migrations that New() would apply to the storage at the specified
+// path, without applying them, or an *StorageTooNewError if the storage is too new to be opened.
+func PendingMigrations(storagePath string) ([]Migration, error) {
+	s := &storage{storagePath: storagePath}
+	if err := s.checkSchemaVersion(); err != nil {
+		return nil, err
+	}
+	schema, err := s.schema() // fails with ErrStorageEncrypted if a legacy updatesFile is encrypted
+	if err != nil {
+		return nil, err
+	}
+	return append([]Migration{}, migrations[schema.Version:]...), nil
+}
+
+// migrate applies the migrations that have not yet been applied to the storage,
+// recording them in the schemaFile.
+func (client *Client) migrate() (err error) {
+	span := irma.StartSpan("irmaclient.migrate")
+	defer func() { span.End(err) }()
+
+	schema, err := client.storage.schema()
+	if err != nil {
+		return err
+	}
+	for ; schema.Version < currentSchemaVersion(); schema.Version++ {
+		m := migrations[schema.Version]
+		if m.Migrate != nil {
+			err = m.Migrate(client)
+		}
+		result := migrationResult{
+			When:    irma.Timestamp(time.Now()),
+			Number:  schema.Version,
+			Success: err == nil,
+		}
+		if err != nil {
+			str := err.Error()
+			result.Error = &str
+		}
+		schema.History = append(schema.History, result)
+		if err != nil {
+			break // retried the next time
+		}
+	}
+	if storeErr := client.storage.storeSchema(schema); storeErr != nil {
+		return storeErr
+	}
+	return err
+}
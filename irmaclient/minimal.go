@@ -0,0 +1,120 @@
+package irmaclient
+
+import (
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the minimal disclosure optimizer, which selects from the candidates of each
+// disjunction of a disclosure request the choice that reveals the least information about the
+// user. Its choice is suggested to the user by default in the permission prompt (see the Choice of
+// the session request passed to the Handler). Choices are compared by, in this order:
+//  1. the amount of disclosed attributes flagged as sensitive in the scheme (see AttributeType.Sensitive);
+//  2. the amount of disclosed attribute values, where disjunctions satisfied by the mere presence of a
+//     credential disclose no value, and an attribute chosen for multiple disjunctions counts once;
+//  3. the amount of credentials out of which attributes are disclosed, as the metadata of each of
+//     them (e.g. its expiry date) is disclosed as well.
+// Among equally minimal choices, the candidates are preferred in the order of CheckSatisfiability()
+// (i.e. newest credentials first). When there are too many combinations of candidates to consider
+// them all, the disjunctions are decided one after another instead.
+
+// minimalDisclosureMaxChoices is the maximum amount of combinations of candidates that
+// MinimalDisclosure() considers.
+const minimalDisclosureMaxChoices = 4096
+
+// disclosureCost is the information revealed by a disclosure choice; see above.
+type disclosureCost struct {
+	sensitive, values, credentials int
+}
+
+func (c disclosureCost) less(o disclosureCost) bool {
+	if c.sensitive != o.sensitive {
+		return c.sensitive < o.sensitive
+	}
+	if c.values != o.values {
+		return c.values < o.values
+	}
+	return c.credentials < o.credentials
+}
+
+// MinimalDisclosure returns the choice of candidates, one for each disjunction, that discloses the
+// least information, or nil if a disjunction has no candidates.
+func (client *Client) MinimalDisclosure(candidates [][]*irma.AttributeIdentifier) *irma.DisclosureChoice {
+	combinations := 1
+	for _, list := range candidates {
+		if len(list) == 0 {
+			return nil
+		}
+		if combinations <= minimalDisclosureMaxChoices {
+			combinations *= len(list)
+		}
+	}
+
+	choice := make([]*irma.AttributeIdentifier, len(candidates))
+	if combinations <= minimalDisclosureMaxChoices {
+		var best []*irma.AttributeIdentifier
+		var bestCost disclosureCost
+		client.minimalDisclosureSearch(candidates, choice, 0, &best, &bestCost)
+		choice = best
+	} else {
+		for i, list := range candidates {
+			best, bestCost := list[0], disclosureCost{}
+			for j, candidate := range list {
+				choice[i] = candidate
+				if cost := client.disclosureCost(choice[:i+1]); j == 0 || cost.less(bestCost) {
+					best, bestCost = candidate, cost
+				}
+			}
+			choice[i] = best
+		}
+	}
+	return &irma.DisclosureChoice{Attributes: choice}
+}
+
+// minimalDisclosureSearch tries all candidates for the disjunctions from index i onwards, keeping
+// the first choice with the lowest cost in best.
+func (client *Client) minimalDisclosureSearch(
+	candidates [][]*irma.AttributeIdentifier,
+	choice []*irma.AttributeIdentifier,
+	i int,
+	best *[]*irma.AttributeIdentifier,
+	bestCost *disclosureCost,
+) {
+	if i == len(candidates) {
+		if cost := client.disclosureCost(choice); *best == nil || cost.less(*bestCost) {
+			*best = append([]*irma.AttributeIdentifier{}, choice...)
+			*bestCost = cost
+		}
+		return
+	}
+	for _, candidate := range candidates[i] {
+		choice[i] = candidate
+		client.minimalDisclosureSearch(candidates, choice, i+1, best, bestCost)
+	}
+}
+
+// disclosureCost computes the information revealed by disclosing the specified attributes.
+func (client *Client) disclosureCost(attributes []*irma.AttributeIdentifier) disclosureCost {
+	cost := disclosureCost{}
+	credentials := map[irma.CredentialIdentifier]struct{}{}
+	values := map[irma.AttributeIdentifier]struct{}{}
+	for _, attr := range attributes {
+		credentials[attr.CredentialIdentifier()] = struct{}{}
+		if attr.Type.IsCredential() {
+			continue
+		}
+		if _, disclosed := values[*attr]; disclosed {
+			continue
+		}
+		values[*attr] = struct{}{}
+		credtype := client.Configuration.CredentialTypes[attr.Type.CredentialTypeIdentifier()]
+		if credtype == nil {
+			continue
+		}
+		if attrtype := credtype.AttributeType(attr.Type); attrtype != nil && attrtype.Sensitive {
+			cost.sensitive++
+		}
+	}
+	cost.values = len(values)
+	cost.credentials = len(credentials)
+	return cost
+}
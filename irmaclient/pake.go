@@ -0,0 +1,178 @@
+package irmaclient
+
+import (
+	"crypto/x509"
+	"net/http"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	gabibig "github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the protocols with which the client registers and proves knowledge of the PIN
+// at keyshare servers. Originally the client sends a salted hash of the PIN (see HashedPin()), which
+// anyone obtaining it (e.g. from the logs or database of the keyshare server) can brute-force offline,
+// PINs being short. Keyshare servers supporting version 3 of the keyshare protocol instead support
+// the PAKE of pake.go in the irma package (implemented for keyshare servers by server/keyshare):
+//
+// - Registration (when enrolling, enrolling a device, or changing the PIN): the client posts the
+//   blinded PIN to client/register/oprf, receiving the evaluation of the OPRF under a fresh OPRF key
+//   along with an identifier for the registration. From this it derives an ECDSA key pair, sending
+//   its public key along with the registration identifier to the keyshare server.
+// - Verification: the client again posts the blinded PIN, now to users/verify/pin/start, receiving
+//   the evaluation of the OPRF and a challenge. It derives the private key as above, and signs the
+//   challenge.
+//
+// Which protocol is used for a keyshare account is negotiated when enrolling, recorded in the
+// keyshareServer, and announced to the keyshare server in the kssVersionHeader. If the keyshare
+// server does not support version 3, enrolling fails with ErrPakeUnsupported, unless the client was
+// created with WithHashedPinFallback(), in which case the hashed PIN is used until the PIN is changed
+// after the keyshare server starts supporting the PAKE. Accounts using the PAKE never switch back.
+
+const (
+	kssVersionHashedPin = 2
+	kssVersionPake      = 3
+)
+
+// ErrPakeUnsupported is returned when registering a PIN at a keyshare server that does not support
+// the PAKE, if the client was not created with WithHashedPinFallback().
+var ErrPakeUnsupported = errors.New("Keyshare server does not support the PAKE")
+
+// WithHashedPinFallback allows registering the hashed PIN at keyshare servers that do not support
+// the PAKE, which lets anyone obtaining it brute-force the PIN offline.
+func WithHashedPinFallback() Option {
+	return func(o *options) {
+		o.hashedPinFallback = true
+	}
+}
+
+// pinProtocol registers and proves knowledge of the PIN at a keyshare server.
+type pinProtocol interface {
+	// register returns the registration of the PIN, to be included in the enrollment or PIN change
+	register(kss *keyshareServer, transport *irma.HTTPTransport, pin string) (*pinRegistration, error)
+	// prove returns a proof of knowledge of the PIN, to be included in the PIN verification or change
+	prove(kss *keyshareServer, transport *irma.HTTPTransport, pin string) (*pinProof, error)
+}
+
+var pinProtocols = map[int]pinProtocol{
+	kssVersionHashedPin: hashedPinProtocol{},
+	kssVersionPake:      pakeProtocol{},
+}
+
+type pinRegistration struct {
+	Pin    string           `json:"pin,omitempty"`
+	Record *irma.PakeRecord `json:"pinRecord,omitempty"`
+}
+
+type pinProof struct {
+	Pin   string `json:"pin,omitempty"`
+	Proof []byte `json:"proof,omitempty"`
+}
+
+// protocolVersion returns the version of the keyshare protocol used with the keyshare server.
+func (ks *keyshareServer) protocolVersion() int {
+	if ks.PinProtocol == 0 {
+		return kssVersionHashedPin
+	}
+	return ks.PinProtocol
+}
+
+func (ks *keyshareServer) pinProtocol() (pinProtocol, error) {
+	protocol, ok := pinProtocols[ks.protocolVersion()]
+	if !ok {
+		return nil, errors.Errorf("Unsupported keyshare protocol version %d", ks.protocolVersion())
+	}
+	return protocol, nil
+}
+
+// setVersionHeader announces the keyshare protocol version used with the keyshare server.
+func (ks *keyshareServer) setVersionHeader(transport *irma.HTTPTransport) {
+	transport.SetHeader(kssVersionHeader, strconv.Itoa(ks.protocolVersion()))
+}
+
+// allowHashedPin returns whether the hashed PIN may be registered for the keyshare account if
+// the keyshare server does not support the PAKE.
+func (client *Client) allowHashedPin(kss *keyshareServer) bool {
+	return client.hashedPinFallback && kss.protocolVersion() < kssVersionPake
+}
+
+// registerPin registers the PIN using the PAKE, returning the keyshare protocol version that is to be
+// used from now on. If the keyshare server does not support the PAKE, the hashed PIN is registered
+// if allowHashedPin is set, and ErrPakeUnsupported is returned otherwise.
+func registerPin(kss *keyshareServer, transport *irma.HTTPTransport, pin string, allowHashedPin bool) (*pinRegistration, int, error) {
+	registration, err := pakeProtocol{}.register(kss, transport, pin)
+	if err == nil {
+		return registration, kssVersionPake, nil
+	}
+	if serr, ok := err.(*irma.SessionError); !ok ||
+		(serr.RemoteStatus != http.StatusNotFound && serr.RemoteStatus != http.StatusMethodNotAllowed) {
+		return nil, 0, err
+	}
+	if !allowHashedPin {
+		return nil, 0, ErrPakeUnsupported
+	}
+	irma.Logger.Warnf("Keyshare server of %s does not support the PAKE, registering hashed PIN", kss.SchemeManagerIdentifier)
+	registration, err = hashedPinProtocol{}.register(kss, transport, pin)
+	return registration, kssVersionHashedPin, err
+}
+
+// hashedPinProtocol sends the salted hash of the PIN.
+type hashedPinProtocol struct{}
+
+func (hashedPinProtocol) register(kss *keyshareServer, _ *irma.HTTPTransport, pin string) (*pinRegistration, error) {
+	return &pinRegistration{Pin: kss.HashedPin(pin)}, nil
+}
+
+func (hashedPinProtocol) prove(kss *keyshareServer, _ *irma.HTTPTransport, pin string) (*pinProof, error) {
+	return &pinProof{Pin: kss.HashedPin(pin)}, nil
+}
+
+// pakeProtocol is the PAKE described above.
+type pakeProtocol struct{}
+
+func (pakeProtocol) register(kss *keyshareServer, transport *irma.HTTPTransport, pin string) (*pinRegistration, error) {
+	blinding, err := irma.NewPakeBlinding(kss.Nonce, pin)
+	if err != nil {
+		return nil, err
+	}
+	res := &irma.PakeOprfResponse{}
+	if err = transport.Post("client/register/oprf", res, irma.PakeOprfRequest{Blinded: blinding.Blinded}); err != nil {
+		return nil, err
+	}
+	sk, err := blinding.Key(res.Evaluated)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeInt(gabibig.Convert(sk.D))
+	pk, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &pinRegistration{Record: &irma.PakeRecord{Registration: res.Registration, PublicKey: pk}}, nil
+}
+
+func (pakeProtocol) prove(kss *keyshareServer, transport *irma.HTTPTransport, pin string) (*pinProof, error) {
+	blinding, err := irma.NewPakeBlinding(kss.Nonce, pin)
+	if err != nil {
+		return nil, err
+	}
+	res := &irma.PakeOprfResponse{}
+	req := irma.PakeOprfRequest{Username: kss.Username, Blinded: blinding.Blinded}
+	if err = transport.Post("users/verify/pin/start", res, req); err != nil {
+		return nil, err
+	}
+	if len(res.Challenge) == 0 {
+		return nil, errors.New("Keyshare server sent no PIN challenge")
+	}
+	sk, err := blinding.Key(res.Evaluated)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeInt(gabibig.Convert(sk.D))
+	sig, err := irma.SignPakeChallenge(sk, res.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	return &pinProof{Proof: sig}, nil
+}
@@ -0,0 +1,303 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server/keyshare"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKeyshareServer implements the PIN endpoints of a keyshare server for a single account,
+// supporting the PAKE of pake.go if pake is set, and token refreshing if refresh is set.
+// It also implements the device management endpoints of keyshare_devices.go.
+type fakeKeyshareServer struct {
+	t       *testing.T
+	pake    bool
+	refresh bool
+
+	// Account state: either the hashed PIN, or the registration of the PAKE
+	hashedPin string
+	account   *keyshare.PinAccount
+
+	verifier *keyshare.Pake
+	versions []string
+
+	// Devices registered to the account, and the current pairing code
+	devices []*KeyshareDevice
+	pairing string
+
+	// Token that the account management endpoints accept, "token" if empty
+	token string
+	info  *KeyshareAccountInfo
+}
+
+func (s *fakeKeyshareServer) start() *httptest.Server {
+	s.verifier = keyshare.NewPake()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.versions = append(s.versions, r.Header.Get(kssVersionHeader))
+		if !s.pake && (r.URL.Path == "/client/register/oprf" || r.URL.Path == "/users/verify/pin/start") ||
+			!s.refresh && r.URL.Path == "/users/refresh" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var res interface{}
+		switch r.URL.Path {
+		case "/client/register/oprf":
+			req := &irma.PakeOprfRequest{}
+			require.NoError(s.t, json.NewDecoder(r.Body).Decode(req))
+			var err error
+			res, err = s.verifier.StartRegistration(req)
+			require.NoError(s.t, err)
+		case "/users/verify/pin/start":
+			req := &irma.PakeOprfRequest{}
+			require.NoError(s.t, json.NewDecoder(r.Body).Decode(req))
+			require.NotNil(s.t, s.account)
+			var err error
+			res, err = s.verifier.StartVerification(s.account, req)
+			require.NoError(s.t, err)
+		case "/users/verify/pin":
+			req := &keysharePinMessage{}
+			require.NoError(s.t, json.NewDecoder(r.Body).Decode(req))
+			res = s.status(s.verify(req.Username, req.Pin, req.Proof))
+		case "/users/refresh":
+			req := &keyshareTokenRefresh{}
+			require.NoError(s.t, json.NewDecoder(r.Body).Decode(req))
+			ok := r.Header.Get(kssAuthHeader) == "Bearer token"
+			res = s.status(ok)
+			if ok {
+				res.(*keysharePinStatus).Message = "refreshed"
+			}
+		case "/users/change/pin":
+			req := &keyshareChangepin{}
+			require.NoError(s.t, json.NewDecoder(r.Body).Decode(req))
+			ok := s.verify(req.Username, req.OldPin, req.OldPinProof)
+			if ok {
+				s.enroll(&pinRegistration{Pin: req.NewPin, Record: req.NewPinRecord})
+			}
+			res = s.status(ok)
+		case "/users/devices":
+			if !s.authorized(w, r) {
+				return
+			}
+			res = s.devices
+		case "/users/devices/revoke":
+			if !s.authorized(w, r) {
+				return
+			}
+			req := &keyshareDeviceRevocation{}
+			require.NoError(s.t, json.NewDecoder(r.Body).Decode(req))
+			for i, device := range s.devices {
+				if device.ID == req.ID {
+					s.devices = append(s.devices[:i], s.devices[i+1:]...)
+					break
+				}
+			}
+			res = "OK"
+		case "/users/devices/pairing":
+			if !s.authorized(w, r) {
+				return
+			}
+			s.pairing = "pairing" + strconv.Itoa(len(s.devices))
+			res = &KeysharePairing{Code: s.pairing}
+		case "/client/register/device":
+			req := &keyshareDeviceEnrollment{}
+			require.NoError(s.t, json.NewDecoder(r.Body).Decode(req))
+			if s.pairing == "" || req.PairingCode != s.pairing {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			s.pairing = ""
+			res = &keyshareDeviceEnrollmentResult{DeviceID: strconv.Itoa(len(s.devices) + 1)}
+		case "/users/info":
+			if !s.authorized(w, r) {
+				return
+			}
+			res = s.info
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		bts, err := json.Marshal(res)
+		require.NoError(s.t, err)
+		_, _ = w.Write(bts)
+	}))
+}
+
+func (s *fakeKeyshareServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := s.token
+	if token == "" {
+		token = "token"
+	}
+	if r.Header.Get(kssAuthHeader) != "Bearer "+token {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (s *fakeKeyshareServer) enroll(registration *pinRegistration) {
+	if registration.Record == nil {
+		s.hashedPin, s.account = registration.Pin, nil
+		return
+	}
+	require.Empty(s.t, registration.Pin)
+	account, err := s.verifier.FinishRegistration(registration.Record)
+	require.NoError(s.t, err)
+	s.hashedPin, s.account = "", account
+}
+
+func (s *fakeKeyshareServer) verify(username, pin string, proof []byte) bool {
+	if s.account == nil {
+		return pin != "" && pin == s.hashedPin
+	}
+	require.Empty(s.t, pin)
+	ok, err := s.verifier.Verify(username, s.account, proof)
+	require.NoError(s.t, err)
+	return ok
+}
+
+func (s *fakeKeyshareServer) status(ok bool) *keysharePinStatus {
+	if ok {
+		return &keysharePinStatus{Status: kssPinSuccess, Message: "token"}
+	}
+	return &keysharePinStatus{Status: kssPinFailure, Message: "2"}
+}
+
+func TestPakePin(t *testing.T) {
+	fake := &fakeKeyshareServer{t: t, pake: true}
+	srv := fake.start()
+	defer srv.Close()
+
+	kss, err := newKeyshareServer(irma.NewSchemeManagerIdentifier("test"))
+	require.NoError(t, err)
+	transport := irma.NewHTTPTransport(srv.URL)
+	registration, version, err := registerPin(kss, transport, "12345", false)
+	require.NoError(t, err)
+	require.Equal(t, kssVersionPake, version)
+	require.Empty(t, registration.Pin)
+	fake.enroll(registration)
+	kss.PinProtocol = version
+
+	success, tries, _, err := verifyPinWorker("54321", kss, irma.NewHTTPTransport(srv.URL))
+	require.NoError(t, err)
+	require.False(t, success)
+	require.Equal(t, 2, tries)
+	success, _, _, err = verifyPinWorker("12345", kss, irma.NewHTTPTransport(srv.URL))
+	require.NoError(t, err)
+	require.True(t, success)
+	require.Equal(t, "3", fake.versions[len(fake.versions)-1])
+
+	// Challenges can be used only once
+	_, err = fake.verifier.Verify(kss.Username, fake.account, nil)
+	require.Error(t, err)
+}
+
+func TestPakePinFallback(t *testing.T) {
+	fake := &fakeKeyshareServer{t: t}
+	srv := fake.start()
+	defer srv.Close()
+
+	kss, err := newKeyshareServer(irma.NewSchemeManagerIdentifier("test"))
+	require.NoError(t, err)
+	// Falling back to the hashed PIN must be allowed explicitly
+	_, _, err = registerPin(kss, irma.NewHTTPTransport(srv.URL), "12345", false)
+	require.Equal(t, ErrPakeUnsupported, err)
+
+	registration, version, err := registerPin(kss, irma.NewHTTPTransport(srv.URL), "12345", true)
+	require.NoError(t, err)
+	require.Equal(t, kssVersionHashedPin, version)
+	require.Equal(t, kss.HashedPin("12345"), registration.Pin)
+	require.Nil(t, registration.Record)
+	fake.enroll(registration)
+
+	success, _, _, err := verifyPinWorker("12345", kss, irma.NewHTTPTransport(srv.URL))
+	require.NoError(t, err)
+	require.True(t, success)
+	require.Equal(t, "2", fake.versions[len(fake.versions)-1])
+}
+
+func TestPakePinUpgrade(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	fake := &fakeKeyshareServer{t: t, pake: true}
+	srv := fake.start()
+	defer srv.Close()
+
+	manager := irma.NewSchemeManagerIdentifier("test")
+	client.Configuration.SchemeManagers[manager].KeyshareServer = srv.URL
+	kss := client.keyshareServers[manager]
+	require.Equal(t, kssVersionHashedPin, kss.protocolVersion())
+	fake.enroll(&pinRegistration{Pin: kss.HashedPin("12345")})
+
+	// Changing the PIN at a keyshare server supporting the PAKE switches to the PAKE
+	require.NoError(t, client.keyshareChangePinWorker(manager, "12345", "54321"))
+	require.Equal(t, kssVersionPake, kss.protocolVersion())
+	require.NotNil(t, fake.account)
+	success, _, _, err := verifyPinWorker("54321", kss, irma.NewHTTPTransport(srv.URL))
+	require.NoError(t, err)
+	require.True(t, success)
+
+	ksses, err := client.storage.LoadKeyshareServers()
+	require.NoError(t, err)
+	require.Equal(t, kssVersionPake, ksses[manager].PinProtocol)
+
+	// Accounts using the PAKE never switch back to the hashed PIN
+	client.hashedPinFallback = true
+	require.False(t, client.allowHashedPin(kss))
+}
+
+func TestKeyshareTokenRefresh(t *testing.T) {
+	fake := &fakeKeyshareServer{t: t, refresh: true}
+	srv := fake.start()
+	defer srv.Close()
+
+	kss, err := newKeyshareServer(irma.NewSchemeManagerIdentifier("test"))
+	require.NoError(t, err)
+	transport := irma.NewHTTPTransport(srv.URL)
+	require.False(t, refreshToken(kss, transport))
+
+	kss.token.set("token")
+	transport.SetHeader(kssAuthHeader, kss.authorization())
+	require.True(t, refreshToken(kss, transport))
+	require.Equal(t, "refreshed", string(kss.token))
+	// The keyshare server refuses to refresh the token again
+	require.False(t, refreshToken(kss, transport))
+	require.Equal(t, "refreshed", string(kss.token))
+
+	// Keyshare servers not supporting this respond with 404
+	fake.refresh = false
+	kss.token.set("token")
+	transport.SetHeader(kssAuthHeader, kss.authorization())
+	require.False(t, refreshToken(kss, transport))
+	require.Equal(t, "token", string(kss.token))
+}
+
+func TestKeyshareRetries(t *testing.T) {
+	fake := &fakeKeyshareServer{t: t}
+	srv := fake.start()
+	var x string
+	apierr := irma.NewHTTPTransport(srv.URL).Post("nonexisting", &x, nil)
+	srv.Close()
+	transporterr := irma.NewHTTPTransport(srv.URL).Post("users/verify/pin", &x, nil)
+
+	ks := &keyshareSession{}
+	// Errors returned by the keyshare server are never retried
+	require.Error(t, apierr)
+	require.False(t, ks.retryable(apierr))
+	require.False(t, ks.retryable(errors.New("not a session error")))
+
+	// Transport errors are retried at most kssMaxRetries times per session
+	require.IsType(t, &irma.SessionError{}, transporterr)
+	require.Equal(t, irma.ErrorTransport, transporterr.(*irma.SessionError).ErrorType)
+	for i := 0; i < kssMaxRetries; i++ {
+		require.True(t, ks.retryable(transporterr))
+	}
+	require.False(t, ks.retryable(transporterr))
+}
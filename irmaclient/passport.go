@@ -0,0 +1,48 @@
+package irmaclient
+
+import (
+	"encoding/json"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// ExportAttributePassport starts a session creating an attribute passport (see irma.AttributePassport)
+// for the specified recipient, disclosing the specified attributes. As in other signature sessions,
+// the handler is asked for permission and which attributes to disclose. When the session succeeds,
+// the Success() method of the handler receives the attribute passport as JSON, suitable for writing
+// to a file that the user can send to the recipient.
+func (client *Client) ExportAttributePassport(
+	attributes []irma.AttributeTypeIdentifier, recipient, note string, handler Handler,
+) SessionDismisser {
+	request, err := irma.NewAttributePassportRequest(attributes, recipient, note)
+	if err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return nil
+	}
+	return client.newManualSession(request, &passportHandler{Handler: handler}, irma.ActionSigning)
+}
+
+// passportHandler wraps the Handler of an attribute passport session, converting the
+// attribute-based signature resulting from the session into an attribute passport.
+type passportHandler struct {
+	Handler
+}
+
+func (h *passportHandler) Success(result string) {
+	signature := &irma.SignedMessage{}
+	if err := json.Unmarshal([]byte(result), signature); err != nil {
+		h.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return
+	}
+	passport, err := irma.NewAttributePassport(signature)
+	if err != nil {
+		h.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return
+	}
+	bts, err := json.Marshal(passport)
+	if err != nil {
+		h.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return
+	}
+	h.Handler.Success(string(bts))
+}
@@ -0,0 +1,252 @@
+package irmaclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains a policy engine for automated uses of the client (e.g. kiosks or IoT devices),
+// which decides on permission requests of sessions without involving a human. A Policy consists of
+// rules, which are Go callbacks that are consulted in the order in which they were added; the first
+// rule that allows or denies the request decides. All decisions are recorded in the audit trail of
+// the policy. The policy is applied to a session by passing a handler obtained from NewPolicyHandler()
+// to NewSession().
+
+// PolicyDecision is the decision of a PolicyRule on a permission request.
+type PolicyDecision string
+
+const (
+	// PolicyAllow means the rule allows the session
+	PolicyAllow = PolicyDecision("allow")
+	// PolicyDeny means the rule denies the session
+	PolicyDeny = PolicyDecision("deny")
+	// PolicyAbstain means the rule does not decide, so that the next rule is consulted
+	PolicyAbstain = PolicyDecision("abstain")
+)
+
+// PolicyRequest is a permission request of a session, to be decided on by a PolicyRule.
+type PolicyRequest struct {
+	Action    irma.Action
+	Request   irma.SessionRequest
+	Requestor *SessionRequestor
+	// For each disjunction of attributes to be disclosed, the attributes that the client could disclose
+	Candidates [][]*irma.AttributeIdentifier
+}
+
+// PolicyRule decides on a permission request. When allowing a session in which attributes are disclosed,
+// the rule may return which attributes to disclose; if it returns nil, the first candidate of each
+// disjunction is disclosed.
+type PolicyRule func(request *PolicyRequest) (PolicyDecision, *irma.DisclosureChoice)
+
+// PolicyAuditEntry records a decision on a permission request made by a Policy.
+type PolicyAuditEntry struct {
+	Time      time.Time             `json:"time"`
+	Action    irma.Action           `json:"action"`
+	Requestor irma.TranslatedString `json:"requestor"`
+	Verified  bool                  `json:"verified"`
+	// Name of the rule that decided; empty if no rule decided
+	Rule      string                         `json:"rule,omitempty"`
+	Decision  PolicyDecision                 `json:"decision"`
+	Disclosed []irma.AttributeTypeIdentifier `json:"disclosed,omitempty"`
+}
+
+// Policy decides on permission requests of sessions using its rules.
+type Policy struct {
+	// If no rule decides, the permission request is passed on to the wrapped Handler if this is true,
+	// and denied otherwise
+	DelegateUndecided bool
+	// If set, called for each decision in addition to recording it in the audit trail
+	OnDecision func(entry *PolicyAuditEntry)
+	// Maximum amount of entries kept in the audit trail, after which the oldest entries are dropped;
+	// if zero, DefaultMaxPolicyAuditEntries is used. Use OnDecision to keep all decisions.
+	MaxAuditEntries int
+
+	rules []*namedPolicyRule
+	audit []*PolicyAuditEntry
+	lock  sync.Mutex
+}
+
+// DefaultMaxPolicyAuditEntries is the default maximum size of the audit trail of a Policy.
+const DefaultMaxPolicyAuditEntries = 1000
+
+type namedPolicyRule struct {
+	name string
+	rule PolicyRule
+}
+
+// AddRule adds the specified rule to the policy, after all existing rules.
+// The name of the rule is recorded in the audit trail when it decides.
+func (policy *Policy) AddRule(name string, rule PolicyRule) {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+	policy.rules = append(policy.rules, &namedPolicyRule{name: name, rule: rule})
+}
+
+// AuditTrail returns the decisions made by the policy so far, oldest first, up to the maximum
+// amount of entries that the audit trail keeps.
+func (policy *Policy) AuditTrail() []*PolicyAuditEntry {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+	return append([]*PolicyAuditEntry{}, policy.audit...)
+}
+
+// decide consults the rules of the policy. If no rule decides, the returned decision is PolicyAbstain.
+func (policy *Policy) decide(request *PolicyRequest) (PolicyDecision, *irma.DisclosureChoice) {
+	policy.lock.Lock()
+	rules := policy.rules
+	policy.lock.Unlock()
+
+	decision, choice, rulename := PolicyAbstain, (*irma.DisclosureChoice)(nil), ""
+	for _, r := range rules {
+		decision, choice = r.rule(request)
+		if decision == PolicyAllow || decision == PolicyDeny {
+			rulename = r.name
+			break
+		}
+		decision = PolicyAbstain
+	}
+
+	if decision == PolicyAllow && choice == nil {
+		choice = firstCandidates(request.Candidates)
+		if choice == nil { // not all disjunctions can be satisfied
+			decision = PolicyDeny
+		}
+	}
+	if decision != PolicyAllow {
+		choice = nil
+	}
+	policy.record(request, rulename, decision, choice)
+	return decision, choice
+}
+
+func (policy *Policy) record(request *PolicyRequest, rule string, decision PolicyDecision, choice *irma.DisclosureChoice) {
+	entry := &PolicyAuditEntry{
+		Time:     time.Now(),
+		Action:   request.Action,
+		Rule:     rule,
+		Decision: decision,
+	}
+	if request.Requestor != nil {
+		entry.Requestor = request.Requestor.Name
+		entry.Verified = request.Requestor.Verified
+	}
+	if choice != nil {
+		for _, attr := range choice.Attributes {
+			entry.Disclosed = append(entry.Disclosed, attr.Type)
+		}
+	}
+
+	policy.lock.Lock()
+	max := policy.MaxAuditEntries
+	if max <= 0 {
+		max = DefaultMaxPolicyAuditEntries
+	}
+	policy.audit = append(policy.audit, entry)
+	if len(policy.audit) > max {
+		policy.audit = append([]*PolicyAuditEntry{}, policy.audit[len(policy.audit)-max:]...)
+	}
+	policy.lock.Unlock()
+	if policy.OnDecision != nil {
+		policy.OnDecision(entry)
+	}
+}
+
+func firstCandidates(candidates [][]*irma.AttributeIdentifier) *irma.DisclosureChoice {
+	choice := &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{}}
+	for _, disjunction := range candidates {
+		if len(disjunction) == 0 {
+			return nil
+		}
+		choice.Attributes = append(choice.Attributes, disjunction[0])
+	}
+	return choice
+}
+
+// AllowVerifiedRequestors returns a rule that allows sessions of the specified types from requestors
+// that are listed in the requestor registry of one of our schemes, provided that they only request
+// attributes that they are allowed to request according to the registry.
+func AllowVerifiedRequestors(actions ...irma.Action) PolicyRule {
+	return func(request *PolicyRequest) (PolicyDecision, *irma.DisclosureChoice) {
+		if request.Requestor == nil || !request.Requestor.Verified || len(request.Requestor.Violations) > 0 {
+			return PolicyAbstain, nil
+		}
+		for _, action := range actions {
+			if action == request.Action {
+				return PolicyAllow, nil
+			}
+		}
+		return PolicyAbstain, nil
+	}
+}
+
+// NewPolicyHandler returns a Handler that decides on the permission requests of a session using
+// the specified policy, and that passes all other callbacks on to the specified handler.
+func (client *Client) NewPolicyHandler(policy *Policy, handler Handler) Handler {
+	return &policyHandler{Handler: handler, client: client, policy: policy}
+}
+
+// policyHandler wraps the Handler of a session, deciding on permission requests using a Policy.
+// It implements RequestorHandler so that the rules can take the details of the requestor into account.
+type policyHandler struct {
+	Handler
+	client *Client
+	policy *Policy
+}
+
+var _ RequestorHandler = (*policyHandler)(nil)
+
+func (h *policyHandler) RequestIssuancePermission(request irma.IssuanceRequest, ServerName irma.TranslatedString, callback PermissionHandler) {
+	h.RequestIssuancePermissionFrom(request, &SessionRequestor{Name: ServerName}, callback)
+}
+
+func (h *policyHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName irma.TranslatedString, callback PermissionHandler) {
+	h.RequestVerificationPermissionFrom(request, &SessionRequestor{Name: ServerName}, callback)
+}
+
+func (h *policyHandler) RequestSignaturePermission(request irma.SignatureRequest, ServerName irma.TranslatedString, callback PermissionHandler) {
+	h.RequestSignaturePermissionFrom(request, &SessionRequestor{Name: ServerName}, callback)
+}
+
+func (h *policyHandler) RequestIssuancePermissionFrom(request irma.IssuanceRequest, requestor *SessionRequestor, callback PermissionHandler) {
+	if h.apply(irma.ActionIssuing, &request, requestor, callback) {
+		requestPermission(h.Handler, &request, requestor, callback)
+	}
+}
+
+func (h *policyHandler) RequestVerificationPermissionFrom(request irma.DisclosureRequest, requestor *SessionRequestor, callback PermissionHandler) {
+	if h.apply(irma.ActionDisclosing, &request, requestor, callback) {
+		requestPermission(h.Handler, &request, requestor, callback)
+	}
+}
+
+func (h *policyHandler) RequestSignaturePermissionFrom(request irma.SignatureRequest, requestor *SessionRequestor, callback PermissionHandler) {
+	if h.apply(irma.ActionSigning, &request, requestor, callback) {
+		requestPermission(h.Handler, &request, requestor, callback)
+	}
+}
+
+// apply decides on the permission request using the policy and invokes the callback accordingly,
+// returning true if the request should instead be passed on to the wrapped handler.
+func (h *policyHandler) apply(action irma.Action, request irma.SessionRequest, requestor *SessionRequestor, callback PermissionHandler) bool {
+	candidates, _ := h.client.CheckSatisfiability(request.ToDisclose())
+	decision, choice := h.policy.decide(&PolicyRequest{
+		Action:     action,
+		Request:    request,
+		Requestor:  requestor,
+		Candidates: candidates,
+	})
+	switch decision {
+	case PolicyAllow:
+		callback(true, choice)
+	case PolicyDeny:
+		callback(false, nil)
+	default:
+		if h.policy.DelegateUndecided {
+			return true
+		}
+		callback(false, nil)
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the detection of identical sessions that are started while an earlier one
+// is still awaiting permission of the user, e.g. because the user scanned a QR twice or because
+// a frontend restarted its session. Instead of asking permission again, such sessions are attached
+// to the pending prompt of the earlier session, and the answer of the user to that prompt is applied
+// to all of them. If the session for which the user was prompted ends before the user answers,
+// the user is prompted again for the next identical session.
+//
+// Sessions are considered identical if they have the same requestor hostname and the same session
+// request, apart from the fields that the IRMA server sets for each session: the context, nonce and
+// protocol version, and the validity and key counter of the credentials to be issued.
+
+// promptKey returns the key identifying identical sessions.
+func (session *session) promptKey() (string, error) {
+	bts, err := json.Marshal(session.request)
+	if err != nil {
+		return "", err
+	}
+	fields := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(bts))
+	decoder.UseNumber()
+	if err = decoder.Decode(&fields); err != nil {
+		return "", err
+	}
+	for _, field := range []string{"context", "nonce", "protocolVersion"} {
+		delete(fields, field)
+	}
+	if creds, ok := fields["credentials"].([]interface{}); ok {
+		for _, cred := range creds {
+			if cred, ok := cred.(map[string]interface{}); ok {
+				delete(cred, "validity")
+				delete(cred, "keyCounter")
+			}
+		}
+	}
+	if bts, err = irma.CanonicalJSON(fields); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(append([]byte(session.Hostname+"\n"), bts...))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// addPendingPrompt registers that the session awaits a permission prompt, returning whether the
+// user should be prompted, i.e. whether no identical session is already awaiting one.
+func (client *Client) addPendingPrompt(s *session) bool {
+	client.pendingPromptsLock.Lock()
+	defer client.pendingPromptsLock.Unlock()
+	if client.pendingPrompts == nil {
+		client.pendingPrompts = map[string][]*session{}
+	}
+	client.pendingPrompts[s.pendingPrompt] = append(client.pendingPrompts[s.pendingPrompt], s)
+	return len(client.pendingPrompts[s.pendingPrompt]) == 1
+}
+
+// removePendingPrompt returns the sessions awaiting the specified prompt, the first of which
+// is the session for which the user was prompted.
+func (client *Client) removePendingPrompt(key string) []*session {
+	client.pendingPromptsLock.Lock()
+	defer client.pendingPromptsLock.Unlock()
+	sessions := client.pendingPrompts[key]
+	delete(client.pendingPrompts, key)
+	return sessions
+}
+
+// dropPendingPrompt removes the session, which has ended, from the sessions awaiting its prompt.
+// If the user was prompted for this session, the user is prompted again for the next one.
+func (client *Client) dropPendingPrompt(session *session) {
+	if session.pendingPrompt == "" {
+		return
+	}
+	client.pendingPromptsLock.Lock()
+	defer client.pendingPromptsLock.Unlock()
+	sessions := client.pendingPrompts[session.pendingPrompt]
+	for i, s := range sessions {
+		if s != session {
+			continue
+		}
+		sessions = append(sessions[:i], sessions[i+1:]...)
+		if len(sessions) == 0 {
+			delete(client.pendingPrompts, session.pendingPrompt)
+			return
+		}
+		client.pendingPrompts[session.pendingPrompt] = sessions
+		if i == 0 {
+			go sessions[0].requestPermission()
+		}
+		return
+	}
+}
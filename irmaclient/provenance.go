@@ -0,0 +1,97 @@
+package irmaclient
+
+import (
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the provenance of credentials: when a credential is issued in a session in which
+// attributes were disclosed (e.g. a diploma issued after disclosing a passport), the credentials from
+// which these attributes were disclosed are recorded as its sources. The provenance is shown in the
+// Provenance field of the credentials in CredentialInfoList(), and in the log entry of the session.
+// It is kept as long as the issued credential is present, also when its sources have been removed.
+
+// recordProvenance records the credentials in the choice as the sources of the credentials that were
+// issued according to the results, adding the provenance to the log entry of the session.
+func (client *Client) recordProvenance(entry *LogEntry, results []*irma.CredentialIssuanceResult, choice *irma.DisclosureChoice) error {
+	provenance := &irma.CredentialProvenance{Time: entry.Time, Requestor: entry.ServerName}
+	seen := map[string]bool{}
+	for _, attr := range choice.Attributes {
+		if attr.CredentialHash == "" || seen[attr.CredentialHash] {
+			continue
+		}
+		seen[attr.CredentialHash] = true
+		provenance.Sources = append(provenance.Sources, &irma.CredentialReference{
+			CredentialType: attr.Type.CredentialTypeIdentifier(),
+			Hash:           attr.CredentialHash,
+		})
+	}
+	if len(provenance.Sources) == 0 {
+		return nil
+	}
+
+	for _, result := range results {
+		if result.Hash != "" {
+			entry.Issued = append(entry.Issued, result.Hash)
+		}
+	}
+	if len(entry.Issued) == 0 {
+		return nil
+	}
+	entry.Provenance = provenance
+	client.provenanceLock.Lock()
+	defer client.provenanceLock.Unlock()
+	if client.provenance == nil {
+		client.provenance = map[string]*irma.CredentialProvenance{}
+	}
+	for _, hash := range entry.Issued {
+		client.provenance[hash] = provenance
+	}
+	return client.storage.StoreProvenance(client.provenance)
+}
+
+// forgetProvenance removes the provenance of the specified credential, if any.
+func (client *Client) forgetProvenance(hash string) error {
+	client.provenanceLock.Lock()
+	defer client.provenanceLock.Unlock()
+	if _, ok := client.provenance[hash]; !ok {
+		return nil
+	}
+	delete(client.provenance, hash)
+	return client.storage.StoreProvenance(client.provenance)
+}
+
+// credentialProvenance returns the provenance of the specified credential, if any.
+func (client *Client) credentialProvenance(hash string) *irma.CredentialProvenance {
+	client.provenanceLock.Lock()
+	defer client.provenanceLock.Unlock()
+	return client.provenance[hash]
+}
+
+// provenanceCopy returns a copy of the provenance of all credentials.
+func (client *Client) provenanceCopy() map[string]*irma.CredentialProvenance {
+	client.provenanceLock.Lock()
+	defer client.provenanceLock.Unlock()
+	cpy := make(map[string]*irma.CredentialProvenance, len(client.provenance))
+	for hash, provenance := range client.provenance {
+		cpy[hash] = provenance
+	}
+	return cpy
+}
+
+// DerivedCredentials returns the credentials that were issued in sessions in which attributes of
+// the specified credential were disclosed.
+func (client *Client) DerivedCredentials(hash string) irma.CredentialInfoList {
+	list := irma.CredentialInfoList{}
+	for _, info := range client.CredentialInfoList() {
+		if info.Provenance == nil {
+			continue
+		}
+		for _, source := range info.Provenance.Sources {
+			if source.Hash == hash {
+				list = append(list, info)
+				break
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,87 @@
+package irmaclient
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the redaction of secret material from panics and errors occurring during
+// sessions, before they are logged, and, in case of panics, before they are passed to the Handler
+// of the session (reports to Sentry contain only the type of the error, see crashreporting.go):
+// the values of the attributes of the client (both decoded and as integers), its secret key, its
+// keyshare tokens, and the PINs entered during the session are replaced by redactedValue in the
+// error messages and stack traces. Values shorter than redactMinLength are not redacted, as
+// replacing them would make the messages unreadable while they reveal little.
+
+const (
+	redactedValue   = "[redacted]"
+	redactMinLength = 4
+)
+
+// pinRecorder wraps the Handler of a session, recording the PINs entered by the user so that
+// they can be redacted.
+type pinRecorder struct {
+	Handler
+	session *session
+}
+
+func (r *pinRecorder) RequestPin(remainingAttempts int, callback PinHandler) {
+	r.Handler.RequestPin(remainingAttempts, func(proceed bool, pin string) {
+		if proceed {
+			r.session.secretsLock.Lock()
+			r.session.pins = append(r.session.pins, pin)
+			r.session.secretsLock.Unlock()
+		}
+		callback(proceed, pin)
+	})
+}
+
+// secrets returns the secret material of the client that is redacted from reports.
+func (client *Client) secrets() []string {
+	var secrets []string
+	for _, lists := range []map[irma.CredentialTypeIdentifier][]*irma.AttributeList{client.attributes, client.archived} {
+		for _, attrlistlist := range lists {
+			for _, attrs := range attrlistlist {
+				for i, val := range attrs.Strings() {
+					if val != nil {
+						secrets = append(secrets, val[""])
+					}
+					secrets = append(secrets, attrs.Ints[i+1].String())
+				}
+			}
+		}
+	}
+	if client.secretkey != nil && client.secretkey.Key != nil {
+		secrets = append(secrets, client.secretkey.Key.String(), client.secretkey.Key.Text(16))
+	}
+	for _, kss := range client.keyshareServers {
+		secrets = append(secrets, string(kss.token))
+	}
+	return secrets
+}
+
+// redact replaces the secret material of the client, and the PINs entered during the session,
+// in the specified string.
+func (session *session) redact(s string) string {
+	secrets := session.client.secrets()
+	session.secretsLock.Lock()
+	secrets = append(secrets, session.pins...)
+	session.secretsLock.Unlock()
+	return redact(s, secrets)
+}
+
+// redact replaces the secrets in the specified string by redactedValue.
+func redact(s string, secrets []string) string {
+	// Replace longer secrets first, so that secrets containing other secrets are replaced entirely
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+	for _, secret := range secrets {
+		if len(secret) >= redactMinLength {
+			s = strings.Replace(s, secret, redactedValue, -1)
+		}
+	}
+	return s
+}
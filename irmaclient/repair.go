@@ -0,0 +1,273 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the detection and repair of corrupted storage files. Files are stored with a
+// header containing the SHA256 checksum of their contents, so that truncated or otherwise corrupted
+// files are detected when they are loaded (encrypted files are authenticated anyway, see encryption.go).
+// Files stored by earlier versions, without the header, are still loaded.
+//
+// Checking the signatures of all credentials is expensive, so the storage is only repaired when
+// loading the attributes or the archive at startup, or the signature of a credential when it is used,
+// fails because a file is corrupted, or when RepairStorage() is called. The attributes, the archive
+// and the signatures of all credentials are then checked. Corrupted files of attributes are moved
+// aside (to the same filename with the .corrupt extension), losing the credentials in it; credentials
+// of which the signature is missing or corrupted are removed. The damage is reported to the
+// StorageRepairHandler if the ClientHandler implements it, instead of the client refusing to start.
+// Other corrupted files, such as the secret key, cannot be repaired and still cause New() to fail.
+
+const checksumFileMagic = "IRMASUM1"
+
+// StorageCorruptionError is returned when a storage file is corrupted.
+type StorageCorruptionError struct {
+	File string
+	Err  error
+}
+
+func (e *StorageCorruptionError) Error() string {
+	return "Storage file " + e.File + " is corrupted: " + e.Err.Error()
+}
+
+// StorageDamage describes damage to the storage repaired by RepairStorage().
+type StorageDamage struct {
+	// The corrupted file, within the storage
+	File string
+	// The credential that was removed, if the damage concerned a single credential
+	Credential *irma.CredentialInfo
+	Err        error
+}
+
+// StorageRepairHandler is informed of the damage to the storage that was repaired after a corrupted
+// file was found, or when RepairStorage() was called. The ClientHandler may optionally implement it.
+type StorageRepairHandler interface {
+	StorageRepaired(damage []*StorageDamage)
+}
+
+// addChecksum prefixes the contents of a file with a header containing their checksum.
+func addChecksum(bts []byte) []byte {
+	sum := sha256.Sum256(bts)
+	return append(append([]byte(checksumFileMagic), sum[:]...), bts...)
+}
+
+// verifyChecksum verifies and strips the checksum header of the contents of a file, if present.
+func verifyChecksum(bts []byte, file string) ([]byte, error) {
+	if !bytes.HasPrefix(bts, []byte(checksumFileMagic)) {
+		return bts, nil
+	}
+	bts = bts[len(checksumFileMagic):]
+	if len(bts) < sha256.Size {
+		return nil, &StorageCorruptionError{File: file, Err: errors.New("file is truncated")}
+	}
+	sum := sha256.Sum256(bts[sha256.Size:])
+	if !bytes.Equal(sum[:], bts[:sha256.Size]) {
+		return nil, &StorageCorruptionError{File: file, Err: errors.New("checksum mismatch")}
+	}
+	return bts[sha256.Size:], nil
+}
+
+// RepairStorage checks the attributes and signatures of the credentials in the storage, removing
+// credentials that are corrupted. It returns the repaired damage, which is also reported to the
+// StorageRepairHandler. It is called automatically when a corrupted file is found.
+func (client *Client) RepairStorage() ([]*StorageDamage, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	damage, err := client.repairStorage()
+	if err != nil {
+		return nil, err
+	}
+	if len(damage) > 0 {
+		client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
+		client.handler.UpdateAttributes()
+	}
+	return damage, nil
+}
+
+// loadAttributeStorage loads the attributes and the archive into the client, repairing the storage
+// only if one of them is corrupted.
+func (client *Client) loadAttributeStorage() error {
+	damage, err := client.loadAttributeLists()
+	if err != nil {
+		return err
+	}
+	client.reportDamage(damage)
+	return nil
+}
+
+// loadAttributeLists is loadAttributeStorage() without reporting the repaired damage.
+func (client *Client) loadAttributeLists() ([]*StorageDamage, error) {
+	var err error
+	if client.attributes, err = client.storage.loadAttributeLists(attributesFile); err == nil {
+		if client.archived, err = client.storage.loadAttributeLists(archiveFile); err == nil {
+			return nil, nil
+		}
+	}
+	if _, corrupted := err.(*StorageCorruptionError); !corrupted {
+		return nil, err
+	}
+	return client.repairAttributeStorage()
+}
+
+// repairCorruptedSignature repairs the storage after the signature of a credential turned out
+// to be corrupted when it was loaded.
+func (client *Client) repairCorruptedSignature() {
+	if _, err := client.RepairStorage(); err != nil {
+		irma.Logger.Warnf("Failed to repair storage: %v", err)
+	}
+}
+
+// repairStorage loads the attributes and the archive into the client, repairing them if necessary,
+// and reports the damage to the handler.
+func (client *Client) repairStorage() ([]*StorageDamage, error) {
+	damage, err := client.repairAttributeStorage()
+	if err != nil {
+		return nil, err
+	}
+	client.reportDamage(damage)
+	return damage, nil
+}
+
+// repairAttributeStorage is repairStorage() without reporting the damage.
+func (client *Client) repairAttributeStorage() ([]*StorageDamage, error) {
+	var damage []*StorageDamage
+	var err error
+	if client.attributes, err = client.repairAttributeLists(attributesFile, &damage); err != nil {
+		return nil, err
+	}
+	if client.archived, err = client.repairAttributeLists(archiveFile, &damage); err != nil {
+		return nil, err
+	}
+	return damage, nil
+}
+
+// reportDamage logs the repaired damage and reports it to the handler.
+func (client *Client) reportDamage(damage []*StorageDamage) {
+	if len(damage) == 0 {
+		return
+	}
+	irma.Logger.Warnf("Repaired %d damaged items in storage", len(damage))
+	if handler, ok := client.handler.(StorageRepairHandler); ok {
+		handler.StorageRepaired(damage)
+	}
+}
+
+// repairAttributeLists loads the attributes or archive from the specified file, moving the file aside
+// if it is corrupted, and removing the credentials of which the signature is corrupted.
+func (client *Client) repairAttributeLists(file string, damage *[]*StorageDamage) (map[irma.CredentialTypeIdentifier][]*irma.AttributeList, error) {
+	s := &client.storage
+	lists, err := s.loadAttributeLists(file)
+	if err != nil {
+		if _, corrupted := err.(*StorageCorruptionError); !corrupted || s.sql != nil {
+			return nil, err
+		}
+		*damage = append(*damage, &StorageDamage{File: file, Err: err})
+		if err = s.moveAside(file); err != nil {
+			return nil, err
+		}
+		return map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}, nil
+	}
+
+	changed := false
+	for id, attrlistlist := range lists {
+		var intact []*irma.AttributeList
+		for _, attrs := range attrlistlist {
+			sig, err := s.LoadSignature(attrs)
+			if err == nil && (sig.A == nil || sig.E == nil || sig.V == nil) {
+				err = &StorageCorruptionError{File: s.signatureFilename(attrs), Err: errors.New("signature is incomplete")}
+			}
+			if err == nil {
+				intact = append(intact, attrs)
+				continue
+			}
+			if _, corrupted := err.(*StorageCorruptionError); !corrupted && !client.signatureMissing(attrs) {
+				return nil, err
+			}
+			*damage = append(*damage, &StorageDamage{File: s.signatureFilename(attrs), Credential: attrs.Info(), Err: err})
+			if err = client.removeCorruptedSignature(attrs); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+		if len(intact) == 0 {
+			delete(lists, id)
+		} else {
+			lists[id] = intact
+		}
+	}
+	if changed {
+		if err = s.storeAttributeLists(lists, file); err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
+
+// storageDamage counts the corrupted files of attributes and the credentials of which the signature
+// is missing or corrupted, like repairAttributeLists() but without repairing them.
+func (client *Client) storageDamage() (int, error) {
+	s := &client.storage
+	damage := 0
+	for _, file := range []string{attributesFile, archiveFile} {
+		lists, err := s.loadAttributeLists(file)
+		if _, corrupted := err.(*StorageCorruptionError); corrupted {
+			damage++
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, attrlistlist := range lists {
+			for _, attrs := range attrlistlist {
+				sig, err := s.LoadSignature(attrs)
+				if err != nil || sig.A == nil || sig.E == nil || sig.V == nil {
+					damage++
+				}
+			}
+		}
+	}
+	return damage, nil
+}
+
+// signatureMissing returns whether the signature of the credential is absent from the storage.
+func (client *Client) signatureMissing(attrs *irma.AttributeList) bool {
+	s := &client.storage
+	if s.sql != nil {
+		var count int
+		err := s.sql.db.QueryRow("SELECT COUNT(*) FROM signatures WHERE hash = ?", attrs.Hash()).Scan(&count)
+		return err == nil && count == 0
+	}
+	exists, err := s.fileExists(s.signatureFilename(attrs))
+	return err == nil && !exists
+}
+
+func (client *Client) removeCorruptedSignature(attrs *irma.AttributeList) error {
+	s := &client.storage
+	if s.sql != nil {
+		s.record(JournalRemove, "sql:signatures/"+attrs.Hash(), nil)
+		return s.sql.deleteSignature(attrs.Hash())
+	}
+	return s.moveAside(s.signatureFilename(attrs))
+}
+
+// moveAside moves a corrupted file to the same filename with the .corrupt extension,
+// or removes it when the storage is kept in memory.
+func (s *storage) moveAside(file string) error {
+	s.record(JournalMoveAside, file, nil)
+	var err error
+	if s.memory != nil {
+		err = s.memory.remove(file)
+	} else {
+		err = os.Rename(s.path(file), s.path(file+".corrupt"))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
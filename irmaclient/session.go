@@ -1,12 +1,16 @@
 package irmaclient
 
 import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"reflect"
 	"runtime/debug"
 	"strings"
+	"sync"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
@@ -25,6 +29,23 @@ type PermissionHandler func(proceed bool, choice *irma.DisclosureChoice)
 // PinHandler is used to provide the user's PIN code.
 type PinHandler func(proceed bool, pin string)
 
+// SessionRequestor describes the requestor of a session in the permission callbacks of the RequestorHandler.
+type SessionRequestor struct {
+	// Name of the requestor to show to the user
+	Name irma.TranslatedString
+	// Hostname of the server of the session; empty in manual sessions
+	Hostname string
+	// Whether or not the requestor is listed in the requestor registry of one of our schemes
+	Verified bool
+	// Entry of the requestor in the requestor registry, nil if not verified
+	Info *irma.RequestorInfo
+	// Attributes requested in the session that the requestor may not request according to the registry
+	Violations []irma.AttributeTypeIdentifier
+	// In sessions started using NewDeepLinkSession(), the code that the user should compare to the
+	// code shown by the app or website that started the session
+	ConfirmationCode string
+}
+
 // A Handler contains callbacks for communication to the user.
 type Handler interface {
 	StatusUpdate(action irma.Action, status irma.Status)
@@ -46,6 +67,15 @@ type Handler interface {
 	RequestPin(remainingAttempts int, callback PinHandler)
 }
 
+// RequestorHandler may optionally be implemented by a Handler. If so, the permission requests of
+// sessions are passed to its methods instead of to the corresponding methods of the Handler,
+// along with the details of the requestor instead of only its name.
+type RequestorHandler interface {
+	RequestIssuancePermissionFrom(request irma.IssuanceRequest, requestor *SessionRequestor, callback PermissionHandler)
+	RequestVerificationPermissionFrom(request irma.DisclosureRequest, requestor *SessionRequestor, callback PermissionHandler)
+	RequestSignaturePermissionFrom(request irma.SignatureRequest, requestor *SessionRequestor, callback PermissionHandler)
+}
+
 // SessionDismisser can dismiss the current IRMA session.
 type SessionDismisser interface {
 	Dismiss()
@@ -56,6 +86,7 @@ type session struct {
 	Handler    Handler
 	Version    *irma.ProtocolVersion
 	ServerName irma.TranslatedString
+	Requestor  *SessionRequestor
 
 	choice      *irma.DisclosureChoice
 	attrIndices irma.DisclosedAttributeIndices
@@ -67,10 +98,26 @@ type session struct {
 	issuerProofNonce *big.Int
 	builders         gabi.ProofBuilderList
 
+	// Sanitized record of the session for debugging, nil if disabled
+	transcript *SessionTranscript
+
 	// These are empty on manual sessions
 	Hostname  string
 	ServerURL string
 	transport *irma.HTTPTransport
+	// Connections of the session, closed when it is done; see transportisolation.go
+	pool *irma.ConnectionPool
+	// Only set in sessions started from a deep link, see NewDeepLinkSession()
+	confirmationCode string
+	// Only set if the QR contains a request key, see irma.Qr.RequestKey
+	requestKey *ecdsa.PublicKey
+	// Key of the permission prompt that the session awaits, see prompts.go
+	pendingPrompt string
+	// Reported to the server when the session is deleted, see reportFailure()
+	failure *irma.ClientFailure
+	// PINs entered during the session, to be redacted from reports, see redact.go
+	pins        []string
+	secretsLock sync.Mutex
 }
 
 // We implement the handler for the keyshare protocol
@@ -78,7 +125,7 @@ var _ keyshareSessionHandler = (*session)(nil)
 
 // Supported protocol versions. Minor version numbers should be reverse sorted.
 var supportedVersions = map[int][]int{
-	2: {4},
+	2: {4, 5, 6, 7},
 }
 var minVersion = &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][0]}
 var maxVersion = &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][len(supportedVersions[2])-1]}
@@ -87,12 +134,18 @@ var maxVersion = &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][len
 
 // NewSession starts a new IRMA session, given (along with a handler to pass feedback to) a session request.
 // When the request is not suitable to start an IRMA session from, it calls the Failure method of the specified Handler.
+// If the request is a disclosure request with a validity window, the Success method of the handler receives
+// an irma.DisclosureToken.
 func (client *Client) NewSession(sessionrequest string, handler Handler) SessionDismisser {
+	if err := client.checkUnlocked(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorWalletLocked, Err: err})
+		return nil
+	}
 	bts := []byte(sessionrequest)
 
 	qr := &irma.Qr{}
 	if err := irma.UnmarshalValidate(bts, qr); err == nil {
-		return client.newQrSession(qr, handler)
+		return client.newQrSession(qr, handler, "")
 	}
 
 	schemeRequest := &irma.SchemeManagerRequest{}
@@ -107,6 +160,9 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 
 	disclosureRequest := &irma.DisclosureRequest{}
 	if err := irma.UnmarshalValidate(bts, disclosureRequest); err == nil {
+		if disclosureRequest.Window != nil {
+			handler = &tokenHandler{Handler: handler, request: disclosureRequest}
+		}
 		return client.newManualSession(disclosureRequest, handler, irma.ActionDisclosing)
 	}
 
@@ -114,8 +170,42 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 	return nil
 }
 
+// NewPushSession starts a new IRMA session from the JSON payload of a push notification (see irma.PushPayload).
+// The pushOrigin is the hostname of the requestor from which the app received the push notification,
+// as known from the app's registration with the push service. The session is only started if both the
+// requestor named in the payload and the host of the session pointer equal pushOrigin or are a subdomain
+// of it; otherwise the Failure method of the handler is called with an irma.ErrorRequestorMismatch error.
+func (client *Client) NewPushSession(payload string, pushOrigin string, handler Handler) SessionDismisser {
+	push := &irma.PushPayload{}
+	if err := irma.UnmarshalValidate([]byte(payload), push); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err, Info: payload})
+		return nil
+	}
+
+	u, _ := url.ParseRequestURI(push.SessionPtr.URL) // Qr validator already checked this for errors
+	if !matchesHost(push.Requestor, pushOrigin) || !matchesHost(u.Hostname(), pushOrigin) {
+		handler.Failure(&irma.SessionError{
+			ErrorType: irma.ErrorRequestorMismatch,
+			Info:      fmt.Sprintf("push origin %s, requestor %s, session host %s", pushOrigin, push.Requestor, u.Hostname()),
+		})
+		return nil
+	}
+
+	return client.newQrSession(push.SessionPtr, handler, "")
+}
+
+// matchesHost checks if the hostname equals the origin or is a subdomain of it.
+func matchesHost(hostname, origin string) bool {
+	hostname, origin = strings.ToLower(hostname), strings.ToLower(origin)
+	return origin != "" && (hostname == origin || strings.HasSuffix(hostname, "."+origin))
+}
+
 // newManualSession starts a manual session, given a signature request in JSON and a handler to pass messages to
 func (client *Client) newManualSession(request irma.SessionRequest, handler Handler, action irma.Action) SessionDismisser {
+	if err := client.checkUnlocked(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorWalletLocked, Err: err})
+		return nil
+	}
 	session := &session{
 		Action:  action,
 		Handler: handler,
@@ -123,6 +213,9 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 		Version: minVersion,
 		request: request,
 	}
+	client.startSession()
+	session.startTranscript()
+	session.startBreadcrumbs()
 	session.Handler.StatusUpdate(session.Action, irma.StatusManualStarted)
 
 	session.processSessionInfo()
@@ -137,25 +230,43 @@ func (client *Client) newSchemeSession(qr *irma.SchemeManagerRequest, handler Ha
 		Handler:   handler,
 		client:    client,
 	}
+	session.startTranscript()
+	session.startBreadcrumbs()
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
 	go session.managerSession()
 	return session
 }
 
-// newQrSession creates and starts a new interactive IRMA session
-func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisser {
+// newQrSession creates and starts a new interactive IRMA session. The confirmation code,
+// if not empty, is sent to the server along with the first request.
+func (client *Client) newQrSession(qr *irma.Qr, handler Handler, confirmationCode string) SessionDismisser {
 	u, _ := url.ParseRequestURI(qr.URL) // Qr validator already checked this for errors
+	transport, pool := client.sessionTransport(qr.URL, u.Hostname())
 	session := &session{
-		ServerURL: qr.URL,
-		Hostname:  u.Hostname(),
-		transport: irma.NewHTTPTransport(qr.URL),
-		Action:    irma.Action(qr.Type),
-		Handler:   handler,
-		client:    client,
+		ServerURL:        qr.URL,
+		Hostname:         u.Hostname(),
+		transport:        transport,
+		pool:             pool,
+		Action:           irma.Action(qr.Type),
+		Handler:          handler,
+		client:           client,
+		confirmationCode: confirmationCode,
 	}
+	client.startSession()
+	session.startTranscript()
+	session.startBreadcrumbs()
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
+	if err := client.checkUnlocked(); err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorWalletLocked, Err: err})
+		return nil
+	}
+	if err := client.Configuration.CheckSessionURL(qr.URL); err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorInsecureURL, Err: err, Info: qr.URL})
+		return nil
+	}
+
 	// Check if the action is one of the supported types
 	switch session.Action {
 	case irma.ActionDisclosing:
@@ -173,6 +284,23 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 
 	session.transport.SetHeader(irma.MinVersionHeader, minVersion.String())
 	session.transport.SetHeader(irma.MaxVersionHeader, maxVersion.String())
+	attempt := make([]byte, 16)
+	if _, err := rand.Read(attempt); err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+		return nil
+	}
+	session.transport.SetHeader(irma.AttemptHeader, hex.EncodeToString(attempt))
+	if confirmationCode != "" {
+		session.transport.SetHeader(irma.ConfirmationCodeHeader, confirmationCode)
+	}
+	if qr.RequestKey != "" {
+		var err error
+		if session.requestKey, err = irma.ParseRequestKey(qr.RequestKey); err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidJWT, Err: err})
+			return nil
+		}
+		session.transport.SetHeader(irma.SignedRequestHeader, "true")
+	}
 	if !strings.HasSuffix(session.ServerURL, "/") {
 		session.ServerURL += "/"
 	}
@@ -183,6 +311,13 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 
 // Core session methods
 
+// startSpan starts a span for a phase of the session (see irma.SetTracer()).
+func (session *session) startSpan(phase string) irma.Span {
+	span := irma.StartSpan("irmaclient.session." + phase)
+	span.SetAttribute("action", string(session.Action))
+	return span
+}
+
 // getSessionInfo retrieves the first message in the IRMA protocol (only in interactive sessions)
 func (session *session) getSessionInfo() {
 	defer session.recoverFromPanic()
@@ -190,7 +325,14 @@ func (session *session) getSessionInfo() {
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
 	// Get the first IRMA protocol message and parse it
-	err := session.transport.Get("", session.request)
+	span := session.startSpan("getRequest")
+	var err error
+	if session.requestKey == nil {
+		err = session.transport.Get("", session.request)
+	} else {
+		err = session.getSignedRequest()
+	}
+	span.End(err)
 	if err != nil {
 		session.fail(err.(*irma.SessionError))
 		return
@@ -199,6 +341,27 @@ func (session *session) getSessionInfo() {
 	session.processSessionInfo()
 }
 
+// getSignedRequest retrieves the session request as a JWT, which must be signed by the request key
+// from the QR, and which must be issued for this session, i.e. the client token at the end of our URL.
+func (session *session) getSignedRequest() error {
+	return getSignedRequest(session.transport, session.ServerURL, session.requestKey, session.request)
+}
+
+// getSignedRequest retrieves the session request at the server URL as a JWT signed by the key
+// (see also DiscloseForGuardian()).
+func getSignedRequest(transport *irma.HTTPTransport, serverURL string, key *ecdsa.PublicKey, request irma.SessionRequest) error {
+	var token string
+	if err := transport.Get("", &token); err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(serverURL, "/")
+	clienttoken := u[strings.LastIndex(u, "/")+1:]
+	if err := irma.ParseClientSessionRequest(token, clienttoken, key, request); err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorInvalidJWT, Err: err}
+	}
+	return nil
+}
+
 func serverName(hostname string, request irma.SessionRequest, conf *irma.Configuration) irma.TranslatedString {
 	sn := irma.NewTranslatedString(&hostname)
 
@@ -222,6 +385,28 @@ func serverName(hostname string, request irma.SessionRequest, conf *irma.Configu
 	return sn
 }
 
+// sessionRequestor looks up the requestor of the session in the requestor registries of our schemes.
+func sessionRequestor(hostname string, request irma.SessionRequest, conf *irma.Configuration) *SessionRequestor {
+	info := conf.RequestorForHost(hostname)
+	if info == nil {
+		return &SessionRequestor{Name: serverName(hostname, request, conf)}
+	}
+	requested := request.ToDisclose()
+	if ir, ok := request.(*irma.IssuanceRequest); ok {
+		for _, credreq := range ir.Credentials {
+			requested = append(requested, &irma.AttributeDisjunction{
+				Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier(credreq.CredentialTypeID.String())},
+			})
+		}
+	}
+	return &SessionRequestor{
+		Name:       info.Name,
+		Verified:   true,
+		Info:       info,
+		Violations: info.Violations(requested),
+	}
+}
+
 // processSessionInfo continues the session after all session state has been received:
 // it checks if the session can be performed and asks the user for consent.
 func (session *session) processSessionInfo() {
@@ -239,10 +424,19 @@ func (session *session) processSessionInfo() {
 		session.request.SetVersion(session.Version)
 	}
 
-	session.ServerName = serverName(session.Hostname, session.request, session.client.Configuration)
+	session.Requestor = sessionRequestor(session.Hostname, session.request, session.client.Configuration)
+	session.Requestor.Hostname = session.Hostname
+	session.Requestor.ConfirmationCode = session.confirmationCode
+	session.ServerName = session.Requestor.Name
 
 	if session.Action == irma.ActionIssuing {
 		ir := session.request.(*irma.IssuanceRequest)
+		if session.Version.Below(2, 6) {
+			// Servers using older protocol versions don't coarsen signing dates
+			for _, credreq := range ir.Credentials {
+				credreq.SigningDatePrecision = 0
+			}
+		}
 		_, err := ir.GetCredentialInfoList(session.client.Configuration, session.Version)
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownCredentialType, Err: err})
@@ -253,7 +447,7 @@ func (session *session) processSessionInfo() {
 		ir.RemovalCredentialInfoList = irma.CredentialInfoList{}
 		for _, credreq := range ir.Credentials {
 			preexistingCredentials := session.client.attrs(credreq.CredentialTypeID)
-			if len(preexistingCredentials) != 0 && preexistingCredentials[0].IsValid() && preexistingCredentials[0].CredentialType().IsSingleton {
+			if len(preexistingCredentials) != 0 && preexistingCredentials[0].IsValidOn(session.client.now()) && preexistingCredentials[0].CredentialType().IsSingleton {
 				ir.RemovalCredentialInfoList = append(ir.RemovalCredentialInfoList, preexistingCredentials[0].Info())
 			}
 		}
@@ -266,25 +460,72 @@ func (session *session) processSessionInfo() {
 	}
 	session.request.SetCandidates(candidates)
 
-	// Ask for permission to execute the session
+	// Disclose without asking for permission if the user subscribed the requestor to the attributes
+	if session.Action == irma.ActionDisclosing {
+		if choice := session.client.useSubscription(session.Requestor, candidates); choice != nil {
+			session.choice = choice
+			session.request.SetDisclosureChoice(choice)
+			session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
+			go session.doSession(true)
+			return
+		}
+	}
+
+	// Suggest disclosing as little as possible by default in the permission prompt
+	session.request.SetDisclosureChoice(session.client.MinimalDisclosure(candidates))
+
+	// Ask for permission to execute the session, unless an identical session is already awaiting
+	// permission, in which case the answer to that prompt also applies to this session
+	key, err := session.promptKey()
+	if err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return
+	}
+	session.pendingPrompt = key
+	session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
+	if session.client.addPendingPrompt(session) {
+		session.requestPermission()
+	}
+}
+
+// requestPermission asks the user for permission to execute the session, applying the answer
+// to the identical sessions that were started in the meantime as well (see prompts.go).
+func (session *session) requestPermission() {
 	callback := PermissionHandler(func(proceed bool, choice *irma.DisclosureChoice) {
-		session.choice = choice
-		session.request.SetDisclosureChoice(choice)
-		go session.doSession(proceed)
+		for _, s := range session.client.removePendingPrompt(session.pendingPrompt) {
+			s.choice = choice
+			s.request.SetDisclosureChoice(choice)
+			go s.doSession(proceed)
+		}
 	})
-	session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
-	switch session.Action {
-	case irma.ActionDisclosing:
-		session.Handler.RequestVerificationPermission(
-			*session.request.(*irma.DisclosureRequest), session.ServerName, callback)
-	case irma.ActionSigning:
-		session.Handler.RequestSignaturePermission(
-			*session.request.(*irma.SignatureRequest), session.ServerName, callback)
-	case irma.ActionIssuing:
-		session.Handler.RequestIssuancePermission(
-			*session.request.(*irma.IssuanceRequest), session.ServerName, callback)
+	requestPermission(session.Handler, session.request, session.Requestor, callback)
+}
+
+// requestPermission passes the permission request of the session to the handler, using the methods
+// of the RequestorHandler interface if it implements them.
+func requestPermission(handler Handler, request irma.SessionRequest, requestor *SessionRequestor, callback PermissionHandler) {
+	rh, ok := handler.(RequestorHandler)
+	switch r := request.(type) {
+	case *irma.DisclosureRequest:
+		if ok {
+			rh.RequestVerificationPermissionFrom(*r, requestor, callback)
+		} else {
+			handler.RequestVerificationPermission(*r, requestor.Name, callback)
+		}
+	case *irma.SignatureRequest:
+		if ok {
+			rh.RequestSignaturePermissionFrom(*r, requestor, callback)
+		} else {
+			handler.RequestSignaturePermission(*r, requestor.Name, callback)
+		}
+	case *irma.IssuanceRequest:
+		if ok {
+			rh.RequestIssuancePermissionFrom(*r, requestor, callback)
+		} else {
+			handler.RequestIssuancePermission(*r, requestor.Name, callback)
+		}
 	default:
-		panic("Invalid session type") // does not happen, session.Action has been checked earlier
+		panic("Invalid session type") // does not happen, the session action has been checked earlier
 	}
 }
 
@@ -300,8 +541,10 @@ func (session *session) doSession(proceed bool) {
 	}
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
+	span := session.startSpan("buildProofs")
 	if !session.Distributed() {
 		message, err := session.getProof()
+		span.End(err)
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 			return
@@ -310,12 +553,13 @@ func (session *session) doSession(proceed bool) {
 	} else {
 		var err error
 		session.builders, session.attrIndices, session.issuerProofNonce, err = session.getBuilders()
+		span.End(err)
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 		}
 		startKeyshareSession(
 			session,
-			session.Handler,
+			&pinRecorder{Handler: session.Handler, session: session},
 			session.builders,
 			session.request,
 			session.client.Configuration,
@@ -332,11 +576,17 @@ type disclosureResponse string
 func (session *session) sendResponse(message interface{}) {
 	var log *LogEntry
 	var err error
+	var partial *PartialIssuanceError
+	var ok bool
 	var messageJson []byte
 
+	span := session.startSpan("sendResponse")
+	defer func() { span.End(err) }()
+
 	switch session.Action {
 	case irma.ActionSigning:
-		irmaSignature, err := session.request.(*irma.SignatureRequest).SignatureFromMessage(message)
+		var irmaSignature *irma.SignedMessage
+		irmaSignature, err = session.request.(*irma.SignatureRequest).SignatureFromMessage(message)
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Info: "Type assertion failed"})
 			return
@@ -384,21 +634,128 @@ func (session *session) sendResponse(message interface{}) {
 			session.fail(err.(*irma.SessionError))
 			return
 		}
-		if err = session.client.ConstructCredentials(response, session.request.(*irma.IssuanceRequest), session.builders); err != nil {
+		var results []*irma.CredentialIssuanceResult
+		results, err = session.client.ConstructCredentials(response, session.request.(*irma.IssuanceRequest), session.builders)
+		if partial, ok = err.(*PartialIssuanceError); ok {
+			session.reportIssuanceResults(results)
+		} else if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 			return
 		}
 		log, _ = session.createLogEntry(message) // TODO err
+		if log != nil && session.choice != nil {
+			// The session succeeded regardless, so failing to record the provenance is not fatal
+			if provenanceErr := session.client.recordProvenance(log, results, session.choice); provenanceErr != nil {
+				irma.Logger.Warn("Failed to record credential provenance: ", provenanceErr.Error())
+			}
+		}
 	}
 
 	_ = session.client.addLogEntry(log) // TODO err
+	if session.choice != nil {
+		// The session succeeded regardless, so failing to record the usage is not fatal
+		if usageErr := session.client.recordUsage(session.choice); usageErr != nil {
+			irma.Logger.Warn("Failed to record credential usage: ", usageErr.Error())
+		}
+	}
 	if session.Action == irma.ActionIssuing {
 		session.client.handler.UpdateAttributes()
 	}
-	session.done = true
+	session.markDone()
+	session.closeConnections()
+	if partial != nil {
+		// The credentials that could be constructed have been stored and logged, so we don't
+		// cancel the session at the server but report the failed credentials separately
+		failed := []string{}
+		for _, cred := range partial.Failed() {
+			failed = append(failed, cred.String())
+		}
+		session.Handler.Failure(&irma.SessionError{
+			ErrorType: irma.ErrorPartialIssuance,
+			Info:      strings.Join(failed, ", "),
+			Err:       errors.Wrap(partial, 0),
+		})
+		return
+	}
 	session.Handler.Success(string(messageJson))
 }
 
+// reportIssuanceResults informs the server which of the issued credentials could be constructed,
+// if it supports this.
+func (session *session) reportIssuanceResults(results []*irma.CredentialIssuanceResult) {
+	if session.Version.Below(2, 6) {
+		return
+	}
+	var x string
+	if err := session.transport.Post("issuanceresults", &x, results); err != nil {
+		irma.Logger.Warnf("Failed to report issuance results to server: %s", err.Error())
+	}
+}
+
+// reportFailure informs the server why the session failed, if it failed at the client
+// and the server supports this.
+func (session *session) reportFailure() {
+	if session.failure == nil || session.Version == nil || session.Version.Below(2, 7) {
+		return
+	}
+	if session.request != nil && session.failure.Validate(session.request.Identifiers().SchemeManagers) != nil {
+		session.failure = &irma.ClientFailure{Code: session.failure.Code}
+	}
+	var x string
+	if err := session.transport.Post("failure", &x, session.failure); err != nil {
+		irma.Logger.Warnf("Failed to report failure to server: %s", err.Error())
+	}
+}
+
+// reportableError is an error whose cause is reported to the server if it fails the session.
+type reportableError struct {
+	irma.ClientFailure
+	msg string
+}
+
+func (e *reportableError) Error() string {
+	return e.msg
+}
+
+// clientFailure returns the report to the server of the failure of a session. It contains
+// no error messages, which might contain attribute values or other information about the user,
+// but only a code and the identifier of the scheme, credential type or public key involved.
+func clientFailure(err *irma.SessionError) *irma.ClientFailure {
+	for cause := err.Err; cause != nil; {
+		switch e := cause.(type) {
+		case *reportableError:
+			failure := e.ClientFailure
+			return &failure
+		case *errors.Error:
+			cause = e.Err
+		default:
+			cause = nil
+		}
+	}
+
+	switch err.ErrorType {
+	case irma.ErrorUnknownSchemeManager:
+		id := err.Info
+		if len(id) > irma.MaxClientFailureIdentifierLength {
+			id = ""
+		}
+		return &irma.ClientFailure{Code: irma.FailureUnknownScheme, Identifier: id}
+	case irma.ErrorInvalidSchemeManager:
+		return &irma.ClientFailure{Code: irma.FailureUnknownScheme}
+	case irma.ErrorKeyshare:
+		return &irma.ClientFailure{Code: irma.FailureKeyshare}
+	case irma.ErrorConfigurationDownload, irma.ErrorInsecureURL:
+		return &irma.ClientFailure{Code: irma.FailureConfigurationDownload}
+	case irma.ErrorCrypto:
+		return &irma.ClientFailure{Code: irma.FailureCrypto}
+	case irma.ErrorProtocolVersionNotSupported, irma.ErrorInvalidJWT, irma.ErrorUnknownAction,
+		irma.ErrorSerialization, irma.ErrorRequestorMismatch:
+		return &irma.ClientFailure{Code: irma.FailureProtocol}
+	default:
+		return &irma.ClientFailure{Code: irma.FailureOther}
+	}
+}
+
 // managerSession performs a "session" in which a new scheme manager is added (asking for permission first).
 func (session *session) managerSession() {
 	defer session.recoverFromPanic()
@@ -408,7 +765,7 @@ func (session *session) managerSession() {
 	// when asking installation permission.
 	manager, err := irma.DownloadSchemeManager(session.ServerURL)
 	if err != nil {
-		session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
+		session.Handler.Failure(downloadError(err))
 		return
 	}
 
@@ -418,7 +775,7 @@ func (session *session) managerSession() {
 			return
 		}
 		if err := session.client.Configuration.InstallSchemeManager(manager, nil); err != nil {
-			session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
+			session.Handler.Failure(downloadError(err))
 			return
 		}
 
@@ -489,6 +846,7 @@ func (session *session) checkKeyshareEnrollment() bool {
 		distributed := manager.Distributed()
 		_, enrolled := session.client.keyshareServers[id]
 		if distributed && !enrolled {
+			session.failure = &irma.ClientFailure{Code: irma.FailureKeyshareEnrollment, Identifier: id.String()}
 			session.Handler.KeyshareEnrollmentMissing(id)
 			return false
 		}
@@ -515,6 +873,12 @@ func (session *session) checkAndUpateConfiguration() bool {
 		}
 	}
 
+	// Refuse the session if it involves stale schemes and the preferences say so, see freshness.go
+	if id, refuse := session.client.refuseStaleSchemes(session.Action, session.request); refuse {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorStaleScheme, Info: id.String()})
+		return false
+	}
+
 	// Check if we are enrolled into all involved keyshare servers
 	if !session.checkKeyshareEnrollment() {
 		return false
@@ -523,7 +887,7 @@ func (session *session) checkAndUpateConfiguration() bool {
 	// Download missing credential types/issuers/public keys from the scheme manager
 	downloaded, err := session.client.Configuration.Download(session.request)
 	if err != nil {
-		session.fail(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
+		session.fail(downloadError(err))
 		return false
 	}
 	if downloaded != nil && !downloaded.Empty() {
@@ -532,6 +896,19 @@ func (session *session) checkAndUpateConfiguration() bool {
 	return true
 }
 
+// downloadError returns the SessionError for an error that occurred while downloading configuration,
+// which is of type irma.ErrorInsecureURL if the download was refused because it would not use HTTPS.
+func downloadError(err error) *irma.SessionError {
+	cause := err
+	if serr, ok := err.(*irma.SchemeManagerError); ok {
+		cause = serr.Err
+	}
+	if _, ok := cause.(*irma.InsecureURLError); ok {
+		return &irma.SessionError{ErrorType: irma.ErrorInsecureURL, Err: err}
+	}
+	return &irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err}
+}
+
 // IsInteractive returns whether this session uses an API server or not.
 func (session *session) IsInteractive() bool {
 	return session.ServerURL != ""
@@ -568,12 +945,13 @@ func (session *session) Distributed() bool {
 func (session *session) recoverFromPanic() {
 	if e := recover(); e != nil {
 		if session.Handler != nil {
-			session.Handler.Failure(panicToError(e))
+			session.Handler.Failure(panicToError(e, session.redact))
 		}
 	}
 }
 
-func panicToError(e interface{}) *irma.SessionError {
+// panicToError converts the recovered panic to an error, redacting its message and stack trace.
+func panicToError(e interface{}, redact func(string) string) *irma.SessionError {
 	var info string
 	switch x := e.(type) {
 	case string:
@@ -584,25 +962,77 @@ func panicToError(e interface{}) *irma.SessionError {
 		info = x.String()
 	default: // nop
 	}
+	info = redact(info)
 	fmt.Println("Panic: " + info)
-	return &irma.SessionError{ErrorType: irma.ErrorPanic, Info: info + "\n\n" + string(debug.Stack())}
+	return &irma.SessionError{ErrorType: irma.ErrorPanic, Info: info + "\n\n" + redact(string(debug.Stack()))}
 }
 
 // Idempotently send DELETE to remote server, returning whether or not we did something
 func (session *session) delete() bool {
 	if !session.done {
 		if session.IsInteractive() {
+			session.reportFailure()
 			session.transport.Delete()
+			session.closeConnections()
 		}
-		session.done = true
+		session.markDone()
+		session.client.dropPendingPrompt(session)
 		return true
 	}
 	return false
 }
 
+// markDone marks the session as done, if it was not already.
+func (session *session) markDone() {
+	if !session.done {
+		session.done = true
+		// Scheme sessions are not registered by startSession()
+		if session.Action != irma.ActionSchemeManager {
+			session.client.finishSession()
+		}
+	}
+}
+
+// startSession registers a session that may use or store credentials as running, waiting for
+// operations that must not run concurrently with sessions, such as CompactStorage(), to finish.
+// Other operations using the unwrapped secret key (see keystore.go) register themselves likewise,
+// so that it is not released while they are using it.
+func (client *Client) startSession() {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	client.runningSessions++
+}
+
+// finishSession registers that a session started by startSession() is done, releasing the
+// unwrapped secret key once no sessions are running anymore.
+func (client *Client) finishSession() {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	client.runningSessions--
+	if client.runningSessions == 0 {
+		client.releaseSecretKey()
+	}
+}
+
+// closeConnections closes the connections of the session, if it has its own.
+func (session *session) closeConnections() {
+	if session.pool != nil {
+		session.pool.Close()
+	}
+}
+
 func (session *session) fail(err *irma.SessionError) {
+	if !session.done && session.failure == nil {
+		session.failure = clientFailure(err)
+	}
 	if session.delete() {
 		err.Err = errors.Wrap(err.Err, 0)
+		// Errors of keyshare servers are translated by KeyshareError()
+		if err.RemoteError != nil && err.ErrorType != irma.ErrorKeyshare {
+			if requestor := session.client.Configuration.RequestorForHost(session.Hostname); requestor != nil {
+				err.LocalizedMessage, _ = session.client.Configuration.RemoteErrorMessage(err.RemoteError, requestor.Scheme, session.client.language())
+			}
+		}
 		session.Handler.Failure(err)
 	}
 }
@@ -632,6 +1062,7 @@ func (session *session) KeyshareDone(message interface{}) {
 		session.sendResponse(&irma.IssueCommitmentMessage{
 			IssueCommitmentMessage: message.(*gabi.IssueCommitmentMessage),
 			Indices:                session.attrIndices,
+			CredentialIDs:          issuanceCredentialIDs(session.request.(*irma.IssuanceRequest)),
 		})
 	}
 }
@@ -641,14 +1072,17 @@ func (session *session) KeyshareCancelled() {
 }
 
 func (session *session) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	session.failure = &irma.ClientFailure{Code: irma.FailureKeyshareEnrollment, Identifier: manager.String()}
 	session.Handler.KeyshareEnrollmentIncomplete(manager)
 }
 
 func (session *session) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	session.failure = &irma.ClientFailure{Code: irma.FailureKeyshareEnrollment, Identifier: manager.String()}
 	session.Handler.KeyshareEnrollmentDeleted(manager)
 }
 
 func (session *session) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	session.failure = &irma.ClientFailure{Code: irma.FailureKeyshareBlocked, Identifier: manager.String()}
 	session.Handler.KeyshareBlocked(manager, duration)
 }
 
@@ -660,9 +1094,26 @@ func (session *session) KeyshareError(manager *irma.SchemeManagerIdentifier, err
 	} else {
 		serr.ErrorType = irma.ErrorKeyshare
 	}
+	if serr.RemoteError != nil && manager != nil {
+		serr.LocalizedMessage, _ = session.client.Configuration.RemoteErrorMessage(serr.RemoteError, *manager, session.client.language())
+	}
 	session.fail(serr)
 }
 
+func (session *session) KeyshareKeyRotated(manager irma.SchemeManagerIdentifier) error {
+	downloaded := &irma.IrmaIdentifierSet{
+		SchemeManagers:  map[irma.SchemeManagerIdentifier]struct{}{},
+		Issuers:         map[irma.IssuerIdentifier]struct{}{},
+		CredentialTypes: map[irma.CredentialTypeIdentifier]struct{}{},
+	}
+	if err := session.client.Configuration.UpdateSchemeManager(manager, downloaded); err != nil {
+		return err
+	}
+	downloaded.SchemeManagers[manager] = struct{}{}
+	session.client.handler.UpdateConfiguration(downloaded)
+	return nil
+}
+
 func (session *session) KeysharePin() {
 	session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
 }
@@ -0,0 +1,385 @@
+package irmaclient
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains an alternative storage for the attributes and signatures of the credentials
+// of the client, in an SQLite database instead of in the attrs and archive files and the sigs folder.
+// This allows large wallets to be queried by credential type or attribute value (see QueryCredentials())
+// without deserializing all of their credentials, and signatures to be stored without one file per
+// credential. The other contents of the storage are still kept in files. New() does not load the
+// attributes from the database: they are loaded on first use, as with WithLazyAttributeLoading() (see
+// lazy.go), with the amount of credentials per credential type queried from the database meanwhile.
+// QueryCredentials() is answered by the database without loading the attributes.
+//
+// The SQLite database driver is not included in this package: the app must register it by importing
+// it (e.g. github.com/mattn/go-sqlite3), and pass its name to WithSQLiteStorage(). When the SQLite storage
+// is first enabled, the existing attributes and signatures are moved into the database.
+
+const sqlStorageFile = "storage.db"
+
+const sqlStorageSchema = `
+CREATE TABLE IF NOT EXISTS credentials (
+	hash TEXT NOT NULL,
+	archived INTEGER NOT NULL,
+	credtype TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	attributes BLOB NOT NULL,
+	PRIMARY KEY (hash, archived)
+);
+CREATE INDEX IF NOT EXISTS credentials_credtype ON credentials (credtype);
+CREATE TABLE IF NOT EXISTS attribute_values (
+	hash TEXT NOT NULL,
+	archived INTEGER NOT NULL,
+	attrtype TEXT NOT NULL,
+	value TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS attribute_values_attrtype ON attribute_values (attrtype, value);
+CREATE TABLE IF NOT EXISTS signatures (
+	hash TEXT NOT NULL PRIMARY KEY,
+	signature BLOB NOT NULL
+);`
+
+// WithSQLiteStorage stores the attributes and signatures of the client in an SQLite database,
+// using the database/sql driver registered under the specified name (usually "sqlite3").
+// It cannot be combined with WithStoragePassphrase() or WithStorageKey().
+func WithSQLiteStorage(driverName string) Option {
+	return func(o *options) {
+		o.sqlDriver = driverName
+	}
+}
+
+// CredentialQuery selects credentials in QueryCredentials(). Empty fields match all credentials.
+type CredentialQuery struct {
+	CredentialType irma.CredentialTypeIdentifier
+	// If set, only credentials in which this attribute has the specified Value are selected
+	Attribute irma.AttributeTypeIdentifier
+	Value     string
+	// Whether to select archived credentials instead of the credentials in use
+	Archived bool
+}
+
+type sqlStorage struct {
+	db *sql.DB
+}
+
+// openSQL opens (creating it if necessary) the SQLite database of the storage, moving
+// the attributes and signatures in the files of the storage into it, if any.
+func (s *storage) openSQL(driverName string) error {
+	db, err := sql.Open(driverName, s.path(sqlStorageFile))
+	if err != nil {
+		return err
+	}
+	// Overwrite deleted content, see wipe.go
+	if _, err = db.Exec("PRAGMA secure_delete = ON"); err != nil {
+		db.Close()
+		return err
+	}
+	if _, err = db.Exec(sqlStorageSchema); err != nil {
+		db.Close()
+		return err
+	}
+	sqldb := &sqlStorage{db: db}
+	if err = s.migrateToSQL(sqldb); err != nil {
+		db.Close()
+		return err
+	}
+	s.sql = sqldb
+	return nil
+}
+
+// migrateToSQL moves the attributes and signatures from the files of the storage into the database.
+// The files are only removed after all of their contents have been committed to the database, so
+// if this is interrupted it is redone the next time.
+func (s *storage) migrateToSQL(db *sqlStorage) error {
+	exists := false
+	for _, file := range []string{attributesFile, archiveFile} {
+		e, err := fs.PathExists(s.path(file))
+		if err != nil {
+			return err
+		}
+		exists = exists || e
+	}
+	if !exists {
+		return nil
+	}
+
+	attributes, err := s.LoadAttributes()
+	if err != nil {
+		return err
+	}
+	archive, err := s.LoadArchive()
+	if err != nil {
+		return err
+	}
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = db.storeAttributeLists(tx, attributes, false); err != nil {
+		return err
+	}
+	if err = db.storeAttributeLists(tx, archive, true); err != nil {
+		return err
+	}
+	for _, lists := range []map[irma.CredentialTypeIdentifier][]*irma.AttributeList{attributes, archive} {
+		for _, attrlistlist := range lists {
+			for _, attrs := range attrlistlist {
+				exists, err := fs.PathExists(s.path(s.signatureFilename(attrs)))
+				if err != nil {
+					return err
+				}
+				if !exists {
+					continue // nothing to migrate; loading the credential will fail as it did before
+				}
+				sig, err := s.LoadSignature(attrs)
+				if err != nil {
+					return err
+				}
+				if err = db.storeSignature(tx, attrs.Hash(), sig); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, file := range []string{attributesFile, archiveFile} {
+		s.record(JournalRemove, file, nil)
+		if err = os.Remove(s.path(file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.record(JournalRemove, signaturesDir, nil)
+	return os.RemoveAll(s.path(signaturesDir))
+}
+
+// storeAttributeLists replaces the (archived) attribute lists in the database by the specified ones.
+func (db *sqlStorage) storeAttributeLists(tx *sql.Tx, attributes map[irma.CredentialTypeIdentifier][]*irma.AttributeList, archived bool) error {
+	if _, err := tx.Exec("DELETE FROM credentials WHERE archived = ?", archived); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM attribute_values WHERE archived = ?", archived); err != nil {
+		return err
+	}
+	for id, attrlistlist := range attributes {
+		for i, attrs := range attrlistlist {
+			bts, err := json.Marshal(attrs)
+			if err != nil {
+				return err
+			}
+			hash := attrs.Hash()
+			if _, err = tx.Exec(
+				"INSERT INTO credentials (hash, archived, credtype, position, attributes) VALUES (?, ?, ?, ?, ?)",
+				hash, archived, id.String(), i, bts,
+			); err != nil {
+				return err
+			}
+			ct := attrs.CredentialType()
+			if ct == nil {
+				continue
+			}
+			for _, attrtype := range ct.AttributeTypes {
+				attrid := attrtype.GetAttributeTypeIdentifier()
+				value := attrs.UntranslatedAttribute(attrid)
+				if value == nil {
+					continue
+				}
+				if _, err = tx.Exec(
+					"INSERT INTO attribute_values (hash, archived, attrtype, value) VALUES (?, ?, ?, ?)",
+					hash, archived, attrid.String(), *value,
+				); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (db *sqlStorage) storeSignature(tx *sql.Tx, hash string, sig *gabi.CLSignature) error {
+	bts, err := json.Marshal(sig)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO signatures (hash, signature) VALUES (?, ?)", hash, bts)
+	return err
+}
+
+// transaction runs f within a transaction, which is committed if f returns no error.
+func (db *sqlStorage) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// compact removes the signatures of which the credential no longer exists, and reclaims
+// the space they occupied in the database file.
+func (db *sqlStorage) compact() (*CompactionResult, error) {
+	const orphaned = "FROM signatures WHERE hash NOT IN (SELECT hash FROM credentials)"
+	result := &CompactionResult{}
+	err := db.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(LENGTH(signature)), 0) "+orphaned).
+		Scan(&result.Signatures, &result.Reclaimed)
+	if err != nil || result.Signatures == 0 {
+		return result, err
+	}
+	if _, err = db.db.Exec("DELETE " + orphaned); err != nil {
+		return nil, err
+	}
+	if _, err = db.db.Exec("VACUUM"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (db *sqlStorage) loadSignature(hash string) (*gabi.CLSignature, error) {
+	var bts []byte
+	err := db.db.QueryRow("SELECT signature FROM signatures WHERE hash = ?", hash).Scan(&bts)
+	if err == sql.ErrNoRows {
+		return nil, errors.Errorf("Signature %s not found", hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sig := new(gabi.CLSignature)
+	if err = json.Unmarshal(bts, sig); err != nil {
+		return nil, &StorageCorruptionError{File: signaturesDir + "/" + hash, Err: err}
+	}
+	return sig, nil
+}
+
+// countCredentials returns the amount of credentials per credential type, i.e. the attributes index
+// with which the attributes are loaded lazily (see lazy.go).
+func (db *sqlStorage) countCredentials() (attributesIndex, error) {
+	rows, err := db.db.Query("SELECT credtype, COUNT(*) FROM credentials WHERE archived = ? GROUP BY credtype", false)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	index := attributesIndex{}
+	for rows.Next() {
+		var credtype string
+		var count int
+		if err = rows.Scan(&credtype, &count); err != nil {
+			return nil, err
+		}
+		index[irma.NewCredentialTypeIdentifier(credtype)] = count
+	}
+	return index, rows.Err()
+}
+
+func (db *sqlStorage) deleteSignature(hash string) error {
+	_, err := db.db.Exec("DELETE FROM signatures WHERE hash = ?", hash)
+	return err
+}
+
+// queryAttributeLists returns the attribute lists selected by the query, in storage order.
+func (db *sqlStorage) queryAttributeLists(query CredentialQuery) ([]*irma.AttributeList, error) {
+	var conditions []string
+	args := []interface{}{query.Archived}
+	conditions = append(conditions, "c.archived = ?")
+	if !query.CredentialType.Empty() {
+		conditions = append(conditions, "c.credtype = ?")
+		args = append(args, query.CredentialType.String())
+	}
+	if !query.Attribute.Empty() {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM attribute_values v "+
+			"WHERE v.hash = c.hash AND v.archived = c.archived AND v.attrtype = ? AND v.value = ?)")
+		args = append(args, query.Attribute.String(), query.Value)
+	}
+
+	rows, err := db.db.Query("SELECT c.attributes FROM credentials c WHERE "+
+		strings.Join(conditions, " AND ")+" ORDER BY c.credtype, c.position", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lists []*irma.AttributeList
+	for rows.Next() {
+		var bts []byte
+		if err = rows.Scan(&bts); err != nil {
+			return nil, err
+		}
+		attrs := &irma.AttributeList{}
+		if err = json.Unmarshal(bts, attrs); err != nil {
+			return nil, err
+		}
+		lists = append(lists, attrs)
+	}
+	return lists, rows.Err()
+}
+
+// QueryCredentials returns information on the credentials selected by the query. With the SQLite
+// storage (see WithSQLiteStorage()) the query is performed by the database.
+func (client *Client) QueryCredentials(query CredentialQuery) (irma.CredentialInfoList, error) {
+	if client.WalletLocked() {
+		return nil, ErrWalletLocked
+	}
+	if client.storage.sql == nil {
+		if err := client.ensureAttributes(); err != nil {
+			return nil, err
+		}
+	}
+	if !query.Attribute.Empty() && !query.CredentialType.Empty() && query.Attribute.CredentialTypeIdentifier() != query.CredentialType {
+		return nil, errors.Errorf("Attribute %s does not belong to credential type %s", query.Attribute, query.CredentialType)
+	}
+
+	var lists []*irma.AttributeList
+	if client.storage.sql != nil {
+		var err error
+		if lists, err = client.storage.sql.queryAttributeLists(query); err != nil {
+			return nil, err
+		}
+		for _, attrs := range lists {
+			attrs.MetadataAttribute = irma.MetadataFromInt(attrs.Ints[0], client.Configuration)
+		}
+	} else {
+		source := client.attributes
+		if query.Archived {
+			source = client.archived
+		}
+		for id, attrlistlist := range source {
+			if !query.CredentialType.Empty() && id != query.CredentialType {
+				continue
+			}
+			for _, attrs := range attrlistlist {
+				if !query.Attribute.Empty() {
+					if attrs.CredentialType() == nil {
+						continue
+					}
+					value := attrs.UntranslatedAttribute(query.Attribute)
+					if value == nil || *value != query.Value {
+						continue
+					}
+				}
+				lists = append(lists, attrs)
+			}
+		}
+	}
+
+	list := irma.CredentialInfoList{}
+	for _, attrs := range lists {
+		if info := attrs.Info(); info != nil {
+			list = append(list, info)
+		}
+	}
+	return list, nil
+}
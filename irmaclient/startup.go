@@ -0,0 +1,71 @@
+package irmaclient
+
+import (
+	"sync"
+	"time"
+)
+
+// This file contains the concurrent initialization of the client, reducing the startup latency
+// of New() on slow (mobile) storage. It runs in the following phases:
+//  1. parsing the configuration, concurrently with opening the storage (locking it, checking its
+//     schema version and setting up encryption) and loading the preferences;
+//  2. opening the SQLite storage if enabled, and migrating the storage, which both use the configuration;
+//  3. loading the secret key, the attributes, the keyshare servers and the remaining state
+//     (subscriptions, usage, provenance and removals) concurrently (see loadStorage()).
+// When the wallet lock is enabled, the third phase happens when the wallet is unlocked.
+// The duration of each phase is available from StartupTimings().
+
+// StartupTimings contains the duration of the phases of the initialization of the client.
+// Concurrent phases overlap, so their durations do not add up to the total.
+type StartupTimings struct {
+	Configuration   time.Duration
+	Storage         time.Duration
+	Preferences     time.Duration
+	Migrations      time.Duration
+	SecretKey       time.Duration
+	Attributes      time.Duration
+	KeyshareServers time.Duration
+	Other           time.Duration
+	Total           time.Duration
+}
+
+// StartupTimings returns the duration of the phases of New(), and of UnlockWallet() for the phases
+// that happen when the wallet is unlocked.
+func (client *Client) StartupTimings() StartupTimings {
+	return client.timings
+}
+
+// loadGroup runs functions concurrently, keeping the first error that they return.
+type loadGroup struct {
+	wg   sync.WaitGroup
+	once sync.Once
+	err  error
+}
+
+// run runs f in a goroutine, storing the time it took in duration.
+func (g *loadGroup) run(duration *time.Duration, f func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		start := time.Now()
+		err := f()
+		*duration = time.Since(start)
+		if err != nil {
+			g.once.Do(func() { g.err = err })
+		}
+	}()
+}
+
+// wait waits until all functions have returned, returning the first error, if any.
+func (g *loadGroup) wait() error {
+	g.wg.Wait()
+	return g.err
+}
+
+// timed runs f, storing the time it took in duration.
+func timed(duration *time.Duration, f func() error) error {
+	start := time.Now()
+	err := f()
+	*duration = time.Since(start)
+	return err
+}
@@ -0,0 +1,141 @@
+package irmaclient
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// Stats contains statistics about the contents and usage of the client, e.g. for display in
+// settings screens. It contains no attribute values or other personal data, so that it may
+// also be used for (opt-in, anonymized) telemetry.
+type Stats struct {
+	// Amount of credentials per scheme and per issuer
+	CredentialsPerScheme map[irma.SchemeManagerIdentifier]int `json:"credentialsPerScheme"`
+	CredentialsPerIssuer map[irma.IssuerIdentifier]int        `json:"credentialsPerIssuer"`
+	// Amount of sessions per month (formatted as 2006-01) and per session type, from the logs
+	// (excluding credential removals)
+	SessionsPerMonth map[string]map[irma.Action]int `json:"sessionsPerMonth"`
+	// Total size in bytes of the files in the client storage
+	StorageSize int64 `json:"storageSize"`
+	// Time of last modification of each scheme
+	SchemeTimestamps map[irma.SchemeManagerIdentifier]irma.Timestamp `json:"schemeTimestamps"`
+}
+
+// Stats computes statistics about the contents and usage of the client.
+func (client *Client) Stats() (*Stats, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	stats := &Stats{
+		CredentialsPerScheme: map[irma.SchemeManagerIdentifier]int{},
+		CredentialsPerIssuer: map[irma.IssuerIdentifier]int{},
+		SessionsPerMonth:     map[string]map[irma.Action]int{},
+		SchemeTimestamps:     map[irma.SchemeManagerIdentifier]irma.Timestamp{},
+	}
+
+	for credtype, attrlistlist := range client.attributes {
+		issuer := credtype.IssuerIdentifier()
+		stats.CredentialsPerScheme[issuer.SchemeManagerIdentifier()] += len(attrlistlist)
+		stats.CredentialsPerIssuer[issuer] += len(attrlistlist)
+	}
+
+	// Count the sessions one log segment at a time, skipping the entries of credential removals
+	// and the summaries of pruned entries, which are not sessions
+	end, err := client.storage.LogPosition()
+	if err != nil {
+		return nil, err
+	}
+	err = client.storage.EachLogBefore(end, func(entry *LogEntry) (bool, error) {
+		if entry.Type == actionRemoval || entry.Type == actionPruned {
+			return true, nil
+		}
+		month := time.Time(entry.Time).Format("2006-01")
+		if stats.SessionsPerMonth[month] == nil {
+			stats.SessionsPerMonth[month] = map[irma.Action]int{}
+		}
+		stats.SessionsPerMonth[month][entry.Type]++
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := client.storage.info()
+	if err != nil {
+		return nil, err
+	}
+	stats.StorageSize = info.Total()
+
+	for id, manager := range client.Configuration.SchemeManagers {
+		stats.SchemeTimestamps[id] = manager.Timestamp
+	}
+
+	return stats, nil
+}
+
+// StorageInfo contains the size in bytes of the files in the client storage, per category,
+// e.g. for display in settings screens.
+type StorageInfo struct {
+	// The schemes in irma_configuration
+	Configuration int64 `json:"configuration"`
+	// The attributes and signatures of the credentials, including archived credentials
+	Credentials int64 `json:"credentials"`
+	Logs        int64 `json:"logs"`
+	// The enrollments at keyshare servers
+	Keyshare int64 `json:"keyshare"`
+	// Everything else, such as the secret key and preferences
+	Other int64 `json:"other"`
+}
+
+// Total returns the total size of the client storage.
+func (info *StorageInfo) Total() int64 {
+	return info.Configuration + info.Credentials + info.Logs + info.Keyshare + info.Other
+}
+
+// StorageInfo computes the size of the files in the client storage, per category.
+func (client *Client) StorageInfo() (*StorageInfo, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	return client.storage.info()
+}
+
+func (s *storage) info() (*StorageInfo, error) {
+	info := &StorageInfo{}
+	if s.memory != nil {
+		for file, size := range s.memory.sizes() {
+			*info.category(file) += size
+		}
+		return info, nil
+	}
+	err := s.walk(func(file, path string, fileinfo os.FileInfo) error {
+		if fileinfo.IsDir() {
+			return nil
+		}
+		*info.category(file) += fileinfo.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// category returns the field of the category of the specified file within the storage.
+func (info *StorageInfo) category(file string) *int64 {
+	switch strings.SplitN(file, "/", 2)[0] {
+	case "irma_configuration":
+		return &info.Configuration
+	case attributesFile, attrsIndexFile, archiveFile, signaturesDir, sqlStorageFile, provenanceFile, removalsFile, issuanceQueueFile:
+		return &info.Credentials
+	case logSegmentsDir, logsFile:
+		return &info.Logs
+	case kssFile:
+		return &info.Keyshare
+	default:
+		return &info.Other
+	}
+}
@@ -1,10 +1,13 @@
 package irmaclient
 
 import (
+	"crypto/cipher"
+	"database/sql"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
@@ -17,21 +20,49 @@ import (
 type storage struct {
 	storagePath   string
 	Configuration *irma.Configuration
+
+	// Locations of data classes stored outside the storage path, see storagelocation.go
+	locations map[DataClass]string
+
+	logIndex *logIndex // cached, see loadLogIndex()
+
+	// Set if the storage is encrypted, see encryption.go
+	aead cipher.AEAD
+	// Set if the check value of encrypted storage records that the wallet lock is enabled
+	walletLockCheck bool
+	// Set if attributes and signatures are stored in SQLite, see sqlstorage.go
+	sql *sqlStorage
+	// Set if the storage is kept in memory, see memstorage.go
+	memory *memoryFiles
+	// Holds the lock on the storage, see storagelock.go
+	lockFile *os.File
+	// Set if the storage journal is enabled, see journal.go
+	journal *storageJournal
 }
 
 // Filenames in which we store stuff
 const (
-	skFile          = "sk"
-	attributesFile  = "attrs"
-	kssFile         = "kss"
-	updatesFile     = "updates"
-	logsFile        = "logs"
-	preferencesFile = "preferences"
-	signaturesDir   = "sigs"
+	skFile              = "sk"
+	attributesFile      = "attrs"
+	attrsIndexFile      = "attrsindex"
+	archiveFile         = "archive"
+	kssFile             = "kss"
+	updatesFile         = "updates" // no longer used except for migration, see migrations.go
+	logsFile            = "logs"    // no longer used except for migration, see logstorage.go
+	preferencesFile     = "preferences"
+	walletLockFile      = "walletlock"
+	subscriptionsFile   = "subscriptions"
+	signaturesDir       = "sigs"
+	usageFile           = "usage"
+	provenanceFile      = "provenance"
+	removalsFile        = "removals"
+	healthReportKeyFile = "attestationkey" // named so by earlier versions
+	guardianshipsFile   = "guardianships"
+	issuanceQueueFile   = "issuancequeue"
 )
 
 func (s *storage) path(p string) string {
-	return s.storagePath + "/" + p
+	return s.location(p) + "/" + p
 }
 
 // EnsureStorageExists initializes the credential storage folder,
@@ -40,22 +71,77 @@ func (s *storage) path(p string) string {
 // Setting it up in a properly protected location (e.g., with automatic
 // backups to iCloud/Google disabled) is the responsibility of the user.
 func (s *storage) EnsureStorageExists() error {
+	if s.memory != nil {
+		return nil
+	}
 	if err := fs.AssertPathExists(s.storagePath); err != nil {
 		return err
 	}
+	if err := s.checkLocations(); err != nil {
+		return err
+	}
 	return fs.EnsureDirectoryExists(s.path(signaturesDir))
 }
 
-func (s *storage) load(dest interface{}, path string) (err error) {
-	exists, err := fs.PathExists(s.path(path))
+// The following functions access the files of the storage, on disk or in memory,
+// by their name within the storage path.
+
+func (s *storage) fileExists(file string) (bool, error) {
+	if s.memory != nil {
+		_, exists := s.memory.read(file)
+		return exists, nil
+	}
+	return fs.PathExists(s.path(file))
+}
+
+// readFile returns the contents of the file, or nil if it does not exist.
+func (s *storage) readFile(file string) ([]byte, error) {
+	if s.memory != nil {
+		bts, _ := s.memory.read(file)
+		return bts, nil
+	}
+	exists, err := fs.PathExists(s.path(file))
 	if err != nil || !exists {
+		return nil, err
+	}
+	return ioutil.ReadFile(s.path(file))
+}
+
+func (s *storage) writeFile(file string, bts []byte) error {
+	s.record(JournalWrite, file, bts)
+	if s.memory != nil {
+		s.memory.write(file, bts)
+		return nil
+	}
+	return fs.SaveFile(s.path(file), bts)
+}
+
+func (s *storage) removeFile(file string) error {
+	s.record(JournalRemove, file, nil)
+	if s.memory != nil {
+		return s.memory.remove(file)
+	}
+	return os.Remove(s.path(file))
+}
+
+func (s *storage) load(dest interface{}, path string) (err error) {
+	bytes, err := s.readFile(path)
+	if err != nil || bytes == nil {
 		return
 	}
-	bytes, err := ioutil.ReadFile(s.path(path))
-	if err != nil {
+	if bytes, err = s.decrypt(bytes, path); err != nil {
+		if err != ErrStorageEncrypted {
+			err = &StorageCorruptionError{File: path, Err: err}
+		}
+		return
+	}
+	if bytes, err = verifyChecksum(bytes, path); err != nil {
 		return
 	}
-	return json.Unmarshal(bytes, dest)
+	if err = json.Unmarshal(bytes, dest); err != nil {
+		return &StorageCorruptionError{File: path, Err: err}
+	}
+	return nil
 }
 
 func (s *storage) store(contents interface{}, file string) error {
@@ -63,7 +149,12 @@ func (s *storage) store(contents interface{}, file string) error {
 	if err != nil {
 		return err
 	}
-	return fs.SaveFile(s.path(file), bts)
+	if s.aead == nil {
+		bts = addChecksum(bts)
+	} else if bts, err = s.encrypt(bts, file); err != nil {
+		return err
+	}
+	return s.writeFile(file, bts)
 }
 
 func (s *storage) signatureFilename(attrs *irma.AttributeList) string {
@@ -76,10 +167,20 @@ func (s *storage) signatureFilename(attrs *irma.AttributeList) string {
 }
 
 func (s *storage) DeleteSignature(attrs *irma.AttributeList) error {
-	return os.Remove(s.path(s.signatureFilename(attrs)))
+	if s.sql != nil {
+		s.record(JournalRemove, "sql:signatures/"+attrs.Hash(), nil)
+		return s.sql.deleteSignature(attrs.Hash())
+	}
+	return s.wipeFile(s.signatureFilename(attrs))
 }
 
 func (s *storage) StoreSignature(cred *credential) error {
+	if s.sql != nil {
+		s.record(JournalWrite, "sql:signatures/"+cred.AttributeList().Hash(), nil)
+		return s.sql.transaction(func(tx *sql.Tx) error {
+			return s.sql.storeSignature(tx, cred.AttributeList().Hash(), cred.Signature)
+		})
+	}
 	return s.store(cred.Signature, s.signatureFilename(cred.AttributeList()))
 }
 
@@ -88,6 +189,31 @@ func (s *storage) StoreSecretKey(sk *secretKey) error {
 }
 
 func (s *storage) StoreAttributes(attributes map[irma.CredentialTypeIdentifier][]*irma.AttributeList) error {
+	if err := s.storeAttributeLists(attributes, attributesFile); err != nil {
+		return err
+	}
+	return s.StoreAttributesIndex(newAttributesIndex(attributes))
+}
+
+func (s *storage) StoreAttributesIndex(index attributesIndex) error {
+	if s.sql != nil {
+		return nil // the index is queried from the database, see sqlstorage.go
+	}
+	return s.store(index, attrsIndexFile)
+}
+
+func (s *storage) StoreArchive(archive map[irma.CredentialTypeIdentifier][]*irma.AttributeList) error {
+	return s.storeAttributeLists(archive, archiveFile)
+}
+
+func (s *storage) storeAttributeLists(attributes map[irma.CredentialTypeIdentifier][]*irma.AttributeList, file string) error {
+	if s.sql != nil {
+		s.record(JournalWrite, "sql:credentials/"+file, nil)
+		return s.sql.transaction(func(tx *sql.Tx) error {
+			return s.sql.storeAttributeLists(tx, attributes, file == archiveFile)
+		})
+	}
+
 	temp := []*irma.AttributeList{}
 	for _, attrlistlist := range attributes {
 		for _, attrlist := range attrlistlist {
@@ -95,30 +221,64 @@ func (s *storage) StoreAttributes(attributes map[irma.CredentialTypeIdentifier][
 		}
 	}
 
-	return s.store(temp, attributesFile)
+	return s.store(temp, file)
 }
 
 func (s *storage) StoreKeyshareServers(keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer) error {
 	return s.store(keyshareServers, kssFile)
 }
 
-func (s *storage) StoreLogs(logs []*LogEntry) error {
-	return s.store(logs, logsFile)
-}
-
 func (s *storage) StorePreferences(prefs Preferences) error {
 	return s.store(prefs, preferencesFile)
 }
 
-func (s *storage) StoreUpdates(updates []update) (err error) {
-	return s.store(updates, updatesFile)
+func (s *storage) StoreWalletLock(lock *walletLock) error {
+	return s.store(lock, walletLockFile)
+}
+
+func (s *storage) RemoveWalletLock() error {
+	if err := s.removeFile(walletLockFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *storage) StoreSubscriptions(subscriptions []*Subscription) error {
+	return s.store(subscriptions, subscriptionsFile)
+}
+
+func (s *storage) StoreUsage(usage map[irma.CredentialTypeIdentifier]*irma.CredentialUsage) error {
+	return s.store(usage, usageFile)
+}
+
+func (s *storage) StoreProvenance(provenance map[string]*irma.CredentialProvenance) error {
+	return s.store(provenance, provenanceFile)
+}
+
+func (s *storage) StoreRemovals(removals map[string]*irma.Timestamp) error {
+	return s.store(removals, removalsFile)
+}
+
+func (s *storage) StoreGuardianships(guardianships []*Guardianship) error {
+	return s.store(guardianships, guardianshipsFile)
+}
+
+func (s *storage) StoreIssuanceQueue(queue []*queuedCredential) error {
+	return s.store(queue, issuanceQueueFile)
 }
 
 func (s *storage) LoadSignature(attrs *irma.AttributeList) (signature *gabi.CLSignature, err error) {
+	if s.sql != nil {
+		return s.sql.loadSignature(attrs.Hash())
+	}
 	sigpath := s.signatureFilename(attrs)
-	if err := fs.AssertPathExists(s.path(sigpath)); err != nil {
+	exists, err := s.fileExists(sigpath)
+	if err != nil {
 		return nil, err
 	}
+	if !exists {
+		return nil, errors.Errorf("Path %s does not exist", sigpath)
+	}
 	signature = new(gabi.CLSignature)
 	if err := s.load(signature, sigpath); err != nil {
 		return nil, err
@@ -126,17 +286,30 @@ func (s *storage) LoadSignature(attrs *irma.AttributeList) (signature *gabi.CLSi
 	return signature, nil
 }
 
+// ErrSecretKeyMissing is returned when the storage contains credentials but no secret key, e.g.
+// because the storage location of the secret key was cleared (see WithStorageLocation()). A new
+// secret key is then not generated, as the credentials can only be used with their secret key.
+var ErrSecretKeyMissing = errors.New("Storage contains credentials but no secret key")
+
 // LoadSecretKey retrieves and returns the secret key from storage, or if no secret key
-// was found in storage, it generates, saves, and returns a new secret key.
+// was found in storage and there are no credentials, it generates, saves, and returns a new
+// secret key.
 func (s *storage) LoadSecretKey() (*secretKey, error) {
 	var err error
 	sk := &secretKey{}
 	if err = s.load(sk, skFile); err != nil {
 		return nil, err
 	}
-	if sk.Key != nil {
+	if sk.Key != nil || sk.Wrapped != nil {
 		return sk, nil
 	}
+	attrs, err := s.LoadAttributes()
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) > 0 {
+		return nil, ErrSecretKeyMissing
+	}
 
 	if sk, err = generateSecretKey(); err != nil {
 		return nil, err
@@ -148,9 +321,31 @@ func (s *storage) LoadSecretKey() (*secretKey, error) {
 }
 
 func (s *storage) LoadAttributes() (list map[irma.CredentialTypeIdentifier][]*irma.AttributeList, err error) {
+	return s.loadAttributeLists(attributesFile)
+}
+
+// LoadAttributesIndex returns the stored attributes index, or nil if none has been stored yet.
+func (s *storage) LoadAttributesIndex() (index attributesIndex, err error) {
+	if s.sql != nil {
+		return s.sql.countCredentials()
+	}
+	err = s.load(&index, attrsIndexFile)
+	return
+}
+
+func (s *storage) LoadArchive() (list map[irma.CredentialTypeIdentifier][]*irma.AttributeList, err error) {
+	return s.loadAttributeLists(archiveFile)
+}
+
+func (s *storage) loadAttributeLists(file string) (list map[irma.CredentialTypeIdentifier][]*irma.AttributeList, err error) {
 	// The attributes are stored as a list of instances of AttributeList
 	temp := []*irma.AttributeList{}
-	if err = s.load(&temp, attributesFile); err != nil {
+	if s.sql != nil {
+		temp, err = s.sql.queryAttributeLists(CredentialQuery{Archived: file == archiveFile})
+	} else {
+		err = s.load(&temp, file)
+	}
+	if err != nil {
 		return
 	}
 
@@ -179,23 +374,49 @@ func (s *storage) LoadKeyshareServers() (ksses map[irma.SchemeManagerIdentifier]
 	return ksses, nil
 }
 
-func (s *storage) LoadLogs() (logs []*LogEntry, err error) {
-	logs = []*LogEntry{}
-	if err := s.load(&logs, logsFile); err != nil {
-		return nil, err
-	}
-	return logs, nil
+func (s *storage) LoadSubscriptions() ([]*Subscription, error) {
+	subscriptions := []*Subscription{}
+	return subscriptions, s.load(&subscriptions, subscriptionsFile)
 }
 
-func (s *storage) LoadUpdates() (updates []update, err error) {
-	updates = []update{}
-	if err := s.load(&updates, updatesFile); err != nil {
-		return nil, err
-	}
-	return updates, nil
+func (s *storage) LoadUsage() (map[irma.CredentialTypeIdentifier]*irma.CredentialUsage, error) {
+	usage := map[irma.CredentialTypeIdentifier]*irma.CredentialUsage{}
+	return usage, s.load(&usage, usageFile)
+}
+
+func (s *storage) LoadProvenance() (map[string]*irma.CredentialProvenance, error) {
+	provenance := map[string]*irma.CredentialProvenance{}
+	return provenance, s.load(&provenance, provenanceFile)
+}
+
+func (s *storage) LoadRemovals() (map[string]*irma.Timestamp, error) {
+	removals := map[string]*irma.Timestamp{}
+	return removals, s.load(&removals, removalsFile)
+}
+
+func (s *storage) LoadGuardianships() ([]*Guardianship, error) {
+	guardianships := []*Guardianship{}
+	return guardianships, s.load(&guardianships, guardianshipsFile)
+}
+
+func (s *storage) LoadIssuanceQueue() ([]*queuedCredential, error) {
+	var queue []*queuedCredential
+	return queue, s.load(&queue, issuanceQueueFile)
 }
 
 func (s *storage) LoadPreferences() (Preferences, error) {
 	config := defaultPreferences
 	return config, s.load(&config, preferencesFile)
 }
+
+// LoadWalletLock returns the stored wallet lock, or nil if the wallet lock is not enabled.
+func (s *storage) LoadWalletLock() (*walletLock, error) {
+	lock := &walletLock{}
+	if err := s.load(lock, walletLockFile); err != nil {
+		return nil, err
+	}
+	if lock.Hash == nil {
+		return nil, nil
+	}
+	return lock, nil
+}
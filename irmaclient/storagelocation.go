@@ -0,0 +1,268 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the storage of different classes of data in different locations. By default
+// all files are stored within the storage path passed to New(), but using WithStorageLocation() the
+// app can store e.g. the secret key in a location that is excluded from backups and protected by the
+// platform, and the logs in a cache directory that the user can clear (in which case the logs are
+// lost, but the credentials are unaffected). Files not belonging to any of the classes below, such
+// as the preferences, the keyshare servers and the files of storage encryption, schema version and
+// locking, are always stored in the storage path.
+//
+// Each location must be a separate directory, not within the storage path or another location.
+// The configured locations are recorded in the locationsFile in the storage path. When the location
+// of a data class changes, its files are moved from the previous location (or from the storage path)
+// to the new one when the storage is opened; if a file exists in both, opening the storage fails, as
+// either may be the current one.
+
+// locationsFile records the storage locations, as JSON in plaintext, since it is read before storage
+// encryption is set up.
+const locationsFile = "storagelocations"
+
+// DataClass is a class of data stored by the client, see WithStorageLocation().
+type DataClass int
+
+const (
+	// DataSecretKey is the secret key of the client, and the attestation key
+	DataSecretKey DataClass = iota + 1
+	// DataCredentials are the attributes and signatures of the credentials, including the SQLite
+	// database if enabled, their provenance and removals, and the issuance queue
+	DataCredentials
+	// DataLogs are the logs of the client
+	DataLogs
+)
+
+func (class DataClass) String() string {
+	switch class {
+	case DataSecretKey:
+		return "secret key"
+	case DataCredentials:
+		return "credentials"
+	case DataLogs:
+		return "logs"
+	default:
+		return "unknown"
+	}
+}
+
+// WithStorageLocation stores the files of the specified data class in the directory at path,
+// instead of in the storage path. Except for DataLogs, it is the responsibility of the caller
+// that the directory exists; the directory of DataLogs is created if it does not exist, so that
+// it can be in a cache that is cleared by the user or the platform.
+func WithStorageLocation(class DataClass, path string) Option {
+	return func(o *options) {
+		if o.locations == nil {
+			o.locations = map[DataClass]string{}
+		}
+		o.locations[class] = path
+	}
+}
+
+// dataClass returns the class of the specified file within the storage, or 0 if it belongs to none.
+func dataClass(file string) DataClass {
+	switch strings.SplitN(file, "/", 2)[0] {
+	case skFile, healthReportKeyFile:
+		return DataSecretKey
+	case attributesFile, attrsIndexFile, archiveFile, signaturesDir, sqlStorageFile, provenanceFile, removalsFile, issuanceQueueFile:
+		return DataCredentials
+	case logSegmentsDir, logsFile:
+		return DataLogs
+	}
+	if strings.HasPrefix(file, sqlStorageFile) {
+		return DataCredentials // the journal and WAL files of SQLite
+	}
+	return 0
+}
+
+// location returns the directory in which the specified file within the storage is stored.
+func (s *storage) location(file string) string {
+	if path, ok := s.locations[dataClass(file)]; ok {
+		return path
+	}
+	return s.storagePath
+}
+
+// checkLocations checks that the storage locations are valid, and creates the location of the logs.
+func (s *storage) checkLocations() error {
+	for class, path := range s.locations {
+		if class < DataSecretKey || class > DataLogs {
+			return errors.Errorf("Unknown data class %d", class)
+		}
+		if err := checkDistinctPaths(s.storagePath, path); err != nil {
+			return err
+		}
+		for other, otherPath := range s.locations {
+			if other == class {
+				continue
+			}
+			if err := checkDistinctPaths(otherPath, path); err != nil {
+				return err
+			}
+		}
+		if class == DataLogs {
+			if err := fs.EnsureDirectoryExists(path); err != nil {
+				return err
+			}
+		} else if err := fs.AssertPathExists(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDistinctPaths returns an error if either of the paths is, or is within, the other.
+func checkDistinctPaths(a, b string) error {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	sep := string(filepath.Separator)
+	if a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep) {
+		return errors.Errorf("Storage location %s overlaps with %s", b, a)
+	}
+	return nil
+}
+
+// walk calls f for all files and directories in the storage on disk, by their name within the
+// storage and their path. If f returns filepath.SkipDir for a directory, its contents are skipped.
+func (s *storage) walk(f func(file, path string, info os.FileInfo) error) error {
+	roots := []string{s.storagePath}
+	for _, path := range s.locations {
+		roots = append(roots, path)
+	}
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == root {
+				return nil
+			}
+			file, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			file = filepath.ToSlash(file)
+			if s.location(file) != root {
+				// Files of other classes that happen to be present, e.g. created by the app,
+				// are not part of the storage
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return f(file, path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relocate moves the files of the data classes whose location changed since the storage was last
+// opened to their current location, and records the current locations. The storage must be locked.
+func (s *storage) relocate() error {
+	if s.memory != nil {
+		return nil
+	}
+	recorded := map[DataClass]string{}
+	bts, err := ioutil.ReadFile(filepath.Join(s.storagePath, locationsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err = json.Unmarshal(bts, &recorded); err != nil {
+			return errors.WrapPrefix(err, "Failed to parse storage locations", 0)
+		}
+	}
+
+	for class := DataSecretKey; class <= DataLogs; class++ {
+		to := s.storagePath
+		if path, ok := s.locations[class]; ok {
+			to = path
+		}
+		from := []string{s.storagePath}
+		if path, ok := recorded[class]; ok && path != s.storagePath {
+			from = append(from, path)
+		}
+		for _, old := range from {
+			if filepath.Clean(old) == filepath.Clean(to) {
+				continue
+			}
+			if err = relocateClass(class, old, to); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(s.locations) == 0 && len(recorded) == 0 {
+		return nil
+	}
+	if bts, err = json.Marshal(s.locations); err != nil {
+		return err
+	}
+	return fs.SaveFile(filepath.Join(s.storagePath, locationsFile), bts)
+}
+
+// relocateClass moves the files of the data class in the directory at from, if it exists, to the
+// directory at to.
+func relocateClass(class DataClass, from, to string) error {
+	infos, err := ioutil.ReadDir(from)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if dataClass(info.Name()) != class {
+			continue
+		}
+		src, dest := filepath.Join(from, info.Name()), filepath.Join(to, info.Name())
+		exists, err := fs.PathExists(dest)
+		if err != nil {
+			return err
+		}
+		// Empty directories, such as the signatures directory created when opening the storage,
+		// are not considered to exist
+		if exists && info.IsDir() && fs.Empty(src) {
+			if err = os.Remove(src); err != nil {
+				return err
+			}
+			continue
+		}
+		if exists && info.IsDir() && fs.Empty(dest) {
+			if err = os.Remove(dest); err != nil {
+				return err
+			}
+			exists = false
+		}
+		if exists {
+			return errors.Errorf("Storage file %s of the %s exists both in %s and in %s", info.Name(), class, from, to)
+		}
+		if err = os.Rename(src, dest); err == nil {
+			continue
+		}
+		// The locations may be on different file systems
+		if info.IsDir() {
+			err = fs.CopyDirectory(src, dest)
+		} else {
+			err = fs.Copy(src, dest)
+		}
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to move "+src, 0)
+		}
+		if err = os.RemoveAll(src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
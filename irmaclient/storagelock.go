@@ -0,0 +1,52 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// This file contains the locking of the storage, so that two clients cannot use the same storage
+// at the same time, which would corrupt it as each client overwrites the files of the other. New()
+// locks the storage using an advisory lock on the lockFile in the storage path (see the platform
+// specific storagelock_*.go files), failing with ErrStorageLocked if it is already locked by another
+// client, in this or another process. The lock is released by Close(), or when the process exits.
+// In-memory storage needs no locking.
+
+// ErrStorageLocked is returned by New() when the storage is in use by another client.
+var ErrStorageLocked = errors.New("Storage is in use by another client")
+
+const lockFile = "lock"
+
+func (s *storage) lock() error {
+	if s.memory != nil {
+		return nil
+	}
+	f, err := lockFileExclusive(s.path(lockFile))
+	if err != nil {
+		return err
+	}
+	s.lockFile = f
+	return nil
+}
+
+func (s *storage) unlock() error {
+	if s.lockFile == nil {
+		return nil
+	}
+	err := s.lockFile.Close() // releases the lock
+	s.lockFile = nil
+	return err
+}
+
+// Close releases the storage of the client, after which it may be used by another client.
+// The client must not be used after it is closed.
+func (client *Client) Close() error {
+	client.stopBackups()
+	client.closeRequestorPools()
+	if client.storage.sql != nil {
+		if err := client.storage.sql.db.Close(); err != nil {
+			return err
+		}
+		client.storage.sql = nil
+	}
+	return client.storage.unlock()
+}
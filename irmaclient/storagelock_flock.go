@@ -0,0 +1,25 @@
+// +build !windows,!plan9,!nacl
+
+package irmaclient
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFileExclusive opens the file and takes an exclusive flock() on it, which belongs to the
+// opened file so that it also excludes other clients in the same process.
+func lockFileExclusive(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrStorageLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
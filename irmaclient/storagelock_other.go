@@ -0,0 +1,10 @@
+// +build plan9 nacl
+
+package irmaclient
+
+import "os"
+
+// lockFileExclusive only opens the file, as file locking is not supported on this platform.
+func lockFileExclusive(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -0,0 +1,224 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains re-verification subscriptions. With a subscription, the user consents that a
+// specific verifier may request refreshed disclosures of specific attributes, up to a maximum amount
+// of times and/or until a date, without the user being asked for permission each time. Disclosure
+// sessions of the verifier (e.g. started using NewPushSession()) that request exactly the attributes
+// of one of its subscriptions are then performed automatically. A subscription is bound to the hostname
+// of the verifier as well as to its entry in the requestor registry (if any), so that the user is asked
+// for permission again if the hostname becomes associated to another requestor. The user can see the
+// subscriptions using Subscriptions() and revoke them at any time using RevokeSubscription().
+
+// Subscription allows a verifier to request disclosures of the specified attributes without
+// asking the user for permission.
+type Subscription struct {
+	ID string `json:"id"`
+	// Hostname of the server of the verifier, as in SessionRequestor.Hostname
+	Hostname string `json:"hostname"`
+	// Requestor registry entry of the verifier, as in requestorID(); empty if it was not verified
+	Requestor  string                         `json:"requestor,omitempty"`
+	Name       irma.TranslatedString          `json:"name"`
+	Attributes []irma.AttributeTypeIdentifier `json:"attributes"`
+	// Amount of disclosures allowed; 0 means unlimited (then Until must be set)
+	MaxUses int `json:"maxUses,omitempty"`
+	// After this date no disclosures are allowed; nil means no limit (then MaxUses must be set)
+	Until *irma.Timestamp `json:"until,omitempty"`
+
+	Uses     int             `json:"uses"`
+	Created  irma.Timestamp  `json:"created"`
+	LastUsed *irma.Timestamp `json:"lastUsed,omitempty"`
+}
+
+// Active returns whether the subscription still allows disclosures.
+func (sub *Subscription) Active() bool {
+	if sub.MaxUses > 0 && sub.Uses >= sub.MaxUses {
+		return false
+	}
+	return sub.Until == nil || time.Time(*sub.Until).After(time.Now())
+}
+
+// choice returns the attributes to disclose from the candidates if the disjunctions can be satisfied
+// by disclosing exactly the attributes of the subscription, and nil otherwise.
+func (sub *Subscription) choice(candidates [][]*irma.AttributeIdentifier) *irma.DisclosureChoice {
+	choice := allowedChoice(sub.Attributes, candidates)
+	if choice == nil || len(choice.Attributes) != len(sub.Attributes) {
+		return nil
+	}
+	disclosed := map[irma.AttributeTypeIdentifier]struct{}{}
+	for _, attr := range choice.Attributes {
+		disclosed[attr.Type] = struct{}{}
+	}
+	for _, attr := range sub.Attributes {
+		if _, ok := disclosed[attr]; !ok {
+			return nil
+		}
+	}
+	return choice
+}
+
+// requestorID returns the identifier of the entry of the requestor in the requestor registry,
+// or the empty string if the requestor is not verified.
+func requestorID(requestor *SessionRequestor) string {
+	if requestor.Info == nil {
+		return ""
+	}
+	return requestor.Info.Scheme.String() + "." + requestor.Info.ID
+}
+
+// allowedChoice returns, for each disjunction of candidates, the first candidate of which the type is
+// one of the allowed attributes, or nil if some disjunction contains no such candidate.
+func allowedChoice(attributes []irma.AttributeTypeIdentifier, candidates [][]*irma.AttributeIdentifier) *irma.DisclosureChoice {
+	allowed := map[irma.AttributeTypeIdentifier]struct{}{}
+	for _, attr := range attributes {
+		allowed[attr] = struct{}{}
+	}
+	choice := &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{}}
+	for _, disjunction := range candidates {
+		var chosen *irma.AttributeIdentifier
+		for _, candidate := range disjunction {
+			if _, ok := allowed[candidate.Type]; ok {
+				chosen = candidate
+				break
+			}
+		}
+		if chosen == nil {
+			return nil
+		}
+		choice.Attributes = append(choice.Attributes, chosen)
+	}
+	return choice
+}
+
+// Subscriptions returns the active subscriptions.
+func (client *Client) Subscriptions() []*Subscription {
+	client.subscriptionsLock.Lock()
+	defer client.subscriptionsLock.Unlock()
+	subs := make([]*Subscription, 0, len(client.subscriptions))
+	for _, sub := range client.subscriptions {
+		if sub.Active() {
+			copied := *sub
+			subs = append(subs, &copied)
+		}
+	}
+	return subs
+}
+
+// Subscribe creates a subscription for the requestor of a session, typically after the user consented
+// to it when asked for permission to disclose the attributes. At least one of maxUses and until
+// must be specified.
+func (client *Client) Subscribe(
+	requestor *SessionRequestor, attributes []irma.AttributeTypeIdentifier, maxUses int, until *irma.Timestamp,
+) (*Subscription, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	if requestor == nil || requestor.Hostname == "" {
+		return nil, errors.New("Subscriptions require a requestor with a hostname")
+	}
+	if len(attributes) == 0 {
+		return nil, errors.New("Subscription contains no attributes")
+	}
+	seen := map[irma.AttributeTypeIdentifier]struct{}{}
+	for _, attr := range attributes {
+		if _, ok := seen[attr]; ok {
+			return nil, errors.Errorf("Subscription contains attribute %s more than once", attr)
+		}
+		seen[attr] = struct{}{}
+		if client.Configuration.AttributeTypes[attr] == nil &&
+			!(attr.IsCredential() && client.Configuration.Contains(attr.CredentialTypeIdentifier())) {
+			return nil, errors.Errorf("Subscription contains unknown attribute %s", attr)
+		}
+	}
+	if maxUses < 0 || (maxUses == 0 && until == nil) {
+		return nil, errors.New("Subscription must be limited in uses or time")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	sub := &Subscription{
+		ID:         hex.EncodeToString(id),
+		Hostname:   strings.ToLower(requestor.Hostname),
+		Requestor:  requestorID(requestor),
+		Name:       requestor.Name,
+		Attributes: attributes,
+		MaxUses:    maxUses,
+		Until:      until,
+		Created:    irma.Timestamp(time.Now()),
+	}
+
+	client.subscriptionsLock.Lock()
+	defer client.subscriptionsLock.Unlock()
+	client.subscriptions = append(client.activeSubscriptions(), sub)
+	copied := *sub
+	return &copied, client.storage.StoreSubscriptions(client.subscriptions)
+}
+
+// RevokeSubscription removes the specified subscription.
+func (client *Client) RevokeSubscription(id string) error {
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
+	client.subscriptionsLock.Lock()
+	defer client.subscriptionsLock.Unlock()
+	for i, sub := range client.subscriptions {
+		if sub.ID == id {
+			client.subscriptions = append(client.subscriptions[:i], client.subscriptions[i+1:]...)
+			return client.storage.StoreSubscriptions(client.subscriptions)
+		}
+	}
+	return errors.Errorf("Unknown subscription %s", id)
+}
+
+// useSubscription returns the attributes to disclose if a subscription of the requestor covers the
+// candidates exactly, registering the use of the subscription; otherwise it returns nil.
+func (client *Client) useSubscription(requestor *SessionRequestor, candidates [][]*irma.AttributeIdentifier) *irma.DisclosureChoice {
+	if requestor == nil || requestor.Hostname == "" {
+		return nil
+	}
+	hostname, id := strings.ToLower(requestor.Hostname), requestorID(requestor)
+	client.subscriptionsLock.Lock()
+	defer client.subscriptionsLock.Unlock()
+	for _, sub := range client.subscriptions {
+		if sub.Hostname != hostname || sub.Requestor != id || !sub.Active() {
+			continue
+		}
+		choice := sub.choice(candidates)
+		if choice == nil {
+			continue
+		}
+		now := irma.Timestamp(time.Now())
+		sub.Uses++
+		sub.LastUsed = &now
+		client.subscriptions = client.activeSubscriptions()
+		if err := client.storage.StoreSubscriptions(client.subscriptions); err != nil {
+			// Don't allow more uses than stored
+			irma.Logger.Warnf("Failed to store subscriptions: %s", err.Error())
+			return nil
+		}
+		return choice
+	}
+	return nil
+}
+
+// activeSubscriptions returns the subscriptions that still allow disclosures.
+func (client *Client) activeSubscriptions() []*Subscription {
+	subs := []*Subscription{}
+	for _, sub := range client.subscriptions {
+		if sub.Active() {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
@@ -0,0 +1,389 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+	"golang.org/x/crypto/hkdf"
+)
+
+// This file contains the synchronization of two clients holding the same secret key, e.g. on the
+// phone and the tablet of a user (after restoring a backup of the one on the other, see backup.go).
+// Sync() sends the sync state of the client, consisting of its credentials (without the secret key,
+// as in export.go), the hashes of the credentials it removed, and its logs, to the other device over
+// a SyncChannel implemented by the app, and merges the sync state of the other device that it
+// receives in return. As both devices merge the same two states in the same way, they end up with
+// the same credentials and logs:
+//  - credentials removed on either device are removed on both;
+//  - other credentials present on either device are present on both, except that
+//  - if the devices hold different instances of a singleton credential type, the one with the latest
+//    signing date (or, if equal, the highest hash) is kept on both.
+// Archived credentials are not synchronized. A removed credential stays removed, also if an identical
+// credential is issued again later, until its removal is forgotten after syncRemovalLifetime; a device
+// that has not been synchronized for that long may then bring the credential back.
+//
+// As the SyncChannel may not be trusted, the sync state is encrypted using AES-GCM with a key derived
+// using HKDF from the secret key and a random salt. The sync state starts with the unencrypted
+// syncMagic, the version of its format and the salt, which are authenticated along with the encrypted
+// contents. Sync states that are not authenticated by a device holding the same secret key are
+// rejected with ErrSyncStateUnauthenticated.
+
+// ErrSyncStateUnauthenticated is returned by Sync() if the sync state received from the other device
+// was not created by a device holding the same secret key, or has been tampered with.
+var ErrSyncStateUnauthenticated = errors.New("Sync state is not authenticated by a device holding the same secret key")
+
+const (
+	syncMagic    = "IRMASYNC"
+	syncVersion  = 2
+	syncSaltSize = 32
+	syncKeyInfo  = "irmaclient sync"
+
+	syncRemovalLifetime = 365 * 24 * time.Hour
+)
+
+// SyncChannel connects the client to another device holding the same secret key; it is implemented
+// by the app (e.g. using a QR code and a local network connection between the devices).
+type SyncChannel interface {
+	// Exchange sends the sync state of this client to the other device, which should call Sync()
+	// as well, and returns the sync state of the other device.
+	Exchange(state []byte) ([]byte, error)
+}
+
+// SyncReport describes the changes made by Sync().
+type SyncReport struct {
+	// Credentials received from the other device
+	Credentials []*ImportedCredential `json:"credentials"`
+	// Hashes of the credentials removed because they were removed on the other device,
+	// or because they conflict with a newer singleton credential of the other device
+	Removed []string `json:"removed"`
+	// Amount of log entries received from the other device
+	Logs int `json:"logs"`
+}
+
+// syncState is the sync state that a client sends to the other device.
+type syncState struct {
+	Version     int                        `json:"version"`
+	Credentials []*exportedCredential      `json:"credentials"`
+	Removals    map[string]*irma.Timestamp `json:"removals"`
+	Logs        []*LogEntry                `json:"logs"`
+}
+
+// Sync synchronizes the credentials and logs of the client with those of the other device
+// connected through the specified channel.
+func (client *Client) Sync(channel SyncChannel) (*SyncReport, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	state, err := client.syncState()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := channel.Exchange(state)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to exchange sync state", 0)
+	}
+	return client.mergeSyncState(remote)
+}
+
+// syncState returns the sync state of the client.
+func (client *Client) syncState() ([]byte, error) {
+	state := &syncState{
+		Version:     syncVersion,
+		Credentials: []*exportedCredential{},
+		Removals:    map[string]*irma.Timestamp{},
+	}
+	for hash, timestamp := range client.removals {
+		if !client.removalExpired(timestamp) {
+			state.Removals[hash] = timestamp
+		}
+	}
+	for _, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			sig, err := client.storage.LoadSignature(attrs)
+			if err != nil {
+				return nil, err
+			}
+			state.Credentials = append(state.Credentials, &exportedCredential{Signature: sig, Attributes: attrs.Ints})
+		}
+	}
+	var err error
+	if state.Logs, err = client.loadLogs(); err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, syncSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := client.syncCipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(syncMagic), syncVersion), salt...)
+	sealed := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(sealed, nonce, plaintext, header), nil
+}
+
+// openSyncState authenticates and decrypts the sync state of the other device.
+func (client *Client) openSyncState(bts []byte) ([]byte, error) {
+	headerSize := len(syncMagic) + 1 + syncSaltSize
+	if len(bts) < headerSize || !bytes.HasPrefix(bts, []byte(syncMagic)) {
+		return nil, ErrSyncStateUnauthenticated
+	}
+	if version := bts[len(syncMagic)]; version != syncVersion {
+		return nil, errors.Errorf("Unsupported sync state version %d", version)
+	}
+	header, ciphertext := bts[:headerSize], bts[headerSize:]
+	aead, err := client.syncCipher(header[len(syncMagic)+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrSyncStateUnauthenticated
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrSyncStateUnauthenticated
+	}
+	return plaintext, nil
+}
+
+// syncCipher returns the cipher of sync states having the specified salt, of which the key is
+// derived from the secret key.
+func (client *Client) syncCipher(salt []byte) (cipher.AEAD, error) {
+	sk, err := client.unwrappedSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	skBytes := secret(sk.Bytes())
+	defer skBytes.wipe()
+	key := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, skBytes, salt, []byte(syncKeyInfo)), key); err != nil {
+		return nil, err
+	}
+	defer secret(key).wipe()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// mergeSyncState merges the sync state of the other device into the client.
+func (client *Client) mergeSyncState(bts []byte) (*SyncReport, error) {
+	bts, err := client.openSyncState(bts)
+	if err != nil {
+		return nil, err
+	}
+	remote := &syncState{}
+	if err := json.Unmarshal(bts, remote); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse sync state", 0)
+	}
+	if remote.Version != syncVersion {
+		return nil, errors.Errorf("Unsupported sync state version %d", remote.Version)
+	}
+	report := &SyncReport{Credentials: []*ImportedCredential{}, Removed: []string{}}
+
+	// Remove the credentials that were removed on the other device
+	removed := client.pruneRemovals()
+	for hash, timestamp := range remote.Removals {
+		if timestamp == nil || client.removalExpired(timestamp) {
+			continue
+		}
+		if _, ok := client.removals[hash]; !ok {
+			client.removals[hash] = timestamp
+			removed = true
+		}
+		if id, index, found := findAttributeList(client.attributes, hash); found {
+			if err := client.remove(id, index, false); err != nil {
+				return report, err
+			}
+			delete(client.credentialsCache, id)
+			report.Removed = append(report.Removed, hash)
+		}
+	}
+
+	// Resolve conflicts between instances of singleton credential types
+	var received []*exportedCredential
+	for _, exported := range remote.Credentials {
+		if exported == nil || len(exported.Attributes) == 0 {
+			continue
+		}
+		attrs := irma.NewAttributeListFromInts(exported.Attributes, client.Configuration)
+		hash := attrs.Hash()
+		if _, ok := client.removals[hash]; ok {
+			continue
+		}
+		credtype := attrs.CredentialType()
+		if credtype == nil || !credtype.IsSingleton {
+			received = append(received, exported)
+			continue
+		}
+		id := credtype.Identifier()
+		if client.hasCredential(hash) {
+			continue
+		}
+		winner := attrs
+		for _, local := range client.attrs(id) {
+			if syncPrecedes(local, winner) {
+				winner = local
+			}
+		}
+		for index := len(client.attrs(id)) - 1; index >= 0; index-- {
+			if local := client.attrs(id)[index]; local != winner {
+				if err := client.remove(id, index, false); err != nil {
+					return report, err
+				}
+				delete(client.credentialsCache, id)
+				report.Removed = append(report.Removed, local.Hash())
+			}
+		}
+		if winner == attrs {
+			received = append(received, exported)
+		} else if winner.Hash() != hash {
+			// The other device makes the same decision, removing its instance
+			now := irma.Timestamp(client.now())
+			client.removals[hash] = &now
+			removed = true
+		}
+	}
+
+	// Import the remaining credentials of the other device
+	key, err := client.unwrappedSecretKey()
+	if err != nil {
+		return report, err
+	}
+	for _, exported := range received {
+		attributes := append([]*big.Int{key}, exported.Attributes...)
+		result := client.importCredential(key, exported.Signature, attributes)
+		if result.Status != ImportStatusPresent {
+			report.Credentials = append(report.Credentials, result)
+		}
+	}
+
+	if len(report.Removed) > 0 || len(report.Credentials) > 0 {
+		if err := client.storage.StoreAttributes(client.attributes); err != nil {
+			return report, err
+		}
+	}
+	if removed {
+		if err := client.storage.StoreRemovals(client.removals); err != nil {
+			return report, err
+		}
+	}
+	if err := client.mergeLogs(remote.Logs, report); err != nil {
+		return report, err
+	}
+	if len(report.Removed) > 0 || len(report.Credentials) > 0 {
+		client.handler.UpdateAttributes()
+	}
+	return report, nil
+}
+
+// mergeLogs adds the log entries of the other device that the client does not have yet.
+func (client *Client) mergeLogs(entries []*LogEntry, report *SyncReport) error {
+	logs, err := client.loadLogs()
+	if err != nil {
+		return err
+	}
+	present := map[[sha256.Size]byte]bool{}
+	for _, entry := range logs {
+		key, err := syncLogKey(entry)
+		if err != nil {
+			return err
+		}
+		present[key] = true
+	}
+	merged := append([]*LogEntry{}, logs...)
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		key, err := syncLogKey(entry)
+		if err != nil {
+			return err
+		}
+		if present[key] {
+			continue
+		}
+		present[key] = true
+		merged = append(merged, entry)
+		report.Logs++
+	}
+	if report.Logs == 0 {
+		return nil
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Time.Before(merged[j].Time)
+	})
+	if err = client.storage.StoreLogs(merged); err != nil {
+		return err
+	}
+	client.logs = merged
+	return nil
+}
+
+// syncLogKey identifies a log entry across devices.
+func syncLogKey(entry *LogEntry) ([sha256.Size]byte, error) {
+	bts, err := irma.CanonicalJSON(entry)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(bts), nil
+}
+
+// syncPrecedes returns whether the first of two instances of a singleton credential type is kept
+// over the second when synchronizing.
+func syncPrecedes(a, b *irma.AttributeList) bool {
+	if !a.SigningDate().Equal(b.SigningDate()) {
+		return a.SigningDate().After(b.SigningDate())
+	}
+	return a.Hash() > b.Hash()
+}
+
+// recordRemoval records the removal of the specified credential, so that it is also removed
+// from other devices by Sync().
+func (client *Client) recordRemoval(hash string) error {
+	if client.removals == nil {
+		client.removals = map[string]*irma.Timestamp{}
+	}
+	now := irma.Timestamp(client.now())
+	client.removals[hash] = &now
+	client.pruneRemovals()
+	return client.storage.StoreRemovals(client.removals)
+}
+
+// removalExpired returns whether a removal at the specified time is to be forgotten.
+func (client *Client) removalExpired(timestamp *irma.Timestamp) bool {
+	return client.now().Sub(time.Time(*timestamp)) > syncRemovalLifetime
+}
+
+// pruneRemovals forgets the expired removals, returning whether there were any.
+func (client *Client) pruneRemovals() bool {
+	pruned := false
+	for hash, timestamp := range client.removals {
+		if timestamp == nil || client.removalExpired(timestamp) {
+			delete(client.removals, hash)
+			pruned = true
+		}
+	}
+	return pruned
+}
@@ -0,0 +1,166 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the recording of session transcripts: sanitized records of IRMA sessions
+// meant to be attached to bug reports. A transcript contains the HTTP requests made during the
+// session (endpoints, message types, sizes, timings, and error messages returned by servers)
+// and the outcome of the session, but never attribute values, keys, or other message contents.
+// Transcripts are recorded only if enabled using SetSessionTranscriptsPreference(), and are
+// kept only in memory.
+
+// maxSessionTranscripts is the amount of transcripts of the most recent sessions that are kept.
+const maxSessionTranscripts = 20
+
+// SessionTranscript is a sanitized record of an IRMA session.
+type SessionTranscript struct {
+	Action   irma.Action            `json:"action"`
+	Hostname string                 `json:"hostname,omitempty"`
+	Started  time.Time              `json:"started"`
+	Finished *time.Time             `json:"finished,omitempty"`
+	Statuses []*TranscriptStatus    `json:"statuses"`
+	Requests []*irma.TransportEvent `json:"requests"`
+	// Outcome of the session: "success", "cancelled", "unsatisfiable" or "failure"
+	Result string           `json:"result,omitempty"`
+	Error  *TranscriptError `json:"error,omitempty"`
+
+	lock sync.Mutex
+}
+
+// TranscriptStatus is a status update that occurred during a session.
+type TranscriptStatus struct {
+	Time   time.Time   `json:"time"`
+	Status irma.Status `json:"status"`
+}
+
+// TranscriptError is the sanitized version of the error with which a session failed.
+type TranscriptError struct {
+	Type         irma.ErrorType    `json:"type"`
+	RemoteStatus int               `json:"remoteStatus,omitempty"`
+	RemoteError  *irma.RemoteError `json:"remoteError,omitempty"`
+}
+
+// SessionTranscripts returns the transcripts of the most recent sessions, most recent first.
+func (client *Client) SessionTranscripts() []*SessionTranscript {
+	client.transcriptsLock.Lock()
+	defer client.transcriptsLock.Unlock()
+	transcripts := make([]*SessionTranscript, len(client.transcripts))
+	for i, transcript := range client.transcripts {
+		transcripts[len(transcripts)-1-i] = transcript
+	}
+	return transcripts
+}
+
+// ExportSessionTranscripts returns the transcripts of the most recent sessions as JSON.
+func (client *Client) ExportSessionTranscripts() ([]byte, error) {
+	transcripts := client.SessionTranscripts()
+	for _, transcript := range transcripts {
+		transcript.lock.Lock()
+		defer transcript.lock.Unlock()
+	}
+	return json.MarshalIndent(transcripts, "", "  ")
+}
+
+// newTranscript starts a new transcript if enabled, returning nil otherwise.
+func (client *Client) newTranscript(action irma.Action, hostname string) *SessionTranscript {
+	if !client.Preferences.EnableSessionTranscripts {
+		return nil
+	}
+	transcript := &SessionTranscript{
+		Action:   action,
+		Hostname: hostname,
+		Started:  time.Now(),
+		Statuses: []*TranscriptStatus{},
+		Requests: []*irma.TransportEvent{},
+	}
+	client.transcriptsLock.Lock()
+	defer client.transcriptsLock.Unlock()
+	client.transcripts = append(client.transcripts, transcript)
+	if len(client.transcripts) > maxSessionTranscripts {
+		client.transcripts = client.transcripts[len(client.transcripts)-maxSessionTranscripts:]
+	}
+	return transcript
+}
+
+func (transcript *SessionTranscript) record(event *irma.TransportEvent) {
+	transcript.lock.Lock()
+	defer transcript.lock.Unlock()
+	transcript.Requests = append(transcript.Requests, event)
+}
+
+func (transcript *SessionTranscript) finish(result string, err *irma.SessionError) {
+	transcript.lock.Lock()
+	defer transcript.lock.Unlock()
+	if transcript.Finished != nil {
+		return
+	}
+	now := time.Now()
+	transcript.Finished = &now
+	transcript.Result = result
+	if err != nil {
+		transcript.Error = &TranscriptError{
+			Type:         err.ErrorType,
+			RemoteStatus: err.RemoteStatus,
+			RemoteError:  err.RemoteError,
+		}
+	}
+}
+
+// transcriptHandler wraps the Handler of a session, recording status updates and the
+// outcome of the session into its transcript.
+type transcriptHandler struct {
+	Handler
+	transcript *SessionTranscript
+}
+
+func (h *transcriptHandler) StatusUpdate(action irma.Action, status irma.Status) {
+	h.transcript.lock.Lock()
+	h.transcript.Statuses = append(h.transcript.Statuses, &TranscriptStatus{Time: time.Now(), Status: status})
+	h.transcript.lock.Unlock()
+	h.Handler.StatusUpdate(action, status)
+}
+
+func (h *transcriptHandler) Success(result string) {
+	h.transcript.finish("success", nil)
+	h.Handler.Success(result)
+}
+
+func (h *transcriptHandler) Cancelled() {
+	h.transcript.finish("cancelled", nil)
+	h.Handler.Cancelled()
+}
+
+func (h *transcriptHandler) Failure(err *irma.SessionError) {
+	h.transcript.finish("failure", err)
+	h.Handler.Failure(err)
+}
+
+func (h *transcriptHandler) UnsatisfiableRequest(ServerName irma.TranslatedString, missing irma.AttributeDisjunctionList) {
+	h.transcript.finish("unsatisfiable", nil)
+	h.Handler.UnsatisfiableRequest(ServerName, missing)
+}
+
+// startTranscript starts recording a transcript of the session, if enabled.
+func (session *session) startTranscript() {
+	session.transcript = session.client.newTranscript(session.Action, session.Hostname)
+	if session.transcript == nil {
+		return
+	}
+	session.Handler = &transcriptHandler{Handler: session.Handler, transcript: session.transcript}
+	if session.transport != nil {
+		session.observeTransport(session.transport)
+	}
+}
+
+// observeTransport records the requests made by the transport into the transcript of the session, if any.
+func (session *session) observeTransport(transport *irma.HTTPTransport) {
+	if session.transcript != nil {
+		transport.SetObserver(session.transcript.record)
+	}
+}
@@ -0,0 +1,73 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the isolation of the connections to requestors. If requests of different
+// sessions were made over the same connection, or over connections resuming the same TLS session,
+// requestors (or whoever terminates TLS for them) could link the sessions to each other at the
+// network layer, regardless of which attributes were disclosed. Therefore, by default each session
+// makes its requests over fresh connections of its own, which are closed when the session is done.
+// Alternatively, each requestor can be given a connection pool of its own, which is reused across
+// sessions with that requestor but never shared with other requestors; this saves setting up
+// connections for sessions with the same requestor, which that requestor could link anyway.
+// Requests to requestors carry no headers or cookies that identify the client across sessions.
+// Connections to keyshare servers and scheme servers are not affected by this.
+
+// TransportIsolation specifies how the connections to requestors are isolated from each other.
+type TransportIsolation string
+
+const (
+	// TransportIsolationSession uses fresh connections for each session (default)
+	TransportIsolationSession = TransportIsolation("session")
+	// TransportIsolationRequestor uses a separate connection pool for each requestor
+	TransportIsolationRequestor = TransportIsolation("requestor")
+)
+
+// SetTransportIsolationPreference sets how the connections to requestors are isolated.
+func (client *Client) SetTransportIsolationPreference(isolation TransportIsolation) error {
+	switch isolation {
+	case "", TransportIsolationSession, TransportIsolationRequestor:
+	default:
+		return errors.Errorf("Unknown transport isolation %s", isolation)
+	}
+	client.Preferences.TransportIsolation = isolation
+	client.closeRequestorPools()
+	return client.storage.StorePreferences(client.Preferences)
+}
+
+// sessionTransport returns a transport to the requestor at the specified URL, and the connection
+// pool that must be closed once the session is done, if any.
+func (client *Client) sessionTransport(url, hostname string) (*irma.HTTPTransport, *irma.ConnectionPool) {
+	transport := irma.NewHTTPTransport(url)
+	if client.Preferences.TransportIsolation != TransportIsolationRequestor {
+		pool := irma.NewConnectionPool()
+		transport.SetConnectionPool(pool)
+		return transport, pool
+	}
+
+	client.requestorPoolsLock.Lock()
+	defer client.requestorPoolsLock.Unlock()
+	if client.requestorPools == nil {
+		client.requestorPools = map[string]*irma.ConnectionPool{}
+	}
+	pool := client.requestorPools[hostname]
+	if pool == nil {
+		pool = irma.NewConnectionPool()
+		client.requestorPools[hostname] = pool
+	}
+	transport.SetConnectionPool(pool)
+	return transport, nil
+}
+
+// closeRequestorPools closes and forgets the connection pools of the requestors.
+func (client *Client) closeRequestorPools() {
+	client.requestorPoolsLock.Lock()
+	defer client.requestorPoolsLock.Unlock()
+	for _, pool := range client.requestorPools {
+		pool.Close()
+	}
+	client.requestorPools = nil
+}
@@ -0,0 +1,111 @@
+package irmaclient
+
+import (
+	"sort"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the tracking of how often each credential type is disclosed. The usage is
+// only stored locally, and is shown in the Usage field of the credentials in CredentialInfoList(),
+// so that the app can suggest removing credentials that are never used (see UnusedCredentials()).
+// If the user opts in (see SetUsageExportPreference()), the app may export the aggregate usage
+// using ExportUsage(), e.g. to inform scheme maintainers which credential types matter. This export
+// contains only the amount of disclosures per credential type, and no dates or attribute values.
+
+// ErrUsageExportDisabled is returned by ExportUsage() if the user did not opt in to exporting usage.
+var ErrUsageExportDisabled = errors.New("Exporting usage is disabled")
+
+// UsageReport is the aggregate usage of credential types exported by ExportUsage().
+type UsageReport struct {
+	// Amount of disclosures per credential type
+	Disclosures map[irma.CredentialTypeIdentifier]int `json:"disclosures"`
+	// Credential types of which the client has credentials that have never been disclosed
+	Unused []irma.CredentialTypeIdentifier `json:"unused"`
+}
+
+// recordUsage registers that the credentials in the choice have been disclosed, counting
+// each credential type once.
+func (client *Client) recordUsage(choice *irma.DisclosureChoice) error {
+	client.usageLock.Lock()
+	defer client.usageLock.Unlock()
+	if client.usage == nil {
+		client.usage = map[irma.CredentialTypeIdentifier]*irma.CredentialUsage{}
+	}
+	now := irma.Timestamp(time.Now())
+	seen := map[irma.CredentialTypeIdentifier]bool{}
+	for _, attr := range choice.Attributes {
+		id := attr.Type.CredentialTypeIdentifier()
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if client.usage[id] == nil {
+			client.usage[id] = &irma.CredentialUsage{}
+		}
+		client.usage[id].Disclosures++
+		client.usage[id].LastDisclosed = now
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+	return client.storage.StoreUsage(client.usage)
+}
+
+// credentialUsage returns (a copy of) the usage of the credential type.
+func (client *Client) credentialUsage(id irma.CredentialTypeIdentifier) *irma.CredentialUsage {
+	client.usageLock.Lock()
+	defer client.usageLock.Unlock()
+	usage := &irma.CredentialUsage{}
+	if u := client.usage[id]; u != nil {
+		*usage = *u
+	}
+	return usage
+}
+
+// UnusedCredentials returns the credentials of which the credential type has never been disclosed.
+func (client *Client) UnusedCredentials() irma.CredentialInfoList {
+	list := irma.CredentialInfoList{}
+	for _, info := range client.CredentialInfoList() {
+		if info.Usage.Disclosures == 0 {
+			list = append(list, info)
+		}
+	}
+	return list
+}
+
+// SetUsageExportPreference enables or disables exporting the aggregate usage of credential types.
+func (client *Client) SetUsageExportPreference(enable bool) {
+	client.Preferences.EnableUsageExport = enable
+	_ = client.storage.StorePreferences(client.Preferences)
+}
+
+// ExportUsage returns the aggregate usage of credential types, if the user opted in to this.
+func (client *Client) ExportUsage() (*UsageReport, error) {
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	if !client.Preferences.EnableUsageExport {
+		return nil, ErrUsageExportDisabled
+	}
+	report := &UsageReport{Disclosures: map[irma.CredentialTypeIdentifier]int{}}
+	client.usageLock.Lock()
+	for id, usage := range client.usage {
+		report.Disclosures[id] = usage.Disclosures
+	}
+	client.usageLock.Unlock()
+
+	unused := map[irma.CredentialTypeIdentifier]bool{}
+	for _, info := range client.UnusedCredentials() {
+		unused[info.Identifier()] = true
+	}
+	for id := range unused {
+		report.Unused = append(report.Unused, id)
+	}
+	sort.Slice(report.Unused, func(i, j int) bool {
+		return report.Unused[i].String() < report.Unused[j].String()
+	})
+	return report, nil
+}
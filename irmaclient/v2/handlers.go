@@ -0,0 +1,30 @@
+package irmaclient
+
+import (
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// This file contains the adapters of the handlers of this API to those of the irmaclient package,
+// so that the handlers of this API do not change along with those of the irmaclient package.
+
+// sessionHandler adapts a Handler to an irmaclient.Handler.
+type sessionHandler struct {
+	Handler
+}
+
+func (h sessionHandler) RequestIssuancePermission(request irma.IssuanceRequest, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.Handler.RequestIssuancePermission(request, serverName, PermissionHandler(callback))
+}
+
+func (h sessionHandler) RequestVerificationPermission(request irma.DisclosureRequest, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.Handler.RequestVerificationPermission(request, serverName, PermissionHandler(callback))
+}
+
+func (h sessionHandler) RequestSignaturePermission(request irma.SignatureRequest, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.Handler.RequestSignaturePermission(request, serverName, PermissionHandler(callback))
+}
+
+func (h sessionHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	h.Handler.RequestPin(remainingAttempts, PinHandler(callback))
+}
@@ -0,0 +1,51 @@
+package irmaclient
+
+import (
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+func newLogEntries(entries []*irmaclient.LogEntry) []*LogEntry {
+	logs := make([]*LogEntry, 0, len(entries))
+	for _, entry := range entries {
+		logs = append(logs, &LogEntry{
+			Index:      entry.Index,
+			Type:       entry.Type,
+			Time:       entry.Time,
+			Hostname:   entry.Hostname,
+			ServerName: entry.ServerName,
+			Removed:    entry.Removed,
+			Issued:     entry.Issued,
+			Provenance: entry.Provenance,
+			entry:      entry,
+		})
+	}
+	return logs
+}
+
+// SessionRequest returns the request of the session of the entry, or nil for removals.
+func (entry *LogEntry) SessionRequest() (irma.SessionRequest, error) {
+	return entry.entry.SessionRequest()
+}
+
+// DisclosedAttributes returns the attributes disclosed in the session of the entry.
+func (entry *LogEntry) DisclosedAttributes(conf *irma.Configuration) ([]*irma.DisclosedAttribute, error) {
+	return entry.entry.GetDisclosedCredentials(conf)
+}
+
+// IssuedCredentials returns the credentials issued in the session of the entry.
+func (entry *LogEntry) IssuedCredentials(conf *irma.Configuration) (irma.CredentialInfoList, error) {
+	return entry.entry.GetIssuedCredentials(conf)
+}
+
+// SignedMessage returns the attribute-based signature created in the session of the entry, or nil
+// if it was not a signature session.
+func (entry *LogEntry) SignedMessage() (*irma.SignedMessage, error) {
+	return entry.entry.GetSignedMessage()
+}
+
+// Entry returns the underlying log entry of the irmaclient package, for details that are not part
+// of this API.
+func (entry *LogEntry) Entry() *irmaclient.LogEntry {
+	return entry.entry
+}
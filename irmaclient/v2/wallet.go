@@ -0,0 +1,264 @@
+// Package irmaclient is version 2 of the API of the IRMA client for apps, imported as
+// "github.com/privacybydesign/irmago/irmaclient/v2". Unlike the API of the irmaclient package itself,
+// which exposes the client as its internals evolve, this API is versioned semantically (see
+// APIVersion): within a major version its interfaces only change in backwards compatible ways, and
+// anything that is to be removed is first deprecated.
+//
+// The Wallet interface is implemented on top of the current client, so that apps can migrate to it
+// gradually: the underlying client remains available through Wallet.Client() for functionality
+// that is not (yet) part of this API, and apps that create the client themselves can use Wrap().
+// Functions of the irmaclient package that are superseded by this API log a warning when called.
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// APIVersion is the semantic version of this API.
+const APIVersion = "2.1.0"
+
+// ClientHandler is informed of events of the wallet that are not part of a session.
+type ClientHandler interface {
+	EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error)
+	EnrollmentSuccess(manager irma.SchemeManagerIdentifier)
+
+	ChangePinFailure(manager irma.SchemeManagerIdentifier, err error)
+	ChangePinSuccess(manager irma.SchemeManagerIdentifier)
+	ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int)
+	ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int)
+
+	UpdateConfiguration(new *irma.IrmaIdentifierSet)
+	UpdateAttributes()
+}
+
+// SchemeFreshnessHandler may optionally be implemented by a ClientHandler to be warned of schemes
+// that have not been refreshed for longer than the scheme freshness policy allows.
+type SchemeFreshnessHandler interface {
+	SchemeStale(scheme irma.SchemeManagerIdentifier, refreshed time.Time)
+}
+
+// PermissionHandler is called with the choice of the user whether to proceed with a session,
+// and if so, which attributes to disclose.
+type PermissionHandler func(proceed bool, choice *irma.DisclosureChoice)
+
+// PinHandler is called with the PIN entered by the user, or with false if the user cancelled.
+type PinHandler func(proceed bool, pin string)
+
+// Handler is informed of the progress of a session, and asks the user for permission and their PIN.
+type Handler interface {
+	StatusUpdate(action irma.Action, status irma.Status)
+	Success(result string)
+	Cancelled()
+	Failure(err *irma.SessionError)
+	UnsatisfiableRequest(serverName irma.TranslatedString, missing irma.AttributeDisjunctionList)
+
+	KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int)
+	KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier)
+	KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier)
+	KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier)
+
+	RequestIssuancePermission(request irma.IssuanceRequest, serverName irma.TranslatedString, callback PermissionHandler)
+	RequestVerificationPermission(request irma.DisclosureRequest, serverName irma.TranslatedString, callback PermissionHandler)
+	RequestSignaturePermission(request irma.SignatureRequest, serverName irma.TranslatedString, callback PermissionHandler)
+	RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool))
+
+	RequestPin(remainingAttempts int, callback PinHandler)
+}
+
+// SessionDismisser can dismiss a session started by Wallet.NewSession().
+type SessionDismisser interface {
+	Dismiss()
+}
+
+// Unwrapper wraps the secret key of the wallet using a keystore of the platform, see WithKeystore().
+type Unwrapper interface {
+	// Wrap encrypts the secret key using the keystore key.
+	Wrap(secret []byte) ([]byte, error)
+	// Unwrap decrypts the secret key wrapped by Wrap().
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// Option configures optional behaviour of a Wallet opened by Open().
+type Option func(*options)
+
+type options struct {
+	client []irmaclient.Option
+}
+
+// LogEntry is an entry in the logs of the wallet: a past session, or a removal of credentials.
+type LogEntry struct {
+	// Position of the entry in the logs, oldest first, see Wallet.LoadLogsBefore()
+	Index int
+	Type  irma.Action
+	Time  irma.Timestamp
+	// Requestor of the session; empty for removals and in entries of old sessions
+	Hostname   string
+	ServerName irma.TranslatedString
+	// In case of removals: the names of the attributes of the removed credentials, by credential type
+	Removed map[irma.CredentialTypeIdentifier][]irma.TranslatedString
+	// In case of issuance sessions in which attributes were disclosed: the issued credentials by their
+	// hash, and the credentials from which attributes were disclosed
+	Issued     []string
+	Provenance *irma.CredentialProvenance
+
+	entry *irmaclient.LogEntry
+}
+
+// Wallet is an IRMA client holding the credentials of a user.
+type Wallet interface {
+	// Credentials returns the credentials in the wallet, excluding archived ones. Credentials are
+	// identified in this API by their Hash.
+	Credentials() irma.CredentialInfoList
+	// ArchivedCredentials returns the archived credentials, which are not used in sessions.
+	ArchivedCredentials() irma.CredentialInfoList
+	// RemoveCredential removes the specified credential.
+	RemoveCredential(hash string) error
+	// ArchiveCredential archives the specified credential.
+	ArchiveCredential(hash string) error
+	// RestoreCredential moves the specified credential out of the archive.
+	RestoreCredential(hash string) error
+
+	// NewSession starts the session specified by the session request or session pointer
+	// (e.g. scanned from a QR), informing the handler of its progress.
+	NewSession(request string, handler Handler) SessionDismisser
+	// Logs returns the log entries of past sessions and removals, oldest first.
+	//
+	// Deprecated: this loads all log entries in memory; use LoadNewestLogs() and LoadLogsBefore() instead.
+	Logs() ([]*LogEntry, error)
+	// LoadNewestLogs returns at most max of the newest log entries, newest first.
+	LoadNewestLogs(max int) ([]*LogEntry, error)
+	// LoadLogsBefore returns at most max of the log entries preceding the one with the specified
+	// Index, newest first.
+	LoadLogsBefore(index, max int) ([]*LogEntry, error)
+
+	// SetLanguage sets the language of the user (e.g. "nl"), by which credentials are sorted.
+	SetLanguage(lang string)
+	// Close closes the wallet, after which it can no longer be used.
+	Close() error
+
+	// Client returns the underlying client, for functionality that is not part of this API; its
+	// API is not covered by the stability guarantees of this package.
+	Client() *irmaclient.Client
+}
+
+// Open opens the wallet in the specified storage, creating it if the storage is empty, using the
+// IRMA schemes in the specified folder; see irmaclient.New().
+func Open(storagePath, schemesPath string, handler ClientHandler, opts ...Option) (Wallet, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	client, err := irmaclient.New(storagePath, schemesPath, handler, o.client...)
+	if client == nil {
+		return nil, err
+	}
+	// As in irmaclient.New(), the client is returned along with scheme errors, as it is usable without the scheme
+	return Wrap(client), err
+}
+
+// Wrap returns the Wallet of an existing client.
+func Wrap(client *irmaclient.Client) Wallet {
+	return &wallet{client: client}
+}
+
+// WithStoragePassphrase encrypts the storage with the specified passphrase.
+func WithStoragePassphrase(passphrase string) Option {
+	return withClientOption(irmaclient.WithStoragePassphrase(passphrase))
+}
+
+// WithStorageKey encrypts the storage with the specified key.
+func WithStorageKey(key []byte) Option {
+	return withClientOption(irmaclient.WithStorageKey(key))
+}
+
+// WithInMemoryStorage keeps the storage in memory instead of in the storage path.
+func WithInMemoryStorage() Option {
+	return withClientOption(irmaclient.WithInMemoryStorage())
+}
+
+// WithSQLiteStorage keeps the storage in a SQLite database, using the specified database/sql driver.
+func WithSQLiteStorage(driverName string) Option {
+	return withClientOption(irmaclient.WithSQLiteStorage(driverName))
+}
+
+// WithKeystore wraps the secret key of the wallet using the specified platform keystore.
+func WithKeystore(keystore Unwrapper) Option {
+	return withClientOption(irmaclient.WithKeystore(keystore))
+}
+
+func withClientOption(option irmaclient.Option) Option {
+	return func(opts *options) {
+		opts.client = append(opts.client, option)
+	}
+}
+
+type wallet struct {
+	client *irmaclient.Client
+}
+
+func (w *wallet) Credentials() irma.CredentialInfoList {
+	return w.client.CredentialInfoList()
+}
+
+func (w *wallet) ArchivedCredentials() irma.CredentialInfoList {
+	return w.client.ArchivedCredentialInfoList()
+}
+
+func (w *wallet) RemoveCredential(hash string) error {
+	return w.client.RemoveCredentialByHash(hash)
+}
+
+func (w *wallet) ArchiveCredential(hash string) error {
+	return w.client.ArchiveCredentialByHash(hash)
+}
+
+func (w *wallet) RestoreCredential(hash string) error {
+	return w.client.RestoreCredentialByHash(hash)
+}
+
+func (w *wallet) NewSession(request string, handler Handler) SessionDismisser {
+	return w.client.NewSession(request, sessionHandler{handler})
+}
+
+func (w *wallet) Logs() ([]*LogEntry, error) {
+	entries, err := w.client.QueryLogs(irmaclient.LogQuery{})
+	if err != nil {
+		return nil, err
+	}
+	// QueryLogs() returns the newest entry first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return newLogEntries(entries), nil
+}
+
+func (w *wallet) LoadNewestLogs(max int) ([]*LogEntry, error) {
+	entries, err := w.client.LoadNewestLogs(max)
+	if err != nil {
+		return nil, err
+	}
+	return newLogEntries(entries), nil
+}
+
+func (w *wallet) LoadLogsBefore(index, max int) ([]*LogEntry, error) {
+	entries, err := w.client.LoadLogsBefore(index, max)
+	if err != nil {
+		return nil, err
+	}
+	return newLogEntries(entries), nil
+}
+
+func (w *wallet) SetLanguage(lang string) {
+	w.client.SetLanguagePreference(lang)
+}
+
+func (w *wallet) Close() error {
+	return w.client.Close()
+}
+
+func (w *wallet) Client() *irmaclient.Client {
+	return w.client
+}
@@ -0,0 +1,343 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"golang.org/x/crypto/scrypt"
+)
+
+// This file contains the wallet lock: an optional PIN or passphrase of the user that unlocks the
+// client as a whole, independent of the PINs of the keyshare servers of distributed schemes.
+// When the wallet lock is enabled, the client starts locked: the credentials, secret key, keyshare
+// server information and logs are not loaded from storage, and sessions and other operations on them
+// fail with ErrWalletLocked (in sessions, with an irma.ErrorWalletLocked error), until the wallet is
+// unlocked with UnlockWallet().
+//
+// The wallet PIN is stored as a salted scrypt hash. After walletPinAttempts incorrect attempts the
+// wallet is blocked for walletPinBlockDuration, which doubles each next time that the wallet is blocked.
+// The attempts and blocking are persisted, so that they survive restarting the app.
+//
+// That the wallet lock is enabled is also recorded in the storage schema and, if the storage is
+// encrypted, in the check value of the storage key (which cannot be changed without the key).
+// New() refuses to open storage in which the wallet lock is recorded as enabled while the walletlock
+// file is missing, so that the wallet lock cannot be bypassed by removing the file.
+//
+// For biometric unlocking, the app can obtain a random key using EnableBiometricUnlock(), which it
+// should store in the keystore of the platform (iOS Keychain or Android Keystore) protected by
+// biometric authentication. After successful biometric authentication the app retrieves the key from
+// the keystore and passes it to UnlockWalletBiometric().
+
+var (
+	// ErrWalletLocked is returned by operations requiring the wallet to be unlocked.
+	ErrWalletLocked = errors.New("Wallet is locked")
+	// ErrWalletLockMissing is returned by New() if the wallet lock is enabled but its file is missing.
+	ErrWalletLockMissing = errors.New("Wallet lock is enabled but missing from storage")
+)
+
+const (
+	walletPinAttempts         = 3
+	walletPinBlockDuration    = time.Minute
+	walletPinMaxBlockDuration = 24 * time.Hour
+
+	// scrypt parameters as recommended for interactive logins
+	walletPinScryptN = 32768
+	walletPinScryptR = 8
+	walletPinScryptP = 1
+	walletPinKeySize = 32
+)
+
+// walletLock is the stored state of the wallet lock.
+type walletLock struct {
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+	// SHA-256 hash of the key for biometric unlocking, if enabled
+	BiometricKeyHash []byte `json:"biometricKeyHash,omitempty"`
+
+	// Incorrect attempts since the last successful attempt or block
+	Attempts int `json:"attempts"`
+	// Amount of times the wallet was blocked since the last successful attempt
+	Blocks       int       `json:"blocks"`
+	BlockedUntil time.Time `json:"blockedUntil"`
+}
+
+func newWalletLock(pin string) (*walletLock, error) {
+	lock := &walletLock{Salt: make([]byte, walletPinKeySize)}
+	if _, err := rand.Read(lock.Salt); err != nil {
+		return nil, err
+	}
+	var err error
+	lock.Hash, err = lock.hash(pin)
+	return lock, err
+}
+
+func (lock *walletLock) hash(pin string) ([]byte, error) {
+	return scrypt.Key([]byte(pin), lock.Salt, walletPinScryptN, walletPinScryptR, walletPinScryptP, walletPinKeySize)
+}
+
+// blocked returns the amount of seconds that the wallet is still blocked, if any.
+func (lock *walletLock) blocked() int {
+	if remaining := time.Until(lock.BlockedUntil); remaining > 0 {
+		return int(remaining/time.Second) + 1
+	}
+	return 0
+}
+
+// attempt registers an attempt to unlock the wallet, returning how many tries are left and for
+// how long the wallet is blocked, if the attempt was not ok.
+func (lock *walletLock) attempt(ok bool) (int, int) {
+	if ok {
+		lock.Attempts, lock.Blocks, lock.BlockedUntil = 0, 0, time.Time{}
+		return 0, 0
+	}
+	lock.Attempts++
+	if lock.Attempts < walletPinAttempts {
+		return walletPinAttempts - lock.Attempts, 0
+	}
+	duration := walletPinMaxBlockDuration
+	if lock.Blocks < 16 && walletPinBlockDuration<<uint(lock.Blocks) < duration {
+		duration = walletPinBlockDuration << uint(lock.Blocks)
+	}
+	lock.Attempts = 0
+	lock.Blocks++
+	lock.BlockedUntil = time.Now().Add(duration)
+	return 0, lock.blocked()
+}
+
+// WalletPinEnabled returns whether or not the wallet lock is enabled.
+func (client *Client) WalletPinEnabled() bool {
+	return client.walletLock != nil
+}
+
+// WalletLocked returns whether or not the wallet is currently locked. While the wallet is locked
+// no credentials are available; e.g., CredentialInfoList() returns an empty list.
+func (client *Client) WalletLocked() bool {
+	client.walletLockedLock.RLock()
+	defer client.walletLockedLock.RUnlock()
+	return client.walletLocked
+}
+
+func (client *Client) setWalletLocked(locked bool) {
+	client.walletLockedLock.Lock()
+	defer client.walletLockedLock.Unlock()
+	client.walletLocked = locked
+}
+
+// checkUnlocked returns ErrWalletLocked if the wallet is locked.
+func (client *Client) checkUnlocked() error {
+	if client.WalletLocked() {
+		return ErrWalletLocked
+	}
+	return client.ensureAttributes()
+}
+
+// markWalletLock records in the storage whether or not the wallet lock is enabled.
+func (s *storage) markWalletLock(enabled bool) error {
+	schema, err := s.schema()
+	if err != nil {
+		return err
+	}
+	schema.WalletLock = enabled
+	if err = s.storeSchema(schema); err != nil {
+		return err
+	}
+	return s.markKeyInfo(enabled)
+}
+
+// walletLockRecorded returns whether or not the storage records that the wallet lock is enabled.
+func (s *storage) walletLockRecorded() (bool, error) {
+	if s.walletLockCheck {
+		return true, nil
+	}
+	schema, err := s.loadSchema()
+	if err != nil || schema == nil {
+		return false, err
+	}
+	return schema.WalletLock, nil
+}
+
+// loadWalletLock loads the wallet lock, if enabled, and checks it against what the storage records.
+func (client *Client) loadWalletLock() error {
+	lock, err := client.storage.LoadWalletLock()
+	if err != nil {
+		return err
+	}
+	recorded, err := client.storage.walletLockRecorded()
+	if err != nil {
+		return err
+	}
+	if lock == nil && recorded {
+		return ErrWalletLockMissing
+	}
+	if lock != nil && !recorded {
+		// Enabled before it was recorded in the storage
+		if err = client.storage.markWalletLock(true); err != nil {
+			return err
+		}
+	}
+	client.walletLock = lock
+	client.setWalletLocked(lock != nil)
+	return nil
+}
+
+// UnlockWallet unlocks the wallet using the specified wallet PIN, returning if it succeeded;
+// if not, how many tries are left, or for how long (in seconds) the wallet is blocked.
+func (client *Client) UnlockWallet(pin string) (bool, int, int, error) {
+	return client.unlockWallet(func(lock *walletLock) (bool, error) {
+		hash, err := lock.hash(pin)
+		return err == nil && subtle.ConstantTimeCompare(hash, lock.Hash) == 1, err
+	})
+}
+
+// UnlockWalletBiometric unlocks the wallet using the key obtained from EnableBiometricUnlock(),
+// with the same return values and throttling as UnlockWallet().
+func (client *Client) UnlockWalletBiometric(key []byte) (bool, int, int, error) {
+	return client.unlockWallet(func(lock *walletLock) (bool, error) {
+		if lock.BiometricKeyHash == nil {
+			return false, errors.New("Biometric unlocking is not enabled")
+		}
+		hash := sha256.Sum256(key)
+		return subtle.ConstantTimeCompare(hash[:], lock.BiometricKeyHash) == 1, nil
+	})
+}
+
+func (client *Client) unlockWallet(check func(lock *walletLock) (bool, error)) (bool, int, int, error) {
+	ok, attempts, blocked, err := client.verifyWalletLock(check)
+	if err != nil || !ok || !client.WalletLocked() {
+		return ok, attempts, blocked, err
+	}
+	client.setWalletLocked(false)
+	if err = client.loadStorage(); err != nil {
+		client.LockWallet()
+		return false, 0, 0, err
+	}
+	return true, 0, 0, nil
+}
+
+// verifyWalletLock checks the wallet PIN or key using the specified function, registering the attempt.
+func (client *Client) verifyWalletLock(check func(lock *walletLock) (bool, error)) (bool, int, int, error) {
+	lock := client.walletLock
+	if lock == nil {
+		return false, 0, 0, errors.New("Wallet PIN is not enabled")
+	}
+	if blocked := lock.blocked(); blocked > 0 {
+		return false, 0, blocked, nil
+	}
+	ok, err := check(lock)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	attempts, blocked := lock.attempt(ok)
+	if err = client.storage.StoreWalletLock(lock); err != nil {
+		return false, 0, 0, err
+	}
+	return ok, attempts, blocked, nil
+}
+
+// LockWallet locks the wallet, removing the credentials, secret key, keyshare server information,
+// logs and subscriptions from memory. It should not be called while a session is running.
+// Does nothing if the wallet lock is not enabled.
+func (client *Client) LockWallet() {
+	if client.walletLock == nil {
+		return
+	}
+	client.setWalletLocked(true)
+	client.secretkey.wipe()
+	client.secretkey = nil
+	for _, kss := range client.keyshareServers {
+		kss.wipe()
+	}
+	client.attributes = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
+	client.archived = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
+	client.attributesLock.Lock()
+	client.attributesPending = false
+	client.attributesIndex = nil
+	client.attributesLock.Unlock()
+	client.credentialsCache = map[irma.CredentialTypeIdentifier]map[int]*credential{}
+	client.keyshareServers = map[irma.SchemeManagerIdentifier]*keyshareServer{}
+	client.logs = nil
+	client.subscriptionsLock.Lock()
+	client.subscriptions = nil
+	client.subscriptionsLock.Unlock()
+}
+
+// SetWalletPin enables the wallet lock with the specified new PIN, changes the wallet PIN if the
+// wallet lock is already enabled, or disables the wallet lock if the new PIN is empty. If the wallet
+// lock is enabled, the old PIN must be correct; the return values are then as those of UnlockWallet().
+// Disabling the wallet lock also disables biometric unlocking.
+func (client *Client) SetWalletPin(oldPin, newPin string) (bool, int, int, error) {
+	if client.walletLock != nil {
+		ok, attempts, blocked, err := client.UnlockWallet(oldPin)
+		if err != nil || !ok {
+			return ok, attempts, blocked, err
+		}
+	}
+
+	if newPin == "" {
+		if err := client.storage.markWalletLock(false); err != nil {
+			return false, 0, 0, err
+		}
+		if err := client.storage.RemoveWalletLock(); err != nil {
+			return false, 0, 0, err
+		}
+		client.walletLock = nil
+		return true, 0, 0, nil
+	}
+
+	lock, err := newWalletLock(newPin)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if client.walletLock != nil {
+		lock.BiometricKeyHash = client.walletLock.BiometricKeyHash
+	}
+	if err = client.storage.StoreWalletLock(lock); err != nil {
+		return false, 0, 0, err
+	}
+	if err = client.storage.markWalletLock(true); err != nil {
+		return false, 0, 0, err
+	}
+	client.walletLock = lock
+	return true, 0, 0, nil
+}
+
+// EnableBiometricUnlock generates and returns a new key for unlocking the wallet with
+// UnlockWalletBiometric(), replacing any earlier key. The wallet lock must be enabled
+// and the wallet must be unlocked.
+func (client *Client) EnableBiometricUnlock() ([]byte, error) {
+	if client.walletLock == nil {
+		return nil, errors.New("Wallet PIN is not enabled")
+	}
+	if err := client.checkUnlocked(); err != nil {
+		return nil, err
+	}
+	key := make([]byte, walletPinKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(key)
+	client.walletLock.BiometricKeyHash = hash[:]
+	return key, client.storage.StoreWalletLock(client.walletLock)
+}
+
+// DisableBiometricUnlock disables unlocking the wallet with UnlockWalletBiometric().
+// The wallet must be unlocked.
+func (client *Client) DisableBiometricUnlock() error {
+	if client.walletLock == nil || client.walletLock.BiometricKeyHash == nil {
+		return nil
+	}
+	if err := client.checkUnlocked(); err != nil {
+		return err
+	}
+	client.walletLock.BiometricKeyHash = nil
+	return client.storage.StoreWalletLock(client.walletLock)
+}
+
+// BiometricUnlockEnabled returns whether or not the wallet can be unlocked with UnlockWalletBiometric().
+func (client *Client) BiometricUnlockEnabled() bool {
+	return client.walletLock != nil && len(client.walletLock.BiometricKeyHash) > 0
+}
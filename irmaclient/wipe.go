@@ -0,0 +1,138 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"os"
+
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the wiping of removed credentials. When a credential is removed, the file
+// containing its signature is overwritten before it is unlinked, and the attribute values and
+// signature kept in memory are overwritten with zeros, so that removed credentials cannot be
+// recovered by forensic tools from the storage or from memory dumps. With the SQLite storage,
+// the secure_delete option of SQLite is enabled to the same effect.
+//
+// Other sensitive material is wiped from memory in the same way as soon as it is no longer needed:
+// keyshare tokens are kept as a secret instead of as a string and wiped when they are replaced or
+// when the keyshare server or the wallet is locked or removed; the secret key of the client is wiped
+// when the wallet is locked, and the unwrapped secret key (see keystore.go) once no sessions are
+// running; and intermediate values derived from the PIN (see HashedPin() and pake.go) are wiped
+// right after use.
+//
+// This is a best effort: flash storage may keep copies of the overwritten data due to wear
+// leveling, and copies of attribute values may remain in memory in strings (e.g. in CredentialInfo).
+// Likewise, PINs are passed to the client as strings, and tokens and hashed PINs are sent in HTTP
+// headers and bodies, neither of which can be wiped. Encrypting the storage (see encryption.go)
+// offers stronger protection.
+
+// secret is sensitive data kept in memory as bytes instead of as a string, so that it can be wiped.
+type secret []byte
+
+// wipe overwrites the secret with zeros.
+func (s secret) wipe() {
+	for i := range s {
+		s[i] = 0
+	}
+}
+
+// set replaces the secret by the specified value, wiping the old value.
+func (s *secret) set(value string) {
+	s.wipe()
+	*s = secret(value)
+}
+
+// wipeFile overwrites the contents of the file with random data and then removes it.
+func (s *storage) wipeFile(file string) error {
+	s.record(JournalRemove, file, nil)
+	if s.memory != nil {
+		return s.memory.wipe(file)
+	}
+
+	f, err := os.OpenFile(s.path(file), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	noise := make([]byte, info.Size())
+	if _, err = rand.Read(noise); err == nil {
+		if _, err = f.WriteAt(noise, 0); err == nil {
+			err = f.Sync()
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(s.path(file))
+}
+
+// wipeInt overwrites the integer with zeros.
+func wipeInt(i *big.Int) {
+	if i == nil {
+		return
+	}
+	bits := i.Bits()
+	for k := range bits {
+		bits[k] = 0
+	}
+	i.SetInt64(0)
+}
+
+// wipe overwrites the secret key in memory.
+func (sk *secretKey) wipe() {
+	if sk == nil {
+		return
+	}
+	wipeInt(sk.Key)
+	secret(sk.Wrapped).wipe()
+}
+
+// wipe overwrites the token of the keyshare server in memory.
+func (ks *keyshareServer) wipe() {
+	ks.token.wipe()
+	ks.token = nil
+}
+
+// copyInts returns a deep copy of the integers. The attribute lists of the client and its cached
+// credentials are given their own copies of the attribute values, so that wiping one of them when
+// the credential is removed does not affect anything that is still in use.
+func copyInts(ints []*big.Int) []*big.Int {
+	cpy := make([]*big.Int, len(ints))
+	for i, x := range ints {
+		if x != nil {
+			cpy[i] = new(big.Int).Set(x)
+		}
+	}
+	return cpy
+}
+
+// wipeCredential overwrites the attribute values and, if present, the signature of a removed
+// credential in memory. Its first attribute, the secret key of the client which all credentials
+// share, is never wiped.
+func (client *Client) wipeCredential(attrs *irma.AttributeList, cred *credential) {
+	if attrs != nil {
+		for _, i := range attrs.Ints {
+			wipeInt(i)
+		}
+	}
+	if cred == nil || cred.Credential == nil || len(cred.Credential.Attributes) == 0 {
+		return
+	}
+	for _, i := range cred.Credential.Attributes[1:] {
+		wipeInt(i)
+	}
+	if sig := cred.Signature; sig != nil {
+		wipeInt(sig.A)
+		wipeInt(sig.E)
+		wipeInt(sig.V)
+		wipeInt(sig.KeyshareP)
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"encoding/asn1"
 	"encoding/pem"
 	gobig "math/big"
+	neturl "net/url"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
@@ -46,6 +47,9 @@ type Configuration struct {
 	CredentialTypes map[CredentialTypeIdentifier]*CredentialType
 	AttributeTypes  map[AttributeTypeIdentifier]*AttributeType
 
+	// Requestors from the requestor registries of the schemes, by scheme and requestor ID
+	Requestors map[string]*RequestorInfo
+
 	// Path to the irma_configuration folder that this instance represents
 	Path string
 
@@ -55,6 +59,10 @@ type Configuration struct {
 
 	Warnings []string
 
+	// ProofVerificationPool, if set, is used by ProofList.VerifyProofs to verify the proofs
+	// of proof lists in parallel
+	ProofVerificationPool *ProofVerificationPool
+
 	kssPublicKeys map[SchemeManagerIdentifier]map[int]*rsa.PublicKey
 	publicKeys    map[IssuerIdentifier]map[int]*gabi.PublicKey
 	privateKeys   map[IssuerIdentifier]*gabi.PrivateKey
@@ -147,6 +155,7 @@ func (conf *Configuration) clear() {
 	conf.Issuers = make(map[IssuerIdentifier]*Issuer)
 	conf.CredentialTypes = make(map[CredentialTypeIdentifier]*CredentialType)
 	conf.AttributeTypes = make(map[AttributeTypeIdentifier]*AttributeType)
+	conf.Requestors = make(map[string]*RequestorInfo)
 	conf.DisabledSchemeManagers = make(map[SchemeManagerIdentifier]*SchemeManagerError)
 	conf.kssPublicKeys = make(map[SchemeManagerIdentifier]map[int]*rsa.PublicKey)
 	conf.publicKeys = make(map[IssuerIdentifier]map[int]*gabi.PublicKey)
@@ -157,9 +166,19 @@ func (conf *Configuration) clear() {
 // ParseFolder populates the current Configuration by parsing the storage path,
 // listing the containing scheme managers, issuers and credential types.
 func (conf *Configuration) ParseFolder() (err error) {
+	span := StartSpan("irma.Configuration.ParseFolder")
+	span.SetAttribute("path", conf.Path)
+	defer func() { span.End(err) }()
+
 	// Init all maps
 	conf.clear()
 
+	if !conf.readOnly {
+		if err = conf.recoverSchemeUpdates(); err != nil {
+			return err
+		}
+	}
+
 	// Copy any new or updated scheme managers out of the assets into storage
 	if conf.assets != "" {
 		err = iterateSubfolders(conf.assets, func(dir string) error {
@@ -205,6 +224,21 @@ func (conf *Configuration) ParseFolder() (err error) {
 	return
 }
 
+// Reparse parses the folder of the configuration into a new Configuration, which is returned
+// only if parsing succeeded. The configuration itself is left untouched, so that it can
+// remain in use until it is replaced by the new one.
+func (conf *Configuration) Reparse() (*Configuration, error) {
+	parsed, err := newConfiguration(conf.Path, conf.assets)
+	if err != nil {
+		return nil, err
+	}
+	parsed.readOnly = conf.readOnly
+	if err = parsed.ParseFolder(); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
 // ParseOrRestoreFolder parses the irma_configuration folder, and when possible attempts to restore
 // any broken scheme managers from their remote.
 // Any error encountered during parsing is considered recoverable only if it is of type *SchemeManagerError;
@@ -240,7 +274,19 @@ func (conf *Configuration) ParseOrRestoreFolder() error {
 
 // ParseSchemeManagerFolder parses the entire tree of the specified scheme manager
 // If err != nil then a problem occured
-func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeManager) (err error) {
+func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeManager) error {
+	return conf.parseSchemeManagerFolder(dir, manager, true)
+}
+
+// ParseUnsignedSchemeManagerFolder parses the entire tree of the specified scheme manager like
+// ParseSchemeManagerFolder(), but without verifying its signature and the hashes of its files, for
+// tools inspecting schemes that are not (yet) signed. The scheme manager is not marked as valid,
+// so it must not be used for anything else.
+func (conf *Configuration) ParseUnsignedSchemeManagerFolder(dir string, manager *SchemeManager) error {
+	return conf.parseSchemeManagerFolder(dir, manager, false)
+}
+
+func (conf *Configuration) parseSchemeManagerFolder(dir string, manager *SchemeManager, verify bool) (err error) {
 	// From this point, keep it in our map even if it has an error. The user must check either:
 	// - manager.Status == SchemeManagerStatusValid, aka "VALID"
 	// - or equivalently, manager.Valid == true
@@ -259,12 +305,15 @@ func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeM
 	}()
 
 	// Verify signature and read scheme manager description
-	if err = conf.VerifySignature(manager.Identifier()); err != nil {
-		return
-	}
-	if manager.index, err = conf.parseIndex(filepath.Base(dir), manager); err != nil {
-		manager.Status = SchemeManagerStatusInvalidIndex
-		return
+	manager.unsigned = !verify
+	if verify {
+		if err = conf.VerifySignature(manager.Identifier()); err != nil {
+			return
+		}
+		if manager.index, err = conf.parseIndex(filepath.Base(dir), manager); err != nil {
+			manager.Status = SchemeManagerStatusInvalidIndex
+			return
+		}
 	}
 	exists, err := conf.pathToDescription(manager, dir+"/description.xml", manager)
 	if err != nil {
@@ -279,19 +328,21 @@ func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeM
 		return
 	}
 
-	// Verify that all other files are validly signed
-	err = conf.VerifySchemeManager(manager)
-	if err != nil {
-		manager.Status = SchemeManagerStatusInvalidSignature
-		return
-	}
+	if verify {
+		// Verify that all other files are validly signed
+		err = conf.VerifySchemeManager(manager)
+		if err != nil {
+			manager.Status = SchemeManagerStatusInvalidSignature
+			return
+		}
 
-	// Read timestamp indicating time of last modification
-	ts, exists, err := readTimestamp(dir + "/timestamp")
-	if err != nil || !exists {
-		return errors.WrapPrefix(err, "Could not read scheme manager timestamp", 0)
+		// Read timestamp indicating time of last modification
+		ts, exists, err := readTimestamp(dir + "/timestamp")
+		if err != nil || !exists {
+			return errors.WrapPrefix(err, "Could not read scheme manager timestamp", 0)
+		}
+		manager.Timestamp = *ts
 	}
-	manager.Timestamp = *ts
 
 	// Parse contained issuers and credential types
 	err = conf.parseIssuerFolders(manager, dir)
@@ -299,6 +350,13 @@ func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeM
 		manager.Status = SchemeManagerStatusContentParsingError
 		return
 	}
+	if err = conf.parseRequestors(manager, dir); err != nil {
+		manager.Status = SchemeManagerStatusContentParsingError
+		return
+	}
+	if !verify {
+		return
+	}
 	manager.Status = SchemeManagerStatusValid
 	manager.Valid = true
 	return
@@ -402,13 +460,29 @@ func (conf *Configuration) KeyshareServerKeyFunc(scheme SchemeManagerIdentifier)
 	}
 }
 
+// UnknownKeyshareKeyError is returned when a keyshare server JWT is signed with a key that its scheme
+// does not contain. This happens when the keyshare server rotated its keys while the scheme has not
+// yet been updated.
+type UnknownKeyshareKeyError struct {
+	Scheme SchemeManagerIdentifier
+	Index  int
+}
+
+func (e *UnknownKeyshareKeyError) Error() string {
+	return fmt.Sprintf("keyshare server public key %d of scheme %s not found", e.Index, e.Scheme)
+}
+
 // KeyshareServerPublicKey returns the i'th public key of the specified scheme.
+// The keys are cached until the scheme is updated.
 func (conf *Configuration) KeyshareServerPublicKey(scheme SchemeManagerIdentifier, i int) (*rsa.PublicKey, error) {
 	if _, contains := conf.kssPublicKeys[scheme]; !contains {
 		conf.kssPublicKeys[scheme] = make(map[int]*rsa.PublicKey)
 	}
 	if _, contains := conf.kssPublicKeys[scheme][i]; !contains {
 		pkbts, err := ioutil.ReadFile(filepath.Join(conf.Path, scheme.Name(), fmt.Sprintf("kss-%d.pem", i)))
+		if os.IsNotExist(err) {
+			return nil, &UnknownKeyshareKeyError{Scheme: scheme, Index: i}
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -495,6 +569,11 @@ func (conf *Configuration) DeleteSchemeManager(id SchemeManagerIdentifier) error
 			delete(conf.CredentialTypes, cred)
 		}
 	}
+	for key, requestor := range conf.Requestors {
+		if requestor.Scheme == id {
+			delete(conf.Requestors, key)
+		}
+	}
 	if !conf.readOnly {
 		return os.RemoveAll(filepath.Join(conf.Path, id.Name()))
 	}
@@ -614,8 +693,8 @@ func iterateSubfolders(path string, handler func(string) error) error {
 		if !stat.IsDir() {
 			continue
 		}
-		if strings.HasSuffix(dir, "/.git") {
-			continue
+		if strings.HasPrefix(filepath.Base(dir), ".") {
+			continue // .git, or a staged scheme update
 		}
 		err = handler(dir)
 		if err != nil {
@@ -655,6 +734,86 @@ func (conf *Configuration) pathToDescription(manager *SchemeManager, path string
 	return true, nil
 }
 
+// IssuanceSource describes a credential type from which an attribute can be obtained,
+// along with its issuer and scheme and the scheme-declared information on how to obtain it.
+type IssuanceSource struct {
+	CredentialType *CredentialType
+	Issuer         *Issuer
+	SchemeManager  *SchemeManager
+	// Webpage where the credential type can be obtained, if declared in the scheme
+	IssueURL    TranslatedString
+	Description TranslatedString
+}
+
+// IssuanceSources returns the credential types from which the specified attribute can be
+// obtained, for use in helping the user to obtain missing attributes. The identifier may also
+// refer to a credential type (i.e. have 3 parts), in which case that credential type is returned.
+// Credential types from invalid scheme managers are not returned.
+func (conf *Configuration) IssuanceSources(attr AttributeTypeIdentifier) []*IssuanceSource {
+	var sources []*IssuanceSource
+	for id, credtype := range conf.CredentialTypes {
+		if attr.IsCredential() && id != attr.CredentialTypeIdentifier() ||
+			!attr.IsCredential() && !credtype.ContainsAttribute(attr) {
+			continue
+		}
+		manager := conf.SchemeManagers[credtype.SchemeManagerIdentifier()]
+		if manager == nil || !manager.Valid {
+			continue
+		}
+		sources = append(sources, &IssuanceSource{
+			CredentialType: credtype,
+			Issuer:         conf.Issuers[credtype.IssuerIdentifier()],
+			SchemeManager:  manager,
+			IssueURL:       credtype.IssueURL,
+			Description:    credtype.Description,
+		})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].CredentialType.Identifier().String() < sources[j].CredentialType.Identifier().String()
+	})
+	return sources
+}
+
+// CheckSessionURL checks that the URL of a session uses HTTPS, unless its host is a loopback host
+// or listed among the InsecureHosts of the scheme to which the URL belongs, i.e., the valid scheme
+// in whose requestor registry the requestor of the host is listed (see RequestorForHost()).
+func (conf *Configuration) CheckSessionURL(url string) error {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return err
+	}
+	requestor := conf.RequestorForHost(u.Hostname())
+	if requestor == nil {
+		return checkURL(url)
+	}
+	manager := conf.SchemeManagers[requestor.Scheme]
+	if manager == nil || !manager.Valid {
+		return checkURL(url)
+	}
+	return checkURL(url, manager)
+}
+
+// RemoteErrorMessage returns the message for the user describing the specified error in the
+// specified language, as translated by the specified scheme, and false if the scheme is not valid
+// or does not translate the ErrorName of the error. Only the scheme to which the server returning
+// the error belongs (e.g. in whose requestor registry the requestor is listed) should be used, so
+// that schemes cannot change the messages of errors of servers of other schemes.
+func (conf *Configuration) RemoteErrorMessage(err *RemoteError, scheme SchemeManagerIdentifier, lang string) (string, bool) {
+	manager := conf.SchemeManagers[scheme]
+	if err.ErrorName == "" || manager == nil || !manager.Valid {
+		return "", false
+	}
+	for _, msg := range manager.ErrorMessages {
+		if msg.Key != err.ErrorName {
+			continue
+		}
+		if text := msg.Message.translation(lang); text != "" {
+			return text, true
+		}
+	}
+	return "", false
+}
+
 // Contains checks if the configuration contains the specified credential type.
 func (conf *Configuration) Contains(cred CredentialTypeIdentifier) bool {
 	return conf.SchemeManagers[cred.IssuerIdentifier().SchemeManagerIdentifier()] != nil &&
@@ -696,7 +855,7 @@ func (conf *Configuration) CopyManagerFromAssets(scheme SchemeManagerIdentifier)
 }
 
 // DownloadSchemeManager downloads and returns a scheme manager description.xml file
-// from the specified URL.
+// from the specified URL, which must use HTTPS unless its host is a loopback host.
 func DownloadSchemeManager(url string) (*SchemeManager, error) {
 	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
 		url = "https://" + url
@@ -707,6 +866,9 @@ func DownloadSchemeManager(url string) (*SchemeManager, error) {
 	if strings.HasSuffix(url, "/description.xml") {
 		url = url[:len(url)-len("/description.xml")]
 	}
+	if err := checkURL(url); err != nil {
+		return nil, err
+	}
 	b, err := NewHTTPTransport(url).GetBytes("description.xml")
 	if err != nil {
 		return nil, err
@@ -739,6 +901,7 @@ func (conf *Configuration) RemoveSchemeManager(id SchemeManagerIdentifier, fromS
 			delete(conf.publicKeys, issid)
 		}
 	}
+	delete(conf.kssPublicKeys, id)
 	delete(conf.SchemeManagers, id)
 
 	if fromStorage || !conf.readOnly {
@@ -772,6 +935,9 @@ func (conf *Configuration) InstallSchemeManager(manager *SchemeManager, publicke
 		return errors.New("cannot install scheme into a read-only configuration")
 	}
 
+	if err := manager.CheckURL(manager.URL); err != nil {
+		return err
+	}
 	name := manager.ID
 	if err := fs.EnsureDirectoryExists(filepath.Join(conf.Path, name)); err != nil {
 		return err
@@ -1069,6 +1235,14 @@ func (conf *Configuration) VerifySchemeManager(manager *SchemeManager) error {
 // and verifies its authenticity by checking that the file hash
 // is present in the (signed) scheme manager index file.
 func (conf *Configuration) ReadAuthenticatedFile(manager *SchemeManager, path string) ([]byte, bool, error) {
+	if manager.unsigned {
+		// See ParseUnsignedSchemeManagerFolder()
+		bts, err := ioutil.ReadFile(filepath.Join(conf.Path, path))
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return bts, true, err
+	}
 	signedHash, ok := manager.index[filepath.ToSlash(path)]
 	if !ok {
 		return nil, false, nil
@@ -1162,6 +1336,8 @@ func (hash ConfigurationFileHash) Equal(other ConfigurationFileHash) bool {
 // with the remote version at the scheme manager's URL, downloading and storing
 // new and modified files, according to the index files of both versions.
 // It stores the identifiers of new or updated credential types or issuers in the second parameter.
+// The update is downloaded into a copy of the scheme, which replaces the stored version only after
+// it has been verified against the new signed index; otherwise the stored version is left intact.
 // Note: any newly downloaded files are not yet parsed and inserted into conf.
 func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downloaded *IrmaIdentifierSet) (err error) {
 	if conf.readOnly {
@@ -1172,6 +1348,10 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 		return errors.Errorf("Cannot update unknown scheme manager %s", id)
 	}
 
+	if err = manager.CheckURL(manager.URL); err != nil {
+		return err
+	}
+
 	// Check remote timestamp and see if we have to do anything
 	transport := NewHTTPTransport(manager.URL + "/")
 	timestampBts, err := transport.GetBytes("timestamp")
@@ -1186,15 +1366,23 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 		return nil
 	}
 
+	// Stage the update in a copy of the scheme, leaving our stored copy of the scheme intact until
+	// the update has been downloaded and verified completely. If anything goes wrong before that,
+	// including the process dying, the staged copy is discarded.
+	staging, err := conf.stageSchemeUpdate(id)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(staging.Path)
+	}()
+
 	// Download the new index and its signature, and check that the new index
 	// is validly signed by the new signature
-	// By aborting immediately in case of error, and restoring backup versions
-	// of the index and signature, we leave our stored copy of the scheme manager
-	// intact.
-	if err = conf.DownloadSchemeManagerSignature(manager); err != nil {
+	if err = staging.DownloadSchemeManagerSignature(manager); err != nil {
 		return
 	}
-	newIndex, err := conf.parseIndex(manager.ID, manager)
+	newIndex, err := staging.parseIndex(manager.ID, manager)
 	if err != nil {
 		return
 	}
@@ -1202,9 +1390,8 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 	issPattern := regexp.MustCompile("(.+)/(.+)/description\\.xml")
 	credPattern := regexp.MustCompile("(.+)/(.+)/Issues/(.+)/description\\.xml")
 
-	// TODO: how to recover/fix local copy if err != nil below?
 	for filename, newHash := range newIndex {
-		path := filepath.Join(conf.Path, filename)
+		path := filepath.Join(staging.Path, filename)
 		oldHash, known := manager.index[filename]
 		var have bool
 		have, err = fs.PathExists(path)
@@ -1219,7 +1406,7 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 			return err
 		}
 		stripped := filename[len(manager.ID)+1:] // Scheme manager URL already ends with its name
-		// Download the new file, store it in our own irma_configuration folder
+		// Download the new file, store it in the staged copy of the scheme
 		if err = transport.GetSignedFile(stripped, path, newHash); err != nil {
 			return
 		}
@@ -1240,10 +1427,114 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 		}
 	}
 
+	// Verify the staged scheme as a whole: all of its files must match the signed index,
+	// and it must parse
+	if err = staging.VerifySchemeManager(&SchemeManager{ID: manager.ID, index: newIndex}); err != nil {
+		return
+	}
+	if err = staging.ParseFolder(); err != nil {
+		return
+	}
+	// The timestamp downloaded above is not signed, but the staged one is covered by the new index
+	staged := staging.SchemeManagers[id]
+	if staged == nil || !manager.Timestamp.Before(staged.Timestamp) {
+		return errors.Errorf("Signed timestamp of scheme manager %s is not newer than ours", id)
+	}
+
+	if err = conf.commitSchemeUpdate(id, staging); err != nil {
+		return
+	}
 	manager.index = newIndex
+	manager.Timestamp = staged.Timestamp
+	// The keyshare server may have rotated its keys
+	delete(conf.kssPublicKeys, id)
 	return
 }
 
+// Prefixes of the folders in which scheme updates are staged, and in which the previous version
+// of a scheme is kept while it is being replaced by the staged update
+const (
+	schemeStagingPrefix = ".update-"
+	schemeBackupPrefix  = ".backup-"
+)
+
+// stageSchemeUpdate returns a Configuration containing only a copy of the specified scheme,
+// into which an update of the scheme can be downloaded.
+func (conf *Configuration) stageSchemeUpdate(id SchemeManagerIdentifier) (*Configuration, error) {
+	path := filepath.Join(conf.Path, schemeStagingPrefix+id.String())
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+	if err := fs.EnsureDirectoryExists(path); err != nil {
+		return nil, err
+	}
+	staging, err := NewConfiguration(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = fs.CopyDirectory(filepath.Join(conf.Path, id.String()), filepath.Join(path, id.String())); err != nil {
+		_ = os.RemoveAll(path)
+		return nil, err
+	}
+	return staging, nil
+}
+
+// commitSchemeUpdate replaces our copy of the scheme with the staged one. Renaming a folder is atomic,
+// but replacing one takes two renames: if the process dies in between, the previous version of the
+// scheme is restored by recoverSchemeUpdates() the next time the configuration is parsed.
+func (conf *Configuration) commitSchemeUpdate(id SchemeManagerIdentifier, staging *Configuration) error {
+	dir := filepath.Join(conf.Path, id.String())
+	backup := filepath.Join(conf.Path, schemeBackupPrefix+id.String())
+	if err := os.RemoveAll(backup); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, backup); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(staging.Path, id.String()), dir); err != nil {
+		if rollbackErr := os.Rename(backup, dir); rollbackErr != nil {
+			return errors.WrapPrefix(rollbackErr, "failed to restore previous version of scheme "+id.String(), 0)
+		}
+		return err
+	}
+	return os.RemoveAll(backup)
+}
+
+// recoverSchemeUpdates cleans up after scheme updates that were interrupted by the process dying,
+// restoring the previous version of schemes that were being replaced.
+func (conf *Configuration) recoverSchemeUpdates() error {
+	backups, err := filepath.Glob(filepath.Join(conf.Path, schemeBackupPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		dir := filepath.Join(conf.Path, strings.TrimPrefix(filepath.Base(backup), schemeBackupPrefix))
+		exists, err := fs.PathExists(dir)
+		if err != nil {
+			return err
+		}
+		if exists {
+			err = os.RemoveAll(backup)
+		} else {
+			Logger.WithField("scheme", filepath.Base(dir)).Warn("Restoring scheme after interrupted update")
+			err = os.Rename(backup, dir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	stagings, err := filepath.Glob(filepath.Join(conf.Path, schemeStagingPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, staging := range stagings {
+		if err = os.RemoveAll(staging); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (conf *Configuration) UpdateSchemes() error {
 	updated := IrmaIdentifierSet{
 		SchemeManagers:  map[SchemeManagerIdentifier]struct{}{},
@@ -1334,6 +1625,12 @@ func (conf *Configuration) checkCredentialType(manager *SchemeManager, issuer *I
 	if cred.SchemeManagerID != manager.ID {
 		return errors.Errorf("Credential type %s has wrong SchemeManager %s", credid.String(), cred.SchemeManagerID)
 	}
+	if cred.MaxInstances < 0 {
+		return errors.Errorf("Credential type %s has negative MaxInstances", credid.String())
+	}
+	if cred.MaxInstances != 0 && cred.IsSingleton {
+		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s is a singleton, ignoring MaxInstances", credid.String()))
+	}
 	if err := fs.AssertPathExists(dir + "/logo.png"); err != nil {
 		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has no logo.png", credid.String()))
 	}
@@ -1349,10 +1646,15 @@ func (conf *Configuration) checkAttributes(cred *CredentialType) error {
 	}
 	for i, attr := range cred.AttributeTypes {
 		conf.checkTranslations(fmt.Sprintf("Attribute %s of credential type %s", attr.ID, cred.Identifier().String()), attr)
-		index := i
-		if attr.DisplayIndex != nil {
-			index = *attr.DisplayIndex
+		if attr.DisplayGroup != "" && cred.DisplayGroup(attr.DisplayGroup) == nil {
+			conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has unknown displayGroup %s at attribute %d", name, attr.DisplayGroup, i))
+		}
+		if attr.IsDerived() {
+			if err := conf.checkDerivedAttribute(cred, attr); err != nil {
+				return err
+			}
 		}
+		index := attr.displayIndex(i)
 		if index >= count {
 			conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has invalid attribute displayIndex at attribute %d", name, i))
 		}
@@ -1364,6 +1666,26 @@ func (conf *Configuration) checkAttributes(cred *CredentialType) error {
 	return nil
 }
 
+func (conf *Configuration) checkDerivedAttribute(cred *CredentialType, attr *AttributeType) error {
+	name := cred.Identifier().String()
+	if attr.DerivedFrom == attr.ID {
+		return errors.Errorf("Attribute %s of credential type %s is derived from itself", attr.ID, name)
+	}
+	for _, base := range cred.AttributeTypes {
+		if base.ID != attr.DerivedFrom {
+			continue
+		}
+		if base.IsDerived() {
+			return errors.Errorf("Attribute %s of credential type %s is derived from derived attribute %s", attr.ID, name, base.ID)
+		}
+		if _, _, err := attr.derivation(); err != nil {
+			return errors.WrapPrefix(err, fmt.Sprintf("Attribute %s of credential type %s", attr.ID, name), 0)
+		}
+		return nil
+	}
+	return errors.Errorf("Attribute %s of credential type %s is derived from unknown attribute %s", attr.ID, name, attr.DerivedFrom)
+}
+
 func (conf *Configuration) checkScheme(scheme *SchemeManager, dir string) error {
 	if scheme.XMLVersion < 7 {
 		scheme.Status = SchemeManagerStatusParsingError
@@ -1373,6 +1695,15 @@ func (conf *Configuration) checkScheme(scheme *SchemeManager, dir string) error
 		scheme.Status = SchemeManagerStatusParsingError
 		return errors.Errorf("Scheme %s has wrong directory name %s", scheme.ID, filepath.Base(dir))
 	}
+	for _, url := range []string{scheme.URL, scheme.KeyshareServer} {
+		if url == "" {
+			continue
+		}
+		if err := scheme.CheckURL(url); err != nil {
+			scheme.Status = SchemeManagerStatusParsingError
+			return err
+		}
+	}
 	if scheme.KeyshareServer != "" {
 		if err := fs.AssertPathExists(filepath.Join(dir, "kss-0.pem")); err != nil {
 			scheme.Status = SchemeManagerStatusParsingError
@@ -1387,20 +1718,10 @@ func (conf *Configuration) checkScheme(scheme *SchemeManager, dir string) error
 // that it contains all necessary translations.
 func (conf *Configuration) checkTranslations(file string, o interface{}) {
 	langs := []string{"en", "nl"} // Hardcode these for now, TODO make configurable
-	v := reflect.ValueOf(o)
-
-	// Dereference in case of pointer or interface
-	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
-		v = v.Elem()
-	}
-
-	for i := 0; i < v.NumField(); i++ {
-		if v.Field(i).Type() == reflect.TypeOf(TranslatedString{}) {
-			val := v.Field(i).Interface().(TranslatedString)
-			for _, lang := range langs {
-				if _, exists := val[lang]; !exists {
-					conf.Warnings = append(conf.Warnings, fmt.Sprintf("%s misses %s translation in <%s> tag", file, lang, v.Type().Field(i).Name))
-				}
+	for _, field := range translatedFields(o) {
+		for _, lang := range langs {
+			if _, exists := field.value[lang]; !exists {
+				conf.Warnings = append(conf.Warnings, fmt.Sprintf("%s misses %s translation in <%s> tag", file, lang, field.name))
 			}
 		}
 	}
@@ -1,15 +1,32 @@
 package irma
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/bwesterb/go-atum"
+	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/testvectors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -73,6 +90,65 @@ func TestRetryHTTPRequest(t *testing.T) {
 	require.Equal(t, "42\n", string(bts))
 }
 
+func TestHTTPConnectionReuse(t *testing.T) {
+	var connections int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`"ok"`))
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	// Consecutive requests, also by different transports, use the same connection
+	var result string
+	for i := 0; i < 3; i++ {
+		require.NoError(t, NewHTTPTransport(srv.URL).Post("", &result, "message"))
+		require.NoError(t, NewHTTPTransport(srv.URL).Get("", &result))
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
+
+func TestConnectionPool(t *testing.T) {
+	var connections int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`"ok"`))
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	// Transports using the same pool share connections, but not with other pools
+	var result string
+	pool := NewConnectionPool()
+	for i := 0; i < 2; i++ {
+		transport := NewHTTPTransport(srv.URL)
+		transport.SetConnectionPool(pool)
+		require.NoError(t, transport.Get("", &result))
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&connections))
+	other := NewConnectionPool()
+	defer other.Close()
+	transport := NewHTTPTransport(srv.URL)
+	transport.SetConnectionPool(other)
+	require.NoError(t, transport.Get("", &result))
+	require.Equal(t, int32(2), atomic.LoadInt32(&connections))
+
+	// After closing the pool, new connections are made
+	pool.Close()
+	transport = NewHTTPTransport(srv.URL)
+	transport.SetConnectionPool(pool)
+	require.NoError(t, transport.Get("", &result))
+	require.Equal(t, int32(3), atomic.LoadInt32(&connections))
+}
+
 func TestInvalidIrmaConfigurationRestoreFromRemote(t *testing.T) {
 	test.StartSchemeManagerHttpServer()
 	defer test.StopSchemeManagerHttpServer()
@@ -90,6 +166,68 @@ func TestInvalidIrmaConfigurationRestoreFromRemote(t *testing.T) {
 	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
 }
 
+func TestAtomicSchemeUpdate(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	conf, err := NewConfigurationFromAssets(path, filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseOrRestoreFolder())
+
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attrid := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+	description := filepath.Join(path, "irma-demo", "RU", "Issues", "studentCard", "description.xml")
+	original, err := ioutil.ReadFile(description)
+	require.NoError(t, err)
+
+	// Serve the updated scheme with one of its files tampered with
+	fileserver := http.FileServer(http.Dir(filepath.Join("testdata", "irma_configuration_updated")))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/studentCard/description.xml") {
+			w.Write([]byte("<IssueSpecification></IssueSpecification>"))
+			return
+		}
+		fileserver.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// The update fails, leaving the stored scheme intact
+	conf.SchemeManagers[schemeid].URL = srv.URL + "/irma-demo"
+	require.Error(t, conf.UpdateSchemeManager(schemeid, nil))
+	bts, err := ioutil.ReadFile(description)
+	require.NoError(t, err)
+	require.Equal(t, original, bts)
+	require.NoError(t, conf.ParseFolder())
+	require.Nil(t, conf.CredentialTypes[credid].AttributeType(attrid))
+	require.Equal(t, SchemeManagerStatusValid, conf.SchemeManagers[schemeid].Status)
+	_, err = os.Stat(filepath.Join(path, schemeStagingPrefix+"irma-demo"))
+	require.True(t, os.IsNotExist(err))
+
+	// Updating from an untampered server succeeds
+	conf.SchemeManagers[schemeid].URL = "http://localhost:48681/irma_configuration_updated/irma-demo"
+	require.NoError(t, conf.UpdateSchemeManager(schemeid, nil))
+	require.NoError(t, conf.ParseFolder())
+	require.NotNil(t, conf.CredentialTypes[credid].AttributeType(attrid))
+	dirs, err := filepath.Glob(filepath.Join(path, ".*"))
+	require.NoError(t, err)
+	require.Empty(t, dirs)
+
+	// Simulate the process dying after moving the scheme out of the way, before moving the update in
+	require.NoError(t, os.Rename(filepath.Join(path, "irma-demo"), filepath.Join(path, schemeBackupPrefix+"irma-demo")))
+	require.NoError(t, os.Mkdir(filepath.Join(path, schemeStagingPrefix+"irma-demo"), 0700))
+	require.NoError(t, conf.ParseFolder())
+	require.Contains(t, conf.SchemeManagers, schemeid)
+	require.NotNil(t, conf.CredentialTypes[credid].AttributeType(attrid))
+	dirs, err = filepath.Glob(filepath.Join(path, ".*"))
+	require.NoError(t, err)
+	require.Empty(t, dirs)
+}
+
 func TestInvalidIrmaConfigurationRestoreFromAssets(t *testing.T) {
 	test.CreateTestStorage(t)
 	defer test.ClearTestStorage(t)
@@ -307,6 +445,62 @@ func TestVerifyValidSig(t *testing.T) {
 	require.Equal(t, attrs[0].Value["en"], "456")
 }
 
+func TestVerifySigAtTime(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	irmaSignedMessageJson := "{\"signature\":[{\"c\":\"pliyrSE7wXcDcKXuBtZW5bnucvBSXpILIRvnNBgx7hQ=\",\"A\":\"D/8wLPq9860bpXZ5c+VYyoPJ+Z8CWDZNQ0jXvst8qnPRdivy/GQIfJHjVnpOPlHbguphb/7JVbfcV3bZeybA3bCF/4UesjRUZlMf/iJ/QgKHbt41ogN1PPT5z7qBJpkxuNTIkHxaUPoDvhouHmuC9pNj4afRUyLJerxKPkpdBw0=\",\"e_response\":\"YOrKTrMSs4/QOUtPkT0YaYNEmW7Cs+cu624zr2xrHodyL88ub6yaXB7MGHAcQ1+iXsGN8jkfxB/0\",\"v_response\":\"AYSa1p8ISs//MsocJjODwWuPB/z6+iKHHi+sTToRs0eJ2X1gwmWoA5QB0aHjRkWye3/+2rtosfUzI77FlPQVnrbMERwcuYM/fx3fpNCpjm2qcs3AOJRcSRxcNFMe1+4ECsmJhByMDutS1KXAAKiNvnhEXx9f0JrQGwQFtpSFPh8dOuvEKUZHAUALr4FcHCa2HL9nDRiqy2KAOxE0nAANAcMaBo/ed+WZeHtv4CTB7egyYs27cklVbwlBzmRrbjNZk57ICd0jVd6SZ2Ir93r/aPejkyhQ03xh9RVVyhOn4bkbjKIBzEybXTJAXgNmvd6F8Ds00srBZVWlo7Z23JZ7\",\"a_responses\":{\"0\":\"QHTznWWrECRNNmUNcy0yGu2L6qsZU6qkvaII8QB8QjbUxpwHzSeJWkzrn/Kk1KIowfoqB1DKGaFLATvuBl+bCoJjea+2VfK9Ns8=\",\"2\":\"H57Y9CTXJ5MAVo+aFfNSbmRMFQpraBIZVOXiRxCD/P7Aw4fW8r9P5l9pO9DTUeExaqFzsLyF5i5EridVWxlP2Wv0zbH8ku9Sg9w=\",\"3\":\"joggAmOhqM4QsKdoLHAfaslzXqJswS7MwZ/5+AKYdkMaHQ45biMdZU/6R+B7bjvsumg2f6KyTyg0G+BI+wVdJOjh3kGezdANB7Y=\",\"5\":\"5YP4A82WWeqc33e5Zg/Q8lqQQ1amLE8mOxMwCXb3N4J0UJRfV9lUFvbH1Q3Yb3YHAZpzGvhN/pBacwqktMkP4L71PnMldqA+nqA=\"},\"a_disclosed\":{\"1\":\"AgAJuwB+AALWy2qU9p3l52l9LU1rVT4M\",\"4\":\"NDU2\"}}],\"nonce\":\"Kg==\",\"context\":\"BTk=\",\"message\":\"I owe you everything\",\"timestamp\":{\"Time\":1527196489,\"ServerUrl\":\"https://metrics.privacybydesign.foundation/atum\",\"Sig\":{\"Alg\":\"ed25519\",\"Data\":\"ZV1qkvDrFK14QrUSC66xTNr9HitCOV4vwfGX0bh3iwY7qyHCi9rIOE97KY8CZifU5oLgVhFWy5E+ALR+gEpACw==\",\"PublicKey\":\"e/nMAJF7nwrvNZRpuJljNpRx+CsT7caaXyn9OX683R8=\"}}}"
+	irmaSignedMessage := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(irmaSignedMessageJson), irmaSignedMessage))
+
+	// The attributes were valid when the signature was created, but have expired since
+	signed := time.Unix(irmaSignedMessage.Timestamp.Time, 0)
+	require.False(t, ProofList(irmaSignedMessage.Signature).Expired(conf, &signed))
+	require.True(t, ProofList(irmaSignedMessage.Signature).Expired(conf, nil))
+}
+
+func TestRetimestamp(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	require.Error(t, (&SignedMessage{}).Retimestamp())
+
+	irmaSignedMessageJson := "{\"signature\":[{\"c\":\"pliyrSE7wXcDcKXuBtZW5bnucvBSXpILIRvnNBgx7hQ=\",\"A\":\"D/8wLPq9860bpXZ5c+VYyoPJ+Z8CWDZNQ0jXvst8qnPRdivy/GQIfJHjVnpOPlHbguphb/7JVbfcV3bZeybA3bCF/4UesjRUZlMf/iJ/QgKHbt41ogN1PPT5z7qBJpkxuNTIkHxaUPoDvhouHmuC9pNj4afRUyLJerxKPkpdBw0=\",\"e_response\":\"YOrKTrMSs4/QOUtPkT0YaYNEmW7Cs+cu624zr2xrHodyL88ub6yaXB7MGHAcQ1+iXsGN8jkfxB/0\",\"v_response\":\"AYSa1p8ISs//MsocJjODwWuPB/z6+iKHHi+sTToRs0eJ2X1gwmWoA5QB0aHjRkWye3/+2rtosfUzI77FlPQVnrbMERwcuYM/fx3fpNCpjm2qcs3AOJRcSRxcNFMe1+4ECsmJhByMDutS1KXAAKiNvnhEXx9f0JrQGwQFtpSFPh8dOuvEKUZHAUALr4FcHCa2HL9nDRiqy2KAOxE0nAANAcMaBo/ed+WZeHtv4CTB7egyYs27cklVbwlBzmRrbjNZk57ICd0jVd6SZ2Ir93r/aPejkyhQ03xh9RVVyhOn4bkbjKIBzEybXTJAXgNmvd6F8Ds00srBZVWlo7Z23JZ7\",\"a_responses\":{\"0\":\"QHTznWWrECRNNmUNcy0yGu2L6qsZU6qkvaII8QB8QjbUxpwHzSeJWkzrn/Kk1KIowfoqB1DKGaFLATvuBl+bCoJjea+2VfK9Ns8=\",\"2\":\"H57Y9CTXJ5MAVo+aFfNSbmRMFQpraBIZVOXiRxCD/P7Aw4fW8r9P5l9pO9DTUeExaqFzsLyF5i5EridVWxlP2Wv0zbH8ku9Sg9w=\",\"3\":\"joggAmOhqM4QsKdoLHAfaslzXqJswS7MwZ/5+AKYdkMaHQ45biMdZU/6R+B7bjvsumg2f6KyTyg0G+BI+wVdJOjh3kGezdANB7Y=\",\"5\":\"5YP4A82WWeqc33e5Zg/Q8lqQQ1amLE8mOxMwCXb3N4J0UJRfV9lUFvbH1Q3Yb3YHAZpzGvhN/pBacwqktMkP4L71PnMldqA+nqA=\"},\"a_disclosed\":{\"1\":\"AgAJuwB+AALWy2qU9p3l52l9LU1rVT4M\",\"4\":\"NDU2\"}}],\"nonce\":\"Kg==\",\"context\":\"BTk=\",\"message\":\"I owe you everything\",\"timestamp\":{\"Time\":1527196489,\"ServerUrl\":\"https://metrics.privacybydesign.foundation/atum\",\"Sig\":{\"Alg\":\"ed25519\",\"Data\":\"ZV1qkvDrFK14QrUSC66xTNr9HitCOV4vwfGX0bh3iwY7qyHCi9rIOE97KY8CZifU5oLgVhFWy5E+ALR+gEpACw==\",\"PublicKey\":\"e/nMAJF7nwrvNZRpuJljNpRx+CsT7caaXyn9OX683R8=\"}}}"
+	sm := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(irmaSignedMessageJson), sm))
+	signed := time.Unix(sm.Timestamp.Time, 0)
+	_, status, err := sm.VerifyAt(conf, nil, &signed)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+
+	// Each archive timestamp covers the preceding ones, and the nonce of timestamps made by earlier
+	// versions is computed over the non-canonical serialization of the signature
+	first, err := sm.archiveTimestampRequest(0, false)
+	require.NoError(t, err)
+	legacy, err := sm.archiveTimestampRequest(0, true)
+	require.NoError(t, err)
+	require.NotEqual(t, first, legacy)
+	archive := *sm.Timestamp
+	archive.Time++
+	sm.ArchiveTimestamps = []*atum.Timestamp{&archive}
+	second, err := sm.archiveTimestampRequest(1, false)
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+	again, err := sm.archiveTimestampRequest(0, false)
+	require.NoError(t, err)
+	require.Equal(t, first, again)
+
+	// Archive timestamps that do not sign the signature are rejected
+	_, status, err = sm.VerifyAt(conf, nil, &signed)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusInvalidTimestamp, status)
+
+	// As are archive timestamps from other timestamp servers, or not in chronological order
+	archive.ServerUrl = "https://example.com/atum"
+	require.Error(t, sm.verifyArchiveTimestamps())
+	archive.ServerUrl = TimestampServerURL
+	archive.Time = sm.Timestamp.Time - 1
+	require.EqualError(t, sm.verifyArchiveTimestamps(), "Archive timestamps not in chronological order")
+}
+
 func TestVerifyInValidSig(t *testing.T) {
 	conf := parseConfiguration(t)
 
@@ -360,6 +554,164 @@ func TestEmptySignature(t *testing.T) {
 	require.NotEqual(t, ProofStatusValid, status)
 }
 
+func TestSignedFile(t *testing.T) {
+	file, err := NewSignedFile("contract.pdf", "application/pdf", strings.NewReader("contents"))
+	require.NoError(t, err)
+	require.NoError(t, file.Validate())
+	require.Equal(t, int64(8), file.Size)
+
+	match, err := file.Matches(strings.NewReader("contents"))
+	require.NoError(t, err)
+	require.True(t, match)
+	match, err = file.Matches(strings.NewReader("other contents"))
+	require.NoError(t, err)
+	require.False(t, match)
+
+	request := &SignatureRequest{
+		DisclosureRequest: DisclosureRequest{
+			BaseRequest: BaseRequest{Type: ActionSigning, Nonce: big.NewInt(1), Context: big.NewInt(1)},
+			Content: AttributeDisjunctionList{{
+				Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+			}},
+		},
+		File: file,
+	}
+	require.NoError(t, request.Validate())
+
+	// The file metadata is bound to the signature
+	renamed := *file
+	renamed.Name = "other.pdf"
+	other := *request
+	other.File = &renamed
+	require.NotEqual(t, request.GetNonce(), other.GetNonce())
+
+	request.Message = "message"
+	require.Error(t, request.Validate())
+	request.Message = ""
+	request.File = &SignedFile{Digest: "abcd"}
+	require.Error(t, request.Validate())
+
+	sm := &SignedMessage{File: file}
+	require.NoError(t, sm.VerifyFile(strings.NewReader("contents")))
+	require.Error(t, sm.VerifyFile(strings.NewReader("other contents")))
+
+	// Signatures over both a message and a file are rejected
+	sm.Message = "message"
+	_, status, err := sm.Verify(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusInvalid, status)
+}
+
+func TestAttributePassport(t *testing.T) {
+	attr := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request, err := NewAttributePassportRequest([]AttributeTypeIdentifier{attr}, "example.com", "application")
+	require.NoError(t, err)
+	require.NoError(t, request.Validate())
+	require.Len(t, request.Content, 1)
+
+	signature := &SignedMessage{Message: request.Message, Nonce: request.Nonce, Context: request.Context}
+	passport, err := NewAttributePassport(signature)
+	require.NoError(t, err)
+	require.Equal(t, "example.com", passport.Recipient)
+	require.Equal(t, "application", passport.Note)
+
+	// Passports without timestamp are rejected
+	_, status, err := passport.Verify(nil)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusInvalidTimestamp, status)
+
+	// Passports whose statement does not match the signed message are rejected
+	signature.Timestamp = &atum.Timestamp{}
+	passport.Recipient = "attacker.example.com"
+	_, status, err = passport.Verify(nil)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusUnmatchedRequest, status)
+
+	_, err = NewAttributePassport(&SignedMessage{Message: "I owe you everything"})
+	require.Error(t, err)
+}
+
+func TestDisclosureRecipients(t *testing.T) {
+	request := &DisclosureRequest{
+		BaseRequest: BaseRequest{Type: ActionDisclosing, Nonce: big.NewInt(1), Context: big.NewInt(1)},
+		Content: AttributeDisjunctionList{{
+			Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+		Recipients: []*DisclosureRecipient{
+			{Name: "notary", Nonce: big.NewInt(2)},
+			{Name: "counterparty", Nonce: big.NewInt(3)},
+		},
+	}
+	require.NoError(t, request.Validate())
+	require.NotEqual(t, request.Nonce, request.GetNonce())
+
+	transcripts := request.Transcripts(&Disclosure{})
+	require.Len(t, transcripts, 2)
+	require.Equal(t, "counterparty", transcripts[1].Recipient)
+
+	// A transcript does not verify against the nonce of another recipient
+	_, status, err := transcripts[1].Verify(&Configuration{}, big.NewInt(2))
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusUnmatchedRequest, status)
+
+	request.Recipients[1].Name = "notary"
+	require.Error(t, request.Validate())
+}
+
+func TestRequestorInfo(t *testing.T) {
+	requestor := &RequestorInfo{
+		ID:      "example",
+		Domains: []string{"example.com", "*.example.org"},
+		AllowedAttributes: []AttributeTypeIdentifier{
+			NewAttributeTypeIdentifier("irma-demo.RU.studentCard"),
+			NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over18"),
+		},
+	}
+	require.True(t, requestor.MatchesHost("example.com"))
+	require.True(t, requestor.MatchesHost("www.Example.org"))
+	require.False(t, requestor.MatchesHost("www.example.com"))
+	require.False(t, requestor.MatchesHost("example.org.evil.com"))
+
+	// Exact domains take precedence over wildcard domains, regardless of map iteration order
+	conf := &Configuration{Requestors: map[string]*RequestorInfo{
+		"a.wildcard": {ID: "wildcard", Domains: []string{"*.example.org"}},
+		"b.example":  requestor,
+		"c.exact":    {ID: "exact", Domains: []string{"www.example.org"}},
+		"d.nested":   {ID: "nested", Domains: []string{"*.www.example.org"}},
+	}}
+	for i := 0; i < 10; i++ {
+		require.Equal(t, "exact", conf.RequestorForHost("www.example.org").ID)
+		// Ties are broken by scheme and requestor ID
+		require.Equal(t, "wildcard", conf.RequestorForHost("mail.example.org").ID)
+		require.Equal(t, "nested", conf.RequestorForHost("a.www.example.org").ID)
+	}
+	require.Nil(t, conf.RequestorForHost("example.net"))
+	require.Nil(t, conf.RequestorForHost(""))
+
+	violations := requestor.Violations(AttributeDisjunctionList{
+		{Attributes: []AttributeTypeIdentifier{
+			NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+			NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over18"),
+		}},
+		{Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over21")}},
+	})
+	require.Equal(t, []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over21")}, violations)
+}
+
+func TestIssuanceSources(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	sources := conf.IssuanceSources(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.Len(t, sources, 1)
+	require.Equal(t, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), sources[0].CredentialType.Identifier())
+	require.Equal(t, NewIssuerIdentifier("irma-demo.RU"), sources[0].Issuer.Identifier())
+
+	sources = conf.IssuanceSources(NewAttributeTypeIdentifier("irma-demo.RU.studentCard"))
+	require.Len(t, sources, 1)
+
+	require.Empty(t, conf.IssuanceSources(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.nonexisting")))
+}
+
 // Test attribute decoding with both old and new metadata versions
 func TestAttributeDecoding(t *testing.T) {
 	expected := "male"
@@ -372,3 +724,760 @@ func TestAttributeDecoding(t *testing.T) {
 	oldString := decodeAttribute(oldAttribute, 2)
 	require.Equal(t, *oldString, expected)
 }
+
+func TestSignedMessageDigest(t *testing.T) {
+	signature := &SignedMessage{Message: "message", Nonce: big.NewInt(1), Context: big.NewInt(1), Timestamp: &atum.Timestamp{}}
+	digest, err := signature.Digest()
+	require.NoError(t, err)
+	require.Len(t, digest, 64)
+
+	// Archive timestamps do not change the digest, but the message does
+	signature.ArchiveTimestamps = []*atum.Timestamp{{}}
+	archived, err := signature.Digest()
+	require.NoError(t, err)
+	require.Equal(t, digest, archived)
+
+	// Attestations issued by earlier versions refer to the signature by its legacy digest
+	legacy, err := signature.LegacyDigest()
+	require.NoError(t, err)
+	require.NotEqual(t, digest, legacy)
+	for _, d := range []string{digest, legacy} {
+		matches, err := signature.MatchesDigest(d)
+		require.NoError(t, err)
+		require.True(t, matches)
+	}
+
+	signature.Message = "other message"
+	other, err := signature.Digest()
+	require.NoError(t, err)
+	require.NotEqual(t, digest, other)
+	matches, err := signature.MatchesDigest(digest)
+	require.NoError(t, err)
+	require.False(t, matches)
+
+	require.NoError(t, (&AttestationRequest{Signature: signature}).Validate())
+	signature.Timestamp = nil
+	require.Error(t, (&AttestationRequest{Signature: signature}).Validate())
+}
+
+func TestDisclosureToken(t *testing.T) {
+	now := time.Now()
+	request := &DisclosureRequest{
+		BaseRequest: BaseRequest{Type: ActionDisclosing, Nonce: big.NewInt(1), Context: big.NewInt(1)},
+		Content: AttributeDisjunctionList{{
+			Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+		Window: &DisclosureWindow{
+			NotBefore: Timestamp(now.Add(-time.Hour)),
+			NotAfter:  Timestamp(now.Add(time.Hour)),
+		},
+	}
+	require.NoError(t, request.Validate())
+	nonce := request.GetNonce()
+	require.NotEqual(t, request.Nonce, nonce)
+
+	// The window is bound to the nonce over which the proofs are computed
+	bts, err := json.Marshal(request.Token(&Disclosure{}))
+	require.NoError(t, err)
+	token := &DisclosureToken{}
+	require.NoError(t, json.Unmarshal(bts, token))
+	token.Window.NotAfter = Timestamp(now.Add(2 * time.Hour))
+	_, status, err := token.Verify(&Configuration{}, request)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusUnmatchedRequest, status)
+	require.NotEqual(t, nonce, (&DisclosureRequest{BaseRequest: request.BaseRequest, Window: token.Window}).GetNonce())
+
+	// Tokens cannot be verified after the window has ended
+	request.Window.NotAfter = Timestamp(now.Add(-time.Minute))
+	_, status, err = request.Token(&Disclosure{}).Verify(&Configuration{}, request)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusOutsideWindow, status)
+
+	request.Window.NotAfter = request.Window.NotBefore
+	require.Error(t, request.Validate())
+}
+
+func TestCheckURL(t *testing.T) {
+	manager := &SchemeManager{}
+	require.NoError(t, xml.Unmarshal([]byte(`<SchemeManager version="7"><InsecureHosts><Host>dev.example.com</Host></InsecureHosts></SchemeManager>`), manager))
+	require.Equal(t, []string{"dev.example.com"}, manager.InsecureHosts)
+
+	require.NoError(t, manager.CheckURL("https://example.com/scheme"))
+	require.NoError(t, manager.CheckURL("http://localhost:8080/scheme"))
+	require.NoError(t, manager.CheckURL("http://127.0.0.1/scheme"))
+	require.NoError(t, manager.CheckURL("http://Dev.example.com/scheme"))
+	require.IsType(t, &InsecureURLError{}, manager.CheckURL("http://example.com/scheme"))
+	require.IsType(t, &InsecureURLError{}, manager.CheckURL("ftp://dev.example.com/scheme"))
+
+	// In sessions, hosts are exempted only by the valid scheme listing the requestor of the host
+	other := &SchemeManager{ID: "other", Valid: true}
+	conf := &Configuration{
+		SchemeManagers: map[SchemeManagerIdentifier]*SchemeManager{
+			NewSchemeManagerIdentifier("dev"):   manager,
+			NewSchemeManagerIdentifier("other"): other,
+		},
+		Requestors: map[string]*RequestorInfo{},
+	}
+	require.Error(t, conf.CheckSessionURL("http://dev.example.com/irma"))
+	conf.Requestors["other.dev"] = &RequestorInfo{ID: "dev", Domains: []string{"dev.example.com"}, Scheme: other.Identifier()}
+	manager.Valid = true
+	require.Error(t, conf.CheckSessionURL("http://dev.example.com/irma"))
+	other.InsecureHosts = []string{"dev.example.com"}
+	require.NoError(t, conf.CheckSessionURL("http://dev.example.com/irma"))
+	other.Valid = false
+	require.Error(t, conf.CheckSessionURL("http://dev.example.com/irma"))
+	require.NoError(t, conf.CheckSessionURL("http://localhost/irma"))
+
+	_, err := DownloadSchemeManager("http://example.com/scheme")
+	require.IsType(t, &InsecureURLError{}, err)
+}
+
+func TestUnknownKeyshareKey(t *testing.T) {
+	conf := parseConfiguration(t)
+	scheme := NewSchemeManagerIdentifier("test")
+
+	pk, err := conf.KeyshareServerPublicKey(scheme, 0)
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+	require.Contains(t, conf.kssPublicKeys, scheme)
+
+	_, err = conf.KeyshareServerPublicKey(scheme, 1)
+	require.IsType(t, &UnknownKeyshareKeyError{}, err)
+	require.Equal(t, 1, err.(*UnknownKeyshareKeyError).Index)
+}
+
+func TestRemoteErrorMessage(t *testing.T) {
+	conf := parseConfiguration(t)
+	manager := conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+	require.NoError(t, xml.Unmarshal([]byte(`<SchemeManager><ErrorMessages>
+		<Message key="SESSION_UNKNOWN"><en>This session has expired</en><nl>Deze sessie is verlopen</nl></Message>
+		<Message key="custom.key"><en>Something custom</en></Message>
+	</ErrorMessages></SchemeManager>`), manager))
+	require.Len(t, manager.ErrorMessages, 2)
+
+	msg, ok := conf.RemoteErrorMessage(&RemoteError{ErrorName: "SESSION_UNKNOWN", Description: "Unknown or expired session"}, manager.Identifier(), "nl")
+	require.True(t, ok)
+	require.Equal(t, "Deze sessie is verlopen", msg)
+	msg, ok = conf.RemoteErrorMessage(&RemoteError{ErrorName: "custom.key"}, manager.Identifier(), "nl")
+	require.True(t, ok)
+	require.Equal(t, "Something custom", msg)
+	_, ok = conf.RemoteErrorMessage(&RemoteError{ErrorName: "EXCEPTION"}, manager.Identifier(), "en")
+	require.False(t, ok)
+
+	// Other schemes do not translate the errors of the servers of the scheme
+	_, ok = conf.RemoteErrorMessage(&RemoteError{ErrorName: "SESSION_UNKNOWN"}, NewSchemeManagerIdentifier("test"), "en")
+	require.False(t, ok)
+
+	manager.Valid = false
+	defer func() { manager.Valid = true }()
+	_, ok = conf.RemoteErrorMessage(&RemoteError{ErrorName: "SESSION_UNKNOWN"}, manager.Identifier(), "en")
+	require.False(t, ok)
+}
+
+func TestAttributeDisplayOrder(t *testing.T) {
+	credtype := &CredentialType{}
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4">
+		<DisplayGroups><Group id="address"><Name><en>Address</en></Name></Group></DisplayGroups>
+		<Attributes>
+			<Attribute id="city" displayIndex="2" displayGroup="address"></Attribute>
+			<Attribute id="name" displayIndex="0" important="true"></Attribute>
+			<Attribute id="street" displayIndex="1" displayGroup="address"></Attribute>
+		</Attributes>
+	</IssueSpecification>`), credtype))
+
+	order := credtype.DisplayOrder()
+	require.Len(t, order, 3)
+	require.Equal(t, "name", order[0].ID)
+	require.Equal(t, "street", order[1].ID)
+	require.Equal(t, "city", order[2].ID)
+	require.True(t, order[0].Important)
+	require.Equal(t, "Address", credtype.DisplayGroup(order[1].DisplayGroup).Name["en"])
+	require.Nil(t, credtype.DisplayGroup(order[0].DisplayGroup))
+
+	// Without displayIndex the XML order is used
+	conf := parseConfiguration(t)
+	info, err := (&CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		Attributes:       map[string]string{"university": "Radboud", "studentCardNumber": "1", "studentID": "s1", "level": "42"},
+	}).Info(conf, 0x03)
+	require.NoError(t, err)
+	attrtypes := conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")].AttributeTypes
+	require.Len(t, info.DisplayAttributes, len(attrtypes))
+	for i, attr := range info.DisplayAttributes {
+		require.Equal(t, attrtypes[i].GetAttributeTypeIdentifier(), attr.Type)
+		require.Equal(t, info.Attributes[attr.Type], attr.Value)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	conf := parseConfiguration(t)
+	vectors, err := testvectors.Load("testdata/testvectors")
+	require.NoError(t, err)
+
+	for _, vector := range vectors.Requests {
+		var request SessionRequest
+		switch Action(vector.Type) {
+		case ActionDisclosing:
+			request = &DisclosureRequest{}
+		case ActionSigning:
+			request = &SignatureRequest{}
+		case ActionIssuing:
+			request = &IssuanceRequest{}
+		default:
+			require.Fail(t, "unknown request type", vector.Name)
+		}
+		err = UnmarshalValidate(vector.Request, request)
+		require.Equal(t, vector.Valid, err == nil, vector.Name)
+	}
+
+	for _, vector := range vectors.Metadata {
+		attr := MetadataFromInt(s2big(vector.Value), conf)
+		require.NotNil(t, attr.CredentialType(), vector.Name)
+		require.Equal(t, NewCredentialTypeIdentifier(vector.CredentialType), attr.CredentialType().Identifier(), vector.Name)
+		require.Equal(t, vector.Version, attr.Version(), vector.Name)
+		require.Equal(t, time.Unix(vector.SigningDate, 0), attr.SigningDate(), vector.Name)
+		require.Equal(t, time.Unix(vector.Expiry, 0), attr.Expiry(), vector.Name)
+		require.Equal(t, vector.KeyCounter, attr.KeyCounter(), vector.Name)
+	}
+
+	for _, vector := range vectors.Attributes {
+		require.Equal(t, vector.Decoded, decodeAttribute(s2big(vector.Value), vector.MetadataVersion), vector.Name)
+	}
+}
+
+func TestDisclosureVectors(t *testing.T) {
+	conf := parseConfiguration(t)
+	vectors, err := testvectors.Load("testdata/testvectors")
+	require.NoError(t, err)
+	require.NotEmpty(t, vectors.Disclosures)
+
+	for _, vector := range vectors.Disclosures {
+		var request SessionRequest
+		disclosure := &Disclosure{}
+		switch Action(vector.Type) {
+		case ActionDisclosing:
+			request = &DisclosureRequest{}
+			require.NoError(t, json.Unmarshal(vector.Message, disclosure), vector.Name)
+		case ActionIssuing:
+			request = &IssuanceRequest{}
+			commitments := &IssueCommitmentMessage{}
+			require.NoError(t, json.Unmarshal(vector.Message, commitments), vector.Name)
+			disclosure = commitments.Disclosure()
+		default:
+			require.Fail(t, "unknown request type", vector.Name)
+		}
+		require.NoError(t, UnmarshalValidate(vector.Request, request), vector.Name)
+
+		attrs, err := disclosure.ResolveIndices(conf, request)
+		if vector.Resolved == nil {
+			require.Error(t, err, vector.Name)
+			continue
+		}
+		require.NoError(t, err, vector.Name)
+		require.Len(t, attrs, len(vector.Resolved), vector.Name)
+		for i, expected := range vector.Resolved {
+			require.Equal(t, NewAttributeTypeIdentifier(expected.ID), attrs[i].Identifier, vector.Name)
+			require.Equal(t, expected.Value, attrs[i].RawValue, vector.Name)
+			require.Equal(t, AttributeProofStatus(expected.Status), attrs[i].Status, vector.Name)
+		}
+	}
+}
+
+func TestSignatureVectors(t *testing.T) {
+	conf := parseConfiguration(t)
+	vectors, err := testvectors.Load("testdata/testvectors")
+	require.NoError(t, err)
+
+	for _, vector := range vectors.Signatures {
+		msg := &SignedMessage{}
+		require.NoError(t, json.Unmarshal(vector.Message, msg), vector.Name)
+		var request *SignatureRequest
+		if vector.Request != nil {
+			request = &SignatureRequest{}
+			require.NoError(t, json.Unmarshal(vector.Request, request), vector.Name)
+		}
+		attrs, status, err := msg.Verify(conf, request)
+		require.NoError(t, err, vector.Name)
+		require.Equal(t, ProofStatus(vector.Status), status, vector.Name)
+		for id, value := range vector.Disclosed {
+			found := false
+			for _, attr := range attrs {
+				if attr.Identifier == NewAttributeTypeIdentifier(id) {
+					require.Equal(t, value, attr.Value["en"], vector.Name)
+					found = true
+				}
+			}
+			require.True(t, found, vector.Name)
+		}
+	}
+}
+
+func TestNonceStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noncestore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bolt, err := NewBoltNonceStore(filepath.Join(dir, "nonces.db"))
+	require.NoError(t, err)
+
+	for _, store := range []NonceStore{NewMemoryNonceStore(), bolt} {
+		expiry := time.Now().Add(time.Hour)
+		fresh, err := store.Use(big.NewInt(1), big.NewInt(42), expiry)
+		require.NoError(t, err)
+		require.True(t, fresh)
+		fresh, err = store.Use(big.NewInt(1), big.NewInt(42), expiry)
+		require.NoError(t, err)
+		require.False(t, fresh)
+		fresh, err = store.Use(big.NewInt(2), big.NewInt(42), expiry)
+		require.NoError(t, err)
+		require.True(t, fresh)
+
+		// Expired nonces are forgotten
+		fresh, err = store.Use(nil, big.NewInt(43), time.Now().Add(-time.Second))
+		require.NoError(t, err)
+		require.True(t, fresh)
+		fresh, err = store.Use(nil, big.NewInt(43), expiry)
+		require.NoError(t, err)
+		require.True(t, fresh)
+
+		// Only the nonces of valid proofs are registered
+		status, err := useNonce(store, big.NewInt(3), big.NewInt(42), expiry, ProofStatusInvalid)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusInvalid, status)
+		status, err = useNonce(store, big.NewInt(3), big.NewInt(42), expiry, ProofStatusValid)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusValid, status)
+		status, err = useNonce(store, big.NewInt(3), big.NewInt(42), expiry, ProofStatusValid)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusReplayed, status)
+	}
+
+	// The bolt store persists the nonces
+	require.NoError(t, bolt.Close())
+	bolt, err = NewBoltNonceStore(filepath.Join(dir, "nonces.db"))
+	require.NoError(t, err)
+	defer bolt.Close()
+	fresh, err := bolt.Use(big.NewInt(1), big.NewInt(42), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.False(t, fresh)
+}
+
+// testCredential returns a credential with four attributes, issued using the private key in the testdata.
+func testCredential(t require.TestingT) (*gabi.Credential, *gabi.PublicKey) {
+	conf, err := NewConfiguration("testdata/irma_configuration")
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	pk, err := conf.PublicKey(NewIssuerIdentifier("irma-demo.RU"), 2)
+	require.NoError(t, err)
+	sk, err := gabi.NewPrivateKeyFromFile("testdata/irma_configuration/irma-demo/RU/PrivateKeys/2.xml")
+	require.NoError(t, err)
+
+	context, nonce1, nonce2, secret := big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(42)
+	attrs := []*big.Int{new(big.Int).SetBytes(NewMetadataAttribute(0x03).Bytes()),
+		big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4)}
+	builder := gabi.NewCredentialBuilder(pk, context, secret, nonce2)
+	commitment := builder.CommitToSecretAndProve(nonce1)
+	sig, err := gabi.NewIssuer(sk, pk, context).IssueSignature(commitment.U, attrs, nonce2)
+	require.NoError(t, err)
+	cred, err := builder.ConstructCredential(sig, attrs)
+	require.NoError(t, err)
+	return cred, pk
+}
+
+func TestConcurrentProofVerification(t *testing.T) {
+	cred1, pk := testCredential(t)
+	cred2, _ := testCredential(t)
+	context, nonce := big.NewInt(1), big.NewInt(2)
+	keyshareServers := []string{".", "."}
+	pks := []*gabi.PublicKey{pk, pk}
+	pool := NewProofVerificationPool(2)
+
+	for _, issig := range []bool{false, true} {
+		builders := gabi.ProofBuilderList{
+			cred1.CreateDisclosureProofBuilder([]int{1}),
+			cred2.CreateDisclosureProofBuilder([]int{2, 3}),
+		}
+		proofs := ProofList(builders.BuildProofList(context, nonce, issig))
+		require.True(t, gabi.ProofList(proofs).Verify(pks, context, nonce, issig, keyshareServers))
+		require.True(t, pool.verify(proofs, pks, context, nonce, issig, keyshareServers))
+		require.False(t, pool.verify(proofs, pks, context, big.NewInt(3), issig, keyshareServers))
+		require.False(t, pool.verify(proofs, pks, context, nonce, !issig, keyshareServers))
+
+		// Proof lists verified at the same time share the workers of the pool
+		results := make(chan bool)
+		for i := 0; i < 8; i++ {
+			go func(i int) {
+				n := nonce
+				if i%2 == 1 {
+					n = big.NewInt(3)
+				}
+				results <- pool.verify(proofs, pks, context, n, issig, keyshareServers) == (i%2 == 0)
+			}(i)
+		}
+		for i := 0; i < 8; i++ {
+			require.True(t, <-results)
+		}
+		require.Empty(t, pool.workers)
+
+		// Proofs that should share their secret key but don't
+		proofs[1].(*gabi.ProofD).AResponses[0] = big.NewInt(1)
+		require.False(t, pool.verify(proofs, pks, context, nonce, issig, keyshareServers))
+	}
+}
+
+type recordingTracer struct {
+	spans []*recordedSpan
+	sync.Mutex
+}
+
+type recordedSpan struct {
+	name       string
+	attributes map[string]string
+	ended      bool
+	err        error
+}
+
+func (t *recordingTracer) StartSpan(name string) Span {
+	t.Lock()
+	defer t.Unlock()
+	span := &recordedSpan{name: name, attributes: map[string]string{}}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func (s *recordedSpan) SetAttribute(key, value string) { s.attributes[key] = value }
+func (s *recordedSpan) End(err error)                  { s.ended, s.err = true, err }
+
+func TestIssueCommitmentCredentialIDs(t *testing.T) {
+	request := &IssuanceRequest{Credentials: []*CredentialRequest{
+		{CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard")},
+		{CredentialTypeID: NewCredentialTypeIdentifier("test.test.email")},
+	}}
+
+	ids, err := (&IssueCommitmentMessage{}).CredentialIndices(request)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, ids)
+	ids, err = (&IssueCommitmentMessage{CredentialIDs: []int{1, 0}}).CredentialIndices(request)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 0}, ids)
+
+	for _, invalid := range [][]int{{}, {0}, {0, 0}, {0, 2}, {-1, 0}, {0, 1, 2}} {
+		_, err = (&IssueCommitmentMessage{CredentialIDs: invalid}).CredentialIndices(request)
+		require.Error(t, err)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	parseConfiguration(t)
+	require.Len(t, tracer.spans, 1)
+	span := tracer.spans[0]
+	require.Equal(t, "irma.Configuration.ParseFolder", span.name)
+	require.Equal(t, "testdata/irma_configuration", span.attributes["path"])
+	require.True(t, span.ended)
+	require.NoError(t, span.err)
+
+	conf, err := NewConfigurationReadOnly("testdata/irma_configuration_invalid")
+	require.NoError(t, err)
+	require.Error(t, conf.ParseFolder())
+	require.Len(t, tracer.spans, 2)
+	require.True(t, tracer.spans[1].ended)
+	require.Error(t, tracer.spans[1].err)
+
+	SetTracer(nil)
+	parseConfiguration(t)
+	require.Len(t, tracer.spans, 2)
+}
+
+func TestResolveIndices(t *testing.T) {
+	conf := parseConfiguration(t)
+	pk, err := conf.PublicKey(NewIssuerIdentifier("irma-demo.RU"), 2)
+	require.NoError(t, err)
+	sk, err := gabi.NewPrivateKeyFromFile("testdata/irma_configuration/irma-demo/RU/PrivateKeys/2.xml")
+	require.NoError(t, err)
+
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	list, err := (&CredentialRequest{
+		CredentialTypeID: credid,
+		KeyCounter:       2,
+		Attributes: map[string]string{
+			"university": "Radboud", "studentCardNumber": "31415927", "studentID": "s1234567", "level": "high",
+		},
+	}).AttributeList(conf, 0x03)
+	require.NoError(t, err)
+
+	context, nonce := big.NewInt(1), big.NewInt(2)
+	builder := gabi.NewCredentialBuilder(pk, context, big.NewInt(42), big.NewInt(3))
+	commitment := builder.CommitToSecretAndProve(big.NewInt(4))
+	sig, err := gabi.NewIssuer(sk, pk, context).IssueSignature(commitment.U, list.Ints, big.NewInt(3))
+	require.NoError(t, err)
+	cred, err := builder.ConstructCredential(sig, list.Ints)
+	require.NoError(t, err)
+
+	university := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	level := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	low := "low"
+	request := &DisclosureRequest{Content: AttributeDisjunctionList{
+		{Label: "University", Attributes: []AttributeTypeIdentifier{university}},
+		{Label: "Level", Attributes: []AttributeTypeIdentifier{level}, Values: map[AttributeTypeIdentifier]*string{level: &low}},
+	}}
+	disclosure := &Disclosure{
+		Proofs: gabi.ProofList{cred.CreateDisclosureProof([]int{1, 2, 5}, context, nonce)},
+		Indices: DisclosedAttributeIndices{
+			{{CredentialIndex: 0, AttributeIndex: 2}},
+			{{CredentialIndex: 0, AttributeIndex: 5}},
+		},
+	}
+
+	attrs, err := disclosure.ResolveIndices(conf, request)
+	require.NoError(t, err)
+	require.Len(t, attrs, 2)
+	require.Equal(t, university, attrs[0].Identifier)
+	require.Equal(t, "Radboud", *attrs[0].RawValue)
+	require.Equal(t, AttributeProofStatusPresent, attrs[0].Status)
+	require.Equal(t, level, attrs[1].Identifier)
+	require.Equal(t, "high", *attrs[1].RawValue)
+	require.Equal(t, AttributeProofStatusInvalidValue, attrs[1].Status)
+
+	// Indices pointing to the wrong, undisclosed or nonexisting attributes are rejected
+	for i, indices := range []DisclosedAttributeIndices{
+		{{{CredentialIndex: 0, AttributeIndex: 2}}, {{CredentialIndex: 0, AttributeIndex: 3}}},
+		{{{CredentialIndex: 0, AttributeIndex: 2}}, {{CredentialIndex: 1, AttributeIndex: 5}}},
+		{{{CredentialIndex: 0, AttributeIndex: 2}}, {{CredentialIndex: 0, AttributeIndex: 0}}},
+		{{{CredentialIndex: 0, AttributeIndex: 2}}, {}},
+		{{{CredentialIndex: 0, AttributeIndex: 2}}},
+		{{{CredentialIndex: 0, AttributeIndex: 5}}, {{CredentialIndex: 0, AttributeIndex: 2}}},
+	} {
+		disclosure.Indices = indices
+		_, err = disclosure.ResolveIndices(conf, request)
+		require.Error(t, err)
+		if i < 5 { // DisclosedAttributes marks the attributes of the last one as missing instead
+			_, _, err = disclosure.DisclosedAttributes(conf, request.Content)
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestSignedClientSessionRequest(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	key, err := MarshalRequestKey(&sk.PublicKey)
+	require.NoError(t, err)
+	pk, err := ParseRequestKey(key)
+	require.NoError(t, err)
+	require.NoError(t, (&Qr{URL: "https://example.com/irma/session", Type: ActionDisclosing, RequestKey: key}).Validate())
+	require.Error(t, (&Qr{URL: "https://example.com/irma/session", Type: ActionDisclosing, RequestKey: "foo"}).Validate())
+
+	request := &DisclosureRequest{
+		BaseRequest: BaseRequest{Type: ActionDisclosing, Nonce: big.NewInt(42), Context: big.NewInt(1)},
+		Content: AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+	}
+	token, err := SignClientSessionRequest(request, "session", sk)
+	require.NoError(t, err)
+
+	parsed := &DisclosureRequest{}
+	require.NoError(t, ParseClientSessionRequest(token, "session", pk, parsed))
+	require.Equal(t, request.Nonce, parsed.Nonce)
+	require.Equal(t, request.Content[0].Attributes, parsed.Content[0].Attributes)
+
+	// Signed for another session, or by another key
+	require.Error(t, ParseClientSessionRequest(token, "othersession", pk, &DisclosureRequest{}))
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.Error(t, ParseClientSessionRequest(token, "session", &other.PublicKey, &DisclosureRequest{}))
+}
+
+func TestCredentialInfoListOrder(t *testing.T) {
+	conf := &Configuration{
+		SchemeManagers: map[SchemeManagerIdentifier]*SchemeManager{
+			NewSchemeManagerIdentifier("s"): {Name: TranslatedString{"en": "Scheme"}},
+		},
+		Issuers: map[IssuerIdentifier]*Issuer{
+			NewIssuerIdentifier("s.a"): {Name: TranslatedString{"en": "Ärzte"}},
+			NewIssuerIdentifier("s.b"): {Name: TranslatedString{"en": "Zahnärzte"}},
+		},
+		CredentialTypes: map[CredentialTypeIdentifier]*CredentialType{},
+	}
+	old := &CredentialInfo{SchemeManagerID: "s", IssuerID: "a", ID: "c", SignedOn: Timestamp(time.Unix(1, 0)), Hash: "1"}
+	recent := &CredentialInfo{SchemeManagerID: "s", IssuerID: "a", ID: "c", SignedOn: Timestamp(time.Unix(2, 0)), Hash: "2"}
+	other := &CredentialInfo{SchemeManagerID: "s", IssuerID: "b", ID: "c", SignedOn: Timestamp(time.Unix(3, 0)), Hash: "3"}
+
+	// By default, by identifiers and then newest first
+	list := CredentialInfoList{other, old, recent}
+	sort.Sort(list)
+	require.Equal(t, CredentialInfoList{recent, old, other}, list)
+
+	// In German, Ä is collated as A, while in Swedish it comes after Z
+	list = CredentialInfoList{other, old, recent}
+	list.SortLocalized(conf, "de")
+	require.Equal(t, CredentialInfoList{recent, old, other}, list)
+	list.SortLocalized(conf, "sv")
+	require.Equal(t, CredentialInfoList{other, recent, old}, list)
+}
+
+func TestDerivedAttributes(t *testing.T) {
+	conf := parseConfiguration(t)
+	id := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	credtype := conf.CredentialTypes[id]
+	credtype.AttributeTypes = append(credtype.AttributeTypes,
+		&AttributeType{ID: "dateofbirth", Optional: "true"},
+		&AttributeType{ID: "over18", DerivedFrom: "dateofbirth", Derivation: "ageAtLeast:18"},
+		&AttributeType{ID: "yearofbirth", Optional: "true", DerivedFrom: "dateofbirth", Derivation: "year"},
+	)
+	require.NoError(t, conf.checkAttributes(credtype))
+
+	attrs := map[string]string{"university": "Radboud", "studentCardNumber": "31415927", "studentID": "s1234567", "level": "42"}
+	request := func(extra map[string]string) *CredentialRequest {
+		cr := &CredentialRequest{CredentialTypeID: id, Attributes: map[string]string{}}
+		for k, v := range attrs {
+			cr.Attributes[k] = v
+		}
+		for k, v := range extra {
+			cr.Attributes[k] = v
+		}
+		return cr
+	}
+
+	cr := request(map[string]string{"dateofbirth": "01-04-1990"})
+	require.NoError(t, cr.Validate(conf))
+	require.NoError(t, cr.DeriveAttributes(conf))
+	require.Equal(t, "Yes", cr.Attributes["over18"])
+	require.Equal(t, "1990", cr.Attributes["yearofbirth"])
+
+	birth := time.Now().AddDate(-10, 0, 0).Format("2006-01-02")
+	cr = request(map[string]string{"dateofbirth": birth})
+	require.NoError(t, cr.DeriveAttributes(conf))
+	require.Equal(t, "No", cr.Attributes["over18"])
+
+	// Supplied derived attributes must be consistent
+	cr = request(map[string]string{"dateofbirth": birth, "over18": "Yes"})
+	require.Error(t, cr.DeriveAttributes(conf))
+	cr = request(map[string]string{"dateofbirth": "1990"})
+	require.Error(t, cr.DeriveAttributes(conf))
+
+	// Required derived attributes cannot be computed without the attribute they are derived from
+	cr = request(nil)
+	require.Error(t, cr.Validate(conf))
+
+	// Invalid declarations of derived attributes
+	credtype.AttributeTypes[len(credtype.AttributeTypes)-1].Derivation = "nonexisting"
+	require.Error(t, conf.checkAttributes(credtype))
+	credtype.AttributeTypes[len(credtype.AttributeTypes)-1].DerivedFrom = "over18"
+	require.Error(t, conf.checkAttributes(credtype))
+}
+
+func TestQrSize(t *testing.T) {
+	require.Equal(t, 1, QrVersion(17, QrLevelL))
+	require.Equal(t, 2, QrVersion(18, QrLevelL))
+	require.Equal(t, 40, QrVersion(1273, QrLevelH))
+	require.Equal(t, 0, QrVersion(1274, QrLevelH))
+
+	qr := &Qr{URL: "https://example.com/irma/session/" + strings.Repeat("a", 20), Type: ActionDisclosing}
+	version, err := CheckQrSize(qr, QrLevelL)
+	require.NoError(t, err)
+	require.True(t, version <= 5)
+
+	request := &DisclosureRequest{BaseRequest: BaseRequest{Type: ActionDisclosing}}
+	for i := 0; i < 20; i++ {
+		request.Content = append(request.Content, &AttributeDisjunction{
+			Label:      "Name",
+			Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")},
+		})
+	}
+	version, err = CheckQrSize(request, QrLevelL)
+	require.IsType(t, &QrTooLargeError{}, err)
+	require.True(t, version > MaxScannableQrVersion)
+}
+
+func TestTranslate(t *testing.T) {
+	ts := TranslatedString{"en": "Hello", "nl": "Hallo", "de": "Guten Tag"}
+	require.Equal(t, Translation{Text: "Hallo", Language: "nl"}, ts.Translate("nl"))
+	require.Equal(t, Translation{Text: "Hallo", Language: "nl", Fallback: true}, ts.Translate("nl-BE"))
+	require.Equal(t, Translation{Text: "Hello", Language: "en", Fallback: true}, ts.Translate("fr"))
+	require.Equal(t, Translation{Text: "Guten Tag", Language: "de", Fallback: true}, TranslatedString{"fr": "Bonjour", "de": "Guten Tag"}.Translate("nl"))
+	require.Equal(t, Translation{Language: "nl"}, TranslatedString{}.Translate("nl"))
+	require.Equal(t, "Hello", ts.translation("fr"))
+}
+
+func TestMissingTranslations(t *testing.T) {
+	conf := parseConfiguration(t)
+	id := NewSchemeManagerIdentifier("irma-demo")
+	missing, err := conf.MissingTranslations(id)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]MissingTranslation{"en": {}, "nl": {}}, missing)
+
+	credtype := conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")]
+	delete(credtype.Name, "nl")
+	credtype.AttributeTypes[0].Description["de"] = "Universität"
+	missing, err = conf.MissingTranslations(id)
+	require.NoError(t, err)
+	require.Equal(t, []MissingTranslation{{Object: "Credential type irma-demo.RU.studentCard", Field: "Name"}}, missing["nl"])
+	require.Empty(t, missing["en"])
+	require.NotEmpty(t, missing["de"])
+	require.Contains(t, missing["de"], MissingTranslation{Object: "Credential type irma-demo.RU.studentCard", Field: "Name"})
+
+	missing, err = conf.MissingTranslations(id, "en")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]MissingTranslation{"en": {}}, missing)
+
+	_, err = conf.MissingTranslations(NewSchemeManagerIdentifier("nonexisting"))
+	require.Error(t, err)
+}
+
+func TestMissingTranslationsUnsigned(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// A scheme that is edited after it was signed
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	description := filepath.Join(path, "irma-demo", "RU", "Issues", "studentCard", "description.xml")
+	bts, err := ioutil.ReadFile(description)
+	require.NoError(t, err)
+	bts = bytes.Replace(bts, []byte("<nl>Studentenkaart</nl>"), nil, 1)
+	require.NoError(t, ioutil.WriteFile(description, bts, 0644))
+
+	conf, err := NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	id := NewSchemeManagerIdentifier("irma-demo")
+	require.Error(t, conf.ParseSchemeManagerFolder(filepath.Join(path, "irma-demo"), NewSchemeManager("irma-demo")))
+
+	conf, err = NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseUnsignedSchemeManagerFolder(filepath.Join(path, "irma-demo"), NewSchemeManager("irma-demo")))
+	require.False(t, conf.SchemeManagers[id].Valid)
+	missing, err := conf.MissingTranslations(id, "nl")
+	require.NoError(t, err)
+	require.Equal(t, []MissingTranslation{{Object: "Credential type irma-demo.RU.studentCard", Field: "Name"}}, missing["nl"])
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	canonical, err := CanonicalizeJSON([]byte(`{ "b": [1, 2.50, 1e3, "<é>\n"], "a": {"z": null, "€": true, "😀": 123456789012345678901234567890} }`))
+	require.NoError(t, err)
+	require.Equal(t, `{"a":{"z":null,"€":true,"😀":123456789012345678901234567890},"b":[1,2.5,1000,"<é>\n"]}`, string(canonical))
+	_, err = CanonicalizeJSON([]byte(`{} {}`))
+	require.Error(t, err)
+
+	// Independent of the order of the fields and of whitespace
+	request := &DisclosureRequest{
+		BaseRequest: BaseRequest{Type: ActionDisclosing, Nonce: big.NewInt(42), Context: big.NewInt(1)},
+		Content: AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+	}
+	bts, err := CanonicalJSON(request)
+	require.NoError(t, err)
+	fields := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(bts, &fields))
+	indented, err := json.MarshalIndent(fields, "", "  ")
+	require.NoError(t, err)
+	canonical, err = CanonicalizeJSON(indented)
+	require.NoError(t, err)
+	require.Equal(t, string(bts), string(canonical))
+}
@@ -24,8 +24,21 @@ var ForceHttps bool = false
 const (
 	MinVersionHeader = "X-IRMA-MinProtocolVersion"
 	MaxVersionHeader = "X-IRMA-MaxProtocolVersion"
+	// Header containing the confirmation code of a session started from a deep link,
+	// sent by the client when retrieving the session request
+	ConfirmationCodeHeader = "X-IRMA-ConfirmationCode"
+	// Header sent by the client when retrieving the session request if the QR contains a request key,
+	// asking the server to return the session request signed by that key (see SignClientSessionRequest())
+	SignedRequestHeader = "X-IRMA-SignedRequest"
+	// Header containing a random identifier of the attempt of the client to complete the session, sent
+	// by the client in all requests of the session, with which the server tells apart the clients of
+	// group issuance sessions
+	AttemptHeader = "X-IRMA-Attempt"
 )
 
+// MaxConfirmationCodeLength is the maximum length of the value of the ConfirmationCodeHeader.
+const MaxConfirmationCodeLength = 16
+
 // ProtocolVersion encodes the IRMA protocol version of an IRMA session.
 type ProtocolVersion struct {
 	Major int
@@ -105,6 +118,9 @@ type SessionError struct {
 	Info         string
 	RemoteError  *RemoteError
 	RemoteStatus int
+	// Message describing the RemoteError to the user in the language of the user, if the
+	// scheme of the server translates its ErrorName (see Configuration.RemoteErrorMessage())
+	LocalizedMessage string
 }
 
 // RemoteError is an error message returned by the API server on errors.
@@ -147,10 +163,23 @@ type Qr struct {
 	URL string `json:"u"`
 	// Session type (disclosing, signing, issuing)
 	Type Action `json:"irmaqr"`
+	// Public key of the server (see MarshalRequestKey()), if it signs the session request. If present,
+	// the client only accepts a session request signed with this key, so that the session request
+	// cannot be altered by anyone between the server and the client (e.g. a reverse proxy).
+	RequestKey string `json:"k,omitempty"`
 }
 
 type SchemeManagerRequest Qr
 
+// PushPayload contains the data of a push notification with which a requestor asks the user
+// to perform an IRMA session, suitable for Client.NewPushSession().
+type PushPayload struct {
+	// Session pointer of the session to be performed
+	SessionPtr *Qr `json:"sessionPtr"`
+	// Hostname of the requestor that sent the push notification
+	Requestor string `json:"requestor"`
+}
+
 // Statuses
 const (
 	StatusConnected     = Status("connected")
@@ -199,6 +228,16 @@ const (
 	ErrorInvalidSchemeManager = ErrorType("invalidSchemeManager")
 	// Recovered panic
 	ErrorPanic = ErrorType("panic")
+	// Requestor of a session pointer received by push notification does not match the push origin
+	ErrorRequestorMismatch = ErrorType("requestorMismatch")
+	// URL does not use HTTPS, while its host is not exempted by a scheme (see InsecureURLError)
+	ErrorInsecureURL = ErrorType("insecureUrl")
+	// The wallet lock of the client is enabled and the wallet is locked
+	ErrorWalletLocked = ErrorType("walletLocked")
+	// Some of the issued credentials could not be constructed; the others were stored
+	ErrorPartialIssuance = ErrorType("partialIssuance")
+	// A scheme involved in the session has not been refreshed for too long (see the preferences of the client)
+	ErrorStaleScheme = ErrorType("staleScheme")
 )
 
 func (e *SessionError) Error() string {
@@ -262,6 +301,35 @@ type DisclosedAttributeIndex struct {
 type IssueCommitmentMessage struct {
 	*gabi.IssueCommitmentMessage
 	Indices DisclosedAttributeIndices `json:"indices"`
+	// CredentialIDs correlates the issuance proofs, which follow the disclosure proofs in Proofs, with the
+	// credentials of the issuance request: the i-th issuance proof commits to the credential at index
+	// CredentialIDs[i] of IssuanceRequest.Credentials, and the issuer returns the i-th signature over it.
+	// If absent, the issuance proofs are in the order of IssuanceRequest.Credentials.
+	CredentialIDs []int `json:"credentialIDs,omitempty"`
+}
+
+// CredentialIndices returns the index in request.Credentials of the credential of each issuance proof,
+// checking that each credential has exactly one issuance proof (see CredentialIDs).
+func (i *IssueCommitmentMessage) CredentialIndices(request *IssuanceRequest) ([]int, error) {
+	count := len(request.Credentials)
+	if i.CredentialIDs == nil {
+		ids := make([]int, count)
+		for j := range ids {
+			ids[j] = j
+		}
+		return ids, nil
+	}
+	if len(i.CredentialIDs) != count {
+		return nil, errors.Errorf("Expected %d credential IDs, got %d", count, len(i.CredentialIDs))
+	}
+	seen := make([]bool, count)
+	for _, id := range i.CredentialIDs {
+		if id < 0 || id >= count || seen[id] {
+			return nil, errors.Errorf("Invalid or duplicate credential ID %d", id)
+		}
+		seen[id] = true
+	}
+	return i.CredentialIDs, nil
 }
 
 func (i *IssueCommitmentMessage) Disclosure() *Disclosure {
@@ -291,6 +359,16 @@ func ParseRequestorJwt(action string, requestorJwt string) (RequestorJwt, error)
 	return retval, nil
 }
 
+func (p *PushPayload) Validate() error {
+	if p.SessionPtr == nil {
+		return errors.New("No session pointer specified")
+	}
+	if p.Requestor == "" {
+		return errors.New("No requestor specified")
+	}
+	return p.SessionPtr.Validate()
+}
+
 func (qr *Qr) Validate() (err error) {
 	if qr.URL == "" {
 		return errors.New("No URL specified")
@@ -311,6 +389,12 @@ func (qr *Qr) Validate() (err error) {
 		return errors.New("Unsupported session type")
 	}
 
+	if qr.RequestKey != "" {
+		if _, err = ParseRequestKey(qr.RequestKey); err != nil {
+			return errors.Errorf("Invalid request key: %s", err.Error())
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,188 @@
+package irma
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/timshannon/bolthold"
+)
+
+// This file contains replay protection for verifiers that verify disclosures or attribute-based signatures
+// themselves using this package, instead of using an IRMA server (which generates a fresh nonce for each
+// session). Although a proof is bound to the nonce and context of the request for which it was made, a
+// verifier that does not keep track of which nonces it has already accepted also accepts the same proof when
+// it is presented to it again. The VerifyOnce() methods of Disclosure, DisclosureToken and SignedMessage
+// therefore register the nonce of each valid proof in a NonceStore, returning ProofStatusReplayed for proofs
+// whose nonce was registered before.
+
+// DefaultNonceRetention is how long the nonces of accepted proofs are remembered by VerifyOnce(),
+// except for disclosure tokens, whose nonces are remembered until the end of their window.
+// Verifiers must not accept proofs of requests older than this.
+const DefaultNonceRetention = 24 * time.Hour
+
+// NonceStore keeps track of the nonces of accepted proofs.
+type NonceStore interface {
+	// Use registers the nonce and context of an accepted proof, returning false if they were already
+	// registered before. The store may forget the registration after the expiry.
+	Use(context, nonce *big.Int, expiry time.Time) (bool, error)
+}
+
+// nonceKey identifies a nonce and context in a NonceStore.
+func nonceKey(context, nonce *big.Int) string {
+	if context == nil {
+		context = big.NewInt(0)
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s", context.String(), nonce.String())))
+	return hex.EncodeToString(hash[:])
+}
+
+// MemoryNonceStore is a NonceStore that keeps the nonces in memory.
+type MemoryNonceStore struct {
+	nonces map[string]time.Time
+	sync.Mutex
+}
+
+// NewMemoryNonceStore returns a new, empty MemoryNonceStore.
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: map[string]time.Time{}}
+}
+
+func (s *MemoryNonceStore) Use(context, nonce *big.Int, expiry time.Time) (bool, error) {
+	if nonce == nil {
+		return false, errors.New("Cannot register empty nonce")
+	}
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for key, exp := range s.nonces {
+		if exp.Before(now) {
+			delete(s.nonces, key)
+		}
+	}
+	key := nonceKey(context, nonce)
+	if _, used := s.nonces[key]; used {
+		return false, nil
+	}
+	s.nonces[key] = expiry
+	return true, nil
+}
+
+// BoltNonceStore is a NonceStore that persists the nonces in a bolt database, so that they survive
+// restarts of the verifier. The database can be used by one process at a time.
+type BoltNonceStore struct {
+	db         *bolthold.Store
+	lastPruned time.Time
+	sync.Mutex
+}
+
+type usedNonce struct {
+	Expiry time.Time
+}
+
+// NewBoltNonceStore opens or creates a BoltNonceStore using the database at the specified path.
+func NewBoltNonceStore(path string) (*BoltNonceStore, error) {
+	db, err := bolthold.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltNonceStore{db: db}, nil
+}
+
+// Close closes the database of the store.
+func (s *BoltNonceStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltNonceStore) Use(context, nonce *big.Int, expiry time.Time) (bool, error) {
+	if nonce == nil {
+		return false, errors.New("Cannot register empty nonce")
+	}
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastPruned) > time.Minute {
+		if err := s.db.DeleteMatching(&usedNonce{}, bolthold.Where("Expiry").Lt(now)); err != nil {
+			return false, err
+		}
+		s.lastPruned = now
+	}
+
+	key := nonceKey(context, nonce)
+	var used usedNonce
+	err := s.db.Get(key, &used)
+	if err == nil && used.Expiry.After(now) {
+		return false, nil
+	}
+	if err != nil && err != bolthold.ErrNotFound {
+		return false, err
+	}
+	if err = s.db.Upsert(key, &usedNonce{Expiry: expiry}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// useNonce registers the nonce of a proof having the specified status in the store,
+// returning ProofStatusReplayed if it was already registered.
+func useNonce(store NonceStore, context, nonce *big.Int, expiry time.Time, status ProofStatus) (ProofStatus, error) {
+	if store == nil {
+		return status, errors.New("No nonce store specified")
+	}
+	if status != ProofStatusValid {
+		return status, nil
+	}
+	fresh, err := store.Use(context, nonce, expiry)
+	if err != nil {
+		return status, err
+	}
+	if !fresh {
+		return ProofStatusReplayed, nil
+	}
+	return status, nil
+}
+
+// VerifyOnce verifies the disclosure against the request like Verify, and additionally registers the
+// nonce of the request in the store if the disclosure is valid, returning ProofStatusReplayed if the
+// nonce was already registered.
+func (d *Disclosure) VerifyOnce(configuration *Configuration, request *DisclosureRequest, store NonceStore) ([]*DisclosedAttribute, ProofStatus, error) {
+	list, status, err := d.Verify(configuration, request)
+	if err != nil {
+		return list, status, err
+	}
+	status, err = useNonce(store, request.Context, request.GetNonce(), time.Now().Add(DefaultNonceRetention), status)
+	return list, status, err
+}
+
+// VerifyOnce verifies the disclosure token against the request like Verify, and additionally registers
+// the nonce of the token in the store until the end of its window if the token is valid, returning
+// ProofStatusReplayed if the nonce was already registered.
+func (token *DisclosureToken) VerifyOnce(configuration *Configuration, request *DisclosureRequest, store NonceStore) ([]*DisclosedAttribute, ProofStatus, error) {
+	list, status, err := token.Verify(configuration, request)
+	if err != nil {
+		return list, status, err
+	}
+	status, err = useNonce(store, request.Context, request.Nonce, time.Time(request.Window.NotAfter), status)
+	return list, status, err
+}
+
+// VerifyOnce verifies the attribute-based signature against the request like Verify, and additionally
+// registers the nonce of the request in the store if the signature is valid, returning ProofStatusReplayed
+// if the nonce was already registered. Unlike Verify, the request is required: attribute-based signatures
+// are meant to be verifiable by anyone any number of times, so only signatures that were requested by
+// the verifier itself should be verified only once.
+func (sm *SignedMessage) VerifyOnce(configuration *Configuration, request *SignatureRequest, store NonceStore) ([]*DisclosedAttribute, ProofStatus, error) {
+	if request == nil {
+		return nil, ProofStatusUnmatchedRequest, errors.New("VerifyOnce requires a signature request")
+	}
+	list, status, err := sm.Verify(configuration, request)
+	if err != nil {
+		return list, status, err
+	}
+	status, err = useNonce(store, request.Context, request.GetNonce(), time.Now().Add(DefaultNonceRetention), status)
+	return list, status, err
+}
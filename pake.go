@@ -0,0 +1,194 @@
+package irma
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// This file contains the PAKE with which IRMA apps register and prove knowledge of their PIN at
+// keyshare servers supporting version 3 of the keyshare protocol; see irmaclient/pake.go for the
+// client, and server/keyshare for the keyshare server. The keyshare server only ever receives values
+// from which the PIN can not be brute-forced without its OPRF key.
+//
+// The PAKE is built on the OPRF of RFC 9497 (in its base mode, with the P256-SHA256 suite, whose
+// hash-to-curve runs in constant time) as implemented by github.com/cloudflare/circl/oprf. The input
+// of the OPRF is the PIN, salted with the nonce of the keyshare account. The client derives an ECDSA
+// key pair on P-256 from the output of the OPRF using HKDF; the keyshare server stores the OPRF key and
+// the public key of the account, and the client proves knowledge of the PIN by signing a fresh
+// challenge of the keyshare server.
+
+const (
+	// Domain separators of the key derivation and of the signed challenges
+	pakeKeyDomain       = "irma pake key"
+	pakeChallengeDomain = "irma pake challenge"
+
+	pakeChallengeLength = 32
+)
+
+var pakeSuite = oprf.SuiteP256
+
+// PakeOprfRequest asks the keyshare server to evaluate the OPRF on a blinded PIN, when registering
+// a PIN (without Username), or when starting the verification of the PIN of an account.
+type PakeOprfRequest struct {
+	Username string `json:"id,omitempty"`
+	Blinded  []byte `json:"blinded"`
+}
+
+// PakeOprfResponse contains the evaluation of the OPRF on the blinded PIN, along with the identifier
+// of the registration when registering a PIN, or the challenge to be signed when verifying the PIN.
+type PakeOprfResponse struct {
+	Registration string `json:"registration,omitempty"`
+	Evaluated    []byte `json:"evaluated"`
+	Challenge    []byte `json:"challenge,omitempty"`
+}
+
+// PakeRecord completes the registration of a PIN with the public key derived from it.
+type PakeRecord struct {
+	Registration string `json:"registration"`
+	PublicKey    []byte `json:"publicKey"`
+}
+
+// PakeBlinding is the state of the client between blinding the PIN and receiving the evaluation
+// of the OPRF on it.
+type PakeBlinding struct {
+	Blinded []byte
+	data    *oprf.FinalizeData
+}
+
+// NewPakeBlinding blinds the PIN, salted with the nonce of the keyshare account.
+func NewPakeBlinding(nonce []byte, pin string) (*PakeBlinding, error) {
+	data, req, err := oprf.NewClient(pakeSuite).Blind([][]byte{pakeInput(nonce, pin)})
+	if err != nil {
+		return nil, err
+	}
+	blinded, err := req.Elements[0].MarshalBinaryCompress()
+	if err != nil {
+		return nil, err
+	}
+	return &PakeBlinding{Blinded: blinded, data: data}, nil
+}
+
+// Key unblinds the evaluation of the OPRF received from the keyshare server, and derives the
+// key pair of the PIN from the output of the OPRF.
+func (b *PakeBlinding) Key(evaluated []byte) (*ecdsa.PrivateKey, error) {
+	element := pakeSuite.Group().NewElement()
+	if err := element.UnmarshalBinary(evaluated); err != nil {
+		return nil, errors.New("Keyshare server sent invalid OPRF evaluation")
+	}
+	outputs, err := oprf.NewClient(pakeSuite).Finalize(b.data, &oprf.Evaluation{Elements: []oprf.Evaluated{element}})
+	if err != nil {
+		return nil, err
+	}
+	return pakeKey(outputs[0])
+}
+
+// SignPakeChallenge proves knowledge of the PIN by signing the challenge of the keyshare server.
+func SignPakeChallenge(sk *ecdsa.PrivateKey, challenge []byte) ([]byte, error) {
+	hash := pakeChallengeHash(challenge)
+	return ecdsa.SignASN1(rand.Reader, sk, hash[:])
+}
+
+// PakeKey is the OPRF key of a registered PIN, which the keyshare server keeps secret.
+type PakeKey []byte
+
+// NewPakeKey generates a new OPRF key for the registration of a PIN.
+func NewPakeKey() (PakeKey, error) {
+	key, err := oprf.GenerateKey(pakeSuite, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return key.MarshalBinary()
+}
+
+// Evaluate evaluates the OPRF on the blinded PIN sent by the client.
+func (k PakeKey) Evaluate(blinded []byte) ([]byte, error) {
+	key := &oprf.PrivateKey{}
+	if err := key.UnmarshalBinary(pakeSuite, k); err != nil {
+		return nil, err
+	}
+	element := pakeSuite.Group().NewElement()
+	if err := element.UnmarshalBinary(blinded); err != nil {
+		return nil, errors.New("Invalid blinded PIN")
+	}
+	evaluation, err := oprf.NewServer(pakeSuite, key).Evaluate(&oprf.EvaluationRequest{Elements: []oprf.Blinded{element}})
+	if err != nil {
+		return nil, err
+	}
+	return evaluation.Elements[0].MarshalBinaryCompress()
+}
+
+// NewPakeChallenge returns a fresh challenge for the client to sign when verifying its PIN.
+func NewPakeChallenge() ([]byte, error) {
+	challenge := make([]byte, pakeChallengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// ParsePakePublicKey parses the public key of a PakeRecord.
+func ParsePakePublicKey(bts []byte) (*ecdsa.PublicKey, error) {
+	pk, err := x509.ParsePKIXPublicKey(bts)
+	if err != nil {
+		return nil, err
+	}
+	ecpk, ok := pk.(*ecdsa.PublicKey)
+	if !ok || ecpk.Curve != elliptic.P256() {
+		return nil, errors.New("PIN public key is not a P-256 ECDSA key")
+	}
+	return ecpk, nil
+}
+
+// VerifyPakeProof checks the signature of the client on the challenge against the public key
+// registered for the PIN.
+func VerifyPakeProof(publicKey []byte, challenge []byte, proof []byte) (bool, error) {
+	pk, err := ParsePakePublicKey(publicKey)
+	if err != nil {
+		return false, err
+	}
+	hash := pakeChallengeHash(challenge)
+	return ecdsa.VerifyASN1(pk, hash[:], proof), nil
+}
+
+func pakeInput(nonce []byte, pin string) []byte {
+	input := make([]byte, 4, 4+len(nonce)+len(pin))
+	binary.BigEndian.PutUint32(input, uint32(len(nonce)))
+	input = append(input, nonce...)
+	return append(input, pin...)
+}
+
+func pakeChallengeHash(challenge []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte(pakeChallengeDomain), challenge...))
+}
+
+// pakeKey derives an ECDSA key pair from the output of the OPRF, reducing 64 bits more than the
+// size of the curve order to make the bias negligible (FIPS 186-4, B.4.1).
+func pakeKey(output []byte) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	n := curve.Params().N
+	bts := make([]byte, (n.BitLen()+64)/8)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, output, nil, []byte(pakeKeyDomain)), bts); err != nil {
+		return nil, err
+	}
+	d := new(big.Int).SetBytes(bts)
+	for i := range bts {
+		bts[i] = 0
+	}
+	d.Mod(d, new(big.Int).Sub(n, big.NewInt(1)))
+	d.Add(d, big.NewInt(1))
+
+	sk := &ecdsa.PrivateKey{D: d}
+	sk.PublicKey.Curve = curve
+	sk.PublicKey.X, sk.PublicKey.Y = curve.ScalarBaseMult(d.FillBytes(make([]byte, 32)))
+	return sk, nil
+}
@@ -0,0 +1,92 @@
+package irma
+
+import (
+	"encoding/json"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+)
+
+// AttributePassport is a portable, signed and timestamped snapshot of attributes, meant for relying
+// parties that cannot run an interactive IRMA session: the user creates it without a server, and sends
+// it (e.g. as a file by email) to the relying party, who can verify it offline using only the public
+// keys of the issuers in the scheme. It consists of an attribute-based signature over a statement
+// containing the intended recipient and an optional note.
+//
+// Since the passport is not bound to a nonce of the relying party, anyone holding it can show it to
+// others; the recipient in the statement allows the relying party to check that it was meant for them.
+type AttributePassport struct {
+	PassportStatement
+	Signature *SignedMessage `json:"signature"`
+}
+
+// PassportStatement is the message that is signed in an AttributePassport.
+type PassportStatement struct {
+	Type      string `json:"type"`
+	Recipient string `json:"recipient"`
+	Note      string `json:"note,omitempty"`
+}
+
+const passportStatementType = "attribute-passport"
+
+// NewAttributePassportRequest returns a signature request for creating an attribute passport for the specified
+// recipient, disclosing the specified attributes.
+func NewAttributePassportRequest(attributes []AttributeTypeIdentifier, recipient, note string) (*SignatureRequest, error) {
+	statement := PassportStatement{Type: passportStatementType, Recipient: recipient, Note: note}
+	message, err := statement.message()
+	if err != nil {
+		return nil, err
+	}
+	disjunctions := make(AttributeDisjunctionList, 0, len(attributes))
+	for _, attr := range attributes {
+		disjunctions = append(disjunctions, &AttributeDisjunction{
+			Label:      attr.Name(),
+			Attributes: []AttributeTypeIdentifier{attr},
+		})
+	}
+	return &SignatureRequest{
+		Message: message,
+		DisclosureRequest: DisclosureRequest{
+			BaseRequest: BaseRequest{Type: ActionSigning, Nonce: big.NewInt(0), Context: big.NewInt(1)},
+			Content:     disjunctions,
+		},
+	}, nil
+}
+
+// NewAttributePassport creates an attribute passport out of a signature created using a request
+// from NewAttributePassportRequest().
+func NewAttributePassport(signature *SignedMessage) (*AttributePassport, error) {
+	passport := &AttributePassport{Signature: signature}
+	if err := json.Unmarshal([]byte(signature.Message), &passport.PassportStatement); err != nil {
+		return nil, errors.WrapPrefix(err, "Signature is not an attribute passport", 0)
+	}
+	if passport.Type != passportStatementType {
+		return nil, errors.New("Signature is not an attribute passport")
+	}
+	return passport, nil
+}
+
+func (statement PassportStatement) message() (string, error) {
+	bts, err := json.Marshal(statement)
+	return string(bts), err
+}
+
+// Verify verifies the attribute passport, returning the contained attributes. The attributes are
+// checked to have been valid at the time of the timestamp of the passport, which is required.
+// The caller should check that the recipient of the passport is as expected.
+func (passport *AttributePassport) Verify(conf *Configuration) ([]*DisclosedAttribute, ProofStatus, error) {
+	if passport.Signature == nil {
+		return nil, ProofStatusInvalid, nil
+	}
+	if passport.Signature.Timestamp == nil {
+		return nil, ProofStatusInvalidTimestamp, nil
+	}
+	message, err := passport.PassportStatement.message()
+	if err != nil {
+		return nil, ProofStatusInvalid, err
+	}
+	if passport.Signature.Message != message || passport.Signature.File != nil {
+		return nil, ProofStatusUnmatchedRequest, nil
+	}
+	return passport.Signature.Verify(conf, nil)
+}
@@ -0,0 +1,88 @@
+package irma
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// This file contains helpers to estimate the size of the QR code encoding a session pointer (Qr) or,
+// for manual sessions, a session request, so that requestors can avoid QRs that are too dense to be
+// scanned. Session pointers are small, but session requests embedded in a QR may not be: these
+// should be replaced by a session pointer to a server from which the client fetches the request.
+
+// QrErrorCorrection is the error correction level of a QR code.
+type QrErrorCorrection int
+
+const (
+	QrLevelL QrErrorCorrection = iota // 7% of the code can be restored
+	QrLevelM                          // 15%
+	QrLevelQ                          // 25%
+	QrLevelH                          // 30%
+)
+
+// MaxScannableQrVersion is the largest QR version (77x77 modules) that phone cameras
+// reliably scan from a screen.
+const MaxScannableQrVersion = 15
+
+// qrCapacity contains the amount of bytes that fit in byte mode in each QR version,
+// for each error correction level.
+var qrCapacity = [40][4]int{
+	{17, 14, 11, 7}, {32, 26, 20, 14}, {53, 42, 32, 24}, {78, 62, 46, 34}, {106, 84, 60, 44},
+	{134, 106, 74, 58}, {154, 122, 86, 64}, {192, 152, 108, 84}, {230, 180, 130, 98}, {271, 213, 151, 119},
+	{321, 251, 177, 137}, {367, 287, 203, 155}, {425, 331, 241, 177}, {458, 362, 258, 194}, {520, 412, 292, 220},
+	{586, 450, 322, 250}, {644, 504, 364, 280}, {718, 560, 394, 310}, {792, 624, 442, 338}, {858, 666, 482, 382},
+	{929, 711, 509, 403}, {1003, 779, 565, 439}, {1091, 857, 611, 461}, {1171, 911, 661, 511}, {1273, 997, 715, 535},
+	{1367, 1059, 751, 593}, {1465, 1125, 805, 625}, {1528, 1190, 868, 658}, {1628, 1264, 908, 698}, {1732, 1370, 982, 742},
+	{1840, 1452, 1030, 790}, {1952, 1538, 1112, 842}, {2068, 1628, 1168, 898}, {2188, 1722, 1228, 958}, {2303, 1809, 1283, 983},
+	{2431, 1911, 1351, 1051}, {2563, 1989, 1423, 1093}, {2699, 2099, 1499, 1139}, {2809, 2213, 1579, 1219}, {2953, 2331, 1663, 1273},
+}
+
+// QrTooLargeError is returned by CheckQrSize() when the contents do not fit in a scannable QR.
+type QrTooLargeError struct {
+	Size int
+	// The QR version required for the contents, or 0 if they do not fit in any QR version
+	Version int
+}
+
+func (e *QrTooLargeError) Error() string {
+	if e.Version == 0 {
+		return fmt.Sprintf("QR contents of %d bytes do not fit in a QR code", e.Size)
+	}
+	return fmt.Sprintf("QR contents of %d bytes require QR version %d, which may not be scannable (max %d)",
+		e.Size, e.Version, MaxScannableQrVersion)
+}
+
+// QrVersion returns the smallest QR version (1 to 40) in which the specified amount of bytes fit
+// at the specified error correction level, or 0 if they do not fit in any version.
+func QrVersion(size int, level QrErrorCorrection) int {
+	for i, capacity := range qrCapacity {
+		if size <= capacity[level] {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// QrSize returns the size in bytes of the JSON encoding of a session pointer or session request,
+// as it is encoded in a QR.
+func QrSize(contents interface{}) (int, error) {
+	bts, err := json.Marshal(contents)
+	if err != nil {
+		return 0, err
+	}
+	return len(bts), nil
+}
+
+// CheckQrSize returns the QR version required to encode the session pointer or session request
+// at the specified error correction level, or a QrTooLargeError if it exceeds MaxScannableQrVersion.
+func CheckQrSize(contents interface{}, level QrErrorCorrection) (int, error) {
+	size, err := QrSize(contents)
+	if err != nil {
+		return 0, err
+	}
+	version := QrVersion(size, level)
+	if version == 0 || version > MaxScannableQrVersion {
+		return version, &QrTooLargeError{Size: size, Version: version}
+	}
+	return version, nil
+}
@@ -0,0 +1,142 @@
+package irma
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// RequestorInfo describes a requestor (i.e. a verifier or issuer) as listed in the requestor registry
+// of a scheme, which is contained in the requestors.json file in the scheme folder. Like all other
+// files in the scheme, it is authenticated using the signed scheme index.
+type RequestorInfo struct {
+	ID      string           `json:"id"`
+	Name    TranslatedString `json:"name"`
+	Domains []string         `json:"domains"`
+	// Path to the logo of the requestor, relative to the scheme folder
+	Logo string `json:"logo,omitempty"`
+	// Attributes or credential types that the requestor may request; if empty, it is not restricted
+	AllowedAttributes []AttributeTypeIdentifier `json:"allowedAttributes,omitempty"`
+
+	Scheme SchemeManagerIdentifier `json:"-"`
+}
+
+const requestorsFile = "requestors.json"
+
+// parseRequestors parses the requestor registry of the specified scheme, if present.
+func (conf *Configuration) parseRequestors(manager *SchemeManager, dir string) error {
+	relativepath, err := relativePath(conf.Path, filepath.Join(dir, requestorsFile))
+	if err != nil {
+		return err
+	}
+	bts, found, err := conf.ReadAuthenticatedFile(manager, relativepath)
+	if !found {
+		return nil // the requestor registry is optional
+	}
+	if err != nil {
+		return err
+	}
+
+	var requestors []*RequestorInfo
+	if err = json.Unmarshal(bts, &requestors); err != nil {
+		return errors.WrapPrefix(err, "Failed to parse requestor registry", 0)
+	}
+	for _, requestor := range requestors {
+		if requestor.ID == "" {
+			return errors.New("Requestor registry contains requestor without ID")
+		}
+		requestor.Scheme = manager.Identifier()
+		conf.Requestors[requestor.Scheme.String()+"."+requestor.ID] = requestor
+	}
+	return nil
+}
+
+// RequestorForHost returns the requestor from the requestor registries of all schemes whose
+// domains include the specified hostname, or nil if there is none. If several requestors match,
+// the one with the most specific matching domain is returned, exact domains taking precedence over
+// wildcard domains; remaining ties are broken by scheme and requestor ID, so that the result
+// does not depend on map iteration order.
+func (conf *Configuration) RequestorForHost(hostname string) *RequestorInfo {
+	if hostname == "" {
+		return nil
+	}
+	keys := make([]string, 0, len(conf.Requestors))
+	for key := range conf.Requestors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var result *RequestorInfo
+	best := 0
+	for _, key := range keys {
+		if specificity := conf.Requestors[key].matchHost(hostname); specificity > best {
+			result, best = conf.Requestors[key], specificity
+		}
+	}
+	return result
+}
+
+// MatchesHost returns whether or not the specified hostname is one of the domains of the requestor.
+// Domains of the form "*.example.com" match all subdomains of example.com.
+func (ri *RequestorInfo) MatchesHost(hostname string) bool {
+	return ri.matchHost(hostname) > 0
+}
+
+// matchHost returns how specifically the domains of the requestor match the specified hostname:
+// 0 if none match, the length of the longest matching wildcard domain if only wildcard domains
+// match, and a number larger than that if the hostname is one of the domains.
+func (ri *RequestorInfo) matchHost(hostname string) int {
+	hostname = strings.ToLower(hostname)
+	specificity := 0
+	for _, domain := range ri.Domains {
+		domain = strings.ToLower(domain)
+		if strings.HasPrefix(domain, "*.") {
+			if strings.HasSuffix(hostname, domain[1:]) && len(domain) > specificity {
+				specificity = len(domain)
+			}
+		} else if hostname == domain {
+			// A wildcard domain matching the hostname is shorter than it
+			return len(hostname) + 1
+		}
+	}
+	return specificity
+}
+
+// Allowed returns whether or not the requestor may request the specified attribute.
+func (ri *RequestorInfo) Allowed(attr AttributeTypeIdentifier) bool {
+	if len(ri.AllowedAttributes) == 0 {
+		return true
+	}
+	for _, allowed := range ri.AllowedAttributes {
+		if allowed == attr ||
+			(allowed.IsCredential() && allowed.CredentialTypeIdentifier() == attr.CredentialTypeIdentifier()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Violations returns the attributes requested in the specified disjunctions that
+// the requestor is not allowed to request.
+func (ri *RequestorInfo) Violations(disjunctions AttributeDisjunctionList) []AttributeTypeIdentifier {
+	var violations []AttributeTypeIdentifier
+	for _, disjunction := range disjunctions {
+		for _, attr := range disjunction.Attributes {
+			if !ri.Allowed(attr) {
+				violations = append(violations, attr)
+			}
+		}
+	}
+	return violations
+}
+
+// LogoPath returns the path to the logo of the requestor, or the empty string if it has none.
+func (ri *RequestorInfo) LogoPath(conf *Configuration) string {
+	if ri.Logo == "" {
+		return ""
+	}
+	return filepath.Join(conf.Path, ri.Scheme.String(), filepath.FromSlash(ri.Logo))
+}
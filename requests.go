@@ -1,6 +1,10 @@
 package irma
 
 import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"strconv"
@@ -20,8 +24,10 @@ type BaseRequest struct {
 	Type    Action   `json:"type"`
 
 	Candidates [][]*AttributeIdentifier `json:"-"`
-	Choice     *DisclosureChoice        `json:"-"`
-	Ids        *IrmaIdentifierSet       `json:"-"`
+	// Before the user is asked for permission, the choice of attributes suggested to the user by
+	// default; afterwards, the attributes that the user chose to disclose
+	Choice *DisclosureChoice  `json:"-"`
+	Ids    *IrmaIdentifierSet `json:"-"`
 
 	Version *ProtocolVersion `json:"protocolVersion,omitempty"`
 }
@@ -54,12 +60,56 @@ func (sr *BaseRequest) GetVersion() *ProtocolVersion {
 type DisclosureRequest struct {
 	BaseRequest
 	Content AttributeDisjunctionList `json:"content"`
+
+	// If present, the disclosure is delivered to each of these recipients, see DisclosureRecipient
+	Recipients []*DisclosureRecipient `json:"recipients,omitempty"`
+
+	// If present, the disclosure is a token that the verifier can verify later within this window, see DisclosureToken
+	Window *DisclosureWindow `json:"window,omitempty"`
+}
+
+// DisclosureRecipient is one of several verifiers to which the attributes of a disclosure request
+// are disclosed in a single session. Each recipient contributes its own nonce, and the disclosure proofs
+// are computed over a nonce derived from the session nonce and the nonces of all recipients (see
+// DisclosureRequest.GetNonce()). A recipient receives a DisclosureTranscript that it can verify
+// independently using its own nonce.
+type DisclosureRecipient struct {
+	Name  string   `json:"name"`
+	Nonce *big.Int `json:"nonce"`
+}
+
+// DisclosureTranscript is the result of a disclosure session as delivered to one of its recipients.
+type DisclosureTranscript struct {
+	Recipient  string                 `json:"recipient"`
+	Disclosure *Disclosure            `json:"disclosure"`
+	Nonce      *big.Int               `json:"nonce"`
+	Context    *big.Int               `json:"context"`
+	Recipients []*DisclosureRecipient `json:"recipients"`
+}
+
+// DisclosureWindow is the period, chosen by the verifier, within which a disclosure token can be verified.
+type DisclosureWindow struct {
+	NotBefore Timestamp `json:"notBefore"`
+	NotAfter  Timestamp `json:"notAfter"`
+}
+
+// DisclosureToken is a disclosure that the verifier checks asynchronously instead of during the session,
+// e.g. when the user sends it by email. The disclosure proofs are computed over a nonce derived from
+// the nonce of the verifier and the validity window (see DisclosureRequest.GetNonce()), so that the
+// window cannot be changed after the disclosure was made.
+type DisclosureToken struct {
+	Disclosure *Disclosure       `json:"disclosure"`
+	Nonce      *big.Int          `json:"nonce"`
+	Context    *big.Int          `json:"context"`
+	Window     *DisclosureWindow `json:"window"`
 }
 
 // A SignatureRequest is a a request to sign a message with certain attributes.
+// Instead of a message, a file may be signed by specifying its digest and metadata in File.
 type SignatureRequest struct {
 	DisclosureRequest
-	Message string `json:"message"`
+	Message string      `json:"message"`
+	File    *SignedFile `json:"file,omitempty"`
 
 	// Session state
 	Timestamp *atum.Timestamp `json:"-"`
@@ -84,6 +134,112 @@ type CredentialRequest struct {
 	KeyCounter       int                      `json:"keyCounter,omitempty"`
 	CredentialTypeID CredentialTypeIdentifier `json:"credential"`
 	Attributes       map[string]string        `json:"attributes"`
+
+	// SigningDatePrecision, if larger than 1, is the amount of epochs (weeks, see ExpiryFactor) to which
+	// the signing date of the credential is rounded down, without affecting its expiry date.
+	// The metadata attribute is a single attribute of the credential, so it is always disclosed as
+	// a whole; since the signing date within it allows verifiers to distinguish (and so link) credentials
+	// of the same type, making it coarser makes the credentials of all users receiving the credential
+	// within the same period of SigningDatePrecision weeks indistinguishable in this respect.
+	// Requires protocol version 2.6; for older clients the session fails.
+	SigningDatePrecision int `json:"signingDatePrecision,omitempty"`
+}
+
+// MaxSigningDatePrecision is the maximum value of CredentialRequest.SigningDatePrecision (one year).
+const MaxSigningDatePrecision = 52
+
+// CredentialIssuanceResult reports whether the client succeeded in constructing and storing
+// one of the credentials issued to it in an issuance session.
+type CredentialIssuanceResult struct {
+	CredentialTypeID CredentialTypeIdentifier `json:"credential"`
+	// Hash of the credential, if it was stored
+	Hash string `json:"hash,omitempty"`
+	// Empty if the credential was stored
+	Error string `json:"error,omitempty"`
+	// Whether the credential could not be stored but was queued for storing it later
+	Queued bool `json:"queued,omitempty"`
+}
+
+// Success returns whether the credential was stored.
+func (r *CredentialIssuanceResult) Success() bool {
+	return r.Error == ""
+}
+
+// ClientFailureCode is a machine-readable reason why a session failed at the client. Only the
+// codes below are valid, so that clients cannot report anything else about the user.
+type ClientFailureCode string
+
+const (
+	// The public key with which a credential was issued is not known to the client
+	FailureUnknownPublicKey = ClientFailureCode("unknownPublicKey")
+	// The signature of a credential is missing from the storage of the client
+	FailureSignatureMissing = ClientFailureCode("signatureMissing")
+	// The user is blocked at the keyshare server after too many incorrect PIN attempts
+	FailureKeyshareBlocked = ClientFailureCode("keyshareBlocked")
+	// The user is not (fully) enrolled at the keyshare server
+	FailureKeyshareEnrollment = ClientFailureCode("keyshareEnrollment")
+	// Other keyshare errors
+	FailureKeyshare = ClientFailureCode("keyshare")
+	// The scheme of the session is not known to the client or invalid
+	FailureUnknownScheme = ClientFailureCode("unknownScheme")
+	// The client failed to download configuration, such as credential types or public keys
+	FailureConfigurationDownload = ClientFailureCode("configurationDownload")
+	// The client failed to construct or verify cryptographic messages
+	FailureCrypto = ClientFailureCode("crypto")
+	// The client did not understand the session request or a message of the server
+	FailureProtocol = ClientFailureCode("protocol")
+	// Other failures
+	FailureOther = ClientFailureCode("other")
+)
+
+// clientFailureSchemeCodes are the failure codes that may be accompanied by the identifier of
+// the scheme involved, with whether or not it is allowed.
+var clientFailureSchemeCodes = map[ClientFailureCode]bool{
+	FailureUnknownPublicKey:      false,
+	FailureSignatureMissing:      false,
+	FailureKeyshareBlocked:       true,
+	FailureKeyshareEnrollment:    true,
+	FailureKeyshare:              false,
+	FailureUnknownScheme:         true,
+	FailureConfigurationDownload: false,
+	FailureCrypto:                false,
+	FailureProtocol:              false,
+	FailureOther:                 false,
+}
+
+// MaxClientFailureIdentifierLength is the maximum length of ClientFailure.Identifier.
+const MaxClientFailureIdentifierLength = 256
+
+// ClientFailure is sent by the client to the server when a session fails at the client (protocol
+// version 2.7 and up), so that requestors can debug integration problems. It contains no attribute
+// values or other information about the user, such as which credentials the user has: the identifier
+// is only present for failures concerning a scheme of the session request, and is that scheme.
+type ClientFailure struct {
+	Code       ClientFailureCode `json:"code"`
+	Identifier string            `json:"identifier,omitempty"`
+}
+
+// Validate checks that the code is one of the known failure codes, and that the identifier is only
+// present for failures concerning a scheme, in which case the scheme must be one of the specified
+// schemes (i.e. those of the session request).
+func (f *ClientFailure) Validate(schemes map[SchemeManagerIdentifier]struct{}) error {
+	allowed, known := clientFailureSchemeCodes[f.Code]
+	if !known {
+		return errors.Errorf("Unknown client failure code %s", f.Code)
+	}
+	if f.Identifier == "" {
+		return nil
+	}
+	if !allowed {
+		return errors.Errorf("Client failure code %s cannot have an identifier", f.Code)
+	}
+	if len(f.Identifier) > MaxClientFailureIdentifierLength {
+		return errors.New("Client failure identifier too long")
+	}
+	if _, ok := schemes[NewSchemeManagerIdentifier(f.Identifier)]; !ok {
+		return errors.Errorf("Client failure identifier %s is not a scheme of the session", f.Identifier)
+	}
+	return nil
 }
 
 // ServerJwt contains standard JWT fields.
@@ -99,6 +255,9 @@ type RequestorBaseRequest struct {
 	ResultJwtValidity int    `json:"validity,omitempty"`    // Validity of session result JWT in seconds
 	ClientTimeout     int    `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
 	CallbackUrl       string `json:"callbackUrl,omitempty"` // URL to post session result to
+	// In issuance sessions, the amount of clients that may complete the session one after another
+	// (e.g. to issue attendee credentials to a group of people using one QR), if more than one
+	MaxCompletions int `json:"maxCompletions,omitempty"`
 }
 
 // RequestorRequest is the message with which requestors start an IRMA session. It contains a
@@ -226,6 +385,9 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 	if credtype == nil {
 		return errors.New("Credential request of unknown credential type")
 	}
+	if cr.SigningDatePrecision < 0 || cr.SigningDatePrecision > MaxSigningDatePrecision {
+		return errors.Errorf("Signing date precision must be between 0 and %d", MaxSigningDatePrecision)
+	}
 
 	// Check that there are no attributes in the credential request that aren't
 	// in the credential descriptor.
@@ -244,6 +406,10 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 
 	for _, attrtype := range credtype.AttributeTypes {
 		if _, present := cr.Attributes[attrtype.ID]; !present && attrtype.Optional != "true" {
+			// Derived attributes are computed by the server when their base attribute is present
+			if _, base := cr.Attributes[attrtype.DerivedFrom]; attrtype.IsDerived() && base {
+				continue
+			}
 			return errors.New("Required attribute not present in credential request")
 		}
 	}
@@ -262,6 +428,7 @@ func (cr *CredentialRequest) AttributeList(conf *Configuration, metadataVersion
 	meta.setKeyCounter(cr.KeyCounter)
 	meta.setCredentialTypeIdentifier(cr.CredentialTypeID.String())
 	meta.setSigningDate()
+	meta.coarsenSigningDate(cr.SigningDatePrecision)
 	if err := meta.setExpiryDate(cr.Validity); err != nil {
 		return nil, err
 	}
@@ -331,6 +498,16 @@ func (ir *IssuanceRequest) ToDisclose() AttributeDisjunctionList {
 	return ir.Disclose
 }
 
+// CoarsensSigningDate returns whether any of the credentials has a SigningDatePrecision.
+func (ir *IssuanceRequest) CoarsensSigningDate() bool {
+	for _, credreq := range ir.Credentials {
+		if credreq.SigningDatePrecision > 1 {
+			return true
+		}
+	}
+	return false
+}
+
 func (ir *IssuanceRequest) GetCredentialInfoList(conf *Configuration, version *ProtocolVersion) (CredentialInfoList, error) {
 	if ir.CredentialInfoList == nil {
 		for _, credreq := range ir.Credentials {
@@ -396,8 +573,17 @@ func (dr *DisclosureRequest) GetContext() *big.Int { return dr.Context }
 // SetContext sets the context of this session.
 func (dr *DisclosureRequest) SetContext(context *big.Int) { dr.Context = context }
 
-// GetNonce returns the nonce of this session.
-func (dr *DisclosureRequest) GetNonce() *big.Int { return dr.Nonce }
+// GetNonce returns the nonce of this session
+// (with the nonces of the recipients or the validity window hashed into it, if any).
+func (dr *DisclosureRequest) GetNonce() *big.Int {
+	if dr.Window != nil {
+		return ASN1ConvertWindowNonce(dr.Nonce, dr.Window)
+	}
+	if len(dr.Recipients) == 0 {
+		return dr.Nonce
+	}
+	return ASN1ConvertRecipientsNonce(dr.Nonce, dr.Recipients)
+}
 
 // SetNonce sets the nonce of this session.
 func (dr *DisclosureRequest) SetNonce(nonce *big.Int) { dr.Nonce = nonce }
@@ -416,13 +602,64 @@ func (dr *DisclosureRequest) Validate() error {
 			return errors.New("Disclosure request had an empty disjunction")
 		}
 	}
+	names := map[string]struct{}{}
+	for _, recipient := range dr.Recipients {
+		if recipient.Name == "" || recipient.Nonce == nil {
+			return errors.New("Disclosure recipient must have a name and a nonce")
+		}
+		if _, present := names[recipient.Name]; present {
+			return errors.Errorf("Duplicate disclosure recipient %s", recipient.Name)
+		}
+		names[recipient.Name] = struct{}{}
+	}
+	if dr.Window != nil {
+		if len(dr.Recipients) > 0 {
+			return errors.New("Disclosure tokens cannot have multiple recipients")
+		}
+		if !time.Time(dr.Window.NotAfter).After(time.Time(dr.Window.NotBefore)) {
+			return errors.New("Disclosure window must end after it starts")
+		}
+	}
 	return nil
 }
 
+// Transcripts splits the specified disclosure, made in a session with this request, into a
+// transcript for each recipient.
+func (dr *DisclosureRequest) Transcripts(disclosure *Disclosure) []*DisclosureTranscript {
+	transcripts := make([]*DisclosureTranscript, 0, len(dr.Recipients))
+	for _, recipient := range dr.Recipients {
+		transcripts = append(transcripts, &DisclosureTranscript{
+			Recipient:  recipient.Name,
+			Disclosure: disclosure,
+			Nonce:      dr.Nonce,
+			Context:    dr.Context,
+			Recipients: dr.Recipients,
+		})
+	}
+	return transcripts
+}
+
+// Token returns the disclosure token consisting of the specified disclosure, made in a session with
+// this request, which must have a validity window.
+func (dr *DisclosureRequest) Token(disclosure *Disclosure) *DisclosureToken {
+	return &DisclosureToken{
+		Disclosure: disclosure,
+		Nonce:      dr.Nonce,
+		Context:    dr.Context,
+		Window:     dr.Window,
+	}
+}
+
 // GetNonce returns the nonce of this signature session
 // (with the message already hashed into it).
 func (sr *SignatureRequest) GetNonce() *big.Int {
-	return ASN1ConvertSignatureNonce(sr.Message, sr.Nonce, sr.Timestamp)
+	return ASN1ConvertSignatureNonce(sr.SignedMessage(), sr.Nonce, sr.Timestamp)
+}
+
+// SignedMessage returns the message that is signed in this session: the message
+// or, if a file is to be signed, the file digest and metadata.
+func (sr *SignatureRequest) SignedMessage() string {
+	return signedMessage(sr.Message, sr.File)
 }
 
 func (sr *SignatureRequest) SignatureFromMessage(message interface{}) (*SignedMessage, error) {
@@ -438,6 +675,7 @@ func (sr *SignatureRequest) SignatureFromMessage(message interface{}) (*SignedMe
 		Nonce:     sr.Nonce,
 		Context:   sr.Context,
 		Message:   sr.Message,
+		File:      sr.File,
 		Timestamp: sr.Timestamp,
 	}, nil
 }
@@ -448,7 +686,17 @@ func (sr *SignatureRequest) Validate() error {
 	if sr.Type != ActionSigning {
 		return errors.New("Not a signature request")
 	}
-	if sr.Message == "" {
+	if len(sr.Recipients) != 0 {
+		return errors.New("Signature request cannot have disclosure recipients")
+	}
+	if sr.File != nil {
+		if sr.Message != "" {
+			return errors.New("Signature request cannot contain both a message and a file")
+		}
+		if err := sr.File.Validate(); err != nil {
+			return err
+		}
+	} else if sr.Message == "" {
 		return errors.New("Signature request had empty message")
 	}
 	if len(sr.Content) == 0 {
@@ -670,3 +918,154 @@ func SignRequestorRequest(request RequestorRequest, alg jwt.SigningMethod, key i
 	}
 	return jwtcontents.Sign(alg, key)
 }
+
+// ClientSessionRequestJwt is the JWT in which a server sends a signed session request to a client,
+// if the QR of the session contains a request key (see Qr.RequestKey).
+type ClientSessionRequestJwt struct {
+	ServerJwt
+	// Client token of the session, i.e. the last element of the session URL, so that the signed
+	// session request cannot be used in another session
+	Session string          `json:"session"`
+	Request json.RawMessage `json:"request"`
+}
+
+func (claims *ClientSessionRequestJwt) Valid() error {
+	if claims.Type != "client_session_request" {
+		return errors.New("Session request jwt has invalid subject")
+	}
+	return nil
+}
+
+// SignClientSessionRequest returns a JWT containing the session request of the session with the
+// specified client token, signed with the private key of the request key of the session (see Qr.RequestKey).
+func SignClientSessionRequest(request SessionRequest, session string, key *ecdsa.PrivateKey) (string, error) {
+	bts, err := CanonicalJSON(request)
+	if err != nil {
+		return "", err
+	}
+	claims := &ClientSessionRequestJwt{
+		ServerJwt: ServerJwt{Type: "client_session_request", IssuedAt: Timestamp(time.Now())},
+		Session:   session,
+		Request:   bts,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+}
+
+// ParseClientSessionRequest verifies the JWT against the request key of the session with the specified
+// client token, and unmarshals the session request that it contains into request.
+func ParseClientSessionRequest(token, session string, key *ecdsa.PublicKey, request SessionRequest) error {
+	claims := &ClientSessionRequestJwt{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodES256 {
+			return nil, errors.Errorf("Session request jwt has unexpected signing method %s", t.Method.Alg())
+		}
+		return key, nil
+	})
+	if err != nil {
+		return err
+	}
+	if claims.Session != session {
+		return errors.New("Session request jwt belongs to another session")
+	}
+	return UnmarshalValidate(claims.Request, request)
+}
+
+// WalletHealth describes the health of an IRMA app, for enterprise device management systems that
+// require a healthy app before allowing access to internal requestors. It contains no attribute
+// values or other information about the user.
+type WalletHealth struct {
+	// Whether all attributes and signatures in the storage could be loaded,
+	// and if not, how many of them are damaged
+	StorageIntact bool `json:"storageIntact"`
+	StorageDamage int  `json:"storageDamage,omitempty"`
+	// Whether the storage is encrypted, and the version of its schema
+	StorageEncrypted bool `json:"storageEncrypted"`
+	StorageVersion   int  `json:"storageVersion"`
+	// The status and timestamp of each scheme
+	Schemes map[SchemeManagerIdentifier]*SchemeHealth `json:"schemes"`
+	// The protocol versions supported by the client, and the version of the app as reported by the app
+	MinProtocolVersion *ProtocolVersion `json:"minProtocolVersion"`
+	MaxProtocolVersion *ProtocolVersion `json:"maxProtocolVersion"`
+	AppVersion         string           `json:"appVersion,omitempty"`
+}
+
+// SchemeHealth describes the state of a scheme in the IRMA app.
+type SchemeHealth struct {
+	Status    SchemeManagerStatus `json:"status"`
+	Timestamp Timestamp           `json:"timestamp"`
+}
+
+// WalletHealthJwt is a JWT in which the IRMA app reports its own health, signed with its health
+// report key (see irmaclient.Client.HealthReportKey()). As the key is generated by the app, this is
+// a self-report, not an attestation of the integrity of the device or app.
+type WalletHealthJwt struct {
+	ServerJwt
+	// Chosen by the verifier, to ensure the report is fresh
+	Nonce  string        `json:"nonce"`
+	Health *WalletHealth `json:"health"`
+}
+
+func (claims *WalletHealthJwt) Valid() error {
+	if claims.Type != "wallet_health" {
+		return errors.New("Wallet health jwt has invalid subject")
+	}
+	return nil
+}
+
+// SignWalletHealth returns a JWT containing the wallet health, signed with the health report key.
+func SignWalletHealth(health *WalletHealth, nonce string, key *ecdsa.PrivateKey) (string, error) {
+	claims := &WalletHealthJwt{
+		ServerJwt: ServerJwt{Type: "wallet_health", IssuedAt: Timestamp(time.Now())},
+		Nonce:     nonce,
+		Health:    health,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+}
+
+// ParseWalletHealth verifies the JWT against the health report key of the app and the nonce
+// with which the report was requested, and returns the wallet health that it contains.
+func ParseWalletHealth(token, nonce string, key *ecdsa.PublicKey) (*WalletHealth, error) {
+	claims := &WalletHealthJwt{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodES256 {
+			return nil, errors.Errorf("Wallet health jwt has unexpected signing method %s", t.Method.Alg())
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("Wallet health jwt has unexpected nonce")
+	}
+	if claims.Health == nil {
+		return nil, errors.New("Wallet health jwt contains no wallet health")
+	}
+	return claims.Health, nil
+}
+
+// MarshalRequestKey encodes the public key for use as request key in a QR (see Qr.RequestKey).
+func MarshalRequestKey(pk *ecdsa.PublicKey) (string, error) {
+	bts, err := x509.MarshalPKIXPublicKey(pk)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bts), nil
+}
+
+// ParseRequestKey decodes the request key in a QR (see Qr.RequestKey).
+func ParseRequestKey(key string) (*ecdsa.PublicKey, error) {
+	bts, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := x509.ParsePKIXPublicKey(bts)
+	if err != nil {
+		return nil, err
+	}
+	ecpk, ok := pk.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Request key is not an ECDSA public key")
+	}
+	return ecpk, nil
+}
@@ -41,6 +41,12 @@ type Configuration struct {
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
 	// Issuer private keys
 	IssuerPrivateKeys map[irma.IssuerIdentifier]*gabi.PrivateKey `json:"-"`
+	// Files containing shares of issuer private keys, which are reassembled in memory at startup
+	IssuerPrivateKeyShareFiles []string `json:"privkey_shares" mapstructure:"privkey_shares"`
+	// Shares of issuer private keys, e.g. entered by operators, which are reassembled in memory at startup
+	IssuerPrivateKeyShares []*PrivateKeyShare `json:"-"`
+	// Backends from which issuer private keys kept in an HSM or KMS are loaded at startup
+	IssuerKeyBackends []IssuerKeyBackend `json:"-"`
 	// URL at which the IRMA app can reach this server during sessions
 	URL string `json:"url" mapstructure:"url"`
 	// Required to be set to true if URL does not begin with https:// in production mode.
@@ -65,23 +71,63 @@ type Configuration struct {
 
 	// Production mode: enables safer and stricter defaults and config checking
 	Production bool `json:"production" mapstructure:"production"`
+
+	// Validators and normalizers to run on attribute values to be issued, per attribute type identifier,
+	// in the specified order
+	AttributeValidators map[string][]*AttributeValidatorConfig `json:"attribute_validators" mapstructure:"attribute_validators"`
+
+	// Sinks to which audit events are sent (see AuditEvent)
+	AuditSinks []AuditSink `json:"-"`
+	// Include disclosed attribute values in audit events (by default only their identifiers are included)
+	AuditAttributeValues bool `json:"audit_attribute_values" mapstructure:"audit_attribute_values"`
+
+	// Amount of workers across which the proofs of multiple credentials are verified in parallel
+	// (default value 0 means the amount of CPUs, 1 disables parallel verification); see irma.ProofVerificationPool
+	ProofVerificationWorkers int `json:"proof_verification_workers" mapstructure:"proof_verification_workers"`
+
+	// Hooks called during the lifecycle of sessions (see SessionHooks)
+	Hooks []SessionHooks `json:"-"`
+	// Store in which accepted issuance commitments and client nonces are recorded, so that replayed
+	// commitments are refused (default: in memory, see NewMemoryReplayStore())
+	ReplayStore ReplayStore `json:"-"`
+
+	// ECDSA private key (PEM) with which session requests are signed when clients retrieve them; its public
+	// key is included in the QR of each session (see irma.Qr.RequestKey), so that clients reject session
+	// requests altered between this server and the client (e.g. by a reverse proxy)
+	SessionRequestPrivateKey     string `json:"session_request_privkey" mapstructure:"session_request_privkey"`
+	SessionRequestPrivateKeyFile string `json:"session_request_privkey_file" mapstructure:"session_request_privkey_file"`
+
+	// What to do with session requests asking for sensitive attributes when less would likely suffice:
+	// "warn" (default), "reject" or "off" (see CheckMinimization())
+	MinimizationPolicy string `json:"minimization_policy" mapstructure:"minimization_policy"`
 }
 
 type SessionPackage struct {
 	SessionPtr *irma.Qr `json:"sessionPtr"`
 	Token      string   `json:"token"`
+	// Guidance on disclosing less sensitive information, see CheckMinimization()
+	Warnings []*MinimizationWarning `json:"warnings,omitempty"`
 }
 
 // SessionResult contains session information such as the session status, type, possible errors,
 // and disclosed attributes or attribute-based signature if appropriate to the session type.
 type SessionResult struct {
-	Token       string                     `json:"token"`
-	Status      Status                     `json:"status"`
-	Type        irma.Action                `json:"type"'`
-	ProofStatus irma.ProofStatus           `json:"proofStatus,omitempty"`
-	Disclosed   []*irma.DisclosedAttribute `json:"disclosed,omitempty"`
-	Signature   *irma.SignedMessage        `json:"signature,omitempty"`
-	Err         *irma.RemoteError          `json:"error,omitempty"`
+	Token       string                       `json:"token"`
+	Status      Status                       `json:"status"`
+	Type        irma.Action                  `json:"type"'`
+	ProofStatus irma.ProofStatus             `json:"proofStatus,omitempty"`
+	Disclosed   []*irma.DisclosedAttribute   `json:"disclosed,omitempty"`
+	Signature   *irma.SignedMessage          `json:"signature,omitempty"`
+	Transcripts []*irma.DisclosureTranscript `json:"transcripts,omitempty"`
+	Err         *irma.RemoteError            `json:"error,omitempty"`
+
+	// If the session failed at the client, why it failed, if reported by the client
+	// (protocol version 2.7 and up) before it cancelled the session
+	ClientFailure *irma.ClientFailure `json:"clientFailure,omitempty"`
+
+	// In group issuance sessions (see irma.RequestorBaseRequest.MaxCompletions), the results of
+	// the clients that completed the session so far, in order of completion
+	Completions []*SessionResult `json:"completions,omitempty"`
 }
 
 // Status is the status of an IRMA session.
@@ -95,6 +141,26 @@ const (
 	StatusTimeout     Status = "TIMEOUT"     // Session timed out
 )
 
+// Readiness reports whether the server is ready to handle sessions, containing the outcome of each of
+// its dependency checks: the check name maps to "ok", or to a description of what is wrong.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Summary returns the readiness with the outcome of each check reduced to "ok" or "failed", for
+// reporting to parties that should not learn the details of the configuration of the server.
+func (r *Readiness) Summary() *Readiness {
+	summary := &Readiness{Ready: r.Ready, Checks: make(map[string]string, len(r.Checks))}
+	for check, result := range r.Checks {
+		if result != "ok" {
+			result = "failed"
+		}
+		summary.Checks[check] = result
+	}
+	return summary
+}
+
 func (conf *Configuration) PrivateKey(id irma.IssuerIdentifier) (sk *gabi.PrivateKey, err error) {
 	sk = conf.IssuerPrivateKeys[id]
 	if sk == nil {
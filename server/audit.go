@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+)
+
+// AuditEventType is the type of an audit event.
+type AuditEventType string
+
+const (
+	AuditSessionCreated    AuditEventType = "session_created"    // A requestor started a session
+	AuditSessionFinished   AuditEventType = "session_finished"   // A session reached a final status
+	AuditResultFetched     AuditEventType = "result_fetched"     // A requestor retrieved the result of a session
+	AuditIssuancePerformed AuditEventType = "issuance_performed" // Credentials were signed and sent to the client
+)
+
+// AuditEvent is an entry in the audit log of the server. By default it contains only the identifiers
+// of the involved attributes and credential types, and never the attribute values themselves;
+// see Configuration.AuditAttributeValues.
+type AuditEvent struct {
+	Time        time.Time                               `json:"time"`
+	Type        AuditEventType                          `json:"type"`
+	Session     string                                  `json:"session"`
+	Action      irma.Action                             `json:"action,omitempty"`
+	Status      Status                                  `json:"status,omitempty"`
+	Credentials []irma.CredentialTypeIdentifier         `json:"credentials,omitempty"`
+	Attributes  []irma.AttributeTypeIdentifier          `json:"attributes,omitempty"`
+	Values      map[irma.AttributeTypeIdentifier]string `json:"values,omitempty"`
+}
+
+// AuditSink receives audit events. Implementations should treat the event stream as append-only.
+type AuditSink interface {
+	Audit(event *AuditEvent) error
+}
+
+// Audit sends the event to all configured audit sinks. Errors from the sinks are logged, but
+// otherwise do not affect the session.
+func (conf *Configuration) Audit(event *AuditEvent) {
+	if len(conf.AuditSinks) == 0 {
+		return
+	}
+	event.Time = time.Now()
+	if !conf.AuditAttributeValues {
+		event.Values = nil
+	}
+	for _, sink := range conf.AuditSinks {
+		if err := sink.Audit(event); err != nil {
+			conf.Logger.WithFields(logrus.Fields{"type": event.Type, "session": event.Session}).
+				Error("Failed to write audit event: ", err.Error())
+		}
+	}
+}
+
+// FileAuditSink appends audit events as lines of JSON to a file.
+type FileAuditSink struct {
+	sync.Mutex
+	file *os.File
+}
+
+// NewFileAuditSink opens the specified file for appending audit events, creating it if necessary.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to open audit log", 0)
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+func (sink *FileAuditSink) Audit(event *AuditEvent) error {
+	bts, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	_, err = sink.file.Write(append(bts, '\n'))
+	return err
+}
+
+// Close closes the underlying file.
+func (sink *FileAuditSink) Close() error {
+	return sink.file.Close()
+}
+
+// WebhookAuditQueueSize is the maximum amount of audit events that a WebhookAuditSink keeps
+// waiting to be sent.
+const WebhookAuditQueueSize = 1000
+
+// WebhookAuditSink POSTs audit events as JSON to a URL, such as the REST proxy of a Kafka cluster
+// or a log collector. The events are sent in the background, so that sessions are not delayed by
+// the webhook. If WebhookAuditQueueSize events are already waiting to be sent, further events are
+// dropped, which is logged.
+type WebhookAuditSink struct {
+	sync.RWMutex
+	transport *irma.HTTPTransport
+	queue     chan []byte
+	done      chan struct{}
+	closed    bool
+}
+
+func NewWebhookAuditSink(url string) *WebhookAuditSink {
+	transport := irma.NewHTTPTransport(url)
+	transport.SetHeader("User-Agent", "irmaserver")
+	sink := &WebhookAuditSink{
+		transport: transport,
+		queue:     make(chan []byte, WebhookAuditQueueSize),
+		done:      make(chan struct{}),
+	}
+	go sink.send()
+	return sink
+}
+
+func (sink *WebhookAuditSink) Audit(event *AuditEvent) error {
+	bts, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	sink.RLock()
+	defer sink.RUnlock()
+	if sink.closed {
+		return errors.New("audit webhook closed")
+	}
+	select {
+	case sink.queue <- bts:
+		return nil
+	default:
+		return errors.New("audit webhook queue full, dropping event")
+	}
+}
+
+func (sink *WebhookAuditSink) send() {
+	defer close(sink.done)
+	for bts := range sink.queue {
+		var x string
+		if err := sink.transport.Post("", &x, json.RawMessage(bts)); err != nil {
+			Logger.Error("Failed to send audit event to webhook: ", err.Error())
+		}
+	}
+}
+
+// Close sends the audit events that are still waiting to be sent, after which it returns.
+// Later audit events are refused.
+func (sink *WebhookAuditSink) Close() error {
+	sink.Lock()
+	if !sink.closed {
+		sink.closed = true
+		close(sink.queue)
+	}
+	sink.Unlock()
+	<-sink.done
+	return nil
+}
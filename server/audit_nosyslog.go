@@ -0,0 +1,16 @@
+// +build windows plan9 nacl
+
+package server
+
+import "github.com/go-errors/errors"
+
+// SyslogAuditSink is not supported on this platform.
+type SyslogAuditSink struct{}
+
+func NewSyslogAuditSink(tag string) (*SyslogAuditSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (sink *SyslogAuditSink) Audit(event *AuditEvent) error {
+	return errors.New("syslog is not supported on this platform")
+}
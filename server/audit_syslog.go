@@ -0,0 +1,29 @@
+// +build !windows,!plan9,!nacl
+
+package server
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogAuditSink sends audit events as JSON to the local syslog daemon.
+type SyslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogAuditSink(tag string) (*SyslogAuditSink, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogAuditSink{writer: writer}, nil
+}
+
+func (sink *SyslogAuditSink) Audit(event *AuditEvent) error {
+	bts, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return sink.writer.Info(string(bts))
+}
@@ -18,6 +18,11 @@ var (
 	ErrorUnauthorized              Error = Error{Type: "UNAUTHORIZED", Status: 403, Description: "You are not authorized to issue or verify this attribute"}
 	ErrorAttributesWrong           Error = Error{Type: "ATTRIBUTES_WRONG", Status: 400, Description: "Specified attribute(s) do not belong to this credential type or missing attributes"}
 	ErrorCannotIssue               Error = Error{Type: "CANNOT_ISSUE", Status: 500, Description: "Cannot issue this credential"}
+	ErrorInvalidAttributeValue     Error = Error{Type: "INVALID_ATTRIBUTE_VALUE", Status: 400, Description: "Attribute value rejected by validator"}
+	ErrorInvalidSignature          Error = Error{Type: "INVALID_SIGNATURE", Status: 400, Description: "Attribute-based signature was invalid"}
+	ErrorAttestationRejected       Error = Error{Type: "ATTESTATION_REJECTED", Status: 403, Description: "Signature was not accepted for attestation"}
+	ErrorSessionRefused            Error = Error{Type: "SESSION_REFUSED", Status: 403, Description: "Session was refused by the server"}
+	ErrorDataMinimization          Error = Error{Type: "DATA_MINIMIZATION", Status: 400, Description: "Session request does not minimize disclosure of sensitive attributes"}
 
 	ErrorIssuanceFailed       Error = Error{Type: "ISSUANCE_FAILED", Status: 500, Description: "Failed to create credential(s)"}
 	ErrorInvalidProofs        Error = Error{Type: "INVALID_PROOFS", Status: 400, Description: "Invalid secret key commitments and/or disclosure proofs"}
@@ -26,6 +31,7 @@ var (
 	ErrorUnexpectedRequest    Error = Error{Type: "UNEXPECTED_REQUEST", Status: 403, Description: "Unexpected request in this state"}
 	ErrorUnknownPublicKey     Error = Error{Type: "UNKNOWN_PUBLIC_KEY", Status: 403, Description: "Attributes were not valid against a known public key"}
 	ErrorKeyshareProofMissing Error = Error{Type: "KEYSHARE_PROOF_MISSING", Status: 403, Description: "ProofP object from a keyshare server missing"}
+	ErrorReplayedCommitments  Error = Error{Type: "REPLAYED_COMMITMENTS", Status: 403, Description: "Commitments or nonce were already used"}
 	ErrorSessionUnknown       Error = Error{Type: "SESSION_UNKNOWN", Status: 400, Description: "Unknown or expired session"}
 	ErrorMalformedInput       Error = Error{Type: "MALFORMED_INPUT", Status: 400, Description: "Input could not be parsed"}
 	ErrorUnknown              Error = Error{Type: "EXCEPTION", Status: 500, Description: "Encountered unexpected problem"}
@@ -33,4 +39,5 @@ var (
 	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
 	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
 	ErrorProtocolVersion Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
+	ErrorShuttingDown    Error = Error{Type: "SHUTTING_DOWN", Status: 503, Description: "Server is shutting down and does not accept new sessions"}
 )
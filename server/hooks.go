@@ -0,0 +1,37 @@
+package server
+
+import (
+	"github.com/privacybydesign/irmago"
+)
+
+// SessionHooks can be implemented by deployments to add custom logic to the lifecycle of sessions,
+// such as fraud checks, enrichment of session results or custom persistence, without modifying the
+// server. Hooks are configured in Configuration.Hooks, and are called in the order in which they are
+// configured. They are called while the session is not locked, so they may take long, and may use the
+// server to access the same session. Embed NopSessionHooks to implement only some of the hooks.
+type SessionHooks interface {
+	// OnSessionCreated is called when a requestor starts a session. If it returns an error, the
+	// session is not started; the error is logged, and a generic error is returned to the requestor.
+	OnSessionCreated(token string, request irma.RequestorRequest) error
+	// OnClientConnected is called when the client retrieves the session request, before the protocol
+	// version is negotiated. If it returns an error, the session is cancelled; the error is logged, and
+	// ErrorSessionRefused is returned to the client without the error message.
+	OnClientConnected(token string, request irma.SessionRequest) error
+	// OnResult is called with a copy of the result when a session is done or cancelled (or, in group
+	// issuance sessions, when a client completed it), e.g. to persist or enrich it elsewhere.
+	OnResult(result *SessionResult)
+	// OnExpiry is called when a session times out.
+	OnExpiry(token string)
+}
+
+// NopSessionHooks implements SessionHooks without doing anything.
+type NopSessionHooks struct{}
+
+func (NopSessionHooks) OnSessionCreated(token string, request irma.RequestorRequest) error {
+	return nil
+}
+func (NopSessionHooks) OnClientConnected(token string, request irma.SessionRequest) error {
+	return nil
+}
+func (NopSessionHooks) OnResult(result *SessionResult) {}
+func (NopSessionHooks) OnExpiry(token string)          {}
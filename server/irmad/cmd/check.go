@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"encoding/json"
+	"sort"
+	"strings"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/server/requestorserver"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var CheckCommand = &cobra.Command{
@@ -15,24 +18,63 @@ var CheckCommand = &cobra.Command{
 configuration file, command line flags, or environmental variables, and checks
 that the configuration is valid.
 
-Specify -v to see the configuration.`,
+Specify -v to see the configuration. Running the main command with --check-config
+is equivalent.`,
 	Run: func(command *cobra.Command, args []string) {
 		if err := configure(command); err != nil {
 			die(errors.WrapPrefix(err, "Failed to read configuration from file, args, or env vars", 0))
 		}
+		checkConfiguration(command)
+	},
+}
 
-		// Hack: temporarily disable scheme updating to prevent verifyConfiguration() from immediately updating schemes
-		enabled := conf.DisableSchemesUpdate
-		conf.DisableSchemesUpdate = true
+// checkConfiguration validates the configuration read by configure(), and dies if it is invalid.
+func checkConfiguration(command *cobra.Command) {
+	if unknown := unknownConfigKeys(command); len(unknown) > 0 {
+		die(errors.Errorf("Unknown option(s) in configuration file %s: %s",
+			viper.ConfigFileUsed(), strings.Join(unknown, ", ")))
+	}
 
-		if _, err := requestorserver.New(conf); err != nil {
-			die(errors.WrapPrefix(err, "Invalid configuration", 0))
-		}
+	// Hack: temporarily disable scheme updating to prevent verifyConfiguration() from immediately updating schemes
+	enabled := conf.DisableSchemesUpdate
+	conf.DisableSchemesUpdate = true
 
-		conf.DisableSchemesUpdate = enabled // restore previous value before printing configuration
-		bts, _ := json.MarshalIndent(conf, "", "   ")
-		conf.Logger.Debug("Configuration: ", string(bts), "\n")
-	},
+	if _, err := requestorserver.New(conf); err != nil {
+		die(errors.WrapPrefix(err, "Invalid configuration", 0))
+	}
+
+	conf.DisableSchemesUpdate = enabled // restore previous value before printing configuration
+	bts, _ := json.MarshalIndent(conf, "", "   ")
+	conf.Logger.Debug("Configuration: ", string(bts), "\n")
+	conf.Logger.Info("Configuration is valid")
+}
+
+// unknownConfigKeys returns the top-level keys from the configuration file, if any, that do not
+// correspond to a flag of the specified command.
+func unknownConfigKeys(command *cobra.Command) []string {
+	if viper.ConfigFileUsed() == "" {
+		return nil
+	}
+	v := viper.New()
+	v.SetConfigFile(viper.ConfigFileUsed())
+	if err := v.ReadInConfig(); err != nil {
+		return nil // already reported by configure()
+	}
+
+	var unknown []string
+	seen := map[string]bool{}
+	for _, key := range v.AllKeys() {
+		key = strings.Split(key, ".")[0]
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if command.Flags().Lookup(strings.Replace(key, "_", "-", -1)) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
 }
 
 func init() {
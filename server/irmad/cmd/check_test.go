@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownConfigKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irmad")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer viper.Reset()
+
+	// Without a configuration file nothing is reported
+	require.Empty(t, unknownConfigKeys(RootCommand))
+
+	file := filepath.Join(dir, "irmaserver.yml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+port: 8088
+schemes_path: /tmp
+no_auth: true
+requestors:
+  myapp:
+    auth_method: token
+    key: secret
+shemes_update: 10
+unknown:
+  nested: true
+`), 0600))
+	viper.SetConfigFile(file)
+	require.Equal(t, []string{"shemes_update", "unknown"}, unknownConfigKeys(RootCommand))
+	require.Equal(t, []string{"shemes_update", "unknown"}, unknownConfigKeys(CheckCommand))
+}
@@ -1,11 +1,16 @@
 package cmd
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/mitchellh/mapstructure"
@@ -27,6 +32,10 @@ var RootCommand = &cobra.Command{
 		if err := configure(command); err != nil {
 			die(errors.WrapPrefix(err, "Failed to read configuration", 0))
 		}
+		if viper.GetBool("check-config") {
+			checkConfiguration(command)
+			return
+		}
 		serv, err := requestorserver.New(conf)
 		if err != nil {
 			die(errors.WrapPrefix(err, "Failed to configure server", 0))
@@ -35,6 +44,8 @@ var RootCommand = &cobra.Command{
 		stopped := make(chan struct{})
 		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
 
 		go func() {
 			if err := serv.Start(conf); err != nil {
@@ -48,12 +59,21 @@ var RootCommand = &cobra.Command{
 			select {
 			case <-interrupt:
 				conf.Logger.Debug("Caught interrupt")
-				serv.Stop() // causes serv.Start() above to return
+				signal.Stop(interrupt) // a second interrupt kills the process
+				// causes serv.Start() above to return
+				serv.Shutdown(time.Duration(conf.ShutdownTimeout) * time.Second)
 				conf.Logger.Debug("Sent stop signal to server")
+			case <-hangup:
+				conf.Logger.Info("Caught SIGHUP, reloading")
+				if err := serv.Reload(); err != nil {
+					conf.Logger.Error("Reloading failed, continuing with previous configuration: ", err.Error())
+				}
 			case <-stopped:
 				conf.Logger.Info("Exiting")
+				signal.Stop(hangup)
 				close(stopped)
 				close(interrupt)
+				close(hangup)
 				return
 			}
 		}
@@ -104,10 +124,25 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("schemes-assets-path", "", "if specified, copy schemes from here into --schemes-path")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
 	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
+	flags.StringSlice("privkey-shares", nil, "files containing shares of IRMA private keys, reassembled in memory at startup")
+	flags.Int("privkey-shares-stdin", 0, "read this many shares of IRMA private keys from stdin at startup, one per line")
+	flags.String("privkeys-encrypted", "", "path to IRMA private keys encrypted using a key in Vault, a PKCS#11 HSM or Google Cloud KMS")
+	flags.String("vault-url", "", "URL of HashiCorp Vault server with which encrypted IRMA private keys are decrypted")
+	flags.String("vault-token-file", "", "file containing the Vault token (default: $VAULT_TOKEN)")
+	flags.String("vault-transit-key", "", "name of the key in the Vault transit secrets engine")
+	flags.String("pkcs11-module", "", "path to PKCS#11 library of HSM with which encrypted IRMA private keys are decrypted (requires building with the pkcs11 tag)")
+	flags.String("pkcs11-token", "", "label of the PKCS#11 token")
+	flags.String("pkcs11-pin-file", "", "file containing the PIN of the PKCS#11 token (default: $PKCS11_PIN)")
+	flags.String("pkcs11-key", "", "label of the AES key in the PKCS#11 token")
+	flags.String("gcp-kms-key", "", "resource name of Google Cloud KMS key with which encrypted IRMA private keys are decrypted")
+	flags.String("gcp-token-file", "", "file containing the Google Cloud access token (default: $GOOGLE_OAUTH_ACCESS_TOKEN)")
 	flags.String("static-path", "", "Host files under this path as static files (leave empty to disable)")
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
 	flags.StringP("url", "u", defaulturl, "external URL to server to which the IRMA client connects")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
+	flags.Int("shutdown-timeout", 30, "on SIGTERM, wait at most x seconds for sessions in progress to finish")
+	flags.Int("proof-verification-workers", 0, "verify proofs across at most x goroutines (0 means amount of CPUs)")
+	flags.String("minimization-policy", "warn", "on requests for sensitive attributes when less would suffice: warn, reject or off")
 
 	flags.IntP("port", "p", 8088, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
@@ -130,6 +165,8 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("jwt-privkey", "", "JWT private key")
 	flags.String("jwt-privkey-file", "", "path to JWT private key")
 	flags.Int("max-request-age", 300, "max age in seconds of a session request JWT")
+	flags.String("session-request-privkey", "", "ECDSA private key with which session requests are signed for the IRMA app")
+	flags.String("session-request-privkey-file", "", "path to ECDSA private key with which session requests are signed for the IRMA app")
 	flags.Lookup("jwt-issuer").Header = `JWT configuration`
 
 	flags.String("tls-cert", "", "TLS certificate (chain)")
@@ -143,6 +180,16 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.Bool("no-tls", false, "Disable TLS")
 	flags.Lookup("tls-cert").Header = "TLS configuration (leave empty to disable TLS)"
 
+	flags.String("attribute-validators", "", "validators/normalizers for attribute values to be issued (in JSON)")
+	flags.Lookup("attribute-validators").Header = "Issuance"
+	flags.String("attestation", "", "issue credentials attesting to attribute-based signatures submitted at /attestation (in JSON)")
+
+	flags.String("audit-log", "", "append audit events to this file")
+	flags.Bool("audit-syslog", false, "send audit events to syslog")
+	flags.String("audit-webhook", "", "POST audit events to this URL")
+	flags.Bool("audit-attribute-values", false, "include disclosed attribute values in audit events")
+	flags.Lookup("audit-log").Header = "Audit log (no attribute values are logged unless --audit-attribute-values is set)"
+
 	flags.StringP("email", "e", "", "Email address of server admin, for incidental notifications such as breaking API changes")
 	flags.Bool("no-email", !production, "Opt out of prodiding an email address with --email")
 	flags.Lookup("email").Header = "Email address (see README for more info)"
@@ -151,6 +198,7 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.BoolP("quiet", "q", false, "quiet")
 	flags.Bool("log-json", false, "Log in JSON format")
 	flags.Bool("production", false, "Production mode")
+	flags.Bool("check-config", false, "Check configuration for validity, then exit")
 	flags.Lookup("verbose").Header = `Other options`
 
 	return nil
@@ -199,25 +247,37 @@ func configure(cmd *cobra.Command) error {
 		}
 	} else {
 		logger.Info("Config file: ", viper.ConfigFileUsed())
+		if unknown := unknownConfigKeys(cmd); len(unknown) > 0 {
+			logger.Warn("Ignoring unknown option(s) in configuration file: ", strings.Join(unknown, ", "))
+		}
 	}
 
 	// Read configuration from flags and/or environmental variables
 	conf = &requestorserver.Configuration{
 		Configuration: &server.Configuration{
-			SchemesPath:           viper.GetString("schemes-path"),
-			SchemesAssetsPath:     viper.GetString("schemes-assets-path"),
-			SchemesUpdateInterval: viper.GetInt("schemes-update"),
-			DisableSchemesUpdate:  viper.GetInt("schemes-update") == 0,
-			IssuerPrivateKeysPath: viper.GetString("privkeys"),
-			URL:        viper.GetString("url"),
-			DisableTLS: viper.GetBool("no-tls"),
-			Email:      viper.GetString("email"),
-			EnableSSE:  viper.GetBool("sse"),
-			Verbose:    viper.GetInt("verbose"),
-			Quiet:      viper.GetBool("quiet"),
-			LogJSON:    viper.GetBool("log-json"),
-			Logger:     logger,
-			Production: viper.GetBool("production"),
+			SchemesPath:                viper.GetString("schemes-path"),
+			SchemesAssetsPath:          viper.GetString("schemes-assets-path"),
+			SchemesUpdateInterval:      viper.GetInt("schemes-update"),
+			DisableSchemesUpdate:       viper.GetInt("schemes-update") == 0,
+			IssuerPrivateKeysPath:      viper.GetString("privkeys"),
+			IssuerPrivateKeyShareFiles: viper.GetStringSlice("privkey-shares"),
+			URL:                        viper.GetString("url"),
+			DisableTLS:                 viper.GetBool("no-tls"),
+			Email:                      viper.GetString("email"),
+			EnableSSE:                  viper.GetBool("sse"),
+			Verbose:                    viper.GetInt("verbose"),
+			Quiet:                      viper.GetBool("quiet"),
+			LogJSON:                    viper.GetBool("log-json"),
+			Logger:                     logger,
+			Production:                 viper.GetBool("production"),
+
+			AuditAttributeValues:     viper.GetBool("audit-attribute-values"),
+			ProofVerificationWorkers: viper.GetInt("proof-verification-workers"),
+
+			SessionRequestPrivateKey:     viper.GetString("session-request-privkey"),
+			SessionRequestPrivateKeyFile: viper.GetString("session-request-privkey-file"),
+
+			MinimizationPolicy: viper.GetString("minimization-policy"),
 		},
 		Permissions: requestorserver.Permissions{
 			Disclosing: handlePermission("disclose-perms"),
@@ -236,6 +296,7 @@ func configure(cmd *cobra.Command) error {
 		MaxRequestAge:                  viper.GetInt("max-request-age"),
 		StaticPath:                     viper.GetString("static-path"),
 		StaticPrefix:                   viper.GetString("static-prefix"),
+		ShutdownTimeout:                viper.GetInt("shutdown-timeout"),
 
 		TlsCertificate:           viper.GetString("tls-cert"),
 		TlsCertificateFile:       viper.GetString("tls-cert-file"),
@@ -256,6 +317,71 @@ func configure(cmd *cobra.Command) error {
 		}
 	}
 
+	// Handle private key shares entered by operators
+	if count := viper.GetInt("privkey-shares-stdin"); count > 0 {
+		if conf.IssuerPrivateKeyShares, err = readPrivateKeyShares(count); err != nil {
+			return err
+		}
+	}
+
+	// Handle private keys encrypted using Vault, a PKCS#11 HSM or Google Cloud KMS
+	if path := viper.GetString("privkeys-encrypted"); path != "" {
+		decrypter, err := keyCipher()
+		if err != nil {
+			return errors.WrapPrefix(err, "--privkeys-encrypted", 0)
+		}
+		conf.IssuerKeyBackends = append(conf.IssuerKeyBackends, &server.EncryptedKeysBackend{
+			Path:      path,
+			Decrypter: decrypter,
+		})
+	}
+
+	// Handle audit sinks
+	if path := viper.GetString("audit-log"); path != "" {
+		sink, err := server.NewFileAuditSink(path)
+		if err != nil {
+			return err
+		}
+		conf.AuditSinks = append(conf.AuditSinks, sink)
+	}
+	if viper.GetBool("audit-syslog") {
+		sink, err := server.NewSyslogAuditSink("irmaserver")
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to connect to syslog", 0)
+		}
+		conf.AuditSinks = append(conf.AuditSinks, sink)
+	}
+	if url := viper.GetString("audit-webhook"); url != "" {
+		conf.AuditSinks = append(conf.AuditSinks, server.NewWebhookAuditSink(url))
+	}
+
+	// Handle attribute validators
+	var validators map[string]interface{}
+	if val, flagOrEnv := viper.Get("attribute-validators").(string); !flagOrEnv || val != "" {
+		if validators, err = cast.ToStringMapE(viper.Get("attribute-validators")); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal attribute validators from flag or env var", 0)
+		}
+	}
+	if len(validators) > 0 {
+		if err := mapstructure.Decode(validators, &conf.AttributeValidators); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal attribute validators from config file", 0)
+		}
+	}
+
+	// Handle attestation
+	var attestation map[string]interface{}
+	if val, flagOrEnv := viper.Get("attestation").(string); !flagOrEnv || val != "" {
+		if attestation, err = cast.ToStringMapE(viper.Get("attestation")); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal attestation configuration from flag or env var", 0)
+		}
+	}
+	if len(attestation) > 0 {
+		conf.Attestation = &requestorserver.AttestationConfiguration{}
+		if err := mapstructure.Decode(attestation, conf.Attestation); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal attestation configuration from config file", 0)
+		}
+	}
+
 	// Handle requestors
 	var requestors map[string]interface{}
 	if val, flagOrEnv := viper.Get("requestors").(string); !flagOrEnv || val != "" {
@@ -274,6 +400,72 @@ func configure(cmd *cobra.Command) error {
 	return nil
 }
 
+// readPrivateKeyShares reads the specified amount of JSON-serialized private key shares from
+// stdin, one per line, so that each operator can enter their share without it touching the disk.
+func readPrivateKeyShares(count int) ([]*server.PrivateKeyShare, error) {
+	var shares []*server.PrivateKeyShare
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 1<<20)
+	for len(shares) < count {
+		fmt.Fprintf(os.Stderr, "Enter private key share %d of %d: ", len(shares)+1, count)
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.Errorf("Expected %d private key shares on stdin, got %d", count, len(shares))
+		}
+		share := &server.PrivateKeyShare{}
+		if err := json.Unmarshal(scanner.Bytes(), share); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to parse private key share", 0)
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// keyCipher returns the HSM or KMS configured to decrypt encrypted private keys.
+func keyCipher() (server.KeyCipher, error) {
+	settings := &server.KeyCipherSettings{
+		VaultURL:          viper.GetString("vault-url"),
+		VaultTransitKey:   viper.GetString("vault-transit-key"),
+		PKCS11Module:      viper.GetString("pkcs11-module"),
+		PKCS11Token:       viper.GetString("pkcs11-token"),
+		PKCS11Key:         viper.GetString("pkcs11-key"),
+		GoogleCloudKMSKey: viper.GetString("gcp-kms-key"),
+	}
+	var err error
+	if settings.VaultURL != "" {
+		if settings.VaultToken, err = readSecret("vault-token-file", "VAULT_TOKEN"); err != nil {
+			return nil, err
+		}
+	}
+	if settings.PKCS11Module != "" {
+		if settings.PKCS11PIN, err = readSecret("pkcs11-pin-file", "PKCS11_PIN"); err != nil {
+			return nil, err
+		}
+	}
+	if settings.GoogleCloudKMSKey != "" {
+		if settings.GoogleCloudKMSToken, err = readSecret("gcp-token-file", "GOOGLE_OAUTH_ACCESS_TOKEN"); err != nil {
+			return nil, err
+		}
+	}
+	return settings.Cipher()
+}
+
+// readSecret reads a secret from the file specified by the flag, or else from the environment
+// variable. Secrets are not accepted as flags, which would expose them in the process list.
+func readSecret(flag, env string) (string, error) {
+	path := viper.GetString(flag)
+	if path == "" {
+		return os.Getenv(env), nil
+	}
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.WrapPrefix(err, "Failed to read --"+flag, 0)
+	}
+	return strings.TrimSpace(string(bts)), nil
+}
+
 func handlePermission(typ string) []string {
 	if !viper.IsSet(typ) && (!viper.GetBool("production") || typ != "issue-perms") {
 		return []string{"*"}
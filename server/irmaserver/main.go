@@ -7,6 +7,7 @@ package irmaserver
 import (
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
@@ -53,6 +54,40 @@ func (s *Server) Stop() {
 	s.Server.Stop()
 }
 
+// Drain stops the server from accepting new sessions and waits until all sessions in progress
+// have finished, or until the timeout has passed. It returns the amount of unfinished sessions.
+func Drain(timeout time.Duration) int {
+	return s.Drain(timeout)
+}
+func (s *Server) Drain(timeout time.Duration) int {
+	return s.Server.Drain(timeout)
+}
+
+// Reload re-parses the IRMA schemes and issuer private keys from disk, without affecting
+// sessions in progress.
+func Reload() error {
+	return s.Reload()
+}
+func (s *Server) Reload() error {
+	return s.Server.Reload()
+}
+
+// IrmaConfiguration returns the IRMA configuration currently in use, which is replaced by Reload().
+func IrmaConfiguration() *irma.Configuration {
+	return s.IrmaConfiguration()
+}
+func (s *Server) IrmaConfiguration() *irma.Configuration {
+	return s.Server.IrmaConfiguration()
+}
+
+// Readiness reports if the server is able to handle sessions.
+func Readiness() *server.Readiness {
+	return s.Readiness()
+}
+func (s *Server) Readiness() *server.Readiness {
+	return s.Server.Readiness()
+}
+
 // StartSession starts an IRMA session, running the handler on completion, if specified.
 // The session token (the second return parameter) can be used in GetSessionResult()
 // and CancelSession().
@@ -88,6 +123,33 @@ func (s *Server) GetRequest(token string) irma.RequestorRequest {
 	return s.Server.GetRequest(token)
 }
 
+// GetMinimizationWarnings retrieves the data minimization warnings of the request of the specified
+// IRMA session, see server.CheckMinimization().
+func GetMinimizationWarnings(token string) []*server.MinimizationWarning {
+	return s.GetMinimizationWarnings(token)
+}
+func (s *Server) GetMinimizationWarnings(token string) []*server.MinimizationWarning {
+	return s.Server.GetMinimizationWarnings(token)
+}
+
+// GetIssuanceResults retrieves which of the issued credentials the clients that completed the
+// specified IRMA issuance session could construct, as reported by the clients.
+func GetIssuanceResults(token string) ([][]*irma.CredentialIssuanceResult, error) {
+	return s.GetIssuanceResults(token)
+}
+func (s *Server) GetIssuanceResults(token string) ([][]*irma.CredentialIssuanceResult, error) {
+	return s.Server.GetIssuanceResults(token)
+}
+
+// GetConfirmationCode retrieves the confirmation code that the client sent in the specified IRMA
+// session started from a deep link, for the app or website that started the session to show to the user.
+func GetConfirmationCode(token string) (string, error) {
+	return s.GetConfirmationCode(token)
+}
+func (s *Server) GetConfirmationCode(token string) (string, error) {
+	return s.Server.GetConfirmationCode(token)
+}
+
 // CancelSession cancels the specified IRMA session.
 func CancelSession(token string) error {
 	return s.CancelSession(token)
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains backends from which the server obtains issuer private keys that are kept
+// in a hardware security module (HSM) or cloud key management service (KMS), so that the raw private
+// keys never reside on the disk of the server. Issuing a credential requires the private key itself,
+// which HSMs and KMSs cannot use, so the private keys are stored on disk encrypted under a key that
+// never leaves the HSM or KMS, and are only decrypted in memory when the server starts.
+//
+// Encrypted private keys use envelope encryption: the private key is encrypted using AES-GCM with a
+// random data key, which is itself encrypted by the HSM or KMS (see EncryptPrivateKey()). This way the
+// size limits that most HSMs and KMSs impose on data they encrypt do not apply to the private key.
+// The HSM or KMS is accessed through a KeyEncrypter and KeyDecrypter, which are implemented for the
+// transit secrets engine of HashiCorp Vault (VaultTransit), for Google Cloud KMS (GoogleCloudKMS), and
+// for HSMs through their PKCS#11 library (PKCS11, see keybackend_pkcs11.go; only in builds with the
+// pkcs11 tag, as it requires cgo).
+
+// IssuerKeyBackend provides issuer private keys to the server (see Configuration.IssuerKeyBackends).
+type IssuerKeyBackend interface {
+	// PrivateKeys returns the issuer private keys held by the backend.
+	PrivateKeys() (map[irma.IssuerIdentifier]*gabi.PrivateKey, error)
+}
+
+// KeyEncrypter encrypts data keys using a key in an HSM or KMS.
+type KeyEncrypter interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+}
+
+// KeyDecrypter decrypts data keys encrypted by the corresponding KeyEncrypter.
+type KeyDecrypter interface {
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// KeyCipher is a KeyEncrypter and KeyDecrypter.
+type KeyCipher interface {
+	KeyEncrypter
+	KeyDecrypter
+}
+
+// KeyCipherSettings specifies the HSM or KMS with which issuer private keys are encrypted;
+// exactly one of VaultURL, PKCS11Module and GoogleCloudKMSKey must be set.
+type KeyCipherSettings struct {
+	VaultURL        string
+	VaultToken      string
+	VaultTransitKey string
+
+	PKCS11Module string
+	PKCS11Token  string
+	PKCS11PIN    string
+	PKCS11Key    string
+
+	GoogleCloudKMSKey   string
+	GoogleCloudKMSToken string
+}
+
+// Cipher returns the KeyCipher for the HSM or KMS specified by the settings.
+func (s *KeyCipherSettings) Cipher() (KeyCipher, error) {
+	count := 0
+	for _, val := range []string{s.VaultURL, s.PKCS11Module, s.GoogleCloudKMSKey} {
+		if val != "" {
+			count++
+		}
+	}
+	if count != 1 {
+		return nil, errors.New("Exactly one of Vault, PKCS#11 and Google Cloud KMS must be configured")
+	}
+	switch {
+	case s.VaultURL != "":
+		if s.VaultToken == "" || s.VaultTransitKey == "" {
+			return nil, errors.New("Vault requires a token and transit key")
+		}
+		return NewVaultTransit(s.VaultURL, s.VaultToken, s.VaultTransitKey), nil
+	case s.PKCS11Module != "":
+		if s.PKCS11Token == "" || s.PKCS11Key == "" {
+			return nil, errors.New("PKCS#11 requires a token label and key label")
+		}
+		return NewPKCS11(s.PKCS11Module, s.PKCS11Token, s.PKCS11PIN, s.PKCS11Key)
+	default:
+		if s.GoogleCloudKMSToken == "" {
+			return nil, errors.New("Google Cloud KMS requires an access token")
+		}
+		return NewGoogleCloudKMS(s.GoogleCloudKMSKey, s.GoogleCloudKMSToken), nil
+	}
+}
+
+// EncryptedPrivateKey is an issuer private key encrypted using envelope encryption.
+type EncryptedPrivateKey struct {
+	Issuer     irma.IssuerIdentifier `json:"issuer"`
+	Counter    uint                  `json:"counter"`
+	DataKey    []byte                `json:"datakey"` // Encrypted by the HSM or KMS
+	Nonce      []byte                `json:"nonce"`
+	Ciphertext []byte                `json:"ciphertext"`
+}
+
+// EncryptPrivateKey encrypts the private key of the issuer using a random data key,
+// which is encrypted using the encrypter.
+func EncryptPrivateKey(issuer irma.IssuerIdentifier, sk *gabi.PrivateKey, encrypter KeyEncrypter) (*EncryptedPrivateKey, error) {
+	var buf bytes.Buffer
+	if _, err := sk.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newDataKeyCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	esk := &EncryptedPrivateKey{Issuer: issuer, Counter: sk.Counter, Nonce: make([]byte, aead.NonceSize())}
+	if _, err = rand.Read(esk.Nonce); err != nil {
+		return nil, err
+	}
+	esk.Ciphertext = aead.Seal(nil, esk.Nonce, buf.Bytes(), esk.additionalData())
+	if esk.DataKey, err = encrypter.Encrypt(key); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to encrypt data key", 0)
+	}
+	return esk, nil
+}
+
+// Decrypt decrypts the private key, using the decrypter to decrypt its data key.
+func (esk *EncryptedPrivateKey) Decrypt(decrypter KeyDecrypter) (*gabi.PrivateKey, error) {
+	key, err := decrypter.Decrypt(esk.DataKey)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to decrypt data key", 0)
+	}
+	aead, err := newDataKeyCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	bts, err := aead.Open(nil, esk.Nonce, esk.Ciphertext, esk.additionalData())
+	if err != nil {
+		return nil, errors.Errorf("Failed to decrypt private key %s-%d", esk.Issuer, esk.Counter)
+	}
+	sk, err := gabi.NewPrivateKeyFromXML(string(bts))
+	if err != nil {
+		return nil, err
+	}
+	if sk.Counter != esk.Counter {
+		return nil, errors.Errorf("Encrypted private key %s-%d has counter %d", esk.Issuer, esk.Counter, sk.Counter)
+	}
+	return sk, nil
+}
+
+// additionalData binds the ciphertext to the issuer and counter of the private key.
+func (esk *EncryptedPrivateKey) additionalData() []byte {
+	bts, _ := json.Marshal([]interface{}{esk.Issuer, esk.Counter})
+	return bts
+}
+
+func newDataKeyCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedKeysBackend is an IssuerKeyBackend that decrypts the JSON-serialized EncryptedPrivateKeys
+// in the .json files of a directory, using the HSM or KMS that encrypted them. If the Decrypter is an
+// io.Closer, it is closed once the private keys have been decrypted.
+type EncryptedKeysBackend struct {
+	Path      string
+	Decrypter KeyDecrypter
+}
+
+func (b *EncryptedKeysBackend) PrivateKeys() (map[irma.IssuerIdentifier]*gabi.PrivateKey, error) {
+	if closer, ok := b.Decrypter.(io.Closer); ok {
+		defer closer.Close()
+	}
+	files, err := ioutil.ReadDir(b.Path)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[irma.IssuerIdentifier]*gabi.PrivateKey{}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		bts, err := ioutil.ReadFile(filepath.Join(b.Path, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		esk := &EncryptedPrivateKey{}
+		if err = json.Unmarshal(bts, esk); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to parse encrypted private key "+file.Name(), 0)
+		}
+		sk, err := esk.Decrypt(b.Decrypter)
+		if err != nil {
+			return nil, err
+		}
+		if existing := keys[esk.Issuer]; existing == nil || existing.Counter < sk.Counter {
+			keys[esk.Issuer] = sk
+		}
+	}
+	return keys, nil
+}
+
+// kmsClient posts JSON requests to the REST API of a KMS. Unlike irma.HTTPTransport it does not
+// log requests and responses, as these contain data keys.
+type kmsClient struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newKMSClient(url string, headers map[string]string) *kmsClient {
+	return &kmsClient{
+		url:     strings.TrimSuffix(url, "/") + "/",
+		headers: headers,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *kmsClient) post(path string, object, result interface{}) error {
+	bts, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url+path, bytes.NewReader(bts))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, val := range c.headers {
+		req.Header.Set(name, val)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if bts, err = ioutil.ReadAll(res.Body); err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("KMS returned status %d: %s", res.StatusCode, strings.TrimSpace(string(bts)))
+	}
+	return json.Unmarshal(bts, result)
+}
+
+// VaultTransit is a KeyEncrypter and KeyDecrypter using a key in the transit secrets engine
+// of HashiCorp Vault.
+type VaultTransit struct {
+	client *kmsClient
+	key    string
+}
+
+// NewVaultTransit returns a VaultTransit for the specified key of the transit secrets engine
+// mounted at "transit" at the Vault server, authenticating using the specified token.
+func NewVaultTransit(url, token, key string) *VaultTransit {
+	return &VaultTransit{client: newKMSClient(url, map[string]string{"X-Vault-Token": token}), key: key}
+}
+
+type vaultTransitResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext,omitempty"`
+		Plaintext  string `json:"plaintext,omitempty"`
+	} `json:"data"`
+}
+
+func (v *VaultTransit) Encrypt(plaintext []byte) ([]byte, error) {
+	res := &vaultTransitResponse{}
+	err := v.client.post("v1/transit/encrypt/"+v.key,
+		map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}, res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Data.Ciphertext == "" {
+		return nil, errors.New("Vault returned no ciphertext")
+	}
+	return []byte(res.Data.Ciphertext), nil
+}
+
+func (v *VaultTransit) Decrypt(ciphertext []byte) ([]byte, error) {
+	res := &vaultTransitResponse{}
+	err := v.client.post("v1/transit/decrypt/"+v.key,
+		map[string]string{"ciphertext": string(ciphertext)}, res)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Data.Plaintext)
+}
+
+// GoogleCloudKMS is a KeyEncrypter and KeyDecrypter using a symmetric key in Google Cloud KMS.
+type GoogleCloudKMS struct {
+	client *kmsClient
+	key    string
+}
+
+// NewGoogleCloudKMS returns a GoogleCloudKMS for the specified key, i.e. its resource name
+// projects/.../locations/.../keyRings/.../cryptoKeys/..., authenticating using the specified
+// OAuth 2.0 access token (e.g. as returned by "gcloud auth print-access-token").
+func NewGoogleCloudKMS(key, token string) *GoogleCloudKMS {
+	return &GoogleCloudKMS{
+		client: newKMSClient("https://cloudkms.googleapis.com", map[string]string{"Authorization": "Bearer " + token}),
+		key:    key,
+	}
+}
+
+type googleCloudKMSMessage struct {
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+func (g *GoogleCloudKMS) Encrypt(plaintext []byte) ([]byte, error) {
+	res := &googleCloudKMSMessage{}
+	if err := g.client.post("v1/"+g.key+":encrypt", &googleCloudKMSMessage{Plaintext: plaintext}, res); err != nil {
+		return nil, err
+	}
+	if len(res.Ciphertext) == 0 {
+		return nil, errors.New("Google Cloud KMS returned no ciphertext")
+	}
+	return res.Ciphertext, nil
+}
+
+func (g *GoogleCloudKMS) Decrypt(ciphertext []byte) ([]byte, error) {
+	res := &googleCloudKMSMessage{}
+	if err := g.client.post("v1/"+g.key+":decrypt", &googleCloudKMSMessage{Ciphertext: ciphertext}, res); err != nil {
+		return nil, err
+	}
+	return res.Plaintext, nil
+}
@@ -0,0 +1,27 @@
+// +build !pkcs11
+
+package server
+
+import "github.com/go-errors/errors"
+
+// PKCS11 is not supported in this build: the PKCS#11 backend requires cgo, so that it is only
+// included in builds with the pkcs11 tag (see keybackend_pkcs11.go).
+type PKCS11 struct{}
+
+var errNoPKCS11 = errors.New("PKCS#11 is not supported in this build; build with the pkcs11 tag to use it")
+
+func NewPKCS11(module, tokenLabel, pin, keyLabel string) (*PKCS11, error) {
+	return nil, errNoPKCS11
+}
+
+func (p *PKCS11) Encrypt(plaintext []byte) ([]byte, error) {
+	return nil, errNoPKCS11
+}
+
+func (p *PKCS11) Decrypt(ciphertext []byte) ([]byte, error) {
+	return nil, errNoPKCS11
+}
+
+func (p *PKCS11) Close() error {
+	return nil
+}
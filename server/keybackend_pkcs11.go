@@ -0,0 +1,156 @@
+// +build pkcs11
+
+package server
+
+import (
+	"crypto/rand"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/miekg/pkcs11"
+)
+
+const pkcs11NonceSize = 12
+
+// PKCS11 is a KeyEncrypter and KeyDecrypter using an AES key in an HSM, accessed through the
+// PKCS#11 library of the HSM. Data keys are encrypted using AES-GCM (CKM_AES_GCM) within the HSM;
+// the random nonce is prepended to the ciphertext. As the PKCS#11 library is loaded using cgo, it is
+// only available in builds with the pkcs11 tag (see keybackend_nopkcs11.go).
+type PKCS11 struct {
+	sync.Mutex // PKCS#11 sessions must not be used concurrently
+
+	ctx      *pkcs11.Ctx
+	session  pkcs11.SessionHandle
+	key      pkcs11.ObjectHandle
+	opened   bool
+	loggedIn bool
+}
+
+// NewPKCS11 loads the PKCS#11 library at the specified path, logs in to the token having the
+// specified label using the PIN, and looks up the AES key having the specified label.
+// Close() must be called when the PKCS11 is no longer used.
+func NewPKCS11(module, tokenLabel, pin, keyLabel string) (*PKCS11, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, errors.Errorf("Failed to load PKCS#11 library %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, errors.WrapPrefix(err, "Failed to initialize PKCS#11 library", 0)
+	}
+	p := &PKCS11{ctx: ctx}
+	if err := p.open(tokenLabel, pin, keyLabel); err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PKCS11) open(tokenLabel, pin, keyLabel string) error {
+	slots, err := p.ctx.GetSlotList(true)
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		info, err := p.ctx.GetTokenInfo(slot)
+		if err != nil {
+			return err
+		}
+		if info.Label != tokenLabel {
+			continue
+		}
+		if p.session, err = p.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION); err != nil {
+			return err
+		}
+		p.opened = true
+		if err = p.ctx.Login(p.session, pkcs11.CKU_USER, pin); err != nil {
+			return errors.WrapPrefix(err, "Failed to log in to PKCS#11 token", 0)
+		}
+		p.loggedIn = true
+		return p.findKey(keyLabel)
+	}
+	return errors.Errorf("PKCS#11 token %s not found", tokenLabel)
+}
+
+func (p *PKCS11) findKey(label string) error {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := p.ctx.FindObjectsInit(p.session, template); err != nil {
+		return err
+	}
+	objects, _, err := p.ctx.FindObjects(p.session, 2)
+	if finalErr := p.ctx.FindObjectsFinal(p.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return err
+	}
+	if len(objects) != 1 {
+		return errors.Errorf("Expected one AES key labeled %s in PKCS#11 token, found %d", label, len(objects))
+	}
+	p.key = objects[0]
+	return nil
+}
+
+func (p *PKCS11) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, pkcs11NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ciphertext, err := p.crypt(nonce, plaintext, true)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ciphertext...), nil
+}
+
+func (p *PKCS11) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) <= pkcs11NonceSize {
+		return nil, errors.New("PKCS#11 ciphertext too short")
+	}
+	return p.crypt(ciphertext[:pkcs11NonceSize], ciphertext[pkcs11NonceSize:], false)
+}
+
+func (p *PKCS11) crypt(nonce, input []byte, encrypt bool) ([]byte, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	params := pkcs11.NewGCMParams(nonce, nil, 128)
+	defer params.Free()
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}
+	if encrypt {
+		if err := p.ctx.EncryptInit(p.session, mechanism, p.key); err != nil {
+			return nil, err
+		}
+		return p.ctx.Encrypt(p.session, input)
+	}
+	if err := p.ctx.DecryptInit(p.session, mechanism, p.key); err != nil {
+		return nil, err
+	}
+	return p.ctx.Decrypt(p.session, input)
+}
+
+// Close logs out of the token and unloads the PKCS#11 library.
+func (p *PKCS11) Close() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.ctx == nil {
+		return nil
+	}
+	if p.loggedIn {
+		_ = p.ctx.Logout(p.session)
+		p.loggedIn = false
+	}
+	if p.opened {
+		_ = p.ctx.CloseSession(p.session)
+		p.opened = false
+	}
+	err := p.ctx.Finalize()
+	p.ctx.Destroy()
+	p.ctx = nil
+	return err
+}
@@ -0,0 +1,154 @@
+// Package keyshare contains the keyshare server side of the PAKE with which IRMA apps register and
+// prove knowledge of their PIN at keyshare servers supporting version 3 of the keyshare protocol
+// (see pake.go in the irma package), for use by keyshare servers:
+//
+//   - client/register/oprf: StartRegistration();
+//   - client/register, client/register/device and users/change/pin: FinishRegistration() on the
+//     PakeRecord sent by the client, after which the keyshare server stores the returned PinAccount
+//     with the account;
+//   - users/verify/pin/start: StartVerification();
+//   - users/verify/pin and users/change/pin: Verify() on the proof sent by the client. The keyshare
+//     server counts failed verifications toward blocking the account, as it does for hashed PINs.
+package keyshare
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// PakeTimeout is the time within which a registration or verification must be completed.
+const PakeTimeout = 5 * time.Minute
+
+// PinAccount is the registration of the PIN of a keyshare account, to be stored by the keyshare
+// server. Its Key must be kept secret, as with it the PIN can be brute-forced from the PublicKey.
+type PinAccount struct {
+	Key       irma.PakeKey `json:"key"`
+	PublicKey []byte       `json:"publicKey"`
+}
+
+// Pake keeps the state of the PAKE between requests of clients: the OPRF keys of registrations
+// that have not yet been finished, and the challenges of verifications in progress. It is safe
+// for concurrent use.
+type Pake struct {
+	registrations map[string]*pendingRegistration
+	challenges    map[string]*pendingChallenge
+	lastPrune     time.Time
+	lock          sync.Mutex
+}
+
+type pendingRegistration struct {
+	key     irma.PakeKey
+	expires time.Time
+}
+
+type pendingChallenge struct {
+	challenge []byte
+	expires   time.Time
+}
+
+// NewPake returns a Pake without registrations or verifications in progress.
+func NewPake() *Pake {
+	return &Pake{
+		registrations: map[string]*pendingRegistration{},
+		challenges:    map[string]*pendingChallenge{},
+		lastPrune:     time.Now(),
+	}
+}
+
+// StartRegistration evaluates the OPRF on the blinded PIN using a new OPRF key, returning the
+// evaluation along with the identifier of the registration.
+func (p *Pake) StartRegistration(req *irma.PakeOprfRequest) (*irma.PakeOprfResponse, error) {
+	key, err := irma.NewPakeKey()
+	if err != nil {
+		return nil, err
+	}
+	evaluated, err := key.Evaluate(req.Blinded)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	registration := base64.RawURLEncoding.EncodeToString(id)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.prune()
+	p.registrations[registration] = &pendingRegistration{key: key, expires: time.Now().Add(PakeTimeout)}
+	return &irma.PakeOprfResponse{Registration: registration, Evaluated: evaluated}, nil
+}
+
+// FinishRegistration returns the PinAccount of the registration of the record. Each registration
+// can be finished only once.
+func (p *Pake) FinishRegistration(record *irma.PakeRecord) (*PinAccount, error) {
+	if _, err := irma.ParsePakePublicKey(record.PublicKey); err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	pending := p.registrations[record.Registration]
+	delete(p.registrations, record.Registration)
+	p.lock.Unlock()
+	if pending == nil || time.Now().After(pending.expires) {
+		return nil, errors.New("Unknown or expired PIN registration")
+	}
+	return &PinAccount{Key: pending.key, PublicKey: record.PublicKey}, nil
+}
+
+// StartVerification evaluates the OPRF on the blinded PIN using the OPRF key of the account of
+// req.Username, returning the evaluation along with a challenge to be signed by the client.
+// A previous challenge of the account is replaced.
+func (p *Pake) StartVerification(account *PinAccount, req *irma.PakeOprfRequest) (*irma.PakeOprfResponse, error) {
+	evaluated, err := account.Key.Evaluate(req.Blinded)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := irma.NewPakeChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.prune()
+	p.challenges[req.Username] = &pendingChallenge{challenge: challenge, expires: time.Now().Add(PakeTimeout)}
+	return &irma.PakeOprfResponse{Evaluated: evaluated, Challenge: challenge}, nil
+}
+
+// Verify checks the proof of knowledge of the PIN against the challenge of the verification of
+// the account of the username, which can be used only once.
+func (p *Pake) Verify(username string, account *PinAccount, proof []byte) (bool, error) {
+	p.lock.Lock()
+	pending := p.challenges[username]
+	delete(p.challenges, username)
+	p.lock.Unlock()
+	if pending == nil || time.Now().After(pending.expires) {
+		return false, errors.New("No PIN verification in progress")
+	}
+	return irma.VerifyPakeProof(account.PublicKey, pending.challenge, proof)
+}
+
+// prune removes expired registrations and challenges, at most once per PakeTimeout so that
+// its cost is spread over many requests. The lock must be held.
+func (p *Pake) prune() {
+	now := time.Now()
+	if now.Sub(p.lastPrune) < PakeTimeout {
+		return
+	}
+	p.lastPrune = now
+	for id, pending := range p.registrations {
+		if now.After(pending.expires) {
+			delete(p.registrations, id)
+		}
+	}
+	for username, pending := range p.challenges {
+		if now.After(pending.expires) {
+			delete(p.challenges, username)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the splitting of issuer private keys into shares using Shamir secret sharing,
+// so that no single operator needs to hold the full issuing key. A private key is split into a number
+// of shares (see SplitPrivateKey() and "irma scheme issuer split-key"), of which a threshold amount
+// is required to reassemble it (see CombinePrivateKeyShares()). The server reassembles private keys
+// in memory when it starts, from the shares in Configuration.IssuerPrivateKeyShareFiles and
+// Configuration.IssuerPrivateKeyShares, which may be provided by different operators; the full
+// private key is never written to disk.
+//
+// The XML serialization of the private key is shared bytewise over GF(2^8). Each share contains
+// the SHA256 hash of the serialization, with which incorrect or mismatching shares are detected
+// when the key is reassembled.
+
+// PrivateKeyShare is a share of an issuer private key.
+type PrivateKeyShare struct {
+	Issuer    irma.IssuerIdentifier `json:"issuer"`
+	Counter   uint                  `json:"counter"`
+	Threshold int                   `json:"threshold"`
+	Index     byte                  `json:"index"`
+	Share     []byte                `json:"share"`
+	Hash      []byte                `json:"hash"`
+}
+
+// SplitPrivateKey splits the private key of the issuer into the specified amount of shares,
+// of which threshold are required to reassemble it.
+func SplitPrivateKey(issuer irma.IssuerIdentifier, sk *gabi.PrivateKey, threshold, count int) ([]*PrivateKeyShare, error) {
+	if threshold < 1 || count < threshold || count > 255 {
+		return nil, errors.Errorf("Invalid threshold %d and share count %d: need 1 <= threshold <= count <= 255", threshold, count)
+	}
+	var buf bytes.Buffer
+	if _, err := sk.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	secret := buf.Bytes()
+	hash := sha256.Sum256(secret)
+
+	shares := make([]*PrivateKeyShare, count)
+	for i := range shares {
+		shares[i] = &PrivateKeyShare{
+			Issuer:    issuer,
+			Counter:   sk.Counter,
+			Threshold: threshold,
+			Index:     byte(i + 1),
+			Share:     make([]byte, len(secret)),
+			Hash:      hash[:],
+		}
+	}
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		// Random polynomial of degree threshold-1 whose constant term is the secret byte
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, share.Index) ^ coefficients[k]
+			}
+			share.Share[j] = y
+		}
+	}
+	return shares, nil
+}
+
+// CombinePrivateKeyShares reassembles a private key from at least its threshold amount of shares.
+func CombinePrivateKeyShares(shares []*PrivateKeyShare) (irma.IssuerIdentifier, *gabi.PrivateKey, error) {
+	if len(shares) == 0 {
+		return irma.IssuerIdentifier{}, nil, errors.New("No private key shares")
+	}
+	first := shares[0]
+	indices := map[byte]bool{}
+	for _, share := range shares {
+		if share.Issuer != first.Issuer || share.Counter != first.Counter || share.Threshold != first.Threshold ||
+			!bytes.Equal(share.Hash, first.Hash) || len(share.Share) != len(first.Share) {
+			return first.Issuer, nil, errors.Errorf("Private key shares of %s-%d do not belong together", first.Issuer, first.Counter)
+		}
+		if share.Index == 0 || indices[share.Index] {
+			return first.Issuer, nil, errors.Errorf("Invalid or duplicate private key share index %d", share.Index)
+		}
+		indices[share.Index] = true
+	}
+	if len(shares) < first.Threshold {
+		return first.Issuer, nil, errors.Errorf("Private key %s-%d requires %d shares, got %d",
+			first.Issuer, first.Counter, first.Threshold, len(shares))
+	}
+
+	// Lagrange interpolation at x = 0, in which addition and subtraction are both xor
+	shares = shares[:first.Threshold]
+	weights := make([]byte, len(shares))
+	for i, share := range shares {
+		weight := byte(1)
+		for k, other := range shares {
+			if k != i {
+				weight = gfMul(weight, gfDiv(other.Index, other.Index^share.Index))
+			}
+		}
+		weights[i] = weight
+	}
+	secret := make([]byte, len(first.Share))
+	for j := range secret {
+		for i, share := range shares {
+			secret[j] ^= gfMul(weights[i], share.Share[j])
+		}
+	}
+
+	hash := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare(hash[:], first.Hash) != 1 {
+		return first.Issuer, nil, errors.Errorf("Private key shares of %s-%d are incorrect", first.Issuer, first.Counter)
+	}
+	sk, err := gabi.NewPrivateKeyFromXML(string(secret))
+	if err != nil {
+		return first.Issuer, nil, err
+	}
+	return first.Issuer, sk, nil
+}
+
+// ReadPrivateKeyShare reads a JSON-serialized private key share from the specified file.
+func ReadPrivateKeyShare(filename string) (*PrivateKeyShare, error) {
+	bts, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	share := &PrivateKeyShare{}
+	if err = json.Unmarshal(bts, share); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse private key share "+filename, 0)
+	}
+	return share, nil
+}
+
+var gfExp, gfLog [256]byte
+
+func init() {
+	// Tables of powers of the generator 3 in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		x ^= x<<1 ^ byte(int8(x)>>7)&0x1b // x *= 3
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+255-int(gfLog[b]))%255]
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the data minimization checks of session requests. When a requestor asks for
+// an attribute flagged as sensitive in the scheme (see irma.AttributeType.Sensitive) while a less
+// revealing request would likely suffice, the server warns the requestor: the warnings are logged
+// and included in the response to the session request of the requestor server (see SessionPackage),
+// or, depending on Configuration.MinimizationPolicy, the session request is rejected.
+
+// Policies for session requests that do not minimize the disclosure of sensitive attributes.
+const (
+	// MinimizationWarn logs and returns warnings for such requests (default)
+	MinimizationWarn = "warn"
+	// MinimizationReject rejects such requests, if they ask for sensitive attributes of which other
+	// attributes are alternatives (see MinimizationAlternatives)
+	MinimizationReject = "reject"
+	// MinimizationOff disables the checks
+	MinimizationOff = "off"
+)
+
+// Reasons of a MinimizationWarning.
+const (
+	// The value of the sensitive attribute is requested without restricting it to a required value.
+	// As the requestor may need the value, this warning is only logged once per attribute.
+	MinimizationUnrestricted = "unrestricted"
+	// The sensitive attribute is one of several alternatives of which others are not sensitive
+	MinimizationAlternatives = "alternatives"
+)
+
+// MinimizationWarning describes how a session request could disclose less sensitive information.
+type MinimizationWarning struct {
+	Attribute irma.AttributeTypeIdentifier `json:"attribute"`
+	Reason    string                       `json:"reason"`
+	Guidance  string                       `json:"guidance"`
+}
+
+// MinimizationError is returned when a session request is rejected by the MinimizationReject policy.
+type MinimizationError struct {
+	Warnings []*MinimizationWarning
+}
+
+func (e *MinimizationError) Error() string {
+	guidance := make([]string, 0, len(e.Warnings))
+	for _, warning := range e.Warnings {
+		guidance = append(guidance, warning.Guidance)
+	}
+	return "session request does not minimize disclosure of sensitive attributes: " + strings.Join(guidance, "; ")
+}
+
+// CheckMinimization returns warnings for the sensitive attributes in the disjunctions of the request
+// of which the disclosure could likely be avoided.
+func CheckMinimization(conf *irma.Configuration, request irma.SessionRequest) []*MinimizationWarning {
+	var warnings []*MinimizationWarning
+	for _, disjunction := range request.ToDisclose() {
+		alternatives := false
+		for _, attr := range disjunction.Attributes {
+			if !attr.IsCredential() && !sensitive(conf, attr) {
+				alternatives = true
+			}
+		}
+		for _, attr := range disjunction.Attributes {
+			if attr.IsCredential() || !sensitive(conf, attr) {
+				continue
+			}
+			if _, restricted := disjunction.Values[attr]; !restricted {
+				warnings = append(warnings, &MinimizationWarning{
+					Attribute: attr,
+					Reason:    MinimizationUnrestricted,
+					Guidance: fmt.Sprintf("%s is sensitive: if its value is not needed, request a required value "+
+						"or only the presence of credential %s instead", attr, attr.CredentialTypeIdentifier()),
+				})
+			}
+			if alternatives {
+				warnings = append(warnings, &MinimizationWarning{
+					Attribute: attr,
+					Reason:    MinimizationAlternatives,
+					Guidance: fmt.Sprintf("%s is sensitive: if the other attributes of disjunction %q suffice, "+
+						"leave it out of the disjunction", attr, disjunction.Label),
+				})
+			}
+		}
+	}
+	return warnings
+}
+
+func sensitive(conf *irma.Configuration, attr irma.AttributeTypeIdentifier) bool {
+	credtype := conf.CredentialTypes[attr.CredentialTypeIdentifier()]
+	if credtype == nil {
+		return false
+	}
+	attrtype := credtype.AttributeType(attr)
+	return attrtype != nil && attrtype.Sensitive
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// This file contains the stores in which the server records the issuance commitments and client
+// nonces that it accepted, so that replayed commitments are refused (see Configuration.ReplayStore).
+// By default they are recorded in memory; deployments in which multiple servers handle sessions
+// for the same issuers should implement a ReplayStore shared by all of them.
+
+// ReplayStore records the issuance commitments and client nonces used in sessions.
+type ReplayStore interface {
+	// Record records the keys as used by the session until the expiry. If any of the keys was
+	// already recorded and has not expired, nothing is recorded and the session that used it is
+	// returned.
+	Record(session string, keys []string, expiry time.Time) (usedBy string, err error)
+}
+
+// replayRecord is a key recorded by the memoryReplayStore.
+type replayRecord struct {
+	session string
+	expiry  time.Time
+}
+
+// memoryReplayStore keeps the records in a map, and their keys in a heap ordered by expiry so that
+// expired records can be pruned without going through all records.
+type memoryReplayStore struct {
+	sync.Mutex
+	records  map[string]replayRecord
+	expiries replayExpiries
+}
+
+// NewMemoryReplayStore returns a ReplayStore that records keys in memory.
+func NewMemoryReplayStore() ReplayStore {
+	return &memoryReplayStore{records: map[string]replayRecord{}}
+}
+
+func (s *memoryReplayStore) Record(session string, keys []string, expiry time.Time) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+	for _, key := range keys {
+		if record, ok := s.records[key]; ok {
+			return record.session, nil
+		}
+	}
+	for _, key := range keys {
+		s.records[key] = replayRecord{session: session, expiry: expiry}
+		heap.Push(&s.expiries, replayExpiry{key: key, expiry: expiry})
+	}
+	return "", nil
+}
+
+// prune removes the records that have expired, which are at the top of the heap.
+func (s *memoryReplayStore) prune(now time.Time) {
+	for len(s.expiries) > 0 && !s.expiries[0].expiry.After(now) {
+		expired := heap.Pop(&s.expiries).(replayExpiry)
+		// The key may have been recorded again after it expired; then it is kept until its new expiry
+		if record, ok := s.records[expired.key]; ok && !record.expiry.After(now) {
+			delete(s.records, expired.key)
+		}
+	}
+}
+
+type replayExpiry struct {
+	key    string
+	expiry time.Time
+}
+
+// replayExpiries is a container/heap of the keys of the records, the first to expire on top.
+type replayExpiries []replayExpiry
+
+func (e replayExpiries) Len() int            { return len(e) }
+func (e replayExpiries) Less(i, j int) bool  { return e[i].expiry.Before(e[j].expiry) }
+func (e replayExpiries) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *replayExpiries) Push(x interface{}) { *e = append(*e, x.(replayExpiry)) }
+
+func (e *replayExpiries) Pop() interface{} {
+	old := *e
+	x := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,158 @@
+package requestorserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// AttestationConfiguration configures the /attestation endpoint, at which IRMA apps can submit
+// attribute-based signatures to receive a credential attesting to them (see irma.AttestationRequest).
+type AttestationConfiguration struct {
+	// Credential type to issue
+	Credential string `json:"credential" mapstructure:"credential"`
+	// Attribute that receives the digest of the signature (see irma.SignedMessage.Digest())
+	DigestAttribute string `json:"digest_attribute" mapstructure:"digest_attribute"`
+	// Attribute that receives the date (YYYY-MM-DD) of the timestamp of the signature
+	DateAttribute string `json:"date_attribute" mapstructure:"date_attribute"`
+	// Attribute that receives the signed message (optional)
+	MessageAttribute string `json:"message_attribute" mapstructure:"message_attribute"`
+
+	// Hook, if not nil, is invoked after the signature has been verified and before the credential
+	// is issued. It can modify the credential request, e.g. to add attributes, or reject the signature
+	// by returning an error.
+	Hook AttestationHook `json:"-" mapstructure:"-"`
+
+	credential irma.CredentialTypeIdentifier
+}
+
+// AttestationHook receives a verified signature submitted for attestation along with the attributes
+// disclosed in it, and the credential request that will be issued in response.
+type AttestationHook func(signature *irma.SignedMessage, attributes []*irma.DisclosedAttribute, cred *irma.CredentialRequest) error
+
+func (conf *AttestationConfiguration) initialize(irmaconf *irma.Configuration) error {
+	conf.credential = irma.NewCredentialTypeIdentifier(conf.Credential)
+	credtype := irmaconf.CredentialTypes[conf.credential]
+	if credtype == nil {
+		return errors.Errorf("Attestation credential type %s not found", conf.Credential)
+	}
+	if conf.DigestAttribute == "" || conf.DateAttribute == "" {
+		return errors.New("Attestation requires digest_attribute and date_attribute")
+	}
+	attrs := map[string]bool{}
+	for _, attr := range []string{conf.DigestAttribute, conf.DateAttribute, conf.MessageAttribute} {
+		if attr == "" {
+			continue
+		}
+		if attrs[attr] {
+			return errors.Errorf("Attestation attribute %s configured more than once", attr)
+		}
+		attrs[attr] = true
+		if !credtype.ContainsAttribute(irma.NewAttributeTypeIdentifier(conf.Credential + "." + attr)) {
+			return errors.Errorf("Attestation credential type %s has no attribute %s", conf.Credential, attr)
+		}
+	}
+	return nil
+}
+
+// issuanceRequest verifies the signature and returns the issuance request of the credential
+// attesting to it. As anyone can submit a signature, the issuance request requires disclosure of
+// the attributes disclosed in the signature with the same values, so that only the signer (or
+// at least someone possessing the same attributes) can obtain the attestation.
+func (conf *AttestationConfiguration) issuanceRequest(irmaconf *irma.Configuration, signature *irma.SignedMessage) (*irma.IssuanceRequest, *server.Error, error) {
+	attributes, status, err := signature.Verify(irmaconf, nil)
+	if err != nil {
+		return nil, &server.ErrorInvalidSignature, err
+	}
+	if status != irma.ProofStatusValid {
+		return nil, &server.ErrorInvalidSignature, errors.Errorf("signature status %s", status)
+	}
+	disclose := signerDisjunctions(attributes)
+	if len(disclose) == 0 {
+		return nil, &server.ErrorInvalidSignature, errors.New("signature discloses no attributes")
+	}
+	digest, err := signature.Digest()
+	if err != nil {
+		return nil, &server.ErrorUnknown, err
+	}
+
+	cred := &irma.CredentialRequest{
+		CredentialTypeID: conf.credential,
+		Attributes: map[string]string{
+			conf.DigestAttribute: digest,
+			conf.DateAttribute:   time.Unix(signature.Timestamp.Time, 0).UTC().Format("2006-01-02"),
+		},
+	}
+	if conf.MessageAttribute != "" {
+		cred.Attributes[conf.MessageAttribute] = signature.Message
+	}
+	if conf.Hook != nil {
+		if err = conf.Hook(signature, attributes, cred); err != nil {
+			return nil, &server.ErrorAttestationRejected, err
+		}
+	}
+	return &irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing},
+		Credentials: []*irma.CredentialRequest{cred},
+		Disclose:    disclose,
+	}, nil, nil
+}
+
+// signerDisjunctions returns a disjunction for each of the attributes disclosed in a signature,
+// requiring the attribute to be disclosed again with the same value.
+func signerDisjunctions(attributes []*irma.DisclosedAttribute) irma.AttributeDisjunctionList {
+	var list irma.AttributeDisjunctionList
+	for _, attr := range attributes {
+		if attr.Status != irma.AttributeProofStatusPresent && attr.Status != irma.AttributeProofStatusExtra {
+			continue
+		}
+		disjunction := &irma.AttributeDisjunction{
+			Label:      attr.Identifier.Name(),
+			Attributes: []irma.AttributeTypeIdentifier{attr.Identifier},
+		}
+		if attr.RawValue != nil {
+			disjunction.Values = map[irma.AttributeTypeIdentifier]*string{attr.Identifier: attr.RawValue}
+		}
+		list = append(list, disjunction)
+	}
+	return list
+}
+
+func (s *Server) handleAttestation(w http.ResponseWriter, r *http.Request) {
+	if s.irmaserv.Draining() {
+		server.WriteError(w, server.ErrorShuttingDown, "")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	request := &irma.AttestationRequest{}
+	if err = irma.UnmarshalValidate(body, request); err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+
+	isreq, serr, err := s.conf.Attestation.issuanceRequest(s.irmaserv.IrmaConfiguration(), request.Signature)
+	if err != nil {
+		s.conf.Logger.WithField("error", err.Error()).Warn("Attestation of signature refused")
+		server.WriteError(w, *serr, err.Error())
+		return
+	}
+
+	qr, _, err := s.irmaserv.StartSession(isreq, nil)
+	if err != nil {
+		_ = server.LogError(err)
+		server.WriteError(w, server.ErrorCannotIssue, err.Error())
+		return
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"credential": s.conf.Attestation.credential}).Info("Attesting signature")
+	server.WriteJson(w, qr)
+}
@@ -65,6 +65,13 @@ type Configuration struct {
 	// Host static files under this URL prefix
 	StaticPrefix string `json:"static_prefix" mapstructure:"static_prefix"`
 
+	// When shutting down, max amount of seconds to wait for sessions in progress to finish
+	ShutdownTimeout int `json:"shutdown_timeout" mapstructure:"shutdown_timeout"`
+
+	// If specified, IRMA apps can submit attribute-based signatures at /attestation to receive
+	// a credential attesting to them
+	Attestation *AttestationConfiguration `json:"attestation" mapstructure:"attestation"`
+
 	jwtPrivateKey *rsa.PrivateKey
 }
 
@@ -212,6 +219,12 @@ func (conf *Configuration) initialize() error {
 		return err
 	}
 
+	if conf.Attestation != nil {
+		if err := conf.Attestation.initialize(conf.IrmaConfiguration); err != nil {
+			return err
+		}
+	}
+
 	if conf.StaticPath != "" {
 		if err := fs.AssertPathExists(conf.StaticPath); err != nil {
 			return errors.WrapPrefix(err, "Invalid static_path", 0)
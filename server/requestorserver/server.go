@@ -140,6 +140,20 @@ func (s *Server) Stop() {
 	}
 }
 
+// Shutdown gracefully stops the server: new sessions are refused, and sessions in progress are
+// given until the timeout has passed to finish, after which the server is stopped.
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.conf.Logger.Info("Shutting down, waiting at most ", timeout, " for sessions in progress")
+	s.irmaserv.Drain(timeout)
+	s.Stop()
+}
+
+// Reload re-parses the IRMA schemes and issuer private keys from disk. Sessions in progress
+// are not affected.
+func (s *Server) Reload() error {
+	return s.irmaserv.Reload()
+}
+
 func New(config *Configuration) (*Server, error) {
 	irmaserv, err := irmaserver.New(config.Configuration)
 	if err != nil {
@@ -168,6 +182,11 @@ func (s *Server) ClientHandler() http.Handler {
 	if s.conf.StaticPath != "" {
 		router.Mount(s.conf.StaticPrefix, s.StaticFilesHandler())
 	}
+	if s.conf.Attestation != nil {
+		router.Post("/attestation", s.handleAttestation)
+	}
+	router.Get("/healthz", s.handleHealth)
+	router.Get("/readyz", s.handleReady)
 
 	return router
 }
@@ -184,14 +203,19 @@ func (s *Server) Handler() http.Handler {
 		if s.conf.StaticPath != "" {
 			router.Mount(s.conf.StaticPrefix, s.StaticFilesHandler())
 		}
+		if s.conf.Attestation != nil {
+			router.Post("/attestation", s.handleAttestation)
+		}
 	}
 
 	// Server routes
 	router.Post("/session", s.handleCreate)
 	router.Delete("/session/{token}", s.handleDelete)
 	router.Get("/session/{token}/status", s.handleStatus)
+	router.Get("/session/{token}/confirmation", s.handleConfirmation)
 	router.Get("/session/{token}/statusevents", s.handleStatusEvents)
 	router.Get("/session/{token}/result", s.handleResult)
+	router.Get("/session/{token}/issuanceresults", s.handleIssuanceResults)
 
 	// Routes for getting signed JWTs containing the session result. Only work if configuration has a private key
 	router.Get("/session/{token}/result-jwt", s.handleJwtResult)
@@ -199,6 +223,10 @@ func (s *Server) Handler() http.Handler {
 
 	router.Get("/publickey", s.handlePublicKey)
 
+	// Liveness and readiness probes
+	router.Get("/healthz", s.handleHealth)
+	router.Get("/readyz", s.handleReady)
+
 	return router
 }
 
@@ -218,6 +246,11 @@ func (s *Server) StaticFilesHandler() http.Handler {
 }
 
 func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if s.irmaserv.Draining() {
+		server.WriteError(w, server.ErrorShuttingDown, "")
+		return
+	}
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		s.conf.Logger.Error("Could not read session request HTTP POST body")
@@ -284,6 +317,14 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 
 	// Everything is authenticated and parsed, we're good to go!
 	qr, token, err := s.irmaserv.StartSession(rrequest, s.doResultCallback)
+	if aerr, ok := err.(*server.AttributeValueError); ok {
+		server.WriteError(w, server.ErrorInvalidAttributeValue, aerr.Error())
+		return
+	}
+	if merr, ok := err.(*server.MinimizationError); ok {
+		server.WriteError(w, server.ErrorDataMinimization, merr.Error())
+		return
+	}
 	if err != nil {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
@@ -292,9 +333,28 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, server.SessionPackage{
 		SessionPtr: qr,
 		Token:      token,
+		Warnings:   s.irmaserv.GetMinimizationWarnings(token),
 	})
 }
 
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	server.WriteString(w, "OK")
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	readiness := s.irmaserv.Readiness()
+	if !readiness.Ready {
+		// The details of the checks are only logged, as this endpoint is publicly accessible
+		s.conf.Logger.WithField("checks", readiness.Checks).Warn("Server not ready")
+		bts, _ := json.Marshal(readiness.Summary())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write(bts)
+		return
+	}
+	server.WriteJson(w, readiness.Summary())
+}
+
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	res := s.irmaserv.GetSessionResult(chi.URLParam(r, "token"))
 	if res == nil {
@@ -304,6 +364,15 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, res.Status)
 }
 
+func (s *Server) handleConfirmation(w http.ResponseWriter, r *http.Request) {
+	code, err := s.irmaserv.GetConfirmationCode(chi.URLParam(r, "token"))
+	if err != nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	server.WriteJson(w, code)
+}
+
 func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
 	token := chi.URLParam(r, "token")
 	s.conf.Logger.WithFields(logrus.Fields{"session": token}).Debug("new client subscribed to server sent events")
@@ -332,6 +401,15 @@ func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, res)
 }
 
+func (s *Server) handleIssuanceResults(w http.ResponseWriter, r *http.Request) {
+	results, err := s.irmaserv.GetIssuanceResults(chi.URLParam(r, "token"))
+	if err != nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	server.WriteJson(w, results)
+}
+
 func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 	if s.conf.jwtPrivateKey == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
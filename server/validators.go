@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// AttributeValidator checks an attribute value before it is issued, returning the value to be issued
+// (possibly normalized) or an error if the value is rejected.
+type AttributeValidator interface {
+	Validate(value string) (string, error)
+}
+
+// AttributeValidatorConfig configures an AttributeValidator. Supported types:
+//  - "regex": the value must entirely match Pattern
+//  - "date": the value must be a date in one of the InputFormats (Go time layouts; if empty
+//    then Format is used), and is normalized to Format (default "2006-01-02")
+//  - "bsn": the value must be a Dutch citizen service number (BSN) satisfying the "elfproef"
+//  - "trim": leading and trailing whitespace is removed
+type AttributeValidatorConfig struct {
+	Type         string   `json:"type" mapstructure:"type"`
+	Pattern      string   `json:"pattern,omitempty" mapstructure:"pattern"`
+	Format       string   `json:"format,omitempty" mapstructure:"format"`
+	InputFormats []string `json:"input_formats,omitempty" mapstructure:"input_formats"`
+}
+
+// AttributeValueError is returned when an attribute value in an issuance request is rejected.
+type AttributeValueError struct {
+	Attribute irma.AttributeTypeIdentifier
+	Reason    string
+}
+
+func (e *AttributeValueError) Error() string {
+	return fmt.Sprintf("invalid value for attribute %s: %s", e.Attribute, e.Reason)
+}
+
+// NewAttributeValidator returns the AttributeValidator specified by the configuration.
+func NewAttributeValidator(conf *AttributeValidatorConfig) (AttributeValidator, error) {
+	switch conf.Type {
+	case "regex":
+		r, err := regexp.Compile("^(?:" + conf.Pattern + ")$")
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "invalid regex validator pattern", 0)
+		}
+		return regexValidator{r}, nil
+	case "date":
+		format := conf.Format
+		if format == "" {
+			format = "2006-01-02"
+		}
+		inputs := conf.InputFormats
+		if len(inputs) == 0 {
+			inputs = []string{format}
+		}
+		return dateValidator{format: format, inputs: inputs}, nil
+	case "bsn":
+		return bsnValidator{}, nil
+	case "trim":
+		return trimValidator{}, nil
+	default:
+		return nil, errors.Errorf("unknown attribute validator type %s", conf.Type)
+	}
+}
+
+type regexValidator struct {
+	regex *regexp.Regexp
+}
+
+func (v regexValidator) Validate(value string) (string, error) {
+	if !v.regex.MatchString(value) {
+		return "", errors.New("value does not match required pattern")
+	}
+	return value, nil
+}
+
+type dateValidator struct {
+	format string
+	inputs []string
+}
+
+func (v dateValidator) Validate(value string) (string, error) {
+	for _, layout := range v.inputs {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format(v.format), nil
+		}
+	}
+	return "", errors.New("value is not a valid date")
+}
+
+type bsnValidator struct{}
+
+// Validate applies the "elfproef": for the digits d1..d9 of the BSN,
+// 9*d1 + 8*d2 + ... + 2*d8 - d9 must be divisible by 11.
+func (bsnValidator) Validate(value string) (string, error) {
+	if len(value) == 8 {
+		value = "0" + value
+	}
+	if len(value) != 9 {
+		return "", errors.New("BSN must consist of 9 digits")
+	}
+	sum := 0
+	for i, c := range value {
+		if c < '0' || c > '9' {
+			return "", errors.New("BSN must consist of 9 digits")
+		}
+		weight := 9 - i
+		if i == 8 {
+			weight = -1
+		}
+		sum += weight * int(c-'0')
+	}
+	if sum == 0 || sum%11 != 0 {
+		return "", errors.New("BSN does not satisfy the elfproef")
+	}
+	return value, nil
+}
+
+type trimValidator struct{}
+
+func (trimValidator) Validate(value string) (string, error) {
+	return strings.TrimSpace(value), nil
+}
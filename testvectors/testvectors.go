@@ -0,0 +1,114 @@
+// Package testvectors contains test vectors of the IRMA protocol: serialized session requests,
+// disclosures and issuance commitments, attribute-based signatures, metadata attributes and attribute
+// encodings, along with their expected parsing or verification outcomes. irmago checks itself against them in its own tests; other
+// implementations of IRMA can do the same to stay wire-compatible with irmago.
+//
+// The vectors are stored as JSON files in testdata/testvectors in the root of the irmago repository,
+// so that they can be consumed without Go. This package contains the types of the JSON files and a
+// function to load them. The vectors refer to the schemes in testdata/irma_configuration, against
+// which signatures must be verified.
+package testvectors
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Vectors contains all test vectors.
+type Vectors struct {
+	Requests    []*Request
+	Disclosures []*Disclosure
+	Signatures  []*Signature
+	Metadata    []*Metadata
+	Attributes  []*Attribute
+}
+
+// Request is a session request (requests.json).
+type Request struct {
+	Name string `json:"name"`
+	// Session type as which the request should be parsed: "disclosing", "signing" or "issuing"
+	Type    string          `json:"type"`
+	Request json.RawMessage `json:"request"`
+	// Whether or not the request should pass validation
+	Valid bool `json:"valid"`
+}
+
+// Disclosure is a disclosure, or the commitments of the client in an issuance session which contain
+// a disclosure, along with the request it responds to (disclosures.json).
+type Disclosure struct {
+	Name string `json:"name"`
+	// Session type of the request: "disclosing", in which case Message is a disclosure, or "issuing",
+	// in which case Message contains the commitments of the client
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+	Request json.RawMessage `json:"request"`
+	// Expected attributes to which the attribute indices of the disclosure resolve, one for each
+	// disjunction of the request; absent if the indices do not match the request
+	Resolved []*ResolvedAttribute `json:"resolved,omitempty"`
+}
+
+// ResolvedAttribute is an attribute to which an attribute index of a disclosure resolves.
+type ResolvedAttribute struct {
+	ID    string  `json:"id"`
+	Value *string `json:"value"`
+	// Expected attribute proof status, e.g. "PRESENT" or "INVALID_VALUE"
+	Status string `json:"status"`
+}
+
+// Signature is an attribute-based signature (signatures.json).
+type Signature struct {
+	Name    string          `json:"name"`
+	Message json.RawMessage `json:"message"`
+	// The signature request to verify the signature against; if absent, the signature
+	// should be verified on its own
+	Request json.RawMessage `json:"request,omitempty"`
+	// Expected proof status, e.g. "VALID" or "INVALID"
+	Status string `json:"status"`
+	// Expected disclosed attribute values, if the signature is valid
+	Disclosed map[string]string `json:"disclosed,omitempty"`
+}
+
+// Metadata is a metadata attribute (metadata.json). Dates are Unix timestamps.
+type Metadata struct {
+	Name string `json:"name"`
+	// The metadata attribute as a decimal integer
+	Value          string `json:"value"`
+	CredentialType string `json:"credentialType"`
+	Version        byte   `json:"version"`
+	SigningDate    int64  `json:"signingDate"`
+	Expiry         int64  `json:"expiry"`
+	KeyCounter     int    `json:"keyCounter"`
+}
+
+// Attribute is an encoded attribute value (attributes.json).
+type Attribute struct {
+	Name string `json:"name"`
+	// The attribute as a decimal integer
+	Value           string `json:"value"`
+	MetadataVersion byte   `json:"metadataVersion"`
+	// The decoded value, nil if the attribute is absent
+	Decoded *string `json:"decoded"`
+}
+
+// Load loads the test vectors from the specified directory.
+func Load(dir string) (*Vectors, error) {
+	vectors := &Vectors{}
+	files := map[string]interface{}{
+		"requests.json":    &vectors.Requests,
+		"disclosures.json": &vectors.Disclosures,
+		"signatures.json":  &vectors.Signatures,
+		"metadata.json":    &vectors.Metadata,
+		"attributes.json":  &vectors.Attributes,
+	}
+	for filename, dest := range files {
+		bts, err := ioutil.ReadFile(filepath.Join(dir, filename))
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(bts, dest); err != nil {
+			return nil, err
+		}
+	}
+	return vectors, nil
+}
@@ -1,8 +1,10 @@
 package irma
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/asn1"
+	"encoding/json"
 	"errors"
 	gobig "math/big"
 
@@ -61,8 +63,126 @@ func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int) (
 
 const TimestampServerURL = "https://metrics.privacybydesign.foundation/atum"
 
+// Retimestamp adds an archive timestamp to the attribute-based signature, over the signature
+// including its timestamp and any earlier archive timestamps. As long as the last archive timestamp
+// can be verified, the signature and its earlier timestamps are considered to have existed at the time
+// of that archive timestamp, so that they remain verifiable after the keys of the timestamp server
+// with which they were made expire or are no longer trusted. Thus signatures that need to be verifiable
+// in the long term should be retimestamped periodically, before the key of the timestamp server
+// or of the issuers of the contained attributes expires.
+//
+// Note that the public keys of the issuers of the attributes must remain available in the scheme
+// in order to verify the signature.
+func (sm *SignedMessage) Retimestamp() error {
+	if sm.Timestamp == nil {
+		return errors.New("Cannot retimestamp a signature without timestamp")
+	}
+	nonce, err := sm.archiveTimestampRequest(len(sm.ArchiveTimestamps), false)
+	if err != nil {
+		return err
+	}
+	alg := atum.Ed25519
+	ts, err := atum.SendRequest(TimestampServerURL, atum.Request{
+		Nonce:           nonce,
+		PreferredSigAlg: &alg,
+	})
+	if err != nil {
+		return err
+	}
+	sm.ArchiveTimestamps = append(sm.ArchiveTimestamps, ts)
+	return nil
+}
+
+// archiveTimestampRequest computes the nonce to be signed by the timestamp server in the i-th
+// archive timestamp: a hash over the signature, its timestamp and the preceding archive timestamps.
+// The signature is hashed in its canonical JSON serialization (see CanonicalJSON()), or if legacy
+// is set, as serialized by earlier versions, which did not canonicalize it.
+func (sm *SignedMessage) archiveTimestampRequest(i int, legacy bool) ([]byte, error) {
+	var proofs []byte
+	var err error
+	if legacy {
+		proofs, err = json.Marshal(sm.Signature)
+	} else {
+		proofs, err = CanonicalJSON(sm.Signature)
+	}
+	if err != nil {
+		return nil, err
+	}
+	proofsHash := sha256.Sum256(proofs)
+	timestamps := [][]byte{sm.Timestamp.Sig.Data}
+	for _, ts := range sm.ArchiveTimestamps[:i] {
+		timestamps = append(timestamps, ts.Sig.Data)
+	}
+	bts, err := asn1.Marshal(struct {
+		Nonce      *gobig.Int
+		ProofsHash []byte
+		Timestamps [][]byte
+	}{
+		sm.GetNonce().Value(), proofsHash[:], timestamps,
+	})
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256(bts)
+	return hashed[:], nil
+}
+
+// verifyTimestampSignature verifies the signature of the timestamp server over the specified nonce.
+// If trustKey is true then the public key of the timestamp server is not checked; this is appropriate
+// only when a later, verified, archive timestamp vouches for the timestamp.
+func verifyTimestampSignature(ts *atum.Timestamp, nonce []byte, trustKey bool) error {
+	if ts.ServerUrl != TimestampServerURL {
+		return errors.New("Untrusted timestamp server")
+	}
+	var valid bool
+	var err error
+	if !trustKey {
+		valid, err = ts.Verify(nonce)
+	} else {
+		if ts.Hashing != nil {
+			if nonce, err = ts.Hashing.ComputeNonce(bytes.NewReader(nonce)); err != nil {
+				return err
+			}
+		}
+		valid, err = ts.Sig.DangerousVerifySignatureButNotPublicKey(ts.Time, nonce)
+	}
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("Timestamp signature invalid")
+	}
+	return nil
+}
+
+// verifyArchiveTimestamps verifies the archive timestamps (if any) of the attribute-based signature.
+func (sm *SignedMessage) verifyArchiveTimestamps() error {
+	previous := sm.Timestamp.Time
+	for i, ts := range sm.ArchiveTimestamps {
+		if ts.Time < previous {
+			return errors.New("Archive timestamps not in chronological order")
+		}
+		previous = ts.Time
+		nonce, err := sm.archiveTimestampRequest(i, false)
+		if err != nil {
+			return err
+		}
+		trustKey := i < len(sm.ArchiveTimestamps)-1
+		if err = verifyTimestampSignature(ts, nonce, trustKey); err != nil {
+			// Archive timestamps made by earlier versions are over the non-canonical serialization
+			if nonce, err = sm.archiveTimestampRequest(i, true); err != nil {
+				return err
+			}
+			if err = verifyTimestampSignature(ts, nonce, trustKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Given an SignedMessage, verify the timestamp over the signed message, disclosed attributes,
-// and rerandomized CL-signatures.
+// and rerandomized CL-signatures, as well as the archive timestamps, if present.
 func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) error {
 	if sm.Timestamp.ServerUrl != TimestampServerURL {
 		return errors.New("Untrusted timestamp server")
@@ -97,12 +217,9 @@ func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) er
 	if err != nil {
 		return err
 	}
-	valid, err := sm.Timestamp.Verify(bts)
-	if err != nil {
+	// If the signature has been retimestamped, the last archive timestamp vouches for the original one
+	if err = verifyTimestampSignature(sm.Timestamp, bts, len(sm.ArchiveTimestamps) > 0); err != nil {
 		return err
 	}
-	if !valid {
-		return errors.New("Timestamp signature invalid")
-	}
-	return nil
+	return sm.verifyArchiveTimestamps()
 }
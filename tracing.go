@@ -0,0 +1,60 @@
+package irma
+
+import "sync"
+
+// This file contains hooks for tracing the duration of potentially slow operations, such as parsing
+// the schemes, loading the storage of the client, and the phases of sessions in the client and the
+// server, for integrators wishing to find out where time is spent. Traced operations are reported as
+// spans to the Tracer set with SetTracer(). The interfaces are modeled after those of OpenTelemetry,
+// so that an adapter to an OpenTelemetry tracer (or other tracing systems) needs only a few lines:
+//
+//   type otelTracer struct{ trace.Tracer }
+//   func (t otelTracer) StartSpan(name string) irma.Span {
+//       _, span := t.Start(context.Background(), name)
+//       return otelSpan{span}
+//   }
+//
+// Span names are of the form package.Operation, e.g. "irmaclient.loadStorage" or
+// "irmaserver.HandleProtocolMessage".
+
+// Tracer starts spans for traced operations.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+// Span is a traced operation, ended by calling End().
+type Span interface {
+	// SetAttribute adds information about the operation to the span.
+	SetAttribute(key, value string)
+	// End ends the span. If err is not nil, the operation failed with it.
+	End(err error)
+}
+
+type noopTracer struct{}
+type noopSpan struct{}
+
+func (noopTracer) StartSpan(string) Span        { return noopSpan{} }
+func (noopSpan) SetAttribute(key, value string) {}
+func (noopSpan) End(error)                      {}
+
+var (
+	tracer     Tracer = noopTracer{}
+	tracerLock sync.RWMutex
+)
+
+// SetTracer sets the Tracer to which spans of traced operations are reported; nil disables tracing.
+func SetTracer(t Tracer) {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+	if t == nil {
+		t = noopTracer{}
+	}
+	tracer = t
+}
+
+// StartSpan starts a span for an operation using the Tracer set with SetTracer().
+func StartSpan(name string) Span {
+	tracerLock.RLock()
+	defer tracerLock.RUnlock()
+	return tracer.StartSpan(name)
+}
@@ -0,0 +1,167 @@
+package irma
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains the handling of missing translations in schemes. Translate() falls back to
+// another language when a TranslatedString lacks the requested language, reporting that it did so,
+// so that user interfaces can mark text shown in another language than that of the user. For scheme
+// maintainers, MissingTranslations() reports which translations are missing in a scheme, per
+// language (see also the "irma scheme translations" command).
+
+// Translation is a string translated by TranslatedString.Translate().
+type Translation struct {
+	Text string
+	// The language of Text, which differs from the requested language if Fallback is true
+	Language string
+	// Whether the translation to the requested language is missing, so that Text is in another language
+	Fallback bool
+}
+
+// Translate returns the translation in the specified language. If that is missing, it falls back to
+// the base language (e.g. "nl" for "nl-BE"), then to English, and then to the first of the other
+// languages in alphabetical order.
+func (ts TranslatedString) Translate(lang string) Translation {
+	if str, ok := ts[lang]; ok {
+		return Translation{Text: str, Language: lang}
+	}
+	candidates := []string{}
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		candidates = append(candidates, lang[:i])
+	}
+	candidates = append(candidates, "en")
+	for _, candidate := range candidates {
+		if str, ok := ts[candidate]; ok {
+			return Translation{Text: str, Language: candidate, Fallback: true}
+		}
+	}
+	langs := ts.languages()
+	if len(langs) == 0 {
+		return Translation{Language: lang}
+	}
+	return Translation{Text: ts[langs[0]], Language: langs[0], Fallback: true}
+}
+
+// languages returns the languages to which the string is translated, in alphabetical order.
+func (ts TranslatedString) languages() []string {
+	langs := make([]string, 0, len(ts))
+	for lang := range ts {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// MissingTranslation is a translation missing from a scheme, as reported by MissingTranslations().
+type MissingTranslation struct {
+	// The part of the scheme missing the translation, e.g. "Credential type irma-demo.RU.studentCard"
+	Object string
+	// The name of the tag missing the translation, e.g. "Name"
+	Field string
+}
+
+func (m MissingTranslation) String() string {
+	return fmt.Sprintf("%s misses translation in <%s> tag", m.Object, m.Field)
+}
+
+// MissingTranslations reports per language which translations are missing from the scheme, its
+// issuers, credential types and attribute types. If no languages are specified, all languages that
+// occur in the scheme are checked. Tags that are not translated to any language (e.g. optional tags
+// that are absent) are not reported.
+func (conf *Configuration) MissingTranslations(id SchemeManagerIdentifier, langs ...string) (map[string][]MissingTranslation, error) {
+	scheme := conf.SchemeManagers[id]
+	if scheme == nil {
+		return nil, errors.Errorf("Unknown scheme %s", id)
+	}
+
+	type translatable struct {
+		object string
+		value  interface{}
+	}
+	objects := []translatable{{fmt.Sprintf("Scheme %s", id), scheme}}
+	for _, msg := range scheme.ErrorMessages {
+		objects = append(objects, translatable{fmt.Sprintf("Error message %s of scheme %s", msg.Key, id), msg})
+	}
+	for _, issuer := range conf.Issuers {
+		if issuer.SchemeManagerIdentifier() == id {
+			objects = append(objects, translatable{fmt.Sprintf("Issuer %s", issuer.Identifier()), issuer})
+		}
+	}
+	for _, credtype := range conf.CredentialTypes {
+		if credtype.SchemeManagerIdentifier() != id {
+			continue
+		}
+		objects = append(objects, translatable{fmt.Sprintf("Credential type %s", credtype.Identifier()), credtype})
+		for _, attr := range credtype.AttributeTypes {
+			objects = append(objects, translatable{
+				fmt.Sprintf("Attribute %s of credential type %s", attr.ID, credtype.Identifier()), attr,
+			})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].object < objects[j].object })
+
+	check := langs
+	if len(check) == 0 {
+		all := map[string]struct{}{}
+		for _, o := range objects {
+			for _, field := range translatedFields(o.value) {
+				for lang := range field.value {
+					all[lang] = struct{}{}
+				}
+			}
+		}
+		for lang := range all {
+			check = append(check, lang)
+		}
+	}
+
+	missing := make(map[string][]MissingTranslation, len(check))
+	for _, lang := range check {
+		missing[lang] = []MissingTranslation{}
+	}
+	for _, o := range objects {
+		for _, field := range translatedFields(o.value) {
+			if len(field.value) == 0 {
+				continue
+			}
+			for _, lang := range check {
+				if _, exists := field.value[lang]; !exists {
+					missing[lang] = append(missing[lang], MissingTranslation{Object: o.object, Field: field.name})
+				}
+			}
+		}
+	}
+	return missing, nil
+}
+
+type translatedField struct {
+	name  string
+	value TranslatedString
+}
+
+// translatedFields returns the fields of type TranslatedString of the struct o (or pointer to it).
+func translatedFields(o interface{}) []translatedField {
+	v := reflect.ValueOf(o)
+
+	// Dereference in case of pointer or interface
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	var fields []translatedField
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Type() == reflect.TypeOf(TranslatedString{}) {
+			fields = append(fields, translatedField{
+				name:  v.Type().Field(i).Name,
+				value: v.Field(i).Interface().(TranslatedString),
+			})
+		}
+	}
+	return fields
+}
@@ -2,15 +2,20 @@ package irma
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -23,9 +28,28 @@ import (
 
 // HTTPTransport sends and receives JSON messages to a HTTP server.
 type HTTPTransport struct {
-	Server  string
-	client  *retryablehttp.Client
-	headers map[string]string
+	Server   string
+	client   *retryablehttp.Client
+	headers  map[string]string
+	observer func(*TransportEvent)
+}
+
+// TransportEvent describes a request made by a HTTPTransport, for debugging purposes.
+// Apart from error messages returned by the server, it does not contain the contents of
+// the request or the response.
+type TransportEvent struct {
+	Time           time.Time     `json:"time"`
+	Method         string        `json:"method"`
+	Host           string        `json:"host"`
+	Endpoint       string        `json:"endpoint"`
+	MessageType    string        `json:"messageType,omitempty"`
+	RequestSize    int           `json:"requestSize"`
+	ResponseType   string        `json:"responseType,omitempty"`
+	ResponseSize   int           `json:"responseSize"`
+	Status         int           `json:"status,omitempty"`
+	Duration       time.Duration `json:"duration"`
+	Error          *RemoteError  `json:"error,omitempty"`
+	TransportError string        `json:"transportError,omitempty"`
 }
 
 // Logger is used for logging. If not set, init() will initialize it to logrus.StandardLogger().
@@ -39,6 +63,73 @@ func init() {
 	}
 }
 
+var (
+	httpTransport     *http.Transport
+	httpTransportOnce sync.Once
+)
+
+// sharedTransport returns the http.Transport used by all HTTPTransports, so that connections
+// (and TLS sessions) to a server are reused across requests, also when made by different
+// HTTPTransport instances, e.g. in the consecutive keyshare requests of a session.
+// Connections to servers supporting it use HTTP/2.
+func sharedTransport() *http.Transport {
+	httpTransportOnce.Do(func() {
+		httpTransport = newTransport()
+	})
+	return httpTransport
+}
+
+// newTransport returns a new http.Transport, which does not share connections with other ones.
+// As it does not cache TLS sessions, new connections do not resume earlier TLS sessions.
+func newTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		// Dial with a SIGPIPE handler (which is only active on iOS)
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return c, err
+			}
+			if err = disable_sigpipe.DisableSigPipe(c); err != nil {
+				return c, err
+			}
+			return c, nil
+		},
+		// Using a custom dialer disables HTTP/2 unless explicitly enabled
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+}
+
+// CloseIdleConnections closes the connections kept open for reuse by HTTPTransports,
+// e.g. when the app is moved to the background.
+func CloseIdleConnections() {
+	sharedTransport().CloseIdleConnections()
+}
+
+// ConnectionPool holds the connections of the HTTPTransports using it (see SetConnectionPool()),
+// instead of the connections shared by all other HTTPTransports. As connections and TLS sessions
+// are not shared across pools, servers cannot link the requests made through different pools by
+// the connections over which they are made.
+type ConnectionPool struct {
+	transport *http.Transport
+}
+
+// NewConnectionPool returns a new ConnectionPool without any connections.
+func NewConnectionPool() *ConnectionPool {
+	return &ConnectionPool{transport: newTransport()}
+}
+
+// Close closes the idle connections of the pool. Connections that are still in use are closed
+// when they have been idle for 90 seconds.
+func (pool *ConnectionPool) Close() {
+	pool.transport.CloseIdleConnections()
+}
+
 // NewHTTPTransport returns a new HTTPTransport.
 func NewHTTPTransport(serverURL string) *HTTPTransport {
 	if Logger.IsLevelEnabled(logrus.TraceLevel) {
@@ -52,20 +143,6 @@ func NewHTTPTransport(serverURL string) *HTTPTransport {
 		url += "/"
 	}
 
-	// Create a transport that dials with a SIGPIPE handler (which is only active on iOS)
-	var innerTransport http.Transport
-
-	innerTransport.Dial = func(network, addr string) (c net.Conn, err error) {
-		c, err = net.Dial(network, addr)
-		if err != nil {
-			return c, err
-		}
-		if err = disable_sigpipe.DisableSigPipe(c); err != nil {
-			return c, err
-		}
-		return c, nil
-	}
-
 	client := retryablehttp.NewClient()
 	client.RetryMax = 3
 	client.RetryWaitMin = 100 * time.Millisecond
@@ -73,7 +150,7 @@ func NewHTTPTransport(serverURL string) *HTTPTransport {
 	client.Logger = transportlogger
 	client.HTTPClient = &http.Client{
 		Timeout:   time.Second * 5,
-		Transport: &innerTransport,
+		Transport: sharedTransport(),
 	}
 
 	return &HTTPTransport{
@@ -88,6 +165,65 @@ func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers[name] = val
 }
 
+// SetConnectionPool makes the transport use the connections of the pool.
+func (transport *HTTPTransport) SetConnectionPool(pool *ConnectionPool) {
+	transport.client.HTTPClient.Transport = pool.transport
+}
+
+// SetObserver sets a function that is called with a TransportEvent after each JSON request.
+func (transport *HTTPTransport) SetObserver(observer func(*TransportEvent)) {
+	transport.observer = observer
+}
+
+// observe reports a request to the observer, if any.
+func (transport *HTTPTransport) observe(
+	start time.Time, url, method string, result, object interface{}, reqsize int, res *http.Response, body []byte, err error,
+) {
+	if transport.observer == nil {
+		return
+	}
+	event := &TransportEvent{
+		Time:         start,
+		Method:       method,
+		Endpoint:     url,
+		RequestSize:  reqsize,
+		ResponseSize: len(body),
+		Duration:     time.Since(start),
+	}
+	if u, e := neturl.Parse(transport.Server); e == nil {
+		event.Host = u.Host
+	}
+	if object != nil {
+		event.MessageType = fmt.Sprintf("%T", object)
+	}
+	if result != nil {
+		event.ResponseType = fmt.Sprintf("%T", result)
+	}
+	if res != nil {
+		event.Status = res.StatusCode
+	}
+	if serr, ok := err.(*SessionError); ok && serr.RemoteError != nil {
+		event.Error = serr.RemoteError
+	} else if err != nil {
+		event.TransportError = stripURLs(err.Error())
+	}
+	transport.observer(event)
+}
+
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"']+`)
+
+// stripURLs removes the path and query from all URLs in the specified error message,
+// as these may contain session tokens.
+func stripURLs(msg string) string {
+	return urlPattern.ReplaceAllStringFunc(msg, func(match string) string {
+		u, err := neturl.Parse(match)
+		if err != nil || u.Host == "" {
+			return "<url>"
+		}
+		return u.Scheme + "://" + u.Host
+	})
+}
+
 func (transport *HTTPTransport) request(
 	url string, method string, reader io.Reader, isstr bool,
 ) (response *http.Response, err error) {
@@ -116,7 +252,7 @@ func (transport *HTTPTransport) request(
 	return res, nil
 }
 
-func (transport *HTTPTransport) jsonRequest(url string, method string, result interface{}, object interface{}) error {
+func (transport *HTTPTransport) jsonRequest(url string, method string, result interface{}, object interface{}) (err error) {
 	if method != http.MethodPost && method != http.MethodGet && method != http.MethodDelete {
 		panic("Unsupported HTTP method " + method)
 	}
@@ -126,10 +262,12 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 
 	var isstr bool
 	var reader io.Reader
+	var reqsize int
 	if object != nil {
 		var objstr string
 		if objstr, isstr = object.(string); isstr {
 			reader = bytes.NewBuffer([]byte(objstr))
+			reqsize = len(objstr)
 		} else {
 			marshaled, err := json.Marshal(object)
 			if err != nil {
@@ -137,20 +275,29 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 			}
 			Logger.Debugf("%s %s: %s\n", method, url, string(marshaled))
 			reader = bytes.NewBuffer(marshaled)
+			reqsize = len(marshaled)
 		}
 	} else {
 		Logger.Debugf("%s %s\n", method, url)
 	}
 
-	res, err := transport.request(url, method, reader, isstr)
+	var res *http.Response
+	var body []byte
+	start := time.Now()
+	defer func() {
+		transport.observe(start, url, method, result, object, reqsize, res, body, err)
+	}()
+
+	res, err = transport.request(url, method, reader, isstr)
 	if err != nil {
 		return err
 	}
+	defer closeBody(res)
 	if method == http.MethodDelete {
 		return nil
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err = ioutil.ReadAll(res.Body)
 	if err != nil {
 		return &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
 	}
@@ -182,6 +329,7 @@ func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	defer closeBody(res)
 
 	if res.StatusCode != 200 {
 		return nil, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
@@ -193,6 +341,13 @@ func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
 	return b, nil
 }
 
+// closeBody reads the remainder of the response body and closes it, so that the connection
+// can be reused.
+func closeBody(res *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	_ = res.Body.Close()
+}
+
 func (transport *HTTPTransport) GetSignedFile(url string, dest string, hash ConfigurationFileHash) error {
 	b, err := transport.GetBytes(url)
 	if err != nil {
@@ -226,3 +381,39 @@ func (transport *HTTPTransport) Get(url string, result interface{}) error {
 func (transport *HTTPTransport) Delete() {
 	_ = transport.jsonRequest("", http.MethodDelete, nil, nil)
 }
+
+// InsecureURLError is returned when a URL of a scheme, keyshare server or session does not use HTTPS,
+// while its host is not a loopback host and is not listed among the InsecureHosts of the relevant schemes.
+type InsecureURLError struct {
+	URL string
+}
+
+func (e *InsecureURLError) Error() string {
+	return "URL does not use HTTPS: " + e.URL
+}
+
+// checkURL checks that the URL uses HTTPS, or HTTP if its host is a loopback host or
+// listed among the InsecureHosts of one of the specified schemes.
+func checkURL(url string, managers ...*SchemeManager) error {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+		for _, manager := range managers {
+			for _, insecure := range manager.InsecureHosts {
+				if strings.EqualFold(insecure, host) {
+					return nil
+				}
+			}
+		}
+	}
+	return &InsecureURLError{URL: url}
+}
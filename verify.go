@@ -2,6 +2,10 @@ package irma
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	gobig "math/big"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -23,6 +27,8 @@ const (
 	ProofStatusUnmatchedRequest  = ProofStatus("UNMATCHED_REQUEST")  // Proof does not correspond to a specified request
 	ProofStatusMissingAttributes = ProofStatus("MISSING_ATTRIBUTES") // Proof does not contain all requested attributes
 	ProofStatusExpired           = ProofStatus("EXPIRED")            // Attributes were expired at proof creation time (now, or according to timestamp in case of abs)
+	ProofStatusOutsideWindow     = ProofStatus("OUTSIDE_WINDOW")     // Disclosure token was verified outside of its validity window
+	ProofStatusReplayed          = ProofStatus("REPLAYED")           // Proof was valid, but its nonce was already used (see NonceStore)
 
 	AttributeProofStatusPresent      = AttributeProofStatus("PRESENT")       // Attribute is disclosed and matches the value
 	AttributeProofStatusExtra        = AttributeProofStatus("EXTRA")         // Attribute is disclosed, but wasn't requested in request
@@ -94,10 +100,90 @@ func (pl ProofList) VerifyProofs(configuration *Configuration, context *big.Int,
 		}
 	}
 
+	if pool := configuration.ProofVerificationPool; pool != nil && len(pl) > 1 {
+		return pool.verify(pl, publickeys, context, nonce, isSig, keyshareServers), nil
+	}
 	return gabi.ProofList(pl).Verify(publickeys, context, nonce, isSig, keyshareServers), nil
 }
 
-// Expired returns true if any of the contained disclosure proofs is specified at the specified time,
+// ProofVerificationPool is a fixed amount of workers across which the proofs of proof lists containing
+// more than one proof are verified in parallel. The workers are shared by all proof lists being verified
+// at the same time. VerifyProofs uses the ProofVerificationPool of the Configuration, if set.
+type ProofVerificationPool struct {
+	workers chan struct{}
+}
+
+// NewProofVerificationPool returns a ProofVerificationPool having the specified amount of workers.
+func NewProofVerificationPool(workers int) *ProofVerificationPool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &ProofVerificationPool{workers: make(chan struct{}, workers)}
+}
+
+// verify verifies the proofs like gabi.ProofList.Verify, except that the challenge contributions
+// of the proofs, which consist of the expensive modular exponentiations, are computed in parallel
+// by the workers of the pool.
+func (pool *ProofVerificationPool) verify(pl ProofList, publickeys []*gabi.PublicKey, context, nonce *big.Int, issig bool, keyshareServers []string) bool {
+	if len(pl) != len(publickeys) || len(pl) != len(keyshareServers) {
+		return false
+	}
+
+	contributions := make([][]*big.Int, len(pl))
+	var wg sync.WaitGroup
+	wg.Add(len(pl))
+	for i, proof := range pl {
+		go func(i int, proof gabi.Proof) {
+			defer wg.Done()
+			pool.workers <- struct{}{}
+			defer func() { <-pool.workers }()
+			contributions[i] = proof.ChallengeContribution(publickeys[i])
+		}(i, proof)
+	}
+	wg.Wait()
+
+	// Compute the challenge as gabi does: the hash of the ASN.1 encoding of the contributions
+	// sandwiched between the context and nonce, preceded by their amount
+	values := []interface{}{}
+	if issig {
+		values = append(values, true)
+	}
+	count := 2
+	for _, c := range contributions {
+		count += len(c)
+	}
+	values = append(values, gobig.NewInt(int64(count)), context.Value())
+	for _, c := range contributions {
+		for _, v := range c {
+			values = append(values, v.Value())
+		}
+	}
+	values = append(values, nonce.Value())
+	bts, err := asn1.Marshal(values)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(bts)
+	challenge := new(big.Int).SetBytes(hash[:])
+
+	// Check the responses and challenges, and that proofs sharing a keyshare server (or none)
+	// have the same secret key response
+	secretkeyResponses := make(map[string]*big.Int)
+	for i, proof := range pl {
+		if !proof.VerifyWithChallenge(publickeys[i], challenge) {
+			return false
+		}
+		response, contains := secretkeyResponses[keyshareServers[i]]
+		if !contains {
+			secretkeyResponses[keyshareServers[i]] = proof.SecretKeyResponse()
+		} else if response.Cmp(proof.SecretKeyResponse()) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Expired returns true if any of the contained disclosure proofs is expired at the specified time,
 // or now, when the specified time is nil.
 func (pl ProofList) Expired(configuration *Configuration, t *time.Time) bool {
 	if t == nil {
@@ -133,16 +219,11 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 	// For each of the disjunctions, lookup the attribute that the user sent to satisfy this disjunction,
 	// using the indices specified by the user in d.Indices. Then see if the attribute satisfies the disjunction.
 	for i, disjunction := range disjunctions {
-		index := d.Indices[i][0]
-		proofd, ok := d.Proofs[index.CredentialIndex].(*gabi.ProofD)
-		if !ok {
-			// If with the index the user told us to look for the required attribute at this specific location,
-			// and the proof here is not a disclosure proof, then reject
-			return false, nil, errors.New("ProofList contained proof of invalid type")
+		if i >= len(d.Indices) || len(d.Indices[i]) == 0 {
+			return false, nil, errors.New("Disclosure contains no attribute index for disjunction")
 		}
-
-		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration) // index 1 is metadata attribute
-		attr, attrval, err := parseAttribute(index.AttributeIndex, metadata, proofd.ADisclosed[index.AttributeIndex])
+		index := d.Indices[i][0]
+		attr, attrval, err := d.resolveIndex(configuration, index)
 		if err != nil {
 			return false, nil, err
 		}
@@ -190,6 +271,78 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 	return len(disjunctions) == 0 || disjunctions.satisfied(), list, nil
 }
 
+// resolveIndex returns the attribute to which the index points in the proofs of the disclosure,
+// returning an error if it does not point to a disclosed attribute.
+func (d *Disclosure) resolveIndex(configuration *Configuration, index *DisclosedAttributeIndex) (*DisclosedAttribute, *string, error) {
+	if index == nil || index.CredentialIndex < 0 || index.CredentialIndex >= len(d.Proofs) {
+		return nil, nil, errors.New("Attribute index points to nonexisting proof")
+	}
+	proofd, ok := d.Proofs[index.CredentialIndex].(*gabi.ProofD)
+	if !ok {
+		// If with the index the user told us to look for the required attribute at this specific location,
+		// and the proof here is not a disclosure proof, then reject
+		return nil, nil, errors.New("ProofList contained proof of invalid type")
+	}
+
+	metadataInt, metadataDisclosed := proofd.ADisclosed[1] // index 1 is metadata attribute
+	attrInt, attrDisclosed := proofd.ADisclosed[index.AttributeIndex]
+	if !metadataDisclosed || !attrDisclosed || index.AttributeIndex < 1 {
+		return nil, nil, errors.New("Attribute index points to undisclosed attribute")
+	}
+	metadata := MetadataFromInt(metadataInt, configuration)
+	if credtype := metadata.CredentialType(); credtype != nil && index.AttributeIndex-2 >= len(credtype.AttributeTypes) {
+		return nil, nil, errors.New("Attribute index points to nonexisting attribute")
+	}
+	return parseAttribute(index.AttributeIndex, metadata, attrInt)
+}
+
+// ResolveIndices returns, for each disjunction of the request, the attribute that was disclosed
+// to satisfy it, as pointed to by the indices of the disclosure. It checks that the indices point
+// to disclosed attributes asked for by the corresponding disjunctions, returning an error if not;
+// the status of the returned attributes is AttributeProofStatusInvalidValue if the disjunction
+// requires another value. Verifiers can use this to relate disclosed attributes to the request
+// without re-deriving the indices themselves. The proofs themselves are not verified: use
+// Verify() (or VerifyAgainstDisjunctions()) for that.
+func (d *Disclosure) ResolveIndices(configuration *Configuration, request SessionRequest) ([]*DisclosedAttribute, error) {
+	disjunctions := request.ToDisclose()
+	if len(d.Indices) != len(disjunctions) {
+		return nil, errors.Errorf("Disclosure contains %d attribute indices for %d disjunctions",
+			len(d.Indices), len(disjunctions))
+	}
+
+	list := make([]*DisclosedAttribute, len(disjunctions))
+	for i, disjunction := range disjunctions {
+		if len(d.Indices[i]) != 1 {
+			return nil, errors.Errorf("Disclosure contains %d attribute indices for disjunction %d",
+				len(d.Indices[i]), i)
+		}
+		attr, value, err := d.resolveIndex(configuration, d.Indices[i][0])
+		if err != nil {
+			return nil, err
+		}
+
+		var requested bool
+		for _, id := range disjunction.Attributes {
+			if id == attr.Identifier {
+				requested = true
+				break
+			}
+		}
+		if !requested {
+			return nil, errors.Errorf("Attribute %s was not requested in disjunction %d", attr.Identifier, i)
+		}
+
+		attr.Status = AttributeProofStatusPresent
+		if required := disjunction.Values[attr.Identifier]; disjunction.HasValues() && required != nil &&
+			(value == nil || *value != *required) {
+			attr.Status = AttributeProofStatusInvalidValue
+		}
+		list[i] = attr
+	}
+
+	return list, nil
+}
+
 func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*DisclosedAttribute, *string, error) {
 	var attrid AttributeTypeIdentifier
 	var attrval *string
@@ -304,19 +457,67 @@ func (d *Disclosure) VerifyAgainstDisjunctions(
 }
 
 func (d *Disclosure) Verify(configuration *Configuration, request *DisclosureRequest) ([]*DisclosedAttribute, ProofStatus, error) {
-	list, status, err := d.VerifyAgainstDisjunctions(configuration, request.Content, request.Context, request.Nonce, nil, false)
+	return d.VerifyAt(configuration, request, nil)
+}
+
+// VerifyAt verifies the disclosure against the request like Verify, except that the validity
+// of the disclosed attributes is evaluated at the specified time instead of now (if t is not nil).
+// This allows verifiers that accept historic proofs, e.g. from a log, to check that the attributes
+// were valid when the proof was created.
+func (d *Disclosure) VerifyAt(configuration *Configuration, request *DisclosureRequest, t *time.Time) ([]*DisclosedAttribute, ProofStatus, error) {
+	list, status, err := d.VerifyAgainstDisjunctions(configuration, request.Content, request.Context, request.GetNonce(), nil, false)
 	if err != nil {
 		return list, status, err
 	}
 
-	now := time.Now()
-	if expired := ProofList(d.Proofs).Expired(configuration, &now); expired {
+	if expired := ProofList(d.Proofs).Expired(configuration, t); expired {
 		return list, ProofStatusExpired, nil
 	}
 
 	return list, status, nil
 }
 
+// Verify verifies the disclosure in the transcript as its recipient, i.e. the recipient whose name
+// is t.Recipient, which must have contributed the specified nonce to the session.
+func (t *DisclosureTranscript) Verify(configuration *Configuration, nonce *big.Int) ([]*DisclosedAttribute, ProofStatus, error) {
+	var found bool
+	for _, recipient := range t.Recipients {
+		if recipient.Name == t.Recipient && recipient.Nonce != nil && recipient.Nonce.Cmp(nonce) == 0 {
+			found = true
+			break
+		}
+	}
+	if !found || t.Nonce == nil || t.Disclosure == nil {
+		return nil, ProofStatusUnmatchedRequest, nil
+	}
+	request := &DisclosureRequest{
+		BaseRequest: BaseRequest{Type: ActionDisclosing, Context: t.Context, Nonce: t.Nonce},
+		Recipients:  t.Recipients,
+	}
+	return t.Disclosure.Verify(configuration, request)
+}
+
+// Verify verifies the disclosure token against the request from which the verifier created it,
+// checking that the current time lies within the validity window of the request.
+//
+// Verify does not protect against replay: within its window, a token verifies any number of times.
+// Verifiers should therefore use a fresh random nonce for each token request, and verify tokens
+// using VerifyOnce, which rejects tokens whose nonce it has seen before.
+func (token *DisclosureToken) Verify(configuration *Configuration, request *DisclosureRequest) ([]*DisclosedAttribute, ProofStatus, error) {
+	if token.Disclosure == nil || token.Window == nil || request.Window == nil ||
+		token.Nonce == nil || request.Nonce == nil || token.Nonce.Cmp(request.Nonce) != 0 ||
+		token.Context == nil || request.Context == nil || token.Context.Cmp(request.Context) != 0 ||
+		time.Time(token.Window.NotBefore).Unix() != time.Time(request.Window.NotBefore).Unix() ||
+		time.Time(token.Window.NotAfter).Unix() != time.Time(request.Window.NotAfter).Unix() {
+		return nil, ProofStatusUnmatchedRequest, nil
+	}
+	now := time.Now()
+	if now.Before(time.Time(request.Window.NotBefore)) || now.After(time.Time(request.Window.NotAfter)) {
+		return nil, ProofStatusOutsideWindow, nil
+	}
+	return token.Disclosure.Verify(configuration, request)
+}
+
 // Verify the attribute-based signature, optionally against a corresponding signature request. If the request is present
 // (i.e. not nil), then the first attributes in the returned result match with the disjunction list in the request
 // (that is, the i'th attribute in the result should satisfy the i'th disjunction in the request). If the request is not
@@ -327,8 +528,22 @@ func (d *Disclosure) Verify(configuration *Configuration, request *DisclosureReq
 // The signature request is optional; if it is nil then the attribute-based signature is still verified, and all
 // containing attributes returned in the result.
 func (sm *SignedMessage) Verify(configuration *Configuration, request *SignatureRequest) ([]*DisclosedAttribute, ProofStatus, error) {
+	return sm.VerifyAt(configuration, request, nil)
+}
+
+// VerifyAt verifies the attribute-based signature like Verify, except that the validity of the
+// contained attributes is evaluated at the specified time, if t is not nil. Otherwise, the signing time
+// according to the timestamp is used, or now if the signature has no timestamp. Specifying t is useful
+// for signatures without timestamp whose signing time is known by other means.
+func (sm *SignedMessage) VerifyAt(configuration *Configuration, request *SignatureRequest, t *time.Time) ([]*DisclosedAttribute, ProofStatus, error) {
 	var message string
 
+	// A signature is over either a message or a file, never both: the message would be shown
+	// to the verifier while not being signed
+	if sm.File != nil && sm.Message != "" {
+		return nil, ProofStatusInvalid, nil
+	}
+
 	// First check if this signature matches the request
 	if request != nil {
 		request.Timestamp = sm.Timestamp
@@ -336,10 +551,10 @@ func (sm *SignedMessage) Verify(configuration *Configuration, request *Signature
 			return nil, ProofStatusUnmatchedRequest, nil
 		}
 		// If there is a request, then the signed message must be that of the request
-		message = request.Message
+		message = request.SignedMessage()
 	} else {
 		// If not, we just verify that the signed message is a valid signature over its contained message
-		message = sm.Message
+		message = signedMessage(sm.Message, sm.File)
 	}
 
 	// Now, cryptographically verify the IRMA disclosure proofs in the signature
@@ -353,16 +568,18 @@ func (sm *SignedMessage) Verify(configuration *Configuration, request *Signature
 	}
 
 	// Next, verify the timestamp
-	t := time.Now()
 	if sm.Timestamp != nil {
 		if err := sm.VerifyTimestamp(message, configuration); err != nil {
 			return nil, ProofStatusInvalidTimestamp, nil
 		}
-		t = time.Unix(sm.Timestamp.Time, 0)
+		if t == nil {
+			signed := time.Unix(sm.Timestamp.Time, 0)
+			t = &signed
+		}
 	}
 
 	// Check if a credential was expired at creation time, according to the timestamp
-	if expired := ProofList(sm.Signature).Expired(configuration, &t); expired {
+	if expired := ProofList(sm.Signature).Expired(configuration, t); expired {
 		return result, ProofStatusExpired, nil
 	}
 